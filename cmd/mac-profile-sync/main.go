@@ -1,16 +1,26 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/jseidel/mac-profile-sync/internal/config"
 	"github.com/jseidel/mac-profile-sync/internal/discovery"
+	"github.com/jseidel/mac-profile-sync/internal/logging"
 	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/jseidel/mac-profile-sync/internal/share"
 	"github.com/jseidel/mac-profile-sync/internal/sync"
 	"github.com/jseidel/mac-profile-sync/internal/tui"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
@@ -65,6 +75,7 @@ interactive configuration and control.`,
 		Args:  cobra.ExactArgs(1),
 		RunE:  runAdd,
 	}
+	addCmd.Flags().String("name", "", "Name peers match the folder by, instead of its base name")
 
 	// Remove folder command
 	removeCmd := &cobra.Command{
@@ -74,12 +85,294 @@ interactive configuration and control.`,
 		RunE:  runRemove,
 	}
 
+	// Sparse subfolder selection command
+	subfoldersCmd := &cobra.Command{
+		Use:   "subfolders [folder] [subfolder...]",
+		Short: "Show or choose which subfolders of a folder to sync",
+		Args:  cobra.MinimumNArgs(1),
+		RunE:  runSubfolders,
+	}
+	subfoldersCmd.Flags().Bool("all", false, "Sync all subfolders (clear the selection and exclusions)")
+	subfoldersCmd.Flags().Bool("except", false, "Sync everything except the given subfolders")
+
+	// Browse and fetch what peers have outside a sparse selection
+	browseCmd := &cobra.Command{
+		Use:   "browse [folder] [subfolder]",
+		Short: "List files peers have in subfolders of a folder that aren't synced",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE:  runBrowse,
+	}
+	fetchCmd := &cobra.Command{
+		Use:   "fetch [folder] [path...]",
+		Short: "Fetch files or subfolders that aren't synced from a peer, once",
+		Args:  cobra.MinimumNArgs(2),
+		RunE:  runFetch,
+	}
+
+	// Per-folder ignore rules command
+	ignoreCmd := &cobra.Command{
+		Use:   "ignore [folder] [pattern...]",
+		Short: "Show or add ignore rules for a folder, shared with peers or local to this Mac",
+		Args:  cobra.MinimumNArgs(1),
+		RunE:  runIgnore,
+	}
+	ignoreCmd.Flags().Bool("local", false, "Ignore the patterns on this Mac only")
+	ignoreCmd.Flags().String("share", "", "Honor the folder's synced .mpsignore file: on or off")
+	ignoreCmd.Flags().String("private", "", "Keep the folder's .mpsignore file on this Mac instead of syncing it: on or off")
+	ignoreCmd.Flags().String("finder-views", "", "Sync Finder's .DS_Store files so icon positions and views match: on or off")
+	ignoreCmd.Flags().Bool("cleanup", false, "Stop tracking synced files the rules now ignore")
+	ignoreCmd.Flags().Bool("delete", false, "With --cleanup, also delete peers' synced copies")
+	ignoreCmd.Flags().BoolP("yes", "y", false, "With --cleanup, don't ask for confirmation")
+
+	// Post-restore reconciliation command
+	reconcileCmd := &cobra.Command{
+		Use:   "reconcile [folder]",
+		Short: "Review folders held after a restore or before their first sync, and choose which side wins",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  runReconcile,
+	}
+	reconcileCmd.Flags().String("keep", "", "Authoritative side for the folder: local or remote")
+	reconcileCmd.Flags().Bool("confirm", false, "Start the folder's first sync with the suggested strategy")
+	reconcileCmd.Flags().BoolP("yes", "y", false, "Don't ask before confirming (with --confirm)")
+
+	// Files kept out of syncing for a while
+	excludeCmd := &cobra.Command{
+		Use:   "exclude [path]",
+		Short: "Stop syncing a file or directory for a while, or list paths excluded that way",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  runExclude,
+	}
+	excludeCmd.Flags().Duration("for", sync.DefaultExclusionTTL, "How long to exclude the path")
+
+	includeCmd := &cobra.Command{
+		Use:   "include <path>",
+		Short: "Sync a path excluded with 'exclude' again before its time is up",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runInclude,
+	}
+
+	// Mass deletions held until approved
+	deletesCmd := &cobra.Command{
+		Use:   "deletes [folder]",
+		Short: "Review mass deletions held back from peers, and send or restore them",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  runDeletes,
+	}
+	deletesCmd.Flags().Bool("approve", false, "Tell peers to delete the folder's held deletions too")
+	deletesCmd.Flags().Bool("restore", false, "Fetch the folder's deleted files back from peers")
+	deletesCmd.Flags().BoolP("yes", "y", false, "Don't ask before approving")
+	deletesCmd.Flags().Bool("all", false, "List every held path")
+
+	// Changes waiting for peers that are away
+	pendingCmd := &cobra.Command{
+		Use:   "pending [folder]",
+		Short: "List changes made here that peers that are away get when they reconnect",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  runPending,
+	}
+
+	// Manual approval commands
+	approvalCmd := &cobra.Command{
+		Use:   "approval [folder] [auto|manual]",
+		Short: "Show or set whether peer changes to a folder need approval",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE:  runApproval,
+	}
+
+	priorityCmd := &cobra.Command{
+		Use:   "priority [folder] [high|normal|low]",
+		Short: "Show or set a folder's transfer priority",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE:  runPriority,
+	}
+
+	throttleCmd := &cobra.Command{
+		Use:   "throttle [folder]",
+		Short: "Show or set how fast received files are written to a folder",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runThrottle,
+	}
+	throttleCmd.Flags().Int("concurrency", 0, "Max received files written at once (0 = no limit)")
+	throttleCmd.Flags().Int("rate", 0, "Max received files written per second (0 = no limit)")
+
+	watchCmd := &cobra.Command{
+		Use:   "watch [folder] [auto|fsevents|poll|portable]",
+		Short: "Show or set how a folder's changes are noticed",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE:  runWatch,
+	}
+
+	nameCmd := &cobra.Command{
+		Use:   "name [folder] [name]",
+		Short: "Show or set the name peers match a folder by",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE:  runName,
+	}
+
+	detectCmd := &cobra.Command{
+		Use:   "detect [folder] [hash|size_mtime|hybrid]",
+		Short: "Show or set how a folder tells whether a file changed",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE:  runDetect,
+	}
+
+	limitsCmd := &cobra.Command{
+		Use:   "limits [device]",
+		Short: "Show or set per-peer transfer and bandwidth limits",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  runLimits,
+	}
+	limitsCmd.Flags().Int("transfers", 0, "Max concurrent transfers with this peer (0 = sync.max_concurrent_transfers)")
+	limitsCmd.Flags().Int("up", 0, "Max upload to this peer in kbps (0 = no per-peer cap)")
+	limitsCmd.Flags().Int("down", 0, "Max download from this peer in kbps (0 = no per-peer cap)")
+
+	// Pausing without stopping the daemon
+	pauseCmd := &cobra.Command{
+		Use:   "pause [folder]",
+		Short: "Pause all syncing, or one folder, without disconnecting from peers",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  runPause,
+	}
+
+	resumeCmd := &cobra.Command{
+		Use:   "resume [folder]",
+		Short: "Resume syncing paused with 'pause'",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  runResume,
+	}
+
+	// Backup coordination for pre/post-backup hooks
+	backupLockCmd := &cobra.Command{
+		Use:   "backup-lock [acquire|release]",
+		Short: "Show, acquire, or release the lock that pauses incoming changes during a backup",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  runBackupLock,
+	}
+	backupLockCmd.Flags().String("holder", "backup", "Name of the tool holding the lock")
+	backupLockCmd.Flags().Duration("ttl", sync.DefaultBackupLockTTL, "Ignore the lock after this long, in case it is never released")
+
+	// Temporary download links for devices that don't run the tool
+	shareCmd := &cobra.Command{
+		Use:   "share [file]",
+		Short: "Create a temporary HTTPS link to a file in a synced folder, or list links",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  runShare,
+	}
+	shareCmd.Flags().Duration("expires", share.DefaultExpiry, "How long the link works")
+	shareCmd.Flags().Int("downloads", share.DefaultDownloads, "How many times the file can be downloaded (0 = until it expires)")
+	shareCmd.Flags().String("revoke", "", "Revoke the link with this token")
+
+	// Read-only browsing of whole folders
+	exportCmd := &cobra.Command{
+		Use:   "export [folder] [off|local|lan]",
+		Short: "Show or set whether a folder can be browsed read-only in a web browser",
+		Args:  cobra.MaximumNArgs(2),
+		RunE:  runExport,
+	}
+	exportCmd.Flags().Bool("reset-password", false, "Replace the password for exported folders")
+
+	// Trace why a file is or isn't syncing
+	explainCmd := &cobra.Command{
+		Use:   "explain <path>",
+		Short: "Explain why a file is or isn't syncing",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runExplain,
+	}
+
+	// Compare a synced folder with another directory
+	compareCmd := &cobra.Command{
+		Use:   "compare <synced-folder> <other-dir>",
+		Short: "Show how a synced folder differs from another directory, like an old backup",
+		Args:  cobra.ExactArgs(2),
+		RunE:  runCompare,
+	}
+
+	// Dry run of a sync with the peers
+	previewCmd := &cobra.Command{
+		Use:   "preview [folder]",
+		Short: "Exchange file lists with peers and show what a sync would send, receive, delete, or conflict on, without changing anything",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  runPreview,
+	}
+	previewCmd.Flags().Duration("timeout", 30*time.Second, "Give up waiting for peers' file lists after this long")
+
+	// Folder snapshot commands
+	snapshotsCmd := &cobra.Command{
+		Use:   "snapshots [list|create|restore] [folder|id]",
+		Short: "List, take, or restore folder snapshots taken before large batches of peer changes",
+		Args:  cobra.MaximumNArgs(2),
+		RunE:  runSnapshots,
+	}
+
+	// Previous file version commands
+	versionsCmd := &cobra.Command{
+		Use:   "versions [list|restore] <path> [version]",
+		Short: "List or restore previous versions of files kept when peers' copies replaced them",
+		Args:  cobra.MaximumNArgs(3),
+		RunE:  runVersions,
+	}
+
+	approveCmd := &cobra.Command{
+		Use:   "approve [folder] [file...]",
+		Short: "List or approve peer changes staged for folders that need approval",
+		Args:  cobra.ArbitraryArgs,
+		RunE:  runApprove,
+	}
+	approveCmd.Flags().Bool("all", false, "Approve every staged change (in the given folder, if any)")
+	approveCmd.Flags().String("resolution", "", "Resolution for approved conflicts: keep_local, keep_remote, or keep_both")
+
+	// Change plan commands
+	planCmd := &cobra.Command{
+		Use:   "plan",
+		Short: "Print the changes syncing would make to this Mac as a JSON plan",
+		Args:  cobra.NoArgs,
+		RunE:  runPlan,
+	}
+	planCmd.Flags().StringP("output", "o", "", "Write the plan to a file instead of stdout")
+	planCmd.Flags().Duration("timeout", 30*time.Second, "Give up waiting for peers' file lists after this long (daemon stopped)")
+
+	applyCmd := &cobra.Command{
+		Use:   "apply",
+		Short: "Have the running daemon execute exactly the changes in a plan file",
+		Args:  cobra.NoArgs,
+		RunE:  runApply,
+	}
+	applyCmd.Flags().String("plan", "", "Plan file produced by 'plan'")
+	applyCmd.Flags().Bool("wait", false, "Wait for the daemon to finish, showing progress")
+	applyCmd.Flags().Duration("timeout", 10*time.Minute, "Give up waiting after this long (with --wait)")
+	_ = applyCmd.MarkFlagRequired("plan")
+
 	// List peers command
 	peersCmd := &cobra.Command{
-		Use:   "peers",
-		Short: "List discovered peers",
+		Use:   "peers [forget <name> | rename <name> <nickname>]",
+		Short: "List known peers and search for more, forget a peer, or give one a nickname",
+		Args:  cobra.MaximumNArgs(3),
 		RunE:  runPeers,
 	}
+	peersCmd.Flags().String("icon", "", "Emoji shown before the peer's nickname (with rename)")
+
+	// Relay command for peers that can't reach each other directly
+	relayCmd := &cobra.Command{
+		Use:   "relay",
+		Short: "Run a relay that forwards traffic between peers on different networks",
+		Args:  cobra.NoArgs,
+		RunE:  runRelay,
+	}
+	relayCmd.Flags().String("listen", ":9877", "Address to accept peer registrations on")
+
+	// Debug commands for diagnosing peer connections
+	debugCmd := &cobra.Command{
+		Use:   "debug",
+		Short: "Inspect the running daemon's connections",
+	}
+	debugTraceCmd := &cobra.Command{
+		Use:   "trace <peer>",
+		Short: "Show message counts, sizes and timings for a connected peer, and its recent messages",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runDebugTrace,
+	}
+	debugTraceCmd.Flags().Int("last", 50, "Recent messages to show (0 = all kept)")
+	debugCmd.AddCommand(debugTraceCmd)
 
 	// TUI command for interactive configuration and control
 	tuiCmd := &cobra.Command{
@@ -89,14 +382,33 @@ interactive configuration and control.`,
 	}
 
 	// Add commands
-	rootCmd.AddCommand(versionCmd, statusCmd, addCmd, removeCmd, peersCmd, tuiCmd)
+	rootCmd.AddCommand(versionCmd, statusCmd, addCmd, removeCmd, subfoldersCmd, browseCmd, fetchCmd, ignoreCmd, approvalCmd, approveCmd, priorityCmd, throttleCmd, watchCmd, detectCmd, nameCmd, limitsCmd, pauseCmd, resumeCmd, backupLockCmd, snapshotsCmd, versionsCmd, compareCmd, previewCmd, shareCmd, exportCmd, explainCmd, reconcileCmd, deletesCmd, pendingCmd, excludeCmd, includeCmd, planCmd, applyCmd, peersCmd, relayCmd, debugCmd, tuiCmd)
 
 	// Flags
 	rootCmd.PersistentFlags().BoolP("verbose", "v", false, "Enable verbose logging")
 	rootCmd.PersistentFlags().StringP("config", "c", "", "Config file path")
+	rootCmd.PersistentFlags().BoolP("quiet", "q", false, "Print only the final summary line (no progress output)")
+	rootCmd.Flags().Bool("safe-mode", false, "Observe only: scan and report differences without transferring or deleting anything")
+
+	// Errors are printed below so exit codes stay consistent; usage is only
+	// shown for invalid arguments and flags
+	rootCmd.SilenceErrors = true
+	rootCmd.SilenceUsage = true
+	rootCmd.SetFlagErrorFunc(func(c *cobra.Command, err error) error {
+		_ = c.Usage()
+		return withExitCode(exitUsage, err)
+	})
+	for _, c := range rootCmd.Commands() {
+		if c.Args != nil {
+			c.Args = usageArgs(c.Args)
+		}
+	}
 
 	if err := rootCmd.Execute(); err != nil {
-		os.Exit(1)
+		if msg := err.Error(); msg != "" {
+			fmt.Fprintln(os.Stderr, "Error:", msg)
+		}
+		os.Exit(exitCode(err))
 	}
 }
 
@@ -135,12 +447,51 @@ func runDaemon(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
+	if pid := config.DaemonPID(); pid != 0 && pid != os.Getpid() {
+		return fmt.Errorf("daemon is already running (pid %d)", pid)
+	}
+
+	// Copy lines about one peer or folder into logs of their own
+	if cfg.Logging.SplitByPeer || cfg.Logging.SplitByFolder {
+		splitter := logging.NewSplitter(filepath.Join(config.ConfigDir(), "logs"), cfg.Logging.SplitByPeer, cfg.Logging.SplitByFolder)
+		defer splitter.Close()
+		log.Logger = log.Output(zerolog.MultiLevelWriter(zerolog.ConsoleWriter{Out: os.Stderr}, splitter))
+	}
+
+	// Collapse repeated messages so a flapping peer can't flood the log
+	sampler := logging.NewSampler(cfg.Logging.MaxPerMinute)
+	log.Logger = log.Logger.Hook(sampler)
+	samplerDone := make(chan struct{})
+	sampler.Start(samplerDone)
+	defer close(samplerDone)
+
 	log.Info().Str("device", cfg.Device.Name).Msg("Starting Mac Profile Sync daemon")
 
 	// Create network components
 	server := network.NewServer(cfg.Network.Port, nil)
 	client := network.NewClient(nil)
 
+	queuePolicy := network.ParseQueuePolicy(cfg.Network.SendQueuePolicy)
+	server.SetQueueOptions(cfg.Network.SendQueueSize, queuePolicy)
+	client.SetQueueOptions(cfg.Network.SendQueueSize, queuePolicy)
+
+	// Bandwidth caps apply to all peers combined
+	upLimit := network.NewRateLimiter(cfg.Network.MaxUploadKbps)
+	downLimit := network.NewRateLimiter(cfg.Network.MaxDownloadKbps)
+	server.SetRateLimiters(upLimit, downLimit)
+	client.SetRateLimiters(upLimit, downLimit)
+
+	keepaliveInterval := time.Duration(cfg.Network.KeepaliveInterval) * time.Second
+	keepaliveTimeout := time.Duration(cfg.Network.KeepaliveTimeout) * time.Second
+	server.SetKeepalive(keepaliveInterval, keepaliveTimeout)
+	client.SetKeepalive(keepaliveInterval, keepaliveTimeout)
+	server.SetTraceSize(cfg.Logging.TraceMessages)
+	client.SetTraceSize(cfg.Logging.TraceMessages)
+
+	relayAddr := cfg.Network.RelayAddress
+	server.SetSTUNServer(cfg.Network.STUNServer)
+	client.SetSTUNServer(cfg.Network.STUNServer)
+
 	// Create discovery service
 	disc := discovery.NewDiscovery(
 		cfg.Device.Name,
@@ -148,6 +499,16 @@ func runDaemon(cmd *cobra.Command, args []string) error {
 		cfg.Network.UseDiscovery,
 		cfg.Network.ManualPeers,
 	)
+	if err := disc.SetAdvertisement(cfg.Network.MDNSInstanceName, cfg.Network.MDNSAdvertise, cfg.Network.MDNSInterfaces); err != nil {
+		return fmt.Errorf("invalid mDNS settings: %w", err)
+	}
+	disc.SetOwner(config.Owner())
+	if cfg.Network.TailscaleDiscovery {
+		disc.EnableTailscale(cfg.Network.TailscaleSocket)
+	}
+	if cfg.Network.BeaconDiscovery {
+		disc.EnableBeacon(cfg.Network.BeaconPort)
+	}
 
 	// Create sync engine
 	engine, err := sync.NewEngine(cfg, server, client)
@@ -155,27 +516,47 @@ func runDaemon(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("failed to create sync engine: %w", err)
 	}
 
+	if safeMode, _ := cmd.Flags().GetBool("safe-mode"); safeMode {
+		engine.SetSafeMode(true)
+	}
+
+	// Peers an introducer knows are found like discovered ones
+	engine.SetIntroductionHandler(disc.AddIntroducedPeer)
+
 	// Set up discovery callbacks
 	disc.SetCallbacks(
 		func(peer *discovery.Peer) {
-			log.Info().Str("peer", peer.Name).Msg("Peer found")
+			log.Info().Str("peer_id", peer.Name).Msg("Peer found")
 			go func() {
-				if _, err := client.Connect(peer.Address()); err != nil {
-					log.Error().Err(err).Str("peer", peer.Name).Msg("Failed to connect to peer")
+				_, err := client.Connect(peer.Address())
+				if err != nil && relayAddr != "" {
+					log.Info().Err(err).Str("peer_id", peer.Name).Msg("Direct connection failed, trying relay")
+					_, err = client.ConnectViaRelay(relayAddr, cfg.Device.Name, peer.Name)
+				}
+				if err != nil {
+					log.Error().Err(err).Str("peer_id", peer.Name).Msg("Failed to connect to peer")
 				}
 			}()
 		},
 		func(peer *discovery.Peer) {
-			log.Info().Str("peer", peer.Name).Msg("Peer lost")
+			log.Info().Str("peer_id", peer.Name).Msg("Peer lost")
 		},
 	)
 
 	// Start services
 	if err := server.Start(); err != nil {
+		if errors.Is(err, syscall.EADDRINUSE) {
+			return fmt.Errorf("port %d is already in use, likely by another user's daemon on this Mac; set network.port to a free port: %w", cfg.Network.Port, err)
+		}
 		return fmt.Errorf("failed to start server: %w", err)
 	}
 	defer server.Stop()
 
+	if err := config.WritePIDFile(); err != nil {
+		log.Warn().Err(err).Msg("Failed to record daemon pid")
+	}
+	defer config.RemovePIDFile()
+
 	if err := disc.Start(); err != nil {
 		return fmt.Errorf("failed to start discovery: %w", err)
 	}
@@ -186,6 +567,26 @@ func runDaemon(cmd *cobra.Command, args []string) error {
 	}
 	defer engine.Stop()
 
+	// Serve share links to devices that don't run the tool
+	if cfg.Network.SharePort > 0 {
+		shareServer := share.NewServer(cfg, cfg.Network.SharePort)
+		if err := shareServer.Start(); err != nil {
+			log.Error().Err(err).Msg("Failed to start share server")
+		} else {
+			defer shareServer.Stop()
+		}
+	}
+
+	// Stay reachable through the relay and reach peers that are only there
+	if relayAddr != "" {
+		token, err := config.RelayToken()
+		if err != nil {
+			return err
+		}
+		server.ListenViaRelay(relayAddr, cfg.Device.Name, token)
+		client.KeepRelayPeers(relayAddr, cfg.Device.Name, cfg.Network.RelayPeers)
+	}
+
 	log.Info().Msg("Daemon running. Press Ctrl+C to stop.")
 
 	// Wait for interrupt
@@ -206,16 +607,153 @@ func runStatus(cmd *cobra.Command, args []string) error {
 	fmt.Printf("Mac Profile Sync Status\n")
 	fmt.Printf("=======================\n\n")
 	fmt.Printf("Device: %s\n", cfg.Device.Name)
+	if pid := config.DaemonPID(); pid != 0 {
+		fmt.Printf("Daemon: running (pid %d)\n", pid)
+	} else {
+		fmt.Printf("Daemon: not running\n")
+	}
+	pauses, _ := sync.LoadPauses()
+	if pauses != nil && pauses.All {
+		fmt.Printf("Sync: paused (resume with 'mac-profile-sync resume')\n")
+	} else if block := cfg.ScheduleBlock(time.Now()); block != "" {
+		fmt.Printf("Sync: paused, %s\n", block)
+	}
 	fmt.Printf("Port: %d\n", cfg.Network.Port)
 	fmt.Printf("Discovery: %v\n", cfg.Network.UseDiscovery)
+	if cfg.Network.UseDiscovery && !cfg.Network.MDNSAdvertise {
+		fmt.Printf("Advertising: off (browsing only)\n")
+	} else if cfg.Network.UseDiscovery && cfg.Network.MDNSInstanceName != "" {
+		fmt.Printf("Advertised as: %s\n", cfg.Network.MDNSInstanceName)
+	}
 	fmt.Printf("\nSynced Folders:\n")
+	if err := cfg.CheckFanIn(); err != nil {
+		fmt.Printf("  Warning: %v\n", err)
+	}
+
+	// State is written by the daemon; it may not exist yet
+	state := sync.NewStateStore()
+	_ = state.Load()
+
+	pipelines := make(map[string]sync.FolderStatus)
+	if folders, err := sync.LoadFolderStatus(); err == nil {
+		for _, f := range folders {
+			pipelines[f.Path] = f
+		}
+	}
+
+	journaled := make(map[string]int)
+	if changes, err := sync.LoadPendingChanges(); err == nil {
+		for _, c := range changes {
+			journaled[c.FolderPath]++
+		}
+	}
 
 	for _, folder := range cfg.Folders {
 		status := "enabled"
 		if !folder.Enabled {
 			status = "disabled"
 		}
+		if pauses != nil && folder.Enabled && pauses.IsPaused(folder.Path) {
+			status = "paused"
+		}
 		fmt.Printf("  %s (%s)\n", folder.Path, status)
+		if len(folder.Subfolders) > 0 {
+			fmt.Printf("    only: %s\n", strings.Join(folder.Subfolders, ", "))
+		}
+		if len(folder.Excluded) > 0 {
+			fmt.Printf("    except: %s\n", strings.Join(folder.Excluded, ", "))
+		}
+		if folder.Priority != "" && folder.Priority != config.PriorityNormal {
+			fmt.Printf("    priority: %s\n", folder.Priority)
+		}
+		if folder.Name != "" {
+			fmt.Printf("    synced as: %s\n", folder.Name)
+		}
+		if folder.HasApplyLimits() {
+			fmt.Printf("    writes: %s\n", applyLimits(folder))
+		}
+		if mode := folder.ChangeDetectionMode(); mode != config.DetectHash {
+			fmt.Printf("    change detection: %s\n", mode)
+		}
+
+		if p, ok := pipelines[folder.Path]; ok {
+			if p.State == sync.FolderBackoff {
+				fmt.Printf("    paused after repeated errors until %s: %s\n", fileutil.FormatClock(p.BackoffUntil), p.LastError)
+			}
+			if p.State == sync.FolderPaused {
+				fmt.Println("    changes here paused until offline peers catch up on deletions")
+			}
+			if p.State == sync.FolderLowDisk {
+				fmt.Printf("    receiving paused: its volume is down to %s free\n", cfg.Sync.MinFreeSpace)
+			}
+			if p.State == sync.FolderOffline {
+				fmt.Println("    offline: its drive isn't mounted")
+			}
+			if p.State == sync.FolderMissing {
+				fmt.Println("    missing: deleted, moved, or its volume unmounted; paused until it is back")
+			}
+			if p.QueuedEvents > 0 || p.QueuedRequests > 0 {
+				fmt.Printf("    %d change(s) and %d peer request(s) queued\n", p.QueuedEvents, p.QueuedRequests)
+			}
+			if p.UnseenDeletions > 0 {
+				fmt.Printf("    %d deletion(s) waiting for offline peers (%d remembered, limit %d), oldest %s\n",
+					p.UnseenDeletions, p.Deletions, p.DeletionsLimit, fileutil.FormatTime(p.OldestDeletion))
+			}
+		}
+
+		if n := journaled[folder.Path]; n > 0 {
+			fmt.Printf("    %d change(s) waiting for peers that are away (see `mac-profile-sync pending %s`)\n", n, folder.Path)
+		}
+		if unreadable := state.GetUnreadable(folder.Path); len(unreadable) > 0 {
+			fmt.Printf("    %d unreadable file(s) not synced\n", len(unreadable))
+		}
+		if unwritable := state.GetUnwritable(folder.Path); len(unwritable) > 0 {
+			fmt.Printf("    %d locked or read-only file(s) not updated from peers (see `mac-profile-sync explain <file>`)\n", len(unwritable))
+		}
+		if outdated := state.CountOutdatedHashes(folder.Path, folder.HashAlgorithm()); outdated > 0 {
+			fmt.Printf("    %d file hash(es) waiting to be migrated to %s\n", outdated, folder.HashAlgorithm())
+		}
+	}
+
+	if peers, err := sync.LoadPeerStatus(); err == nil && len(peers) > 0 {
+		fmt.Printf("\nConnected Peers:\n")
+		for _, p := range peers {
+			name := cfg.PeerLabel(p.Name)
+			if name == "" {
+				name = p.Address
+			}
+			latency := "measuring..."
+			if p.RTT > 0 {
+				latency = p.RTT.Round(time.Millisecond).String()
+			}
+			clock := ""
+			if p.ClockOffset >= time.Second || p.ClockOffset <= -time.Second {
+				clock = fmt.Sprintf(", clock %+v", p.ClockOffset.Round(time.Second))
+			}
+			queue := fmt.Sprintf(", queue %d/%d", p.Queue.Depth, p.Queue.Capacity)
+			if p.Queue.Dropped > 0 {
+				queue += fmt.Sprintf(", %s dropped", fileutil.FormatCount(int64(p.Queue.Dropped)))
+			}
+			fmt.Printf("  %s (%s, %s) latency %s%s%s\n", name, p.Address, p.Direction, latency, clock, queue)
+		}
+	}
+
+	if held, _ := sync.LoadHeldDeletes(); len(held) > 0 {
+		fmt.Printf("\n%d folder(s) have mass deletions held back from peers. Run 'mac-profile-sync deletes'.\n", len(held))
+	}
+
+	reconcile := sync.NewReconcileStore()
+	_ = reconcile.Load()
+	if pending := reconcile.List(); len(pending) > 0 {
+		fmt.Printf("\n%d folder(s) held after a restore or before their first sync. Run 'mac-profile-sync reconcile'.\n", len(pending))
+	}
+
+	if lock, _ := sync.LoadBackupLock(); lock != nil && !lock.Expired() {
+		fmt.Printf("\nIncoming changes paused: backup lock held by %s until %s\n", lock.Holder, fileutil.FormatClock(lock.ExpiresAt))
+	}
+
+	if quarantined, _ := fileutil.CountFilesRecursive(sync.QuarantineDir()); quarantined > 0 {
+		fmt.Printf("\n%d file(s) rejected by the scanner are in %s\n", quarantined, sync.QuarantineDir())
 	}
 
 	fmt.Printf("\nConflict Resolution: %s\n", cfg.Sync.ConflictResolution)
@@ -230,11 +768,15 @@ func runAdd(cmd *cobra.Command, args []string) error {
 	}
 
 	path := args[0]
-	if err := cfg.AddFolder(path); err != nil {
+	name, _ := cmd.Flags().GetString("name")
+	if err := cfg.AddFolderNamed(path, name); err != nil {
 		return err
 	}
 
 	fmt.Printf("Added folder: %s\n", path)
+	if volume := fileutil.ExternalVolume(fileutil.ExpandHome(path)); volume != "" && !fileutil.VolumeMounted(volume) {
+		fmt.Printf("%s isn't mounted; the folder is offline and syncs once it is.\n", volume)
+	}
 	return nil
 }
 
@@ -245,48 +787,1939 @@ func runRemove(cmd *cobra.Command, args []string) error {
 	}
 
 	path := args[0]
+	folder := cfg.GetFolder(path)
 	if err := cfg.RemoveFolder(path); err != nil {
 		return err
 	}
 
+	// A running daemon notices the removal and forgets the folder's state
+	if folder != nil && config.DaemonPID() == 0 {
+		sync.NewStateStore().ClearFolder(folder.Path)
+	}
+
 	fmt.Printf("Removed folder: %s\n", path)
 	return nil
 }
 
-func runPeers(cmd *cobra.Command, args []string) error {
+func runSubfolders(cmd *cobra.Command, args []string) error {
 	cfg, err := config.Load()
 	if err != nil {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
-	fmt.Printf("Searching for peers...\n")
+	folder := cfg.GetFolder(args[0])
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", args[0])
+	}
 
-	// Create discovery service
-	disc := discovery.NewDiscovery(
-		cfg.Device.Name,
-		cfg.Network.Port,
-		cfg.Network.UseDiscovery,
-		cfg.Network.ManualPeers,
-	)
+	all, _ := cmd.Flags().GetBool("all")
+	except, _ := cmd.Flags().GetBool("except")
+	switch {
+	case all:
+		if err := cfg.SetSubfolders(args[0], nil); err != nil {
+			return err
+		}
+		if err := cfg.SetExcluded(args[0], nil); err != nil {
+			return err
+		}
+		fmt.Printf("Syncing all subfolders of %s\n", folder.Path)
 
-	disc.SetCallbacks(
-		func(peer *discovery.Peer) {
-			fmt.Printf("  Found: %s (%s)\n", peer.Name, peer.Address())
-		},
-		nil,
-	)
+	case except:
+		if err := cfg.SetExcluded(args[0], args[1:]); err != nil {
+			return err
+		}
+		if len(folder.Excluded) == 0 {
+			fmt.Printf("No subfolders of %s are excluded\n", folder.Path)
+		} else {
+			fmt.Printf("Syncing %s except %s\n", folder.Path, strings.Join(folder.Excluded, ", "))
+		}
 
-	if err := disc.Start(); err != nil {
-		return fmt.Errorf("failed to start discovery: %w", err)
+	case len(args) > 1:
+		if err := cfg.SetSubfolders(args[0], args[1:]); err != nil {
+			return err
+		}
+		fmt.Printf("Syncing only %s in %s\n", strings.Join(folder.Subfolders, ", "), folder.Path)
+
+	default:
+		if !folder.IsSparse() {
+			fmt.Printf("All subfolders of %s are synced\n", folder.Path)
+			return nil
+		}
+		if len(folder.Subfolders) > 0 {
+			fmt.Printf("Synced subfolders of %s:\n", folder.Path)
+			for _, sub := range folder.Subfolders {
+				fmt.Printf("  %s\n", sub)
+			}
+		}
+		if len(folder.Excluded) > 0 {
+			fmt.Printf("Excluded subfolders of %s (kept on this Mac only):\n", folder.Path)
+			for _, sub := range folder.Excluded {
+				fmt.Printf("  %s\n", sub)
+			}
+		}
+		return nil
 	}
-	defer disc.Stop()
 
-	// Wait for discovery
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	if config.DaemonPID() != 0 {
+		fmt.Println("The running daemon backfills or removes subfolders within a few seconds.")
+	} else {
+		fmt.Println("Subfolders are backfilled or removed when the daemon starts.")
+	}
+	return nil
+}
 
-	fmt.Println("Press Ctrl+C to stop...")
-	<-sigCh
+// remoteListing returns what peers have outside a sparse folder's selection,
+// as the daemon last published it
+func remoteListing(folder *config.FolderConfig) (*sync.RemoteListing, error) {
+	if !folder.IsSparse() {
+		return nil, fmt.Errorf("all subfolders of %s are synced", folder.Path)
+	}
+	listings, err := sync.LoadRemoteListings()
+	if err != nil {
+		return nil, err
+	}
+	listing := listings[folder.Path]
+	if listing == nil {
+		return nil, fmt.Errorf("no file list for %s from a peer yet: start the daemon and wait for a peer to connect", folder.Path)
+	}
+	return listing, nil
+}
+
+func runBrowse(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	folder := cfg.GetFolder(args[0])
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", args[0])
+	}
+	listing, err := remoteListing(folder)
+	if err != nil {
+		return err
+	}
+
+	dir := ""
+	if len(args) > 1 {
+		dir = args[1]
+	}
+	files := listing.Under(dir)
+	if len(files) == 0 {
+		fmt.Printf("%s has no files there outside the synced subfolders\n", cfg.PeerLabel(listing.PeerName))
+		return nil
+	}
+
+	fmt.Printf("Not synced, on %s as of %s:\n", cfg.PeerLabel(listing.PeerName), fileutil.FormatTime(listing.ReceivedAt))
+	for _, f := range files {
+		fetched := ""
+		if _, err := os.Stat(filepath.Join(folder.Path, f.RelPath)); err == nil {
+			fetched = "  (fetched)"
+		}
+		fmt.Printf("  %-50s %10s  %s%s\n", f.RelPath, fileutil.FormatSize(f.Size), fileutil.FormatTime(f.ModTime), fetched)
+	}
+	fmt.Printf("\nFetch files or subfolders with 'mac-profile-sync fetch %s <path>'.\n", args[0])
+	return nil
+}
+
+func runFetch(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	folder := cfg.GetFolder(args[0])
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", args[0])
+	}
+	if config.DaemonPID() == 0 {
+		return fmt.Errorf("the daemon isn't running: start it to fetch files")
+	}
+	listing, err := remoteListing(folder)
+	if err != nil {
+		return err
+	}
+
+	// A subfolder fetches every file in it
+	var requests []sync.FetchRequest
+	for _, path := range args[1:] {
+		files := listing.Under(path)
+		if len(files) == 0 {
+			return fmt.Errorf("%s isn't among the files %s has outside the synced subfolders", path, cfg.PeerLabel(listing.PeerName))
+		}
+		for _, f := range files {
+			requests = append(requests, sync.FetchRequest{FolderPath: folder.Path, RelPath: f.RelPath})
+		}
+	}
+	if err := sync.QueueFetch(requests); err != nil {
+		return err
+	}
+
+	fmt.Printf("Fetching %d file(s) from %s. They aren't synced after that.\n", len(requests), cfg.PeerLabel(listing.PeerName))
+	return nil
+}
+
+func runIgnore(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	folder := cfg.GetFolder(args[0])
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", args[0])
+	}
+
+	// Sharing changes need a restart; patterns are picked up live
+	restart := false
+	if share, _ := cmd.Flags().GetString("share"); share != "" {
+		if share != "on" && share != "off" {
+			return fmt.Errorf("invalid --share value %q (use on or off)", share)
+		}
+		if err := cfg.SetSharedIgnore(folder.Path, share == "on"); err != nil {
+			return err
+		}
+		restart = true
+	}
+	if private, _ := cmd.Flags().GetString("private"); private != "" {
+		if private != "on" && private != "off" {
+			return fmt.Errorf("invalid --private value %q (use on or off)", private)
+		}
+		if err := cfg.SetPrivateIgnoreFile(folder.Path, private == "on"); err != nil {
+			return err
+		}
+		restart = true
+	}
+	if views, _ := cmd.Flags().GetString("finder-views"); views != "" {
+		if views != "on" && views != "off" {
+			return fmt.Errorf("invalid --finder-views value %q (use on or off)", views)
+		}
+		if err := cfg.SetFinderViews(folder.Path, views == "on"); err != nil {
+			return err
+		}
+		restart = true
+	}
+
+	if patterns := args[1:]; len(patterns) > 0 {
+		local, _ := cmd.Flags().GetBool("local")
+		if local {
+			if err := cfg.AddLocalIgnore(folder.Path, patterns); err != nil {
+				return err
+			}
+			fmt.Printf("Ignoring %s in %s on this Mac\n", strings.Join(patterns, ", "), folder.Path)
+		} else {
+			if err := sync.AddToIgnoreFile(folder.Path, patterns); err != nil {
+				return err
+			}
+			fmt.Printf("Added %s to %s\n", strings.Join(patterns, ", "), filepath.Join(folder.Path, sync.IgnoreFileName))
+			if !folder.SharedIgnore {
+				fmt.Println("Shared ignore rules are off for this folder; enable them with --share on")
+			}
+		}
+	}
+
+	shared, err := sync.ReadIgnoreFile(folder.Path)
+	if err != nil {
+		return err
+	}
+
+	state := "off"
+	if folder.SharedIgnore {
+		state = "on"
+	}
+	file := "synced"
+	if folder.PrivateIgnoreFile {
+		file = "private"
+	}
+	fmt.Printf("Ignore rules for %s (shared: %s, %s: %s)\n", folder.Path, state, sync.IgnoreFileName, file)
+	for _, pattern := range shared {
+		fmt.Printf("  %s\n", pattern)
+	}
+	for _, pattern := range folder.LocalIgnore {
+		fmt.Printf("  %s (local)\n", pattern)
+	}
+	if len(shared) == 0 && len(folder.LocalIgnore) == 0 {
+		fmt.Println("  (none)")
+	}
+	if folder.FinderViews {
+		fmt.Printf("  %s files sync (finder views: on)\n", config.FinderViewFile)
+	}
+	if restart {
+		fmt.Println("Restart the daemon to apply the change.")
+	}
+
+	if cleanup, _ := cmd.Flags().GetBool("cleanup"); cleanup {
+		deletes, _ := cmd.Flags().GetBool("delete")
+		yes, _ := cmd.Flags().GetBool("yes")
+		return runIgnoreCleanup(cfg, folder.Path, deletes, yes)
+	}
+	return nil
+}
+
+// runIgnoreCleanup lists synced files a folder's ignore rules now exclude and,
+// once confirmed, has the daemon stop tracking them or delete peers' copies
+func runIgnoreCleanup(cfg *config.Config, folderPath string, deletes, yes bool) error {
+	state := sync.NewStateStore()
+	if err := state.Load(); err != nil {
+		return err
+	}
+	paths := sync.NewlyIgnored(cfg, sync.NewIgnoreRules(cfg), state, folderPath)
 
+	fmt.Println()
+	if len(paths) == 0 {
+		fmt.Println("No synced files are ignored by the current rules.")
+		return nil
+	}
+	printPreview("synced before the rules ignored them", paths)
+
+	if config.DaemonPID() == 0 {
+		return fmt.Errorf("the daemon isn't running; start it to clean up ignored files")
+	}
+
+	action, question := sync.CleanupUntrack, fmt.Sprintf("Stop tracking %d file(s)? Peers keep their copies.", len(paths))
+	if deletes {
+		peers, _ := sync.LoadPeerStatus()
+		if len(peers) == 0 {
+			return fmt.Errorf("every %w; their copies can only be deleted while connected", sync.ErrPeerOffline)
+		}
+		names := make([]string, 0, len(peers))
+		for _, p := range peers {
+			name := cfg.PeerLabel(p.Name)
+			if name == "" {
+				name = p.Address
+			}
+			names = append(names, name)
+		}
+		action = sync.CleanupDelete
+		question = fmt.Sprintf("Delete %d file(s) on %s? The copies on this Mac are kept.", len(paths), strings.Join(names, ", "))
+	}
+	if !yes && !confirm(question) {
+		fmt.Println("Nothing changed.")
+		return nil
+	}
+
+	err := sync.QueueIgnoreCleanup(&sync.IgnoreCleanup{
+		FolderPath:  folderPath,
+		Action:      action,
+		Paths:       paths,
+		RequestedAt: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("The running daemon cleans them up within a few seconds.")
+	return nil
+}
+
+// confirm asks a yes/no question on the terminal; anything but yes is no
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func runReconcile(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	store := sync.NewReconcileStore()
+	if err := store.Load(); err != nil {
+		return err
+	}
+
+	folderPath := ""
+	if len(args) > 0 {
+		folder := cfg.GetFolder(args[0])
+		if folder == nil {
+			return fmt.Errorf("folder not found: %s", args[0])
+		}
+		folderPath = folder.Path
+	}
+
+	keep, _ := cmd.Flags().GetString("keep")
+	if keep != "" {
+		if folderPath == "" {
+			return fmt.Errorf("specify the folder to reconcile")
+		}
+
+		count, err := store.SetAuthoritative(folderPath, keep)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("no pending reconciliation for %s", folderPath)
+		}
+		if err := store.Save(); err != nil {
+			return err
+		}
+
+		fmt.Printf("Keeping %s side of %s. The running daemon applies this within a few seconds.\n", keep, folderPath)
+		return nil
+	}
+
+	if confirmFirst, _ := cmd.Flags().GetBool("confirm"); confirmFirst {
+		if folderPath == "" {
+			return fmt.Errorf("specify the folder to confirm")
+		}
+		yes, _ := cmd.Flags().GetBool("yes")
+		return confirmFirstSync(cfg, store, folderPath, yes)
+	}
+
+	pending := store.List()
+	if len(pending) == 0 {
+		fmt.Println("No folders are waiting for reconciliation.")
+		return nil
+	}
+
+	firstSyncs := 0
+	for _, r := range pending {
+		if folderPath != "" && r.FolderPath != folderPath {
+			continue
+		}
+
+		peer := cfg.PeerLabel(r.PeerName)
+		restored := "this Mac"
+		if r.RestoredSide == sync.SideRemote {
+			restored = peer
+		}
+		fmt.Printf("%s (with %s)\n", r.FolderPath, peer)
+		if r.Reason == sync.ReasonFirstSync {
+			firstSyncs++
+			printPairing(cfg, r)
+		} else if r.Reason == sync.ReasonStale {
+			fmt.Printf("  %s was away longer than the deletions it missed were remembered (detected %s)\n",
+				peer, fileutil.FormatDateTime(r.DetectedAt))
+			fmt.Println("  Keeping local deletes what was deleted here; keeping remote brings it back")
+		} else {
+			fmt.Printf("  %s appears to have been restored from a backup (detected %s)\n",
+				restored, fileutil.FormatDateTime(r.DetectedAt))
+		}
+		if r.Authoritative != "" {
+			fmt.Printf("  Keeping %s side, waiting for the daemon\n", r.Authoritative)
+		}
+
+		printPreview("only on this Mac", r.Preview.OnlyLocal)
+		printPreview("only on "+peer, r.Preview.OnlyRemote)
+		printPreview("newer on this Mac", r.Preview.LocalNewer)
+		printPreview("newer on "+peer, r.Preview.RemoteNewer)
+		fmt.Println()
+	}
+
+	if firstSyncs > 0 {
+		fmt.Println("Start a first sync as suggested with: mac-profile-sync reconcile <folder> --confirm")
+	}
+	fmt.Println("Choose a side with: mac-profile-sync reconcile <folder> --keep local|remote")
+	return nil
+}
+
+func runExclude(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	if len(args) == 0 {
+		list, err := sync.LoadTempExclusions()
+		if err != nil {
+			return err
+		}
+		shown := 0
+		for _, x := range list {
+			if x.Expired() {
+				continue
+			}
+			shown++
+			fmt.Printf("%s  until %s\n", filepath.Join(x.FolderPath, x.RelPath), fileutil.FormatDateTime(x.Until))
+		}
+		if shown == 0 {
+			fmt.Println("No paths are excluded for a while.")
+		}
+		return nil
+	}
+
+	d, _ := cmd.Flags().GetDuration("for")
+	if d <= 0 {
+		return fmt.Errorf("--for must be positive")
+	}
+	x, err := sync.SetTempExclusion(cfg, args[0], d)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s isn't synced until %s.\n", filepath.Join(x.FolderPath, x.RelPath), fileutil.FormatDateTime(x.Until))
+	fmt.Println("Sync it again sooner with: mac-profile-sync include <path>")
+	return nil
+}
+
+func runInclude(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	x, err := sync.SetTempExclusion(cfg, args[0], 0)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s syncs again.\n", filepath.Join(x.FolderPath, x.RelPath))
+	return nil
+}
+
+func runPending(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	folders := cfg.Folders
+	if len(args) > 0 {
+		folder := cfg.GetFolder(args[0])
+		if folder == nil {
+			return fmt.Errorf("folder not found: %s", args[0])
+		}
+		folders = []config.FolderConfig{*folder}
+	}
+
+	changes, err := sync.LoadPendingChanges()
+	if err != nil {
+		return err
+	}
+	state := sync.NewStateStore()
+	_ = state.Load()
+
+	shown := 0
+	for _, folder := range folders {
+		var changed []sync.PendingChange
+		for _, c := range changes {
+			if c.FolderPath == folder.Path {
+				changed = append(changed, c)
+			}
+		}
+		deleted := state.GetUnseenDeletions(folder.Path)
+		if len(changed) == 0 && len(deleted) == 0 {
+			continue
+		}
+		shown++
+
+		fmt.Printf("%s\n", folder.Path)
+		if len(changed) > 0 {
+			fmt.Printf("  Changed while peers were away (%d):\n", len(changed))
+			for _, c := range changed {
+				peers := make([]string, len(c.Peers))
+				for i, p := range c.Peers {
+					peers[i] = cfg.PeerLabel(p)
+				}
+				fmt.Printf("    %s  for %s, changed %s\n", c.RelPath, strings.Join(peers, ", "), fileutil.FormatTime(c.ChangedAt))
+			}
+		}
+		if len(deleted) > 0 {
+			fmt.Printf("  Deleted, not yet seen by every peer (%d):\n", len(deleted))
+			for _, p := range deleted {
+				fmt.Printf("    %s\n", p)
+			}
+		}
+		fmt.Println()
+	}
+
+	if shown == 0 {
+		fmt.Println("No changes are waiting for peers.")
+	}
+	return nil
+}
+
+func runDeletes(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	folderPath := ""
+	if len(args) > 0 {
+		folder := cfg.GetFolder(args[0])
+		if folder == nil {
+			return fmt.Errorf("folder not found: %s", args[0])
+		}
+		folderPath = folder.Path
+	}
+
+	held, err := sync.LoadHeldDeletes()
+	if err != nil {
+		return err
+	}
+
+	approve, _ := cmd.Flags().GetBool("approve")
+	restore, _ := cmd.Flags().GetBool("restore")
+	if approve && restore {
+		return fmt.Errorf("use either --approve or --restore")
+	}
+	if approve || restore {
+		if folderPath == "" {
+			return fmt.Errorf("specify the folder")
+		}
+		decision := sync.DeletesRestore
+		if approve {
+			decision = sync.DeletesApprove
+			yes, _ := cmd.Flags().GetBool("yes")
+			for _, h := range held {
+				if h.FolderPath == folderPath && !yes && !confirm(fmt.Sprintf("Delete %d file(s) from %s on every peer?", h.Files, folderPath)) {
+					return nil
+				}
+			}
+		}
+		if err := sync.DecideHeldDeletes(folderPath, decision); err != nil {
+			return err
+		}
+
+		if approve {
+			fmt.Printf("Sending the deletions in %s to peers.", folderPath)
+		} else {
+			fmt.Printf("Restoring the deleted files in %s from peers.", folderPath)
+		}
+		if config.DaemonPID() == 0 {
+			fmt.Println(" The daemon isn't running; this applies when it starts.")
+		} else {
+			fmt.Println(" The running daemon applies this within a few seconds.")
+		}
+		return nil
+	}
+
+	all, _ := cmd.Flags().GetBool("all")
+	shown := 0
+	for _, h := range held {
+		if folderPath != "" && h.FolderPath != folderPath {
+			continue
+		}
+		shown++
+		fmt.Printf("%s\n", h.FolderPath)
+		fmt.Printf("  %s of %s file(s) deleted at once (detected %s)\n",
+			fileutil.FormatCount(int64(h.Files)), fileutil.FormatCount(int64(h.FolderSize)), fileutil.FormatDateTime(h.DetectedAt))
+		if h.Decision != "" {
+			fmt.Printf("  Chosen: %s, waiting for the daemon\n", h.Decision)
+		}
+		paths := h.Paths
+		if !all && len(paths) > 10 {
+			paths = paths[:10]
+		}
+		for _, p := range paths {
+			fmt.Printf("    %s\n", p)
+		}
+		if len(paths) < len(h.Paths) {
+			fmt.Printf("    ... and %d more (--all lists them)\n", len(h.Paths)-len(paths))
+		}
+		fmt.Println()
+	}
+
+	if shown == 0 {
+		fmt.Println("No deletions are held.")
+		return nil
+	}
+	fmt.Println("Send them to peers with: mac-profile-sync deletes <folder> --approve")
+	fmt.Println("Get the files back with: mac-profile-sync deletes <folder> --restore")
+	return nil
+}
+
+// printPairing describes both sides of a folder waiting for its first sync
+// and the suggested way to start it
+func printPairing(cfg *config.Config, r *sync.Reconciliation) {
+	peer := cfg.PeerLabel(r.PeerName)
+	p := r.Pairing
+	fmt.Printf("  First sync: this Mac has %s file(s) (%s), %s has %s file(s) (%s)\n",
+		fileutil.FormatCount(int64(p.LocalFiles)), fileutil.FormatSize(p.LocalBytes), peer, fileutil.FormatCount(int64(p.RemoteFiles)), fileutil.FormatSize(p.RemoteBytes))
+
+	switch p.Strategy {
+	case sync.PairSeedLocal:
+		fmt.Printf("  Suggested: %s is empty, seed it from this Mac\n", peer)
+	case sync.PairSeedRemote:
+		fmt.Printf("  Suggested: this Mac is empty, seed it from %s\n", peer)
+	default:
+		fmt.Printf("  Suggested: merge both sides; files that differ are conflicts, resolved with %s\n", cfg.GetConflictStrategy())
+	}
+	fmt.Println("  Nothing is deleted on either side by the first sync")
+	if r.Confirmed {
+		fmt.Println("  Confirmed, waiting for the daemon")
+	}
+}
+
+// confirmFirstSync confirms the first syncs of a folder waiting for it
+func confirmFirstSync(cfg *config.Config, store *sync.ReconcileStore, folderPath string, yes bool) error {
+	var waiting []*sync.Reconciliation
+	for _, r := range store.List() {
+		if r.FolderPath == folderPath && r.Reason == sync.ReasonFirstSync {
+			waiting = append(waiting, r)
+		}
+	}
+	if len(waiting) == 0 {
+		return fmt.Errorf("no first sync of %s is waiting", folderPath)
+	}
+
+	if !yes {
+		for _, r := range waiting {
+			fmt.Printf("%s (with %s)\n", r.FolderPath, cfg.PeerLabel(r.PeerName))
+			printPairing(cfg, r)
+		}
+		if !confirm("Start the first sync as suggested?") {
+			fmt.Println("Nothing changed.")
+			return nil
+		}
+	}
+
+	store.Confirm(folderPath)
+	if err := store.Save(); err != nil {
+		return err
+	}
+	fmt.Printf("Confirmed the first sync of %s. The running daemon starts it within a few seconds.\n", folderPath)
+	return nil
+}
+
+func runApproval(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	folder := cfg.GetFolder(args[0])
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", args[0])
+	}
+
+	if len(args) == 1 {
+		mode := folder.Approval
+		if mode == "" {
+			mode = config.ApprovalAuto
+		}
+		fmt.Printf("%s: %s\n", folder.Path, mode)
+		return nil
+	}
+
+	if err := cfg.SetApproval(args[0], args[1]); err != nil {
+		return err
+	}
+	fmt.Printf("Peer changes to %s now use %s approval\n", folder.Path, args[1])
+	fmt.Println("Restart the daemon for this to take effect.")
+	return nil
+}
+
+func runPriority(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	folder := cfg.GetFolder(args[0])
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", args[0])
+	}
+
+	if len(args) == 1 {
+		priority := folder.Priority
+		if priority == "" {
+			priority = config.PriorityNormal
+		}
+		fmt.Printf("%s: %s\n", folder.Path, priority)
+		return nil
+	}
+
+	if err := cfg.SetPriority(args[0], args[1]); err != nil {
+		return err
+	}
+	fmt.Printf("Transfers for %s now use %s priority\n", folder.Path, args[1])
+	fmt.Println("Restart the daemon for this to take effect.")
+	return nil
+}
+
+func runThrottle(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	folder := cfg.GetFolder(args[0])
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", args[0])
+	}
+
+	flags := cmd.Flags()
+	if !flags.Changed("concurrency") && !flags.Changed("rate") {
+		fmt.Printf("%s: %s\n", folder.Path, applyLimits(*folder))
+		return nil
+	}
+
+	concurrency, rate := folder.ApplyConcurrency, folder.ApplyRate
+	if flags.Changed("concurrency") {
+		concurrency, _ = flags.GetInt("concurrency")
+	}
+	if flags.Changed("rate") {
+		rate, _ = flags.GetInt("rate")
+	}
+
+	if err := cfg.SetApplyLimits(args[0], concurrency, rate); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	fmt.Printf("%s: %s\n", folder.Path, applyLimits(*folder))
+	fmt.Println("Restart the daemon for this to take effect.")
+	return nil
+}
+
+// applyLimits describes how fast received files are written to a folder
+func applyLimits(folder config.FolderConfig) string {
+	if !folder.HasApplyLimits() {
+		return "received files written without limits"
+	}
+	var limits []string
+	if folder.ApplyConcurrency > 0 {
+		limits = append(limits, fmt.Sprintf("%d at once", folder.ApplyConcurrency))
+	}
+	if folder.ApplyRate > 0 {
+		limits = append(limits, fmt.Sprintf("%d per second", folder.ApplyRate))
+	}
+	return "received files written " + strings.Join(limits, ", ")
+}
+
+func runWatch(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	folder := cfg.GetFolder(args[0])
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", args[0])
+	}
+
+	if len(args) == 1 {
+		mode := folder.WatchMode()
+		switch {
+		case mode == config.WatchAuto && fileutil.IsNetworkVolume(folder.Path):
+			fmt.Printf("%s: %s (polling every %s, on a network volume)\n", folder.Path, mode, cfg.GetPollInterval())
+		case mode == config.WatchPoll:
+			fmt.Printf("%s: %s (every %s)\n", folder.Path, mode, cfg.GetPollInterval())
+		case mode == config.WatchPortable && !fileutil.IsDir(folder.Path):
+			fmt.Printf("%s: %s (drive not mounted)\n", folder.Path, mode)
+		case mode == config.WatchPortable && cfg.GetRescanInterval(folder.Path) > 0:
+			fmt.Printf("%s: %s (rescanned on mount and every %s while mounted)\n", folder.Path, mode, cfg.GetRescanInterval(folder.Path))
+		case mode == config.WatchPortable:
+			fmt.Printf("%s: %s (rescanned on mount)\n", folder.Path, mode)
+		default:
+			fmt.Printf("%s: %s\n", folder.Path, mode)
+		}
+		return nil
+	}
+
+	if err := cfg.SetWatchMode(args[0], args[1]); err != nil {
+		return err
+	}
+	fmt.Printf("%s is now watched in %s mode\n", folder.Path, args[1])
+	fmt.Println("Restart the daemon for this to take effect.")
+	return nil
+}
+
+func runName(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	folder := cfg.GetFolder(args[0])
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", args[0])
+	}
+
+	if len(args) == 1 {
+		fmt.Printf("%s: %s\n", folder.Path, folder.SyncName())
+		return nil
+	}
+
+	if err := cfg.SetFolderName(args[0], args[1]); err != nil {
+		return err
+	}
+	fmt.Printf("%s now syncs as %s; set the same name for it on peers\n", folder.Path, folder.SyncName())
+	fmt.Println("Restart the daemon for this to take effect.")
+	return nil
+}
+
+func runDetect(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	folder := cfg.GetFolder(args[0])
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", args[0])
+	}
+
+	if len(args) == 1 {
+		fmt.Printf("%s: %s\n", folder.Path, folder.ChangeDetectionMode())
+		return nil
+	}
+
+	if err := cfg.SetChangeDetection(args[0], args[1]); err != nil {
+		return err
+	}
+	fmt.Printf("Changes in %s are now detected with %s\n", folder.Path, args[1])
+	fmt.Println("Restart the daemon for this to take effect.")
+	return nil
+}
+
+func runLimits(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	if len(args) == 0 {
+		listed := 0
+		for _, peer := range cfg.Peers {
+			if peer.HasLimits() {
+				printPeerLimits(cfg, peer)
+				listed++
+			}
+		}
+		if listed == 0 {
+			fmt.Println("No per-peer limits configured.")
+		}
+		return nil
+	}
+
+	limits := config.PeerConfig{Name: args[0]}
+	if existing := cfg.GetPeer(args[0]); existing != nil {
+		limits = *existing
+	}
+
+	flags := cmd.Flags()
+	if !flags.Changed("transfers") && !flags.Changed("up") && !flags.Changed("down") {
+		printPeerLimits(cfg, limits)
+		return nil
+	}
+	if flags.Changed("transfers") {
+		limits.MaxConcurrentTransfers, _ = flags.GetInt("transfers")
+	}
+	if flags.Changed("up") {
+		limits.MaxUploadKbps, _ = flags.GetInt("up")
+	}
+	if flags.Changed("down") {
+		limits.MaxDownloadKbps, _ = flags.GetInt("down")
+	}
+
+	if err := cfg.SetPeerLimits(limits); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	printPeerLimits(cfg, limits)
+	fmt.Println("Restart the daemon for this to take effect.")
+	return nil
+}
+
+func printPeerLimits(cfg *config.Config, peer config.PeerConfig) {
+	kbps := func(v int) string {
+		if v <= 0 {
+			return "unlimited"
+		}
+		return fmt.Sprintf("%d kbps", v)
+	}
+	fmt.Printf("%s: %d transfers, upload %s, download %s\n",
+		cfg.PeerLabel(peer.Name), cfg.GetPeerMaxTransfers(peer.Name), kbps(peer.MaxUploadKbps), kbps(peer.MaxDownloadKbps))
+}
+
+func runPause(cmd *cobra.Command, args []string) error {
+	return setPaused(args, true)
+}
+
+func runResume(cmd *cobra.Command, args []string) error {
+	return setPaused(args, false)
+}
+
+// setPaused pauses or resumes all syncing, or the folder in args
+func setPaused(args []string, paused bool) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	pauses, err := sync.LoadPauses()
+	if err != nil {
+		return err
+	}
+
+	action := "resumed"
+	if paused {
+		action = "paused"
+	}
+
+	if len(args) == 0 {
+		pauses.All = paused
+		if !paused {
+			pauses.Folders = nil
+		}
+		if err := sync.SavePauses(pauses); err != nil {
+			return err
+		}
+		fmt.Printf("Syncing %s.\n", action)
+	} else {
+		folder := cfg.GetFolder(args[0])
+		if folder == nil {
+			return fmt.Errorf("folder not found: %s", args[0])
+		}
+		pauses.SetFolder(folder.Path, paused)
+		if err := sync.SavePauses(pauses); err != nil {
+			return err
+		}
+		fmt.Printf("%s %s.\n", folder.Path, action)
+		if !paused && pauses.All {
+			fmt.Println("All syncing is still paused; run 'mac-profile-sync resume' to resume it.")
+		}
+	}
+
+	if config.DaemonPID() == 0 {
+		fmt.Println("The daemon isn't running; this applies when it starts.")
+	}
+	return nil
+}
+
+func runBackupLock(cmd *cobra.Command, args []string) error {
+	if _, err := config.Load(); err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	if len(args) == 0 {
+		lock, err := sync.LoadBackupLock()
+		if err != nil {
+			return err
+		}
+		switch {
+		case lock == nil:
+			fmt.Println("No backup lock held.")
+		case lock.Expired():
+			fmt.Printf("Backup lock held by %s expired at %s and is ignored.\n", lock.Holder, fileutil.FormatDateTimeSeconds(lock.ExpiresAt))
+		default:
+			fmt.Printf("Backup lock held by %s since %s, until %s.\n", lock.Holder, fileutil.FormatDateTimeSeconds(lock.AcquiredAt), fileutil.FormatDateTimeSeconds(lock.ExpiresAt))
+		}
+		return nil
+	}
+
+	switch args[0] {
+	case "acquire":
+		holder, _ := cmd.Flags().GetString("holder")
+		ttl, _ := cmd.Flags().GetDuration("ttl")
+		lock, err := sync.AcquireBackupLock(holder, ttl)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Incoming changes paused until released or %s.\n", fileutil.FormatDateTimeSeconds(lock.ExpiresAt))
+	case "release":
+		if err := sync.ReleaseBackupLock(); err != nil {
+			return err
+		}
+		fmt.Println("Backup lock released; held changes will be applied.")
+	default:
+		return withExitCode(exitUsage, fmt.Errorf("unknown action %q: use acquire or release", args[0]))
+	}
+	return nil
+}
+
+func runShare(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	store := share.NewStore()
+	if err := store.Load(); err != nil {
+		return err
+	}
+
+	if token, _ := cmd.Flags().GetString("revoke"); token != "" {
+		link, err := store.Revoke(token)
+		if err != nil {
+			return err
+		}
+		if err := store.Save(); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked link to %s\n", link.FullPath())
+		return nil
+	}
+
+	if len(args) == 0 {
+		links := store.List()
+		if len(links) == 0 {
+			fmt.Println("No active share links.")
+			return nil
+		}
+		for _, link := range links {
+			downloads := fmt.Sprintf("%d/%d downloads", link.Downloads, link.MaxDownloads)
+			if link.MaxDownloads == 0 {
+				downloads = fmt.Sprintf("%d downloads", link.Downloads)
+			}
+			fmt.Printf("%s  %s (%s, expires %s)\n", link.Token[:8], link.FullPath(), downloads, fileutil.FormatClock(link.ExpiresAt))
+			fmt.Printf("  %s\n", share.URL(link, cfg.Network.SharePort))
+		}
+		return nil
+	}
+
+	if cfg.Network.SharePort <= 0 {
+		return fmt.Errorf("share links are off; set network.share_port, e.g. to %d, and restart the daemon", config.SuggestedSharePort())
+	}
+
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid path: %w", err)
+	}
+	folder, relPath := cfg.FolderContaining(path)
+	if folder == nil {
+		return fmt.Errorf("%s is not in a synced folder", path)
+	}
+	if info, err := os.Stat(path); err != nil || info.IsDir() {
+		return fmt.Errorf("%s is not a file", path)
+	}
+
+	expires, _ := cmd.Flags().GetDuration("expires")
+	downloads, _ := cmd.Flags().GetInt("downloads")
+	link, err := store.Create(folder.Path, relPath, expires, downloads)
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if err := store.Save(); err != nil {
+		return err
+	}
+
+	fmt.Println(share.URL(link, cfg.Network.SharePort))
+	infof(cmd, "Expires %s. The daemon must be running to serve it; browsers will warn about its self-signed certificate.\n", fileutil.FormatClock(link.ExpiresAt))
+	return nil
+}
+
+func runExport(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	if reset, _ := cmd.Flags().GetBool("reset-password"); reset {
+		if _, err := share.ResetExportPassword(); err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			return printExportCredentials()
+		}
+	}
+
+	if len(args) == 0 {
+		exported := 0
+		for _, folder := range cfg.Folders {
+			if folder.ExportMode() == config.ExportOff {
+				continue
+			}
+			exported++
+			fmt.Printf("%s (%s)\n", folder.Path, folder.ExportMode())
+			fmt.Printf("  %s\n", share.ExportURL(folder, cfg.Network.SharePort))
+		}
+		if exported == 0 {
+			fmt.Println("No folders are exported.")
+			return nil
+		}
+		return printExportCredentials()
+	}
+
+	folder := cfg.GetFolder(args[0])
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", args[0])
+	}
+
+	if len(args) == 1 {
+		fmt.Printf("%s: %s\n", folder.Path, folder.ExportMode())
+		return nil
+	}
+
+	if err := cfg.SetExport(args[0], args[1]); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	if args[1] == config.ExportOff {
+		fmt.Printf("%s is no longer exported\n", folder.Path)
+		fmt.Println("Restart the daemon for this to take effect.")
+		return nil
+	}
+
+	if cfg.Network.SharePort <= 0 {
+		fmt.Printf("Exports are served on network.share_port, which is 0; set it, e.g. to %d, to serve them.\n", config.SuggestedSharePort())
+	}
+	fmt.Println(share.ExportURL(*folder, cfg.Network.SharePort))
+	if err := printExportCredentials(); err != nil {
+		return err
+	}
+	fmt.Println("Restart the daemon for this to take effect.")
+	return nil
+}
+
+// printExportCredentials prints the login for exported folders
+func printExportCredentials() error {
+	user, password, err := share.ExportCredentials()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("User: %s  Password: %s\n", user, password)
+	return nil
+}
+
+func runExplain(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	x, err := sync.Explain(cfg, args[0])
+	if err != nil {
+		return withExitCode(exitUsage, err)
+	}
+
+	fmt.Printf("%s\n\n", x.Path)
+	for _, step := range x.Steps {
+		mark := "ok"
+		if !step.OK {
+			mark = "NO"
+		}
+		fmt.Printf("  [%s] %-13s %s\n", mark, step.Check+":", step.Detail)
+	}
+
+	blockers := x.Blockers()
+	if len(blockers) == 0 {
+		fmt.Printf("\nThis file is syncing.\n")
+		return nil
+	}
+	reasons := make([]string, len(blockers))
+	for i, step := range blockers {
+		reasons[i] = step.Check
+	}
+	fmt.Printf("\nNot fully syncing: %s\n", strings.Join(reasons, ", "))
+	return nil
+}
+
+func runCompare(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	folder := cfg.GetFolder(args[0])
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", args[0])
+	}
+	otherDir, err := filepath.Abs(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid directory: %w", err)
+	}
+
+	preview, err := sync.CompareFolder(cfg, folder.Path, otherDir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s (with %s)\n", folder.Path, otherDir)
+	if preview.Total() == 0 {
+		fmt.Println("  No differences")
+		return nil
+	}
+	printPreview("only in "+folder.Path, preview.OnlyLocal)
+	printPreview("only in "+otherDir, preview.OnlyRemote)
+	printPreview("newer in "+folder.Path, preview.LocalNewer)
+	printPreview("newer in "+otherDir, preview.RemoteNewer)
+	return nil
+}
+
+func runPreview(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	var folders []string
+	if len(args) > 0 {
+		folder := cfg.GetFolder(args[0])
+		if folder == nil {
+			return fmt.Errorf("folder not found: %s", args[0])
+		}
+		folders = append(folders, folder.Path)
+	} else {
+		folders = enabledFolders(cfg)
+	}
+	if len(folders) == 0 {
+		return fmt.Errorf("no folders to preview")
+	}
+
+	// The daemon would sync for real alongside the preview
+	if pid := config.DaemonPID(); pid != 0 {
+		return fmt.Errorf("daemon is running (pid %d); stop it first, or restart it with --safe-mode and use 'plan'", pid)
+	}
+
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	previews, failures, err := previewFolders(cmd, cfg, folders, timeout)
+	if err != nil {
+		return err
+	}
+
+	for _, folderPath := range folders {
+		fmt.Println()
+		preview := previews[folderPath]
+		if preview == nil {
+			fmt.Printf("%s\n  %v\n", folderPath, failures[folderPath])
+			continue
+		}
+
+		peer := cfg.PeerLabel(preview.PeerName)
+		fmt.Printf("%s (with %s)\n", folderPath, peer)
+		if preview.Total() == 0 {
+			fmt.Println("  Already in sync")
+			continue
+		}
+		printPreview("to send", planPaths(preview.Sends))
+		printPreview("to receive", planPaths(preview.Receives))
+		printPreview("to delete on this Mac", planPaths(preview.Deletes))
+		printPreview("to delete on "+peer, planPaths(preview.PeerDeletes))
+		printPreview("in conflict", planPaths(preview.Conflicts))
+		if preview.FirstSync {
+			fmt.Println("  First sync: nothing is deleted on either side")
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("no file list for %d folder(s) within %s: %w", len(failures), timeout, sync.ErrPeerOffline)
+	}
+	return nil
+}
+
+// enabledFolders returns the paths of the folders that sync
+func enabledFolders(cfg *config.Config) []string {
+	var folders []string
+	for _, folder := range cfg.Folders {
+		if folder.Enabled {
+			folders = append(folders, folder.Path)
+		}
+	}
+	return folders
+}
+
+// previewFolders connects to peers without starting the engine, waits up to
+// timeout for their file lists, and works out what syncing each folder would
+// do. Folders that got no list are returned in failures.
+func previewFolders(cmd *cobra.Command, cfg *config.Config, folders []string, timeout time.Duration) (map[string]*sync.SyncPreview, map[string]error, error) {
+	if verbose, _ := cmd.Flags().GetBool("verbose"); !verbose {
+		zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	}
+
+	// Connect out to peers without announcing this Mac
+	server := network.NewServer(cfg.Network.Port, nil)
+	client := network.NewClient(nil)
+	disc := discovery.NewDiscovery(cfg.Device.Name, cfg.Network.Port, cfg.Network.UseDiscovery, cfg.Network.ManualPeers)
+	if err := disc.SetAdvertisement(cfg.Network.MDNSInstanceName, false, cfg.Network.MDNSInterfaces); err != nil {
+		return nil, nil, fmt.Errorf("invalid mDNS settings: %w", err)
+	}
+	if cfg.Network.TailscaleDiscovery {
+		disc.EnableTailscale(cfg.Network.TailscaleSocket)
+	}
+
+	// Only file lists are exchanged; nothing is transferred, deleted or saved
+	engine, err := sync.NewEngine(cfg, server, client)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create sync engine: %w", err)
+	}
+
+	disc.SetCallbacks(
+		func(peer *discovery.Peer) {
+			go func() {
+				if _, err := client.Connect(peer.Address()); err != nil {
+					log.Debug().Err(err).Str("peer_id", peer.Name).Msg("Failed to connect to peer")
+				}
+			}()
+		},
+		func(peer *discovery.Peer) {},
+	)
+	engine.StartPreview()
+	defer engine.StopPreview()
+	if err := disc.Start(); err != nil {
+		return nil, nil, fmt.Errorf("failed to start discovery: %w", err)
+	}
+	defer disc.Stop()
+
+	// Stderr, so a plan printed to stdout stays valid JSON
+	if !isQuiet(cmd) {
+		fmt.Fprintf(os.Stderr, "Waiting up to %s for peers' file lists...\n", timeout)
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		listed := 0
+		for _, folderPath := range folders {
+			if engine.RemoteBrowse(folderPath) != nil {
+				listed++
+			}
+		}
+		if listed == len(folders) {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	previews := make(map[string]*sync.SyncPreview)
+	failures := make(map[string]error)
+	for _, folderPath := range folders {
+		preview, err := engine.Preview(folderPath)
+		if err != nil {
+			failures[folderPath] = err
+			continue
+		}
+		previews[folderPath] = preview
+	}
+	return previews, failures, nil
+}
+
+// planPaths returns the paths of plan items
+func planPaths(items []sync.PlanItem) []string {
+	paths := make([]string, len(items))
+	for i, item := range items {
+		paths[i] = item.RelPath
+	}
+	return paths
+}
+
+func runSnapshots(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	action := "list"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	switch action {
+	case "list":
+		folderPath := ""
+		if len(args) > 1 {
+			folder := cfg.GetFolder(args[1])
+			if folder == nil {
+				return fmt.Errorf("folder not found: %s", args[1])
+			}
+			folderPath = folder.Path
+		}
+		snapshots, err := sync.ListSnapshots(folderPath)
+		if err != nil {
+			return err
+		}
+		if len(snapshots) == 0 {
+			fmt.Println("No snapshots.")
+			return nil
+		}
+		for _, snap := range snapshots {
+			fmt.Printf("%s  %s  %s (%s)\n", snap.ID, fileutil.FormatDateTimeSeconds(snap.CreatedAt), snap.FolderPath, snap.Reason)
+		}
+
+	case "create":
+		if len(args) < 2 {
+			return withExitCode(exitUsage, fmt.Errorf("create needs a folder"))
+		}
+		folder := cfg.GetFolder(args[1])
+		if folder == nil {
+			return fmt.Errorf("folder not found: %s", args[1])
+		}
+		snap, err := sync.CreateSnapshot(folder.Path, "taken manually", 0)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created snapshot %s\n", snap.ID)
+
+	case "restore":
+		if len(args) < 2 {
+			return withExitCode(exitUsage, fmt.Errorf("restore needs a snapshot id"))
+		}
+		before, err := sync.RestoreSnapshot(args[1])
+		if before != nil {
+			fmt.Printf("Saved the folder as it was in snapshot %s\n", before.ID)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Restored %s. A running daemon sends the restored files to peers.\n", args[1])
+
+	default:
+		return withExitCode(exitUsage, fmt.Errorf("unknown action %q: use list, create, or restore", action))
+	}
+	return nil
+}
+
+func runVersions(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	action := "list"
+	if len(args) > 0 && (args[0] == "list" || args[0] == "restore") {
+		action, args = args[0], args[1:]
+	}
+	if len(args) == 0 {
+		return withExitCode(exitUsage, fmt.Errorf("%s needs a file or folder path", action))
+	}
+
+	absPath, err := filepath.Abs(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid path: %w", err)
+	}
+	folder, relPath := cfg.FolderContaining(absPath)
+	if folder == nil {
+		return fmt.Errorf("%s is not in a synced folder", args[0])
+	}
+	if relPath == "." {
+		relPath = ""
+	}
+
+	switch action {
+	case "list":
+		if len(args) > 1 {
+			return withExitCode(exitUsage, fmt.Errorf("list takes only a path"))
+		}
+		versions, err := sync.ListVersions(folder.Path, relPath)
+		if err != nil {
+			return err
+		}
+		if len(versions) == 0 {
+			fmt.Println("No previous versions.")
+			return nil
+		}
+		for _, v := range versions {
+			fmt.Printf("%s  %s  %s  modified %s\n", v.ID, v.RelPath, fileutil.FormatSize(v.Size), fileutil.FormatDateTimeSeconds(v.ModTime))
+		}
+
+	case "restore":
+		if len(args) < 2 || relPath == "" {
+			return withExitCode(exitUsage, fmt.Errorf("restore needs a file and a version"))
+		}
+		if err := sync.RestoreVersion(folder.Path, relPath, args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Restored %s to version %s. The version it replaced was kept. A running daemon sends the restored file to peers.\n", relPath, args[1])
+	}
+	return nil
+}
+
+func runApprove(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	pending, err := sync.LoadPlan(sync.ApprovalsPath())
+	if err != nil || pending.Len() == 0 {
+		fmt.Println("No changes are waiting for approval.")
+		return nil
+	}
+
+	folderPath := ""
+	if len(args) > 0 {
+		folder := cfg.GetFolder(args[0])
+		if folder == nil {
+			return fmt.Errorf("folder not found: %s", args[0])
+		}
+		folderPath = folder.Path
+	}
+	files := make(map[string]bool)
+	for _, f := range args[1:] {
+		files[f] = true
+	}
+
+	selected := pending.Filter(func(item sync.PlanItem) bool {
+		if folderPath != "" && item.FolderPath != folderPath {
+			return false
+		}
+		return len(files) == 0 || files[item.RelPath]
+	})
+
+	all, _ := cmd.Flags().GetBool("all")
+	if !all && len(files) == 0 {
+		printStaged("add", selected.Adds)
+		printStaged("update", selected.Updates)
+		printStaged("delete", selected.Deletes)
+		printStaged("conflict", selected.Conflicts)
+		fmt.Println("\nApprove with: mac-profile-sync approve <folder> <file...> or --all")
+		return nil
+	}
+
+	if selected.Len() == 0 {
+		return fmt.Errorf("no matching staged changes")
+	}
+
+	resolution, _ := cmd.Flags().GetString("resolution")
+	for i := range selected.Conflicts {
+		selected.Conflicts[i].Resolution = sync.ConflictResolution(resolution)
+	}
+
+	if err := sync.QueuePlan(selected); err != nil {
+		return err
+	}
+
+	fmt.Printf("Approved %d change(s). The running daemon applies them within a few seconds.\n", selected.Len())
+	if len(selected.Conflicts) > 0 && resolution == "" {
+		fmt.Println("Conflicts stay staged until approved with --resolution.")
+	}
+	return nil
+}
+
+// printStaged prints staged changes of one kind
+func printStaged(action string, items []sync.PlanItem) {
+	for _, item := range items {
+		fmt.Printf("  %-8s %s  (%s)\n", action, filepath.Join(item.FolderPath, item.RelPath), item.Reason)
+	}
+}
+
+func runPlan(cmd *cobra.Command, args []string) error {
+	plan, err := loadOrMakePlan(cmd)
+	if err != nil {
+		return err
+	}
+
+	output, _ := cmd.Flags().GetString("output")
+	if output != "" {
+		if err := sync.WritePlan(output, plan); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %d change(s) to %s\n", plan.Len(), output)
+		return nil
+	}
+
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal plan: %w", err)
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// loadOrMakePlan returns the plan a safe-mode daemon recorded or, with the
+// daemon stopped, makes one by exchanging file lists with peers
+func loadOrMakePlan(cmd *cobra.Command) (*sync.Plan, error) {
+	if pid := config.DaemonPID(); pid != 0 {
+		plan, err := sync.LoadPlan(sync.PlanPath())
+		if err != nil {
+			return nil, fmt.Errorf("the daemon (pid %d) has recorded no change plan; restart it with --safe-mode, or stop it to make one: %w", pid, err)
+		}
+		return plan, nil
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	folders := enabledFolders(cfg)
+	if len(folders) == 0 {
+		return nil, fmt.Errorf("no folders to plan")
+	}
+
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	previews, failures, err := previewFolders(cmd, cfg, folders, timeout)
+	if err != nil {
+		return nil, err
+	}
+	for folderPath, err := range failures {
+		fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", folderPath, err)
+	}
+
+	list := make([]*sync.SyncPreview, 0, len(previews))
+	for _, folderPath := range folders {
+		if preview := previews[folderPath]; preview != nil {
+			list = append(list, preview)
+		}
+	}
+	return sync.PlanFromPreviews(cfg.Device.Name, list), nil
+}
+
+func runApply(cmd *cobra.Command, args []string) error {
+	path, _ := cmd.Flags().GetString("plan")
+	plan, err := sync.LoadPlan(path)
+	if err != nil {
+		return err
+	}
+
+	if err := sync.QueuePlan(plan); err != nil {
+		return err
+	}
+
+	if wait, _ := cmd.Flags().GetBool("wait"); !wait {
+		fmt.Printf("Queued %d change(s).\n", plan.Len())
+		infof(cmd, "The running daemon applies them within a few seconds; files modified since the plan was made are skipped.\n")
+		return nil
+	}
+
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	status, err := waitForApply(cmd, timeout)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Applied %d of %d change(s), skipped %d.\n", status.Applied, status.Total, status.Skipped)
+	if status.Skipped > 0 {
+		return exitWith(exitPartial)
+	}
+	return nil
+}
+
+// waitForApply follows the daemon's progress through a queued plan
+func waitForApply(cmd *cobra.Command, timeout time.Duration) (*sync.ApplyStatus, error) {
+	bar := newProgressBar(cmd, "Applying")
+	defer bar.Finish()
+
+	start := time.Now()
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		status, err := sync.LoadApplyStatus()
+		if err == nil {
+			bar.Update(status.Done, status.Total)
+			if status.Finished() {
+				return status, nil
+			}
+		} else if time.Since(start) > 15*time.Second {
+			// The daemon checks for queued plans every few seconds
+			return nil, errors.New("the daemon didn't pick up the plan; is it running?")
+		}
+
+		if time.Since(start) > timeout {
+			return nil, fmt.Errorf("timed out after %s waiting for the daemon", timeout)
+		}
+	}
+}
+
+// printPreview prints a reconciliation preview section, truncated to a few paths
+func printPreview(label string, paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+
+	const maxShown = 10
+	fmt.Printf("  %d file(s) %s:\n", len(paths), label)
+	for i, p := range paths {
+		if i == maxShown {
+			fmt.Printf("    ... and %d more\n", len(paths)-maxShown)
+			break
+		}
+		fmt.Printf("    %s\n", p)
+	}
+}
+
+func runRelay(cmd *cobra.Command, args []string) error {
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+
+	listen, _ := cmd.Flags().GetString("listen")
+	relay := network.NewRelay(listen)
+	if err := relay.Start(); err != nil {
+		return err
+	}
+	defer relay.Stop()
+
+	fmt.Printf("Relay listening on %s. Press Ctrl+C to stop.\n", listen)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+
+	return nil
+}
+
+// printKnownPeers describes every peer this Mac has synced with, online or not
+func printKnownPeers(cfg *config.Config, peers []*sync.KnownPeer) {
+	if len(peers) == 0 {
+		return
+	}
+
+	connected := make(map[string]sync.PeerStatus)
+	if statuses, err := sync.LoadPeerStatus(); err == nil {
+		for _, p := range statuses {
+			connected[p.Name] = p
+		}
+	}
+
+	fmt.Printf("Known peers:\n")
+	for _, p := range peers {
+		seen := "last seen " + fileutil.FormatTime(p.LastSeen)
+		status, online := connected[p.Name]
+		if online {
+			seen = "connected"
+		}
+		version := "unknown version"
+		if p.Version != "" {
+			version = "protocol " + p.Version
+			if caps := p.Capabilities(); len(caps) > 0 {
+				version += " (" + strings.Join(caps, ", ") + ")"
+			}
+		}
+		name := p.Name
+		if label := cfg.PeerLabel(p.Name); label != p.Name {
+			name = fmt.Sprintf("%s (%s)", label, p.Name)
+		}
+		fmt.Printf("  %s - %s, %s\n", name, seen, version)
+
+		if len(p.Addresses) > 0 {
+			fmt.Printf("    Addresses: %s\n", strings.Join(p.Addresses, ", "))
+		}
+		if p.RTT > 0 {
+			fmt.Printf("    Latency: %s\n", p.RTT.Round(time.Millisecond))
+		}
+		if online {
+			fmt.Printf("    Send queue: %d of %d messages (peak %d), %s sent, %s dropped\n",
+				status.Queue.Depth, status.Queue.Capacity, status.Queue.MaxDepth, fileutil.FormatCount(int64(status.Queue.Sent)), fileutil.FormatCount(int64(status.Queue.Dropped)))
+		}
+		fmt.Printf("    Sent %s files (%s), received %s files (%s) over %s connections\n",
+			fileutil.FormatCount(int64(p.FilesSent)), fileutil.FormatSize(p.BytesSent), fileutil.FormatCount(int64(p.FilesReceived)), fileutil.FormatSize(p.BytesReceived), fileutil.FormatCount(int64(p.Connections)))
+	}
+	fmt.Println()
+}
+
+func runPeers(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	known := sync.NewPeerStore()
+	if err := known.Load(); err != nil {
+		return err
+	}
+
+	if len(args) > 0 && args[0] == "rename" {
+		if len(args) < 2 {
+			return withExitCode(exitUsage, fmt.Errorf("rename needs a peer name"))
+		}
+		nickname := ""
+		if len(args) > 2 {
+			nickname = args[2]
+		}
+		icon, _ := cmd.Flags().GetString("icon")
+		if err := cfg.SetPeerNickname(args[1], nickname, icon); err != nil {
+			return withExitCode(exitUsage, err)
+		}
+		if nickname == "" && icon == "" {
+			fmt.Printf("%s is shown by its device name again.\n", args[1])
+		} else {
+			fmt.Printf("%s is now shown as %s.\n", args[1], cfg.PeerLabel(args[1]))
+		}
+		return nil
+	}
+
+	if len(args) > 0 {
+		if args[0] != "forget" {
+			return withExitCode(exitUsage, fmt.Errorf("unknown action %q: use forget or rename", args[0]))
+		}
+		if len(args) < 2 {
+			return withExitCode(exitUsage, fmt.Errorf("forget needs a peer name"))
+		}
+		if !known.Forget(args[1]) {
+			return fmt.Errorf("no known peer named %s", args[1])
+		}
+		if err := known.Save(); err != nil {
+			return err
+		}
+		fmt.Printf("Forgot %s. It is remembered again if it connects.\n", args[1])
+		return nil
+	}
+
+	printKnownPeers(cfg, known.List())
+
+	fmt.Printf("Searching for peers...\n")
+
+	// Create discovery service
+	disc := discovery.NewDiscovery(
+		cfg.Device.Name,
+		cfg.Network.Port,
+		cfg.Network.UseDiscovery,
+		cfg.Network.ManualPeers,
+	)
+	if err := disc.SetAdvertisement(cfg.Network.MDNSInstanceName, cfg.Network.MDNSAdvertise, cfg.Network.MDNSInterfaces); err != nil {
+		return fmt.Errorf("invalid mDNS settings: %w", err)
+	}
+	disc.SetOwner(config.Owner())
+	if cfg.Network.TailscaleDiscovery {
+		disc.EnableTailscale(cfg.Network.TailscaleSocket)
+	}
+	if cfg.Network.BeaconDiscovery {
+		disc.EnableBeacon(cfg.Network.BeaconPort)
+	}
+
+	disc.SetCallbacks(
+		func(peer *discovery.Peer) {
+			fmt.Printf("  Found: %s (%s)\n", cfg.PeerLabel(peer.Name), peer.Address())
+		},
+		nil,
+	)
+
+	if err := disc.Start(); err != nil {
+		return fmt.Errorf("failed to start discovery: %w", err)
+	}
+	defer disc.Stop()
+
+	// Wait for discovery
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	fmt.Println("Press Ctrl+C to stop...")
+	<-sigCh
+
+	return nil
+}
+
+func runDebugTrace(cmd *cobra.Command, args []string) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	traces, err := sync.LoadPeerTraces(cfg, args[0])
+	if err != nil {
+		return fmt.Errorf("no traces published, is the daemon running? (%w)", err)
+	}
+	if len(traces) == 0 {
+		return fmt.Errorf("%s: %w", args[0], sync.ErrPeerOffline)
+	}
+	last, _ := cmd.Flags().GetInt("last")
+
+	for _, t := range traces {
+		fmt.Printf("%s (%s, %s) - connected %s\n", cfg.PeerLabel(t.Name), t.Address, t.Direction, fileutil.FormatTime(t.Since))
+
+		types := make([]string, 0, len(t.Types))
+		for name := range t.Types {
+			types = append(types, name)
+		}
+		sort.Strings(types)
+
+		fmt.Printf("  %-16s %8s %10s %8s %10s %10s %10s\n", "TYPE", "SENT", "BYTES", "RECV", "BYTES", "WRITE", "HANDLE")
+		for _, name := range types {
+			s := t.Types[name]
+			fmt.Printf("  %-16s %8d %10s %8d %10s %10s %10s\n", name,
+				s.Sent, fileutil.FormatSize(s.BytesSent), s.Received, fileutil.FormatSize(s.BytesReceived),
+				s.WriteTime.Round(time.Millisecond), s.HandleTime.Round(time.Millisecond))
+		}
+
+		if len(t.Trace) == 0 {
+			fmt.Println("  Message tracing is off: set logging.trace_messages to keep recent messages")
+			fmt.Println()
+			continue
+		}
+
+		entries := t.Trace
+		if last > 0 && len(entries) > last {
+			entries = entries[len(entries)-last:]
+		}
+		fmt.Printf("\n  Last %d messages:\n", len(entries))
+		for _, e := range entries {
+			timing := ""
+			if e.Queued > 0 {
+				timing += " queued " + e.Queued.Round(time.Microsecond).String()
+			}
+			if e.Took > 0 {
+				timing += " took " + e.Took.Round(time.Microsecond).String()
+			}
+			fmt.Printf("  %s %-3s %-16s %10s%s\n", e.Time.Format("15:04:05.000"), e.Dir, e.Type, fileutil.FormatSize(int64(e.Size)), timing)
+		}
+		fmt.Println()
+	}
 	return nil
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jseidel/mac-profile-sync/internal/sync"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// Exit codes shared by all commands, so scripts can tell outcomes apart
+const (
+	exitOK      = 0 // Everything succeeded
+	exitFailure = 1 // The command failed
+	exitUsage   = 2 // Invalid arguments or flags
+	exitPartial = 3 // The command finished, but some items were skipped
+	exitOffline = 4 // A peer the command needs isn't connected
+	exitRefused = 5 // The path is ignored, too large, or has a pending conflict, or a peer refused this Mac
+)
+
+// exitError carries a specific exit code out of a command. Without an
+// underlying error nothing is printed; the command already reported why.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return ""
+	}
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error { return e.err }
+
+// withExitCode attaches an exit code to an error
+func withExitCode(code int, err error) error {
+	return &exitError{code: code, err: err}
+}
+
+// exitWith ends a command with an exit code but no error message
+func exitWith(code int) error {
+	return &exitError{code: code}
+}
+
+// usageArgs marks argument validation errors as usage errors
+func usageArgs(args cobra.PositionalArgs) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, a []string) error {
+		if err := args(cmd, a); err != nil {
+			_ = cmd.Usage()
+			return withExitCode(exitUsage, err)
+		}
+		return nil
+	}
+}
+
+// exitCode returns the process exit code for a command's error
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+	switch {
+	case errors.Is(err, sync.ErrPeerOffline):
+		return exitOffline
+	case errors.Is(err, sync.ErrIgnored), errors.Is(err, sync.ErrTooLarge),
+		errors.Is(err, sync.ErrConflictPending), errors.Is(err, sync.ErrUnauthorized):
+		return exitRefused
+	}
+	return exitFailure
+}
+
+// isQuiet reports whether a command should print only its final summary line
+func isQuiet(cmd *cobra.Command) bool {
+	quiet, _ := cmd.Flags().GetBool("quiet")
+	return quiet
+}
+
+// infof prints informational output unless --quiet is set
+func infof(cmd *cobra.Command, format string, args ...interface{}) {
+	if !isQuiet(cmd) {
+		fmt.Printf(format, args...)
+	}
+}
+
+// progressBar draws a single-line progress bar on stderr. It stays silent
+// with --quiet or when stderr isn't a terminal, so output piped into scripts
+// and logs only carries the summary.
+type progressBar struct {
+	out     io.Writer
+	label   string
+	enabled bool
+	drawn   bool
+}
+
+const progressWidth = 30
+
+func newProgressBar(cmd *cobra.Command, label string) *progressBar {
+	return &progressBar{
+		out:     os.Stderr,
+		label:   label,
+		enabled: !isQuiet(cmd) && term.IsTerminal(int(os.Stderr.Fd())),
+	}
+}
+
+// Update redraws the bar for done out of total items
+func (p *progressBar) Update(done, total int) {
+	if !p.enabled || total <= 0 {
+		return
+	}
+	if done > total {
+		done = total
+	}
+
+	filled := progressWidth * done / total
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressWidth-filled)
+	fmt.Fprintf(p.out, "\r%s [%s] %d/%d (%d%%)", p.label, bar, done, total, 100*done/total)
+	p.drawn = true
+}
+
+// Finish ends the bar's line so following output starts cleanly
+func (p *progressBar) Finish() {
+	if p.drawn {
+		fmt.Fprintln(p.out)
+		p.drawn = false
+	}
+}
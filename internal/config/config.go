@@ -4,8 +4,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
 	"github.com/spf13/viper"
 )
 
@@ -16,6 +19,9 @@ type Config struct {
 	Sync     SyncConfig     `mapstructure:"sync"`
 	Network  NetworkConfig  `mapstructure:"network"`
 	Security SecurityConfig `mapstructure:"security"`
+	Logging  LoggingConfig  `mapstructure:"logging"`
+	Display  DisplayConfig  `mapstructure:"display"`
+	Peers    []PeerConfig   `mapstructure:"peers"`
 }
 
 // DeviceConfig identifies this device
@@ -25,17 +31,303 @@ type DeviceConfig struct {
 
 // FolderConfig defines a folder to sync
 type FolderConfig struct {
-	Path    string `mapstructure:"path"`
-	Enabled bool   `mapstructure:"enabled"`
+	Path       string   `mapstructure:"path"`
+	Enabled    bool     `mapstructure:"enabled"`
+	Subfolders []string `mapstructure:"subfolders"` // Subfolders to sync, e.g. "Work" or "Work/Clients" (empty = all)
+	Excluded   []string `mapstructure:"excluded"`   // Subfolders not synced, kept on this Mac only, e.g. "VMs"
+	Approval   string   `mapstructure:"approval"`   // auto (default) | manual
+	Priority   string   `mapstructure:"priority"`   // high | normal (default) | low - share of transfers across folders
+	Export     string   `mapstructure:"export"`     // off (default) | local | lan - browse read-only on share_port
+
+	SharedIgnore bool     `mapstructure:"shared_ignore" yaml:"shared_ignore"` // Honor the folder's synced .mpsignore file
+	LocalIgnore  []string `mapstructure:"local_ignore" yaml:"local_ignore"`   // Patterns ignored on this Mac only
+
+	PrivateIgnoreFile bool `mapstructure:"private_ignore_file" yaml:"private_ignore_file"` // Keep .mpsignore on this Mac instead of syncing it
+
+	RescanInterval int `mapstructure:"rescan_interval" yaml:"rescan_interval"` // Minutes between full rescans (0 = sync.rescan_interval, -1 = never)
+
+	FinderViews bool `mapstructure:"finder_views" yaml:"finder_views"` // Sync .DS_Store so Finder icon positions and views match, newest wins
+
+	Watch string `mapstructure:"watch_mode" yaml:"watch_mode"` // auto (default) | fsevents | poll | portable - how changes are noticed
+
+	ChangeDetection string `mapstructure:"change_detection" yaml:"change_detection"` // hash (default) | size_mtime | hybrid - how changed files are told apart
+
+	Name string `mapstructure:"name" yaml:"name"` // Name peers match the folder by (default: its base name, ~ for the home folder)
+
+	ApplyConcurrency int `mapstructure:"apply_concurrency" yaml:"apply_concurrency"` // Received files written at once (0 = no limit), e.g. 1 for a spinning disk
+	ApplyRate        int `mapstructure:"apply_rate" yaml:"apply_rate"`               // Received files written per second (0 = no limit)
+}
+
+// PeerConfig holds transfer limits and how to show one peer, matched by
+// device name
+type PeerConfig struct {
+	Name                   string `mapstructure:"name"`
+	Nickname               string `mapstructure:"nickname"`                                                 // Shown instead of the device name
+	Icon                   string `mapstructure:"icon"`                                                     // Emoji shown before the name
+	MaxConcurrentTransfers int    `mapstructure:"max_concurrent_transfers" yaml:"max_concurrent_transfers"` // 0 = sync.max_concurrent_transfers
+	MaxUploadKbps          int    `mapstructure:"max_upload_kbps" yaml:"max_upload_kbps"`                   // 0 = no per-peer cap
+	MaxDownloadKbps        int    `mapstructure:"max_download_kbps" yaml:"max_download_kbps"`               // 0 = no per-peer cap
+}
+
+// HasLimits reports whether any transfer limit is set for the peer
+func (p PeerConfig) HasLimits() bool {
+	return p.MaxConcurrentTransfers > 0 || p.MaxUploadKbps > 0 || p.MaxDownloadKbps > 0
+}
+
+// Approval modes for incoming changes
+const (
+	ApprovalAuto   = "auto"   // Apply peer changes immediately
+	ApprovalManual = "manual" // Stage peer changes until approved
+)
+
+// RequiresApproval returns true if peer changes must be approved before applying
+func (f FolderConfig) RequiresApproval() bool {
+	return f.Approval == ApprovalManual
+}
+
+// Transfer priorities for a folder
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// Read-only export modes for a folder
+const (
+	ExportOff   = "off"   // Not exported
+	ExportLocal = "local" // Browsable from this Mac only
+	ExportLAN   = "lan"   // Browsable from other devices on the network
+)
+
+// ExportMode returns how a folder is exported for browsing
+func (f FolderConfig) ExportMode() string {
+	switch f.Export {
+	case ExportLocal, ExportLAN:
+		return f.Export
+	default:
+		return ExportOff
+	}
+}
+
+// How a folder's changes are noticed
+const (
+	WatchAuto     = "auto"     // File events, or polling on network volumes
+	WatchFSEvents = "fsevents" // File events from the system
+	WatchPoll     = "poll"     // Scanning the folder every sync.poll_interval
+	WatchPortable = "portable" // Not watched; synced only while its removable drive is mounted
+)
+
+// WatchMode returns how a folder's changes are noticed
+func (f FolderConfig) WatchMode() string {
+	switch f.Watch {
+	case WatchFSEvents, WatchPoll, WatchPortable:
+		return f.Watch
+	default:
+		return WatchAuto
+	}
+}
+
+// How a folder tells whether a file changed
+const (
+	DetectHash      = "hash"       // Hashing contents
+	DetectSizeMtime = "size_mtime" // Comparing size and mod time only; contents are never read to detect or verify changes
+	DetectHybrid    = "hybrid"     // Comparing size and mod time, hashing contents only to verify transfers
+)
+
+// ChangeDetectionMode returns how a folder tells whether a file changed
+func (f FolderConfig) ChangeDetectionMode() string {
+	switch f.ChangeDetection {
+	case DetectSizeMtime, DetectHybrid:
+		return f.ChangeDetection
+	default:
+		return DetectHash
+	}
+}
+
+// HashAlgorithm returns the algorithm a folder's files are hashed with to
+// tell whether they changed
+func (f FolderConfig) HashAlgorithm() string {
+	if f.ChangeDetectionMode() == DetectHash {
+		return fileutil.HashAlgorithm
+	}
+	return fileutil.SizeModTimeAlgorithm
+}
+
+// SyncName returns the name peers match the folder by: its name if set,
+// otherwise its base name, or ~ for the home folder
+func (f FolderConfig) SyncName() string {
+	if f.Name != "" {
+		return f.Name
+	}
+	if home, _ := os.UserHomeDir(); f.Path == home {
+		return "~"
+	}
+	return filepath.Base(f.Path)
+}
+
+// IsPortable returns true if the folder is on a drive that comes and goes
+func (f FolderConfig) IsPortable() bool {
+	return f.WatchMode() == WatchPortable
+}
+
+// PriorityWeight is a folder's share of transfers with a peer relative to
+// other folders: high gets twice normal's share, normal twice low's
+func (f FolderConfig) PriorityWeight() int {
+	switch f.Priority {
+	case PriorityHigh:
+		return 4
+	case PriorityLow:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// HasApplyLimits reports whether writing received files to the folder is
+// throttled
+func (f FolderConfig) HasApplyLimits() bool {
+	return f.ApplyConcurrency > 0 || f.ApplyRate > 0
+}
+
+// IsSparse returns true if only part of the folder is synced: some subfolders
+// are selected, or some are excluded
+func (f FolderConfig) IsSparse() bool {
+	return len(f.Subfolders) > 0 || len(f.Excluded) > 0
+}
+
+// IncludesPath reports whether a path relative to the folder root is part of
+// the sparse selection. Entries directly in the folder root are always
+// included unless excluded.
+func (f FolderConfig) IncludesPath(relPath string) bool {
+	if !f.IsSparse() {
+		return true
+	}
+	if !strings.Contains(filepath.ToSlash(filepath.Clean(relPath)), "/") {
+		return f.ExcludedBy(relPath) == ""
+	}
+	return f.IncludesDir(relPath)
+}
+
+// IncludesDir reports whether a directory relative to the folder root should be
+// walked, i.e. it is, is inside, or leads to a selected subfolder, and isn't
+// excluded
+func (f FolderConfig) IncludesDir(relDir string) bool {
+	if !f.IsSparse() {
+		return true
+	}
+	if f.ExcludedBy(relDir) != "" {
+		return false
+	}
+	if len(f.Subfolders) == 0 {
+		return true
+	}
+
+	dir := filepath.ToSlash(filepath.Clean(relDir))
+	for _, sub := range f.Subfolders {
+		if dir == sub || strings.HasPrefix(dir, sub+"/") || strings.HasPrefix(sub, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ExcludedBy returns the excluded subfolder a path relative to the folder root
+// is in, or "" if it isn't in one
+func (f FolderConfig) ExcludedBy(relPath string) string {
+	path := filepath.ToSlash(filepath.Clean(relPath))
+	for _, excluded := range f.Excluded {
+		if path == excluded || strings.HasPrefix(path, excluded+"/") {
+			return excluded
+		}
+	}
+	return ""
+}
+
+// IgnoresPath reports whether a path relative to the folder root matches one
+// of the folder's local-only ignore patterns
+func (f FolderConfig) IgnoresPath(relPath string) bool {
+	for _, pattern := range f.LocalIgnore {
+		if MatchIgnorePattern(pattern, relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchIgnorePattern reports whether a relative path is ignored by a pattern.
+// Patterns without a slash match any file or directory name (like
+// ignore_patterns); patterns with a slash match from the folder root, and a
+// matching directory ignores everything under it.
+func MatchIgnorePattern(pattern, relPath string) bool {
+	pattern = strings.Trim(filepath.ToSlash(pattern), "/")
+	relPath = filepath.ToSlash(relPath)
+	if pattern == "" {
+		return false
+	}
+
+	parts := strings.Split(relPath, "/")
+	if !strings.Contains(pattern, "/") {
+		for _, part := range parts {
+			if matched, _ := filepath.Match(pattern, part); matched {
+				return true
+			}
+		}
+		return false
+	}
+
+	depth := strings.Count(pattern, "/") + 1
+	if len(parts) < depth {
+		return false
+	}
+	matched, _ := filepath.Match(pattern, strings.Join(parts[:depth], "/"))
+	return matched
 }
 
 // SyncConfig defines sync behavior
 type SyncConfig struct {
-	Enabled            bool     `mapstructure:"enabled"`
-	Direction          string   `mapstructure:"direction"`
-	ConflictResolution string   `mapstructure:"conflict_resolution"`
-	IgnorePatterns     []string `mapstructure:"ignore_patterns"`
-	ExcludeDirs        []string `mapstructure:"exclude_dirs"`
+	Enabled                bool     `mapstructure:"enabled"`
+	Direction              string   `mapstructure:"direction"`
+	ConflictResolution     string   `mapstructure:"conflict_resolution"`
+	IncludePatterns        []string `mapstructure:"include_patterns"` // When set, only files matching one of these sync; checked before ignore_patterns
+	IgnorePatterns         []string `mapstructure:"ignore_patterns"`
+	ExcludeDirs            []string `mapstructure:"exclude_dirs"`
+	MaxConcurrentTransfers int      `mapstructure:"max_concurrent_transfers"`
+	LargeFileMB            int      `mapstructure:"large_file_mb"`          // Files at least this big transfer after everything else
+	ScanCommand            string   `mapstructure:"scan_command"`           // Run on each incoming file before it is applied (empty = no scan)
+	ScanTimeout            int      `mapstructure:"scan_timeout"`           // Seconds before a scan is treated as failed
+	TieBreak               string   `mapstructure:"tie_break"`              // hash | device - newest_wins winner when mod times are equal
+	DevicePriority         []string `mapstructure:"device_priority"`        // Device names, highest priority first (tie_break: device)
+	ClockSkewTolerance     int      `mapstructure:"clock_skew_tolerance"`   // Seconds apart newest_wins treats mod times as equal, after correcting for peers' clocks
+	PauseForTimeMachine    bool     `mapstructure:"pause_for_time_machine"` // Hold incoming changes while a Time Machine backup runs
+	SnapshotThreshold      int      `mapstructure:"snapshot_threshold"`     // Snapshot a folder before applying at least this many peer changes (0 = off)
+	SnapshotKeep           int      `mapstructure:"snapshot_keep"`          // Snapshots kept per folder
+	Deletes                string   `mapstructure:"deletes"`                // trash | permanent | archive - what happens to files peers delete
+	Versions               int      `mapstructure:"versions"`               // Previous versions kept per file when a peer's copy replaces it (0 = off)
+	VersionsMaxAge         int      `mapstructure:"versions_max_age"`       // Days a previous version is kept (0 = until pushed out by newer ones)
+	RescanInterval         int      `mapstructure:"rescan_interval"`        // Minutes between full rescans of each folder for changes the watcher missed (0 = off)
+	DeletionsMaxAge        int      `mapstructure:"deletions_max_age"`      // Days deletions are remembered for offline peers
+	DeletionsMaxCount      int      `mapstructure:"deletions_max_count"`    // Deletions remembered per folder for offline peers
+	DeletionsOverflow      string   `mapstructure:"deletions_overflow"`     // drop_oldest | pause | alert - what happens past either limit
+	MassDeleteFiles        int      `mapstructure:"mass_delete_files"`      // Hold a batch of local deletions of more files than this until approved (0 = off)
+	MassDeletePercent      int      `mapstructure:"mass_delete_percent"`    // Hold a batch of local deletions of more than this % of a folder until approved (0 = off)
+	ConfirmFirstSync       bool     `mapstructure:"confirm_first_sync"`     // Hold a folder's first sync with a peer until it is confirmed
+	MaxFileSize            string   `mapstructure:"max_file_size"`          // Files bigger than this (e.g. "4GB") aren't sent or received (empty = no limit)
+	MaxAge                 string   `mapstructure:"max_age"`                // Files last modified longer ago than this (e.g. "180d") aren't sent or received (empty = no limit)
+	MinFreeSpace           string   `mapstructure:"min_free_space"`         // Free space (e.g. "2GB") kept on a folder's volume; receiving pauses below it
+	ProtectDatabases       bool     `mapstructure:"protect_databases"`      // Sync SQLite databases only when consistent, never their -wal/-shm/-journal files
+	DatabaseSettle         int      `mapstructure:"database_settle"`        // Seconds a database must be unchanged before it is sent
+	AtomicPackages         bool     `mapstructure:"atomic_packages"`        // Sync apps, libraries and other packages as a whole, swapped in once complete
+	PackageSettle          int      `mapstructure:"package_settle"`         // Seconds a package must be unchanged before peers are told to fetch it
+	ChurnWrites            int      `mapstructure:"churn_writes"`           // Writes in a row, each within churn_settle, that mark a file as busy (0 = off)
+	ChurnSettle            int      `mapstructure:"churn_settle"`           // Seconds without a write before a busy file's changes are sent
+	ChurnMaxDelay          int      `mapstructure:"churn_max_delay"`        // Seconds a busy file still being written waits at most between sends
+	StableInterval         int      `mapstructure:"stable_interval"`        // Seconds a new or changed file's size and mtime must hold before it is sent (0 = off)
+	JournalMaxFiles        int      `mapstructure:"journal_max_files"`      // Changed files remembered per absent peer, sent when it reconnects (0 = off)
+	CheckOpenFiles         bool     `mapstructure:"check_open_files"`       // Also hold large files while a process has them open for writing
+	UnlockReadOnly         bool     `mapstructure:"unlock_readonly"`        // Unlock a locked (uchg) file or read-only directory to apply a peer's update, then lock it again
+	PollInterval           int      `mapstructure:"poll_interval"`          // Seconds between scans of folders watched by polling
+	Schedule               []string `mapstructure:"schedule"`               // Times to sync, e.g. ["18:00-08:00", "Sat,Sun 00:00-23:59"] (empty = any time)
+	QuietHours             []string `mapstructure:"quiet_hours"`            // Times never to sync, e.g. ["Mon-Fri 10:00-11:00"]
 }
 
 // SyncDirection represents the sync direction mode
@@ -45,13 +337,41 @@ const (
 	SyncBidirectional SyncDirection = "bidirectional" // Sync both ways (default)
 	SyncSendOnly      SyncDirection = "send_only"     // Only send files to peers
 	SyncReceiveOnly   SyncDirection = "receive_only"  // Only receive files from peers
+	SyncMaster        SyncDirection = "master"        // Only send, and restore files peers delete or move
 )
 
 // NetworkConfig defines network settings
 type NetworkConfig struct {
-	Port         int      `mapstructure:"port"`
-	UseDiscovery bool     `mapstructure:"use_discovery"`
-	ManualPeers  []string `mapstructure:"manual_peers"`
+	Port            int      `mapstructure:"port"`
+	UseDiscovery    bool     `mapstructure:"use_discovery"`
+	ManualPeers     []string `mapstructure:"manual_peers"`      // host:port, or a MagicDNS name / Tailscale IP (port optional)
+	SendQueueSize   int      `mapstructure:"send_queue_size"`   // Max queued outgoing messages per connection
+	SendQueuePolicy string   `mapstructure:"send_queue_policy"` // block | drop
+	MaxUploadKbps   int      `mapstructure:"max_upload_kbps"`   // 0 = unlimited
+	MaxDownloadKbps int      `mapstructure:"max_download_kbps"` // 0 = unlimited
+
+	ReceiveWindowMB    int `mapstructure:"receive_window_mb"`    // Unacknowledged file data peers may push to us
+	ReceiveWindowFiles int `mapstructure:"receive_window_files"` // Unacknowledged files peers may push to us
+
+	KeepaliveInterval int `mapstructure:"keepalive_interval"` // Seconds between pings (0 = disabled)
+	KeepaliveTimeout  int `mapstructure:"keepalive_timeout"`  // Seconds of silence before a peer is considered dead
+
+	RelayAddress string   `mapstructure:"relay_address"` // host:port of a relay (empty = no relay)
+	RelayPeers   []string `mapstructure:"relay_peers"`   // Device names to always reach through the relay
+	STUNServer   string   `mapstructure:"stun_server"`   // host:port used for hole punching to relay_peers (empty = relay only)
+
+	SharePort int `mapstructure:"share_port"` // HTTPS port for share links (0 = disabled, the default)
+
+	MDNSInstanceName string   `mapstructure:"mdns_instance_name"` // Name announced over Bonjour (empty = device name)
+	MDNSAdvertise    bool     `mapstructure:"mdns_advertise"`     // false = stealth: browse for peers without announcing
+	MDNSInterfaces   []string `mapstructure:"mdns_interfaces"`    // Interfaces to announce on, e.g. ["en0"] (empty = all)
+
+	TailscaleDiscovery bool   `mapstructure:"tailscale_discovery"` // Find peers on the tailnet via tailscaled
+	TailscaleSocket    string `mapstructure:"tailscale_socket"`    // tailscaled local API socket (empty = default)
+
+	BeaconDiscovery bool `mapstructure:"beacon_discovery"` // Find peers by UDP broadcast where mDNS is blocked
+	BeaconPort      int  `mapstructure:"beacon_port"`      // UDP port for beacons, the same on every Mac
+	Introducer      bool `mapstructure:"introducer"`       // Share this Mac's peers with every peer that connects
 }
 
 // SecurityConfig defines security settings
@@ -60,6 +380,45 @@ type SecurityConfig struct {
 	Encryption     bool `mapstructure:"encryption"`
 }
 
+// LoggingConfig defines daemon logging behavior
+type LoggingConfig struct {
+	MaxPerMinute  int  `mapstructure:"max_per_minute"`  // Repeats of one message logged per minute (0 = unlimited)
+	TraceMessages int  `mapstructure:"trace_messages"`  // Recent messages kept per connection for 'debug trace' (0 = counts only)
+	SplitByPeer   bool `mapstructure:"split_by_peer"`   // Also log each peer's lines to logs/peers/<device>.log
+	SplitByFolder bool `mapstructure:"split_by_folder"` // Also log each folder's lines to logs/folders/<folder>.log
+}
+
+// DisplayConfig sets how times and numbers are shown in the CLI and TUI
+type DisplayConfig struct {
+	Locale   string `mapstructure:"locale"`    // e.g. "en_GB", "de_DE" - date and number formats (empty = LC_ALL, LC_TIME or LANG)
+	TimeZone string `mapstructure:"time_zone"` // local | UTC | an IANA zone like "Europe/Berlin" - zone times are shown in
+}
+
+// FormatLocale returns the date and number formats times and sizes are shown with
+func (d DisplayConfig) FormatLocale() fileutil.Locale {
+	name := d.Locale
+	if name == "" {
+		name = fileutil.SystemLocale()
+	}
+	locale, _ := fileutil.LookupLocale(name)
+	return locale
+}
+
+// Location returns the time zone times are shown in
+func (d DisplayConfig) Location() (*time.Location, error) {
+	switch strings.ToLower(d.TimeZone) {
+	case "", "local":
+		return time.Local, nil
+	case "utc":
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(d.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q: %w", d.TimeZone, err)
+	}
+	return loc, nil
+}
+
 // ConflictStrategy represents how to handle conflicts
 type ConflictStrategy string
 
@@ -69,6 +428,45 @@ const (
 	ConflictPrompt     ConflictStrategy = "prompt"
 )
 
+// DeleteMode decides what happens to local files a peer deleted
+type DeleteMode string
+
+const (
+	DeleteTrash     DeleteMode = "trash"     // Move to the macOS Trash
+	DeletePermanent DeleteMode = "permanent" // Remove immediately
+	DeleteArchive   DeleteMode = "archive"   // Move to the folder's archive directory
+)
+
+// DeletionsOverflow decides what happens when a folder remembers more
+// deletions for offline peers than its limits allow
+type DeletionsOverflow string
+
+const (
+	OverflowDropOldest DeletionsOverflow = "drop_oldest" // Forget the oldest; peers that missed them are held for a full resync
+	OverflowPause      DeletionsOverflow = "pause"       // Stop sending the folder's changes until peers catch up
+	OverflowAlert      DeletionsOverflow = "alert"       // Keep everything and warn
+)
+
+// ArchiveDirName is the directory in each synced folder that deletes are
+// archived to. It never syncs.
+const ArchiveDirName = ".mps-archive"
+
+// VersionsDirName is the directory in each synced folder that previous
+// versions of files are kept in. It never syncs.
+const VersionsDirName = ".mps-versions"
+
+// FinderViewFile is where Finder keeps a folder's icon positions and view
+// settings. It only syncs in folders with finder_views on.
+const FinderViewFile = ".DS_Store"
+
+// TieBreak decides newest_wins conflicts when both versions have the same mod time
+type TieBreak string
+
+const (
+	TieBreakHash   TieBreak = "hash"   // Higher content hash wins
+	TieBreakDevice TieBreak = "device" // Earlier device in device_priority wins
+)
+
 var (
 	configDir  string
 	configFile string
@@ -123,6 +521,31 @@ func Load() (*Config, error) {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
 
+	for key, size := range map[string]string{"max_file_size": cfg.Sync.MaxFileSize, "min_free_space": cfg.Sync.MinFreeSpace} {
+		if size == "" {
+			continue
+		}
+		if _, err := fileutil.ParseSize(size); err != nil {
+			return nil, fmt.Errorf("failed to parse sync.%s: %w", key, err)
+		}
+	}
+	if cfg.Sync.MaxAge != "" {
+		if _, err := fileutil.ParseAge(cfg.Sync.MaxAge); err != nil {
+			return nil, fmt.Errorf("failed to parse sync.max_age: %w", err)
+		}
+	}
+	for key, windows := range map[string][]string{"schedule": cfg.Sync.Schedule, "quiet_hours": cfg.Sync.QuietHours} {
+		if _, err := parseWindows(windows); err != nil {
+			return nil, fmt.Errorf("failed to parse sync.%s: %w", key, err)
+		}
+	}
+
+	zone, err := cfg.Display.Location()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse display.time_zone: %w", err)
+	}
+	fileutil.SetDisplay(cfg.Display.FormatLocale(), zone)
+
 	// Expand paths
 	cfg.expandPaths()
 
@@ -136,17 +559,15 @@ func Save(cfg *Config) error {
 	viper.Set("sync", cfg.Sync)
 	viper.Set("network", cfg.Network)
 	viper.Set("security", cfg.Security)
+	viper.Set("logging", cfg.Logging)
+	viper.Set("display", cfg.Display)
+	viper.Set("peers", cfg.Peers)
 
 	return viper.WriteConfig()
 }
 
 func setDefaults() {
-	hostname, _ := os.Hostname()
-	if hostname == "" {
-		hostname = "My-Mac"
-	}
-
-	viper.SetDefault("device.name", hostname)
+	viper.SetDefault("device.name", defaultDeviceName())
 	viper.SetDefault("folders", []FolderConfig{
 		{Path: "~/Desktop", Enabled: true},
 		{Path: "~/Documents", Enabled: true},
@@ -171,8 +592,8 @@ func setDefaults() {
 		".DocumentRevisions-V100",
 		".TemporaryItems",
 		// macOS system folders
-		"Library",
-		"Applications",
+		"/Library",
+		"/Applications",
 		".Trash",
 		".cache",
 		".local",
@@ -192,18 +613,82 @@ func setDefaults() {
 		"*.xcworkspace",
 		"*.xcuserdata",
 		// Build artifacts
-		"build",
-		"dist",
-		"target",
+		"build/",
+		"dist/",
+		"target/",
 		"__pycache__",
 		"*.pyc",
 	})
+	viper.SetDefault("sync.include_patterns", []string{})
 	viper.SetDefault("sync.exclude_dirs", []string{})
-	viper.SetDefault("network.port", 9876)
+	viper.SetDefault("sync.max_concurrent_transfers", 4)
+	viper.SetDefault("sync.large_file_mb", 1024)
+	viper.SetDefault("sync.scan_command", "")
+	viper.SetDefault("sync.scan_timeout", 60)
+	viper.SetDefault("sync.tie_break", "hash")
+	viper.SetDefault("sync.clock_skew_tolerance", 2)
+	viper.SetDefault("sync.device_priority", []string{})
+	viper.SetDefault("sync.pause_for_time_machine", true)
+	viper.SetDefault("sync.snapshot_threshold", 0)
+	viper.SetDefault("sync.snapshot_keep", 5)
+	viper.SetDefault("sync.deletes", "trash")
+	viper.SetDefault("sync.versions", 0)
+	viper.SetDefault("sync.versions_max_age", 0)
+	viper.SetDefault("sync.rescan_interval", 60)
+	viper.SetDefault("sync.poll_interval", 30)
+	viper.SetDefault("sync.deletions_max_age", 30)
+	viper.SetDefault("sync.deletions_max_count", 100000)
+	viper.SetDefault("sync.deletions_overflow", "drop_oldest")
+	viper.SetDefault("sync.mass_delete_files", 100)
+	viper.SetDefault("sync.mass_delete_percent", 25)
+	viper.SetDefault("sync.confirm_first_sync", true)
+	viper.SetDefault("sync.max_file_size", "")
+	viper.SetDefault("sync.max_age", "")
+	viper.SetDefault("sync.min_free_space", "1GB")
+	viper.SetDefault("sync.protect_databases", true)
+	viper.SetDefault("sync.database_settle", 5)
+	viper.SetDefault("sync.atomic_packages", true)
+	viper.SetDefault("sync.package_settle", 5)
+	viper.SetDefault("sync.churn_writes", 5)
+	viper.SetDefault("sync.churn_settle", 5)
+	viper.SetDefault("sync.churn_max_delay", 60)
+	viper.SetDefault("sync.stable_interval", 2)
+	viper.SetDefault("sync.journal_max_files", 10000)
+	viper.SetDefault("sync.check_open_files", true)
+	viper.SetDefault("sync.unlock_readonly", false)
+	viper.SetDefault("sync.schedule", []string{})
+	viper.SetDefault("sync.quiet_hours", []string{})
+	viper.SetDefault("network.port", defaultPort(9876))
 	viper.SetDefault("network.use_discovery", true)
 	viper.SetDefault("network.manual_peers", []string{})
+	viper.SetDefault("network.send_queue_size", 64)
+	viper.SetDefault("network.send_queue_policy", "block")
+	viper.SetDefault("network.max_upload_kbps", 0)
+	viper.SetDefault("network.max_download_kbps", 0)
+	viper.SetDefault("network.receive_window_mb", 128)
+	viper.SetDefault("network.receive_window_files", 64)
+	viper.SetDefault("network.keepalive_interval", 15)
+	viper.SetDefault("network.keepalive_timeout", 45)
+	viper.SetDefault("network.relay_address", "")
+	viper.SetDefault("network.relay_peers", []string{})
+	viper.SetDefault("network.stun_server", "stun.l.google.com:19302")
+	viper.SetDefault("network.share_port", 0)
+	viper.SetDefault("network.mdns_instance_name", "")
+	viper.SetDefault("network.mdns_advertise", true)
+	viper.SetDefault("network.mdns_interfaces", []string{})
+	viper.SetDefault("network.tailscale_discovery", false)
+	viper.SetDefault("network.tailscale_socket", "")
+	viper.SetDefault("network.beacon_discovery", false)
+	viper.SetDefault("network.beacon_port", 9879)
+	viper.SetDefault("network.introducer", false)
 	viper.SetDefault("security.require_pairing", true)
 	viper.SetDefault("security.encryption", true)
+	viper.SetDefault("logging.max_per_minute", 10)
+	viper.SetDefault("logging.trace_messages", 0)
+	viper.SetDefault("logging.split_by_peer", false)
+	viper.SetDefault("logging.split_by_folder", false)
+	viper.SetDefault("display.locale", "")
+	viper.SetDefault("display.time_zone", "local")
 }
 
 func createDefaultConfig() error {
@@ -218,22 +703,11 @@ func createDefaultConfig() error {
 }
 
 func (c *Config) expandPaths() {
-	home, _ := os.UserHomeDir()
 	for i := range c.Folders {
-		c.Folders[i].Path = expandPath(c.Folders[i].Path, home)
+		c.Folders[i].Path = fileutil.ExpandHome(c.Folders[i].Path)
 	}
 }
 
-func expandPath(path, home string) string {
-	if strings.HasPrefix(path, "~/") {
-		return filepath.Join(home, path[2:])
-	}
-	if path == "~" {
-		return home
-	}
-	return path
-}
-
 // GetConflictStrategy returns the configured conflict resolution strategy
 func (c *Config) GetConflictStrategy() ConflictStrategy {
 	switch c.Sync.ConflictResolution {
@@ -248,6 +722,116 @@ func (c *Config) GetConflictStrategy() ConflictStrategy {
 	}
 }
 
+// GetTieBreak returns how newest_wins breaks ties between equal mod times
+func (c *Config) GetTieBreak() TieBreak {
+	if c.Sync.TieBreak == string(TieBreakDevice) {
+		return TieBreakDevice
+	}
+	return TieBreakHash
+}
+
+// GetClockSkewTolerance returns how far apart two mod times may be, once
+// the peer's clock offset is corrected for, and still count as a tie under
+// newest_wins
+func (c *Config) GetClockSkewTolerance() time.Duration {
+	if c.Sync.ClockSkewTolerance <= 0 {
+		return 0
+	}
+	return time.Duration(c.Sync.ClockSkewTolerance) * time.Second
+}
+
+// DeviceRank returns a device's position in device_priority. Unlisted
+// devices rank after every listed one.
+func (c *Config) DeviceRank(name string) int {
+	for i, device := range c.Sync.DevicePriority {
+		if device == name {
+			return i
+		}
+	}
+	return len(c.Sync.DevicePriority)
+}
+
+// GetDeleteMode returns what happens to files peers delete
+func (c *Config) GetDeleteMode() DeleteMode {
+	switch c.Sync.Deletes {
+	case "permanent":
+		return DeletePermanent
+	case "archive":
+		return DeleteArchive
+	default:
+		return DeleteTrash
+	}
+}
+
+// GetVersionsMaxAge returns how long previous versions are kept (0 = no limit)
+func (c *Config) GetVersionsMaxAge() time.Duration {
+	if c.Sync.VersionsMaxAge <= 0 {
+		return 0
+	}
+	return time.Duration(c.Sync.VersionsMaxAge) * 24 * time.Hour
+}
+
+// GetRescanInterval returns how often a folder is rescanned for changes the
+// watcher missed, or 0 if it never is
+func (c *Config) GetRescanInterval(path string) time.Duration {
+	minutes := c.Sync.RescanInterval
+	if folder := c.GetFolder(path); folder != nil && folder.RescanInterval != 0 {
+		minutes = folder.RescanInterval
+	}
+	if minutes <= 0 {
+		return 0
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// GetPollInterval returns how often folders watched by polling are scanned
+func (c *Config) GetPollInterval() time.Duration {
+	if c.Sync.PollInterval <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(c.Sync.PollInterval) * time.Second
+}
+
+// GetDeletionLimits returns how long and how many deletions each folder
+// remembers for offline peers
+func (c *Config) GetDeletionLimits() (time.Duration, int) {
+	days, count := c.Sync.DeletionsMaxAge, c.Sync.DeletionsMaxCount
+	if days <= 0 {
+		days = 30
+	}
+	if count <= 0 {
+		count = 100000
+	}
+	return time.Duration(days) * 24 * time.Hour, count
+}
+
+// GetMassDeleteLimits returns how many files, and what percentage of a
+// folder, one batch of local deletions may remove before it is held for
+// approval. 0 turns a limit off.
+func (c *Config) GetMassDeleteLimits() (int, int) {
+	files, percent := c.Sync.MassDeleteFiles, c.Sync.MassDeletePercent
+	if files < 0 {
+		files = 0
+	}
+	if percent < 0 || percent >= 100 {
+		percent = 0
+	}
+	return files, percent
+}
+
+// GetDeletionsOverflow returns what happens when a folder remembers more
+// deletions than its limits allow
+func (c *Config) GetDeletionsOverflow() DeletionsOverflow {
+	switch c.Sync.DeletionsOverflow {
+	case "pause":
+		return OverflowPause
+	case "alert":
+		return OverflowAlert
+	default:
+		return OverflowDropOldest
+	}
+}
+
 // GetSyncDirection returns the configured sync direction
 func (c *Config) GetSyncDirection() SyncDirection {
 	switch c.Sync.Direction {
@@ -255,6 +839,8 @@ func (c *Config) GetSyncDirection() SyncDirection {
 		return SyncSendOnly
 	case "receive_only":
 		return SyncReceiveOnly
+	case "master":
+		return SyncMaster
 	case "bidirectional":
 		return SyncBidirectional
 	default:
@@ -262,10 +848,214 @@ func (c *Config) GetSyncDirection() SyncDirection {
 	}
 }
 
+// GetSnapshotKeep returns how many snapshots to keep per folder
+func (c *Config) GetSnapshotKeep() int {
+	if c.Sync.SnapshotKeep <= 0 {
+		return 5
+	}
+	return c.Sync.SnapshotKeep
+}
+
+// GetMaxConcurrentTransfers returns how many file transfers may run at once per peer
+func (c *Config) GetMaxConcurrentTransfers() int {
+	if c.Sync.MaxConcurrentTransfers <= 0 {
+		return 1
+	}
+	return c.Sync.MaxConcurrentTransfers
+}
+
+// GetPeer returns the settings configured for a peer device, or nil
+func (c *Config) GetPeer(name string) *PeerConfig {
+	for i := range c.Peers {
+		if strings.EqualFold(c.Peers[i].Name, name) {
+			return &c.Peers[i]
+		}
+	}
+	return nil
+}
+
+// GetPeerMaxTransfers returns how many file requests may be outstanding with a peer
+func (c *Config) GetPeerMaxTransfers(name string) int {
+	if peer := c.GetPeer(name); peer != nil && peer.MaxConcurrentTransfers > 0 {
+		return peer.MaxConcurrentTransfers
+	}
+	return c.GetMaxConcurrentTransfers()
+}
+
+// SetPeerLimits sets a peer's transfer limits; a peer with no limits left is removed
+func (c *Config) SetPeerLimits(limits PeerConfig) error {
+	if limits.Name == "" {
+		return fmt.Errorf("peer name is required")
+	}
+	if limits.MaxConcurrentTransfers < 0 || limits.MaxUploadKbps < 0 || limits.MaxDownloadKbps < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+
+	if existing := c.GetPeer(limits.Name); existing != nil {
+		limits.Nickname, limits.Icon = existing.Nickname, existing.Icon
+	}
+	c.setPeer(limits)
+	return Save(c)
+}
+
+// SetPeerNickname sets the nickname and icon shown for a peer on this Mac;
+// empty values go back to the device name
+func (c *Config) SetPeerNickname(name, nickname, icon string) error {
+	if name == "" {
+		return fmt.Errorf("peer name is required")
+	}
+
+	peer := PeerConfig{Name: name}
+	if existing := c.GetPeer(name); existing != nil {
+		peer = *existing
+	}
+	peer.Nickname = strings.TrimSpace(nickname)
+	peer.Icon = strings.TrimSpace(icon)
+	c.setPeer(peer)
+	return Save(c)
+}
+
+// setPeer replaces a peer's entry, dropping it if nothing is set
+func (c *Config) setPeer(peer PeerConfig) {
+	c.Peers = slices.DeleteFunc(c.Peers, func(p PeerConfig) bool {
+		return strings.EqualFold(p.Name, peer.Name)
+	})
+	if peer.HasLimits() || peer.Nickname != "" || peer.Icon != "" {
+		c.Peers = append(c.Peers, peer)
+	}
+}
+
+// PeerLabel returns how a peer is shown: its icon and nickname, or its
+// device name if it has no nickname
+func (c *Config) PeerLabel(name string) string {
+	peer := c.GetPeer(name)
+	if peer == nil {
+		return name
+	}
+
+	label := name
+	if peer.Nickname != "" {
+		label = peer.Nickname
+	}
+	if peer.Icon != "" {
+		label = peer.Icon + " " + label
+	}
+	return label
+}
+
+// GetLargeFileSize returns the size from which files are transferred last
+func (c *Config) GetLargeFileSize() int64 {
+	if c.Sync.LargeFileMB <= 0 {
+		return 1 << 30
+	}
+	return int64(c.Sync.LargeFileMB) << 20
+}
+
+// GetMaxFileSize returns the size above which files aren't synced, or 0 if
+// there is no limit
+func (c *Config) GetMaxFileSize() int64 {
+	if c.Sync.MaxFileSize == "" {
+		return 0
+	}
+	size, err := fileutil.ParseSize(c.Sync.MaxFileSize)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+// GetMaxAge returns how long ago a file may have last been modified and still
+// sync, or 0 if there is no limit
+func (c *Config) GetMaxAge() time.Duration {
+	if c.Sync.MaxAge == "" {
+		return 0
+	}
+	age, err := fileutil.ParseAge(c.Sync.MaxAge)
+	if err != nil {
+		return 0
+	}
+	return age
+}
+
+// GetMinFreeSpace returns the free space kept on each folder's volume, below
+// which files aren't received (0 = fill the disk)
+func (c *Config) GetMinFreeSpace() int64 {
+	if c.Sync.MinFreeSpace == "" {
+		return 0
+	}
+	size, err := fileutil.ParseSize(c.Sync.MinFreeSpace)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+// GetDatabaseSettle returns how long a database must be unchanged before it
+// is sent
+func (c *Config) GetDatabaseSettle() time.Duration {
+	if c.Sync.DatabaseSettle <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(c.Sync.DatabaseSettle) * time.Second
+}
+
+// GetPackageSettle returns how long a package must be unchanged before
+// peers are told to fetch it
+func (c *Config) GetPackageSettle() time.Duration {
+	if c.Sync.PackageSettle <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(c.Sync.PackageSettle) * time.Second
+}
+
+// GetChurnLimits returns how many quick writes in a row mark a file as busy
+// (0 = never), how long a busy file must go without a write before its
+// changes are sent, and how long they wait at most while writes go on
+func (c *Config) GetChurnLimits() (int, time.Duration, time.Duration) {
+	settle, maxDelay := c.Sync.ChurnSettle, c.Sync.ChurnMaxDelay
+	if settle <= 0 {
+		settle = 5
+	}
+	if maxDelay < settle {
+		maxDelay = settle
+	}
+	return c.Sync.ChurnWrites, time.Duration(settle) * time.Second, time.Duration(maxDelay) * time.Second
+}
+
+// GetStableInterval returns how long a new or changed file must go unchanged
+// before it is sent (0 = send as soon as its events settle)
+func (c *Config) GetStableInterval() time.Duration {
+	if c.Sync.StableInterval <= 0 {
+		return 0
+	}
+	return time.Duration(c.Sync.StableInterval) * time.Second
+}
+
+// GetReceiveWindow returns how much unacknowledged file data peers may push
+// to this Mac, in bytes and files
+func (c *Config) GetReceiveWindow() (int64, int) {
+	bytes, files := int64(c.Network.ReceiveWindowMB)<<20, c.Network.ReceiveWindowFiles
+	if bytes <= 0 {
+		bytes = 128 << 20
+	}
+	if files <= 0 {
+		files = 64
+	}
+	return bytes, files
+}
+
+// GetScanTimeout returns how long the incoming file scanner may run
+func (c *Config) GetScanTimeout() time.Duration {
+	if c.Sync.ScanTimeout <= 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(c.Sync.ScanTimeout) * time.Second
+}
+
 // CanSend returns true if this device should send files to peers
 func (c *Config) CanSend() bool {
 	dir := c.GetSyncDirection()
-	return dir == SyncBidirectional || dir == SyncSendOnly
+	return dir == SyncBidirectional || dir == SyncSendOnly || dir == SyncMaster
 }
 
 // CanReceive returns true if this device should receive files from peers
@@ -274,10 +1064,47 @@ func (c *Config) CanReceive() bool {
 	return dir == SyncBidirectional || dir == SyncReceiveOnly
 }
 
+// FanIn returns enabled folders that share a sync name with another, by
+// name. Peers can't tell them apart, so their contents would mix.
+func (c *Config) FanIn() map[string][]string {
+	byName := make(map[string][]string)
+	for _, folder := range c.Folders {
+		if folder.Enabled {
+			byName[folder.SyncName()] = append(byName[folder.SyncName()], folder.Path)
+		}
+	}
+	for name, paths := range byName {
+		if len(paths) < 2 {
+			delete(byName, name)
+		}
+	}
+	return byName
+}
+
+// CheckFanIn returns an error naming folders that share a sync name, and
+// how to tell them apart
+func (c *Config) CheckFanIn() error {
+	fanIn := c.FanIn()
+	names := make([]string, 0, len(fanIn))
+	for name := range fanIn {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	slices.Sort(names)
+	return fmt.Errorf("folders %s all sync as %q, so peers would mix their contents; give all but one another name with 'mac-profile-sync name <folder> <name>'", strings.Join(fanIn[names[0]], ", "), names[0])
+}
+
 // AddFolder adds a new folder to sync
 func (c *Config) AddFolder(path string) error {
-	home, _ := os.UserHomeDir()
-	expandedPath := expandPath(path, home)
+	return c.AddFolderNamed(path, "")
+}
+
+// AddFolderNamed adds a new folder to sync, matched by peers by name instead
+// of its base name if name isn't empty
+func (c *Config) AddFolderNamed(path, name string) error {
+	expandedPath := fileutil.ExpandHome(path)
 
 	// Check if folder already exists
 	for _, f := range c.Folders {
@@ -286,27 +1113,64 @@ func (c *Config) AddFolder(path string) error {
 		}
 	}
 
-	// Verify path exists and is a directory
+	// Verify path exists and is a directory. A folder on an external volume
+	// that isn't mounted is taken as it is; it syncs once the volume is.
 	info, err := os.Stat(expandedPath)
-	if err != nil {
+	if err != nil && !(os.IsNotExist(err) && !fileutil.VolumeMounted(expandedPath)) {
 		return fmt.Errorf("cannot access path: %w", err)
 	}
-	if !info.IsDir() {
+	if err == nil && !info.IsDir() {
 		return fmt.Errorf("path is not a directory: %s", path)
 	}
 
-	c.Folders = append(c.Folders, FolderConfig{
+	folder := FolderConfig{
 		Path:    expandedPath,
 		Enabled: true,
-	})
+		Name:    name,
+	}
+	if err := c.checkSyncName(folder); err != nil {
+		return fmt.Errorf("%w; choose another name with --name", err)
+	}
+	c.Folders = append(c.Folders, folder)
+
+	return Save(c)
+}
+
+// checkSyncName refuses a folder whose sync name another enabled folder
+// already has
+func (c *Config) checkSyncName(folder FolderConfig) error {
+	if strings.ContainsAny(folder.Name, "/\\") || folder.Name == "." || folder.Name == ".." {
+		return fmt.Errorf("invalid folder name %q", folder.Name)
+	}
+	for _, other := range c.Folders {
+		if other.Enabled && other.Path != folder.Path && other.SyncName() == folder.SyncName() {
+			return fmt.Errorf("%s would sync as %q like %s, so peers would mix their contents", folder.Path, folder.SyncName(), other.Path)
+		}
+	}
+	return nil
+}
+
+// SetFolderName sets the name peers match a folder by. An empty name goes
+// back to its base name.
+func (c *Config) SetFolderName(path, name string) error {
+	folder := c.GetFolder(path)
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", path)
+	}
 
+	renamed := *folder
+	renamed.Name = name
+	if err := c.checkSyncName(renamed); err != nil {
+		return err
+	}
+
+	folder.Name = name
 	return Save(c)
 }
 
 // RemoveFolder removes a folder from sync
 func (c *Config) RemoveFolder(path string) error {
-	home, _ := os.UserHomeDir()
-	expandedPath := expandPath(path, home)
+	expandedPath := fileutil.ExpandHome(path)
 
 	for i, f := range c.Folders {
 		if f.Path == expandedPath {
@@ -320,8 +1184,7 @@ func (c *Config) RemoveFolder(path string) error {
 
 // ToggleFolder enables or disables a folder
 func (c *Config) ToggleFolder(path string) error {
-	home, _ := os.UserHomeDir()
-	expandedPath := expandPath(path, home)
+	expandedPath := fileutil.ExpandHome(path)
 
 	for i, f := range c.Folders {
 		if f.Path == expandedPath {
@@ -333,6 +1196,242 @@ func (c *Config) ToggleFolder(path string) error {
 	return fmt.Errorf("folder not found: %s", path)
 }
 
+// GetFolder returns the folder config for a path, or nil if not configured
+func (c *Config) GetFolder(path string) *FolderConfig {
+	expandedPath := fileutil.ExpandHome(path)
+
+	for i := range c.Folders {
+		if c.Folders[i].Path == expandedPath {
+			return &c.Folders[i]
+		}
+	}
+	return nil
+}
+
+// FolderContaining returns the synced folder a path is inside and the path
+// relative to it, or nil if it isn't in any synced folder
+func (c *Config) FolderContaining(path string) (*FolderConfig, string) {
+	expandedPath := fileutil.ExpandHome(path)
+
+	var match *FolderConfig
+	var matchRel string
+	for i := range c.Folders {
+		rel, ok := fileutil.RelWithin(c.Folders[i].Path, expandedPath)
+		if !ok {
+			continue
+		}
+		// Prefer the innermost folder
+		if match == nil || len(c.Folders[i].Path) > len(match.Path) {
+			match, matchRel = &c.Folders[i], rel
+		}
+	}
+	return match, matchRel
+}
+
+// SetSubfolders sets the subfolders of a folder to sync (nil = sync all)
+func (c *Config) SetSubfolders(path string, subfolders []string) error {
+	folder := c.GetFolder(path)
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", path)
+	}
+
+	cleaned, err := cleanSubfolders(folder.Path, subfolders)
+	if err != nil {
+		return err
+	}
+	folder.Subfolders = cleaned
+	return Save(c)
+}
+
+// SetExcluded sets the subfolders of a folder that aren't synced (nil = none)
+func (c *Config) SetExcluded(path string, excluded []string) error {
+	folder := c.GetFolder(path)
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", path)
+	}
+
+	cleaned, err := cleanSubfolders(folder.Path, excluded)
+	if err != nil {
+		return err
+	}
+	folder.Excluded = cleaned
+	return Save(c)
+}
+
+// cleanSubfolders turns subfolders, given relative to a folder or as full
+// paths inside it, into slash-separated paths relative to the folder
+func cleanSubfolders(folderPath string, subfolders []string) ([]string, error) {
+	var cleaned []string
+	for _, sub := range subfolders {
+		rel := fileutil.ExpandHome(sub)
+		if filepath.IsAbs(rel) {
+			var err error
+			if rel, err = filepath.Rel(folderPath, rel); err != nil {
+				return nil, fmt.Errorf("invalid subfolder: %q", sub)
+			}
+		}
+		rel = filepath.ToSlash(filepath.Clean(rel))
+		if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+			return nil, fmt.Errorf("invalid subfolder: %q is not inside %s", sub, folderPath)
+		}
+		if !slices.Contains(cleaned, rel) {
+			cleaned = append(cleaned, rel)
+		}
+	}
+	return cleaned, nil
+}
+
+// SetPriority sets a folder's transfer priority
+func (c *Config) SetPriority(path, priority string) error {
+	folder := c.GetFolder(path)
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", path)
+	}
+
+	if priority != PriorityHigh && priority != PriorityNormal && priority != PriorityLow {
+		return fmt.Errorf("invalid priority %q (use %s, %s, or %s)", priority, PriorityHigh, PriorityNormal, PriorityLow)
+	}
+
+	folder.Priority = priority
+	return Save(c)
+}
+
+// SetApplyLimits sets how many received files are written to a folder at
+// once and per second; 0 removes a limit
+func (c *Config) SetApplyLimits(path string, concurrency, rate int) error {
+	folder := c.GetFolder(path)
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", path)
+	}
+
+	if concurrency < 0 || rate < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+
+	folder.ApplyConcurrency = concurrency
+	folder.ApplyRate = rate
+	return Save(c)
+}
+
+// SetExport sets how a folder is exported for read-only browsing
+func (c *Config) SetExport(path, mode string) error {
+	folder := c.GetFolder(path)
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", path)
+	}
+
+	if mode != ExportOff && mode != ExportLocal && mode != ExportLAN {
+		return fmt.Errorf("invalid export mode %q (use %s, %s, or %s)", mode, ExportOff, ExportLocal, ExportLAN)
+	}
+
+	folder.Export = mode
+	return Save(c)
+}
+
+// SetWatchMode sets how a folder's changes are noticed
+func (c *Config) SetWatchMode(path, mode string) error {
+	folder := c.GetFolder(path)
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", path)
+	}
+
+	if mode != WatchAuto && mode != WatchFSEvents && mode != WatchPoll && mode != WatchPortable {
+		return fmt.Errorf("invalid watch mode %q (use %s, %s, %s, or %s)", mode, WatchAuto, WatchFSEvents, WatchPoll, WatchPortable)
+	}
+
+	folder.Watch = mode
+	return Save(c)
+}
+
+// SetChangeDetection sets how a folder tells whether a file changed
+func (c *Config) SetChangeDetection(path, mode string) error {
+	folder := c.GetFolder(path)
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", path)
+	}
+
+	if mode != DetectHash && mode != DetectSizeMtime && mode != DetectHybrid {
+		return fmt.Errorf("invalid change detection %q (use %s, %s, or %s)", mode, DetectHash, DetectSizeMtime, DetectHybrid)
+	}
+
+	folder.ChangeDetection = mode
+	return Save(c)
+}
+
+// SetApproval sets whether peer changes to a folder need approval
+func (c *Config) SetApproval(path, mode string) error {
+	folder := c.GetFolder(path)
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", path)
+	}
+
+	if mode != ApprovalAuto && mode != ApprovalManual {
+		return fmt.Errorf("invalid approval mode %q (use %s or %s)", mode, ApprovalAuto, ApprovalManual)
+	}
+
+	folder.Approval = mode
+	return Save(c)
+}
+
+// SetSharedIgnore sets whether a folder honors its synced .mpsignore file
+func (c *Config) SetSharedIgnore(path string, enabled bool) error {
+	folder := c.GetFolder(path)
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", path)
+	}
+
+	folder.SharedIgnore = enabled
+	return Save(c)
+}
+
+// SetPrivateIgnoreFile sets whether a folder's .mpsignore file stays on this
+// Mac instead of syncing
+func (c *Config) SetPrivateIgnoreFile(path string, private bool) error {
+	folder := c.GetFolder(path)
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", path)
+	}
+
+	folder.PrivateIgnoreFile = private
+	return Save(c)
+}
+
+// SetFinderViews sets whether a folder syncs Finder's .DS_Store files
+func (c *Config) SetFinderViews(path string, enabled bool) error {
+	folder := c.GetFolder(path)
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", path)
+	}
+
+	folder.FinderViews = enabled
+	return Save(c)
+}
+
+// SyncsFinderView reports whether a path is a .DS_Store file in a folder
+// that syncs them, which ignore_patterns then don't apply to
+func (c *Config) SyncsFinderView(path string) bool {
+	if filepath.Base(path) != FinderViewFile {
+		return false
+	}
+	folder, _ := c.FolderContaining(path)
+	return folder != nil && folder.FinderViews
+}
+
+// AddLocalIgnore adds patterns ignored in a folder on this Mac only
+func (c *Config) AddLocalIgnore(path string, patterns []string) error {
+	folder := c.GetFolder(path)
+	if folder == nil {
+		return fmt.Errorf("folder not found: %s", path)
+	}
+
+	for _, pattern := range patterns {
+		if !slices.Contains(folder.LocalIgnore, pattern) {
+			folder.LocalIgnore = append(folder.LocalIgnore, pattern)
+		}
+	}
+	return Save(c)
+}
+
 // IsSyncEnabled returns whether sync is enabled
 func (c *Config) IsSyncEnabled() bool {
 	return c.Sync.Enabled
@@ -344,29 +1443,112 @@ func (c *Config) SetSyncEnabled(enabled bool) error {
 	return Save(c)
 }
 
+// ReloadIgnores re-reads include_patterns, ignore_patterns, exclude_dirs and
+// each folder's local_ignore from the config file, reporting whether any of
+// them changed. Other settings still take a restart.
+func (c *Config) ReloadIgnores() (bool, error) {
+	fresh, err := Load()
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+	if !slices.Equal(c.Sync.IncludePatterns, fresh.Sync.IncludePatterns) {
+		c.Sync.IncludePatterns = fresh.Sync.IncludePatterns
+		changed = true
+	}
+	if !slices.Equal(c.Sync.IgnorePatterns, fresh.Sync.IgnorePatterns) {
+		c.Sync.IgnorePatterns = fresh.Sync.IgnorePatterns
+		changed = true
+	}
+	if !slices.Equal(c.Sync.ExcludeDirs, fresh.Sync.ExcludeDirs) {
+		c.Sync.ExcludeDirs = fresh.Sync.ExcludeDirs
+		changed = true
+	}
+	for i := range c.Folders {
+		folder := fresh.GetFolder(c.Folders[i].Path)
+		if folder != nil && !slices.Equal(c.Folders[i].LocalIgnore, folder.LocalIgnore) {
+			c.Folders[i].LocalIgnore = folder.LocalIgnore
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// ReloadRemovedFolders drops the folders removed from the config file since
+// it was loaded, by the remove command or the TUI, and returns their paths.
+// Folders added there still take a restart.
+func (c *Config) ReloadRemovedFolders() ([]string, error) {
+	fresh, err := Load()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	kept := make([]FolderConfig, 0, len(c.Folders))
+	for _, folder := range c.Folders {
+		if fresh.GetFolder(folder.Path) == nil {
+			removed = append(removed, folder.Path)
+			continue
+		}
+		kept = append(kept, folder)
+	}
+	if len(removed) > 0 {
+		c.Folders = kept
+	}
+	return removed, nil
+}
+
+// ReloadSelections picks up sparse selections changed in the config file
+// since it was loaded, by the subfolders command or the TUI, and returns the
+// changed folders as they were before
+func (c *Config) ReloadSelections() ([]FolderConfig, error) {
+	fresh, err := Load()
+	if err != nil {
+		return nil, err
+	}
+
+	var previous []FolderConfig
+	for i := range c.Folders {
+		folder := fresh.GetFolder(c.Folders[i].Path)
+		if folder == nil || (slices.Equal(c.Folders[i].Subfolders, folder.Subfolders) && slices.Equal(c.Folders[i].Excluded, folder.Excluded)) {
+			continue
+		}
+		previous = append(previous, c.Folders[i])
+		c.Folders[i].Subfolders = folder.Subfolders
+		c.Folders[i].Excluded = folder.Excluded
+	}
+	return previous, nil
+}
+
 // ShouldIgnore checks if a path matches any ignore pattern or excluded directory
 func (c *Config) ShouldIgnore(path string) bool {
-	base := filepath.Base(path)
+	return c.IgnoreMatch(path) != ""
+}
 
-	// Check ignore patterns (matches file/dir name)
-	for _, pattern := range c.Sync.IgnorePatterns {
-		matched, _ := filepath.Match(pattern, base)
-		if matched {
-			return true
+// IgnoreMatch returns the ignore_patterns or exclude_dirs entry that ignores
+// a path, or "" if none does. With include_patterns set, a file matching
+// none of them is ignored before ignore_patterns are checked.
+func (c *Config) IgnoreMatch(path string) string {
+	// Directories are walked into, so files inside them can match
+	if len(c.Sync.IncludePatterns) > 0 && !isDir(path) && !c.SyncsFinderView(path) {
+		if globalIncludes(c.Sync.IncludePatterns).Match(ignoreRelPath(path), func() bool { return false }) == "" {
+			return "include_patterns, which it doesn't match"
 		}
 	}
 
+	// Check ignore patterns against the path from the home folder
+	if pattern := globalIgnores(c.Sync.IgnorePatterns).Match(ignoreRelPath(path), func() bool { return isDir(path) }); pattern != "" && !c.SyncsFinderView(path) {
+		return fmt.Sprintf("ignore_patterns %q", pattern)
+	}
+
 	// Check if path is under any excluded directory
 	for _, excludeDir := range c.Sync.ExcludeDirs {
-		// Expand ~ in exclude dir
-		home, _ := os.UserHomeDir()
-		expandedExclude := expandPath(excludeDir, home)
-
-		// Check if path starts with excluded dir
-		if strings.HasPrefix(path, expandedExclude) {
-			return true
+		// Check if path is the excluded dir or inside it
+		if fileutil.IsWithin(path, fileutil.ExpandHome(excludeDir)) {
+			return fmt.Sprintf("exclude_dirs %q", excludeDir)
 		}
 	}
 
-	return false
+	return ""
 }
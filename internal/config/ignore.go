@@ -0,0 +1,201 @@
+package config
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+)
+
+// IgnoreRule is one gitignore-style pattern
+type IgnoreRule struct {
+	Pattern  string // As written
+	negate   bool   // "!" re-includes what earlier rules ignored
+	dirOnly  bool   // Trailing "/" matches directories only
+	anchored bool   // A "/" other than a trailing one matches from the folder root
+	segments []string
+}
+
+// ParseIgnoreRule parses a gitignore-style pattern. It returns false for
+// patterns that match nothing, like "/" or "!".
+func ParseIgnoreRule(pattern string) (IgnoreRule, bool) {
+	rule := IgnoreRule{Pattern: pattern}
+	p := filepath.ToSlash(pattern)
+
+	switch {
+	case strings.HasPrefix(p, "!"):
+		rule.negate = true
+		p = p[1:]
+	case strings.HasPrefix(p, `\!`), strings.HasPrefix(p, `\#`):
+		p = p[1:]
+	}
+	if strings.HasSuffix(p, "/") {
+		rule.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	if strings.Contains(p, "/") {
+		rule.anchored = true
+		p = strings.TrimLeft(p, "/")
+	}
+	if p == "" {
+		return rule, false
+	}
+
+	rule.segments = strings.Split(p, "/")
+	return rule, true
+}
+
+// matches reports whether the rule matches a path, given as its components.
+// isDir is only called for rules that match directories only.
+func (r *IgnoreRule) matches(parts []string, isDir func() bool) bool {
+	matched := false
+	if r.anchored {
+		matched = matchSegments(r.segments, parts)
+	} else {
+		matched, _ = path.Match(r.segments[0], parts[len(parts)-1])
+	}
+	return matched && (!r.dirOnly || isDir())
+}
+
+// matchSegments matches path components against pattern components, where
+// "**" stands for any number of directories
+func matchSegments(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			// A trailing "/**" matches everything inside, not the directory itself
+			if len(rest) == 0 {
+				return len(parts) > 0
+			}
+			for i := 0; i <= len(parts); i++ {
+				if matchSegments(rest, parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], parts[0]); !matched {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+// IgnoreList is an ordered list of gitignore-style rules, where later rules
+// override earlier ones
+type IgnoreList []IgnoreRule
+
+// ParseIgnoreList parses gitignore-style patterns, skipping ones that match
+// nothing
+func ParseIgnoreList(patterns []string) IgnoreList {
+	var list IgnoreList
+	for _, pattern := range patterns {
+		if rule, ok := ParseIgnoreRule(pattern); ok {
+			list = append(list, rule)
+		}
+	}
+	return list
+}
+
+// Match returns the pattern that ignores a path relative to the folder root,
+// or "" if it isn't ignored. As in git, the last matching rule decides, and a
+// path in an ignored directory can't be re-included. isDir reports whether the
+// path is a directory; it is only called if a directory-only rule needs it.
+func (l IgnoreList) Match(relPath string, isDir func() bool) string {
+	if relPath == "" || relPath == "." {
+		return ""
+	}
+	parts := strings.Split(filepath.ToSlash(relPath), "/")
+	for i := 1; i <= len(parts); i++ {
+		dirCheck := isDir
+		if i < len(parts) {
+			dirCheck = isParent
+		}
+		if rule := l.decide(parts[:i], dirCheck); rule != nil && !rule.negate {
+			return rule.Pattern
+		}
+	}
+	return ""
+}
+
+// isParent is the directory check for a path's parents, which always are
+func isParent() bool { return true }
+
+// decide returns the last rule that matches a path, if any
+func (l IgnoreList) decide(parts []string, isDir func() bool) *IgnoreRule {
+	for i := len(l) - 1; i >= 0; i-- {
+		if l[i].matches(parts, isDir) {
+			return &l[i]
+		}
+	}
+	return nil
+}
+
+// patternCache holds patterns from the config compiled, recompiled when
+// they change
+type patternCache struct {
+	mu       sync.Mutex
+	patterns []string
+	list     IgnoreList
+}
+
+// globalIgnoreCache and globalIncludeCache hold ignore_patterns and
+// include_patterns compiled
+var globalIgnoreCache, globalIncludeCache patternCache
+
+// compile returns patterns compiled. A leading "~/" anchors a pattern to the
+// home folder, like a leading "/".
+func (c *patternCache) compile(patterns []string) IgnoreList {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.list != nil && slices.Equal(patterns, c.patterns) {
+		return c.list
+	}
+	expanded := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		if rest, ok := strings.CutPrefix(pattern, "~/"); ok {
+			pattern = "/" + rest
+		} else if rest, ok := strings.CutPrefix(pattern, "!~/"); ok {
+			pattern = "!/" + rest
+		}
+		expanded[i] = pattern
+	}
+	c.patterns = slices.Clone(patterns)
+	c.list = ParseIgnoreList(expanded)
+	return c.list
+}
+
+// globalIgnores returns ignore_patterns compiled
+func globalIgnores(patterns []string) IgnoreList {
+	return globalIgnoreCache.compile(patterns)
+}
+
+// globalIncludes returns include_patterns compiled
+func globalIncludes(patterns []string) IgnoreList {
+	return globalIncludeCache.compile(patterns)
+}
+
+// ignoreRelPath returns the path ignore_patterns are matched against: from
+// the home folder, or from the root for paths outside it
+func ignoreRelPath(path string) string {
+	if home, err := os.UserHomeDir(); err == nil && home != "" {
+		if rel, ok := fileutil.RelWithin(home, path); ok {
+			return rel
+		}
+	}
+	return strings.TrimPrefix(path, string(filepath.Separator))
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
@@ -0,0 +1,134 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// firstUserUID is the UID macOS gives the first account on a Mac
+const firstUserUID = 501
+
+// portStride separates the default ports of each account on the same Mac
+const portStride = 10
+
+// userSlot numbers the accounts on this Mac, 0 for the first. Each account
+// gets its own default port and device name, so daemons run by different
+// users on one Mac don't fight over them.
+func userSlot() int {
+	slot := os.Getuid() - firstUserUID
+	if slot < 0 || slot >= 100 {
+		return 0
+	}
+	return slot
+}
+
+// defaultPort returns this account's default for a port whose first-account
+// default is base
+func defaultPort(base int) int {
+	return base + userSlot()*portStride
+}
+
+// SuggestedSharePort returns the port this account's share server should use
+// when it is turned on; share links and exports are off by default
+func SuggestedSharePort() int {
+	return defaultPort(9878)
+}
+
+// defaultDeviceName returns the host name, followed by the user name for
+// every account but the first
+func defaultDeviceName() string {
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "My-Mac"
+	}
+	if userSlot() == 0 {
+		return hostname
+	}
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return hostname + "-" + u.Username
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getuid())
+}
+
+// Owner identifies this account on this Mac, e.g. "jane@MacBook-Pro"
+func Owner() string {
+	hostname, _ := os.Hostname()
+	hostname = strings.TrimSuffix(hostname, ".local")
+	name := strconv.Itoa(os.Getuid())
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		name = u.Username
+	}
+	return name + "@" + hostname
+}
+
+// PIDFile returns where the running daemon records its process ID
+func PIDFile() string {
+	return filepath.Join(configDir, "daemon.pid")
+}
+
+// DaemonPID returns the process ID of this user's running daemon, or 0 if
+// none is running
+func DaemonPID() int {
+	data, err := os.ReadFile(PIDFile())
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	// Fails for processes that are gone or belong to another user
+	if syscall.Kill(pid, 0) != nil {
+		return 0
+	}
+	return pid
+}
+
+// WritePIDFile records this process as the user's running daemon
+func WritePIDFile() error {
+	if err := os.WriteFile(PIDFile(), []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write pid file: %w", err)
+	}
+	return nil
+}
+
+// RemovePIDFile removes the pid file if it still names this process
+func RemovePIDFile() {
+	data, err := os.ReadFile(PIDFile())
+	if err != nil || strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	_ = os.Remove(PIDFile())
+}
+
+// RelayToken returns the secret this device registers with relays under,
+// creating it the first time. Only a registration with the same token can
+// replace this device's at a relay, so another device can't take its name.
+func RelayToken() (string, error) {
+	path := filepath.Join(ConfigDir(), "relay-token")
+	if data, err := os.ReadFile(path); err == nil {
+		if token := strings.TrimSpace(string(data)); token != "" {
+			return token, nil
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate relay token: %w", err)
+	}
+	token := hex.EncodeToString(secret)
+	if err := os.MkdirAll(ConfigDir(), 0755); err != nil {
+		return "", fmt.Errorf("failed to create config directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to write relay token: %w", err)
+	}
+	return token, nil
+}
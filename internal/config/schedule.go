@@ -0,0 +1,151 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// weekdays are the day names schedule windows accept, indexed by
+// time.Weekday. They may be shortened to three letters or more.
+var weekdays = []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+// TimeWindow is a daily span of time, on some days of the week, given as
+// "18:00-08:00" or "Mon-Fri 10:00-11:30". A window ending before it starts
+// runs past midnight into the next day.
+type TimeWindow struct {
+	Days  [7]bool // Days it starts on, indexed by time.Weekday
+	Start int     // Minutes after midnight
+	End   int
+}
+
+// ParseTimeWindow parses a schedule window
+func ParseTimeWindow(s string) (TimeWindow, error) {
+	var w TimeWindow
+	fields := strings.Fields(s)
+	switch len(fields) {
+	case 1:
+		for i := range w.Days {
+			w.Days[i] = true
+		}
+	case 2:
+		if err := w.parseDays(fields[0]); err != nil {
+			return w, fmt.Errorf("invalid schedule window %q: %w", s, err)
+		}
+		fields = fields[1:]
+	default:
+		return w, fmt.Errorf("invalid schedule window %q (use e.g. \"18:00-08:00\" or \"Mon-Fri 10:00-11:30\")", s)
+	}
+
+	start, end, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return w, fmt.Errorf("invalid schedule window %q: missing end time", s)
+	}
+	var err error
+	if w.Start, err = parseClock(start); err != nil {
+		return w, fmt.Errorf("invalid schedule window %q: %w", s, err)
+	}
+	if w.End, err = parseClock(end); err != nil {
+		return w, fmt.Errorf("invalid schedule window %q: %w", s, err)
+	}
+	if w.Start == w.End {
+		return w, fmt.Errorf("invalid schedule window %q: starts and ends at the same time", s)
+	}
+	return w, nil
+}
+
+// parseDays parses days like "Mon-Fri", "Sat,Sun" or "Wed"
+func (w *TimeWindow) parseDays(s string) error {
+	for _, part := range strings.Split(strings.ToLower(s), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		from := weekdayIndex(first)
+		to := from
+		if isRange {
+			to = weekdayIndex(last)
+		}
+		if from < 0 || to < 0 {
+			return fmt.Errorf("unknown day in %q", s)
+		}
+		// Ranges may wrap around the week, like Fri-Mon
+		for d := from; ; d = (d + 1) % 7 {
+			w.Days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// weekdayIndex returns the time.Weekday a day name stands for, or -1
+func weekdayIndex(day string) int {
+	for i, name := range weekdays {
+		if len(day) >= 3 && strings.HasPrefix(name, day) {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseClock parses "HH:MM" into minutes after midnight. "24:00" ends a
+// window at midnight.
+func parseClock(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q (use HH:MM)", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains reports whether t falls inside the window
+func (w TimeWindow) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.Start < w.End {
+		return w.Days[day] && minute >= w.Start && minute < w.End
+	}
+	// Past midnight: the evening part is on a start day, the morning part
+	// on the day after one
+	yesterday := (day + 6) % 7
+	return (w.Days[day] && minute >= w.Start) || (w.Days[yesterday] && minute < w.End)
+}
+
+// parseWindows parses a list of schedule windows
+func parseWindows(windows []string) ([]TimeWindow, error) {
+	parsed := make([]TimeWindow, 0, len(windows))
+	for _, s := range windows {
+		w, err := ParseTimeWindow(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, w)
+	}
+	return parsed, nil
+}
+
+// ScheduleBlock returns why sync.schedule or sync.quiet_hours keep syncing
+// off at t, or "" if syncing is allowed. Invalid windows are rejected when
+// the config loads, so they are skipped here.
+func (c *Config) ScheduleBlock(t time.Time) string {
+	quiet, _ := parseWindows(c.Sync.QuietHours)
+	for i, w := range quiet {
+		if w.Contains(t) {
+			return fmt.Sprintf("quiet hours %s", c.Sync.QuietHours[i])
+		}
+	}
+
+	windows, _ := parseWindows(c.Sync.Schedule)
+	if len(windows) == 0 {
+		return ""
+	}
+	for _, w := range windows {
+		if w.Contains(t) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("outside sync schedule %s", strings.Join(c.Sync.Schedule, ", "))
+}
@@ -0,0 +1,253 @@
+package discovery
+
+import (
+	"encoding/json"
+	"net"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultBeaconPort is the UDP port beacons are broadcast on. Every Mac on
+// the network must use the same one.
+const DefaultBeaconPort = 9879
+
+// beaconInterval is how often this Mac broadcasts its beacon. Peers time out
+// after two minutes without one.
+const beaconInterval = 30 * time.Second
+
+// beaconService tells our beacons apart from other traffic on the port
+const beaconService = "mac-profile-sync"
+
+// beacon is broadcast over UDP where mDNS is blocked, such as on corporate
+// Wi-Fi. Peers connect to the address it came from on Port.
+type beacon struct {
+	Service string `json:"service"`
+	Name    string `json:"name"`
+	Port    int    `json:"port"`
+	Owner   string `json:"owner,omitempty"`
+}
+
+// EnableBeacon turns on discovery by UDP broadcast on port, as a fallback for
+// networks that block mDNS
+func (d *Discovery) EnableBeacon(port int) {
+	if port <= 0 {
+		port = DefaultBeaconPort
+	}
+	d.beaconPort = port
+}
+
+// runBeacon listens for peers' beacons and, unless advertising is off,
+// broadcasts this Mac's own
+func (d *Discovery) runBeacon() {
+	// Other daemons on this Mac, run by other users, listen on the same port
+	lc := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); sockErr == nil {
+					sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	conn, err := lc.ListenPacket(d.ctx, "udp4", ":"+strconv.Itoa(d.beaconPort))
+	if err != nil {
+		log.Error().Err(err).Int("port", d.beaconPort).Msg("Failed to listen for discovery beacons")
+		return
+	}
+	go func() {
+		<-d.ctx.Done()
+		_ = conn.Close()
+	}()
+
+	log.Info().Int("port", d.beaconPort).Bool("broadcasting", d.advertise).Msg("Beacon discovery started")
+	if d.advertise {
+		go d.broadcastBeacons(conn)
+	}
+
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if d.ctx.Err() == nil {
+				log.Debug().Err(err).Msg("Failed to read discovery beacon")
+			}
+			return
+		}
+		addr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		var b beacon
+		if err := json.Unmarshal(buf[:n], &b); err != nil || b.Service != beaconService || b.Name == "" || b.Port <= 0 {
+			continue
+		}
+		d.handleBeacon(b, addr.IP)
+	}
+}
+
+// broadcastBeacons sends this Mac's beacon to every broadcast address it has
+func (d *Discovery) broadcastBeacons(conn net.PacketConn) {
+	data, err := json.Marshal(beacon{Service: beaconService, Name: d.instanceName, Port: d.port, Owner: d.owner})
+	if err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(beaconInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, ip := range d.broadcastAddresses() {
+			if _, err := conn.WriteTo(data, &net.UDPAddr{IP: ip, Port: d.beaconPort}); err != nil {
+				log.Debug().Err(err).Str("addr", ip.String()).Msg("Failed to broadcast discovery beacon")
+			}
+		}
+
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// broadcastAddresses returns the directed broadcast address of each IPv4
+// network this Mac is on, limited to network.mdns_interfaces if set, and the
+// limited broadcast address some networks only deliver
+func (d *Discovery) broadcastAddresses() []net.IP {
+	ifaces := d.interfaces
+	if len(ifaces) == 0 {
+		ifaces, _ = net.Interfaces()
+	}
+
+	var addrs []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ifAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range ifAddrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			ip := ipNet.IP.To4()
+			mask := net.IP(ipNet.Mask).To4()
+			if mask == nil {
+				continue
+			}
+			bcast := make(net.IP, net.IPv4len)
+			for i := range bcast {
+				bcast[i] = ip[i] | ^mask[i]
+			}
+			if !slices.ContainsFunc(addrs, bcast.Equal) {
+				addrs = append(addrs, bcast)
+			}
+		}
+	}
+	return append(addrs, net.IPv4bcast)
+}
+
+// handleBeacon adds the peer a beacon came from, or keeps it from timing out
+func (d *Discovery) handleBeacon(b beacon, ip net.IP) {
+	// Our own beacon comes back to us too
+	if b.Name == d.instanceName {
+		return
+	}
+
+	// Same ID as over mDNS, so a peer found both ways is added once
+	d.mu.Lock()
+	existing, exists := d.peers[b.Name]
+	if exists {
+		existing.LastSeen = time.Now()
+		d.mu.Unlock()
+		return
+	}
+	peer := &Peer{
+		ID:       b.Name,
+		Name:     b.Name,
+		Host:     ip.String(),
+		Port:     b.Port,
+		Addrs:    []net.IP{ip},
+		LastSeen: time.Now(),
+	}
+	d.peers[peer.ID] = peer
+	d.mu.Unlock()
+
+	log.Info().
+		Str("peer_id", peer.Name).
+		Str("addr", peer.Address()).
+		Str("owner", b.Owner).
+		Msg("Discovered peer by beacon")
+
+	if d.onPeerFound != nil {
+		d.onPeerFound(peer)
+	}
+}
+
+// AddIntroducedPeer adds a peer an introducer told us about, or keeps it
+// from timing out. Addresses are ip:port, most preferred first.
+func (d *Discovery) AddIntroducedPeer(name string, addresses []string) {
+	if name == d.deviceName || name == d.instanceName {
+		return
+	}
+
+	var ips []net.IP
+	port := 0
+	for _, addr := range addresses {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		p, err := strconv.Atoi(portStr)
+		if ip == nil || err != nil {
+			continue
+		}
+		// Peer holds one port; addresses on another are left out
+		if port == 0 {
+			port = p
+		}
+		if p == port {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return
+	}
+
+	d.mu.Lock()
+	if existing, ok := d.peers[name]; ok {
+		existing.LastSeen = time.Now()
+		d.mu.Unlock()
+		return
+	}
+	peer := &Peer{
+		ID:       name,
+		Name:     name,
+		Host:     ips[0].String(),
+		Port:     port,
+		Addrs:    ips,
+		LastSeen: time.Now(),
+	}
+	d.peers[peer.ID] = peer
+	d.mu.Unlock()
+
+	log.Info().Str("peer_id", peer.Name).Str("addr", peer.Address()).Msg("Peer introduced")
+
+	if d.onPeerFound != nil {
+		d.onPeerFound(peer)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,6 +16,7 @@ import (
 const (
 	serviceType   = "_mac-profile-sync._tcp"
 	serviceDomain = "local."
+	ownerKey      = "owner="
 )
 
 // Peer represents a discovered peer
@@ -33,12 +36,12 @@ func (p *Peer) Address() string {
 		// Prefer IPv4
 		for _, addr := range p.Addrs {
 			if addr.To4() != nil {
-				return fmt.Sprintf("%s:%d", addr, p.Port)
+				return net.JoinHostPort(addr.String(), strconv.Itoa(p.Port))
 			}
 		}
-		return fmt.Sprintf("%s:%d", p.Addrs[0], p.Port)
+		return net.JoinHostPort(p.Addrs[0].String(), strconv.Itoa(p.Port))
 	}
-	return fmt.Sprintf("%s:%d", p.Host, p.Port)
+	return net.JoinHostPort(p.Host, strconv.Itoa(p.Port))
 }
 
 // Discovery manages peer discovery via mDNS and manual configuration
@@ -48,6 +51,19 @@ type Discovery struct {
 	useDiscovery bool
 	manualPeers  []string
 
+	// Bonjour announcement
+	instanceName string          // Name peers see (defaults to the device name)
+	advertise    bool            // false = browse only
+	interfaces   []net.Interface // Announce only on these (nil = all)
+	owner        string          // Account running the daemon, e.g. "jane@MacBook-Pro"
+	warnedOwners map[string]bool // Other owners already warned about announcing our name
+
+	// tailscaled local API socket (empty = Tailscale discovery off)
+	tailscaleSocket string
+
+	// UDP port for beacon discovery (0 = beacon discovery off)
+	beaconPort int
+
 	server   *zeroconf.Server
 	peers    map[string]*Peer
 	mu       sync.RWMutex
@@ -69,6 +85,9 @@ func NewDiscovery(deviceName string, port int, useDiscovery bool, manualPeers []
 		port:         port,
 		useDiscovery: useDiscovery,
 		manualPeers:  manualPeers,
+		instanceName: deviceName,
+		advertise:    true,
+		warnedOwners: make(map[string]bool),
 		peers:        make(map[string]*Peer),
 		ctx:          ctx,
 		cancel:       cancel,
@@ -85,8 +104,12 @@ func (d *Discovery) SetCallbacks(onFound, onLost func(*Peer)) {
 func (d *Discovery) Start() error {
 	// Register ourselves via mDNS if enabled
 	if d.useDiscovery {
-		if err := d.registerService(); err != nil {
-			return fmt.Errorf("failed to register mDNS service: %w", err)
+		if d.advertise {
+			if err := d.registerService(); err != nil {
+				return fmt.Errorf("failed to register mDNS service: %w", err)
+			}
+		} else {
+			log.Info().Msg("mDNS advertising disabled, browsing for peers only")
 		}
 
 		// Start browsing for peers
@@ -98,6 +121,16 @@ func (d *Discovery) Start() error {
 		d.addManualPeer(addr)
 	}
 
+	// Look for peers across the tailnet
+	if d.tailscaleSocket != "" {
+		go d.browseTailscale()
+	}
+
+	// Find peers by broadcast where mDNS is blocked
+	if d.beaconPort != 0 {
+		go d.runBeacon()
+	}
+
 	// Start peer health check
 	go d.healthCheck()
 
@@ -145,23 +178,59 @@ func (d *Discovery) GetPeer(id string) *Peer {
 	return d.peers[id]
 }
 
+// SetAdvertisement controls how this Mac is announced over Bonjour. An empty
+// instance name announces the device name. With advertise off, peers are
+// still found but this Mac isn't announced (stealth mode). Interfaces limit
+// the announcement to the named network interfaces, e.g. "en0".
+func (d *Discovery) SetAdvertisement(instanceName string, advertise bool, interfaces []string) error {
+	var ifaces []net.Interface
+	for _, name := range interfaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return fmt.Errorf("unknown network interface %q: %w", name, err)
+		}
+		ifaces = append(ifaces, *iface)
+	}
+
+	if instanceName == "" {
+		instanceName = d.deviceName
+	}
+	d.instanceName = instanceName
+	d.advertise = advertise
+	d.interfaces = ifaces
+	return nil
+}
+
+// SetOwner sets the account announced alongside the service, so another
+// daemon announcing the same name, such as one run by a second user on this
+// Mac, can be told apart and reported
+func (d *Discovery) SetOwner(owner string) {
+	d.owner = owner
+}
+
 func (d *Discovery) registerService() error {
+	txt := []string{"version=1"}
+	if d.owner != "" {
+		txt = append(txt, ownerKey+d.owner)
+	}
+
 	var err error
 	d.server, err = zeroconf.Register(
-		d.deviceName,        // Instance name
-		serviceType,         // Service type
-		serviceDomain,       // Domain
-		d.port,              // Port
-		[]string{"version=1"}, // TXT records
-		nil,                 // Interfaces (nil = all)
+		d.instanceName, // Instance name
+		serviceType,    // Service type
+		serviceDomain,  // Domain
+		d.port,         // Port
+		txt,            // TXT records
+		d.interfaces,   // Interfaces (nil = all)
 	)
 	if err != nil {
 		return err
 	}
 
 	log.Info().
-		Str("name", d.deviceName).
+		Str("name", d.instanceName).
 		Int("port", d.port).
+		Int("interfaces", len(d.interfaces)).
 		Msg("mDNS service registered")
 
 	return nil
@@ -247,7 +316,8 @@ func (d *Discovery) doBrowseCycle() {
 				continue
 			}
 			// Don't add ourselves
-			if entry.Instance == d.deviceName {
+			if entry.Instance == d.instanceName {
+				d.checkNameConflict(entry)
 				continue
 			}
 			d.handleServiceEntry(entry)
@@ -261,6 +331,34 @@ func (d *Discovery) doBrowseCycle() {
 	}
 }
 
+// checkNameConflict warns when a service announcing our own name belongs to
+// another account. Neither can be found by peers reliably until one of them
+// is renamed.
+func (d *Discovery) checkNameConflict(entry *zeroconf.ServiceEntry) {
+	owner := entryOwner(entry)
+	if owner == "" || d.owner == "" || owner == d.owner || d.warnedOwners[owner] {
+		return
+	}
+	d.warnedOwners[owner] = true
+
+	log.Warn().
+		Str("name", entry.Instance).
+		Str("owner", owner).
+		Int("port", entry.Port).
+		Msg("Another daemon announces the same name; set device.name or network.mdns_instance_name to tell them apart")
+}
+
+// entryOwner returns the account a service was announced by, or "" for
+// peers too old to say
+func entryOwner(entry *zeroconf.ServiceEntry) string {
+	for _, txt := range entry.Text {
+		if strings.HasPrefix(txt, ownerKey) {
+			return strings.TrimPrefix(txt, ownerKey)
+		}
+	}
+	return ""
+}
+
 func (d *Discovery) handleServiceEntry(entry *zeroconf.ServiceEntry) {
 	peer := &Peer{
 		ID:       entry.Instance,
@@ -279,8 +377,9 @@ func (d *Discovery) handleServiceEntry(entry *zeroconf.ServiceEntry) {
 
 	if !exists {
 		log.Info().
-			Str("peer", peer.Name).
+			Str("peer_id", peer.Name).
 			Str("addr", peer.Address()).
+			Str("owner", entryOwner(entry)).
 			Msg("Discovered new peer")
 
 		if d.onPeerFound != nil {
@@ -291,15 +390,33 @@ func (d *Discovery) handleServiceEntry(entry *zeroconf.ServiceEntry) {
 	}
 }
 
-func (d *Discovery) addManualPeer(addr string) {
+// splitPeerAddress splits a manual peer into host and port. The port may be
+// left out (e.g., a MagicDNS name or Tailscale IP), in which case the local
+// sync port is assumed.
+func (d *Discovery) splitPeerAddress(addr string) (string, int, error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		return addr, d.port, nil
+	}
+	if !strings.Contains(addr, ":") {
+		return addr, d.port, nil
+	}
+
 	host, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
-		log.Error().Err(err).Str("addr", addr).Msg("Invalid manual peer address")
-		return
+		return "", 0, err
 	}
 
 	var port int
 	_, _ = fmt.Sscanf(portStr, "%d", &port)
+	return host, port, nil
+}
+
+func (d *Discovery) addManualPeer(addr string) {
+	host, port, err := d.splitPeerAddress(addr)
+	if err != nil {
+		log.Error().Err(err).Str("addr", addr).Msg("Invalid manual peer address")
+		return
+	}
 
 	peer := &Peer{
 		ID:       fmt.Sprintf("manual-%s", addr),
@@ -322,8 +439,9 @@ func (d *Discovery) addManualPeer(addr string) {
 	d.mu.Unlock()
 
 	log.Info().
-		Str("peer", peer.Name).
+		Str("peer_id", peer.Name).
 		Str("addr", peer.Address()).
+		Bool("tailscale", IsTailscaleAddress(host)).
 		Msg("Added manual peer")
 
 	if d.onPeerFound != nil {
@@ -344,7 +462,7 @@ func (d *Discovery) healthCheck() {
 				// Remove peers not seen in 2 minutes (unless manual)
 				if !peer.Manual && now.Sub(peer.LastSeen) > 2*time.Minute {
 					delete(d.peers, id)
-					log.Info().Str("peer", peer.Name).Msg("Peer timed out")
+					log.Info().Str("peer_id", peer.Name).Msg("Peer timed out")
 					if d.onPeerLost != nil {
 						d.onPeerLost(peer)
 					}
@@ -0,0 +1,203 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultTailscaleSocket is where the open-source tailscaled serves its local API
+const DefaultTailscaleSocket = "/var/run/tailscaled.socket"
+
+// tailscaleCLIPaths are tried when the local API socket isn't available, e.g.
+// with the Mac App Store build of Tailscale
+var tailscaleCLIPaths = []string{
+	"tailscale",
+	"/Applications/Tailscale.app/Contents/MacOS/Tailscale",
+}
+
+// tailscalePollInterval is how often the tailnet is checked for new nodes
+const tailscalePollInterval = 30 * time.Second
+
+// tailscaleCGNAT is the 100.64.0.0/10 range Tailscale assigns IPv4 addresses from
+var tailscaleCGNAT = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// tailscaleULA is the fd7a:115c:a1e0::/48 range Tailscale assigns IPv6 addresses from
+var tailscaleULA = &net.IPNet{IP: net.ParseIP("fd7a:115c:a1e0::"), Mask: net.CIDRMask(48, 128)}
+
+// IsTailscaleAddress reports whether host is a Tailscale IP or MagicDNS name
+func IsTailscaleAddress(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return tailscaleCGNAT.Contains(ip) || tailscaleULA.Contains(ip)
+	}
+	return strings.HasSuffix(strings.TrimSuffix(host, "."), ".ts.net")
+}
+
+// tailscaleStatus is the part of tailscaled's status response we use
+type tailscaleStatus struct {
+	Peer map[string]*tailscalePeer `json:"Peer"`
+}
+
+type tailscalePeer struct {
+	HostName     string   `json:"HostName"`
+	DNSName      string   `json:"DNSName"`
+	OS           string   `json:"OS"`
+	TailscaleIPs []string `json:"TailscaleIPs"`
+	Online       bool     `json:"Online"`
+}
+
+// EnableTailscale turns on discovery of tailnet nodes through tailscaled.
+// An empty socket uses the default location.
+func (d *Discovery) EnableTailscale(socket string) {
+	if socket == "" {
+		socket = DefaultTailscaleSocket
+	}
+	d.tailscaleSocket = socket
+}
+
+// browseTailscale periodically lists the tailnet and probes each online node
+// for a mac-profile-sync listener, since mDNS doesn't cross subnets
+func (d *Discovery) browseTailscale() {
+	ticker := time.NewTicker(tailscalePollInterval)
+	defer ticker.Stop()
+
+	for {
+		d.scanTailscale()
+
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Discovery) scanTailscale() {
+	status, err := d.tailscaleStatus()
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to query Tailscale status")
+		return
+	}
+
+	for _, node := range status.Peer {
+		if !node.Online || len(node.TailscaleIPs) == 0 {
+			continue
+		}
+		if d.isStopping() {
+			return
+		}
+		d.probeTailscaleNode(node)
+	}
+}
+
+// probeTailscaleNode adds a tailnet node as a peer if it accepts connections
+// on the sync port
+func (d *Discovery) probeTailscaleNode(node *tailscalePeer) {
+	id := "tailscale-" + node.HostName
+
+	d.mu.Lock()
+	existing, exists := d.peers[id]
+	if exists {
+		existing.LastSeen = time.Now()
+	}
+	// Already reachable via mDNS on the local network
+	_, onLAN := d.peers[node.HostName]
+	d.mu.Unlock()
+	if exists || onLAN {
+		return
+	}
+
+	var addrs []net.IP
+	for _, s := range node.TailscaleIPs {
+		if ip := net.ParseIP(s); ip != nil {
+			addrs = append(addrs, ip)
+		}
+	}
+
+	peer := &Peer{
+		ID:       id,
+		Name:     node.HostName,
+		Host:     strings.TrimSuffix(node.DNSName, "."),
+		Port:     d.port,
+		Addrs:    addrs,
+		LastSeen: time.Now(),
+	}
+
+	conn, err := net.DialTimeout("tcp", peer.Address(), 3*time.Second)
+	if err != nil {
+		// Not running mac-profile-sync (or not reachable)
+		return
+	}
+	_ = conn.Close()
+
+	d.mu.Lock()
+	d.peers[id] = peer
+	d.mu.Unlock()
+
+	log.Info().
+		Str("peer_id", peer.Name).
+		Str("addr", peer.Address()).
+		Msg("Discovered Tailscale peer")
+
+	if d.onPeerFound != nil {
+		d.onPeerFound(peer)
+	}
+}
+
+// tailscaleStatus asks tailscaled for the tailnet status, through its local
+// API socket or, failing that, the tailscale CLI
+func (d *Discovery) tailscaleStatus() (*tailscaleStatus, error) {
+	ctx, cancel := context.WithTimeout(d.ctx, 10*time.Second)
+	defer cancel()
+
+	var status tailscaleStatus
+	if _, err := os.Stat(d.tailscaleSocket); err == nil {
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", d.tailscaleSocket)
+				},
+			},
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://local-tailscaled.sock/localapi/v0/status", nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query tailscaled: %w", err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("tailscaled returned %s", resp.Status)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			return nil, fmt.Errorf("failed to decode tailscaled status: %w", err)
+		}
+		return &status, nil
+	}
+
+	for _, path := range tailscaleCLIPaths {
+		output, err := exec.CommandContext(ctx, path, "status", "--json").Output()
+		if err != nil {
+			continue
+		}
+		if err := json.Unmarshal(output, &status); err != nil {
+			return nil, fmt.Errorf("failed to decode tailscale status: %w", err)
+		}
+		return &status, nil
+	}
+
+	return nil, fmt.Errorf("tailscaled not found at %s and no tailscale CLI available", d.tailscaleSocket)
+}
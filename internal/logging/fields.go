@@ -0,0 +1,14 @@
+package logging
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// TransferID identifies one version of a file sent between peers. Both ends
+// derive the same ID from what the file data carries, so the sender's and
+// the receiver's log lines about it match.
+func TransferID(folderName, relPath, hash string) string {
+	sum := sha256.Sum256([]byte(folderName + "\x00" + relPath + "\x00" + hash))
+	return hex.EncodeToString(sum[:6])
+}
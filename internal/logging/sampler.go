@@ -0,0 +1,124 @@
+package logging
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// summaryMsg is logged for each message class that had entries suppressed
+const summaryMsg = "Suppressed repeated log messages"
+
+// Sampler is a zerolog hook that collapses repeated log messages. Each level
+// and message pair is a class; once a class has logged maxPerMinute entries in
+// a minute, further entries are dropped and counted until the minute ends.
+type Sampler struct {
+	maxPerMinute int
+	mu           sync.Mutex
+	classes      map[string]*class
+}
+
+type class struct {
+	level       zerolog.Level
+	msg         string
+	windowStart time.Time
+	count       int
+	suppressed  int
+}
+
+// NewSampler creates a sampler. A limit of zero or less disables sampling.
+func NewSampler(maxPerMinute int) *Sampler {
+	return &Sampler{
+		maxPerMinute: maxPerMinute,
+		classes:      make(map[string]*class),
+	}
+}
+
+// Run implements zerolog.Hook
+func (s *Sampler) Run(e *zerolog.Event, level zerolog.Level, msg string) {
+	if s.maxPerMinute <= 0 || msg == summaryMsg {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	key := level.String() + "\x00" + msg
+	c, ok := s.classes[key]
+	if !ok {
+		c = &class{level: level, msg: msg, windowStart: now}
+		s.classes[key] = c
+	}
+
+	if now.Sub(c.windowStart) >= time.Minute {
+		// Report drops from the last window on the first entry of the next
+		if c.suppressed > 0 {
+			e.Int("suppressed", c.suppressed)
+			c.suppressed = 0
+		}
+		c.windowStart = now
+		c.count = 0
+	}
+
+	c.count++
+	if c.count > s.maxPerMinute {
+		c.suppressed++
+		e.Discard()
+	}
+}
+
+// Flush logs a summary for each class with suppressed entries whose window has
+// ended, and forgets classes that have gone quiet
+func (s *Sampler) Flush() {
+	type summary struct {
+		level      zerolog.Level
+		msg        string
+		suppressed int
+	}
+	var summaries []summary
+
+	s.mu.Lock()
+	now := time.Now()
+	for key, c := range s.classes {
+		if now.Sub(c.windowStart) < time.Minute {
+			continue
+		}
+		if c.suppressed > 0 {
+			summaries = append(summaries, summary{c.level, c.msg, c.suppressed})
+		}
+		delete(s.classes, key)
+	}
+	s.mu.Unlock()
+
+	for _, sum := range summaries {
+		log.WithLevel(sum.level).
+			Str("repeated", sum.msg).
+			Int("suppressed", sum.suppressed).
+			Msg(summaryMsg)
+	}
+}
+
+// Start flushes summaries every minute until done is closed
+func (s *Sampler) Start(done <-chan struct{}) {
+	if s.maxPerMinute <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				s.Flush()
+				return
+			case <-ticker.C:
+				s.Flush()
+			}
+		}
+	}()
+}
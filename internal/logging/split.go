@@ -0,0 +1,160 @@
+package logging
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// The fields log lines are split on: the peer's device name, and the local
+// path of the synced folder
+const (
+	peerField   = "peer_id"
+	folderField = "folder_id"
+)
+
+// maxSplitLogSize is how large a split log grows before it is moved to
+// <name>.log.1, replacing the one before
+const maxSplitLogSize = 10 << 20
+
+// Splitter is a zerolog writer that copies each log line about a peer or a
+// folder into a log of its own, under dir/peers and dir/folders
+type Splitter struct {
+	dir       string
+	byPeer    bool
+	byFolder  bool
+	mu        sync.Mutex
+	files     map[string]*splitFile
+	warnedErr bool
+}
+
+type splitFile struct {
+	path string
+	file *os.File
+	out  io.Writer
+	size int64
+}
+
+// NewSplitter creates a splitter writing into dir
+func NewSplitter(dir string, byPeer, byFolder bool) *Splitter {
+	return &Splitter{
+		dir:      dir,
+		byPeer:   byPeer,
+		byFolder: byFolder,
+		files:    make(map[string]*splitFile),
+	}
+}
+
+// Write implements io.Writer. Lines are taken as zerolog's JSON events.
+func (s *Splitter) Write(p []byte) (int, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(p, &fields); err != nil {
+		return len(p), nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if peer, ok := fields[peerField].(string); ok && peer != "" && s.byPeer {
+		s.writeTo(filepath.Join("peers", logFileName(peer)), p)
+	}
+	if folder, ok := fields[folderField].(string); ok && folder != "" && s.byFolder {
+		s.writeTo(filepath.Join("folders", folderLogName(folder)), p)
+	}
+	return len(p), nil
+}
+
+// writeTo appends a line to a split log, opening or rotating it as needed.
+// Failures only cost the split copy, so they are reported once on stderr.
+func (s *Splitter) writeTo(name string, line []byte) {
+	f, err := s.open(name)
+	if err == nil {
+		var n int
+		n, err = f.out.Write(line)
+		f.size += int64(n)
+	}
+	if err != nil {
+		if !s.warnedErr {
+			s.warnedErr = true
+			fmt.Fprintf(os.Stderr, "failed to write split log %s: %v\n", name, err)
+		}
+		return
+	}
+
+	if f.size >= maxSplitLogSize {
+		_ = f.file.Close()
+		_ = os.Rename(f.path, f.path+".1")
+		delete(s.files, name)
+	}
+}
+
+func (s *Splitter) open(name string) (*splitFile, error) {
+	if f, ok := s.files[name]; ok {
+		return f, nil
+	}
+
+	path := filepath.Join(s.dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	f := &splitFile{
+		path: path,
+		file: file,
+		out:  zerolog.ConsoleWriter{Out: file, NoColor: true, TimeFormat: time.DateTime},
+		size: info.Size(),
+	}
+	s.files[name] = f
+	return f, nil
+}
+
+// Close closes every split log
+func (s *Splitter) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, f := range s.files {
+		_ = f.file.Close()
+		delete(s.files, name)
+	}
+	return nil
+}
+
+// folderLogName returns a folder's log file name: its name, followed by a
+// short hash of its path, so folders with the same name get their own logs
+func folderLogName(folderPath string) string {
+	sum := sha256.Sum256([]byte(folderPath))
+	return logFileName(filepath.Base(folderPath) + "-" + hex.EncodeToString(sum[:3]))
+}
+
+// logFileName turns a device or folder name into a log file name
+func logFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == ':' || r == '\\' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+	return name + ".log"
+}
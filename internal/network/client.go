@@ -21,6 +21,24 @@ type Client struct {
 	connections map[string]*ClientConnection
 	connMu      sync.RWMutex
 
+	// Send queue settings
+	queueSize   int
+	queuePolicy QueuePolicy
+
+	// Bandwidth limits shared by all connections (nil = unlimited)
+	upLimit   *RateLimiter
+	downLimit *RateLimiter
+
+	// STUN server for hole punching (empty = disabled)
+	stunServer string
+
+	// Keepalive settings
+	keepaliveInterval time.Duration
+	keepaliveTimeout  time.Duration
+
+	// Recent messages kept per connection (0 = counts only)
+	traceSize int
+
 	// Handlers
 	onConnect    func(*ClientConnection)
 	onDisconnect func(*ClientConnection)
@@ -33,14 +51,18 @@ type ClientConnection struct {
 	Address    string
 	DeviceName string
 	DeviceID   string
+	Version    string // Peer's protocol version, from its hello
 	Conn       net.Conn
 	Client     *Client
 	Paired     bool
 	LastSeen   time.Time
 
-	ctx    context.Context
-	cancel context.CancelFunc
-	mu     sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	queue     *sendQueue
+	inbound   *reassembler
+	keepalive *keepalive
+	trace     *tracer
 }
 
 // NewClient creates a new network client
@@ -51,9 +73,39 @@ func NewClient(tlsConfig *tls.Config) *Client {
 		ctx:         ctx,
 		cancel:      cancel,
 		connections: make(map[string]*ClientConnection),
+		queueSize:   DefaultQueueSize,
+		queuePolicy: QueueBlock,
+
+		keepaliveInterval: DefaultKeepaliveInterval,
+		keepaliveTimeout:  DefaultKeepaliveTimeout,
 	}
 }
 
+// SetQueueOptions configures the per-connection send queue for new connections
+func (c *Client) SetQueueOptions(size int, policy QueuePolicy) {
+	c.queueSize = size
+	c.queuePolicy = policy
+}
+
+// SetRateLimiters sets the upload and download limiters for new connections
+func (c *Client) SetRateLimiters(up, down *RateLimiter) {
+	c.upLimit = up
+	c.downLimit = down
+}
+
+// SetKeepalive sets how often connections are pinged and how long a silent
+// peer is tolerated before its connection is closed
+func (c *Client) SetKeepalive(interval, timeout time.Duration) {
+	c.keepaliveInterval = interval
+	c.keepaliveTimeout = timeout
+}
+
+// SetTraceSize sets how many recent messages new connections keep for
+// tracing (0 = only count them)
+func (c *Client) SetTraceSize(size int) {
+	c.traceSize = size
+}
+
 // SetHandlers sets the connection handlers
 func (c *Client) SetHandlers(onConnect, onDisconnect func(*ClientConnection), onMessage func(*ClientConnection, *Message)) {
 	c.onConnect = onConnect
@@ -88,23 +140,48 @@ func (c *Client) Connect(address string) (*ClientConnection, error) {
 		return nil, fmt.Errorf("failed to connect: %w", err)
 	}
 
+	return c.attach(address, conn), nil
+}
+
+// attach starts the writer, keepalive, and read loop for an established
+// connection and registers it under address
+func (c *Client) attach(address string, conn net.Conn) *ClientConnection {
 	ctx, cancel := context.WithCancel(c.ctx)
 	clientConn := &ClientConnection{
-		ID:       address,
-		Address:  address,
-		Conn:     conn,
-		Client:   c,
-		LastSeen: time.Now(),
-		ctx:      ctx,
-		cancel:   cancel,
+		ID:        address,
+		Address:   address,
+		Conn:      throttleConn(conn, c.upLimit, c.downLimit),
+		Client:    c,
+		LastSeen:  time.Now(),
+		ctx:       ctx,
+		cancel:    cancel,
+		keepalive: newKeepalive(),
+		trace:     newTracer(c.traceSize),
 	}
+	clientConn.queue = newSendQueue(c.queueSize, c.queuePolicy, ctx.Done(), clientConn.writeMessage)
+	clientConn.inbound = newReassembler(clientConn.queue)
+
+	// Start writer; a write failure closes the socket so the read loop cleans up
+	go func() {
+		if err := clientConn.queue.run(); err != nil {
+			log.Debug().Err(err).Str("address", address).Msg("Write error")
+			clientConn.cancel()
+			_ = clientConn.Conn.Close()
+		}
+	}()
+
+	// Start keepalive; closing the socket lets the read loop clean up
+	go clientConn.keepalive.run(ctx.Done(), c.keepaliveInterval, c.keepaliveTimeout, address, clientConn.Send, func() {
+		clientConn.cancel()
+		_ = clientConn.Conn.Close()
+	})
 
 	// Register connection
 	c.connMu.Lock()
 	c.connections[address] = clientConn
 	c.connMu.Unlock()
 
-	log.Info().Str("address", address).Msg("Connected to peer")
+	log.Info().Str("address", address).Str("peer_id", clientConn.peerID()).Msg("Connected to peer")
 
 	if c.onConnect != nil {
 		c.onConnect(clientConn)
@@ -113,7 +190,7 @@ func (c *Client) Connect(address string) (*ClientConnection, error) {
 	// Start read loop in background
 	go clientConn.readLoop()
 
-	return clientConn, nil
+	return clientConn
 }
 
 // Disconnect closes a connection to a peer
@@ -163,6 +240,15 @@ func (c *Client) GetConnection(address string) *ClientConnection {
 	return c.connections[address]
 }
 
+// peerID names the peer in log lines: its device name once it has answered
+// hello, its address before
+func (cc *ClientConnection) peerID() string {
+	if cc.DeviceName != "" {
+		return cc.DeviceName
+	}
+	return cc.Address
+}
+
 // Close closes the connection
 func (cc *ClientConnection) Close() {
 	cc.cancel()
@@ -172,16 +258,44 @@ func (cc *ClientConnection) Close() {
 		cc.Client.onDisconnect(cc)
 	}
 
-	log.Info().Str("address", cc.Address).Msg("Disconnected from peer")
+	log.Info().Str("address", cc.Address).Str("peer_id", cc.peerID()).Msg("Disconnected from peer")
 }
 
-// Send sends a message to the peer
+// Send queues a message for delivery to the peer
 func (cc *ClientConnection) Send(msg *Message) error {
-	cc.mu.Lock()
-	defer cc.mu.Unlock()
+	return cc.queue.enqueue(msg)
+}
+
+// SetPeerRateLimits caps this connection's bandwidth in kilobits per second,
+// on top of the limits shared by all connections (0 = no per-peer cap)
+func (cc *ClientConnection) SetPeerRateLimits(upKbps, downKbps int) {
+	setPeerLimits(cc.Conn, NewRateLimiter(upKbps), NewRateLimiter(downKbps))
+}
+
+// QueueStats returns send queue metrics for this connection
+func (cc *ClientConnection) QueueStats() QueueStats {
+	return cc.queue.stats()
+}
+
+// RTT returns the most recent keepalive round-trip time (zero if unmeasured)
+func (cc *ClientConnection) RTT() time.Duration {
+	return cc.keepalive.latency()
+}
+
+// ProtocolStats returns message counts by type for this connection, and its
+// most recent messages if tracing is on
+func (cc *ClientConnection) ProtocolStats() ProtocolStats {
+	return cc.trace.snapshot()
+}
 
+func (cc *ClientConnection) writeMessage(msg *Message) error {
 	_ = cc.Conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
-	return WriteMessage(cc.Conn, msg)
+	start := time.Now()
+	if err := WriteMessage(cc.Conn, msg); err != nil {
+		return err
+	}
+	cc.trace.sent(msg, time.Since(start))
+	return nil
 }
 
 // SendPayload creates and sends a message with the given payload
@@ -217,26 +331,43 @@ func (cc *ClientConnection) readLoop() {
 			select {
 			case <-cc.ctx.Done():
 			default:
-				log.Debug().Err(err).Str("address", cc.Address).Msg("Read error")
+				log.Debug().Err(err).Str("address", cc.Address).Str("peer_id", cc.peerID()).Msg("Read error")
 			}
 			return
 		}
 
 		cc.LastSeen = time.Now()
+		cc.keepalive.received(msg)
+		cc.trace.received(msg)
+
+		// Rebuild chunked file data before handing it on
+		msg, err = cc.inbound.receive(msg)
+		if err != nil {
+			log.Debug().Err(err).Str("address", cc.Address).Msg("Invalid file chunk")
+			return
+		}
+		if msg == nil {
+			continue
+		}
 
 		// Handle ping/pong internally
 		if msg.Type == MsgPing {
 			_ = cc.SendPayload(MsgPong, nil)
 			continue
 		}
+		if msg.Type == MsgPong {
+			continue
+		}
 
 		if cc.Client.onMessage != nil {
+			start := time.Now()
 			cc.Client.onMessage(cc, msg)
+			cc.trace.handled(msg, time.Since(start))
 		}
 	}
 }
 
-// Ping sends a ping to the peer and waits for pong
+// Ping sends a ping to the peer; the pong updates RTT
 func (cc *ClientConnection) Ping() error {
-	return cc.SendPayload(MsgPing, nil)
+	return cc.keepalive.ping(cc.Send)
 }
@@ -0,0 +1,475 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Golden messages pin down the wire format: one sample of each message type,
+// framed as WriteMessage writes it. Each protocol version's samples are kept
+// in their own directory under testdata/golden, written by the code that
+// version first shipped in, and TestGolden decodes every version's with the
+// current code, so a change that can't read what older daemons send is caught
+// before it ships. Only the current version's directory is ever rewritten;
+// once ProtocolVersion moves on, the last one written is kept as it is.
+
+// update writes the current version's golden messages before they are
+// checked: go test ./internal/network -run TestGolden -update
+var update = flag.Bool("update", false, "write golden messages for ProtocolVersion")
+
+// goldenDir holds the golden messages, one directory per protocol version
+const goldenDir = "testdata/golden"
+
+// protocolVersions lists every protocol version, oldest first. Add a version
+// here when ProtocolVersion moves on.
+var protocolVersions = []string{
+	"1.0",
+	chunkingVersion,
+	FileMoveVersion,
+	FileMetaVersion,
+	WindowVersion,
+	AddressUpdateVersion,
+	RestoreVersion,
+	IntroducerVersion,
+	JournalVersion,
+	MetaTimesVersion,
+	ResumeVersion,
+}
+
+// goldenTime is the timestamp in golden messages, so they don't change each
+// time they are written
+var goldenTime = time.Date(2024, time.March, 1, 12, 30, 0, 0, time.UTC)
+
+// goldenSample is a message as the current version sends it, and the first
+// version that understands its type. File acks and relay messages came in
+// while daemons still said 1.0, so 1.0 peers can't be counted on to know
+// them; only 1.1 can.
+type goldenSample struct {
+	Type    MessageType
+	Since   string
+	Payload any
+}
+
+// goldenSamples returns a sample of each message type, with every field set
+// so a field that is renamed or dropped shows up. File chunks aren't sampled;
+// TestLoopback covers them.
+func goldenSamples() []goldenSample {
+	file := FileInfo{
+		RelPath:    "Work/report.docx",
+		Size:       11,
+		ModTime:    goldenTime,
+		Hash:       "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+		HashAlgo:   "sha256",
+		Permission: 0644,
+		FolderPath: "/Users/alice/Documents",
+	}
+	link := file
+	link.RelPath, link.LinkOf = "Work/report link.docx", file.RelPath
+	pkg := FileInfo{RelPath: "Apps/Tool.app", IsDir: true, Package: true, Permission: 0755, ModTime: goldenTime, FolderPath: file.FolderPath}
+	xattrs := map[string][]byte{"com.apple.metadata:_kMDItemUserTags": []byte("Red\n6")}
+
+	return []goldenSample{
+		{MsgHello, "1.0", HelloMessage{DeviceName: "MacBook-Pro", DeviceID: "4f1c2a", Version: ProtocolVersion}},
+		{MsgHelloAck, "1.0", HelloAckMessage{DeviceName: "iMac", DeviceID: "9b7e10", Accepted: false, Reason: "not paired"}},
+		{MsgPairRequest, "1.0", PairRequestMessage{DeviceName: "MacBook-Pro", DeviceID: "4f1c2a", PublicKey: []byte{1, 2, 3, 4}}},
+		{MsgPairResponse, "1.0", PairResponseMessage{Accepted: true, Reason: "approved", PublicKey: []byte{5, 6, 7, 8}}},
+		{MsgFileList, "1.0", FileListMessage{
+			FolderPath:    file.FolderPath,
+			FolderName:    "Documents",
+			Files:         []FileInfo{file, link, pkg},
+			Sequence:      42,
+			PeerSequences: map[string]uint64{"iMac": 17},
+			Authoritative: true,
+			Restore:       true,
+			Journal:       true,
+
+			Generation:      3,
+			PeerGenerations: map[string]uint64{"iMac": 2},
+		}},
+		{MsgFileRequest, "1.0", FileRequestMessage{FolderPath: file.FolderPath, FolderName: "Documents", RelPath: file.RelPath, Offset: 4, Hash: file.Hash}},
+		{MsgFileData, "1.0", FileDataMessage{
+			FolderPath:  file.FolderPath,
+			FolderName:  "Documents",
+			RelPath:     file.RelPath,
+			Size:        file.Size,
+			ModTime:     goldenTime,
+			Birthtime:   goldenTime.Add(-time.Hour),
+			Permission:  file.Permission,
+			Hash:        file.Hash,
+			HashAlgo:    file.HashAlgo,
+			ContentHash: file.Hash,
+			Data:        []byte("hello world"),
+			IsChunked:   true,
+			ChunkIndex:  0,
+			TotalChunks: 1,
+			Xattrs:      xattrs,
+		}},
+		{MsgFileDelete, "1.0", FileDeleteMessage{FolderPath: file.FolderPath, FolderName: "Documents", RelPath: "Work/old.docx", Ignored: true}},
+		{MsgSyncComplete, "1.0", nil},
+		{MsgPing, "1.0", nil},
+		{MsgPong, "1.0", nil},
+		{MsgError, "1.0", ErrorMessage{Code: 500, Message: "failed to read file"}},
+		{MsgFileAck, chunkingVersion, FileAckMessage{FolderName: "Documents", RelPath: file.RelPath, Hash: file.Hash, OK: false, Error: "ignored", Code: "ignored", Rerequested: true}},
+		{MsgRelayHello, chunkingVersion, RelayHelloMessage{Role: "punch", Device: "MacBook-Pro", Peer: "iMac", Candidate: "203.0.113.7:9876", Token: "5d41402abc4b2a76"}},
+		{MsgRelayReady, chunkingVersion, RelayReadyMessage{OK: true, Peer: "iMac", Reason: "joined", Candidate: "198.51.100.2:9876"}},
+		{MsgFileMove, FileMoveVersion, FileMoveMessage{FolderPath: file.FolderPath, FolderName: "Documents", OldRelPath: "Work", NewRelPath: "Archive/Work", IsDir: true, Files: []FileInfo{file}}},
+		{MsgDirCreate, FileMetaVersion, DirCreateMessage{FolderPath: file.FolderPath, FolderName: "Documents", RelPath: "Work", Permission: 0755, Xattrs: xattrs}},
+		{MsgFileMeta, FileMetaVersion, FileMetaMessage{FolderPath: file.FolderPath, FolderName: "Documents", RelPath: file.RelPath, Hash: file.Hash, HashAlgo: file.HashAlgo, Permission: 0600, Flags: 0x8000, Xattrs: xattrs, ModTime: goldenTime}},
+		{MsgWindow, WindowVersion, WindowMessage{Bytes: 64 << 20, Files: 256}},
+		{MsgAddressUpdate, AddressUpdateVersion, AddressUpdateMessage{Addresses: []string{"192.168.1.20:9876", "100.64.0.3:9876"}, Introduce: true}},
+		{MsgPeerTable, IntroducerVersion, PeerTableMessage{Peers: []PeerTableEntry{{Name: "Mac-mini", Addresses: []string{"192.168.1.30:9876"}}}}},
+	}
+}
+
+// payloadFor returns a pointer to decode a message type's payload into, or
+// nil for types without one
+func payloadFor(t MessageType) any {
+	for _, sample := range goldenSamples() {
+		if sample.Type == t && sample.Payload != nil {
+			return reflect.New(reflect.TypeOf(sample.Payload)).Interface()
+		}
+	}
+	return nil
+}
+
+// goldenMessage encodes a sample with the golden timestamp
+func goldenMessage(sample goldenSample) (*Message, error) {
+	msg, err := NewMessage(sample.Type, sample.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %w", sample.Type, err)
+	}
+	msg.Timestamp = goldenTime
+	return msg, nil
+}
+
+// goldenFile is the name a message type's golden message is saved under
+func goldenFile(t MessageType) string {
+	return fmt.Sprintf("%02d-%s.msg", t, t)
+}
+
+// writeGolden writes the current version's golden messages to a directory
+// named for ProtocolVersion under dir, replacing any there
+func writeGolden(dir string) error {
+	versionDir := filepath.Join(dir, ProtocolVersion)
+	if err := os.MkdirAll(versionDir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", versionDir, err)
+	}
+
+	for _, sample := range goldenSamples() {
+		msg, err := goldenMessage(sample)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := WriteMessage(&buf, msg); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(versionDir, goldenFile(sample.Type)), buf.Bytes(), 0644); err != nil {
+			return fmt.Errorf("failed to write golden message: %w", err)
+		}
+	}
+	return nil
+}
+
+// TestGolden decodes every golden message with the current code. A message
+// fails if it can't be read or decoded, or if a field it carries is lost when
+// the decoded payload is encoded again.
+func TestGolden(t *testing.T) {
+	if *update {
+		if err := writeGolden(goldenDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(goldenDir, ProtocolVersion)); err != nil {
+		t.Fatalf("no golden messages for protocol %s; write them with -update", ProtocolVersion)
+	}
+
+	for _, version := range protocolVersions {
+		files, err := filepath.Glob(filepath.Join(goldenDir, version, "*.msg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) == 0 {
+			t.Errorf("no golden messages for protocol %s", version)
+			continue
+		}
+		if err := checkGoldenTypes(version, files); err != nil {
+			t.Error(err)
+		}
+		for _, path := range files {
+			name := version + " " + strings.TrimSuffix(filepath.Base(path), ".msg")
+			t.Run(name, func(t *testing.T) {
+				if err := checkGoldenFile(path); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+}
+
+// checkGoldenTypes checks a version's golden messages are of exactly the
+// types that version understands, so each sample's Since is right
+func checkGoldenTypes(version string, files []string) error {
+	have := make(map[string]bool)
+	for _, path := range files {
+		have[filepath.Base(path)] = true
+	}
+	for _, sample := range goldenSamples() {
+		name := goldenFile(sample.Type)
+		known := VersionAtLeast(version, sample.Since)
+		switch {
+		case known && !have[name]:
+			return fmt.Errorf("protocol %s has no golden %s, though its sample says it came in %s", version, sample.Type, sample.Since)
+		case !known && have[name]:
+			return fmt.Errorf("protocol %s sends %s, but its sample says it came in %s", version, sample.Type, sample.Since)
+		}
+		delete(have, name)
+	}
+	for name := range have {
+		return fmt.Errorf("protocol %s has %s, which has no sample", version, name)
+	}
+	return nil
+}
+
+// checkGoldenFile decodes one golden message and checks nothing in it is lost
+func checkGoldenFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	msg, err := ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	payload := payloadFor(msg.Type)
+	if payload == nil {
+		return nil
+	}
+	if err := msg.DecodePayload(payload); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", msg.Type, err)
+	}
+	return samePayload(msg.Payload, payload)
+}
+
+// samePayload checks that encoding a decoded payload again keeps every field
+// of the original. Fields added since are allowed.
+func samePayload(original []byte, decoded any) error {
+	again, err := json.Marshal(decoded)
+	if err != nil {
+		return err
+	}
+	var want, got any
+	if err := json.Unmarshal(original, &want); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(again, &got); err != nil {
+		return err
+	}
+	if field := missingField(want, got, ""); field != "" {
+		return fmt.Errorf("%s is lost when decoded", field)
+	}
+	return nil
+}
+
+// missingField returns the first field of want that got doesn't have with
+// the same value, or "" if there is none
+func missingField(want, got any, at string) string {
+	switch w := want.(type) {
+	case map[string]any:
+		g, ok := got.(map[string]any)
+		if !ok {
+			return at
+		}
+		for key, value := range w {
+			if field := missingField(value, g[key], at+"."+key); field != "" {
+				return field
+			}
+		}
+		return ""
+	case []any:
+		g, ok := got.([]any)
+		if !ok || len(g) != len(w) {
+			return at
+		}
+		for i := range w {
+			if field := missingField(w[i], g[i], fmt.Sprintf("%s[%d]", at, i)); field != "" {
+				return field
+			}
+		}
+		return ""
+	default:
+		if !reflect.DeepEqual(want, got) {
+			return at
+		}
+		return ""
+	}
+}
+
+// TestLoopback runs each protocol version against this one, both ways
+func TestLoopback(t *testing.T) {
+	for _, version := range protocolVersions {
+		for _, pair := range [][2]string{{ProtocolVersion, version}, {version, ProtocolVersion}} {
+			local, remote := pair[0], pair[1]
+			t.Run(local+" to "+remote, func(t *testing.T) {
+				if err := checkLoopback(local, remote); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+}
+
+// checkLoopback sends every message a peer of version remote understands
+// from a daemon of version local, over an in-memory connection through the
+// same lane scheduler and reassembler connections use. An older daemon sends
+// its golden messages, as its own code encoded them. It fails if the peer
+// would get a message type it doesn't know or file data chunks it can't
+// reassemble, or if anything arrives different from how it was sent.
+func checkLoopback(local, remote string) error {
+	// A file data message large enough to be sent in chunks
+	large := FileDataMessage{
+		FolderName:  "Documents",
+		RelPath:     "Media/clip.mov",
+		Size:        3 * laneChunkSize,
+		ModTime:     goldenTime,
+		Data:        bytes.Repeat([]byte("0123456789abcdef"), 3*laneChunkSize/16),
+		TotalChunks: 1,
+	}
+
+	var sent []*Message
+	if local != ProtocolVersion {
+		old, err := readGolden(local)
+		if err != nil {
+			return err
+		}
+		sent = old
+	} else {
+		for _, sample := range goldenSamples() {
+			if sample.Type == MsgHello {
+				sample.Payload = HelloMessage{DeviceName: "local", DeviceID: "local", Version: local}
+			}
+			if VersionAtLeast(remote, sample.Since) {
+				msg, err := goldenMessage(sample)
+				if err != nil {
+					return err
+				}
+				sent = append(sent, msg)
+			}
+		}
+	}
+	msg, err := NewFileDataMessage(large)
+	if err != nil {
+		return err
+	}
+	msg.Timestamp = goldenTime
+	sent = append(sent, msg)
+
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+
+	// Chunks go only to a peer whose hello shows it can reassemble them
+	chunking := VersionAtLeast(local, chunkingVersion) && VersionAtLeast(remote, chunkingVersion)
+	writeErr := make(chan error, 1)
+	go func() {
+		defer ours.Close()
+		lanes := newLaneScheduler()
+		for _, msg := range sent {
+			lanes.add(msg)
+		}
+		for !lanes.empty() {
+			frame, _ := lanes.next(chunking)
+			if err := WriteMessage(ours, frame); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+		writeErr <- nil
+	}()
+
+	reassemble := newReassembler(&sendQueue{})
+	var received []*Message
+	for len(received) < len(sent) {
+		frame, err := ReadMessage(theirs)
+		if err != nil {
+			return fmt.Errorf("after %d messages: %w", len(received), err)
+		}
+		if frame.Type == MsgFileChunk && !VersionAtLeast(remote, chunkingVersion) {
+			return fmt.Errorf("%s peer was sent file data chunks", remote)
+		}
+		msg, err := reassemble.receive(frame)
+		if err != nil {
+			return err
+		}
+		if msg != nil {
+			received = append(received, msg)
+		}
+	}
+	if err := <-writeErr; err != nil {
+		return err
+	}
+
+	// Messages in different lanes may be reordered, but each arrives intact
+	byType := make(map[MessageType][][]byte)
+	for _, msg := range sent {
+		byType[msg.Type] = append(byType[msg.Type], msg.Payload)
+	}
+	for _, msg := range received {
+		if !VersionAtLeast(remote, sinceVersion(msg.Type)) {
+			return fmt.Errorf("%s peer was sent %s, which it doesn't know", remote, msg.Type)
+		}
+		payloads := byType[msg.Type]
+		if len(payloads) == 0 {
+			return fmt.Errorf("%s arrived more often than it was sent", msg.Type)
+		}
+		if !bytes.Equal(payloads[0], msg.Payload) {
+			return fmt.Errorf("%s arrived changed", msg.Type)
+		}
+		byType[msg.Type] = payloads[1:]
+	}
+	return nil
+}
+
+// readGolden reads a version's golden messages
+func readGolden(version string) ([]*Message, error) {
+	files, err := filepath.Glob(filepath.Join(goldenDir, version, "*.msg"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no golden messages for protocol %s", version)
+	}
+
+	var msgs []*Message
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// sinceVersion returns the first version that understands a message type
+func sinceVersion(t MessageType) string {
+	for _, sample := range goldenSamples() {
+		if sample.Type == t {
+			return sample.Since
+		}
+	}
+	return ProtocolVersion
+}
@@ -0,0 +1,63 @@
+package network
+
+import "errors"
+
+// Kinds of error callers tell apart with errors.Is, whichever package
+// returned them. The errors wrapping them carry the details.
+var (
+	// ErrPeerOffline is returned when a peer needed for an operation isn't connected
+	ErrPeerOffline = errors.New("peer is offline")
+	// ErrUnauthorized is returned when a peer refuses this Mac
+	ErrUnauthorized = errors.New("not authorized")
+	// ErrTooLarge is returned for a file or message over a size limit
+	ErrTooLarge = errors.New("too large")
+	// ErrIgnored is returned for a path that ignore rules exclude from sync
+	ErrIgnored = errors.New("ignored")
+	// ErrConflictPending is returned for a file with a conflict waiting to be resolved
+	ErrConflictPending = errors.New("conflict pending")
+)
+
+// Error codes carry an error's kind to a peer, in a file ack
+var errorCodes = map[string]error{
+	"peer_offline":     ErrPeerOffline,
+	"unauthorized":     ErrUnauthorized,
+	"too_large":        ErrTooLarge,
+	"ignored":          ErrIgnored,
+	"conflict_pending": ErrConflictPending,
+}
+
+// ErrorCode returns the code for err's kind, or "" if it is none of them
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	for code, kind := range errorCodes {
+		if errors.Is(err, kind) {
+			return code
+		}
+	}
+	return ""
+}
+
+// CodeError turns an error a peer reported back into one of its kind, so it
+// can be told apart like a local one. Its message is the peer's.
+func CodeError(code, message string) error {
+	kind, ok := errorCodes[code]
+	if !ok {
+		return errors.New(message)
+	}
+	if message == "" {
+		return kind
+	}
+	return &codeError{kind: kind, message: message}
+}
+
+// codeError is an error from a peer, of a known kind
+type codeError struct {
+	kind    error
+	message string
+}
+
+func (e *codeError) Error() string { return e.message }
+
+func (e *codeError) Unwrap() error { return e.kind }
@@ -0,0 +1,75 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"nil", nil, ""},
+		{"unknown", errors.New("disk full"), ""},
+		{"sentinel", ErrTooLarge, "too_large"},
+		{"wrapped", fmt.Errorf("notes.tmp is %w by this Mac's rules", ErrIgnored), "ignored"},
+		{"wrapped twice", fmt.Errorf("send: %w", fmt.Errorf("iMac: %w", ErrPeerOffline)), "peer_offline"},
+		{"from a peer", CodeError("conflict_pending", "a.txt has a pending conflict"), "conflict_pending"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ErrorCode(tt.err); got != tt.want {
+				t.Errorf("ErrorCode(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCodeError(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    string
+		message string
+		kind    error // nil if the error is of no known kind
+		want    string
+	}{
+		{"known code", "ignored", "notes.tmp is ignored by the peer's rules", ErrIgnored, "notes.tmp is ignored by the peer's rules"},
+		{"known code without a message", "unauthorized", "", ErrUnauthorized, ErrUnauthorized.Error()},
+		{"unknown code", "quota", "over quota", nil, "over quota"},
+		{"no code", "", "failed to write file", nil, "failed to write file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CodeError(tt.code, tt.message)
+			if err.Error() != tt.want {
+				t.Errorf("message = %q, want %q", err.Error(), tt.want)
+			}
+			for _, kind := range errorCodes {
+				if got := errors.Is(err, kind); got != (kind == tt.kind) {
+					t.Errorf("errors.Is(%v) = %v", kind, got)
+				}
+			}
+		})
+	}
+}
+
+// Every kind survives the trip to a peer and back
+func TestErrorCodeRoundTrip(t *testing.T) {
+	for code, kind := range errorCodes {
+		t.Run(code, func(t *testing.T) {
+			err := fmt.Errorf("a.txt: %w", kind)
+			back := CodeError(ErrorCode(err), err.Error())
+			if !errors.Is(back, kind) {
+				t.Errorf("%v came back as %v", err, back)
+			}
+			if back.Error() != err.Error() {
+				t.Errorf("message = %q, want %q", back.Error(), err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package network
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultKeepaliveInterval = 15 * time.Second
+	DefaultKeepaliveTimeout  = 45 * time.Second
+)
+
+// keepalive pings a connection periodically, measures round-trip time, and
+// detects peers that have stopped responding
+type keepalive struct {
+	mu       sync.Mutex
+	pingSent time.Time // Zero when no ping is outstanding
+	lastRecv time.Time
+	rtt      time.Duration
+}
+
+func newKeepalive() *keepalive {
+	return &keepalive{lastRecv: time.Now()}
+}
+
+// received notes incoming traffic; a pong completes the outstanding ping
+func (k *keepalive) received(msg *Message) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := time.Now()
+	k.lastRecv = now
+	if msg.Type == MsgPong && !k.pingSent.IsZero() {
+		k.rtt = now.Sub(k.pingSent)
+		k.pingSent = time.Time{}
+	}
+}
+
+// ping sends a ping unless one is already outstanding
+func (k *keepalive) ping(send func(*Message) error) error {
+	k.mu.Lock()
+	if !k.pingSent.IsZero() {
+		k.mu.Unlock()
+		return nil
+	}
+	k.pingSent = time.Now()
+	k.mu.Unlock()
+
+	msg, err := NewMessage(MsgPing, nil)
+	if err != nil {
+		return err
+	}
+	return send(msg)
+}
+
+func (k *keepalive) latency() time.Duration {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.rtt
+}
+
+func (k *keepalive) idle() time.Duration {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return time.Since(k.lastRecv)
+}
+
+// run pings every interval and calls onDead once nothing has been received
+// for longer than timeout. An interval of zero disables keepalives.
+func (k *keepalive) run(done <-chan struct{}, interval, timeout time.Duration, remote string, send func(*Message) error, onDead func()) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if idle := k.idle(); timeout > 0 && idle > timeout {
+				log.Warn().Str("remote", remote).Dur("idle", idle).Msg("Peer stopped responding, closing connection")
+				onDead()
+				return
+			}
+			if err := k.ping(send); err != nil {
+				log.Debug().Err(err).Str("remote", remote).Msg("Failed to send keepalive ping")
+			}
+		}
+	}
+}
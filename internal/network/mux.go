@@ -0,0 +1,269 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// laneChunkSize is how much file data is written before another folder gets a turn
+	laneChunkSize = 256 * 1024
+
+	// Chunk payloads start with a 4-byte stream ID and a flags byte
+	chunkHeaderSize = 5
+	chunkFinal      = 0x01
+)
+
+// First protocol versions that understand newer message types
+const (
+	chunkingVersion = "1.1" // MsgFileChunk
+	FileMoveVersion = "1.2" // MsgFileMove
+	FileMetaVersion = "1.3" // MsgFileMeta
+	WindowVersion   = "1.4" // MsgWindow
+
+	AddressUpdateVersion = "1.5" // MsgAddressUpdate
+	RestoreVersion       = "1.6" // FileListMessage.Restore
+	IntroducerVersion    = "1.7" // MsgPeerTable
+	JournalVersion       = "1.8" // FileListMessage.Journal
+	MetaTimesVersion     = "1.9" // FileMetaMessage.ModTime
+
+	ResumeVersion = "1.10" // FileRequestMessage.Offset, file data in parts
+)
+
+// VersionAtLeast reports whether a peer's protocol version is want or newer
+func VersionAtLeast(version, want string) bool {
+	major, minor := parseVersion(version)
+	wantMajor, wantMinor := parseVersion(want)
+	return major > wantMajor || (major == wantMajor && minor >= wantMinor)
+}
+
+// Capabilities lists the protocol features a peer's version supports
+func Capabilities(version string) []string {
+	var caps []string
+	if VersionAtLeast(version, chunkingVersion) {
+		caps = append(caps, "chunking")
+	}
+	if VersionAtLeast(version, FileMoveVersion) {
+		caps = append(caps, "moves")
+	}
+	if VersionAtLeast(version, FileMetaVersion) {
+		caps = append(caps, "metadata")
+	}
+	if VersionAtLeast(version, WindowVersion) {
+		caps = append(caps, "flow-control")
+	}
+	if VersionAtLeast(version, AddressUpdateVersion) {
+		caps = append(caps, "address-updates")
+	}
+	if VersionAtLeast(version, RestoreVersion) {
+		caps = append(caps, "restores")
+	}
+	if VersionAtLeast(version, IntroducerVersion) {
+		caps = append(caps, "introductions")
+	}
+	if VersionAtLeast(version, JournalVersion) {
+		caps = append(caps, "journal")
+	}
+	if VersionAtLeast(version, MetaTimesVersion) {
+		caps = append(caps, "metadata-times")
+	}
+	if VersionAtLeast(version, ResumeVersion) {
+		caps = append(caps, "resume")
+	}
+	return caps
+}
+
+func parseVersion(version string) (int, int) {
+	parts := strings.SplitN(version, ".", 2)
+	major, _ := strconv.Atoi(parts[0])
+	minor := 0
+	if len(parts) == 2 {
+		minor, _ = strconv.Atoi(parts[1])
+	}
+	return major, minor
+}
+
+// NewFileDataMessage creates a file data message in its folder's lane
+func NewFileDataMessage(data FileDataMessage) (*Message, error) {
+	msg, err := NewMessage(MsgFileData, data)
+	if err != nil {
+		return nil, err
+	}
+	msg.Lane = data.FolderName
+	return msg, nil
+}
+
+// laneOf returns the folder lane for file data, deletes, and moves; other
+// messages are control traffic and go ahead of any file data
+func laneOf(msg *Message) (string, bool) {
+	switch msg.Type {
+	case MsgFileData, MsgFileDelete, MsgFileMove:
+	default:
+		return "", false
+	}
+
+	if msg.Lane != "" {
+		return msg.Lane, true
+	}
+	var folder struct {
+		FolderName string `json:"folder_name"`
+	}
+	_ = msg.DecodePayload(&folder)
+	return folder.FolderName, true
+}
+
+// outgoing is a folder message being written, possibly in several chunks
+type outgoing struct {
+	msg     *Message
+	offset  int
+	stream  uint32
+	chunked bool
+}
+
+// laneScheduler interleaves folder traffic round-robin, one chunk per turn,
+// so one folder's bulk transfer doesn't starve the others. Messages within a
+// folder keep their order. Only the writer goroutine touches it.
+type laneScheduler struct {
+	control []*Message
+	lanes   map[string][]*outgoing
+	order   []string // Lanes with queued messages, next turn first
+	stream  uint32
+}
+
+func newLaneScheduler() *laneScheduler {
+	return &laneScheduler{lanes: make(map[string][]*outgoing)}
+}
+
+func (s *laneScheduler) add(msg *Message) {
+	lane, ok := laneOf(msg)
+	if !ok {
+		s.control = append(s.control, msg)
+		return
+	}
+
+	if len(s.lanes[lane]) == 0 {
+		s.order = append(s.order, lane)
+	}
+	s.lanes[lane] = append(s.lanes[lane], &outgoing{msg: msg})
+}
+
+func (s *laneScheduler) empty() bool {
+	return len(s.control) == 0 && len(s.order) == 0
+}
+
+// next returns the next frame to write and whether it completes a queued message
+func (s *laneScheduler) next(chunking bool) (*Message, bool) {
+	if len(s.control) > 0 {
+		msg := s.control[0]
+		s.control = s.control[1:]
+		return msg, true
+	}
+	if len(s.order) == 0 {
+		return nil, false
+	}
+
+	lane := s.order[0]
+	s.order = s.order[1:]
+	queue := s.lanes[lane]
+	head := queue[0]
+
+	frame, done := s.frame(head, chunking)
+	if done {
+		queue = queue[1:]
+	}
+	if len(queue) == 0 {
+		delete(s.lanes, lane)
+	} else {
+		s.lanes[lane] = queue
+		s.order = append(s.order, lane)
+	}
+	return frame, done
+}
+
+// frame cuts the next chunk from a message, or returns it whole if it is
+// small or the peer can't reassemble chunks
+func (s *laneScheduler) frame(o *outgoing, chunking bool) (*Message, bool) {
+	payload := o.msg.Payload
+	if !o.chunked && (!chunking || o.msg.Type != MsgFileData || len(payload) <= laneChunkSize) {
+		return o.msg, true
+	}
+
+	if !o.chunked {
+		s.stream++
+		o.stream = s.stream
+		o.chunked = true
+	}
+
+	end := o.offset + laneChunkSize
+	if end > len(payload) {
+		end = len(payload)
+	}
+	final := end == len(payload)
+
+	data := make([]byte, chunkHeaderSize+end-o.offset)
+	binary.BigEndian.PutUint32(data[0:4], o.stream)
+	if final {
+		data[4] = chunkFinal
+	}
+	copy(data[chunkHeaderSize:], payload[o.offset:end])
+	o.offset = end
+
+	return &Message{Type: MsgFileChunk, Timestamp: o.msg.Timestamp, Payload: data, queued: o.msg.queued}, final
+}
+
+// reassembler rebuilds file data messages from chunks and turns on chunked
+// sending once the peer's hello shows it can reassemble them (both sides send
+// a hello). Only the read loop touches it.
+type reassembler struct {
+	queue   *sendQueue
+	streams map[uint32]*Message
+}
+
+func newReassembler(queue *sendQueue) *reassembler {
+	return &reassembler{queue: queue, streams: make(map[uint32]*Message)}
+}
+
+// receive returns the message to deliver, or nil while a chunked message is
+// still incomplete
+func (r *reassembler) receive(msg *Message) (*Message, error) {
+	switch msg.Type {
+	case MsgFileChunk:
+		return r.add(msg)
+	case MsgHello:
+		var hello HelloMessage
+		if err := msg.DecodePayload(&hello); err == nil && VersionAtLeast(hello.Version, chunkingVersion) {
+			r.queue.chunking.Store(true)
+		}
+	}
+	return msg, nil
+}
+
+// add takes a chunk and returns the file data message once it is complete
+func (r *reassembler) add(chunk *Message) (*Message, error) {
+	if len(chunk.Payload) < chunkHeaderSize {
+		return nil, fmt.Errorf("short file chunk: %d bytes", len(chunk.Payload))
+	}
+
+	stream := binary.BigEndian.Uint32(chunk.Payload[0:4])
+	final := chunk.Payload[4]&chunkFinal != 0
+	data := chunk.Payload[chunkHeaderSize:]
+
+	msg, ok := r.streams[stream]
+	if !ok {
+		msg = &Message{Type: MsgFileData, Timestamp: chunk.Timestamp}
+		r.streams[stream] = msg
+	}
+	if len(msg.Payload)+len(data) > MaxMessageSize {
+		delete(r.streams, stream)
+		return nil, fmt.Errorf("message %w: %d bytes", ErrTooLarge, len(msg.Payload)+len(data))
+	}
+	msg.Payload = append(msg.Payload, data...)
+
+	if !final {
+		return nil, nil
+	}
+	delete(r.streams, stream)
+	return msg, nil
+}
@@ -29,6 +29,34 @@ const (
 	MsgPing
 	MsgPong
 	MsgError
+
+	// Delivery messages
+	MsgFileAck
+
+	// Relay messages
+	MsgRelayHello
+	MsgRelayReady
+
+	// File data split into chunks so folders can share a connection
+	MsgFileChunk
+
+	// A file or folder renamed or moved within a synced folder
+	MsgFileMove
+
+	// A directory created, or its metadata changed, within a synced folder
+	MsgDirCreate
+
+	// A file's permissions, flags or extended attributes changed, but not its content
+	MsgFileMeta
+
+	// How much unacknowledged file data the receiver accepts
+	MsgWindow
+
+	// The sender's addresses changed, so it can be redialed before discovery notices
+	MsgAddressUpdate
+
+	// An introducer's connected peers and where to reach them
+	MsgPeerTable
 )
 
 // Message is the base network message
@@ -36,6 +64,11 @@ type Message struct {
 	Type      MessageType `json:"type"`
 	Timestamp time.Time   `json:"timestamp"`
 	Payload   []byte      `json:"payload"`
+
+	// Lane is the folder this message's data belongs to (not sent)
+	Lane string `json:"-"`
+
+	queued time.Time // When it was queued for sending
 }
 
 // HelloMessage is sent when connecting to a peer
@@ -53,6 +86,17 @@ type HelloAckMessage struct {
 	Reason     string `json:"reason,omitempty"`
 }
 
+// Err returns ErrUnauthorized with the peer's reason if it refused the hello
+func (a HelloAckMessage) Err() error {
+	if a.Accepted {
+		return nil
+	}
+	if a.Reason == "" {
+		return ErrUnauthorized
+	}
+	return fmt.Errorf("%w: %s", ErrUnauthorized, a.Reason)
+}
+
 // PairRequestMessage requests pairing with a peer
 type PairRequestMessage struct {
 	DeviceName string `json:"device_name"`
@@ -73,16 +117,27 @@ type FileInfo struct {
 	Size       int64       `json:"size"`
 	ModTime    time.Time   `json:"mod_time"`
 	Hash       string      `json:"hash"`
+	HashAlgo   string      `json:"hash_algo,omitempty"` // Empty for peers that predate hash algorithms (sha256)
 	IsDir      bool        `json:"is_dir"`
+	LinkOf     string      `json:"link_of,omitempty"` // Another file in the list this one is a hard link to
+	Package    bool        `json:"package,omitempty"` // A directory synced as one unit, such as an app
 	Permission uint32      `json:"permission"`
 	FolderPath string      `json:"folder_path"` // Base folder being synced
 }
 
 // FileListMessage contains a list of files
 type FileListMessage struct {
-	FolderPath string     `json:"folder_path"`
-	FolderName string     `json:"folder_name"` // Base folder name (e.g., "Desktop", "Documents")
-	Files      []FileInfo `json:"files"`
+	FolderPath    string            `json:"folder_path"`
+	FolderName    string            `json:"folder_name"` // Base folder name (e.g., "Desktop", "Documents")
+	Files         []FileInfo        `json:"files"`
+	Sequence      uint64            `json:"sequence,omitempty"`       // Sender's sync sequence for this folder
+	PeerSequences map[string]uint64 `json:"peer_sequences,omitempty"` // Last sequence the sender saw from each device
+	Authoritative bool              `json:"authoritative,omitempty"`  // Receiver should mirror this list exactly
+	Restore       bool              `json:"restore,omitempty"`        // Sender refused the receiver's deletes; it fetches what it deleted
+	Journal       bool              `json:"journal,omitempty"`        // Only files changed while the receiver was away
+
+	Generation      uint64            `json:"generation,omitempty"`       // Sender's state generation for this folder
+	PeerGenerations map[string]uint64 `json:"peer_generations,omitempty"` // Last generation the sender saw from each device
 }
 
 // FileRequestMessage requests a specific file
@@ -90,6 +145,8 @@ type FileRequestMessage struct {
 	FolderPath string `json:"folder_path"`
 	FolderName string `json:"folder_name"`
 	RelPath    string `json:"rel_path"`
+	Offset     int64  `json:"offset,omitempty"` // Bytes of Hash the requester already has
+	Hash       string `json:"hash,omitempty"`   // Content of the requester's partial copy
 }
 
 // FileDataMessage contains file content
@@ -99,12 +156,52 @@ type FileDataMessage struct {
 	RelPath    string    `json:"rel_path"`
 	Size       int64     `json:"size"`
 	ModTime    time.Time `json:"mod_time"`
+	Birthtime  time.Time `json:"birthtime"` // Creation date; zero if the sender doesn't know it
 	Permission uint32    `json:"permission"`
 	Hash       string    `json:"hash"`
+	HashAlgo   string    `json:"hash_algo,omitempty"`
+	ContentHash string   `json:"content_hash,omitempty"` // HashAlgorithm hash of the contents, when Hash is only of size and mod time
 	Data       []byte    `json:"data"`
 	IsChunked  bool      `json:"is_chunked"`
 	ChunkIndex int       `json:"chunk_index"`
 	TotalChunks int      `json:"total_chunks"`
+	Xattrs     map[string][]byte `json:"xattrs,omitempty"` // Extended attributes to restore on the written file
+}
+
+// FileMoveMessage reports a file or folder renamed or moved within a synced
+// folder, so peers can rename their copy instead of downloading it again
+type FileMoveMessage struct {
+	FolderPath string     `json:"folder_path"`
+	FolderName string     `json:"folder_name"`
+	OldRelPath string     `json:"old_rel_path"`
+	NewRelPath string     `json:"new_rel_path"`
+	IsDir      bool       `json:"is_dir"`
+	Files      []FileInfo `json:"files"` // Moved files, at their new paths
+}
+
+// DirCreateMessage carries a directory and its metadata, so empty
+// directories exist on peers too
+type DirCreateMessage struct {
+	FolderPath string            `json:"folder_path"`
+	FolderName string            `json:"folder_name"`
+	RelPath    string            `json:"rel_path"`
+	Permission uint32            `json:"permission"`
+	Xattrs     map[string][]byte `json:"xattrs,omitempty"` // e.g. Finder tags and folder colours
+}
+
+// FileMetaMessage carries a file's attributes or mod time after they changed
+// without its content, so peers update their copy instead of downloading it
+// again
+type FileMetaMessage struct {
+	FolderPath string            `json:"folder_path"`
+	FolderName string            `json:"folder_name"`
+	RelPath    string            `json:"rel_path"`
+	Hash       string            `json:"hash"` // Content the attributes belong to
+	HashAlgo   string            `json:"hash_algo,omitempty"`
+	Permission uint32            `json:"permission"`
+	Flags      uint32            `json:"flags,omitempty"` // chflags, e.g. hidden or locked
+	Xattrs     map[string][]byte `json:"xattrs,omitempty"`
+	ModTime    time.Time         `json:"mod_time"` // Set when the mod time changed too; zero leaves it
 }
 
 // FileDeleteMessage notifies about a deleted file
@@ -112,6 +209,78 @@ type FileDeleteMessage struct {
 	FolderPath string `json:"folder_path"`
 	FolderName string `json:"folder_name"`
 	RelPath    string `json:"rel_path"`
+	Ignored    bool   `json:"ignored,omitempty"` // Cleanup of a file ignore rules now exclude; deleted even if ignored
+}
+
+// FileAckMessage reports whether received file data was written. A nack
+// carries the receiver's error so the sender can retry or give up.
+type FileAckMessage struct {
+	FolderName  string `json:"folder_name"`
+	RelPath     string `json:"rel_path"`
+	Hash        string `json:"hash"`
+	OK          bool   `json:"ok"`
+	Error       string `json:"error,omitempty"`
+	Code        string `json:"code,omitempty"`        // Kind of error, from ErrorCode; the receiver refused the file and resending won't help
+	Rerequested bool   `json:"rerequested,omitempty"` // Receiver discarded the data and requested the file again
+}
+
+// Err returns the error a nack reports, of its kind if it has a code, or nil
+// for an ack
+func (a FileAckMessage) Err() error {
+	if a.OK {
+		return nil
+	}
+	return CodeError(a.Code, a.Error)
+}
+
+// WindowMessage advertises how much file data a receiver accepts before it
+// has acknowledged what it already got. Senders pause pushing changes while
+// a window is full.
+type WindowMessage struct {
+	Bytes int64 `json:"bytes"`
+	Files int   `json:"files"`
+}
+
+// AddressUpdateMessage lists the addresses a peer can be reached at after
+// its network changed, most preferred first, as ip:port
+type AddressUpdateMessage struct {
+	Addresses []string `json:"addresses"`
+
+	// Sent for an introducer to pass on; the connection stays as it is
+	Introduce bool `json:"introduce,omitempty"`
+}
+
+// PeerTableMessage is sent by an introducer to tell a peer about the others
+// connected to it, so they can find each other without mDNS
+type PeerTableMessage struct {
+	Peers []PeerTableEntry `json:"peers"`
+}
+
+// PeerTableEntry is a peer in an introducer's table
+type PeerTableEntry struct {
+	Name      string   `json:"name"`
+	Addresses []string `json:"addresses"` // ip:port, most preferred first
+}
+
+// RelayHelloMessage registers with a relay. A "listen" registration waits for
+// a peer to reach this device; a "connect" registration asks for Peer; a
+// "punch" registration only trades public addresses with Peer.
+type RelayHelloMessage struct {
+	Role      string `json:"role"` // listen | connect | punch
+	Device    string `json:"device"`
+	Peer      string `json:"peer,omitempty"`
+	Candidate string `json:"candidate,omitempty"` // Public ip:port for hole punching
+	Token     string `json:"token,omitempty"`     // Listen only: proves the device owns its registration
+}
+
+// RelayReadyMessage tells both sides the relay has joined their streams.
+// Everything after it is forwarded unchanged. For hole punching, Candidate
+// carries the peer's public address instead and the relay hangs up.
+type RelayReadyMessage struct {
+	OK        bool   `json:"ok"`
+	Peer      string `json:"peer,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Candidate string `json:"candidate,omitempty"`
 }
 
 // ErrorMessage contains an error
@@ -122,11 +291,20 @@ type ErrorMessage struct {
 
 // Protocol constants
 const (
-	ProtocolVersion = "1.0"
+	ProtocolVersion = "1.10"
 	MaxMessageSize  = 64 * 1024 * 1024 // 64MB max message size
 	ChunkSize       = 1 * 1024 * 1024  // 1MB chunks for large files
+
+	// MaxFileSize is the largest file that fits in a file data message,
+	// whose data is base64 encoded, with room for the rest of the message
+	MaxFileSize = (MaxMessageSize - ChunkSize) / 4 * 3
 )
 
+// ChunkCount returns how many ChunkSize parts a file of size bytes is sent in
+func ChunkCount(size int64) int {
+	return int((size + ChunkSize - 1) / ChunkSize)
+}
+
 // WriteMessage writes a message to a writer
 func WriteMessage(w io.Writer, msg *Message) error {
 	// Serialize the message
@@ -138,7 +316,7 @@ func WriteMessage(w io.Writer, msg *Message) error {
 	// Write length prefix (4 bytes, big endian)
 	length := uint32(len(data))
 	if length > MaxMessageSize {
-		return fmt.Errorf("message too large: %d bytes", length)
+		return fmt.Errorf("message %w: %d bytes", ErrTooLarge, length)
 	}
 
 	lenBuf := make([]byte, 4)
@@ -165,7 +343,7 @@ func ReadMessage(r io.Reader) (*Message, error) {
 
 	length := binary.BigEndian.Uint32(lenBuf)
 	if length > MaxMessageSize {
-		return nil, fmt.Errorf("message too large: %d bytes", length)
+		return nil, fmt.Errorf("message %w: %d bytes", ErrTooLarge, length)
 	}
 
 	// Read message data
@@ -229,6 +407,26 @@ func (t MessageType) String() string {
 		return "Pong"
 	case MsgError:
 		return "Error"
+	case MsgFileAck:
+		return "FileAck"
+	case MsgRelayHello:
+		return "RelayHello"
+	case MsgRelayReady:
+		return "RelayReady"
+	case MsgFileChunk:
+		return "FileChunk"
+	case MsgFileMove:
+		return "FileMove"
+	case MsgDirCreate:
+		return "DirCreate"
+	case MsgFileMeta:
+		return "FileMeta"
+	case MsgWindow:
+		return "Window"
+	case MsgAddressUpdate:
+		return "AddressUpdate"
+	case MsgPeerTable:
+		return "PeerTable"
 	default:
 		return fmt.Sprintf("Unknown(%d)", t)
 	}
@@ -0,0 +1,263 @@
+package network
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+// punchTimeout bounds how long both sides keep dialing each other
+const punchTimeout = 10 * time.Second
+
+const (
+	stunMagicCookie      = 0x2112A442
+	stunBindingRequest   = 0x0001
+	stunBindingSuccess   = 0x0101
+	stunAttrMapped       = 0x0001
+	stunAttrXorMapped    = 0x0020
+	stunHeaderSize       = 20
+	stunTransactionIDLen = 12
+)
+
+// stunMappedAddress asks a STUN server which public address a local UDP port
+// maps to
+func stunMappedAddress(server string, conn *net.UDPConn) (*net.UDPAddr, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve STUN server: %w", err)
+	}
+
+	req := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(req[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:8], stunMagicCookie)
+	txID := req[8 : 8+stunTransactionIDLen]
+	if _, err := rand.Read(txID); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1024)
+	for attempt := 0; attempt < 3; attempt++ {
+		if _, err := conn.WriteToUDP(req, serverAddr); err != nil {
+			return nil, fmt.Errorf("failed to send STUN request: %w", err)
+		}
+
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			continue
+		}
+		if addr := parseSTUNResponse(buf[:n], txID); addr != nil {
+			return addr, nil
+		}
+	}
+	return nil, errors.New("no STUN response")
+}
+
+// parseSTUNResponse extracts the mapped address from a binding response
+func parseSTUNResponse(msg, txID []byte) *net.UDPAddr {
+	if len(msg) < stunHeaderSize ||
+		binary.BigEndian.Uint16(msg[0:2]) != stunBindingSuccess ||
+		binary.BigEndian.Uint32(msg[4:8]) != stunMagicCookie ||
+		string(msg[8:8+stunTransactionIDLen]) != string(txID) {
+		return nil
+	}
+
+	attrs := msg[stunHeaderSize:]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if len(attrs) < 4+attrLen {
+			return nil
+		}
+		value := attrs[4 : 4+attrLen]
+
+		// IPv4 only: family byte 0x01, port, 4-byte address
+		if (attrType == stunAttrXorMapped || attrType == stunAttrMapped) && attrLen >= 8 && value[1] == 0x01 {
+			port := binary.BigEndian.Uint16(value[2:4])
+			ip := make(net.IP, 4)
+			copy(ip, value[4:8])
+			if attrType == stunAttrXorMapped {
+				port ^= stunMagicCookie >> 16
+				binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(ip)^stunMagicCookie)
+			}
+			return &net.UDPAddr{IP: ip, Port: int(port)}
+		}
+
+		// Attributes are padded to 4 bytes
+		attrs = attrs[4+(attrLen+3)&^3:]
+	}
+	return nil
+}
+
+// punchCandidate picks a local port and learns its public address. Punching
+// only works when the NAT keeps the local port, so other NATs are rejected.
+func punchCandidate(stunServer string) (int, string, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to open UDP socket: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	localPort := conn.LocalAddr().(*net.UDPAddr).Port
+	mapped, err := stunMappedAddress(stunServer, conn)
+	if err != nil {
+		return 0, "", err
+	}
+	if mapped.Port != localPort {
+		return 0, "", fmt.Errorf("NAT does not preserve ports (%d mapped to %d)", localPort, mapped.Port)
+	}
+
+	return localPort, mapped.String(), nil
+}
+
+// dialPunch repeatedly dials remote from localPort until the peer, doing the
+// same, completes a simultaneous TCP open through both NATs. The answering
+// side also listens on localPort, in case the peer's SYN gets through first;
+// only one side listens so both always end up with the same connection.
+func dialPunch(ctx context.Context, localPort int, remote string, listen bool) (net.Conn, error) {
+	control := func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); sockErr != nil {
+				return
+			}
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, punchTimeout)
+	defer cancel()
+
+	accepted := make(chan net.Conn, 1)
+	if listen {
+		lc := net.ListenConfig{Control: control}
+		listener, err := lc.Listen(ctx, "tcp4", fmt.Sprintf(":%d", localPort))
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for hole punching: %w", err)
+		}
+		defer func() { _ = listener.Close() }()
+
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				accepted <- conn
+			}
+		}()
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   time.Second,
+		LocalAddr: &net.TCPAddr{Port: localPort},
+		Control:   control,
+	}
+
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp4", remote)
+		if err == nil {
+			return conn, nil
+		}
+
+		select {
+		case conn := <-accepted:
+			return conn, nil
+		case <-ctx.Done():
+			return nil, fmt.Errorf("hole punching to %s failed: %w", remote, err)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// PunchAddress is the connection address used for a peer reached by hole punching
+func PunchAddress(device string) string {
+	return "punch://" + device
+}
+
+// SetSTUNServer sets the STUN server used for hole punching (empty = disabled)
+func (c *Client) SetSTUNServer(addr string) {
+	c.stunServer = addr
+}
+
+// ConnectPunched reaches a peer on another network directly, using the relay
+// only to exchange public addresses
+func (c *Client) ConnectPunched(relayAddr, localDevice, peerDevice string) (*ClientConnection, error) {
+	if c.stunServer == "" {
+		return nil, errors.New("hole punching disabled")
+	}
+
+	localPort, candidate, err := punchCandidate(c.stunServer)
+	if err != nil {
+		return nil, err
+	}
+
+	relayConn, ready, err := dialRelay(c.ctx, relayAddr, RelayHelloMessage{
+		Role:      RelayPunch,
+		Device:    localDevice,
+		Peer:      peerDevice,
+		Candidate: candidate,
+	})
+	if err != nil {
+		return nil, err
+	}
+	_ = relayConn.Close()
+
+	conn, err := dialPunch(c.ctx, localPort, ready.Candidate, false)
+	if err != nil {
+		return nil, err
+	}
+	if c.tlsConfig != nil {
+		conn = tls.Client(conn, c.tlsConfig)
+	}
+
+	log.Info().Str("peer_id", peerDevice).Str("remote", ready.Candidate).Msg("Hole punching succeeded")
+	return c.attach(PunchAddress(peerDevice), conn), nil
+}
+
+// SetSTUNServer sets the STUN server used for hole punching (empty = disabled)
+func (s *Server) SetSTUNServer(addr string) {
+	s.stunServer = addr
+}
+
+// answerPunch handles a peer's hole punching request delivered through the
+// relay: reply with this device's public address, then dial the peer
+func (s *Server) answerPunch(relayConn net.Conn, ready RelayReadyMessage) {
+	defer func() { _ = relayConn.Close() }()
+
+	var localPort int
+	var candidate string
+	if s.stunServer != "" {
+		var err error
+		if localPort, candidate, err = punchCandidate(s.stunServer); err != nil {
+			log.Debug().Err(err).Str("peer_id", ready.Peer).Msg("Can't take part in hole punching")
+		}
+	}
+
+	reply, err := NewMessage(MsgRelayHello, RelayHelloMessage{Role: RelayPunch, Candidate: candidate})
+	if err != nil || WriteMessage(relayConn, reply) != nil || candidate == "" {
+		return
+	}
+
+	conn, err := dialPunch(s.ctx, localPort, ready.Candidate, true)
+	if err != nil {
+		log.Debug().Err(err).Str("peer_id", ready.Peer).Msg("Hole punching failed")
+		return
+	}
+	if s.tlsConfig != nil {
+		conn = tls.Server(conn, s.tlsConfig)
+	}
+
+	s.wg.Add(1)
+	go s.handleConnection(conn, PunchAddress(ready.Peer))
+}
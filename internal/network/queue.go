@@ -0,0 +1,182 @@
+package network
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// QueuePolicy determines what happens when a connection's send queue is full
+type QueuePolicy string
+
+const (
+	QueueBlock QueuePolicy = "block" // Wait for room in the queue (default)
+	QueueDrop  QueuePolicy = "drop"  // Drop file data immediately; control messages still wait
+)
+
+const (
+	DefaultQueueSize  = 64
+	queueBlockTimeout = 30 * time.Second
+)
+
+var (
+	// ErrQueueFull is returned when a message could not be queued in time
+	ErrQueueFull = errors.New("send queue full")
+	// ErrConnectionClosed is returned when sending on a closed connection
+	ErrConnectionClosed = errors.New("connection closed")
+)
+
+// ParseQueuePolicy converts a config string to a QueuePolicy
+func ParseQueuePolicy(s string) QueuePolicy {
+	if QueuePolicy(s) == QueueDrop {
+		return QueueDrop
+	}
+	return QueueBlock
+}
+
+// QueueStats reports the state of a connection's send queue
+type QueueStats struct {
+	Depth    int    `json:"depth"`
+	Capacity int    `json:"capacity"`
+	MaxDepth int    `json:"max_depth"`
+	Sent     uint64 `json:"sent"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+// sendQueue is a bounded outgoing message queue drained by a single writer
+// goroutine, so slow peers don't block callers holding connection locks.
+// The writer interleaves folders' file data so they share the connection.
+type sendQueue struct {
+	ch     chan *Message
+	policy QueuePolicy
+	done   <-chan struct{}
+	write  func(*Message) error
+
+	// Large file data is sent in chunks once the peer supports them
+	chunking atomic.Bool
+
+	pending  atomic.Int64 // Messages taken off ch but not yet fully written
+	sent     atomic.Uint64
+	dropped  atomic.Uint64
+	maxDepth atomic.Int64
+}
+
+func newSendQueue(size int, policy QueuePolicy, done <-chan struct{}, write func(*Message) error) *sendQueue {
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	return &sendQueue{
+		ch:     make(chan *Message, size),
+		policy: policy,
+		done:   done,
+		write:  write,
+	}
+}
+
+// enqueue adds a message to the queue according to the queue policy
+func (q *sendQueue) enqueue(msg *Message) error {
+	select {
+	case <-q.done:
+		return ErrConnectionClosed
+	default:
+	}
+	msg.queued = time.Now()
+
+	// Bulk data may be dropped; handshake and control messages must get through
+	if q.policy == QueueDrop && msg.Type == MsgFileData {
+		select {
+		case q.ch <- msg:
+			q.recordDepth()
+			return nil
+		default:
+			q.dropped.Add(1)
+			return ErrQueueFull
+		}
+	}
+
+	timer := time.NewTimer(queueBlockTimeout)
+	defer timer.Stop()
+
+	select {
+	case q.ch <- msg:
+		q.recordDepth()
+		return nil
+	case <-q.done:
+		return ErrConnectionClosed
+	case <-timer.C:
+		q.dropped.Add(1)
+		return ErrQueueFull
+	}
+}
+
+// run writes queued messages until the connection is done or a write fails.
+// Control messages go first; folders then take turns one chunk at a time.
+func (q *sendQueue) run() error {
+	sched := newLaneScheduler()
+	for {
+		// Pull in what's queued, up to the queue size, so folders can interleave
+		q.fill(sched)
+
+		if sched.empty() {
+			select {
+			case <-q.done:
+				return nil
+			case msg := <-q.ch:
+				sched.add(msg)
+				q.pending.Add(1)
+			}
+			continue
+		}
+
+		select {
+		case <-q.done:
+			return nil
+		default:
+		}
+
+		frame, complete := sched.next(q.chunking.Load())
+		if err := q.write(frame); err != nil {
+			return err
+		}
+		if complete {
+			q.pending.Add(-1)
+			q.sent.Add(1)
+		}
+	}
+}
+
+func (q *sendQueue) fill(sched *laneScheduler) {
+	for q.pending.Load() < int64(cap(q.ch)) {
+		select {
+		case msg := <-q.ch:
+			sched.add(msg)
+			q.pending.Add(1)
+		default:
+			return
+		}
+	}
+}
+
+func (q *sendQueue) depth() int {
+	return len(q.ch) + int(q.pending.Load())
+}
+
+func (q *sendQueue) recordDepth() {
+	depth := int64(q.depth())
+	for {
+		max := q.maxDepth.Load()
+		if depth <= max || q.maxDepth.CompareAndSwap(max, depth) {
+			return
+		}
+	}
+}
+
+func (q *sendQueue) stats() QueueStats {
+	return QueueStats{
+		Depth:    q.depth(),
+		Capacity: cap(q.ch),
+		MaxDepth: int(q.maxDepth.Load()),
+		Sent:     q.sent.Load(),
+		Dropped:  q.dropped.Load(),
+	}
+}
@@ -0,0 +1,189 @@
+package network
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxThrottleChunk caps how many bytes are read or written per limiter wait
+const maxThrottleChunk = 32 * 1024
+
+// RateLimiter is a token bucket shared by every connection in one direction
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter for the given rate in kilobits per second.
+// Returns nil (unlimited) when kbps is zero or negative.
+func NewRateLimiter(kbps int) *RateLimiter {
+	if kbps <= 0 {
+		return nil
+	}
+
+	rate := float64(kbps) * 1000 / 8
+	burst := rate
+	if burst < maxThrottleChunk {
+		burst = maxThrottleChunk
+	}
+
+	return &RateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n bytes may pass through the limiter (a nil limiter never blocks)
+func (l *RateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	// Reserve the bytes up front; a deficit means we sleep it off
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// throttledConn wraps a net.Conn with upload and download limiters shared by
+// all connections, plus this peer's own limiters once it is known.
+// Deadlines are treated as idle timeouts and pushed forward after each
+// throttled chunk, so time spent waiting on the limiter doesn't count.
+type throttledConn struct {
+	net.Conn
+	up   *RateLimiter
+	down *RateLimiter
+
+	peerUp   atomic.Pointer[RateLimiter]
+	peerDown atomic.Pointer[RateLimiter]
+
+	mu           sync.Mutex
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+// throttleConn wraps conn with the shared limiters; per-peer limiters can be
+// added later with setPeerLimits
+func throttleConn(conn net.Conn, up, down *RateLimiter) net.Conn {
+	return &throttledConn{Conn: conn, up: up, down: down}
+}
+
+// setPeerLimits sets a connection's own limiters (nil = no per-peer cap)
+func setPeerLimits(conn net.Conn, up, down *RateLimiter) {
+	if c, ok := conn.(*throttledConn); ok {
+		c.peerUp.Store(up)
+		c.peerDown.Store(down)
+	}
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	peerDown := c.peerDown.Load()
+	if c.down == nil && peerDown == nil {
+		return c.Conn.Read(p)
+	}
+
+	if len(p) > maxThrottleChunk {
+		p = p[:maxThrottleChunk]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.down.wait(n)
+		peerDown.wait(n)
+		c.extendDeadline(true)
+	}
+	return n, err
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	peerUp := c.peerUp.Load()
+	if c.up == nil && peerUp == nil {
+		return c.Conn.Write(p)
+	}
+
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > maxThrottleChunk {
+			chunk = chunk[:maxThrottleChunk]
+		}
+		c.up.wait(len(chunk))
+		peerUp.wait(len(chunk))
+		c.extendDeadline(false)
+
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (c *throttledConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readTimeout = timeoutFromDeadline(t)
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *throttledConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeTimeout = timeoutFromDeadline(t)
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *throttledConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readTimeout = timeoutFromDeadline(t)
+	c.writeTimeout = c.readTimeout
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *throttledConn) extendDeadline(read bool) {
+	c.mu.Lock()
+	timeout := c.writeTimeout
+	if read {
+		timeout = c.readTimeout
+	}
+	c.mu.Unlock()
+
+	if timeout <= 0 {
+		return
+	}
+	if read {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+}
+
+func timeoutFromDeadline(t time.Time) time.Duration {
+	if t.IsZero() {
+		return 0
+	}
+	return time.Until(t)
+}
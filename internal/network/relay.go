@@ -0,0 +1,425 @@
+package network
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Relay roles
+const (
+	RelayListen  = "listen"
+	RelayConnect = "connect"
+	RelayPunch   = "punch"
+)
+
+// relayRetryDelay is how long a device waits before re-registering with a
+// relay after the connection fails
+const relayRetryDelay = 10 * time.Second
+
+// relayNotRegistered is the reason a relay gives for a peer it isn't holding
+// a connection from
+const relayNotRegistered = "peer not registered"
+
+// relayTaken is the reason a relay gives for refusing a registration under
+// the name of a device that is registered with another token
+const relayTaken = "device name registered by another device"
+
+// Relay joins two peers that cannot reach each other directly. Each side
+// registers by device name; once matched, bytes are forwarded unchanged, so
+// TLS between the peers is never terminated at the relay.
+type Relay struct {
+	addr     string
+	listener net.Listener
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	waiting map[string]relayRegistration // Device name -> listen registration
+}
+
+// relayRegistration is a device waiting at the relay for peers
+type relayRegistration struct {
+	conn  net.Conn
+	token string
+}
+
+// NewRelay creates a relay that will listen on addr
+func NewRelay(addr string) *Relay {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Relay{
+		addr:    addr,
+		ctx:     ctx,
+		cancel:  cancel,
+		waiting: make(map[string]relayRegistration),
+	}
+}
+
+// Start starts accepting registrations
+func (r *Relay) Start() error {
+	listener, err := net.Listen("tcp", r.addr)
+	if err != nil {
+		return fmt.Errorf("failed to start relay listener: %w", err)
+	}
+	r.listener = listener
+
+	log.Info().Str("addr", listener.Addr().String()).Msg("Relay started")
+
+	r.wg.Add(1)
+	go r.acceptLoop()
+	return nil
+}
+
+// Stop closes the listener and every relayed connection
+func (r *Relay) Stop() {
+	r.cancel()
+	if r.listener != nil {
+		_ = r.listener.Close()
+	}
+
+	r.mu.Lock()
+	for device, reg := range r.waiting {
+		_ = reg.conn.Close()
+		delete(r.waiting, device)
+	}
+	r.mu.Unlock()
+
+	r.wg.Wait()
+	log.Info().Msg("Relay stopped")
+}
+
+func (r *Relay) acceptLoop() {
+	defer r.wg.Done()
+
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			select {
+			case <-r.ctx.Done():
+				return
+			default:
+				log.Error().Err(err).Msg("Failed to accept relay connection")
+				continue
+			}
+		}
+
+		r.wg.Add(1)
+		go r.handle(conn)
+	}
+}
+
+func (r *Relay) handle(conn net.Conn) {
+	defer r.wg.Done()
+
+	_ = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	msg, err := ReadMessage(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil || msg.Type != MsgRelayHello {
+		_ = conn.Close()
+		return
+	}
+
+	var hello RelayHelloMessage
+	if err := msg.DecodePayload(&hello); err != nil || hello.Device == "" {
+		_ = conn.Close()
+		return
+	}
+
+	switch hello.Role {
+	case RelayListen:
+		// A device re-registers after a restart or a dropped connection, but
+		// only it can take over its name from a live registration
+		r.mu.Lock()
+		old, ok := r.waiting[hello.Device]
+		if ok && subtle.ConstantTimeCompare([]byte(old.token), []byte(hello.Token)) != 1 {
+			r.mu.Unlock()
+			log.Warn().Str("device", hello.Device).Str("remote", conn.RemoteAddr().String()).Msg("Refusing relay registration for a device already registered")
+			writeRelayReady(conn, RelayReadyMessage{Reason: relayTaken})
+			_ = conn.Close()
+			return
+		}
+		if ok {
+			_ = old.conn.Close()
+		}
+		r.waiting[hello.Device] = relayRegistration{conn: conn, token: hello.Token}
+		r.mu.Unlock()
+		log.Info().Str("device", hello.Device).Str("remote", conn.RemoteAddr().String()).Msg("Device registered with relay")
+
+	case RelayConnect:
+		r.mu.Lock()
+		reg, ok := r.waiting[hello.Peer]
+		if ok {
+			delete(r.waiting, hello.Peer)
+		}
+		r.mu.Unlock()
+		target := reg.conn
+
+		if !ok {
+			writeRelayReady(conn, RelayReadyMessage{Reason: relayNotRegistered})
+			_ = conn.Close()
+			return
+		}
+
+		writeRelayReady(target, RelayReadyMessage{OK: true, Peer: hello.Device})
+		writeRelayReady(conn, RelayReadyMessage{OK: true, Peer: hello.Peer})
+		r.splice(hello.Device, hello.Peer, conn, target)
+
+	case RelayPunch:
+		r.mu.Lock()
+		reg, ok := r.waiting[hello.Peer]
+		if ok {
+			delete(r.waiting, hello.Peer)
+		}
+		r.mu.Unlock()
+		target := reg.conn
+
+		if !ok {
+			writeRelayReady(conn, RelayReadyMessage{Reason: relayNotRegistered})
+			_ = conn.Close()
+			return
+		}
+
+		r.exchangeCandidates(hello, conn, target)
+
+	default:
+		_ = conn.Close()
+	}
+}
+
+// exchangeCandidates trades public addresses between a punching device and a
+// registered peer. Both connections are closed afterwards; the peer
+// re-registers on its own.
+func (r *Relay) exchangeCandidates(hello RelayHelloMessage, conn, target net.Conn) {
+	defer func() {
+		_ = conn.Close()
+		_ = target.Close()
+	}()
+
+	writeRelayReady(target, RelayReadyMessage{OK: true, Peer: hello.Device, Candidate: hello.Candidate})
+
+	var reply RelayHelloMessage
+	_ = target.SetReadDeadline(time.Now().Add(10 * time.Second))
+	msg, err := ReadMessage(target)
+	if err != nil || msg.Type != MsgRelayHello || msg.DecodePayload(&reply) != nil || reply.Candidate == "" {
+		writeRelayReady(conn, RelayReadyMessage{Reason: "peer can't punch"})
+		return
+	}
+
+	writeRelayReady(conn, RelayReadyMessage{OK: true, Peer: hello.Peer, Candidate: reply.Candidate})
+	log.Info().Str("from", hello.Device).Str("to", hello.Peer).Msg("Exchanged hole punching candidates")
+}
+
+// splice forwards bytes both ways until either side closes
+func (r *Relay) splice(from, to string, a, b net.Conn) {
+	log.Info().Str("from", from).Str("to", to).Msg("Relaying peers")
+
+	var wg sync.WaitGroup
+	var sent, received int64
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sent, _ = io.Copy(b, a)
+		_ = b.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		received, _ = io.Copy(a, b)
+		_ = a.Close()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-r.ctx.Done():
+		_ = a.Close()
+		_ = b.Close()
+		<-done
+	}
+
+	log.Info().Str("from", from).Str("to", to).Int64("sent", sent).Int64("received", received).Msg("Relay session ended")
+}
+
+func writeRelayReady(conn net.Conn, ready RelayReadyMessage) {
+	msg, err := NewMessage(MsgRelayReady, ready)
+	if err != nil {
+		return
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_ = WriteMessage(conn, msg)
+	_ = conn.SetWriteDeadline(time.Time{})
+}
+
+// dialRelay registers with a relay and waits until it joins this connection
+// to a peer. A listen registration may wait indefinitely.
+func dialRelay(ctx context.Context, relayAddr string, hello RelayHelloMessage) (net.Conn, RelayReadyMessage, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", relayAddr)
+	if err != nil {
+		return nil, RelayReadyMessage{}, fmt.Errorf("failed to connect to relay: %w", err)
+	}
+
+	// Unblock the wait below on shutdown
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	msg, err := NewMessage(MsgRelayHello, hello)
+	if err != nil {
+		_ = conn.Close()
+		return nil, RelayReadyMessage{}, err
+	}
+	if err := WriteMessage(conn, msg); err != nil {
+		_ = conn.Close()
+		return nil, RelayReadyMessage{}, fmt.Errorf("failed to register with relay: %w", err)
+	}
+
+	if hello.Role != RelayListen {
+		_ = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	}
+	reply, err := ReadMessage(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		_ = conn.Close()
+		return nil, RelayReadyMessage{}, fmt.Errorf("failed to read relay reply: %w", err)
+	}
+
+	var ready RelayReadyMessage
+	if reply.Type != MsgRelayReady || reply.DecodePayload(&ready) != nil {
+		_ = conn.Close()
+		return nil, ready, fmt.Errorf("unexpected relay reply: %s", reply.Type)
+	}
+	if !ready.OK {
+		_ = conn.Close()
+		if ready.Reason == relayNotRegistered {
+			return nil, ready, fmt.Errorf("relay refused connection: %w", ErrPeerOffline)
+		}
+		return nil, ready, fmt.Errorf("relay refused connection: %s", ready.Reason)
+	}
+
+	return conn, ready, nil
+}
+
+// RelayAddress is the connection address used for a peer reached via a relay
+func RelayAddress(relayAddr, device string) string {
+	return "relay://" + relayAddr + "/" + device
+}
+
+// ConnectViaRelay connects to a peer by device name through a relay
+func (c *Client) ConnectViaRelay(relayAddr, localDevice, peerDevice string) (*ClientConnection, error) {
+	address := RelayAddress(relayAddr, peerDevice)
+	if existing := c.GetConnection(address); existing != nil {
+		return existing, nil
+	}
+
+	conn, _, err := dialRelay(c.ctx, relayAddr, RelayHelloMessage{
+		Role:   RelayConnect,
+		Device: localDevice,
+		Peer:   peerDevice,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if c.tlsConfig != nil {
+		conn = tls.Client(conn, c.tlsConfig)
+	}
+
+	return c.attach(address, conn), nil
+}
+
+// KeepRelayPeers connects to the given devices, first directly by hole
+// punching and otherwise through the relay, and reconnects whenever a
+// connection drops, until the client stops
+func (c *Client) KeepRelayPeers(relayAddr, localDevice string, peers []string) {
+	if relayAddr == "" || len(peers) == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(relayRetryDelay)
+		defer ticker.Stop()
+
+		for {
+			for _, peer := range peers {
+				if c.GetConnection(RelayAddress(relayAddr, peer)) != nil || c.GetConnection(PunchAddress(peer)) != nil {
+					continue
+				}
+				_, err := c.ConnectPunched(relayAddr, localDevice, peer)
+				if err == nil {
+					continue
+				}
+				log.Debug().Err(err).Str("peer_id", peer).Msg("Hole punching unavailable, using relay")
+				if _, err := c.ConnectViaRelay(relayAddr, localDevice, peer); err != nil {
+					log.Debug().Err(err).Str("peer_id", peer).Msg("Failed to reach peer through relay")
+				}
+			}
+
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// ListenViaRelay keeps this device registered with a relay so peers that
+// cannot reach it directly can connect through the relay. The token proves
+// the registration is this device's; see config.RelayToken.
+func (s *Server) ListenViaRelay(relayAddr, device, token string) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		for {
+			conn, ready, err := dialRelay(s.ctx, relayAddr, RelayHelloMessage{
+				Role:   RelayListen,
+				Device: device,
+				Token:  token,
+			})
+			if err != nil {
+				select {
+				case <-s.ctx.Done():
+					return
+				default:
+				}
+				log.Debug().Err(err).Str("relay", relayAddr).Msg("Relay registration failed, retrying")
+				select {
+				case <-s.ctx.Done():
+					return
+				case <-time.After(relayRetryDelay):
+				}
+				continue
+			}
+
+			// A punch request asks for our public address, not a relayed stream
+			if ready.Candidate != "" {
+				s.wg.Add(1)
+				go func() {
+					defer s.wg.Done()
+					s.answerPunch(conn, ready)
+				}()
+				continue
+			}
+
+			if s.tlsConfig != nil {
+				conn = tls.Server(conn, s.tlsConfig)
+			}
+
+			s.wg.Add(1)
+			go s.handleConnection(conn, RelayAddress(relayAddr, ready.Peer))
+		}
+	}()
+}
@@ -24,6 +24,24 @@ type Server struct {
 	connections map[string]*Connection
 	connMu      sync.RWMutex
 
+	// Send queue settings
+	queueSize   int
+	queuePolicy QueuePolicy
+
+	// Bandwidth limits shared by all connections (nil = unlimited)
+	upLimit   *RateLimiter
+	downLimit *RateLimiter
+
+	// STUN server for hole punching (empty = disabled)
+	stunServer string
+
+	// Keepalive settings
+	keepaliveInterval time.Duration
+	keepaliveTimeout  time.Duration
+
+	// Recent messages kept per connection (0 = counts only)
+	traceSize int
+
 	// Handlers
 	onConnect    func(*Connection)
 	onDisconnect func(*Connection)
@@ -35,14 +53,18 @@ type Connection struct {
 	ID         string
 	DeviceName string
 	DeviceID   string
+	Version    string // Peer's protocol version, from its hello
 	Conn       net.Conn
 	Server     *Server
 	Paired     bool
 	LastSeen   time.Time
 
-	ctx    context.Context
-	cancel context.CancelFunc
-	mu     sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	queue     *sendQueue
+	inbound   *reassembler
+	keepalive *keepalive
+	trace     *tracer
 }
 
 // NewServer creates a new network server
@@ -54,9 +76,39 @@ func NewServer(port int, tlsConfig *tls.Config) *Server {
 		ctx:         ctx,
 		cancel:      cancel,
 		connections: make(map[string]*Connection),
+		queueSize:   DefaultQueueSize,
+		queuePolicy: QueueBlock,
+
+		keepaliveInterval: DefaultKeepaliveInterval,
+		keepaliveTimeout:  DefaultKeepaliveTimeout,
 	}
 }
 
+// SetQueueOptions configures the per-connection send queue for new connections
+func (s *Server) SetQueueOptions(size int, policy QueuePolicy) {
+	s.queueSize = size
+	s.queuePolicy = policy
+}
+
+// SetRateLimiters sets the upload and download limiters for new connections
+func (s *Server) SetRateLimiters(up, down *RateLimiter) {
+	s.upLimit = up
+	s.downLimit = down
+}
+
+// SetKeepalive sets how often connections are pinged and how long a silent
+// peer is tolerated before its connection is closed
+func (s *Server) SetKeepalive(interval, timeout time.Duration) {
+	s.keepaliveInterval = interval
+	s.keepaliveTimeout = timeout
+}
+
+// SetTraceSize sets how many recent messages new connections keep for
+// tracing (0 = only count them)
+func (s *Server) SetTraceSize(size int) {
+	s.traceSize = size
+}
+
 // SetHandlers sets the connection handlers
 func (s *Server) SetHandlers(onConnect, onDisconnect func(*Connection), onMessage func(*Connection, *Message)) {
 	s.onConnect = onConnect
@@ -150,29 +202,50 @@ func (s *Server) acceptLoop() {
 		}
 
 		s.wg.Add(1)
-		go s.handleConnection(conn)
+		go s.handleConnection(conn, conn.RemoteAddr().String())
 	}
 }
 
-func (s *Server) handleConnection(netConn net.Conn) {
+func (s *Server) handleConnection(netConn net.Conn, id string) {
 	defer s.wg.Done()
 
 	ctx, cancel := context.WithCancel(s.ctx)
 	conn := &Connection{
-		ID:       netConn.RemoteAddr().String(),
-		Conn:     netConn,
+		ID:       id,
+		Conn:     throttleConn(netConn, s.upLimit, s.downLimit),
 		Server:   s,
-		LastSeen: time.Now(),
-		ctx:      ctx,
-		cancel:   cancel,
+		LastSeen:  time.Now(),
+		ctx:       ctx,
+		cancel:    cancel,
+		keepalive: newKeepalive(),
+		trace:     newTracer(s.traceSize),
 	}
+	conn.queue = newSendQueue(s.queueSize, s.queuePolicy, ctx.Done(), conn.writeMessage)
+	conn.inbound = newReassembler(conn.queue)
+
+	// Start writer
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := conn.queue.run(); err != nil {
+			log.Debug().Err(err).Str("remote", conn.ID).Msg("Write error")
+			conn.Close()
+		}
+	}()
+
+	// Start keepalive
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		conn.keepalive.run(ctx.Done(), s.keepaliveInterval, s.keepaliveTimeout, conn.ID, conn.Send, conn.Close)
+	}()
 
 	// Register connection
 	s.connMu.Lock()
 	s.connections[conn.ID] = conn
 	s.connMu.Unlock()
 
-	log.Info().Str("remote", conn.ID).Msg("New connection")
+	log.Info().Str("remote", conn.ID).Str("peer_id", conn.peerID()).Msg("New connection")
 
 	if s.onConnect != nil {
 		s.onConnect(conn)
@@ -190,7 +263,16 @@ func (s *Server) handleConnection(netConn net.Conn) {
 		s.onDisconnect(conn)
 	}
 
-	log.Info().Str("remote", conn.ID).Msg("Connection closed")
+	log.Info().Str("remote", conn.ID).Str("peer_id", conn.peerID()).Msg("Connection closed")
+}
+
+// peerID names the peer in log lines: its device name once it has said
+// hello, its address before
+func (c *Connection) peerID() string {
+	if c.DeviceName != "" {
+		return c.DeviceName
+	}
+	return c.ID
 }
 
 // Close closes the connection
@@ -199,13 +281,41 @@ func (c *Connection) Close() {
 	_ = c.Conn.Close()
 }
 
-// Send sends a message to the peer
+// Send queues a message for delivery to the peer
 func (c *Connection) Send(msg *Message) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	return c.queue.enqueue(msg)
+}
+
+// SetPeerRateLimits caps this connection's bandwidth in kilobits per second,
+// on top of the limits shared by all connections (0 = no per-peer cap)
+func (c *Connection) SetPeerRateLimits(upKbps, downKbps int) {
+	setPeerLimits(c.Conn, NewRateLimiter(upKbps), NewRateLimiter(downKbps))
+}
+
+// QueueStats returns send queue metrics for this connection
+func (c *Connection) QueueStats() QueueStats {
+	return c.queue.stats()
+}
 
+// RTT returns the most recent keepalive round-trip time (zero if unmeasured)
+func (c *Connection) RTT() time.Duration {
+	return c.keepalive.latency()
+}
+
+// ProtocolStats returns message counts by type for this connection, and its
+// most recent messages if tracing is on
+func (c *Connection) ProtocolStats() ProtocolStats {
+	return c.trace.snapshot()
+}
+
+func (c *Connection) writeMessage(msg *Message) error {
 	_ = c.Conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
-	return WriteMessage(c.Conn, msg)
+	start := time.Now()
+	if err := WriteMessage(c.Conn, msg); err != nil {
+		return err
+	}
+	c.trace.sent(msg, time.Since(start))
+	return nil
 }
 
 // SendPayload creates and sends a message with the given payload
@@ -231,21 +341,38 @@ func (c *Connection) readLoop() {
 			select {
 			case <-c.ctx.Done():
 			default:
-				log.Debug().Err(err).Str("remote", c.ID).Msg("Read error")
+				log.Debug().Err(err).Str("remote", c.ID).Str("peer_id", c.peerID()).Msg("Read error")
 			}
 			return
 		}
 
 		c.LastSeen = time.Now()
+		c.keepalive.received(msg)
+		c.trace.received(msg)
+
+		// Rebuild chunked file data before handing it on
+		msg, err = c.inbound.receive(msg)
+		if err != nil {
+			log.Debug().Err(err).Str("remote", c.ID).Msg("Invalid file chunk")
+			return
+		}
+		if msg == nil {
+			continue
+		}
 
 		// Handle ping/pong internally
 		if msg.Type == MsgPing {
 			_ = c.SendPayload(MsgPong, nil)
 			continue
 		}
+		if msg.Type == MsgPong {
+			continue
+		}
 
 		if c.Server.onMessage != nil {
+			start := time.Now()
 			c.Server.onMessage(c, msg)
+			c.trace.handled(msg, time.Since(start))
 		}
 	}
 }
@@ -0,0 +1,148 @@
+package network
+
+import (
+	"sync"
+	"time"
+)
+
+// Directions of a traced message
+const (
+	TraceIn  = "in"
+	TraceOut = "out"
+)
+
+// TraceEntry is one message frame sent or received on a connection
+type TraceEntry struct {
+	Time   time.Time     `json:"time"`
+	Dir    string        `json:"dir"` // in | out
+	Type   string        `json:"type"`
+	Size   int           `json:"size"`             // Payload bytes
+	Queued time.Duration `json:"queued,omitempty"` // Time spent in the send queue (out)
+	Took   time.Duration `json:"took,omitempty"`   // Time to write it (out) or handle it (in)
+}
+
+// TypeStats counts the messages of one type on a connection
+type TypeStats struct {
+	Sent          uint64        `json:"sent"`
+	Received      uint64        `json:"received"`
+	BytesSent     int64         `json:"bytes_sent"`
+	BytesReceived int64         `json:"bytes_received"`
+	WriteTime     time.Duration `json:"write_time"`
+	HandleTime    time.Duration `json:"handle_time"`
+}
+
+// ProtocolStats reports the messages a connection has exchanged since it
+// opened, and its most recent frames if tracing is on
+type ProtocolStats struct {
+	Since time.Time             `json:"since"`
+	Types map[string]*TypeStats `json:"types"`
+	Trace []TraceEntry          `json:"trace,omitempty"` // Oldest first
+}
+
+// tracer counts a connection's messages by type and keeps the most recent
+// frames in a ring buffer. The writer and read loop both record into it.
+type tracer struct {
+	mu    sync.Mutex
+	since time.Time
+	types map[string]*TypeStats
+	ring  []TraceEntry // Empty if tracing is off
+	next  int
+	full  bool
+	last  int // Ring index of the last received frame (-1 = none)
+}
+
+func newTracer(size int) *tracer {
+	if size < 0 {
+		size = 0
+	}
+	return &tracer{
+		since: time.Now(),
+		types: make(map[string]*TypeStats),
+		ring:  make([]TraceEntry, size),
+		last:  -1,
+	}
+}
+
+// sent records a frame written to the peer
+func (t *tracer) sent(msg *Message, took time.Duration) {
+	var queued time.Duration
+	if !msg.queued.IsZero() {
+		queued = time.Since(msg.queued) - took
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := t.statsLocked(msg.Type)
+	stats.Sent++
+	stats.BytesSent += int64(len(msg.Payload))
+	stats.WriteTime += took
+	t.addLocked(TraceEntry{Time: time.Now(), Dir: TraceOut, Type: msg.Type.String(), Size: len(msg.Payload), Queued: queued, Took: took})
+}
+
+// received records a frame read from the peer
+func (t *tracer) received(msg *Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := t.statsLocked(msg.Type)
+	stats.Received++
+	stats.BytesReceived += int64(len(msg.Payload))
+	t.last = t.addLocked(TraceEntry{Time: time.Now(), Dir: TraceIn, Type: msg.Type.String(), Size: len(msg.Payload)})
+}
+
+// handled records how long the message completed by the last received frame
+// took to handle
+func (t *tracer) handled(msg *Message, took time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.statsLocked(msg.Type).HandleTime += took
+	if t.last >= 0 {
+		t.ring[t.last].Took = took
+	}
+}
+
+func (t *tracer) statsLocked(msgType MessageType) *TypeStats {
+	stats, ok := t.types[msgType.String()]
+	if !ok {
+		stats = &TypeStats{}
+		t.types[msgType.String()] = stats
+	}
+	return stats
+}
+
+// addLocked stores an entry in the ring and returns its index (-1 if tracing
+// is off)
+func (t *tracer) addLocked(entry TraceEntry) int {
+	if len(t.ring) == 0 {
+		return -1
+	}
+	i := t.next
+	if t.last == i {
+		t.last = -1 // Overwritten before it was handled
+	}
+	t.ring[i] = entry
+	t.next = (i + 1) % len(t.ring)
+	if t.next == 0 {
+		t.full = true
+	}
+	return i
+}
+
+// snapshot copies the counts and traced frames
+func (t *tracer) snapshot() ProtocolStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := ProtocolStats{Since: t.since, Types: make(map[string]*TypeStats, len(t.types))}
+	for name, s := range t.types {
+		copied := *s
+		stats.Types[name] = &copied
+	}
+	if t.full {
+		stats.Trace = append(stats.Trace, t.ring[t.next:]...)
+	}
+	stats.Trace = append(stats.Trace, t.ring[:t.next]...)
+	return stats
+}
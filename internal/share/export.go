@@ -0,0 +1,312 @@
+package share
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// exportUser is the user name for browsing exported folders
+const exportUser = "mps"
+
+// internalPrefix marks the tool's own files and directories in synced folders
+const internalPrefix = ".mps-"
+
+// exportPasswordPath returns where the export password is kept
+func exportPasswordPath() string {
+	return filepath.Join(config.ConfigDir(), "export-password")
+}
+
+// ExportCredentials returns the user name and password for browsing exported
+// folders, creating the password the first time
+func ExportCredentials() (string, string, error) {
+	data, err := os.ReadFile(exportPasswordPath())
+	if err == nil && strings.TrimSpace(string(data)) != "" {
+		return exportUser, strings.TrimSpace(string(data)), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", "", fmt.Errorf("failed to read export password: %w", err)
+	}
+
+	password, err := ResetExportPassword()
+	if err != nil {
+		return "", "", err
+	}
+	return exportUser, password, nil
+}
+
+// ResetExportPassword replaces the export password with a new random one
+func ResetExportPassword() (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate password: %w", err)
+	}
+	password := base64.RawURLEncoding.EncodeToString(buf)
+	if err := os.WriteFile(exportPasswordPath(), []byte(password+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to write export password: %w", err)
+	}
+	return password, nil
+}
+
+// ExportURL returns the address an exported folder can be browsed at
+func ExportURL(folder config.FolderConfig, port int) string {
+	host := "localhost"
+	if folder.ExportMode() == config.ExportLAN {
+		host = localAddress()
+	}
+	if port != 443 {
+		host = net.JoinHostPort(host, fmt.Sprint(port))
+	}
+	return fmt.Sprintf("https://%s/f/%s/", host, url.PathEscape(filepath.Base(folder.Path)))
+}
+
+// hasExports reports whether any enabled folder is exported
+func (s *Server) hasExports() bool {
+	for _, folder := range s.cfg.Folders {
+		if folder.Enabled && folder.ExportMode() != config.ExportOff {
+			return true
+		}
+	}
+	return false
+}
+
+// handleExport serves /f/<folder>/<path> read-only: a listing for
+// directories, the file itself otherwise
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(w, r) {
+		return
+	}
+
+	name, relPath, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/f/"), "/")
+	if name == "" {
+		s.listExports(w, r)
+		return
+	}
+	folder := s.exportedFolder(name, r)
+	if folder == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	relPath = strings.TrimPrefix(path.Clean("/"+relPath), "/")
+	if relPath != "" && !s.exportVisible(folder, relPath) {
+		http.NotFound(w, r)
+		return
+	}
+	fullPath, err := resolveInside(folder.Path, filepath.FromSlash(relPath))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(fullPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer func() { _ = f.Close() }()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		s.listDir(w, folder, relPath, fullPath)
+		return
+	}
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// authorized checks a request's export credentials, asking for them if they
+// are missing or wrong
+func (s *Server) authorized(w http.ResponseWriter, r *http.Request) bool {
+	_, password, err := ExportCredentials()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load export password")
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return false
+	}
+
+	user, given, ok := r.BasicAuth()
+	if ok &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(exportUser)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(given), []byte(password)) == 1 {
+		return true
+	}
+
+	if ok {
+		log.Warn().Str("from", r.RemoteAddr).Msg("Wrong password for exported folders")
+		time.Sleep(time.Second) // Slow down guessing
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="mac-profile-sync", charset="UTF-8"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// exportedFolder returns the exported folder with the given name, if the
+// request may see it. Folders exported locally are only served to this Mac.
+func (s *Server) exportedFolder(name string, r *http.Request) *config.FolderConfig {
+	for i := range s.cfg.Folders {
+		folder := &s.cfg.Folders[i]
+		if !folder.Enabled || filepath.Base(folder.Path) != name {
+			continue
+		}
+		switch folder.ExportMode() {
+		case config.ExportLAN:
+			return folder
+		case config.ExportLocal:
+			if isLoopback(r) {
+				return folder
+			}
+		}
+	}
+	return nil
+}
+
+// isLoopback reports whether a request comes from this Mac
+func isLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// exportVisible reports whether a path in an exported folder is shown: only
+// what syncs is, so ignored files and the tool's own directories stay hidden
+func (s *Server) exportVisible(folder *config.FolderConfig, relPath string) bool {
+	relPath = filepath.FromSlash(relPath)
+	if !folder.IncludesPath(relPath) || folder.IgnoresPath(relPath) {
+		return false
+	}
+	for dir := relPath; dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		if strings.HasPrefix(filepath.Base(dir), internalPrefix) || s.cfg.ShouldIgnore(filepath.Join(folder.Path, dir)) {
+			return false
+		}
+	}
+	return true
+}
+
+// listingEntry is one row of a directory listing
+type listingEntry struct {
+	Name     string
+	Href     string
+	IsDir    bool
+	Size     string
+	Modified string
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, sans-serif; margin: 1em; }
+td { padding: 0.3em 1em 0.3em 0; }
+.meta { color: #888; white-space: nowrap; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<table>
+{{if .Parent}}<tr><td><a href="../">..</a></td></tr>{{end}}
+{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}{{if .IsDir}}/{{end}}</a></td><td class="meta">{{.Size}}</td><td class="meta">{{.Modified}}</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+// listExports lists the exported folders a request may see
+func (s *Server) listExports(w http.ResponseWriter, r *http.Request) {
+	var entries []listingEntry
+	for _, folder := range s.cfg.Folders {
+		name := filepath.Base(folder.Path)
+		if s.exportedFolder(name, r) == nil {
+			continue
+		}
+		entries = append(entries, listingEntry{Name: name, Href: url.PathEscape(name) + "/", IsDir: true})
+	}
+	renderListing(w, "Exported folders", false, entries)
+}
+
+// listDir lists a directory in an exported folder, directories first
+func (s *Server) listDir(w http.ResponseWriter, folder *config.FolderConfig, relPath, fullPath string) {
+	dirEntries, err := os.ReadDir(fullPath)
+	if err != nil {
+		http.Error(w, "unreadable", http.StatusForbidden)
+		return
+	}
+
+	var entries []listingEntry
+	for _, d := range dirEntries {
+		if !s.exportVisible(folder, path.Join(relPath, d.Name())) {
+			continue
+		}
+		info, err := d.Info()
+		if err != nil {
+			continue
+		}
+		entry := listingEntry{
+			Name:     d.Name(),
+			Href:     url.PathEscape(d.Name()),
+			IsDir:    d.IsDir(),
+			Modified: fileutil.FormatDateTime(info.ModTime()),
+		}
+		if d.IsDir() {
+			entry.Href += "/"
+		} else {
+			entry.Size = fileutil.FormatSize(info.Size())
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsDir != entries[j].IsDir {
+			return entries[i].IsDir
+		}
+		return strings.ToLower(entries[i].Name) < strings.ToLower(entries[j].Name)
+	})
+
+	renderListing(w, path.Join(filepath.Base(folder.Path), relPath), true, entries)
+}
+
+func renderListing(w http.ResponseWriter, title string, parent bool, entries []listingEntry) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	err := listingTemplate.Execute(w, struct {
+		Title   string
+		Parent  bool
+		Entries []listingEntry
+	}{title, parent, entries})
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to write listing")
+	}
+}
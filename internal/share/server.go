@@ -0,0 +1,286 @@
+package share
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// certValidity is how long the self-signed share certificate is used
+const certValidity = 365 * 24 * time.Hour
+
+// Server serves share links, and folders exported for read-only browsing,
+// over HTTPS to devices that don't run the sync tool, such as phones on the
+// same network
+type Server struct {
+	cfg    *config.Config
+	port   int
+	server *http.Server
+
+	// Downloads are counted one at a time, so parallel requests can't get
+	// past a link's limit
+	mu      sync.Mutex
+	counted map[string]bool // Token + client address -> download counted
+}
+
+// NewServer creates a share link server
+func NewServer(cfg *config.Config, port int) *Server {
+	return &Server{cfg: cfg, port: port, counted: make(map[string]bool)}
+}
+
+// Start starts serving share links
+func (s *Server) Start() error {
+	cert, err := loadCertificate()
+	if err != nil {
+		return err
+	}
+
+	listener, err := tls.Listen("tcp", fmt.Sprintf(":%d", s.port), &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/s/", s.handleDownload)
+	if s.hasExports() {
+		mux.HandleFunc("/f/", s.handleExport)
+	}
+	s.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Msg("Share server stopped")
+		}
+	}()
+
+	log.Info().Int("port", s.port).Msg("Serving share links")
+	return nil
+}
+
+// Stop stops serving share links
+func (s *Server) Stop() {
+	if s.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = s.server.Shutdown(ctx)
+}
+
+// handleDownload serves /s/<token>/<name>
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/s/"), "/")
+
+	f, info := s.openLink(w, r, token)
+	if f == nil {
+		return
+	}
+	defer func() { _ = f.Close() }()
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename*=UTF-8''%s", url.PathEscape(info.Name())))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// openLink opens the file a link shares and counts the download, or writes
+// the error response and returns nil
+func (s *Server) openLink(w http.ResponseWriter, r *http.Request, token string) (*os.File, os.FileInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Links are created by the CLI, so read them fresh
+	store := NewStore()
+	if err := store.Load(); err != nil {
+		log.Error().Err(err).Msg("Failed to load share links")
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return nil, nil
+	}
+
+	link := store.Get(token)
+	if link == nil {
+		http.NotFound(w, r)
+		return nil, nil
+	}
+	// A device's resumed and partial requests aren't counted again, in
+	// whatever order they come, and finish a download that used the link up
+	key := token + " " + clientAddress(r)
+	resumed := s.counted[key] && !link.Expired()
+	if !link.Active() && !resumed {
+		http.Error(w, "this link has expired", http.StatusGone)
+		return nil, nil
+	}
+
+	// Only files still inside a synced folder are served
+	if s.cfg.GetFolder(link.FolderPath) == nil {
+		http.NotFound(w, r)
+		return nil, nil
+	}
+	fullPath, err := resolveInside(link.FolderPath, link.RelPath)
+	if err != nil {
+		log.Warn().Err(err).Str("file", link.RelPath).Msg("Refusing share link download")
+		http.NotFound(w, r)
+		return nil, nil
+	}
+
+	f, err := os.Open(fullPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return nil, nil
+	}
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		_ = f.Close()
+		http.NotFound(w, r)
+		return nil, nil
+	}
+
+	if r.Method == http.MethodGet && !resumed {
+		if !store.CountDownload(token) {
+			_ = f.Close()
+			http.Error(w, "this link has expired", http.StatusGone)
+			return nil, nil
+		}
+		if err := store.Save(); err != nil {
+			log.Error().Err(err).Msg("Failed to save share links")
+		}
+		s.counted[key] = true
+		log.Info().Str("file", link.RelPath).Str("from", r.RemoteAddr).Msg("Share link downloaded")
+	}
+
+	return f, info
+}
+
+// clientAddress returns the address a request came from, without its port
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// resolveInside returns the real path of relPath, refusing anything that
+// resolves outside folderPath
+func resolveInside(folderPath, relPath string) (string, error) {
+	root, err := filepath.EvalSymlinks(folderPath)
+	if err != nil {
+		return "", err
+	}
+	fullPath, err := filepath.EvalSymlinks(filepath.Join(folderPath, relPath))
+	if err != nil {
+		return "", err
+	}
+	if !fileutil.IsWithin(fullPath, root) {
+		return "", fmt.Errorf("%s is outside %s", relPath, folderPath)
+	}
+	return fullPath, nil
+}
+
+// URL returns the address other devices on the network can download a link from
+func URL(link *Link, port int) string {
+	host := localAddress()
+	if port != 443 {
+		host = net.JoinHostPort(host, fmt.Sprint(port))
+	}
+	return fmt.Sprintf("https://%s/s/%s/%s", host, link.Token, url.PathEscape(filepath.Base(link.RelPath)))
+}
+
+// localAddress returns this Mac's LAN address, or its hostname if there is none
+func localAddress() string {
+	addrs, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsPrivate() && ipNet.IP.To4() != nil {
+				return ipNet.IP.String()
+			}
+		}
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+	return "localhost"
+}
+
+// loadCertificate returns the share server's self-signed certificate,
+// creating it if it doesn't exist or is about to expire
+func loadCertificate() (tls.Certificate, error) {
+	certPath := filepath.Join(config.ConfigDir(), "share-cert.pem")
+	keyPath := filepath.Join(config.ConfigDir(), "share-key.pem")
+
+	if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil && time.Until(leaf.NotAfter) > 24*time.Hour {
+			return cert, nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate serial: %w", err)
+	}
+
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "mac-profile-sync " + hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{hostname, "localhost"},
+	}
+	if ip := net.ParseIP(localAddress()); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to marshal key: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to write certificate: %w", err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to write key: %w", err)
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
@@ -0,0 +1,210 @@
+package share
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+)
+
+// Share link defaults
+const (
+	DefaultExpiry    = time.Hour
+	DefaultDownloads = 1
+)
+
+// Link is a temporary download link for one file in a synced folder
+type Link struct {
+	Token        string    `json:"token"`
+	FolderPath   string    `json:"folder_path"`
+	RelPath      string    `json:"rel_path"`
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	MaxDownloads int       `json:"max_downloads"` // 0 = unlimited until expiry
+	Downloads    int       `json:"downloads"`
+}
+
+// Active reports whether the link can still be downloaded
+func (l *Link) Active() bool {
+	if l.Expired() {
+		return false
+	}
+	return l.MaxDownloads == 0 || l.Downloads < l.MaxDownloads
+}
+
+// Expired reports whether the link is past its expiry
+func (l *Link) Expired() bool {
+	return time.Now().After(l.ExpiresAt)
+}
+
+// FullPath returns the shared file's path
+func (l *Link) FullPath() string {
+	return filepath.Join(l.FolderPath, l.RelPath)
+}
+
+// Store persists share links so the CLI can create them and the daemon can
+// serve them
+type Store struct {
+	mu    sync.Mutex
+	links map[string]*Link
+	path  string
+}
+
+// NewStore creates a new share link store
+func NewStore() *Store {
+	return &Store{
+		links: make(map[string]*Link),
+		path:  filepath.Join(config.ConfigDir(), "shares.json"),
+	}
+}
+
+// Load reads share links from disk
+func (s *Store) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		s.links = make(map[string]*Link)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read share links: %w", err)
+	}
+
+	links := make(map[string]*Link)
+	if err := json.Unmarshal(data, &links); err != nil {
+		return fmt.Errorf("failed to parse share links: %w", err)
+	}
+	s.links = links
+	return nil
+}
+
+// Save writes share links to disk, dropping expired ones. A link used up is
+// kept until it expires, so the devices that downloaded it can resume.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for token, link := range s.links {
+		if link.Expired() {
+			delete(s.links, token)
+		}
+	}
+
+	data, err := json.MarshalIndent(s.links, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal share links: %w", err)
+	}
+	if err := os.WriteFile(s.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write share links: %w", err)
+	}
+	return nil
+}
+
+// Create adds a link for a file inside a synced folder
+func (s *Store) Create(folderPath, relPath string, expiry time.Duration, maxDownloads int) (*Link, error) {
+	if expiry <= 0 {
+		return nil, fmt.Errorf("expiry must be positive")
+	}
+	if maxDownloads < 0 {
+		return nil, fmt.Errorf("download limit can't be negative")
+	}
+	if relPath == "" || relPath == "." || strings.HasPrefix(relPath, "..") || filepath.IsAbs(relPath) {
+		return nil, fmt.Errorf("%s is not inside %s", relPath, folderPath)
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	now := time.Now()
+	link := &Link{
+		Token:        hex.EncodeToString(token),
+		FolderPath:   folderPath,
+		RelPath:      relPath,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(expiry),
+		MaxDownloads: maxDownloads,
+	}
+
+	s.mu.Lock()
+	s.links[link.Token] = link
+	s.mu.Unlock()
+	return link, nil
+}
+
+// Get returns a link by token
+func (s *Store) Get(token string) *Link {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if link, ok := s.links[token]; ok {
+		copied := *link
+		return &copied
+	}
+	return nil
+}
+
+// CountDownload records a download and reports whether the link allowed it
+func (s *Store) CountDownload(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	link, ok := s.links[token]
+	if !ok || !link.Active() {
+		return false
+	}
+	link.Downloads++
+	return true
+}
+
+// Revoke removes a link. A token prefix is enough if it is unambiguous.
+func (s *Store) Revoke(token string) (*Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var match *Link
+	for t, link := range s.links {
+		if !strings.HasPrefix(t, token) {
+			continue
+		}
+		if match != nil {
+			return nil, fmt.Errorf("%q matches more than one link", token)
+		}
+		match = link
+	}
+	if match == nil {
+		return nil, fmt.Errorf("no share link %q", token)
+	}
+
+	delete(s.links, match.Token)
+	return match, nil
+}
+
+// List returns the links that can still be used, newest first
+func (s *Store) List() []*Link {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	links := make([]*Link, 0, len(s.links))
+	for _, link := range s.links {
+		if link.Active() {
+			copied := *link
+			links = append(links, &copied)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].CreatedAt.After(links[j].CreatedAt)
+	})
+	return links
+}
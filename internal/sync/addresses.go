@@ -0,0 +1,187 @@
+package sync
+
+import (
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/rs/zerolog/log"
+)
+
+// addressCheckInterval is how often this Mac's addresses are checked for a
+// network change to announce to connected peers
+const addressCheckInterval = 5 * time.Second
+
+// localAddresses returns the ip:port addresses peers can dial this Mac at,
+// IPv4 first. Only interfaces in network.mdns_interfaces are used if set.
+func localAddresses(port int, interfaces []string) []string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var v4, v6 []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if len(interfaces) > 0 && !slices.Contains(interfaces, iface.Name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			// Link-local addresses can't be dialed without naming the interface
+			if !ok || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			hostPort := net.JoinHostPort(ipNet.IP.String(), strconv.Itoa(port))
+			if ipNet.IP.To4() != nil {
+				v4 = append(v4, hostPort)
+			} else {
+				v6 = append(v6, hostPort)
+			}
+		}
+	}
+	return append(v4, v6...)
+}
+
+// announcedAddresses keeps the addresses peers announced after their network
+// changed, tried first when their connection drops
+type announcedAddresses struct {
+	mu    sync.Mutex
+	peers map[string][]string // Peer name -> addresses, most preferred first
+}
+
+func newAnnouncedAddresses() *announcedAddresses {
+	return &announcedAddresses{peers: make(map[string][]string)}
+}
+
+func (a *announcedAddresses) set(peerName string, addrs []string) {
+	a.mu.Lock()
+	a.peers[peerName] = addrs
+	a.mu.Unlock()
+}
+
+func (a *announcedAddresses) get(peerName string) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.peers[peerName]
+}
+
+// addressLoop acts on this Mac's addresses changing: connections from the old
+// address are dead, so known peers are dialed again from the new one, then
+// all connected peers are told the new addresses so they can dial this Mac
+// at them right away instead of waiting for discovery
+func (e *Engine) addressLoop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(addressCheckInterval)
+	defer ticker.Stop()
+
+	last := localAddresses(e.cfg.Network.Port, e.cfg.Network.MDNSInterfaces)
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			current := localAddresses(e.cfg.Network.Port, e.cfg.Network.MDNSInterfaces)
+			if slices.Equal(current, last) {
+				continue
+			}
+			last = current
+			if len(current) > 0 {
+				log.Info().Strs("addresses", current).Msg("Network changed, announcing new addresses to peers")
+				e.dialKnownPeers()
+				e.announceAddresses(current)
+			}
+		}
+	}
+}
+
+// announceAddresses sends this Mac's addresses to every connected peer that
+// understands address updates
+func (e *Engine) announceAddresses(addrs []string) {
+	msg, err := network.NewMessage(network.MsgAddressUpdate, network.AddressUpdateMessage{Addresses: addrs})
+	if err != nil {
+		return
+	}
+
+	send := func(peerID, version string, sendFn func(*network.Message) error) {
+		if !network.VersionAtLeast(version, network.AddressUpdateVersion) {
+			return
+		}
+		if err := sendFn(msg); err != nil {
+			log.Debug().Err(err).Str("peer_id", e.connName(peerID)).Msg("Failed to announce new addresses")
+		}
+	}
+	for _, conn := range e.server.GetConnections() {
+		send(conn.ID, conn.Version, conn.Send)
+	}
+	for _, conn := range e.client.GetConnections() {
+		send(conn.Address, conn.Version, conn.Send)
+	}
+}
+
+// handleAddressUpdate remembers a peer's new addresses and moves our
+// connection to it onto one of them, unless it already uses one
+func (e *Engine) handleAddressUpdate(update network.AddressUpdateMessage, peerName string) {
+	if peerName == "" || len(update.Addresses) == 0 {
+		return
+	}
+	if update.Introduce {
+		log.Debug().Str("peer_id", peerName).Strs("addresses", update.Addresses).Msg("Peer sent addresses to introduce")
+		e.announced.set(peerName, update.Addresses)
+		return
+	}
+	log.Info().Str("peer_id", peerName).Strs("addresses", update.Addresses).Msg("Peer announced new addresses")
+	e.announced.set(peerName, update.Addresses)
+
+	var stale []string
+	for _, conn := range e.client.GetConnections() {
+		if conn.DeviceName != peerName {
+			continue
+		}
+		if slices.Contains(update.Addresses, conn.Address) {
+			return
+		}
+		// Relayed and hole-punched connections don't depend on its addresses
+		if !strings.Contains(conn.Address, "://") {
+			stale = append(stale, conn.Address)
+		}
+	}
+
+	go func() {
+		if !e.dialAnnounced(peerName) {
+			return
+		}
+		for _, addr := range stale {
+			log.Info().Str("peer_id", peerName).Str("addr", addr).Msg("Closing connection to peer's old address")
+			e.client.Disconnect(addr)
+		}
+	}()
+}
+
+// dialAnnounced connects to the first address a peer announced that
+// answers, reporting whether one did
+func (e *Engine) dialAnnounced(peerName string) bool {
+	for _, addr := range e.announced.get(peerName) {
+		if e.ctx.Err() != nil {
+			return false
+		}
+		if _, err := e.client.Connect(addr); err != nil {
+			log.Debug().Err(err).Str("peer_id", peerName).Str("addr", addr).Msg("Announced address didn't answer")
+			continue
+		}
+		log.Info().Str("peer_id", peerName).Str("addr", addr).Msg("Connected to peer at announced address")
+		return true
+	}
+	return false
+}
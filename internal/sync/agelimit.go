@@ -0,0 +1,33 @@
+package sync
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// tooOld reports whether a file was last modified longer ago than
+// sync.max_age and must be skipped. peerName is the peer offering it, or ""
+// for a local file; a peer's mod time is taken on our clock. Folders full of
+// old files would flood the activity list, so skips are only logged at debug
+// level.
+func (e *Engine) tooOld(folderPath, relPath string, modTime time.Time, peerName string) bool {
+	maxAge := e.cfg.GetMaxAge()
+	if maxAge <= 0 || modTime.IsZero() {
+		return false
+	}
+	if peerName != "" {
+		modTime = e.localClock(peerName, modTime)
+	}
+	if time.Since(modTime) <= maxAge {
+		return false
+	}
+
+	log.Debug().
+		Str("folder_id", folderPath).
+		Str("file", relPath).
+		Time("mod_time", modTime).
+		Str("peer_id", peerName).
+		Msg("File is over max_age, skipping")
+	return true
+}
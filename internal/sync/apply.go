@@ -0,0 +1,110 @@
+package sync
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// applyLimiter throttles writing received files into one folder, so a
+// spinning disk isn't thrashed by thousands of small files at once. It is
+// separate from the network limits, which only shape what is transferred.
+type applyLimiter struct {
+	concurrency int
+	rate        int
+
+	slots chan struct{} // nil = no concurrency limit
+
+	mu   sync.Mutex
+	next time.Time // When the next write may start under the rate limit
+}
+
+func newApplyLimiter(concurrency, rate int) *applyLimiter {
+	l := &applyLimiter{concurrency: concurrency, rate: rate}
+	if concurrency > 0 {
+		l.slots = make(chan struct{}, concurrency)
+	}
+	return l
+}
+
+// applyLimiters holds each throttled folder's limiter, rebuilt when its
+// limits change
+type applyLimiters struct {
+	mu      sync.Mutex
+	folders map[string]*applyLimiter // Folder path -> limiter
+}
+
+func newApplyLimiters() *applyLimiters {
+	return &applyLimiters{folders: make(map[string]*applyLimiter)}
+}
+
+// applyLimiter returns the folder's limiter, or nil if it isn't throttled
+func (e *Engine) applyLimiter(localFolderPath string) *applyLimiter {
+	folderCfg := e.cfg.GetFolder(localFolderPath)
+
+	e.applies.mu.Lock()
+	defer e.applies.mu.Unlock()
+
+	if folderCfg == nil || !folderCfg.HasApplyLimits() {
+		delete(e.applies.folders, localFolderPath)
+		return nil
+	}
+	l := e.applies.folders[localFolderPath]
+	if l == nil || l.concurrency != folderCfg.ApplyConcurrency || l.rate != folderCfg.ApplyRate {
+		l = newApplyLimiter(folderCfg.ApplyConcurrency, folderCfg.ApplyRate)
+		e.applies.folders[localFolderPath] = l
+		log.Info().
+			Str("folder_id", localFolderPath).
+			Int("apply_concurrency", l.concurrency).
+			Int("apply_rate", l.rate).
+			Msg("Throttling writes of received files")
+	}
+	return l
+}
+
+// startApply waits until a received file may be written to a folder under
+// its apply limits, and returns a func to call once the write is done.
+// Returns false if the engine stopped while waiting.
+func (e *Engine) startApply(localFolderPath string) (func(), bool) {
+	l := e.applyLimiter(localFolderPath)
+	if l == nil {
+		return func() {}, true
+	}
+
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-e.ctx.Done():
+			return func() {}, false
+		}
+	}
+	done := func() {
+		if l.slots != nil {
+			<-l.slots
+		}
+	}
+
+	if l.rate > 0 {
+		l.mu.Lock()
+		now := time.Now()
+		start := l.next
+		if start.Before(now) {
+			start = now
+		}
+		l.next = start.Add(time.Second / time.Duration(l.rate))
+		l.mu.Unlock()
+
+		if wait := time.Until(start); wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-e.ctx.Done():
+				done()
+				return func() {}, false
+			}
+		}
+	}
+	return done, true
+}
@@ -0,0 +1,257 @@
+package sync
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+
+	"github.com/jseidel/mac-profile-sync/internal/logging"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// handleAttribChange sends a file's permissions, flags and extended
+// attributes to peers when they changed without its content. If the content
+// changed too, the whole file is sent instead.
+func (e *Engine) handleAttribChange(event FileEvent) {
+	if !e.cfg.CanSend() {
+		log.Debug().Str("path", event.Path).Msg("Skipping attribute change (receive_only mode)")
+		return
+	}
+
+	info, err := os.Lstat(event.Path)
+	if os.IsNotExist(err) {
+		return // Deleted since; the delete event follows
+	}
+	if err != nil {
+		log.Error().Err(err).Str("path", event.Path).Msg("Failed to stat file")
+		return
+	}
+	if info.IsDir() {
+		if e.propagationAllowed("send", event.Path) {
+			e.handleDirChange(event)
+		}
+		return
+	}
+	if !info.Mode().IsRegular() {
+		return
+	}
+
+	// Size and mod time unchanged since the last sync means the content is too
+	state := e.state.GetFileState(event.FolderPath, event.RelPath)
+	if state == nil || state.Size != info.Size() || !state.ModTime.Equal(info.ModTime()) {
+		e.handleFileChange(event)
+		return
+	}
+	if !e.propagationAllowed("send attributes", event.Path) {
+		return
+	}
+
+	xattrs, _ := fileutil.ReadXattrs(event.Path)
+	msg := network.FileMetaMessage{
+		FolderPath: event.FolderPath,
+		FolderName: e.folderName(event.FolderPath),
+		RelPath:    event.RelPath,
+		Hash:       state.Hash,
+		HashAlgo:   state.HashAlgo,
+		Permission: uint32(info.Mode().Perm()),
+		Flags:      fileutil.FileFlags(info),
+		Xattrs:     xattrs,
+	}
+
+	updated := *state
+	updated.Permission = info.Mode().Perm()
+	e.state.UpdateFileState(event.FolderPath, &updated)
+
+	for _, conn := range e.server.GetConnections() {
+		e.sendFileMeta(conn.ID, conn.Version, conn.Send, msg)
+	}
+	for _, conn := range e.client.GetConnections() {
+		e.sendFileMeta(conn.Address, conn.Version, conn.Send, msg)
+	}
+	log.Debug().Str("file", event.RelPath).Str("folder_id", event.FolderPath).Msg("Sent attribute change")
+}
+
+// sendMetaChange sends peers a file's mod time and attributes in place of
+// the whole file when its content is what was last synced, as after touch or
+// chmod. It reports whether the change was sent this way. A file with
+// nothing changed, such as one just received, is still sent whole, which
+// passes it on to peers that don't have it yet.
+func (e *Engine) sendMetaChange(event FileEvent, fi *fileutil.FileInfo) bool {
+	state := e.state.GetFileState(event.FolderPath, fi.RelPath)
+	if state == nil || state.Size != fi.Size || state.Hash != fi.Hash || state.Algorithm() != fileutil.HashAlgorithmOf(fi.HashAlgo) {
+		return false
+	}
+	if state.ModTime.Equal(fi.ModTime) && state.Permission.Perm() == fi.Permission.Perm() {
+		return false
+	}
+	info, err := os.Lstat(event.Path)
+	if err != nil {
+		return false
+	}
+
+	msg := network.FileMetaMessage{
+		FolderPath: event.FolderPath,
+		FolderName: e.folderName(event.FolderPath),
+		RelPath:    fi.RelPath,
+		Hash:       state.Hash,
+		HashAlgo:   state.HashAlgo,
+		Permission: uint32(info.Mode().Perm()),
+		Flags:      fileutil.FileFlags(info),
+		Xattrs:     fi.Xattrs,
+	}
+	if !state.ModTime.Equal(fi.ModTime) {
+		msg.ModTime = fi.ModTime
+	}
+
+	updated := *state
+	updated.ModTime = fi.ModTime
+	updated.Permission = info.Mode().Perm()
+	e.state.UpdateFileState(event.FolderPath, &updated)
+
+	for _, conn := range e.server.GetConnections() {
+		e.sendFileMeta(conn.ID, conn.Version, conn.Send, msg)
+	}
+	for _, conn := range e.client.GetConnections() {
+		e.sendFileMeta(conn.Address, conn.Version, conn.Send, msg)
+	}
+	log.Debug().Str("file", fi.RelPath).Str("folder_id", event.FolderPath).Bool("mod_time", !msg.ModTime.IsZero()).Msg("Sent metadata change")
+	return true
+}
+
+// sendFileMeta sends an attribute change to one peer. Peers too old to
+// understand attribute changes, or a mod time change, get the whole file.
+func (e *Engine) sendFileMeta(peerID, version string, send func(*network.Message) error, meta network.FileMetaMessage) {
+	if network.VersionAtLeast(version, network.FileMetaVersion) && (meta.ModTime.IsZero() || network.VersionAtLeast(version, network.MetaTimesVersion)) {
+		msg, err := network.NewMessage(network.MsgFileMeta, meta)
+		if err != nil {
+			return
+		}
+		if err := send(msg); err != nil {
+			log.Error().Err(err).Str("peer_id", e.connName(peerID)).Msg("Failed to send attribute change")
+		}
+		return
+	}
+
+	data, err := e.fileDataMessage(meta.FolderPath, meta.RelPath)
+	if err != nil {
+		log.Error().Err(err).Str("file", meta.RelPath).Msg("Failed to read file")
+		return
+	}
+	if err := e.pushFileData(peerID, send, data); err != nil {
+		log.Error().Err(err).Str("peer_id", e.connName(peerID)).Str("transfer_id", logging.TransferID(data.FolderName, data.RelPath, data.Hash)).Msg("Failed to send file")
+	}
+}
+
+// handleFileMeta applies a peer's attribute change to the local copy of a
+// file, if it still has the content the attributes were sent for
+func (e *Engine) handleFileMeta(meta network.FileMetaMessage, peerName string) {
+	if !e.cfg.CanReceive() {
+		log.Debug().Str("file", meta.RelPath).Msg("Ignoring attribute change (send_only mode)")
+		return
+	}
+
+	localFolderPath := e.findLocalFolderByName(meta.FolderName)
+	if localFolderPath == "" {
+		return
+	}
+	if e.ignores.Ignored(localFolderPath, meta.RelPath) {
+		return
+	}
+	if folderCfg := e.cfg.GetFolder(localFolderPath); folderCfg != nil {
+		if !folderCfg.IncludesPath(meta.RelPath) {
+			return
+		}
+		if folderCfg.RequiresApproval() {
+			log.Debug().Str("file", meta.RelPath).Msg("Ignoring attribute change in folder that needs approval")
+			return
+		}
+	}
+
+	// A different version here is settled by a file transfer, attributes and all
+	state := e.state.GetFileState(localFolderPath, meta.RelPath)
+	if state == nil || state.Hash != meta.Hash {
+		log.Debug().Str("file", meta.RelPath).Str("peer_id", peerName).Msg("Ignoring attribute change for a different version")
+		return
+	}
+
+	fullPath := filepath.Join(localFolderPath, meta.RelPath)
+	if !e.propagationAllowed("update attributes", fullPath) {
+		return
+	}
+
+	if err := applyFileMeta(fullPath, meta); err != nil {
+		log.Error().Err(err).Str("path", fullPath).Msg("Failed to update attributes")
+		e.folderError(localFolderPath, err)
+		return
+	}
+
+	updated := *state
+	updated.Permission = os.FileMode(meta.Permission).Perm()
+	if !meta.ModTime.IsZero() {
+		updated.ModTime = meta.ModTime
+	}
+	e.state.UpdateFileState(localFolderPath, &updated)
+
+	log.Info().
+		Str("file", meta.RelPath).
+		Str("folder_id", localFolderPath).
+		Str("peer_id", peerName).
+		Msg("Updated attributes")
+}
+
+// applyFileMeta sets a file's permissions, flags, extended attributes and,
+// if sent, mod time. Only what differs is written, so the watcher's event
+// for it settles the change instead of echoing it back.
+func applyFileMeta(fullPath string, meta network.FileMetaMessage) error {
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a file", fullPath)
+	}
+
+	// Unlock first, or nothing else can be changed
+	flags := fileutil.FileFlags(info)
+	if flags != 0 && flags != meta.Flags {
+		if err := fileutil.SetFileFlags(fullPath, 0); err != nil {
+			return err
+		}
+	}
+
+	current, _ := fileutil.ReadXattrs(fullPath)
+	if !maps.EqualFunc(current, meta.Xattrs, bytes.Equal) {
+		if err := fileutil.WriteXattrs(fullPath, meta.Xattrs); err != nil {
+			log.Debug().Err(err).Str("path", fullPath).Msg("Failed to restore extended attributes")
+		}
+		for name := range current {
+			if _, ok := meta.Xattrs[name]; !ok {
+				_ = fileutil.RemoveXattr(fullPath, name)
+			}
+		}
+	}
+
+	perm := os.FileMode(meta.Permission).Perm()
+	if info.Mode().Perm() != perm {
+		if err := os.Chmod(fullPath, perm); err != nil {
+			return fmt.Errorf("failed to set permissions: %w", err)
+		}
+	}
+
+	if !meta.ModTime.IsZero() && !info.ModTime().Equal(meta.ModTime) {
+		if err := os.Chtimes(fullPath, meta.ModTime, meta.ModTime); err != nil {
+			return fmt.Errorf("failed to set mod time: %w", err)
+		}
+	}
+
+	if flags != meta.Flags {
+		if err := fileutil.SetFileFlags(fullPath, meta.Flags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
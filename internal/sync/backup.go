@@ -0,0 +1,252 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// Backup coordination limits
+const (
+	DefaultBackupLockTTL = 6 * time.Hour     // Locks older than this are ignored, in case a post-backup hook never ran
+	maxHeldBackupBytes   = 256 * 1024 * 1024 // Incoming changes held while a backup runs
+	backupCheckInterval  = 5 * time.Second
+)
+
+// errBackupInProgress is returned for incoming files that can't be held while a backup runs
+var errBackupInProgress = errors.New("backup in progress, try again later")
+
+var timeMachineRunning = regexp.MustCompile(`\bRunning = 1;`)
+
+// BackupLock is written by backup tools (e.g. a Carbon Copy Cloner pre-flight
+// script) to pause incoming changes until the backup finishes
+type BackupLock struct {
+	Holder     string    `json:"holder"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Expired reports whether the lock is too old to honour
+func (l *BackupLock) Expired() bool {
+	return time.Now().After(l.ExpiresAt)
+}
+
+// BackupLockPath returns where backup tools hold the backup lock
+func BackupLockPath() string {
+	return filepath.Join(config.ConfigDir(), "backup.lock")
+}
+
+// AcquireBackupLock pauses incoming changes for up to ttl, until released
+func AcquireBackupLock(holder string, ttl time.Duration) (*BackupLock, error) {
+	if ttl <= 0 {
+		ttl = DefaultBackupLockTTL
+	}
+	now := time.Now()
+	lock := &BackupLock{Holder: holder, AcquiredAt: now, ExpiresAt: now.Add(ttl)}
+
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal backup lock: %w", err)
+	}
+	if err := os.WriteFile(BackupLockPath(), data, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write backup lock: %w", err)
+	}
+	return lock, nil
+}
+
+// ReleaseBackupLock lets the daemon apply incoming changes again
+func ReleaseBackupLock() error {
+	if err := os.Remove(BackupLockPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove backup lock: %w", err)
+	}
+	return nil
+}
+
+// LoadBackupLock reads the backup lock, returning nil if none is held
+func LoadBackupLock() (*BackupLock, error) {
+	data, err := os.ReadFile(BackupLockPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup lock: %w", err)
+	}
+
+	var lock BackupLock
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("failed to parse backup lock: %w", err)
+	}
+	return &lock, nil
+}
+
+// TimeMachineRunning reports whether a Time Machine backup is in progress
+func TimeMachineRunning(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "tmutil", "status").Output()
+	if err != nil {
+		return false
+	}
+	return timeMachineRunning.Match(output)
+}
+
+// backupGate holds incoming peer changes while a backup of the synced folders
+// runs, so the backup sees each folder as it was when it started
+type backupGate struct {
+	mu        sync.Mutex
+	paused    bool // A backup is running, or held changes are still being applied
+	held      []func()
+	heldBytes int
+}
+
+func newBackupGate() *backupGate {
+	return &backupGate{}
+}
+
+// hold queues apply while paused. It reports whether apply was held, and
+// whether it was turned away because too much is held already.
+func (g *backupGate) hold(size int, apply func()) (held, full bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.paused {
+		return false, false
+	}
+	if g.heldBytes+size > maxHeldBackupBytes {
+		return false, true
+	}
+	g.held = append(g.held, apply)
+	g.heldBytes += size
+	return true, false
+}
+
+// pause starts holding changes and reports whether it wasn't already
+func (g *backupGate) pause() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	wasPaused := g.paused
+	g.paused = true
+	return !wasPaused
+}
+
+// drain applies held changes in the order they arrived, then stops holding.
+// Changes that arrive meanwhile queue behind the held ones.
+func (g *backupGate) drain() int {
+	applied := 0
+	for {
+		g.mu.Lock()
+		batch := g.held
+		g.held = nil
+		g.heldBytes = 0
+		if len(batch) == 0 {
+			g.paused = false
+			g.mu.Unlock()
+			return applied
+		}
+		g.mu.Unlock()
+
+		for _, apply := range batch {
+			apply()
+		}
+		applied += len(batch)
+	}
+}
+
+func (g *backupGate) isPaused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+// holdsForBackup reports whether a message changes local files
+func holdsForBackup(t network.MessageType) bool {
+	switch t {
+	case network.MsgFileList, network.MsgFileData, network.MsgFileDelete, network.MsgFileMove, network.MsgDirCreate, network.MsgFileMeta:
+		return true
+	}
+	return false
+}
+
+// holdForBackup queues a peer's change while a backup runs. It reports whether
+// the message was dealt with.
+func (e *Engine) holdForBackup(msg *network.Message, connID, peerName string, send func(*network.Message) error) bool {
+	if !holdsForBackup(msg.Type) {
+		return false
+	}
+
+	held, full := e.backup.hold(len(msg.Payload), func() {
+		e.dispatchMessage(msg, connID, peerName, send)
+	})
+	if !held && !full {
+		return false
+	}
+
+	if msg.Type == network.MsgFileData {
+		var fileData network.FileDataMessage
+		if err := msg.DecodePayload(&fileData); err == nil {
+			// Free the transfer slot now; the data is applied (or refused) later
+			e.transfers.complete(connID, fileData.FolderName, fileutil.NormalizePath(fileData.RelPath))
+			if full {
+				e.ackFileData(fileData, errBackupInProgress, false, send)
+			}
+		}
+	} else if full {
+		log.Warn().Str("peer_id", peerName).Str("type", msg.Type.String()).Msg("Too many changes held for backup, dropping")
+	}
+	return true
+}
+
+// backupActive reports whether a backup is running and why
+func (e *Engine) backupActive() (bool, string) {
+	lock, err := LoadBackupLock()
+	if err != nil {
+		log.Debug().Err(err).Msg("Ignoring unreadable backup lock")
+	}
+	if lock != nil && !lock.Expired() {
+		return true, "backup lock held by " + lock.Holder
+	}
+	if e.cfg.Sync.PauseForTimeMachine && TimeMachineRunning(e.ctx) {
+		return true, "Time Machine backup running"
+	}
+	return false, ""
+}
+
+// backupLoop pauses incoming changes while a backup runs and applies them once
+// it finishes
+func (e *Engine) backupLoop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(backupCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if active, reason := e.backupActive(); active {
+			if e.backup.pause() {
+				log.Info().Str("reason", reason).Msg("Backup in progress, holding incoming changes")
+			}
+		} else if e.backup.isPaused() {
+			applied := e.backup.drain()
+			log.Info().Int("changes", applied).Msg("Backup finished, applied held changes")
+		}
+
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
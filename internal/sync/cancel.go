@@ -0,0 +1,98 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// folderContexts holds a context per folder, derived from the engine's, so
+// scans, hashing and file reads in a folder stop promptly when the engine
+// stops or the folder is removed
+type folderContexts struct {
+	mu      sync.Mutex
+	ctxs    map[string]context.Context
+	cancels map[string]context.CancelFunc
+}
+
+func newFolderContexts() *folderContexts {
+	return &folderContexts{
+		ctxs:    make(map[string]context.Context),
+		cancels: make(map[string]context.CancelFunc),
+	}
+}
+
+// folderContext returns the context work in a folder runs under
+func (e *Engine) folderContext(folderPath string) context.Context {
+	e.folderCtxs.mu.Lock()
+	defer e.folderCtxs.mu.Unlock()
+
+	if ctx, ok := e.folderCtxs.ctxs[folderPath]; ok {
+		return ctx
+	}
+	ctx, cancel := context.WithCancel(e.ctx)
+	e.folderCtxs.ctxs[folderPath] = ctx
+	e.folderCtxs.cancels[folderPath] = cancel
+	return ctx
+}
+
+// cancelFolder stops work in progress in a folder. Work started later gets
+// a new context.
+func (e *Engine) cancelFolder(folderPath string) {
+	e.folderCtxs.mu.Lock()
+	cancel := e.folderCtxs.cancels[folderPath]
+	delete(e.folderCtxs.ctxs, folderPath)
+	delete(e.folderCtxs.cancels, folderPath)
+	e.folderCtxs.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// RemoveFolder stops syncing a folder: a scan or transfer in progress in it
+// is canceled, it is no longer watched, and it is removed from the config
+// along with its sync state
+func (e *Engine) RemoveFolder(folderPath string) error {
+	folderCfg := e.cfg.GetFolder(folderPath)
+	if folderCfg == nil {
+		return fmt.Errorf("folder not found: %s", folderPath)
+	}
+	folderPath = folderCfg.Path
+
+	e.cancelFolder(folderPath)
+	_ = e.watcher.RemoveFolder(folderPath)
+
+	if err := e.cfg.RemoveFolder(folderPath); err != nil {
+		return err
+	}
+
+	e.forgetFolder(folderPath)
+	return nil
+}
+
+// reloadRemovedFolders stops syncing folders removed from the config file
+// while the daemon runs, as RemoveFolder does
+func (e *Engine) reloadRemovedFolders() {
+	removed, err := e.cfg.ReloadRemovedFolders()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to reload folders")
+		return
+	}
+	for _, folderPath := range removed {
+		e.cancelFolder(folderPath)
+		_ = e.watcher.RemoveFolder(folderPath)
+		e.forgetFolder(folderPath)
+	}
+}
+
+// forgetFolder drops a removed folder's sync state. The daemon does this
+// itself, since a state file cleared by another process would be written
+// again from memory. Re-adding the folder starts a new state generation, so
+// peers re-verify it.
+func (e *Engine) forgetFolder(folderPath string) {
+	e.state.ClearFolder(folderPath)
+	log.Info().Str("folder_id", folderPath).Msg("Folder removed")
+}
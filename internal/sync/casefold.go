@@ -0,0 +1,121 @@
+package sync
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// caseProbe remembers which synced folders live on a case-insensitive
+// filesystem, where names differing only in case are the same file
+type caseProbe struct {
+	mu        sync.Mutex
+	sensitive map[string]bool
+}
+
+func newCaseProbe() *caseProbe {
+	return &caseProbe{sensitive: make(map[string]bool)}
+}
+
+// caseSensitive reports whether a folder's filesystem tells names apart by
+// case, by creating a temp file and looking it up in upper case
+func (p *caseProbe) caseSensitive(folderPath string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if sensitive, ok := p.sensitive[folderPath]; ok {
+		return sensitive
+	}
+
+	f, err := os.CreateTemp(folderPath, tempPrefix+"case-*")
+	if err != nil {
+		// APFS and HFS+ are case-insensitive unless formatted otherwise
+		return runtime.GOOS != "darwin"
+	}
+	probe := f.Name()
+	_ = f.Close()
+	defer func() { _ = os.Remove(probe) }()
+
+	_, err = os.Lstat(filepath.Join(folderPath, strings.ToUpper(filepath.Base(probe))))
+	sensitive := err != nil
+	p.sensitive[folderPath] = sensitive
+	return sensitive
+}
+
+// caseCollision returns the relative path of an existing file whose name
+// differs from relPath only in case, which a case-insensitive folder can't
+// hold alongside it. Directories differing only in case are treated as the
+// same directory.
+func (e *Engine) caseCollision(folderPath, relPath string) string {
+	if e.cases.caseSensitive(folderPath) {
+		return ""
+	}
+
+	dir := filepath.Join(folderPath, filepath.Dir(relPath))
+	name := filepath.Base(relPath)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+
+	existing := ""
+	for _, entry := range entries {
+		if entry.Name() == name {
+			return ""
+		}
+		if existing == "" && strings.EqualFold(entry.Name(), name) {
+			existing = entry.Name()
+		}
+	}
+	if existing == "" {
+		return ""
+	}
+	return path.Join(path.Dir(filepath.ToSlash(relPath)), existing)
+}
+
+// raiseCaseCollision reports an incoming file that would overwrite a local
+// file differing only in case, instead of clobbering it. Identical contents
+// and collisions already resolved by keeping the local file aren't raised.
+func (e *Engine) raiseCaseCollision(folderPath, relPath, existing string, remote *ConflictFile) {
+	localPath := filepath.Join(folderPath, existing)
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return
+	}
+	localHash, _ := e.hashFile(folderPath, localPath)
+	if matchesHash(localPath, localHash, e.hashAlgo(folderPath), remote.Hash, remote.HashAlgo) || e.conflict.IsSuppressed(folderPath, relPath, localHash, remote.Hash) {
+		return
+	}
+
+	e.conflict.add(&Conflict{
+		ID:         conflictID(folderPath, relPath),
+		FolderPath: folderPath,
+		RelPath:    relPath,
+		CaseOf:     existing,
+		LocalFile: &ConflictFile{
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Hash:    localHash,
+		},
+		RemoteFile: remote,
+		DetectedAt: time.Now(),
+	})
+
+	log.Warn().
+		Str("folder_id", folderPath).
+		Str("file", relPath).
+		Str("existing", existing).
+		Str("peer_id", remote.DeviceName).
+		Msg("Received file differs only in case from a local file, raised as a conflict")
+}
+
+// foldedPath is the key two paths share if they differ only in case
+func foldedPath(relPath string) string {
+	return strings.ToLower(filepath.ToSlash(relPath))
+}
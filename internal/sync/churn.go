@@ -0,0 +1,145 @@
+package sync
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+// churnMemory is how long a file that was written continuously is remembered
+// as busy after its last write, so the next burst is deferred from the start
+const churnMemory = 10 * time.Minute
+
+// churnTracker learns which files are written continuously, like logs and
+// recordings, and holds their changes until writes stop instead of sending
+// every debounce window. A file still being written is sent at least every
+// sync.churn_max_delay.
+type churnTracker struct {
+	cfg  *config.Config
+	emit func(FileEvent) bool
+
+	mu        sync.Mutex
+	paths     map[string]*writePattern
+	lastPrune time.Time
+}
+
+// writePattern is what is known about the recent writes to one file
+type writePattern struct {
+	lastWrite time.Time
+	streak    int  // Bursts of writes, each within churn_settle of the one before
+	busy      bool // Reached churn_writes; writes are held until they stop
+
+	held      *FileEvent // Latest change held, if any
+	heldSince time.Time
+	timer     *time.Timer
+}
+
+func newChurnTracker(cfg *config.Config, emit func(FileEvent) bool) *churnTracker {
+	return &churnTracker{
+		cfg:   cfg,
+		emit:  emit,
+		paths: make(map[string]*writePattern),
+	}
+}
+
+// hold records a write to a file and reports whether its change is held
+// because the file is busy. Held changes are emitted once the file has gone
+// churn_settle without a write, or churn_max_delay after the first was held.
+func (c *churnTracker) hold(event *FileEvent) bool {
+	writes, settle, maxDelay := c.cfg.GetChurnLimits()
+	if writes <= 0 {
+		return false
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pruneLocked(now, settle)
+
+	p, ok := c.paths[event.Path]
+	if !ok {
+		p = &writePattern{}
+		c.paths[event.Path] = p
+	}
+	// Writes within one debounce window are one save, not a pattern
+	switch since := now.Sub(p.lastWrite); {
+	case since < eventDebounce:
+	case since < settle:
+		p.streak++
+	default:
+		p.streak = 1
+	}
+	p.lastWrite = now
+
+	if !p.busy && p.streak < writes {
+		return false
+	}
+	if !p.busy {
+		log.Debug().Str("path", event.Path).Int("writes", p.streak).Msg("File is being written continuously, holding changes until writes stop")
+	}
+	p.busy = true
+
+	if p.held == nil {
+		p.heldSince = now
+	}
+	p.held = event
+
+	delay := settle
+	if remaining := maxDelay - now.Sub(p.heldSince); remaining < delay {
+		delay = max(remaining, 0)
+	}
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	path := event.Path
+	p.timer = time.AfterFunc(delay, func() { c.flush(path) })
+	return true
+}
+
+// flush emits a file's held change
+func (c *churnTracker) flush(path string) {
+	c.mu.Lock()
+	p, ok := c.paths[path]
+	if !ok || p.held == nil {
+		c.mu.Unlock()
+		return
+	}
+	event := *p.held
+	p.held = nil
+	p.timer = nil
+	c.mu.Unlock()
+
+	_ = c.emit(event)
+}
+
+// drop discards a file's held change, when it is deleted or renamed and
+// the held change would only describe a file that is gone
+func (c *churnTracker) drop(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if p, ok := c.paths[path]; ok {
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+		delete(c.paths, path)
+	}
+}
+
+// pruneLocked forgets files that are quiet, at most once a minute. Busy
+// files are remembered for churnMemory, others only while a streak can grow.
+func (c *churnTracker) pruneLocked(now time.Time, settle time.Duration) {
+	if now.Sub(c.lastPrune) < time.Minute {
+		return
+	}
+	c.lastPrune = now
+
+	for path, p := range c.paths {
+		idle := now.Sub(p.lastWrite)
+		if p.held == nil && (idle > churnMemory || (!p.busy && idle > settle)) {
+			delete(c.paths, path)
+		}
+	}
+}
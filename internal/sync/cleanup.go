@@ -0,0 +1,193 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/rs/zerolog/log"
+)
+
+// Ways to clean up files that synced before ignore rules excluded them
+const (
+	CleanupUntrack = "untrack" // Stop tracking them; peers keep their copies
+	CleanupDelete  = "delete"  // Delete peers' synced copies; the copies here stay
+)
+
+// ignoreCheckInterval is how often the config file is checked for edited
+// ignore rules, and the ignore command's cleanups are picked up
+const ignoreCheckInterval = 5 * time.Second
+
+// IgnoreCleanup is a cleanup of newly ignored files, queued by the ignore
+// command for the daemon
+type IgnoreCleanup struct {
+	FolderPath  string    `json:"folder_path"`
+	Action      string    `json:"action"` // untrack | delete
+	Paths       []string  `json:"paths"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+// ignoreCleanupPath is where the ignore command queues a cleanup
+func ignoreCleanupPath() string {
+	return filepath.Join(config.ConfigDir(), "ignore-cleanup.json")
+}
+
+// QueueIgnoreCleanup hands a cleanup to the running daemon
+func QueueIgnoreCleanup(cleanup *IgnoreCleanup) error {
+	if cleanup.Action != CleanupUntrack && cleanup.Action != CleanupDelete {
+		return fmt.Errorf("invalid cleanup %q (use %s or %s)", cleanup.Action, CleanupUntrack, CleanupDelete)
+	}
+
+	data, err := json.MarshalIndent(cleanup, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal cleanup: %w", err)
+	}
+	if err := os.WriteFile(ignoreCleanupPath(), data, 0644); err != nil {
+		return fmt.Errorf("failed to write cleanup: %w", err)
+	}
+	return nil
+}
+
+// NewlyIgnored returns the files in a folder's saved state that the ignore
+// rules now exclude: files that synced before a rule matching them was added,
+// and whose copies on peers are left alone until they are cleaned up
+func NewlyIgnored(cfg *config.Config, ignores *IgnoreRules, state *StateStore, folderPath string) []string {
+	var paths []string
+	for relPath := range state.GetAllFiles(folderPath) {
+		if cfg.ShouldIgnore(filepath.Join(folderPath, relPath)) || ignores.Ignored(folderPath, relPath) {
+			paths = append(paths, relPath)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// ignoreLoop picks up ignore rules and sparse selections edited in the config
+// file and folders removed from it, and cleanups queued with the ignore
+// command
+func (e *Engine) ignoreLoop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(ignoreCheckInterval)
+	defer ticker.Stop()
+
+	modTime := configModTime()
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			if current := configModTime(); !current.Equal(modTime) {
+				modTime = current
+				e.reloadIgnores()
+				e.reloadRemovedFolders()
+				e.reloadSelections()
+			}
+
+			data, err := os.ReadFile(ignoreCleanupPath())
+			if err != nil {
+				continue
+			}
+			_ = os.Remove(ignoreCleanupPath())
+
+			var cleanup IgnoreCleanup
+			if err := json.Unmarshal(data, &cleanup); err != nil {
+				log.Warn().Err(err).Msg("Failed to parse ignore cleanup")
+				continue
+			}
+			e.cleanUpIgnored(&cleanup)
+		}
+	}
+}
+
+func configModTime() time.Time {
+	info, err := os.Stat(config.ConfigFile())
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reloadIgnores applies ignore rules edited in the config file without a
+// restart. Files no longer ignored are found by a rescan and sent.
+func (e *Engine) reloadIgnores() {
+	changed, err := e.cfg.ReloadIgnores()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to reload ignore rules")
+		return
+	}
+	if !changed {
+		return
+	}
+
+	log.Info().Msg("Ignore rules changed in the config file, rescanning folders")
+	for _, folder := range e.cfg.Folders {
+		if !folder.Enabled {
+			continue
+		}
+		e.rescanFolder(folder.Path)
+		e.reportNewlyIgnored(folder.Path)
+	}
+}
+
+// reportNewlyIgnored tells the user about synced files the ignore rules now
+// exclude, which stay on peers until they are cleaned up
+func (e *Engine) reportNewlyIgnored(folderPath string) {
+	paths := NewlyIgnored(e.cfg, e.ignores, e.state, folderPath)
+	if len(paths) == 0 {
+		return
+	}
+
+	log.Info().
+		Str("folder_id", folderPath).
+		Int("files", len(paths)).
+		Msg("Synced files are now ignored, their copies stay on peers")
+	e.publishError(fmt.Errorf("%d synced file(s) in %s are now ignored but stay on peers: run 'mac-profile-sync ignore %s --cleanup' to clean them up",
+		len(paths), folderPath, folderPath))
+}
+
+// cleanUpIgnored stops tracking files a cleanup names, and deletes peers'
+// synced copies if asked. Files that aren't ignored any more are skipped.
+func (e *Engine) cleanUpIgnored(cleanup *IgnoreCleanup) {
+	if e.cfg.GetFolder(cleanup.FolderPath) == nil || !e.propagationAllowed("clean up ignored files", cleanup.FolderPath) {
+		return
+	}
+
+	ignored := make(map[string]bool)
+	for _, relPath := range NewlyIgnored(e.cfg, e.ignores, e.state, cleanup.FolderPath) {
+		ignored[relPath] = true
+	}
+
+	deletes := cleanup.Action == CleanupDelete && e.cfg.CanSend()
+	done := 0
+	for _, relPath := range cleanup.Paths {
+		if !ignored[relPath] {
+			continue
+		}
+		if deletes {
+			e.broadcastPayload(network.MsgFileDelete, network.FileDeleteMessage{
+				FolderPath: cleanup.FolderPath,
+				FolderName: e.folderName(cleanup.FolderPath),
+				RelPath:    relPath,
+				Ignored:    true,
+			})
+		}
+		e.state.RemoveFileState(cleanup.FolderPath, relPath)
+		done++
+	}
+	if err := e.state.Save(); err != nil {
+		log.Warn().Err(err).Msg("Failed to save state")
+	}
+
+	log.Info().
+		Str("folder_id", cleanup.FolderPath).
+		Str("action", cleanup.Action).
+		Int("files", done).
+		Int("skipped", len(cleanup.Paths)-done).
+		Msg("Cleaned up ignored files")
+}
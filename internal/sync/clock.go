@@ -0,0 +1,57 @@
+package sync
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// clockWarnOffset is how far a peer's clock may be off before it is logged
+// as a warning rather than at debug level
+const clockWarnOffset = time.Minute
+
+// peerClocks holds how far each peer's clock is ahead of ours, measured from
+// the timestamp on its hello. The time the hello spent in transit counts as
+// offset too, which on a local network is a few milliseconds.
+type peerClocks struct {
+	mu      sync.Mutex
+	offsets map[string]time.Duration // Peer -> its clock minus ours
+}
+
+func newPeerClocks() *peerClocks {
+	return &peerClocks{offsets: make(map[string]time.Duration)}
+}
+
+// measureClock records a peer's clock offset from when it says it sent a
+// message that just arrived
+func (e *Engine) measureClock(peerName string, sent time.Time) {
+	if peerName == "" || sent.IsZero() {
+		return
+	}
+	offset := sent.Sub(time.Now()).Round(time.Millisecond)
+
+	e.clocks.mu.Lock()
+	e.clocks.offsets[peerName] = offset
+	e.clocks.mu.Unlock()
+
+	event := log.Debug()
+	if offset > clockWarnOffset || offset < -clockWarnOffset {
+		event = log.Warn()
+	}
+	event.Str("peer_id", peerName).Dur("offset", offset).Msg("Measured peer clock offset; newest_wins corrects for it")
+}
+
+// offset returns how far a peer's clock is ahead of ours, or 0 if it hasn't
+// been measured
+func (c *peerClocks) offset(peerName string) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.offsets[peerName]
+}
+
+// localClock converts a time a peer recorded, such as a file's mod time, to
+// our clock
+func (e *Engine) localClock(peerName string, t time.Time) time.Time {
+	return t.Add(-e.clocks.offset(peerName))
+}
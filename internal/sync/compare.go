@@ -0,0 +1,129 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+)
+
+// CompareFolder diffs a synced folder against any local directory, such as an
+// old backup or a copy on an external drive. The synced folder is scanned the
+// way it is for peers; the other directory is held to the same ignore rules
+// and sparse selection. In the result, "local" is the synced folder and
+// "remote" is the other directory.
+func CompareFolder(cfg *config.Config, folderPath, otherDir string) (*ReconcilePreview, error) {
+	if !fileutil.IsDir(otherDir) {
+		return nil, fmt.Errorf("not a directory: %s", otherDir)
+	}
+
+	// Hashes of unchanged files come from the sync state instead of disk
+	state := NewStateStore()
+	if err := state.Load(); err != nil {
+		return nil, fmt.Errorf("failed to load state: %w", err)
+	}
+	ignores := NewIgnoreRules(cfg)
+	known := state.GetAllFiles(folderPath)
+
+	local := make(map[string]os.FileInfo)
+	err := walkFolder(context.Background(), cfg, ignores, folderPath, func(path string, info os.FileInfo, err error) {
+		if err != nil || info.IsDir() {
+			return
+		}
+		if rel, err := filepath.Rel(folderPath, path); err == nil {
+			local[rel] = info
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan folder: %w", err)
+	}
+
+	folderCfg := cfg.GetFolder(folderPath)
+	other := make(map[string]os.FileInfo)
+	err = filepath.Walk(otherDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == otherDir {
+			return nil
+		}
+		rel, err := filepath.Rel(otherDir, path)
+		if err != nil {
+			return nil
+		}
+		if cfg.ShouldIgnore(path) || ignores.Ignored(folderPath, rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if folderCfg != nil && folderCfg.IsSparse() {
+			if info.IsDir() && !folderCfg.IncludesDir(rel) {
+				return filepath.SkipDir
+			}
+			if !folderCfg.IncludesPath(rel) {
+				return nil
+			}
+		}
+		if !info.IsDir() {
+			other[rel] = info
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", otherDir, err)
+	}
+
+	preview := &ReconcilePreview{}
+	for rel, localInfo := range local {
+		otherInfo, ok := other[rel]
+		if !ok {
+			preview.OnlyLocal = append(preview.OnlyLocal, rel)
+			continue
+		}
+		if sameContents(filepath.Join(folderPath, rel), localInfo, known[rel], filepath.Join(otherDir, rel), otherInfo) {
+			continue
+		}
+		if localInfo.ModTime().After(otherInfo.ModTime()) {
+			preview.LocalNewer = append(preview.LocalNewer, rel)
+		} else {
+			preview.RemoteNewer = append(preview.RemoteNewer, rel)
+		}
+	}
+	for rel := range other {
+		if _, ok := local[rel]; !ok {
+			preview.OnlyRemote = append(preview.OnlyRemote, rel)
+		}
+	}
+
+	sort.Strings(preview.OnlyLocal)
+	sort.Strings(preview.OnlyRemote)
+	sort.Strings(preview.LocalNewer)
+	sort.Strings(preview.RemoteNewer)
+	return preview, nil
+}
+
+// sameContents reports whether two files hold the same data. Files of
+// different sizes are never hashed, and a synced file unchanged since it was
+// last synced reuses its recorded hash.
+func sameContents(localPath string, localInfo os.FileInfo, known *FileState, otherPath string, otherInfo os.FileInfo) bool {
+	if localInfo.Size() != otherInfo.Size() {
+		return false
+	}
+
+	var localHash string
+	if known != nil && known.Hash != "" && known.Algorithm() == fileutil.HashAlgorithm &&
+		known.Size == localInfo.Size() && known.ModTime.Equal(localInfo.ModTime()) {
+		localHash = known.Hash
+	} else {
+		hash, err := fileutil.HashFile(localPath)
+		if err != nil {
+			return false
+		}
+		localHash = hash
+	}
+
+	otherHash, err := fileutil.HashFile(otherPath)
+	return err == nil && otherHash == localHash
+}
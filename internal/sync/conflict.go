@@ -1,15 +1,23 @@
 package sync
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/jseidel/mac-profile-sync/internal/config"
 	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
 )
 
+// conflictCheckInterval is how often the daemon publishes its conflicts and
+// picks up decisions made in the TUI
+const conflictCheckInterval = 5 * time.Second
+
 // Conflict represents a sync conflict
 type Conflict struct {
 	ID          string       `json:"id"`
@@ -20,6 +28,8 @@ type Conflict struct {
 	DetectedAt  time.Time    `json:"detected_at"`
 	Resolved    bool         `json:"resolved"`
 	Resolution  string       `json:"resolution"`
+	CaseOf      string       `json:"case_of,omitempty"` // Local file whose name differs only in case
+	Decision    string       `json:"decision,omitempty"` // keep_local | keep_remote | keep_both | skip, set in the TUI
 }
 
 // ConflictFile contains file info for conflict comparison
@@ -27,6 +37,7 @@ type ConflictFile struct {
 	Size       int64     `json:"size"`
 	ModTime    time.Time `json:"mod_time"`
 	Hash       string    `json:"hash"`
+	HashAlgo   string    `json:"hash_algo,omitempty"` // Set for remote files hashed with another algorithm
 	DeviceName string    `json:"device_name"`
 }
 
@@ -44,8 +55,10 @@ const (
 type ConflictDetector struct {
 	cfg        *config.Config
 	state      *StateStore
+	mu         sync.Mutex
 	conflicts  map[string]*Conflict
 	onConflict func(*Conflict)
+	peerClock  func(peer string) time.Duration // How far a peer's clock is ahead of ours
 }
 
 // NewConflictDetector creates a new conflict detector
@@ -62,8 +75,24 @@ func (cd *ConflictDetector) SetCallback(fn func(*Conflict)) {
 	cd.onConflict = fn
 }
 
+// SetClockOffsets sets how to find how far a peer's clock is ahead of ours,
+// so newest_wins compares mod times on one clock
+func (cd *ConflictDetector) SetClockOffsets(fn func(peer string) time.Duration) {
+	cd.peerClock = fn
+}
+
 // DetectConflict checks if there's a conflict between local and remote versions
 func (cd *ConflictDetector) DetectConflict(folderPath, relPath string, remoteFile *ConflictFile) *Conflict {
+	return cd.detect(folderPath, relPath, remoteFile, true)
+}
+
+// DetectUnverifiedConflict treats any difference as a conflict, for when the
+// known state can't be trusted, as after a restore
+func (cd *ConflictDetector) DetectUnverifiedConflict(folderPath, relPath string, remoteFile *ConflictFile) *Conflict {
+	return cd.detect(folderPath, relPath, remoteFile, false)
+}
+
+func (cd *ConflictDetector) detect(folderPath, relPath string, remoteFile *ConflictFile, trustState bool) *Conflict {
 	fullPath := filepath.Join(folderPath, relPath)
 
 	// Check if local file exists
@@ -73,25 +102,29 @@ func (cd *ConflictDetector) DetectConflict(folderPath, relPath string, remoteFil
 		return nil
 	}
 
-	// Get local file hash
-	localHash, err := fileutil.HashFile(fullPath)
+	// Get local file hash, made as the folder's change_detection says
+	algo := folderHashAlgorithm(cd.cfg, folderPath)
+	localHash, err := fileutil.HashFileWith(fullPath, algo)
 	if err != nil {
 		return nil
 	}
 
 	// If hashes match, no conflict
-	if localHash == remoteFile.Hash {
+	if matchesHash(fullPath, localHash, algo, remoteFile.Hash, remoteFile.HashAlgo) {
 		return nil
 	}
 
 	// Get known state
-	knownState := cd.state.GetFileState(folderPath, relPath)
+	var knownState *FileState
+	if trustState {
+		knownState = cd.state.GetFileState(folderPath, relPath)
+	}
 
 	// If we don't have a known state, check if files are identical
 	if knownState == nil {
 		// Files differ and we have no history - conflict
 		conflict := &Conflict{
-			ID:         fmt.Sprintf("%s:%s", folderPath, relPath),
+			ID:         conflictID(folderPath, relPath),
 			FolderPath: folderPath,
 			RelPath:    relPath,
 			LocalFile: &ConflictFile{
@@ -103,22 +136,22 @@ func (cd *ConflictDetector) DetectConflict(folderPath, relPath string, remoteFil
 			DetectedAt: time.Now(),
 		}
 
-		cd.conflicts[conflict.ID] = conflict
-		if cd.onConflict != nil {
-			cd.onConflict(conflict)
-		}
+		cd.add(conflict)
 		return conflict
 	}
 
 	// Compare with known state
-	// If local changed since last sync AND remote is different from what we synced
-	localChanged := localHash != knownState.Hash
-	remoteChanged := remoteFile.Hash != knownState.Hash
+	// If local changed since last sync AND remote is different from what we synced.
+	// A known hash from an older algorithm is checked by rehashing the local
+	// file; a remote hash made with another algorithm can't be checked, so the
+	// remote is assumed to have changed.
+	localChanged := !matchesHash(fullPath, localHash, algo, knownState.Hash, knownState.HashAlgo)
+	remoteChanged := fileutil.HashAlgorithmOf(remoteFile.HashAlgo) != knownState.Algorithm() || remoteFile.Hash != knownState.Hash
 
 	if localChanged && remoteChanged {
 		// Both sides changed - conflict
 		conflict := &Conflict{
-			ID:         fmt.Sprintf("%s:%s", folderPath, relPath),
+			ID:         conflictID(folderPath, relPath),
 			FolderPath: folderPath,
 			RelPath:    relPath,
 			LocalFile: &ConflictFile{
@@ -130,20 +163,41 @@ func (cd *ConflictDetector) DetectConflict(folderPath, relPath string, remoteFil
 			DetectedAt: time.Now(),
 		}
 
-		cd.conflicts[conflict.ID] = conflict
-		if cd.onConflict != nil {
-			cd.onConflict(conflict)
-		}
+		cd.add(conflict)
 		return conflict
 	}
 
 	return nil
 }
 
+// conflictID identifies the conflict over a file
+func conflictID(folderPath, relPath string) string {
+	return fmt.Sprintf("%s:%s", folderPath, relPath)
+}
+
+// add records a new conflict and reports it
+func (cd *ConflictDetector) add(conflict *Conflict) {
+	cd.mu.Lock()
+	cd.conflicts[conflict.ID] = conflict
+	cd.mu.Unlock()
+	if cd.onConflict != nil {
+		cd.onConflict(conflict)
+	}
+}
+
 // ResolveConflict resolves a conflict according to the given resolution
 func (cd *ConflictDetector) ResolveConflict(conflict *Conflict, resolution ConflictResolution) error {
 	fullPath := filepath.Join(conflict.FolderPath, conflict.RelPath)
 
+	// A case-insensitive folder can't hold both names, so the local file is
+	// renamed out of the way for the remote one to arrive with the next list
+	if conflict.CaseOf != "" {
+		fullPath = filepath.Join(conflict.FolderPath, conflict.CaseOf)
+		if resolution == ResolutionKeepRemote {
+			resolution = ResolutionKeepBoth
+		}
+	}
+
 	switch resolution {
 	case ResolutionKeepLocal:
 		// Nothing to do, local file stays
@@ -166,8 +220,20 @@ func (cd *ConflictDetector) ResolveConflict(conflict *Conflict, resolution Confl
 		conflict.Resolution = "skipped"
 	}
 
+	// Both sides still differ after these, so remember the decision
+	if resolution == ResolutionKeepLocal || resolution == ResolutionSkip {
+		cd.state.RecordResolution(conflict.FolderPath, conflict.RelPath, &ResolvedConflict{
+			LocalHash:  conflict.LocalFile.Hash,
+			RemoteHash: conflict.RemoteFile.Hash,
+			Resolution: conflict.Resolution,
+			ResolvedAt: time.Now(),
+		})
+	}
+
 	conflict.Resolved = true
+	cd.mu.Lock()
 	delete(cd.conflicts, conflict.ID)
+	cd.mu.Unlock()
 
 	return nil
 }
@@ -178,10 +244,8 @@ func (cd *ConflictDetector) AutoResolve(conflict *Conflict) (ConflictResolution,
 
 	switch strategy {
 	case config.ConflictNewestWins:
-		if conflict.LocalFile.ModTime.After(conflict.RemoteFile.ModTime) {
-			return ResolutionKeepLocal, cd.ResolveConflict(conflict, ResolutionKeepLocal)
-		}
-		return ResolutionKeepRemote, cd.ResolveConflict(conflict, ResolutionKeepRemote)
+		resolution := cd.newestWins(conflict)
+		return resolution, cd.ResolveConflict(conflict, resolution)
 
 	case config.ConflictKeepBoth:
 		return ResolutionKeepBoth, cd.ResolveConflict(conflict, ResolutionKeepBoth)
@@ -195,26 +259,251 @@ func (cd *ConflictDetector) AutoResolve(conflict *Conflict) (ConflictResolution,
 	}
 }
 
-// GetConflicts returns all unresolved conflicts
+// newestWins picks the newer version. The remote mod time is moved to our
+// clock first, by the peer's measured clock offset. Mod times are compared
+// to the second, since not every filesystem keeps finer precision, and
+// versions within clock_skew_tolerance of each other count as a tie. Ties
+// are broken the same way on both peers so they converge instead of
+// swapping versions.
+func (cd *ConflictDetector) newestWins(conflict *Conflict) ConflictResolution {
+	remoteModTime := conflict.RemoteFile.ModTime
+	if cd.peerClock != nil {
+		remoteModTime = remoteModTime.Add(-cd.peerClock(conflict.RemoteFile.DeviceName))
+	}
+	local := conflict.LocalFile.ModTime.Truncate(time.Second)
+	remote := remoteModTime.Truncate(time.Second)
+	tolerance := cd.cfg.GetClockSkewTolerance()
+
+	switch {
+	case local.Sub(remote) > tolerance:
+		return ResolutionKeepLocal
+	case remote.Sub(local) > tolerance:
+		return ResolutionKeepRemote
+	case cd.localWinsTie(conflict):
+		return ResolutionKeepLocal
+	default:
+		return ResolutionKeepRemote
+	}
+}
+
+// localWinsTie breaks a mod time tie by device priority when configured,
+// otherwise (or when neither device is ranked) by hash order
+func (cd *ConflictDetector) localWinsTie(conflict *Conflict) bool {
+	if cd.cfg.GetTieBreak() == config.TieBreakDevice {
+		localRank := cd.cfg.DeviceRank(cd.cfg.Device.Name)
+		remoteRank := cd.cfg.DeviceRank(conflict.RemoteFile.DeviceName)
+		if localRank != remoteRank {
+			return localRank < remoteRank
+		}
+	}
+	return conflict.LocalFile.Hash > conflict.RemoteFile.Hash
+}
+
+// AutoResolveUnverified resolves a conflict found during re-verification.
+// Mod times can't be trusted then, so newest_wins keeps both versions instead.
+func (cd *ConflictDetector) AutoResolveUnverified(conflict *Conflict) (ConflictResolution, error) {
+	if cd.cfg.GetConflictStrategy() == config.ConflictNewestWins {
+		return ResolutionKeepBoth, cd.ResolveConflict(conflict, ResolutionKeepBoth)
+	}
+	return cd.AutoResolve(conflict)
+}
+
+// IsSuppressed reports whether a conflict between these versions was already
+// resolved and should not be raised again until either side changes
+func (cd *ConflictDetector) IsSuppressed(folderPath, relPath, localHash, remoteHash string) bool {
+	return cd.state.IsResolved(folderPath, relPath, localHash, remoteHash)
+}
+
+// GetConflicts returns all unresolved conflicts, oldest first
 func (cd *ConflictDetector) GetConflicts() []*Conflict {
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
 	conflicts := make([]*Conflict, 0, len(cd.conflicts))
 	for _, c := range cd.conflicts {
 		conflicts = append(conflicts, c)
 	}
+	sortConflicts(conflicts)
 	return conflicts
 }
 
+// sortConflicts orders conflicts by when they were detected, then by ID
+func sortConflicts(conflicts []*Conflict) {
+	sort.Slice(conflicts, func(i, j int) bool {
+		if !conflicts[i].DetectedAt.Equal(conflicts[j].DetectedAt) {
+			return conflicts[i].DetectedAt.Before(conflicts[j].DetectedAt)
+		}
+		return conflicts[i].ID < conflicts[j].ID
+	})
+}
+
 // GetConflict returns a specific conflict by ID
 func (cd *ConflictDetector) GetConflict(id string) *Conflict {
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
 	return cd.conflicts[id]
 }
 
+// Pending reports whether a file has a conflict waiting to be resolved
+func (cd *ConflictDetector) Pending(folderPath, relPath string) bool {
+	return cd.GetConflict(conflictID(folderPath, relPath)) != nil
+}
+
 // HasConflicts returns true if there are unresolved conflicts
 func (cd *ConflictDetector) HasConflicts() bool {
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
 	return len(cd.conflicts) > 0
 }
 
 // ClearConflicts removes all conflicts
 func (cd *ConflictDetector) ClearConflicts() {
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
 	cd.conflicts = make(map[string]*Conflict)
 }
+
+// conflictsPath is where the daemon's unresolved conflicts are saved for the
+// TUI
+func conflictsPath() string {
+	return filepath.Join(config.ConfigDir(), "conflicts.json")
+}
+
+// LoadConflicts reads the running daemon's unresolved conflicts, oldest first
+func LoadConflicts() ([]*Conflict, error) {
+	data, err := os.ReadFile(conflictsPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read conflicts: %w", err)
+	}
+
+	var list []*Conflict
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse conflicts: %w", err)
+	}
+	sortConflicts(list)
+	return list, nil
+}
+
+// saveConflicts writes the unresolved conflicts, removing the file once
+// there are none
+func saveConflicts(list []*Conflict) error {
+	if len(list) == 0 {
+		if err := os.Remove(conflictsPath()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove conflicts: %w", err)
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(conflictsPath()), 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal conflicts: %w", err)
+	}
+	if err := os.WriteFile(conflictsPath(), data, 0644); err != nil {
+		return fmt.Errorf("failed to write conflicts: %w", err)
+	}
+	return nil
+}
+
+// DecideConflict records how a conflict is resolved. The running daemon
+// applies the decision.
+func DecideConflict(id string, resolution ConflictResolution) error {
+	switch resolution {
+	case ResolutionKeepLocal, ResolutionKeepRemote, ResolutionKeepBoth, ResolutionSkip:
+	default:
+		return fmt.Errorf("invalid resolution %q", resolution)
+	}
+
+	list, err := LoadConflicts()
+	if err != nil {
+		return err
+	}
+	for _, c := range list {
+		if c.ID == id {
+			c.Decision = string(resolution)
+			return saveConflicts(list)
+		}
+	}
+	return fmt.Errorf("conflict not found: %s", id)
+}
+
+// conflictLoop publishes the unresolved conflicts for the TUI and applies
+// the decisions made there. Conflicts are only kept in memory, so none are
+// left published once the engine stops.
+func (e *Engine) conflictLoop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(conflictCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			if err := saveConflicts(nil); err != nil {
+				log.Warn().Err(err).Msg("Failed to save conflicts")
+			}
+			return
+		case <-ticker.C:
+			e.syncConflicts()
+		}
+	}
+}
+
+// syncConflicts applies the decisions in the saved conflicts, and saves the
+// conflicts again once they changed
+func (e *Engine) syncConflicts() {
+	saved, err := LoadConflicts()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to load conflicts")
+		return
+	}
+
+	applied := make(map[string]bool)
+	for _, c := range saved {
+		if c.Decision == "" {
+			continue
+		}
+		applied[c.ID] = true
+		if err := e.ResolveConflict(c.ID, ConflictResolution(c.Decision)); err != nil {
+			log.Warn().Err(err).Str("file", c.RelPath).Str("folder_id", c.FolderPath).Msg("Failed to resolve conflict")
+			e.publishError(fmt.Errorf("%s: %w", c.RelPath, err))
+			continue
+		}
+		log.Info().Str("file", c.RelPath).Str("folder_id", c.FolderPath).Str("resolution", c.Decision).Msg("Conflict resolved")
+	}
+
+	current := e.GetConflicts()
+	changed := len(applied) > 0 || len(current) != len(saved)
+	for i := 0; !changed && i < len(current); i++ {
+		changed = current[i].ID != saved[i].ID
+	}
+	if changed {
+		e.saveConflicts(current, applied)
+	}
+}
+
+// saveConflicts writes the unresolved conflicts, keeping decisions made
+// since they were last read, but not the ones just applied
+func (e *Engine) saveConflicts(current []*Conflict, applied map[string]bool) {
+	decisions := make(map[string]string)
+	saved, _ := LoadConflicts()
+	for _, c := range saved {
+		if !applied[c.ID] {
+			decisions[c.ID] = c.Decision
+		}
+	}
+
+	list := make([]*Conflict, 0, len(current))
+	for _, c := range current {
+		copied := *c
+		copied.Decision = decisions[c.ID]
+		list = append(list, &copied)
+	}
+	if err := saveConflicts(list); err != nil {
+		log.Warn().Err(err).Msg("Failed to save conflicts")
+	}
+}
@@ -0,0 +1,63 @@
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+)
+
+func TestNewestWins(t *testing.T) {
+	base := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		tieBreak  string
+		priority  []string
+		tolerance int           // Seconds
+		offset    time.Duration // How far the peer's clock is ahead of ours
+		local     time.Time
+		remote    time.Time // On the peer's clock
+		localHash string
+		want      ConflictResolution
+	}{
+		{name: "local newer", local: base.Add(10 * time.Second), remote: base, localHash: "a", want: ResolutionKeepLocal},
+		{name: "remote newer", local: base, remote: base.Add(10 * time.Second), localHash: "z", want: ResolutionKeepRemote},
+		{name: "same second", local: base.Add(900 * time.Millisecond), remote: base.Add(100 * time.Millisecond), localHash: "z", want: ResolutionKeepLocal},
+		{name: "tie to higher local hash", local: base, remote: base, localHash: "z", want: ResolutionKeepLocal},
+		{name: "tie to higher remote hash", local: base, remote: base, localHash: "a", want: ResolutionKeepRemote},
+		{name: "within tolerance is a tie", tolerance: 2, local: base, remote: base.Add(2 * time.Second), localHash: "z", want: ResolutionKeepLocal},
+		{name: "beyond tolerance", tolerance: 2, local: base, remote: base.Add(3 * time.Second), localHash: "z", want: ResolutionKeepRemote},
+		{name: "tie to device priority", tieBreak: "device", priority: []string{"Local", "Remote"}, local: base, remote: base, localHash: "a", want: ResolutionKeepLocal},
+		{name: "tie to peer's priority", tieBreak: "device", priority: []string{"Remote", "Local"}, local: base, remote: base, localHash: "z", want: ResolutionKeepRemote},
+		{name: "unranked devices tie to hash", tieBreak: "device", priority: []string{"Other"}, local: base, remote: base, localHash: "a", want: ResolutionKeepRemote},
+		{name: "peer clock ahead makes remote older", offset: time.Hour, local: base, remote: base.Add(30 * time.Minute), localHash: "a", want: ResolutionKeepLocal},
+		{name: "peer clock ahead, remote still newer", offset: time.Hour, local: base, remote: base.Add(time.Hour + 10*time.Second), localHash: "z", want: ResolutionKeepRemote},
+		{name: "peer clock behind makes remote newer", offset: -time.Hour, local: base, remote: base.Add(-30 * time.Minute), localHash: "z", want: ResolutionKeepRemote},
+		{name: "skew corrected to a tie", offset: time.Hour, tolerance: 2, local: base, remote: base.Add(time.Hour + time.Second), localHash: "z", want: ResolutionKeepLocal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Device.Name = "Local"
+			cfg.Sync.TieBreak = tt.tieBreak
+			cfg.Sync.DevicePriority = tt.priority
+			cfg.Sync.ClockSkewTolerance = tt.tolerance
+
+			cd := &ConflictDetector{cfg: cfg, peerClock: func(peer string) time.Duration {
+				if peer != "Remote" {
+					t.Errorf("clock offset asked for %q", peer)
+				}
+				return tt.offset
+			}}
+			conflict := &Conflict{
+				LocalFile:  &ConflictFile{ModTime: tt.local, Hash: tt.localHash},
+				RemoteFile: &ConflictFile{ModTime: tt.remote, Hash: "m", DeviceName: "Remote"},
+			}
+			if got := cd.newestWins(conflict); got != tt.want {
+				t.Errorf("newestWins = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
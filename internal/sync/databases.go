@@ -0,0 +1,213 @@
+package sync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// sqliteHeader starts every SQLite database file
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// databaseCompanions are the files SQLite keeps next to a database. They only
+// make sense together with the database, so they are never synced on their
+// own: the database is synced alone once they hold no pending changes.
+var databaseCompanions = []string{"-wal", "-shm", "-journal"}
+
+// databaseOf returns the database a companion file belongs to, or "" if
+// relPath isn't one
+func databaseOf(relPath string) string {
+	for _, suffix := range databaseCompanions {
+		if db, ok := strings.CutSuffix(relPath, suffix); ok && filepath.Base(relPath) != suffix {
+			return db
+		}
+	}
+	return ""
+}
+
+// isDatabase reports whether a file starts with the SQLite header
+func isDatabase(fullPath string) bool {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = f.Close() }()
+
+	header := make([]byte, len(sqliteHeader))
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false
+	}
+	return bytes.Equal(header, sqliteHeader)
+}
+
+// companionSize returns the size of a database's companion file, or -1 if it
+// doesn't exist
+func companionSize(fullPath, suffix string) int64 {
+	info, err := os.Lstat(fullPath + suffix)
+	if err != nil {
+		return -1
+	}
+	return info.Size()
+}
+
+// databasePending returns why a database can't be sent as it is on disk: its
+// write-ahead log holds changes not yet checkpointed into it, or a
+// transaction is half written. It returns "" for a consistent database.
+func databasePending(fullPath string) string {
+	if companionSize(fullPath, "-wal") > 0 {
+		return "has changes in its write-ahead log that aren't checkpointed yet"
+	}
+	if companionSize(fullPath, "-journal") > 0 {
+		return "is in the middle of a transaction"
+	}
+	return ""
+}
+
+// databaseOpen returns why a database can't be replaced here: an app has it
+// open in WAL mode, or is in the middle of a transaction. It returns "" if
+// it is safe to replace.
+func databaseOpen(fullPath string) string {
+	if companionSize(fullPath, "-wal") >= 0 {
+		return "is open in an app here"
+	}
+	if companionSize(fullPath, "-journal") > 0 {
+		return "is in the middle of a transaction here"
+	}
+	return ""
+}
+
+// databaseGroups holds databases back until they and their companion files
+// have stopped changing and are consistent
+type databaseGroups struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer // Full path -> pending recheck once quiet
+	held   map[string]string      // Full path -> reason last warned about
+}
+
+func newDatabaseGroups() *databaseGroups {
+	return &databaseGroups{
+		timers: make(map[string]*time.Timer),
+		held:   make(map[string]string),
+	}
+}
+
+// recheck runs fn after delay, replacing any recheck already pending for path
+func (g *databaseGroups) recheck(path string, delay time.Duration, fn func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if t, ok := g.timers[path]; ok {
+		t.Stop()
+	}
+	g.timers[path] = time.AfterFunc(delay, func() {
+		g.mu.Lock()
+		delete(g.timers, path)
+		g.mu.Unlock()
+		fn()
+	})
+}
+
+// hold records why a database is held, reporting whether that's news
+func (g *databaseGroups) hold(path, reason string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.held[path] == reason {
+		return false
+	}
+	g.held[path] = reason
+	return true
+}
+
+// release forgets a database that is no longer held
+func (g *databaseGroups) release(path string) {
+	g.mu.Lock()
+	delete(g.held, path)
+	g.mu.Unlock()
+}
+
+// lastChange returns when a database or any of its companions last changed
+func lastChange(fullPath string) time.Time {
+	var last time.Time
+	for _, suffix := range append([]string{""}, databaseCompanions...) {
+		if info, err := os.Lstat(fullPath + suffix); err == nil && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last
+}
+
+// holdDatabase reports whether a changed file is a database that must not be
+// sent yet. It is sent once it and its companions have been quiet for
+// sync.database_settle and its write-ahead log is checkpointed; until then a
+// recheck is scheduled, or the next change to its log triggers one.
+func (e *Engine) holdDatabase(event FileEvent) bool {
+	if !e.cfg.Sync.ProtectDatabases || !isDatabase(event.Path) {
+		return false
+	}
+
+	if quiet := time.Since(lastChange(event.Path)); quiet < e.cfg.GetDatabaseSettle() {
+		recheck := event
+		recheck.Type = EventModify
+		e.databases.recheck(event.Path, e.cfg.GetDatabaseSettle()-quiet, func() {
+			if e.ctx.Err() == nil {
+				e.queueFileEvent(recheck)
+			}
+		})
+		return true
+	}
+
+	return e.databaseHeld(event.FolderPath, event.RelPath)
+}
+
+// databaseHeld reports whether a database's pending changes keep it from
+// being listed or sent, warning once each time it becomes held
+func (e *Engine) databaseHeld(folderPath, relPath string) bool {
+	if !e.cfg.Sync.ProtectDatabases {
+		return false
+	}
+
+	// Companions are checked first, so most files are never opened
+	fullPath := filepath.Join(folderPath, relPath)
+	reason := databasePending(fullPath)
+	if reason == "" || !isDatabase(fullPath) {
+		e.databases.release(fullPath)
+		return false
+	}
+	if e.databases.hold(fullPath, reason) {
+		log.Warn().
+			Str("folder_id", folderPath).
+			Str("file", relPath).
+			Str("reason", reason).
+			Msg("Holding SQLite database until it is consistent")
+		e.publishError(fmt.Errorf("%s %s; it syncs once the app using it checkpoints or closes it", fullPath, reason))
+	}
+	return true
+}
+
+// databaseBusy reports whether received file data is a database that can't
+// replace the local copy because it is in use here
+func (e *Engine) databaseBusy(folderPath, relPath string, data []byte, peerName string) bool {
+	if !e.cfg.Sync.ProtectDatabases || !bytes.HasPrefix(data, sqliteHeader) {
+		return false
+	}
+
+	reason := databaseOpen(filepath.Join(folderPath, relPath))
+	if reason == "" {
+		return false
+	}
+	log.Warn().
+		Str("folder_id", folderPath).
+		Str("file", relPath).
+		Str("peer_id", peerName).
+		Str("reason", reason).
+		Msg("Not replacing SQLite database in use, will retry with the next file list")
+	return true
+}
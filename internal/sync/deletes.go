@@ -0,0 +1,128 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+)
+
+// errDirNotEmpty is returned for a deleted directory that still holds files here
+var errDirNotEmpty = errors.New("directory still holds files")
+
+// deletedPaths returns what to tell peers about a local delete: each file
+// tracked under a deleted directory, then the path itself. Peers can't remove
+// a directory that still holds files, so the files go first.
+func (e *Engine) deletedPaths(folderPath, relPath string) []string {
+	var paths []string
+	for sub := range e.statesUnder(folderPath, relPath) {
+		if sub != "" {
+			paths = append(paths, filepath.Join(relPath, sub))
+		}
+	}
+	sort.Strings(paths)
+	return append(paths, relPath)
+}
+
+// removeDeleted removes a path a peer deleted, or that stopped syncing here,
+// the way sync.deletes says. A directory is only removed once nothing but empty directories is left in it,
+// so files the peer never had, or that arrived here since, are kept.
+func (e *Engine) removeDeleted(folderPath, relPath string) error {
+	fullPath := filepath.Join(folderPath, relPath)
+
+	info, err := os.Lstat(fullPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat: %w", err)
+	}
+	if !info.IsDir() {
+		return e.discard(folderPath, relPath)
+	}
+
+	var dirs []string
+	err = filepath.WalkDir(fullPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && d.Name() != ".DS_Store" {
+			return errDirNotEmpty
+		}
+		if d.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Deepest first, so each directory is empty by the time it is removed
+	sort.Slice(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i], string(filepath.Separator)) > strings.Count(dirs[j], string(filepath.Separator))
+	})
+	for _, dir := range dirs {
+		_ = os.Remove(filepath.Join(dir, ".DS_Store"))
+		if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// discard gets a deleted file out of the way: into the Trash, the folder's
+// archive, or gone for good
+func (e *Engine) discard(folderPath, relPath string) error {
+	fullPath := filepath.Join(folderPath, relPath)
+
+	switch e.cfg.GetDeleteMode() {
+	case config.DeletePermanent:
+		if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+
+	case config.DeleteArchive:
+		dest := filepath.Join(folderPath, config.ArchiveDirName, time.Now().Format("20060102-150405"), relPath)
+		if err := placeStaged(fullPath, uniquePath(dest)); err != nil {
+			return fmt.Errorf("failed to archive: %w", err)
+		}
+		return nil
+
+	default:
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("failed to find the Trash: %w", err)
+		}
+		dest := filepath.Join(home, ".Trash", filepath.Base(relPath))
+		if err := placeStaged(fullPath, uniquePath(dest)); err != nil {
+			return fmt.Errorf("failed to move to the Trash: %w", err)
+		}
+		return nil
+	}
+}
+
+// uniquePath returns path, or if something is already there, path with the
+// time added to its name the way the Trash does it
+func uniquePath(path string) string {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return path
+	}
+
+	ext := filepath.Ext(path)
+	name := strings.TrimSuffix(path, ext) + " " + time.Now().Format("15.04.05")
+	path = name + ext
+	for n := 2; ; n++ {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			return path
+		}
+		path = fmt.Sprintf("%s %d%s", name, n, ext)
+	}
+}
@@ -0,0 +1,183 @@
+package sync
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+)
+
+func TestRemoveDeleted(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		files   []string // Created under the folder; a trailing "/" makes a directory
+		relPath string
+		wantErr error
+		gone    []string
+		kept    []string
+	}{
+		{
+			name:    "file",
+			mode:    "permanent",
+			files:   []string{"a.txt"},
+			relPath: "a.txt",
+			gone:    []string{"a.txt"},
+		},
+		{
+			name:    "already gone",
+			mode:    "permanent",
+			relPath: "missing.txt",
+		},
+		{
+			name:    "empty directories",
+			mode:    "permanent",
+			files:   []string{"dir/sub/deeper/", "dir/.DS_Store", "dir/sub/.DS_Store"},
+			relPath: "dir",
+			gone:    []string{"dir"},
+		},
+		{
+			name:    "directory still holding a file",
+			mode:    "permanent",
+			files:   []string{"dir/sub/", "dir/sub/new.txt"},
+			relPath: "dir",
+			wantErr: errDirNotEmpty,
+			kept:    []string{"dir/sub/new.txt"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			folder := t.TempDir()
+			for _, name := range tt.files {
+				path := filepath.Join(folder, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if name[len(name)-1] == '/' {
+					continue
+				}
+				if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			cfg := &config.Config{}
+			cfg.Sync.Deletes = tt.mode
+			e := &Engine{cfg: cfg}
+
+			err := e.removeDeleted(folder, tt.relPath)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("removeDeleted = %v, want %v", err, tt.wantErr)
+			}
+			for _, name := range tt.gone {
+				if _, err := os.Lstat(filepath.Join(folder, name)); !os.IsNotExist(err) {
+					t.Errorf("%s still exists", name)
+				}
+			}
+			for _, name := range tt.kept {
+				if _, err := os.Lstat(filepath.Join(folder, name)); err != nil {
+					t.Errorf("%s was removed", name)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoveDeletedArchives(t *testing.T) {
+	folder := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(folder, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(folder, "docs", "a.txt"), []byte("kept"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{}
+	cfg.Sync.Deletes = "archive"
+	e := &Engine{cfg: cfg}
+	if err := e.removeDeleted(folder, filepath.Join("docs", "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	archived, err := filepath.Glob(filepath.Join(folder, config.ArchiveDirName, "*", "docs", "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archived) != 1 {
+		t.Fatalf("archived copies = %v, want one", archived)
+	}
+	if data, err := os.ReadFile(archived[0]); err != nil || string(data) != "kept" {
+		t.Errorf("archived copy = %q, %v", data, err)
+	}
+}
+
+// Files removed because a peer is authoritative, or because their subfolder
+// was deselected, go where sync.deletes says like any other delete
+func TestRemovalsFollowDeletePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		relPath string
+		remove  func(e *Engine, folder string)
+	}{
+		{
+			name:    "mirroring an authoritative peer",
+			relPath: "a.txt",
+			remove: func(e *Engine, folder string) {
+				e.mirrorRemote(folder, network.FileListMessage{FolderPath: "/Users/peer/Documents", FolderName: "Documents"}, "", "iMac", nil)
+			},
+		},
+		{
+			name:    "pruning a deselected subfolder",
+			relPath: filepath.Join("Old", "a.txt"),
+			remove: func(e *Engine, folder string) {
+				e.pruneDeselected(folder)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			folder := t.TempDir()
+			fullPath := filepath.Join(folder, tt.relPath)
+			if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(fullPath, []byte("synced"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := &config.Config{Folders: []config.FolderConfig{{Path: folder, Enabled: true, Subfolders: []string{"Work"}}}}
+			cfg.Sync.Deletes = "archive"
+			e, err := NewEngine(cfg, network.NewServer(0, nil), network.NewClient(nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer e.cancel()
+
+			hash, err := fileutil.HashFileWith(fullPath, fileutil.HashAlgorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.state.InitFolder(folder)
+			e.state.UpdateFileState(folder, &FileState{RelPath: filepath.ToSlash(tt.relPath), Hash: hash, HashAlgo: fileutil.HashAlgorithm, Size: 6})
+
+			tt.remove(e, folder)
+
+			if _, err := os.Lstat(fullPath); !os.IsNotExist(err) {
+				t.Fatalf("%s still exists", tt.relPath)
+			}
+			archived, _ := filepath.Glob(filepath.Join(folder, config.ArchiveDirName, "*", tt.relPath))
+			if len(archived) != 1 {
+				t.Errorf("archived copies = %v, want one", archived)
+			}
+			if e.state.GetFileState(folder, filepath.ToSlash(tt.relPath)) != nil {
+				t.Errorf("%s is still tracked", tt.relPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,384 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/logging"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/rs/zerolog/log"
+)
+
+// Delivery retry limits
+const (
+	maxPendingDeliveries = 256              // Unacknowledged sends tracked across all peers
+	maxDeliveryAttempts  = 3                // Sends per file before giving up
+	deliveryRetryDelay   = 10 * time.Second // Multiplied by the attempt number
+	deliveryAckTimeout   = 2 * time.Minute  // Peers that never ack (older versions) are forgotten
+)
+
+// delivery is file data sent to a peer that has not been acknowledged yet
+type delivery struct {
+	key        string
+	peerID     string
+	folderPath string
+	relPath    string
+	hash       string
+	size       int64
+	send       func(*network.Message) error
+	attempts   int
+	sentAt     time.Time
+	retryAt    time.Time // Set once the peer nacks; zero while awaiting an ack
+}
+
+// deliveryTracker remembers unacknowledged file data per peer and schedules
+// bounded retries when a peer reports it could not write a file. It also
+// holds each peer's receive window, since what is unacknowledged is what
+// counts against it.
+type deliveryTracker struct {
+	mu      sync.Mutex
+	pending map[string]*delivery
+	windows map[string]network.WindowMessage // peerID -> window it advertised
+	freed   chan struct{}                    // Closed when deliveries finish, waking paused senders
+}
+
+func newDeliveryTracker() *deliveryTracker {
+	return &deliveryTracker{
+		pending: make(map[string]*delivery),
+		windows: make(map[string]network.WindowMessage),
+		freed:   make(chan struct{}),
+	}
+}
+
+// freeLocked wakes senders waiting for room in a peer's window
+func (t *deliveryTracker) freeLocked() {
+	close(t.freed)
+	t.freed = make(chan struct{})
+}
+
+func deliveryKey(peerID, folderName, relPath string) string {
+	return peerID + "\x00" + transferKey(folderName, relPath)
+}
+
+// track records file data sent to a peer. attempt is 1 for a fresh send.
+func (t *deliveryTracker) track(peerID string, send func(*network.Message) error, msg network.FileDataMessage, attempt int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := deliveryKey(peerID, msg.FolderName, msg.RelPath)
+	if _, ok := t.pending[key]; !ok && len(t.pending) >= maxPendingDeliveries {
+		t.evictOldestLocked()
+	}
+
+	t.pending[key] = &delivery{
+		key:        key,
+		peerID:     peerID,
+		folderPath: msg.FolderPath,
+		relPath:    msg.RelPath,
+		hash:       msg.Hash,
+		size:       msg.Size,
+		send:       send,
+		attempts:   attempt,
+		sentAt:     time.Now(),
+	}
+}
+
+func (t *deliveryTracker) evictOldestLocked() {
+	var oldest *delivery
+	for _, d := range t.pending {
+		if oldest == nil || d.sentAt.Before(oldest.sentAt) {
+			oldest = d
+		}
+	}
+	if oldest != nil {
+		log.Warn().Str("remote", oldest.peerID).Str("file", oldest.relPath).Msg("Delivery queue full, no longer tracking oldest send")
+		delete(t.pending, oldest.key)
+		t.freeLocked()
+	}
+}
+
+// ack applies a peer's ack or nack. It returns the delivery it matched and
+// whether a retry was scheduled; acks for an older version are ignored, and
+// files the peer refused aren't retried.
+func (t *deliveryTracker) ack(peerID string, ack network.FileAckMessage) (*delivery, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := deliveryKey(peerID, ack.FolderName, ack.RelPath)
+	d, ok := t.pending[key]
+	if !ok || d.hash != ack.Hash {
+		return nil, false
+	}
+
+	if ack.OK || ack.Rerequested || ack.Code != "" || d.attempts >= maxDeliveryAttempts {
+		delete(t.pending, key)
+		t.freeLocked()
+		return d, false
+	}
+
+	d.retryAt = time.Now().Add(time.Duration(d.attempts) * deliveryRetryDelay)
+	t.freeLocked()
+	return d, true
+}
+
+// due returns deliveries whose retry time has passed, and forgets deliveries
+// that were never acknowledged
+func (t *deliveryTracker) due() []delivery {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var ready []delivery
+	for key, d := range t.pending {
+		switch {
+		case d.retryAt.IsZero():
+			if now.Sub(d.sentAt) > deliveryAckTimeout {
+				delete(t.pending, key)
+				t.freeLocked()
+			}
+		case !now.Before(d.retryAt):
+			d.retryAt = time.Time{}
+			ready = append(ready, *d)
+		}
+	}
+	return ready
+}
+
+func (t *deliveryTracker) remove(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, key)
+	t.freeLocked()
+}
+
+// dropPeer forgets deliveries to a disconnected peer, and its window
+func (t *deliveryTracker) dropPeer(peerID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, d := range t.pending {
+		if d.peerID == peerID {
+			delete(t.pending, key)
+		}
+	}
+	delete(t.windows, peerID)
+	t.freeLocked()
+}
+
+// setWindow records the receive window a peer advertised
+func (t *deliveryTracker) setWindow(peerID string, window network.WindowMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.windows[peerID] = window
+	t.freeLocked()
+}
+
+// hasRoomLocked reports whether size more bytes fit in a peer's window.
+// Peers that advertised no window take everything; a file bigger than the
+// whole window goes once nothing else is outstanding.
+func (t *deliveryTracker) hasRoomLocked(peerID string, size int64) bool {
+	window, ok := t.windows[peerID]
+	if !ok {
+		return true
+	}
+
+	var bytes int64
+	var files int
+	for _, d := range t.pending {
+		// Nacked deliveries awaiting a retry are no longer held by the peer
+		if d.peerID == peerID && d.retryAt.IsZero() {
+			bytes += d.size
+			files++
+		}
+	}
+	if files == 0 {
+		return true
+	}
+	return files < window.Files && bytes+size <= window.Bytes
+}
+
+// waitForRoom blocks until size more bytes fit in a peer's window, the
+// peer disconnects, or done is closed. It reports whether the send may go.
+func (t *deliveryTracker) waitForRoom(done <-chan struct{}, peerID string, size int64) bool {
+	paused := false
+	for {
+		t.mu.Lock()
+		if t.hasRoomLocked(peerID, size) {
+			t.mu.Unlock()
+			if paused {
+				log.Debug().Str("remote", peerID).Msg("Peer's receive window has room again, resuming sends")
+			}
+			return true
+		}
+		freed := t.freed
+		t.mu.Unlock()
+
+		if !paused {
+			log.Debug().Str("remote", peerID).Msg("Peer's receive window is full, pausing sends")
+			paused = true
+		}
+		select {
+		case <-freed:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// pushFileData sends a local change to one peer once its receive window has
+// room. Files a peer requested are sent with sendFileData instead: the peer
+// already limits how many it asks for at once.
+func (e *Engine) pushFileData(peerID string, send func(*network.Message) error, msg network.FileDataMessage) error {
+	if !e.deliveries.waitForRoom(e.ctx.Done(), peerID, msg.Size) {
+		return fmt.Errorf("stopped waiting for room in the peer's receive window")
+	}
+	return e.sendFileData(peerID, send, msg)
+}
+
+// sendWindow advertises this Mac's receive window to a peer
+func (e *Engine) sendWindow(send func(*network.Message) error) {
+	bytes, files := e.cfg.GetReceiveWindow()
+	msg, err := network.NewMessage(network.MsgWindow, network.WindowMessage{Bytes: bytes, Files: files})
+	if err != nil {
+		return
+	}
+	if err := send(msg); err != nil {
+		log.Debug().Err(err).Msg("Failed to send receive window")
+	}
+}
+
+// sendFileData sends file data to one peer and tracks it until acknowledged
+func (e *Engine) sendFileData(peerID string, send func(*network.Message) error, msg network.FileDataMessage) error {
+	dataMsg, err := network.NewFileDataMessage(msg)
+	if err != nil {
+		return err
+	}
+	if err := send(dataMsg); err != nil {
+		return err
+	}
+	e.deliveries.track(peerID, send, msg, 1)
+	log.Debug().
+		Str("file", msg.RelPath).
+		Str("folder_id", msg.FolderPath).
+		Str("peer_id", e.connName(peerID)).
+		Str("transfer_id", logging.TransferID(msg.FolderName, msg.RelPath, msg.Hash)).
+		Msg("Sent file")
+	e.publishProgress(msg.FolderPath, msg.RelPath, peerID, "send", msg.Size, msg.Size)
+	return nil
+}
+
+// ackFileData tells the sender whether its file data was written
+func (e *Engine) ackFileData(fileData network.FileDataMessage, writeErr error, rerequested bool, send func(*network.Message) error) {
+	ack := network.FileAckMessage{
+		FolderName:  fileData.FolderName,
+		RelPath:     fileData.RelPath,
+		Hash:        fileData.Hash,
+		OK:          writeErr == nil,
+		Rerequested: rerequested,
+	}
+	if writeErr != nil {
+		ack.Error = writeErr.Error()
+		ack.Code = network.ErrorCode(writeErr)
+	}
+
+	msg, err := network.NewMessage(network.MsgFileAck, ack)
+	if err != nil {
+		return
+	}
+	if err := send(msg); err != nil {
+		log.Debug().Err(err).Str("file", fileData.RelPath).Msg("Failed to send file ack")
+	}
+}
+
+// handleFileAck clears an acknowledged delivery or schedules a retry
+func (e *Engine) handleFileAck(ack network.FileAckMessage, connID, peerName string) {
+	d, retry := e.deliveries.ack(connID, ack)
+	if d == nil {
+		return
+	}
+	if ack.OK {
+		e.peerDB.recordTransfer(peerName, true, d.size)
+		return
+	}
+	if ack.Rerequested {
+		log.Debug().Str("file", ack.RelPath).Str("peer_id", peerName).Str("transfer_id", logging.TransferID(ack.FolderName, ack.RelPath, ack.Hash)).Str("error", ack.Error).Msg("Peer discarded file and requested it again")
+		return
+	}
+
+	ackErr := ack.Err()
+	if errors.Is(ackErr, ErrIgnored) || errors.Is(ackErr, ErrTooLarge) {
+		log.Info().
+			Str("file", ack.RelPath).
+			Str("folder_id", d.folderPath).
+			Str("peer_id", peerName).
+			Err(ackErr).
+			Msg("Peer declined file")
+		return
+	}
+
+	if retry {
+		log.Warn().
+			Str("file", ack.RelPath).
+			Str("folder_id", d.folderPath).
+			Str("peer_id", peerName).
+			Str("transfer_id", logging.TransferID(ack.FolderName, ack.RelPath, ack.Hash)).
+			Str("error", ack.Error).
+			Int("attempt", d.attempts).
+			Msg("Peer failed to write file, will retry")
+		return
+	}
+
+	log.Error().
+		Str("file", ack.RelPath).
+		Str("folder_id", d.folderPath).
+		Str("peer_id", peerName).
+		Str("transfer_id", logging.TransferID(ack.FolderName, ack.RelPath, ack.Hash)).
+		Str("error", ack.Error).
+		Msg("Peer failed to write file, giving up")
+	e.publishError(fmt.Errorf("%s could not write %s: %w", peerName, ack.RelPath, ackErr))
+}
+
+// deliveryRetryLoop resends file data that peers failed to write
+func (e *Engine) deliveryRetryLoop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			for _, d := range e.deliveries.due() {
+				e.retryDelivery(d)
+			}
+		}
+	}
+}
+
+func (e *Engine) retryDelivery(d delivery) {
+	// Resend the file as it is now; it may have changed since the first send
+	msg, err := e.fileDataMessage(d.folderPath, d.relPath)
+	if err != nil {
+		log.Debug().Err(err).Str("file", d.relPath).Msg("Dropping retry for file that can no longer be read")
+		e.deliveries.remove(d.key)
+		return
+	}
+
+	dataMsg, err := network.NewFileDataMessage(msg)
+	if err != nil {
+		e.deliveries.remove(d.key)
+		return
+	}
+	if err := d.send(dataMsg); err != nil {
+		log.Error().Err(err).Str("peer_id", e.connName(d.peerID)).Str("file", d.relPath).Str("transfer_id", logging.TransferID(msg.FolderName, msg.RelPath, msg.Hash)).Msg("Failed to resend file")
+		e.deliveries.remove(d.key)
+		return
+	}
+
+	e.deliveries.track(d.peerID, d.send, msg, d.attempts+1)
+	log.Info().Str("peer_id", e.connName(d.peerID)).Str("file", d.relPath).Str("transfer_id", logging.TransferID(msg.FolderName, msg.RelPath, msg.Hash)).Int("attempt", d.attempts+1).Msg("Resent file")
+}
@@ -0,0 +1,66 @@
+package sync
+
+import (
+	"os"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+)
+
+// folderHashAlgorithm returns the algorithm a folder's files are hashed with
+// to tell whether they changed, by its change_detection
+func folderHashAlgorithm(cfg *config.Config, folderPath string) string {
+	if folderCfg := cfg.GetFolder(folderPath); folderCfg != nil {
+		return folderCfg.HashAlgorithm()
+	}
+	return fileutil.HashAlgorithm
+}
+
+// hashAlgo returns the algorithm a folder's files are hashed with
+func (e *Engine) hashAlgo(folderPath string) string {
+	return folderHashAlgorithm(e.cfg, folderPath)
+}
+
+// localFileInfo is fileutil.GetFileInfo for a file in a synced folder,
+// hashed with the folder's algorithm
+func (e *Engine) localFileInfo(folderPath, path string) (*fileutil.FileInfo, error) {
+	algo := e.hashAlgo(folderPath)
+	fi, err := fileutil.GetFileInfoWith(path, folderPath, func(os.FileInfo) (string, error) {
+		return fileutil.HashFileWith(path, algo)
+	})
+	if err == nil && fi.Hash != "" {
+		fi.HashAlgo = algo
+	}
+	return fi, err
+}
+
+// contentHash returns the HashAlgorithm hash a hybrid folder's file is sent
+// with, so the receiver can verify it, or "" for other folders
+func (e *Engine) contentHash(folderPath, fullPath string) string {
+	if folderCfg := e.cfg.GetFolder(folderPath); folderCfg == nil || folderCfg.ChangeDetectionMode() != config.DetectHybrid {
+		return ""
+	}
+	hash, err := fileutil.HashFile(fullPath)
+	if err != nil {
+		return ""
+	}
+	return hash
+}
+
+// receivedHash returns the hash to record for a received file, made with its
+// folder's algorithm so later changes to it are compared like any other's.
+// A hybrid peer's content hash saves hashing it again.
+func (e *Engine) receivedHash(localFolderPath, fullPath string, fileData network.FileDataMessage) (string, string) {
+	algo := e.hashAlgo(localFolderPath)
+	switch {
+	case fileutil.HashAlgorithmOf(fileData.HashAlgo) == algo:
+		return fileData.Hash, algo
+	case algo == fileutil.HashAlgorithm && fileData.ContentHash != "":
+		return fileData.ContentHash, algo
+	}
+	if hash, err := fileutil.HashFileWith(fullPath, algo); err == nil {
+		return hash, algo
+	}
+	return fileData.Hash, fileutil.HashAlgorithmOf(fileData.HashAlgo)
+}
@@ -0,0 +1,134 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// dirMessage reads a local directory into a directory message
+func (e *Engine) dirMessage(folderPath, relPath string) (network.DirCreateMessage, error) {
+	fullPath := filepath.Join(folderPath, relPath)
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return network.DirCreateMessage{}, fmt.Errorf("failed to stat directory: %w", err)
+	}
+	if !info.IsDir() {
+		return network.DirCreateMessage{}, fmt.Errorf("not a directory: %s", fullPath)
+	}
+	xattrs, _ := fileutil.ReadXattrs(fullPath)
+
+	return network.DirCreateMessage{
+		FolderPath: folderPath,
+		FolderName: e.folderName(folderPath),
+		RelPath:    relPath,
+		Permission: uint32(info.Mode().Perm()),
+		Xattrs:     xattrs,
+	}, nil
+}
+
+// handleDirChange sends a directory created locally to peers
+func (e *Engine) handleDirChange(event FileEvent) {
+	msg, err := e.dirMessage(event.FolderPath, event.RelPath)
+	if err != nil {
+		log.Error().Err(err).Str("path", event.Path).Msg("Failed to read directory")
+		return
+	}
+	e.state.ClearTombstones(event.FolderPath, event.RelPath)
+	e.broadcastPayload(network.MsgDirCreate, msg)
+}
+
+// handleDirCreate creates a directory sent by a peer, or brings an existing
+// one's permissions and attributes in line with the peer's
+func (e *Engine) handleDirCreate(dir network.DirCreateMessage, peerName string) {
+	if !e.cfg.CanReceive() {
+		log.Debug().Str("dir", dir.RelPath).Msg("Ignoring incoming directory (send_only mode)")
+		return
+	}
+
+	localFolderPath := e.findLocalFolderByName(dir.FolderName)
+	if localFolderPath == "" {
+		return
+	}
+	if e.ignores.Ignored(localFolderPath, dir.RelPath) {
+		return
+	}
+	if folderCfg := e.cfg.GetFolder(localFolderPath); folderCfg != nil && !folderCfg.IncludesDir(dir.RelPath) {
+		return
+	}
+
+	fullPath := filepath.Join(localFolderPath, dir.RelPath)
+
+	// Packages are created whole from the peer's list, with their files
+	if root := e.packageRoot(localFolderPath, dir.RelPath); root != "" && (root != dir.RelPath || !fileutil.Exists(fullPath)) {
+		log.Debug().Str("dir", dir.RelPath).Str("package", root).Msg("Leaving package directory to the package's transfer")
+		return
+	}
+
+	if !e.takeApproved(fullPath, "") && !e.propagationAllowed("create received directory", fullPath) {
+		return
+	}
+
+	if err := e.applyDir(localFolderPath, dir.RelPath, os.FileMode(dir.Permission), dir.Xattrs, peerName, true); err != nil {
+		log.Error().Err(err).Str("path", fullPath).Msg("Failed to create directory")
+		e.folderError(localFolderPath, err)
+	}
+}
+
+// applyDir creates a peer's directory with its permissions. An existing
+// directory is only updated when update is set: file lists are snapshots that
+// may cross in flight, so only an explicit change from a peer overrides ours.
+func (e *Engine) applyDir(localFolderPath, relPath string, perm os.FileMode, xattrs map[string][]byte, peerName string, update bool) error {
+	fullPath := filepath.Join(localFolderPath, relPath)
+
+	// Keep the directory usable by us, or synced files couldn't be written into it
+	perm |= 0700
+
+	info, err := os.Lstat(fullPath)
+	switch {
+	case os.IsNotExist(err):
+		if err := os.MkdirAll(fullPath, 0755); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+		e.state.ClearTombstones(localFolderPath, relPath)
+	case err != nil:
+		return fmt.Errorf("failed to stat directory: %w", err)
+	case !info.IsDir():
+		return fmt.Errorf("%s exists and is not a directory", fullPath)
+	case !update:
+		return nil
+	}
+
+	if err := fileutil.WriteXattrs(fullPath, xattrs); err != nil {
+		log.Debug().Err(err).Str("path", fullPath).Msg("Failed to restore directory attributes")
+	}
+	if info == nil || info.Mode().Perm() != perm {
+		if err := os.Chmod(fullPath, perm); err != nil {
+			return fmt.Errorf("failed to set directory permissions: %w", err)
+		}
+	}
+	if info != nil {
+		return nil
+	}
+
+	e.addActivity(&SyncActivity{
+		Type:       "received",
+		FileName:   filepath.Base(relPath),
+		FolderPath: localFolderPath,
+		RelPath:    relPath,
+		PeerName:   peerName,
+		Timestamp:  time.Now(),
+	})
+	log.Info().
+		Str("dir", relPath).
+		Str("folder_id", localFolderPath).
+		Str("peer_id", peerName).
+		Msg("Created directory")
+	return nil
+}
@@ -0,0 +1,141 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// spaceCheckInterval is how often folders low on space are checked again
+const spaceCheckInterval = 30 * time.Second
+
+// errLowDiskSpace is returned for incoming files that would leave their
+// volume with less than sync.min_free_space
+var errLowDiskSpace = errors.New("not enough free disk space")
+
+// spaceGate pauses receiving into folders whose volume is low on space, and
+// keeps the file lists that couldn't be fetched in full for when it isn't
+type spaceGate struct {
+	mu   sync.Mutex
+	low  map[string]bool                 // Folder path -> receiving paused
+	held map[string]map[string]*heldList // Folder path -> peer -> list to apply again
+}
+
+func newSpaceGate() *spaceGate {
+	return &spaceGate{
+		low:  make(map[string]bool),
+		held: make(map[string]map[string]*heldList),
+	}
+}
+
+// isLow reports whether receiving into a folder is paused for space
+func (g *spaceGate) isLow(folderPath string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.low[folderPath]
+}
+
+// spaceBudget returns how many bytes can be written into a folder before its
+// volume is down to sync.min_free_space. It is negative once it is below.
+func (e *Engine) spaceBudget(folderPath string) (int64, error) {
+	free, err := fileutil.FreeSpace(folderPath)
+	if err != nil {
+		return 0, err
+	}
+	return free - e.cfg.GetMinFreeSpace(), nil
+}
+
+// fitsOnDisk reports whether size more bytes fit in a folder's volume,
+// pausing receiving into it with a surfaced error if they don't. Folders
+// whose free space can't be read are assumed to have room.
+func (e *Engine) fitsOnDisk(folderPath string, size int64) bool {
+	budget, err := e.spaceBudget(folderPath)
+	if err != nil {
+		log.Debug().Err(err).Str("folder_id", folderPath).Msg("Failed to check free space")
+		return true
+	}
+	if size <= budget {
+		return true
+	}
+	e.pauseForSpace(folderPath, budget, size)
+	return false
+}
+
+// pauseForSpace pauses receiving into a folder that has budget bytes left
+// but needs size, reporting it the first time
+func (e *Engine) pauseForSpace(folderPath string, budget, size int64) {
+	e.space.mu.Lock()
+	wasLow := e.space.low[folderPath]
+	e.space.low[folderPath] = true
+	e.space.mu.Unlock()
+
+	if !wasLow {
+		log.Warn().
+			Str("folder_id", folderPath).
+			Str("available", fileutil.FormatSize(max(budget, 0))).
+			Str("needed", fileutil.FormatSize(size)).
+			Msg("Volume low on space, pausing receiving")
+		e.publishError(fmt.Errorf("%s: receiving paused, its volume is down to %s free; free up space to resume", folderPath, e.cfg.Sync.MinFreeSpace))
+	}
+}
+
+// holdForSpace keeps a peer's file list to apply again once there is room
+// for the files that couldn't be requested
+func (e *Engine) holdForSpace(folderPath, peerName string, list *heldList) {
+	e.space.mu.Lock()
+	defer e.space.mu.Unlock()
+
+	if e.space.held[folderPath] == nil {
+		e.space.held[folderPath] = make(map[string]*heldList)
+	}
+	e.space.held[folderPath][peerName] = list
+}
+
+// diskSpaceLoop resumes receiving into folders once their volume has room
+// again, applying the file lists held for them
+func (e *Engine) diskSpaceLoop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(spaceCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			e.resumeReceiving()
+		}
+	}
+}
+
+// resumeReceiving unpauses folders whose volume has room again
+func (e *Engine) resumeReceiving() {
+	e.space.mu.Lock()
+	var folders []string
+	for folderPath := range e.space.low {
+		folders = append(folders, folderPath)
+	}
+	e.space.mu.Unlock()
+
+	for _, folderPath := range folders {
+		if budget, err := e.spaceBudget(folderPath); err != nil || budget <= 0 {
+			continue
+		}
+
+		e.space.mu.Lock()
+		delete(e.space.low, folderPath)
+		lists := e.space.held[folderPath]
+		delete(e.space.held, folderPath)
+		e.space.mu.Unlock()
+
+		log.Info().Str("folder_id", folderPath).Int("lists", len(lists)).Msg("Volume has free space again, resuming receiving")
+		for peerName, list := range lists {
+			e.handleFileList(list.fileList, list.connID, peerName, list.send)
+		}
+	}
+}
@@ -2,14 +2,18 @@ package sync
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/internal/logging"
 	"github.com/jseidel/mac-profile-sync/internal/network"
 	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
 	"github.com/rs/zerolog/log"
@@ -17,7 +21,7 @@ import (
 
 // SyncActivity represents a sync operation
 type SyncActivity struct {
-	Type       string    `json:"type"` // "sent", "received", "deleted"
+	Type       string    `json:"type"` // "sent", "received", "deleted", "moved", "corrupt", "quarantined", "skipped", "restored", "locked"
 	FileName   string    `json:"file_name"`
 	FolderPath string    `json:"folder_path"`
 	RelPath    string    `json:"rel_path"`
@@ -25,30 +29,20 @@ type SyncActivity struct {
 	Timestamp  time.Time `json:"timestamp"`
 }
 
-// getFolderName extracts the base folder name from a path (e.g., "Desktop" from "/Users/josh/Desktop")
+// folderName returns the name peers match a folder by (e.g., "Desktop" from "/Users/josh/Desktop")
 // Special case: home directory returns "~" to allow matching between users with different usernames
-func getFolderName(folderPath string) string {
-	home, _ := os.UserHomeDir()
-	if folderPath == home {
-		return "~"
+func (e *Engine) folderName(folderPath string) string {
+	if folderCfg := e.cfg.GetFolder(folderPath); folderCfg != nil {
+		return folderCfg.SyncName()
 	}
-	return filepath.Base(folderPath)
+	return config.FolderConfig{Path: folderPath}.SyncName()
 }
 
 // findLocalFolderByName finds the local folder path that matches the given folder name
 // Special case: "~" matches the home directory
 func (e *Engine) findLocalFolderByName(folderName string) string {
-	home, _ := os.UserHomeDir()
 	for _, folder := range e.cfg.Folders {
-		if !folder.Enabled {
-			continue
-		}
-		// Check for home directory special case
-		if folderName == "~" && folder.Path == home {
-			return folder.Path
-		}
-		// Normal folder name matching
-		if filepath.Base(folder.Path) == folderName {
+		if folder.Enabled && folder.SyncName() == folderName {
 			return folder.Path
 		}
 	}
@@ -59,6 +53,7 @@ func (e *Engine) findLocalFolderByName(folderName string) string {
 type Engine struct {
 	cfg      *config.Config
 	watcher  *Watcher
+	ignores  *IgnoreRules
 	state    *StateStore
 	conflict *ConflictDetector
 	server   *network.Server
@@ -68,65 +63,266 @@ type Engine struct {
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
 
-	// Callbacks
-	onActivity func(*SyncActivity)
-	onConflict func(*Conflict)
-	onError    func(error)
+	// Safe mode: observe and report only, never transfer or delete
+	safeMode atomic.Bool
+	plan     *planRecorder
+	pending  *planRecorder     // Peer changes staged for folders that need approval
+	approved map[string]string // Full path -> remote hash approved by an applied plan; guarded by remoteMu
+
+	// Transfers
+	transfers   *transferScheduler
+	deliveries  *deliveryTracker
+	checkpoints *checkpointStore // Partial downloads to resume
+	hardLinks   *hardLinks       // Links to make once the files they link to arrive
+
+	// Each folder's own event queue, serve workers, and error state
+	pipelines *pipelineSet
+
+	// Local renames waiting to be paired, and renames applied for peers
+	moves *moveTracker
+
+	// Incoming changes held while a backup runs
+	backup *backupGate
+
+	// When each folder was last snapshotted before a large batch of changes
+	snapshots *snapshotTimes
+
+	// What is known about peers across restarts
+	peerDB *PeerStore
+
+	// Activity, progress, peer, conflict, error, and lifecycle events
+	events *EventBus
 
 	// Activity log
 	activities   []*SyncActivity
 	activityMu   sync.RWMutex
 	maxActivities int
+
+	// Latest remote listings per local folder, for browsing, on-demand fetch,
+	// previews and held deletes
+	remoteLists map[string]*RemoteListing
+	onDemand    map[string]bool // Files requested outside a folder's sparse selection
+	refetching  map[string]int  // Full path -> received copies that failed verification
+	remoteMu    sync.RWMutex
+
+	// Which folders are case-insensitive, where case-only differences collide
+	cases *caseProbe
+
+	// Files skipped for being over sync.max_file_size
+	oversized *oversizedFiles
+
+	// Locked files whose peer updates wait for them to be unlocked
+	locked *lockedFiles
+
+	// SQLite databases held until they are quiet and consistent
+	databases *databaseGroups
+
+	// Packages changed here, and packages assembled from peers' files
+	packages *packages
+
+	// Peers' clock offsets, measured when they say hello
+	clocks *peerClocks
+
+	// Throttles on writing received files, for folders on slow disks
+	applies *applyLimiters
+
+	// Per-folder contexts, canceled when the folder is removed
+	folderCtxs *folderContexts
+
+	// Local deletions batched, and held when too many go at once
+	massDeletes *massDeletes
+
+	// .DS_Store files just received, whose rewrite by Finder isn't sent back
+	finderViews *finderViews
+
+	// Addresses peers announced after their network changed
+	announced *announcedAddresses
+
+	// Peers sent the folder's list after deleting files a master keeps
+	restores *restoreQueue
+
+	// Files changed while known peers were away, sent when they return
+	journal *changeJournal
+
+	// Called with peers an introducer told us about
+	introduce func(name string, addresses []string)
+
+	// Folders not receiving until their volume has room
+	space *spaceGate
+
+	// All syncing or single folders paused by the user
+	paused *pauseState
+
+	// Serializes file list sends so peers see sequences in order
+	listMu sync.Mutex
+
+	// Folders held back after a restore was detected
+	reconcile *ReconcileStore
+	heldLists map[string]*heldList // Guarded by remoteMu
+}
+
+// RemoteListing is the most recent file list a peer sent for a folder
+type RemoteListing struct {
+	PeerName         string             `json:"peer_name"`
+	RemoteFolderPath string             `json:"remote_folder_path"`
+	FolderName       string             `json:"folder_name"`
+	Files            []network.FileInfo `json:"files"`
+	ReceivedAt       time.Time          `json:"received_at"`
+
+	held *heldList // The list itself, and where to request its files
 }
 
 // NewEngine creates a new sync engine
 func NewEngine(cfg *config.Config, server *network.Server, client *network.Client) (*Engine, error) {
-	watcher, err := NewWatcher(cfg)
+	ignores := NewIgnoreRules(cfg)
+	watcher, err := NewWatcher(cfg, ignores)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create watcher: %w", err)
 	}
 
 	state := NewStateStore()
+	events := NewEventBus()
 	conflict := NewConflictDetector(cfg, state)
+	conflict.SetCallback(func(c *Conflict) {
+		events.Publish(Event{Kind: EventConflict, Conflict: c})
+	})
 
 	ctx, cancel := context.WithCancel(context.Background())
 
-	return &Engine{
+	clocks := newPeerClocks()
+	conflict.SetClockOffsets(clocks.offset)
+
+	e := &Engine{
 		cfg:           cfg,
 		watcher:       watcher,
+		ignores:       ignores,
 		state:         state,
 		conflict:      conflict,
 		server:        server,
 		client:        client,
 		ctx:           ctx,
 		cancel:        cancel,
+		events:        events,
 		activities:    make([]*SyncActivity, 0),
 		maxActivities: 100,
-	}, nil
+		remoteLists:   make(map[string]*RemoteListing),
+		onDemand:      make(map[string]bool),
+		refetching:    make(map[string]int),
+		cases:         newCaseProbe(),
+		oversized:     newOversizedFiles(),
+		locked:        newLockedFiles(),
+		databases:     newDatabaseGroups(),
+		packages:      newPackages(),
+		clocks:        clocks,
+		applies:       newApplyLimiters(),
+		folderCtxs:    newFolderContexts(),
+		massDeletes:   newMassDeletes(),
+		finderViews:   newFinderViews(),
+		announced:     newAnnouncedAddresses(),
+		restores:      newRestoreQueue(),
+		journal:       newChangeJournal(),
+		space:         newSpaceGate(),
+		paused:        newPauseState(),
+		plan:          newPlanRecorder(cfg.Device.Name),
+		pending:       newPlanRecorder(cfg.Device.Name),
+		approved:      make(map[string]string),
+		reconcile:     NewReconcileStore(),
+		heldLists:     make(map[string]*heldList),
+		transfers:     newTransferScheduler(cfg.GetMaxConcurrentTransfers()),
+		pipelines:     newPipelineSet(),
+		moves:         newMoveTracker(),
+		backup:        newBackupGate(),
+		snapshots:     newSnapshotTimes(),
+		deliveries:    newDeliveryTracker(),
+		checkpoints:   newCheckpointStore(),
+		hardLinks:     newHardLinks(),
+		peerDB:        NewPeerStore(),
+	}
+	e.transfers.resume = e.resumeRequest
+	return e, nil
+}
+
+// SetSafeMode enables or disables observe-only mode. In safe mode the engine
+// still scans and exchanges file lists, but transfers and deletes nothing.
+func (e *Engine) SetSafeMode(enabled bool) {
+	e.safeMode.Store(enabled)
+	if enabled {
+		log.Warn().Msg("Safe mode enabled: changes will be reported but not propagated")
+	}
+}
+
+// IsSafeMode returns whether the engine is in observe-only mode
+func (e *Engine) IsSafeMode() bool {
+	return e.safeMode.Load()
 }
 
-// SetCallbacks sets the event callbacks
-func (e *Engine) SetCallbacks(onActivity func(*SyncActivity), onConflict func(*Conflict), onError func(error)) {
-	e.onActivity = onActivity
-	e.onConflict = onConflict
-	e.onError = onError
-	e.conflict.SetCallback(onConflict)
+// propagationAllowed reports whether an action may change anything locally or
+// on a peer. In safe mode the action is logged as a difference and skipped.
+func (e *Engine) propagationAllowed(action, path string) bool {
+	if !e.safeMode.Load() {
+		return true
+	}
+	log.Info().Str("action", action).Str("path", path).Msg("Safe mode: not propagating")
+	return false
 }
 
 // Start starts the sync engine
 func (e *Engine) Start() error {
+	// Folders peers can't tell apart would mix their contents
+	if err := e.cfg.CheckFanIn(); err != nil {
+		return err
+	}
+
 	// Load saved state
 	if err := e.state.Load(); err != nil {
 		log.Warn().Err(err).Msg("Failed to load state, starting fresh")
 	}
+	if err := e.reconcile.Load(); err != nil {
+		log.Warn().Err(err).Msg("Failed to load reconciliations")
+	}
+	if pending, err := LoadPlan(ApprovalsPath()); err == nil {
+		e.pending.restore(pending)
+	}
+	if err := e.peerDB.Load(); err != nil {
+		log.Warn().Err(err).Msg("Failed to load known peers")
+	}
+	if err := e.journal.load(); err != nil {
+		log.Warn().Err(err).Msg("Failed to load change journal")
+	}
+	known := make(map[string]bool)
+	for _, p := range e.peerDB.List() {
+		known[p.Name] = true
+	}
+	e.journal.forget(known)
+
+	// Rescan folders whose changes the watcher lost track of
+	e.watcher.SetMissedHandler(func(folderPath string) {
+		e.pipeline(folderPath).overflowed.Store(true)
+	})
+
+	// Deletions held before a restart stay held, even from peers' lists
+	e.loadHeldDeletes()
 
 	// Initialize folder states
 	for _, folder := range e.cfg.Folders {
 		if folder.Enabled {
 			e.state.InitFolder(folder.Path)
+			if folder.IsSparse() {
+				e.pruneDeselected(folder.Path)
+			}
+			e.reconcileOffline(folder.Path)
 		}
 	}
 
+	// Pauses saved before the daemon started, and the schedule, apply from
+	// the first peer
+	e.applyPauses()
+	e.applySchedule()
+
+	// Portable folders whose drive isn't mounted start offline, and missing
+	// folders start paused
+	e.checkMounts()
+
 	// Set up network message handlers
 	e.server.SetHandlers(e.onClientConnect, e.onClientDisconnect, e.onServerMessage)
 	e.client.SetHandlers(e.onServerConnect, e.onServerDisconnect, e.onClientMessage)
@@ -140,7 +336,105 @@ func (e *Engine) Start() error {
 	e.wg.Add(1)
 	go e.processFileEvents()
 
+	// Files left half written were never verified; peers will send them again
+	e.wg.Add(1)
+	go e.removeStaleTemps()
+
+	// Catch changes the watcher missed
+	e.wg.Add(1)
+	go e.rescanLoop()
+
+	// Periodically retry files that were unreadable
+	e.wg.Add(1)
+	go e.retryUnreadableLoop()
+
+	// Start transfer bookkeeping; serve workers run per folder
+	e.wg.Add(1)
+	go e.transferExpiryLoop()
+	e.wg.Add(1)
+	go e.deliveryRetryLoop()
+
+	// Apply decisions on mass deletions made with the deletes command
+	e.wg.Add(1)
+	go e.massDeleteLoop()
+
+	// Publish conflicts for the TUI and apply the decisions made there
+	e.wg.Add(1)
+	go e.conflictLoop()
+
+	// Apply reconciliation choices made with the reconcile command
+	e.wg.Add(1)
+	go e.reconcileLoop()
+
+	// Pick up paths excluded for a while, and let them sync once expired
+	e.wg.Add(1)
+	go e.exclusionLoop()
+
+	// Pick up edited ignore rules and cleanups queued with the ignore command
+	e.wg.Add(1)
+	go e.ignoreLoop()
+
+	// Publish connected peers and their latency
+	e.wg.Add(1)
+	go e.peerStatusLoop()
+
+	// Reach peers where they were last seen instead of waiting for discovery
+	e.wg.Add(1)
+	go e.reconnectKnownPeers()
+
+	// Publish each folder's pipeline state
+	e.wg.Add(1)
+	go e.folderStatusLoop()
+
+	// Rehash state recorded with an older hash algorithm
+	e.wg.Add(1)
+	go e.hashMigrationLoop()
+
+	// Hold incoming changes while a backup of the synced folders runs
+	e.wg.Add(1)
+	go e.backupLoop()
+
+	// Resume receiving into folders once their volume has room again
+	e.wg.Add(1)
+	go e.diskSpaceLoop()
+
+	// Apply pauses made with the pause command or the TUI
+	e.wg.Add(1)
+	go e.pauseLoop()
+
+	// Take portable folders offline and back as their drives come and go,
+	// and pause folders that go missing
+	e.wg.Add(1)
+	go e.mountLoop()
+
+	// Pause and resume syncing with sync.schedule and sync.quiet_hours
+	e.wg.Add(1)
+	go e.scheduleLoop()
+
+	// Tell peers where to reach this Mac when its network changes
+	e.wg.Add(1)
+	go e.addressLoop()
+
+	// Publish what peers have outside sparse selections, and fetch files
+	// queued from it
+	e.wg.Add(1)
+	go e.browseLoop()
+
+	// Share this Mac's peers as the LAN's introducer
+	if e.cfg.Network.Introducer {
+		e.wg.Add(1)
+		go e.introducerLoop()
+	}
+
+	// Save the safe-mode change plan and execute applied plans
+	if e.IsSafeMode() {
+		e.plan.clear()
+	}
+	e.wg.Add(1)
+	go e.planLoop()
+
 	log.Info().Msg("Sync engine started")
+	e.events.Publish(Event{Kind: EventLifecycle, Lifecycle: LifecycleStarted})
 	return nil
 }
 
@@ -148,24 +442,71 @@ func (e *Engine) Start() error {
 func (e *Engine) Stop() {
 	e.cancel()
 	e.watcher.Stop()
+	e.massDeletes.stop()
 	e.wg.Wait()
 
 	// Save state
 	if err := e.state.Save(); err != nil {
 		log.Error().Err(err).Msg("Failed to save state")
 	}
+	e.peerDB.saveIfChanged()
+	e.journal.saveIfChanged()
 
 	log.Info().Msg("Sync engine stopped")
+	e.events.Publish(Event{Kind: EventLifecycle, Lifecycle: LifecycleStopped})
 }
 
 // SyncFolder performs a full sync of a folder with all connected peers
 func (e *Engine) SyncFolder(folderPath string) error {
-	log.Info().Str("folder", folderPath).Msg("Starting folder sync")
+	if e.IsFolderPaused(folderPath) {
+		log.Debug().Str("folder_id", folderPath).Msg("Folder paused, not syncing")
+		return nil
+	}
+	log.Info().Str("folder_id", folderPath).Msg("Starting folder sync")
+
+	e.listMu.Lock()
+	defer e.listMu.Unlock()
+
+	msg, err := e.fileListMessage(folderPath)
+	if isCanceled(err) {
+		log.Debug().Str("folder_id", folderPath).Msg("Folder sync canceled")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := e.server.BroadcastPayload(network.MsgFileList, msg); err != nil {
+		return fmt.Errorf("failed to broadcast file list: %w", err)
+	}
+
+	// Also send to outgoing connections
+	for _, conn := range e.client.GetConnections() {
+		if err := conn.SendPayload(network.MsgFileList, msg); err != nil {
+			log.Error().Err(err).Str("peer_id", e.connName(conn.Address)).Msg("Failed to send file list")
+		}
+	}
+
+	return nil
+}
 
+// fileListMessage scans a folder and builds the file list sent to peers
+func (e *Engine) fileListMessage(folderPath string) (network.FileListMessage, error) {
 	// Scan folder and build file list
 	files, err := e.scanFolder(folderPath)
 	if err != nil {
-		return fmt.Errorf("failed to scan folder: %w", err)
+		return network.FileListMessage{}, fmt.Errorf("failed to scan folder: %w", err)
+	}
+
+	if unreadable := e.state.GetUnreadable(folderPath); len(unreadable) > 0 {
+		log.Warn().
+			Str("folder_id", folderPath).
+			Int("count", len(unreadable)).
+			Msg("Folder has unreadable files that will not be synced")
+	}
+	seq := e.state.NextSequence(folderPath)
+	if err := e.state.Save(); err != nil {
+		log.Warn().Err(err).Msg("Failed to save state")
 	}
 
 	// Convert to network format
@@ -176,43 +517,108 @@ func (e *Engine) SyncFolder(folderPath string) error {
 			Size:       f.Size,
 			ModTime:    f.ModTime,
 			Hash:       f.Hash,
+			HashAlgo:   f.HashAlgo,
 			IsDir:      f.IsDir,
+			LinkOf:     f.LinkOf,
+			Package:    f.Package,
 			Permission: uint32(f.Permission),
 			FolderPath: folderPath,
 		}
 	}
 
-	// Send file list to all connected peers
-	msg := network.FileListMessage{
-		FolderPath: folderPath,
-		FolderName: getFolderName(folderPath),
-		Files:      netFiles,
-	}
+	return network.FileListMessage{
+		FolderPath:    folderPath,
+		FolderName:    e.folderName(folderPath),
+		Files:         netFiles,
+		Sequence:      seq,
+		PeerSequences: e.state.GetPeerSequences(folderPath),
 
-	if err := e.server.BroadcastPayload(network.MsgFileList, msg); err != nil {
-		return fmt.Errorf("failed to broadcast file list: %w", err)
-	}
+		Generation:      e.state.GetGeneration(folderPath),
+		PeerGenerations: e.state.GetPeerGenerations(folderPath),
+	}, nil
+}
 
-	// Also send to outgoing connections
-	for _, conn := range e.client.GetConnections() {
-		if err := conn.SendPayload(network.MsgFileList, msg); err != nil {
-			log.Error().Err(err).Str("peer", conn.Address).Msg("Failed to send file list")
+func (e *Engine) scanFolder(folderPath string) ([]*fileutil.FileInfo, error) {
+	var files []*fileutil.FileInfo
+	seen := make(map[string]bool)
+	links := make(map[string]*fileutil.FileInfo) // Hard link key -> first path scanned with it
+
+	err := walkFolder(e.folderContext(folderPath), e.cfg, e.ignores, folderPath, func(path string, info os.FileInfo, err error) {
+		if err != nil {
+			if isUnreadable(err) {
+				e.markUnreadable(folderPath, path, err)
+			}
+			return
+		}
+
+		// Checked before hashing, which would read all of it
+		if !info.IsDir() {
+			relPath, _ := filepath.Rel(folderPath, path)
+			relPath = fileutil.NormalizePath(relPath)
+			if e.tooLarge(folderPath, relPath, info.Size(), "") || e.tooOld(folderPath, relPath, info.ModTime(), "") || e.databaseHeld(folderPath, relPath) {
+				return
+			}
+		}
+
+		// Hard links share their contents and metadata with the first path
+		// scanned; peers link them too instead of keeping copies
+		key, linked := fileutil.HardLinkKey(info)
+		if first, ok := links[key]; linked && ok {
+			relPath, _ := filepath.Rel(folderPath, path)
+			link := *first
+			link.Path, link.RelPath, link.LinkOf = path, fileutil.NormalizePath(relPath), first.RelPath
+			files = append(files, &link)
+			seen[link.RelPath] = true
+			return
+		}
+
+		fi, err := e.fileInfo(folderPath, path)
+		if err != nil {
+			if isUnreadable(err) {
+				e.markUnreadable(folderPath, path, err)
+			} else if !isCanceled(err) {
+				log.Warn().Err(err).Str("path", path).Msg("Failed to get file info")
+			}
+			return
 		}
+		if linked {
+			links[key] = fi
+		}
+
+		e.state.ClearUnreadable(folderPath, fi.RelPath)
+		files = append(files, fi)
+		seen[fi.RelPath] = true
+	})
+	if err == nil {
+		e.state.RetainCachedHashes(folderPath, seen)
 	}
 
-	return nil
+	return files, err
 }
 
-func (e *Engine) scanFolder(folderPath string) ([]*fileutil.FileInfo, error) {
-	var files []*fileutil.FileInfo
+// walkFolder visits the files and directories of a synced folder that are
+// synced: ignored paths and subfolders outside a sparse selection are skipped.
+// Paths that can't be read are passed to visit with their error. The walk
+// stops with ctx's error once ctx is canceled.
+func walkFolder(ctx context.Context, cfg *config.Config, ignores *IgnoreRules, folderPath string, visit func(path string, info os.FileInfo, err error)) error {
+	return walkFolderFrom(ctx, cfg, ignores, folderPath, folderPath, visit)
+}
+
+// walkFolderFrom is walkFolder over only dir, a path inside the folder
+func walkFolderFrom(ctx context.Context, cfg *config.Config, ignores *IgnoreRules, folderPath, dir string, visit func(path string, info os.FileInfo, err error)) error {
+	folderCfg := cfg.GetFolder(folderPath)
 
-	err := filepath.Walk(folderPath, func(path string, info os.FileInfo, err error) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
 		if err != nil {
+			visit(path, nil, err)
 			return nil // Skip errors
 		}
 
 		// Skip ignored files
-		if e.cfg.ShouldIgnore(path) {
+		if rel, _ := filepath.Rel(folderPath, path); cfg.ShouldIgnore(path) || ignores.Ignored(folderPath, rel) {
 			if info.IsDir() {
 				return filepath.SkipDir
 			}
@@ -224,17 +630,133 @@ func (e *Engine) scanFolder(folderPath string) ([]*fileutil.FileInfo, error) {
 			return nil
 		}
 
-		fi, err := fileutil.GetFileInfo(path, folderPath)
-		if err != nil {
-			log.Warn().Err(err).Str("path", path).Msg("Failed to get file info")
-			return nil
+		// Skip subfolders outside a sparse selection
+		if folderCfg != nil && folderCfg.IsSparse() {
+			rel, _ := filepath.Rel(folderPath, path)
+			if info.IsDir() && !folderCfg.IncludesDir(rel) {
+				return filepath.SkipDir
+			}
+			if !folderCfg.IncludesPath(rel) {
+				return nil
+			}
 		}
 
-		files = append(files, fi)
+		visit(path, info, nil)
 		return nil
 	})
+}
 
-	return files, err
+// isUnreadable reports whether err means the file exists but we lack access to it
+func isUnreadable(err error) bool {
+	return errors.Is(err, os.ErrPermission)
+}
+
+// canRead reports whether a file can be opened and read, without reading
+// more than a byte of it
+func canRead(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	var b [1]byte
+	_, err = f.Read(b[:])
+	return err == nil || err == io.EOF
+}
+
+// markUnreadable records a file we could not read so it is reported and retried
+func (e *Engine) markUnreadable(folderPath, path string, err error) {
+	relPath, relErr := filepath.Rel(folderPath, path)
+	if relErr != nil {
+		relPath = path
+	}
+	relPath = fileutil.NormalizePath(relPath)
+
+	log.Warn().Err(err).Str("path", path).Msg("Skipping unreadable file")
+	e.state.MarkUnreadable(folderPath, relPath, err)
+}
+
+// retryUnreadableLoop periodically re-checks unreadable files and syncs them
+// once their permissions allow it, and fetches updates locked files turned
+// away once they are unlocked
+func (e *Engine) retryUnreadableLoop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			e.retryUnreadable()
+			e.retryUnwritable()
+		}
+	}
+}
+
+func (e *Engine) retryUnreadable() {
+	changed := false
+
+	for _, folder := range e.cfg.Folders {
+		if !folder.Enabled {
+			continue
+		}
+
+		for relPath := range e.state.GetUnreadable(folder.Path) {
+			fullPath := filepath.Join(folder.Path, relPath)
+
+			info, err := os.Stat(fullPath)
+			if err != nil && !isUnreadable(err) {
+				// File is gone, nothing left to retry
+				e.state.ClearUnreadable(folder.Path, relPath)
+				changed = true
+				continue
+			}
+			if err != nil {
+				continue
+			}
+
+			if info.IsDir() {
+				// A directory that can be listed again needs a full rescan
+				if _, err := os.ReadDir(fullPath); err == nil {
+					log.Info().Str("path", fullPath).Msg("Directory is readable again, rescanning folder")
+					e.state.ClearUnreadable(folder.Path, relPath)
+					changed = true
+					e.wg.Add(1)
+					go func(path string) {
+						defer e.wg.Done()
+						_ = e.SyncFolder(path)
+					}(folder.Path)
+				}
+				continue
+			}
+
+			if !canRead(fullPath) {
+				continue
+			}
+
+			log.Info().Str("path", fullPath).Msg("File is readable again, syncing")
+			e.state.ClearUnreadable(folder.Path, relPath)
+			changed = true
+
+			e.handleFileChange(FileEvent{
+				Type:       EventModify,
+				Path:       fullPath,
+				RelPath:    relPath,
+				FolderPath: folder.Path,
+				Timestamp:  time.Now(),
+			})
+		}
+	}
+
+	if changed {
+		if err := e.state.Save(); err != nil {
+			log.Warn().Err(err).Msg("Failed to save state")
+		}
+	}
 }
 
 func (e *Engine) processFileEvents() {
@@ -246,7 +768,7 @@ func (e *Engine) processFileEvents() {
 			return
 
 		case event := <-e.watcher.Events():
-			e.handleFileEvent(event)
+			e.queueFileEvent(event)
 		}
 	}
 }
@@ -255,17 +777,37 @@ func (e *Engine) handleFileEvent(event FileEvent) {
 	log.Debug().
 		Str("type", event.Type.String()).
 		Str("path", event.Path).
-		Str("folder", event.FolderPath).
+		Str("folder_id", event.FolderPath).
 		Msg("File event")
 
+	// The watcher reports the ignore file even when it stays on this Mac
+	if event.RelPath == IgnoreFileName {
+		e.ignoreFileChanged(event.FolderPath)
+		if e.ignores.Ignored(event.FolderPath, event.RelPath) {
+			return
+		}
+	}
+
+	// A folder that is gone looks like every file in it was deleted
+	if (event.Type == EventDelete || event.Type == EventRename) && !e.folderPresent(event.FolderPath) {
+		return
+	}
+
+	// Changes inside a package go to peers with the rest of the package
+	if e.packageChanged(event) {
+		return
+	}
+
 	switch event.Type {
 	case EventCreate, EventModify:
 		e.handleFileChange(event)
 	case EventDelete:
 		e.handleFileDelete(event)
 	case EventRename:
-		// Treat rename as delete + create
-		e.handleFileDelete(event)
+		// The old path of a rename; the new path arrives as a create
+		e.startMove(event)
+	case EventAttrib:
+		e.handleAttribChange(event)
 	}
 }
 
@@ -275,11 +817,47 @@ func (e *Engine) handleFileChange(event FileEvent) {
 		log.Debug().Str("path", event.Path).Msg("Skipping send (receive_only mode)")
 		return
 	}
+	if !e.propagationAllowed("send", event.Path) {
+		return
+	}
+
+	// The new path of a rename goes to peers as a move
+	if event.Type == EventCreate && e.completeMove(event) {
+		return
+	}
+
+	if info, err := os.Lstat(event.Path); err == nil && !info.IsDir() &&
+		(e.tooLarge(event.FolderPath, event.RelPath, info.Size(), "") || e.tooOld(event.FolderPath, event.RelPath, info.ModTime(), "")) {
+		return
+	}
+	if e.holdDatabase(event) || e.finderViewEcho(event) {
+		return
+	}
 
 	// Get file info
-	fi, err := fileutil.GetFileInfo(event.Path, event.FolderPath)
+	fi, err := e.localFileInfo(event.FolderPath, event.Path)
 	if err != nil {
+		if isUnreadable(err) {
+			e.markUnreadable(event.FolderPath, event.Path, err)
+			return
+		}
+		if isCanceled(err) {
+			return
+		}
 		log.Error().Err(err).Str("path", event.Path).Msg("Failed to get file info")
+		e.folderError(event.FolderPath, err)
+		return
+	}
+	e.state.ClearUnreadable(event.FolderPath, fi.RelPath)
+
+	// Directories have no data; peers create them, empty or not
+	if fi.IsDir {
+		e.handleDirChange(event)
+		return
+	}
+
+	// Same content as last synced; only its mod time or attributes changed
+	if e.sendMetaChange(event, fi) {
 		return
 	}
 
@@ -287,6 +865,7 @@ func (e *Engine) handleFileChange(event FileEvent) {
 	e.state.UpdateFileState(event.FolderPath, &FileState{
 		RelPath:    fi.RelPath,
 		Hash:       fi.Hash,
+		HashAlgo:   fi.HashAlgo,
 		Size:       fi.Size,
 		ModTime:    fi.ModTime,
 		Permission: fi.Permission,
@@ -295,34 +874,49 @@ func (e *Engine) handleFileChange(event FileEvent) {
 	})
 
 	// Prepare file data message
-	data, err := os.ReadFile(event.Path)
+	data, err := fileutil.ReadFileContext(e.folderContext(event.FolderPath), event.Path)
 	if err != nil {
+		if isUnreadable(err) {
+			e.markUnreadable(event.FolderPath, event.Path, err)
+			return
+		}
+		if isCanceled(err) {
+			return
+		}
 		log.Error().Err(err).Str("path", event.Path).Msg("Failed to read file")
+		e.folderError(event.FolderPath, err)
 		return
 	}
 
 	msg := network.FileDataMessage{
 		FolderPath: event.FolderPath,
-		FolderName: getFolderName(event.FolderPath),
+		FolderName: e.folderName(event.FolderPath),
 		RelPath:    fi.RelPath,
 		Size:       fi.Size,
 		ModTime:    fi.ModTime,
+		Birthtime:  fi.Birthtime,
 		Permission: uint32(fi.Permission),
 		Hash:       fi.Hash,
+		HashAlgo:   fi.HashAlgo,
 		Data:       data,
 	}
+	msg.ContentHash = e.contentHash(event.FolderPath, event.Path)
 
-	// Send to all peers
-	if err := e.server.BroadcastPayload(network.MsgFileData, msg); err != nil {
-		log.Error().Err(err).Msg("Failed to broadcast file")
+	// Send to all peers, tracking each send until the peer acknowledges it
+	for _, conn := range e.server.GetConnections() {
+		if err := e.pushFileData(conn.ID, conn.Send, msg); err != nil {
+			log.Error().Err(err).Str("peer_id", e.connName(conn.ID)).Str("transfer_id", logging.TransferID(msg.FolderName, msg.RelPath, msg.Hash)).Msg("Failed to send file")
+		}
 	}
 
 	for _, conn := range e.client.GetConnections() {
-		if err := conn.SendPayload(network.MsgFileData, msg); err != nil {
-			log.Error().Err(err).Str("peer", conn.Address).Msg("Failed to send file")
+		if err := e.pushFileData(conn.Address, conn.Send, msg); err != nil {
+			log.Error().Err(err).Str("peer_id", e.connName(conn.Address)).Str("transfer_id", logging.TransferID(msg.FolderName, msg.RelPath, msg.Hash)).Msg("Failed to send file")
 		}
 	}
 
+	e.journalChange(event.FolderPath, fi.RelPath)
+
 	// Record activity
 	e.addActivity(&SyncActivity{
 		Type:       "sent",
@@ -335,8 +929,13 @@ func (e *Engine) handleFileChange(event FileEvent) {
 }
 
 func (e *Engine) handleFileDelete(event FileEvent) {
-	// Update state
-	e.state.RemoveFileState(event.FolderPath, event.RelPath)
+	if !e.propagationAllowed("send delete", event.Path) {
+		return
+	}
+
+	// Update state, for everything under a deleted directory too
+	relPaths := e.deletedPaths(event.FolderPath, event.RelPath)
+	e.state.MarkDeleted(event.FolderPath, event.RelPath)
 
 	// Check if we're allowed to send
 	if !e.cfg.CanSend() {
@@ -344,22 +943,9 @@ func (e *Engine) handleFileDelete(event FileEvent) {
 		return
 	}
 
-	// Notify peers
-	msg := network.FileDeleteMessage{
-		FolderPath: event.FolderPath,
-		FolderName: getFolderName(event.FolderPath),
-		RelPath:    event.RelPath,
-	}
-
-	if err := e.server.BroadcastPayload(network.MsgFileDelete, msg); err != nil {
-		log.Error().Err(err).Msg("Failed to broadcast delete")
-	}
-
-	for _, conn := range e.client.GetConnections() {
-		if err := conn.SendPayload(network.MsgFileDelete, msg); err != nil {
-			log.Error().Err(err).Str("peer", conn.Address).Msg("Failed to send delete")
-		}
-	}
+	// Notify peers, unless the batch this delete is part of turns out to be
+	// a mass deletion
+	e.queueDeletes(event.FolderPath, relPaths)
 
 	// Record activity
 	e.addActivity(&SyncActivity{
@@ -375,6 +961,7 @@ func (e *Engine) handleFileDelete(event FileEvent) {
 // Network handlers
 func (e *Engine) onClientConnect(conn *network.Connection) {
 	log.Info().Str("remote", conn.ID).Msg("Peer connected (incoming)")
+	e.publishPeer(conn.DeviceName, conn.ID, "incoming", true)
 
 	// Send hello
 	hello := network.HelloMessage{
@@ -386,11 +973,15 @@ func (e *Engine) onClientConnect(conn *network.Connection) {
 }
 
 func (e *Engine) onClientDisconnect(conn *network.Connection) {
-	log.Info().Str("remote", conn.ID).Msg("Peer disconnected (incoming)")
+	log.Info().Str("peer_id", conn.DeviceName).Str("remote", conn.ID).Msg("Peer disconnected (incoming)")
+	e.transfers.dropPeer(conn.ID)
+	e.deliveries.dropPeer(conn.ID)
+	e.publishPeer(conn.DeviceName, conn.ID, "incoming", false)
 }
 
 func (e *Engine) onServerConnect(conn *network.ClientConnection) {
 	log.Info().Str("remote", conn.Address).Msg("Connected to peer (outgoing)")
+	e.publishPeer(conn.DeviceName, conn.Address, "outgoing", true)
 
 	// Send hello
 	hello := network.HelloMessage{
@@ -402,22 +993,124 @@ func (e *Engine) onServerConnect(conn *network.ClientConnection) {
 }
 
 func (e *Engine) onServerDisconnect(conn *network.ClientConnection) {
-	log.Info().Str("remote", conn.Address).Msg("Disconnected from peer (outgoing)")
+	log.Info().Str("peer_id", conn.DeviceName).Str("remote", conn.Address).Msg("Disconnected from peer (outgoing)")
+	e.transfers.dropPeer(conn.Address)
+	e.deliveries.dropPeer(conn.Address)
+	e.publishPeer(conn.DeviceName, conn.Address, "outgoing", false)
+
+	// A peer whose network changed may already have told us where it went
+	if conn.DeviceName != "" && len(e.announced.get(conn.DeviceName)) > 0 && e.ctx.Err() == nil {
+		go e.dialAnnounced(conn.DeviceName)
+	}
 }
 
 func (e *Engine) onServerMessage(conn *network.Connection, msg *network.Message) {
-	e.handleMessage(msg, conn.DeviceName, func(m *network.Message) error {
+	if name := helloDeviceName(msg); name != "" {
+		conn.DeviceName = name
+		e.applyPeerLimits(name, conn.ID, conn.SetPeerRateLimits)
+		e.peerDB.recordHello(name, helloVersion(msg), "")
+	}
+	if version := helloVersion(msg); version != "" {
+		conn.Version = version
+	}
+	e.handleMessage(msg, conn.ID, conn.DeviceName, func(m *network.Message) error {
 		return conn.Send(m)
 	})
 }
 
 func (e *Engine) onClientMessage(conn *network.ClientConnection, msg *network.Message) {
-	e.handleMessage(msg, conn.DeviceName, func(m *network.Message) error {
+	if name := helloDeviceName(msg); name != "" {
+		conn.DeviceName = name
+		e.applyPeerLimits(name, conn.Address, conn.SetPeerRateLimits)
+
+		// Relayed and hole-punched connections can't be dialed again directly
+		address := conn.Address
+		if strings.Contains(address, "://") {
+			address = ""
+		}
+		e.peerDB.recordHello(name, helloVersion(msg), address)
+	}
+	if version := helloVersion(msg); version != "" {
+		conn.Version = version
+	}
+	e.handleMessage(msg, conn.Address, conn.DeviceName, func(m *network.Message) error {
 		return conn.Send(m)
 	})
 }
 
-func (e *Engine) handleMessage(msg *network.Message, peerName string, send func(*network.Message) error) {
+// applyPeerLimits applies a peer's configured transfer and bandwidth limits to
+// the connection it just identified itself on
+func (e *Engine) applyPeerLimits(name, connID string, setRateLimits func(upKbps, downKbps int)) {
+	e.transfers.setLimit(connID, e.cfg.GetPeerMaxTransfers(name))
+
+	peer := e.cfg.GetPeer(name)
+	if peer == nil {
+		return
+	}
+	setRateLimits(peer.MaxUploadKbps, peer.MaxDownloadKbps)
+	log.Info().
+		Str("peer_id", name).
+		Int("max_transfers", e.cfg.GetPeerMaxTransfers(name)).
+		Int("max_upload_kbps", peer.MaxUploadKbps).
+		Int("max_download_kbps", peer.MaxDownloadKbps).
+		Msg("Applied peer limits")
+}
+
+// helloVersion returns the protocol version from a peer's hello
+func helloVersion(msg *network.Message) string {
+	if msg.Type != network.MsgHello {
+		return ""
+	}
+	var hello network.HelloMessage
+	if err := msg.DecodePayload(&hello); err != nil {
+		return ""
+	}
+	return hello.Version
+}
+
+// helloDeviceName returns the peer's device name from a hello or hello ack
+func helloDeviceName(msg *network.Message) string {
+	switch msg.Type {
+	case network.MsgHello:
+		var hello network.HelloMessage
+		if err := msg.DecodePayload(&hello); err == nil {
+			return hello.DeviceName
+		}
+	case network.MsgHelloAck:
+		var ack network.HelloAckMessage
+		if err := msg.DecodePayload(&ack); err == nil {
+			return ack.DeviceName
+		}
+	}
+	return ""
+}
+
+// ackHello accepts a peer's hello
+func (e *Engine) ackHello(send func(*network.Message) error) {
+	ack := network.HelloAckMessage{
+		DeviceName: e.cfg.Device.Name,
+		DeviceID:   e.cfg.Device.Name,
+		Accepted:   true,
+	}
+	ackMsg, _ := network.NewMessage(network.MsgHelloAck, ack)
+	_ = send(ackMsg)
+}
+
+// handleMessage dispatches a peer message. connID identifies the connection
+// it arrived on; send replies on that same connection.
+func (e *Engine) handleMessage(msg *network.Message, connID, peerName string, send func(*network.Message) error) {
+	// Changes from peers wait while a backup of the synced folders runs
+	if e.holdForBackup(msg, connID, peerName, send) {
+		return
+	}
+	if e.holdForPause(msg, connID, peerName, send) {
+		return
+	}
+	e.dispatchMessage(msg, connID, peerName, send)
+}
+
+// dispatchMessage handles a message from a peer by type
+func (e *Engine) dispatchMessage(msg *network.Message, connID, peerName string, send func(*network.Message) error) {
 	switch msg.Type {
 	case network.MsgHello:
 		var hello network.HelloMessage
@@ -425,16 +1118,17 @@ func (e *Engine) handleMessage(msg *network.Message, peerName string, send func(
 			log.Error().Err(err).Msg("Failed to decode hello")
 			return
 		}
-		log.Info().Str("peer", hello.DeviceName).Msg("Received hello from peer")
+		log.Info().Str("peer_id", hello.DeviceName).Msg("Received hello from peer")
+		e.measureClock(hello.DeviceName, msg.Timestamp)
+		e.ackHello(send)
 
-		// Send hello ack
-		ack := network.HelloAckMessage{
-			DeviceName: e.cfg.Device.Name,
-			DeviceID:   e.cfg.Device.Name,
-			Accepted:   true,
+		// Tell peers that pause for it how much they may push at once
+		if network.VersionAtLeast(hello.Version, network.WindowVersion) {
+			e.sendWindow(send)
 		}
-		ackMsg, _ := network.NewMessage(network.MsgHelloAck, ack)
-		_ = send(ackMsg)
+
+		// Send what changed while it was away ahead of the full lists
+		go e.replayJournal(hello.DeviceName, hello.Version, send)
 
 		// Trigger sync of all folders
 		for _, folder := range e.cfg.Folders {
@@ -451,7 +1145,12 @@ func (e *Engine) handleMessage(msg *network.Message, peerName string, send func(
 			log.Error().Err(err).Msg("Failed to decode hello ack")
 			return
 		}
-		log.Info().Str("peer", ack.DeviceName).Bool("accepted", ack.Accepted).Msg("Hello acknowledged")
+		log.Info().Str("peer_id", ack.DeviceName).Bool("accepted", ack.Accepted).Msg("Hello acknowledged")
+		e.measureClock(ack.DeviceName, msg.Timestamp)
+		if err := ack.Err(); err != nil {
+			log.Warn().Err(err).Str("peer_id", ack.DeviceName).Msg("Peer refused connection")
+			e.publishError(fmt.Errorf("%s refused the connection: %w", ack.DeviceName, err))
+		}
 
 	case network.MsgFileList:
 		var fileList network.FileListMessage
@@ -459,7 +1158,11 @@ func (e *Engine) handleMessage(msg *network.Message, peerName string, send func(
 			log.Error().Err(err).Msg("Failed to decode file list")
 			return
 		}
-		e.handleFileList(fileList, peerName, send)
+		// Paths are compared in NFC, whatever form the peer walked them in
+		for i := range fileList.Files {
+			fileList.Files[i].RelPath = fileutil.NormalizePath(fileList.Files[i].RelPath)
+		}
+		e.handleFileList(fileList, connID, peerName, send)
 
 	case network.MsgFileRequest:
 		var req network.FileRequestMessage
@@ -467,7 +1170,9 @@ func (e *Engine) handleMessage(msg *network.Message, peerName string, send func(
 			log.Error().Err(err).Msg("Failed to decode file request")
 			return
 		}
-		e.handleFileRequest(req, send)
+		req.RelPath = fileutil.NormalizePath(req.RelPath)
+		// Serve from the folder's workers so reads don't stall this connection
+		e.queueFileRequest(fileRequestJob{req: req, connID: connID, send: send})
 
 	case network.MsgFileData:
 		var fileData network.FileDataMessage
@@ -475,7 +1180,26 @@ func (e *Engine) handleMessage(msg *network.Message, peerName string, send func(
 			log.Error().Err(err).Msg("Failed to decode file data")
 			return
 		}
-		e.handleFileData(fileData, peerName)
+		fileData.RelPath = fileutil.NormalizePath(fileData.RelPath)
+		// Parts before the last are only written down; the last is acked for the file
+		if fileData.IsChunked && fileData.ChunkIndex < fileData.TotalChunks-1 {
+			e.transfers.progress(connID, fileData.FolderName, fileData.RelPath)
+			e.receivePart(fileData, peerName)
+			return
+		}
+		e.transfers.complete(connID, fileData.FolderName, fileData.RelPath)
+		err := e.receiveFileData(fileData, peerName)
+		rerequested := errors.Is(err, errChecksumMismatch) && e.rerequestCorrupt(fileData, connID, peerName, send)
+		e.ackFileData(fileData, err, rerequested, send)
+
+	case network.MsgFileAck:
+		var ack network.FileAckMessage
+		if err := msg.DecodePayload(&ack); err != nil {
+			log.Error().Err(err).Msg("Failed to decode file ack")
+			return
+		}
+		ack.RelPath = fileutil.NormalizePath(ack.RelPath)
+		e.handleFileAck(ack, connID, peerName)
 
 	case network.MsgFileDelete:
 		var del network.FileDeleteMessage
@@ -483,11 +1207,74 @@ func (e *Engine) handleMessage(msg *network.Message, peerName string, send func(
 			log.Error().Err(err).Msg("Failed to decode file delete")
 			return
 		}
+		del.RelPath = fileutil.NormalizePath(del.RelPath)
+		if !e.ignoredCleanup(del) && e.refuseRemoteDelete(del.FolderName, del.RelPath, connID, peerName, send) {
+			return
+		}
 		e.handleRemoteDelete(del, peerName)
+
+	case network.MsgFileMove:
+		var move network.FileMoveMessage
+		if err := msg.DecodePayload(&move); err != nil {
+			log.Error().Err(err).Msg("Failed to decode file move")
+			return
+		}
+		move.OldRelPath = fileutil.NormalizePath(move.OldRelPath)
+		move.NewRelPath = fileutil.NormalizePath(move.NewRelPath)
+		for i := range move.Files {
+			move.Files[i].RelPath = fileutil.NormalizePath(move.Files[i].RelPath)
+		}
+		if e.refuseRemoteDelete(move.FolderName, move.OldRelPath, connID, peerName, send) {
+			return
+		}
+		e.handleFileMove(move, connID, peerName, send)
+
+	case network.MsgDirCreate:
+		var dir network.DirCreateMessage
+		if err := msg.DecodePayload(&dir); err != nil {
+			log.Error().Err(err).Msg("Failed to decode directory")
+			return
+		}
+		dir.RelPath = fileutil.NormalizePath(dir.RelPath)
+		e.transfers.complete(connID, dir.FolderName, dir.RelPath)
+		e.handleDirCreate(dir, peerName)
+
+	case network.MsgAddressUpdate:
+		var update network.AddressUpdateMessage
+		if err := msg.DecodePayload(&update); err != nil {
+			log.Error().Err(err).Msg("Failed to decode address update")
+			return
+		}
+		e.handleAddressUpdate(update, peerName)
+
+	case network.MsgPeerTable:
+		var table network.PeerTableMessage
+		if err := msg.DecodePayload(&table); err != nil {
+			log.Error().Err(err).Msg("Failed to decode peer table")
+			return
+		}
+		e.handlePeerTable(table, peerName, send)
+
+	case network.MsgWindow:
+		var window network.WindowMessage
+		if err := msg.DecodePayload(&window); err != nil {
+			log.Error().Err(err).Msg("Failed to decode receive window")
+			return
+		}
+		e.deliveries.setWindow(connID, window)
+
+	case network.MsgFileMeta:
+		var meta network.FileMetaMessage
+		if err := msg.DecodePayload(&meta); err != nil {
+			log.Error().Err(err).Msg("Failed to decode attribute change")
+			return
+		}
+		meta.RelPath = fileutil.NormalizePath(meta.RelPath)
+		e.handleFileMeta(meta, peerName)
 	}
 }
 
-func (e *Engine) handleFileList(fileList network.FileListMessage, peerName string, send func(*network.Message) error) {
+func (e *Engine) handleFileList(fileList network.FileListMessage, connID, peerName string, send func(*network.Message) error) {
 	// Map remote folder to local folder by name
 	localFolderPath := e.findLocalFolderByName(fileList.FolderName)
 	if localFolderPath == "" {
@@ -501,47 +1288,245 @@ func (e *Engine) handleFileList(fileList network.FileListMessage, peerName strin
 		Str("remoteFolder", fileList.FolderPath).
 		Str("localFolder", localFolderPath).
 		Int("files", len(fileList.Files)).
+		Bool("journal", fileList.Journal).
 		Msg("Received file list")
 
+	// A journal only lists what changed while we were away
+	if fileList.Journal {
+		if e.skipJournal(localFolderPath, peerName) {
+			return
+		}
+	} else {
+		e.rememberListing(localFolderPath, fileList, connID, peerName, send)
+	}
+
+	// Deletions aren't sent on a folder's first sync, so an empty side can't
+	// empty the other
+	first := e.isFirstSync(localFolderPath, fileList, peerName)
+
+	// A new generation on either side means our known state can't be
+	// trusted. Checked before a restore bumps our own generation below.
+	reverify := e.needsReverify(localFolderPath, fileList, peerName)
+
+	// Don't trust mod times if either side was restored from backup
+	if e.holdForReconciliation(localFolderPath, fileList, connID, peerName, send) {
+		return
+	}
+	if peerName != "" && fileList.Generation != 0 {
+		defer e.state.SetPeerGeneration(localFolderPath, peerName, fileList.Generation)
+	}
+
 	// If we can't receive, don't request any files
 	if !e.cfg.CanReceive() {
 		log.Debug().Msg("Ignoring file list (send_only mode)")
 		return
 	}
 
+	folderCfg := e.cfg.GetFolder(localFolderPath)
+
+	// This list supersedes whatever the peer's last list planned or staged
+	if e.IsSafeMode() && !fileList.Journal {
+		e.plan.resetFolder(localFolderPath, peerName)
+	}
+	if folderCfg := e.cfg.GetFolder(localFolderPath); folderCfg != nil && folderCfg.RequiresApproval() && !fileList.Journal {
+		e.pending.resetFolder(localFolderPath, peerName)
+	}
+
+	// Requests are sent after the loop, once the folder is snapshotted if needed
+	type fileRequest struct {
+		req      network.FileRequestMessage
+		priority transferPriority
+		size     int64
+	}
+	var requests []fileRequest
+
+	// Files deleted here that the peer still has; it is asked to delete them
+	var deletes []string
+	// A master refusing our deletes wants what we deleted fetched again
+	sendsDeletes := e.cfg.CanSend() && !first && !fileList.Restore
+
+	// Files from a case-sensitive peer whose names differ only in case
+	folded := make(map[string]string)
+	caseSensitive := e.cases.caseSensitive(localFolderPath)
+
+	// Listed files by path, for the files hard links in the list link to
+	listed := make(map[string]*network.FileInfo, len(fileList.Files))
+	for i := range fileList.Files {
+		listed[fileList.Files[i].RelPath] = &fileList.Files[i]
+	}
+
+	// Packages are fetched into a copy that replaces them once complete
+	pkgs := e.listPackages(fileList.Files)
+
 	// Check each file against our state
 	for _, remoteFile := range fileList.Files {
+		// Leave files outside a sparse selection or ignored here on the peer
+		if folderCfg != nil && !folderCfg.IncludesPath(remoteFile.RelPath) {
+			continue
+		}
+		if e.ignores.Ignored(localFolderPath, remoteFile.RelPath) {
+			continue
+		}
+		if !remoteFile.IsDir && e.tooLarge(localFolderPath, remoteFile.RelPath, remoteFile.Size, peerName) {
+			continue
+		}
+		if !remoteFile.IsDir && e.tooOld(localFolderPath, remoteFile.RelPath, remoteFile.ModTime, peerName) {
+			continue
+		}
+		// A locked file is left alone until it is unlocked
+		if !remoteFile.IsDir && e.stillLocked(localFolderPath, remoteFile.RelPath) {
+			continue
+		}
+
+		// Only one of them can exist here; the first is fetched, and the
+		// others are raised as conflicts once it is in place
+		if !caseSensitive && !remoteFile.IsDir {
+			key := foldedPath(remoteFile.RelPath)
+			if first, ok := folded[key]; ok {
+				log.Warn().
+					Str("folder_id", localFolderPath).
+					Str("file", remoteFile.RelPath).
+					Str("existing", first).
+					Str("peer_id", peerName).
+					Msg("Peer has files differing only in case, skipping one")
+				continue
+			}
+			folded[key] = remoteFile.RelPath
+
+			if existing := e.caseCollision(localFolderPath, remoteFile.RelPath); existing != "" {
+				e.raiseCaseCollision(localFolderPath, remoteFile.RelPath, existing, &ConflictFile{
+					Size:       remoteFile.Size,
+					ModTime:    remoteFile.ModTime,
+					Hash:       remoteFile.Hash,
+					HashAlgo:   remoteFile.HashAlgo,
+					DeviceName: peerName,
+				})
+				continue
+			}
+		}
+
 		localPath := filepath.Join(localFolderPath, remoteFile.RelPath)
+		pkgRoot := packageOf(pkgs, remoteFile.RelPath)
+		if pkgRoot != "" {
+			pkgs[pkgRoot].listed[remoteFile.RelPath] = remoteFile
+		}
+
+		item := PlanItem{
+			FolderPath:       localFolderPath,
+			RelPath:          remoteFile.RelPath,
+			PeerName:         peerName,
+			RemoteHash:       remoteFile.Hash,
+			RemoteFolderPath: fileList.FolderPath,
+			FolderName:       fileList.FolderName,
+		}
+
+		// Create missing directories, so empty ones exist here too
+		if remoteFile.IsDir {
+			if _, err := os.Lstat(localPath); os.IsNotExist(err) {
+				if sendsDeletes && e.deletedHere(localFolderPath, remoteFile) {
+					deletes = append(deletes, remoteFile.RelPath)
+					if pkgRoot == remoteFile.RelPath {
+						pkgs[pkgRoot].deleted = true
+					}
+					continue
+				}
+				// A package's directories are created in its copy
+				if pkgRoot != "" {
+					continue
+				}
+				item.Reason = "new folder on " + peerName
+				if e.planAllowed(PlanAdd, item) {
+					if err := e.applyDir(localFolderPath, remoteFile.RelPath, os.FileMode(remoteFile.Permission), nil, peerName, false); err != nil {
+						log.Error().Err(err).Str("path", localPath).Msg("Failed to create directory")
+					}
+				}
+			}
+			continue
+		}
+
+		request := func(action PlanAction, reason string) {
+			item.Reason = reason
+			if !e.planAllowed(action, item) {
+				return
+			}
+			if pkgRoot != "" {
+				pkgs[pkgRoot].requested[remoteFile.RelPath] = true
+			}
+			requests = append(requests, fileRequest{
+				req: network.FileRequestMessage{
+					FolderPath: fileList.FolderPath,
+					FolderName: fileList.FolderName,
+					RelPath:    remoteFile.RelPath,
+				},
+				priority: e.transferPriorityFor(localFolderPath, remoteFile.Size, remoteFile.ModTime),
+				size:     remoteFile.Size,
+			})
+		}
 
 		// Check if local file exists
 		localInfo, err := os.Stat(localPath)
 		if err != nil {
-			// File doesn't exist locally, request it
-			req := network.FileRequestMessage{
-				FolderPath: fileList.FolderPath,
-				FolderName: fileList.FolderName,
-				RelPath:    remoteFile.RelPath,
+			// Deleted here while the peer was away, or while we were stopped
+			if sendsDeletes && e.deletedHere(localFolderPath, remoteFile) {
+				deletes = append(deletes, remoteFile.RelPath)
+				continue
 			}
-			reqMsg, _ := network.NewMessage(network.MsgFileRequest, req)
-			_ = send(reqMsg)
+
+			// File doesn't exist locally, request it, unless it is a hard
+			// link on the peer that can be linked here
+			if remoteFile.LinkOf != "" && pkgRoot == "" && e.linkFromList(localFolderPath, remoteFile, listed[remoteFile.LinkOf], item, peerName) {
+				continue
+			}
+			request(PlanAdd, "new on "+peerName)
 			continue
 		}
 
 		// File exists, check if we need to sync
-		localHash, _ := fileutil.HashFile(localPath)
+		localHash, _ := e.hashFile(localFolderPath, localPath)
+		item.LocalHash = localHash
+
+		if !matchesHash(localPath, localHash, e.hashAlgo(localFolderPath), remoteFile.Hash, remoteFile.HashAlgo) {
+			// Finder view settings aren't worth a conflict; the newest wins
+			if isFinderView(remoteFile.RelPath) {
+				if e.localClock(peerName, remoteFile.ModTime).After(localInfo.ModTime()) {
+					request(PlanUpdate, "newer Finder view settings on "+peerName)
+				}
+				continue
+			}
+
+			// Leave versions alone that were already resolved as they are
+			if e.conflict.IsSuppressed(localFolderPath, remoteFile.RelPath, localHash, remoteFile.Hash) {
+				continue
+			}
 
-		if localHash != remoteFile.Hash {
 			// Check for conflict
-			conflict := e.conflict.DetectConflict(localFolderPath, remoteFile.RelPath, &ConflictFile{
+			remote := &ConflictFile{
 				Size:       remoteFile.Size,
 				ModTime:    remoteFile.ModTime,
 				Hash:       remoteFile.Hash,
+				HashAlgo:   remoteFile.HashAlgo,
 				DeviceName: peerName,
-			})
+			}
+			var conflict *Conflict
+			if reverify {
+				conflict = e.conflict.DetectUnverifiedConflict(localFolderPath, remoteFile.RelPath, remote)
+			} else {
+				conflict = e.conflict.DetectConflict(localFolderPath, remoteFile.RelPath, remote)
+			}
 
 			if conflict != nil {
+				// Leave conflicts unresolved in safe mode
+				item.Reason = e.conflictReason(localFolderPath, remoteFile.RelPath, reverify)
+				if !e.planAllowed(PlanConflict, item) {
+					continue
+				}
+
 				// Auto-resolve if not set to prompt
-				resolution, err := e.conflict.AutoResolve(conflict)
+				resolve := e.conflict.AutoResolve
+				if reverify {
+					resolve = e.conflict.AutoResolveUnverified
+				}
+				resolution, err := resolve(conflict)
 				if err != nil {
 					log.Error().Err(err).Msg("Failed to auto-resolve conflict")
 					continue
@@ -549,84 +1534,212 @@ func (e *Engine) handleFileList(fileList network.FileListMessage, peerName strin
 
 				if resolution == ResolutionKeepRemote || resolution == ResolutionKeepBoth {
 					// Request the remote file
-					req := network.FileRequestMessage{
-						FolderPath: fileList.FolderPath,
-						FolderName: fileList.FolderName,
-						RelPath:    remoteFile.RelPath,
-					}
-					reqMsg, _ := network.NewMessage(network.MsgFileRequest, req)
-					_ = send(reqMsg)
+					request(PlanUpdate, "conflict resolved in favor of "+peerName)
 				}
 			} else {
-				// No conflict, check which is newer
-				if remoteFile.ModTime.After(localInfo.ModTime()) {
+				// No conflict, check which is newer, on our clock
+				if e.localClock(peerName, remoteFile.ModTime).After(localInfo.ModTime()) {
 					// Remote is newer, request it
-					req := network.FileRequestMessage{
-						FolderPath: fileList.FolderPath,
-						FolderName: fileList.FolderName,
-						RelPath:    remoteFile.RelPath,
-					}
-					reqMsg, _ := network.NewMessage(network.MsgFileRequest, req)
-					_ = send(reqMsg)
+					request(PlanUpdate, "newer on "+peerName)
 				}
 			}
+		} else if remoteFile.LinkOf != "" && pkgRoot == "" {
+			// The same contents; linked here too if it is a hard link on the peer
+			e.linkFromList(localFolderPath, remoteFile, listed[remoteFile.LinkOf], item, peerName)
+		}
+	}
+
+	e.sendTombstones(localFolderPath, deletes, peerName, send)
+
+	// Request only what fits on the volume; the list is applied again once
+	// there is room for the rest
+	if budget, err := e.spaceBudget(localFolderPath); err == nil && len(requests) > 0 {
+		var needed, skipped int64
+		fits := requests[:0]
+		for _, r := range requests {
+			if needed+r.size > budget {
+				skipped += r.size
+				continue
+			}
+			needed += r.size
+			fits = append(fits, r)
 		}
+		if len(fits) < len(requests) {
+			e.pauseForSpace(localFolderPath, budget-needed, skipped)
+			e.holdForSpace(localFolderPath, peerName, &heldList{fileList: fileList, connID: connID, send: send})
+		}
+		requests = fits
+	}
+
+	// Insure against a bad sync round before applying a large one
+	e.snapshotBeforeBatch(localFolderPath, peerName, len(requests))
+	for root, pkg := range pkgs {
+		e.assemblePackage(localFolderPath, root, pkg, peerName, !fileList.Journal)
+	}
+	for _, r := range requests {
+		e.transfers.enqueue(connID, send, r.req, r.priority)
+	}
+}
+
+// conflictReason explains why a differing file is a conflict
+func (e *Engine) conflictReason(folderPath, relPath string, reverify bool) string {
+	switch {
+	case reverify:
+		return "differs after a state generation change"
+	case e.state.GetFileState(folderPath, relPath) == nil:
+		return "differs with no sync history"
+	default:
+		return "changed on both sides"
 	}
 }
 
-func (e *Engine) handleFileRequest(req network.FileRequestMessage, send func(*network.Message) error) {
+// needsReverify reports whether either side of a folder has started a new
+// state generation since the last file list exchanged with this peer, or a
+// reconciliation with the peer is still pending
+func (e *Engine) needsReverify(localFolderPath string, fileList network.FileListMessage, peerName string) bool {
+	if peerName == "" || fileList.Generation == 0 {
+		return false
+	}
+
+	known := e.state.GetPeerGenerations(localFolderPath)[peerName]
+	remoteChanged := known != 0 && known != fileList.Generation
+
+	seenOfUs := fileList.PeerGenerations[e.cfg.Device.Name]
+	localChanged := seenOfUs != 0 && seenOfUs != e.state.GetGeneration(localFolderPath)
+	pending := e.reconcile.Get(localFolderPath, peerName) != nil
+
+	if remoteChanged || localChanged || pending {
+		log.Info().
+			Str("folder_id", localFolderPath).
+			Str("peer_id", peerName).
+			Bool("remoteChanged", remoteChanged).
+			Bool("localChanged", localChanged).
+			Msg("State generation changed, re-verifying all files")
+		return true
+	}
+	return false
+}
+
+// handleFileRequest sends a requested file to a peer. Errors are returned so
+// they count against the folder.
+func (e *Engine) handleFileRequest(req network.FileRequestMessage, connID string, send func(*network.Message) error) error {
 	fullPath := filepath.Join(req.FolderPath, req.RelPath)
 
-	// Check if it's a directory (skip directories)
+	if !e.propagationAllowed("serve request", fullPath) {
+		return nil
+	}
+
 	info, err := os.Stat(fullPath)
 	if err != nil {
 		log.Error().Err(err).Str("path", fullPath).Msg("Failed to stat requested file")
-		return
-	}
-	if info.IsDir() {
-		log.Debug().Str("path", fullPath).Msg("Skipping directory in file request")
-		return
+		return err
 	}
 
 	// Check if path should be ignored
-	if e.cfg.ShouldIgnore(fullPath) {
+	if e.cfg.ShouldIgnore(fullPath) || e.ignores.Ignored(req.FolderPath, req.RelPath) {
 		log.Debug().Str("path", fullPath).Msg("Skipping ignored file in request")
-		return
+		return nil
 	}
 
-	// Read file
-	data, err := os.ReadFile(fullPath)
+	// Peers ask again with our next list, once the database is consistent
+	if !info.IsDir() && e.databaseHeld(req.FolderPath, req.RelPath) {
+		return nil
+	}
+
+	// Directories are answered with their metadata
+	if info.IsDir() {
+		dir, err := e.dirMessage(req.FolderPath, req.RelPath)
+		if err != nil {
+			return err
+		}
+		msg, err := network.NewMessage(network.MsgDirCreate, dir)
+		if err != nil {
+			return err
+		}
+		return send(msg)
+	}
+
+	// Large files go in parts a peer can resume from, if it understands them
+	if info.Size() > network.ChunkSize && network.VersionAtLeast(e.connVersion(connID), network.ResumeVersion) {
+		if err := e.sendFileParts(connID, send, req); err != nil {
+			log.Error().Err(err).Str("path", fullPath).Str("peer_id", e.connName(connID)).Msg("Failed to send requested file")
+			return err
+		}
+		return nil
+	}
+
+	msg, err := e.fileDataMessage(req.FolderPath, req.RelPath)
 	if err != nil {
 		log.Error().Err(err).Str("path", fullPath).Msg("Failed to read requested file")
-		return
+		return err
 	}
 
-	fi, err := fileutil.GetFileInfo(fullPath, req.FolderPath)
+	if err := e.sendFileData(connID, send, msg); err != nil {
+		log.Error().Err(err).Str("path", fullPath).Str("peer_id", e.connName(connID)).Str("transfer_id", logging.TransferID(msg.FolderName, msg.RelPath, msg.Hash)).Msg("Failed to send requested file")
+		return err
+	}
+	return nil
+}
+
+// fileDataMessage reads a local file into a file data message
+func (e *Engine) fileDataMessage(folderPath, relPath string) (network.FileDataMessage, error) {
+	fullPath := filepath.Join(folderPath, relPath)
+
+	data, err := fileutil.ReadFileContext(e.folderContext(folderPath), fullPath)
 	if err != nil {
-		log.Error().Err(err).Str("path", fullPath).Msg("Failed to get file info")
-		return
+		return network.FileDataMessage{}, fmt.Errorf("failed to read file: %w", err)
 	}
 
-	msg := network.FileDataMessage{
-		FolderPath: req.FolderPath,
-		FolderName: getFolderName(req.FolderPath),
-		RelPath:    req.RelPath,
-		Size:       fi.Size,
-		ModTime:    fi.ModTime,
-		Permission: uint32(fi.Permission),
-		Hash:       fi.Hash,
-		Data:       data,
+	fi, err := e.localFileInfo(folderPath, fullPath)
+	if err != nil {
+		return network.FileDataMessage{}, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	return network.FileDataMessage{
+		FolderPath:  folderPath,
+		FolderName:  e.folderName(folderPath),
+		RelPath:     relPath,
+		Size:        fi.Size,
+		ModTime:     fi.ModTime,
+		Birthtime:   fi.Birthtime,
+		Permission:  uint32(fi.Permission),
+		Hash:        fi.Hash,
+		HashAlgo:    fi.HashAlgo,
+		ContentHash: e.contentHash(folderPath, fullPath),
+		Data:        data,
+		Xattrs:      fi.Xattrs,
+	}, nil
+}
+
+// receiveFileData writes received file data unless its folder is backing off,
+// counting write failures against the folder
+func (e *Engine) receiveFileData(fileData network.FileDataMessage, peerName string) error {
+	localFolderPath := e.findLocalFolderByName(fileData.FolderName)
+	if localFolderPath == "" {
+		return e.handleFileData(fileData, peerName)
+	}
+	if e.pipeline(localFolderPath).backingOff() {
+		return errFolderBackoff
+	}
+	if !e.fitsOnDisk(localFolderPath, fileData.Size) {
+		return errLowDiskSpace
 	}
 
-	dataMsg, _ := network.NewMessage(network.MsgFileData, msg)
-	_ = send(dataMsg)
+	err := e.handleFileData(fileData, peerName)
+	if err != nil && !isRefusal(err) {
+		e.folderError(localFolderPath, err)
+	}
+	return err
 }
 
-func (e *Engine) handleFileData(fileData network.FileDataMessage, peerName string) {
+// handleFileData writes received file data. It returns an error when the file
+// should have been written but could not be, or when it is refused for being
+// ignored, too large or in conflict here; other skipped files return nil.
+func (e *Engine) handleFileData(fileData network.FileDataMessage, peerName string) error {
 	// Check if we're allowed to receive files
 	if !e.cfg.CanReceive() {
 		log.Debug().Str("file", fileData.RelPath).Msg("Ignoring incoming file (send_only mode)")
-		return
+		return nil
 	}
 
 	// Map remote folder to local folder by name
@@ -635,39 +1748,190 @@ func (e *Engine) handleFileData(fileData network.FileDataMessage, peerName strin
 		log.Debug().
 			Str("folderName", fileData.FolderName).
 			Msg("No matching local folder for received file")
-		return
+		return nil
+	}
+
+	// A peer that hasn't picked up our ignore rules yet may still send these
+	if e.ignores.Ignored(localFolderPath, fileData.RelPath) {
+		log.Debug().Str("file", fileData.RelPath).Msg("Ignoring received file matching ignore rules")
+		return fmt.Errorf("%s is %w by this Mac's rules", fileData.RelPath, ErrIgnored)
+	}
+	if e.tooLarge(localFolderPath, fileData.RelPath, fileData.Size, peerName) {
+		return fmt.Errorf("%s is %w for this Mac's max_file_size", fileData.RelPath, ErrTooLarge)
+	}
+	if e.tooOld(localFolderPath, fileData.RelPath, fileData.ModTime, peerName) {
+		return fmt.Errorf("%s is %w by this Mac's max_age", fileData.RelPath, ErrIgnored)
+	}
+	if e.databaseBusy(localFolderPath, fileData.RelPath, e.leadingData(localFolderPath, fileData), peerName) {
+		return nil
+	}
+
+	// Only accept files outside a sparse selection if they were fetched on demand
+	onDemand := false
+	if folderCfg := e.cfg.GetFolder(localFolderPath); folderCfg != nil && !folderCfg.IncludesPath(fileData.RelPath) {
+		if onDemand = e.fetchedOnDemand(localFolderPath, fileData.RelPath); !onDemand {
+			log.Debug().Str("file", fileData.RelPath).Msg("Ignoring file outside sparse selection")
+			return nil
+		}
+	}
+
+	// Never overwrite a local file whose name differs only in case
+	if existing := e.caseCollision(localFolderPath, fileData.RelPath); existing != "" {
+		e.raiseCaseCollision(localFolderPath, fileData.RelPath, existing, &ConflictFile{
+			Size:       fileData.Size,
+			ModTime:    fileData.ModTime,
+			Hash:       fileData.Hash,
+			HashAlgo:   fileData.HashAlgo,
+			DeviceName: peerName,
+		})
+		return nil
+	}
+
+	// A conflict waiting for the user keeps the local copy until it is resolved
+	if e.conflict.Pending(localFolderPath, fileData.RelPath) {
+		log.Debug().Str("file", fileData.RelPath).Str("folder_id", localFolderPath).Msg("Not writing received file over a pending conflict")
+		return fmt.Errorf("%s has a %w", fileData.RelPath, ErrConflictPending)
 	}
 
 	fullPath := filepath.Join(localFolderPath, fileData.RelPath)
 
-	// Ensure directory exists
-	dir := filepath.Dir(fullPath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		log.Error().Err(err).Str("dir", dir).Msg("Failed to create directory")
-		return
+	// Data the peer pushed unasked is staged like a listed change; approving
+	// it fetches the file again
+	if !onDemand && !e.takeApproved(fullPath, fileData.Hash) {
+		item := PlanItem{
+			FolderPath:       localFolderPath,
+			RelPath:          fileData.RelPath,
+			PeerName:         peerName,
+			Reason:           "new on " + peerName,
+			RemoteHash:       fileData.Hash,
+			RemoteFolderPath: fileData.FolderPath,
+			FolderName:       fileData.FolderName,
+		}
+		action := PlanAdd
+		if localHash, err := e.hashFile(localFolderPath, fullPath); err == nil {
+			action = PlanUpdate
+			item.Reason = "changed on " + peerName
+			item.LocalHash = localHash
+		}
+		if !e.planAllowed(action, item) {
+			return nil
+		}
 	}
 
-	// Write file with permissions (file will be owned by current user automatically)
-	if err := os.WriteFile(fullPath, fileData.Data, os.FileMode(fileData.Permission)); err != nil {
-		log.Error().Err(err).Str("path", fullPath).Msg("Failed to write file")
-		return
+	// Lift a lock on the local copy for the write, and put it back after
+	if e.cfg.Sync.UnlockReadOnly && writeBlocked(fullPath) {
+		restore, err := unlockForWrite(fullPath)
+		defer restore()
+		if err != nil {
+			log.Warn().Err(err).Str("path", fullPath).Msg("Failed to unlock file")
+		} else {
+			log.Info().Str("path", fullPath).Msg("Unlocked file to update it")
+		}
 	}
 
-	// Set modification time
-	if err := os.Chtimes(fullPath, fileData.ModTime, fileData.ModTime); err != nil {
-		log.Warn().Err(err).Str("path", fullPath).Msg("Failed to set mod time")
+	// Wait for the folder's disk to take another file
+	applied, ok := e.startApply(localFolderPath)
+	defer applied()
+	if !ok {
+		return e.ctx.Err()
 	}
 
-	// Update state (use local folder path)
-	e.state.UpdateFileState(localFolderPath, &FileState{
-		RelPath:    fileData.RelPath,
-		Hash:       fileData.Hash,
-		Size:       fileData.Size,
-		ModTime:    fileData.ModTime,
-		Permission: os.FileMode(fileData.Permission),
-		SyncedAt:   time.Now(),
-		SyncedFrom: peerName,
-	})
+	// Files of a package being assembled go into its copy
+	pkg, dest := e.packages.target(localFolderPath, fileData.RelPath, fullPath)
+
+	// Stage the file so it is verified and scanned before replacing anything
+	var staged string
+	var err error
+	if fileData.IsChunked {
+		staged, err = e.stageParts(fileData, localFolderPath)
+	} else {
+		e.checkpoints.discard(fullPath) // A partial download of another version
+		staged, err = stageIncoming(fileData, localFolderPath)
+	}
+	if err != nil && isUnwritable(err) {
+		e.markUnwritable(localFolderPath, fileData, peerName, err)
+		return nil
+	}
+	if err != nil {
+		log.Error().Err(err).Str("path", fullPath).Msg("Failed to stage file")
+		return err
+	}
+	defer func() { _ = os.Remove(staged) }() // No-op once moved into place
+
+	// Verify the staged copy; a corrupt one is discarded and fetched again.
+	// A hybrid peer's size and mod time hash comes with one of the contents.
+	err = verifyReceived(staged, fileData.Hash, fileData.HashAlgo)
+	if err == nil {
+		err = verifyReceived(staged, fileData.ContentHash, fileutil.HashAlgorithm)
+	}
+	if err != nil {
+		e.noteCorrupt(fullPath)
+
+		e.addActivity(&SyncActivity{
+			Type:       "corrupt",
+			FileName:   filepath.Base(fileData.RelPath),
+			FolderPath: localFolderPath,
+			RelPath:    fileData.RelPath,
+			PeerName:   peerName,
+			Timestamp:  time.Now(),
+		})
+
+		log.Error().
+			Err(err).
+			Str("file", fileData.RelPath).
+			Str("folder_id", localFolderPath).
+			Str("peer_id", peerName).
+			Str("transfer_id", logging.TransferID(fileData.FolderName, fileData.RelPath, fileData.Hash)).
+			Msg("Received file failed verification")
+		return err
+	}
+	e.clearCorrupt(fullPath)
+
+	// Rejected files are quarantined; retrying the send would not help
+	if err := e.scanStaged(staged, localFolderPath, fileData.RelPath, peerName); err != nil {
+		e.quarantineStaged(staged, localFolderPath, fileData.RelPath, peerName, err)
+		return nil
+	}
+
+	if pkg != nil {
+		return e.placePackageFile(pkg, staged, dest, fileData, peerName)
+	}
+
+	e.keepVersion(localFolderPath, fileData.RelPath)
+
+	// Move into place (file will be owned by current user automatically)
+	if err := placeStaged(staged, fullPath); err != nil {
+		if isUnwritable(err) {
+			e.markUnwritable(localFolderPath, fileData, peerName, err)
+			return nil
+		}
+		log.Error().Err(err).Str("path", fullPath).Msg("Failed to write file")
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	e.state.ClearUnwritable(localFolderPath, fileData.RelPath)
+	e.publishProgress(localFolderPath, fileData.RelPath, peerName, "receive", fileData.Size, fileData.Size)
+	e.peerDB.recordTransfer(peerName, false, fileData.Size)
+	if isFinderView(fileData.RelPath) {
+		e.finderViews.wrote(fullPath, fileData.ModTime)
+	}
+
+	// Update state (use local folder path). A file fetched on demand is a
+	// local copy outside the selection, so it isn't tracked.
+	if onDemand {
+		e.doneOnDemand(localFolderPath, fileData.RelPath)
+	} else {
+		hash, hashAlgo := e.receivedHash(localFolderPath, fullPath, fileData)
+		e.state.UpdateFileState(localFolderPath, &FileState{
+			RelPath:    fileData.RelPath,
+			Hash:       hash,
+			HashAlgo:   hashAlgo,
+			Size:       fileData.Size,
+			ModTime:    fileData.ModTime,
+			Permission: os.FileMode(fileData.Permission),
+			SyncedAt:   time.Now(),
+			SyncedFrom: peerName,
+		})
+	}
 
 	// Record activity
 	e.addActivity(&SyncActivity{
@@ -681,9 +1945,13 @@ func (e *Engine) handleFileData(fileData network.FileDataMessage, peerName strin
 
 	log.Info().
 		Str("file", fileData.RelPath).
-		Str("folder", localFolderPath).
-		Str("from", peerName).
+		Str("folder_id", localFolderPath).
+		Str("peer_id", peerName).
+		Str("transfer_id", logging.TransferID(fileData.FolderName, fileData.RelPath, fileData.Hash)).
 		Msg("Received file")
+
+	e.linkWaiting(localFolderPath, fileData.RelPath, fileData.Hash)
+	return nil
 }
 
 func (e *Engine) handleRemoteDelete(del network.FileDeleteMessage, peerName string) {
@@ -702,16 +1970,54 @@ func (e *Engine) handleRemoteDelete(del network.FileDeleteMessage, peerName stri
 		return
 	}
 
+	// Deletes outside a sparse selection or of ignored files don't concern us
+	if folderCfg := e.cfg.GetFolder(localFolderPath); folderCfg != nil && !folderCfg.IncludesPath(del.RelPath) {
+		return
+	}
+	if !del.Ignored && e.ignores.Ignored(localFolderPath, del.RelPath) {
+		return
+	}
+	// Nothing is deleted before a first sync is confirmed
+	if rec := e.reconcile.Get(localFolderPath, peerName); rec != nil && rec.Reason == ReasonFirstSync {
+		log.Debug().Str("file", del.RelPath).Msg("Ignoring delete before first sync is confirmed")
+		return
+	}
+	// A cleanup only removes copies that were synced, not files kept here on purpose
+	if del.Ignored && e.state.GetFileState(localFolderPath, del.RelPath) == nil {
+		return
+	}
+
 	fullPath := filepath.Join(localFolderPath, del.RelPath)
 
-	// Delete local file
-	if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
-		log.Error().Err(err).Str("path", fullPath).Msg("Failed to delete file")
+	localHash, _ := e.hashFile(localFolderPath, fullPath)
+	if !e.planAllowed(PlanDelete, PlanItem{
+		FolderPath: localFolderPath,
+		RelPath:    del.RelPath,
+		PeerName:   peerName,
+		Reason:     "deleted on " + peerName,
+		LocalHash:  localHash,
+	}) {
+		return
+	}
+
+	applied, ok := e.startApply(localFolderPath)
+	defer applied()
+	if !ok {
+		return
+	}
+
+	// Delete local file, or directory once the peer's deletes have emptied it
+	if err := e.removeDeleted(localFolderPath, del.RelPath); err != nil {
+		if errors.Is(err, errDirNotEmpty) {
+			log.Info().Str("path", fullPath).Msg("Keeping deleted directory, it holds files the peer didn't delete")
+		} else {
+			log.Error().Err(err).Str("path", fullPath).Msg("Failed to delete file")
+		}
 		return
 	}
 
 	// Update state
-	e.state.RemoveFileState(localFolderPath, del.RelPath)
+	e.state.MarkDeleted(localFolderPath, del.RelPath)
 
 	// Record activity
 	e.addActivity(&SyncActivity{
@@ -725,25 +2031,22 @@ func (e *Engine) handleRemoteDelete(del network.FileDeleteMessage, peerName stri
 
 	log.Info().
 		Str("file", del.RelPath).
-		Str("folder", localFolderPath).
-		Str("from", peerName).
+		Str("folder_id", localFolderPath).
+		Str("peer_id", peerName).
 		Msg("Deleted file (remote request)")
 }
 
 func (e *Engine) addActivity(activity *SyncActivity) {
 	e.activityMu.Lock()
-	defer e.activityMu.Unlock()
-
 	e.activities = append([]*SyncActivity{activity}, e.activities...)
 
 	// Trim to max
 	if len(e.activities) > e.maxActivities {
 		e.activities = e.activities[:e.maxActivities]
 	}
+	e.activityMu.Unlock()
 
-	if e.onActivity != nil {
-		e.onActivity(activity)
-	}
+	e.events.Publish(Event{Kind: EventActivity, Activity: activity})
 }
 
 // GetActivities returns recent sync activities
@@ -774,6 +2077,81 @@ func (e *Engine) ResolveConflict(conflictID string, resolution ConflictResolutio
 	return e.conflict.ResolveConflict(conflict, resolution)
 }
 
+// rememberListing keeps a peer's full file list for browsing unsynced
+// subfolders, backfilling newly selected ones, previews and restoring held
+// deletes
+func (e *Engine) rememberListing(localFolderPath string, fileList network.FileListMessage, connID, peerName string, send func(*network.Message) error) {
+	e.remoteMu.Lock()
+	defer e.remoteMu.Unlock()
+	e.remoteLists[localFolderPath] = &RemoteListing{
+		PeerName:         peerName,
+		RemoteFolderPath: fileList.FolderPath,
+		FolderName:       fileList.FolderName,
+		Files:            fileList.Files,
+		ReceivedAt:       time.Now(),
+		held:             &heldList{fileList: fileList, connID: connID, send: send},
+	}
+}
+
+// RemoteBrowse returns the latest remote listing for a local folder, or nil if
+// no peer has sent one yet
+func (e *Engine) RemoteBrowse(folderPath string) *RemoteListing {
+	e.remoteMu.RLock()
+	defer e.remoteMu.RUnlock()
+	return e.remoteLists[folderPath]
+}
+
+// pruneDeselected removes local copies of tracked files that are no longer in
+// the folder's sparse selection. Files modified since they were synced are kept,
+// and so are files in excluded subfolders, which just stop being tracked.
+func (e *Engine) pruneDeselected(folderPath string) {
+	folderCfg := e.cfg.GetFolder(folderPath)
+	if folderCfg == nil || !e.propagationAllowed("prune deselected subfolders", folderPath) {
+		return
+	}
+
+	for relPath, fileState := range e.state.GetAllFiles(folderPath) {
+		if folderCfg.IncludesPath(relPath) {
+			continue
+		}
+		if folderCfg.ExcludedBy(relPath) != "" {
+			e.state.RemoveFileState(folderPath, relPath)
+			continue
+		}
+
+		fullPath := filepath.Join(folderPath, relPath)
+		if hash, err := fileutil.HashFileWith(fullPath, fileState.Algorithm()); err == nil && hash != fileState.Hash {
+			log.Warn().Str("path", fullPath).Msg("Keeping locally modified file outside sparse selection")
+			e.state.RemoveFileState(folderPath, relPath)
+			continue
+		}
+
+		if err := e.removeDeleted(folderPath, relPath); err != nil {
+			log.Error().Err(err).Str("path", fullPath).Msg("Failed to remove deselected file")
+			continue
+		}
+		e.state.RemoveFileState(folderPath, relPath)
+	}
+}
+
+// fileKey identifies a file across folders
+func fileKey(folderPath, relPath string) string {
+	return folderPath + "\x00" + relPath
+}
+
+// broadcastPayload sends a message to all connected peers, incoming and outgoing
+func (e *Engine) broadcastPayload(msgType network.MessageType, payload interface{}) {
+	if err := e.server.BroadcastPayload(msgType, payload); err != nil {
+		log.Error().Err(err).Str("type", msgType.String()).Msg("Failed to broadcast")
+	}
+
+	for _, conn := range e.client.GetConnections() {
+		if err := conn.SendPayload(msgType, payload); err != nil {
+			log.Error().Err(err).Str("peer_id", e.connName(conn.Address)).Str("type", msgType.String()).Msg("Failed to send")
+		}
+	}
+}
+
 // GetWatcher returns the file watcher
 func (e *Engine) GetWatcher() *Watcher {
 	return e.watcher
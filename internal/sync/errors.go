@@ -0,0 +1,31 @@
+package sync
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jseidel/mac-profile-sync/internal/network"
+)
+
+// Kinds of error the engine returns, told apart with errors.Is. They are the
+// network package's, so errors a peer reported match them too.
+var (
+	ErrPeerOffline     = network.ErrPeerOffline
+	ErrUnauthorized    = network.ErrUnauthorized
+	ErrTooLarge        = network.ErrTooLarge
+	ErrIgnored         = network.ErrIgnored
+	ErrConflictPending = network.ErrConflictPending
+)
+
+// isRefusal reports whether err is a file this Mac declined rather than
+// failed to write, which doesn't count against its folder and which a peer
+// shouldn't send again
+func isRefusal(err error) bool {
+	return network.ErrorCode(err) != ""
+}
+
+// isCanceled reports whether err is work given up because the engine is
+// stopping or the folder was removed, which isn't a failure
+func isCanceled(err error) bool {
+	return errors.Is(err, context.Canceled)
+}
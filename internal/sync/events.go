@@ -0,0 +1,156 @@
+package sync
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/network"
+)
+
+// EventKind identifies what an engine event reports
+type EventKind string
+
+const (
+	EventActivity  EventKind = "activity"  // A file was sent, received, deleted, or rejected
+	EventProgress  EventKind = "progress"  // Bytes moved for a file transfer
+	EventPeer      EventKind = "peer"      // A peer connected or disconnected
+	EventConflict  EventKind = "conflict"  // A conflict was detected
+	EventError     EventKind = "error"     // Something needs the user's attention
+	EventLifecycle EventKind = "lifecycle" // The engine started or stopped
+)
+
+// Lifecycle states carried by lifecycle events
+const (
+	LifecycleStarted = "started"
+	LifecycleStopped = "stopped"
+)
+
+// Event is published on the engine's event bus. The payload field matching
+// Kind is set; the others are empty.
+type Event struct {
+	Kind      EventKind      `json:"kind"`
+	Time      time.Time      `json:"time"`
+	Activity  *SyncActivity  `json:"activity,omitempty"`
+	Progress  *ProgressEvent `json:"progress,omitempty"`
+	Peer      *PeerEvent     `json:"peer,omitempty"`
+	Conflict  *Conflict      `json:"conflict,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	ErrorKind string         `json:"error_kind,omitempty"` // Code of the error's kind (see network.ErrorCode), if it has one
+	Lifecycle string         `json:"lifecycle,omitempty"`
+}
+
+// ProgressEvent reports bytes moved for one file transfer
+type ProgressEvent struct {
+	FolderPath string `json:"folder_path"`
+	RelPath    string `json:"rel_path"`
+	PeerName   string `json:"peer_name"`
+	Direction  string `json:"direction"` // send | receive
+	Bytes      int64  `json:"bytes"`
+	Total      int64  `json:"total"`
+}
+
+// PeerEvent reports a peer connecting or disconnecting
+type PeerEvent struct {
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+	Direction string `json:"direction"` // incoming | outgoing
+	Connected bool   `json:"connected"`
+}
+
+// EventBus fans engine events out to subscribers. Publishing never blocks:
+// a subscriber whose buffer is full misses the event.
+type EventBus struct {
+	mu   sync.RWMutex
+	subs map[int]*subscription
+	next int
+}
+
+type subscription struct {
+	ch    chan Event
+	kinds map[EventKind]bool // Empty = all kinds
+}
+
+// NewEventBus creates an event bus with no subscribers
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[int]*subscription)}
+}
+
+// Subscribe returns a channel that receives events of the given kinds (all
+// kinds when none are given) and a function that ends the subscription
+func (b *EventBus) Subscribe(buffer int, kinds ...EventKind) (<-chan Event, func()) {
+	sub := &subscription{
+		ch:    make(chan Event, buffer),
+		kinds: make(map[EventKind]bool),
+	}
+	for _, k := range kinds {
+		sub.kinds[k] = true
+	}
+
+	b.mu.Lock()
+	id := b.next
+	b.next++
+	b.subs[id] = sub
+	b.mu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, id)
+			b.mu.Unlock()
+			close(sub.ch)
+		})
+	}
+}
+
+// Publish delivers an event to every interested subscriber
+func (b *EventBus) Publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, sub := range b.subs {
+		if len(sub.kinds) > 0 && !sub.kinds[ev.Kind] {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+		}
+	}
+}
+
+// Events returns the engine's event bus
+func (e *Engine) Events() *EventBus {
+	return e.events
+}
+
+// publishError reports an error that needs the user's attention
+func (e *Engine) publishError(err error) {
+	e.events.Publish(Event{Kind: EventError, Error: err.Error(), ErrorKind: network.ErrorCode(err)})
+}
+
+// publishPeer reports a peer connecting or disconnecting
+func (e *Engine) publishPeer(name, address, direction string, connected bool) {
+	e.events.Publish(Event{Kind: EventPeer, Peer: &PeerEvent{
+		Name:      name,
+		Address:   address,
+		Direction: direction,
+		Connected: connected,
+	}})
+}
+
+// publishProgress reports bytes moved for a file transfer
+func (e *Engine) publishProgress(folderPath, relPath, peerName, direction string, bytes, total int64) {
+	e.events.Publish(Event{Kind: EventProgress, Progress: &ProgressEvent{
+		FolderPath: folderPath,
+		RelPath:    relPath,
+		PeerName:   peerName,
+		Direction:  direction,
+		Bytes:      bytes,
+		Total:      total,
+	}})
+}
@@ -0,0 +1,231 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultExclusionTTL is how long a path stays excluded when no duration is
+// given
+const DefaultExclusionTTL = time.Hour
+
+// exclusionCheckInterval is how often the daemon picks up exclusions made
+// with the exclude command and lets expired ones sync again
+const exclusionCheckInterval = 5 * time.Second
+
+// TempExclusion is a single file or directory kept out of syncing for a
+// while, without editing the config
+type TempExclusion struct {
+	FolderPath string    `json:"folder_path"`
+	RelPath    string    `json:"rel_path"`
+	Until      time.Time `json:"until"`
+}
+
+// Expired reports whether the exclusion has run out
+func (x TempExclusion) Expired() bool {
+	return !time.Now().Before(x.Until)
+}
+
+// tempExclusionsPath is where temporary exclusions are saved for the daemon
+func tempExclusionsPath() string {
+	return filepath.Join(config.ConfigDir(), "exclusions.json")
+}
+
+// LoadTempExclusions reads the saved temporary exclusions, expired ones
+// included, sorted by folder and path
+func LoadTempExclusions() ([]TempExclusion, error) {
+	data, err := os.ReadFile(tempExclusionsPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read exclusions: %w", err)
+	}
+
+	var list []TempExclusion
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse exclusions: %w", err)
+	}
+	sortExclusions(list)
+	return list, nil
+}
+
+// SaveTempExclusions writes temporary exclusions, removing the file once
+// there are none
+func SaveTempExclusions(list []TempExclusion) error {
+	if len(list) == 0 {
+		if err := os.Remove(tempExclusionsPath()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove exclusions: %w", err)
+		}
+		return nil
+	}
+
+	sortExclusions(list)
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal exclusions: %w", err)
+	}
+	if err := os.WriteFile(tempExclusionsPath(), data, 0644); err != nil {
+		return fmt.Errorf("failed to write exclusions: %w", err)
+	}
+	return nil
+}
+
+func sortExclusions(list []TempExclusion) {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].FolderPath != list[j].FolderPath {
+			return list[i].FolderPath < list[j].FolderPath
+		}
+		return list[i].RelPath < list[j].RelPath
+	})
+}
+
+// SetTempExclusion excludes a path inside a synced folder for d, or lets it
+// sync again if d is 0, and saves the change for the daemon. Returns the
+// exclusion.
+func SetTempExclusion(cfg *config.Config, path string, d time.Duration) (TempExclusion, error) {
+	abs, err := filepath.Abs(fileutil.ExpandHome(path))
+	if err != nil {
+		return TempExclusion{}, fmt.Errorf("invalid path: %w", err)
+	}
+	folder, relPath := cfg.FolderContaining(abs)
+	if folder == nil {
+		return TempExclusion{}, fmt.Errorf("not inside any synced folder: %s", path)
+	}
+	if relPath == "." {
+		return TempExclusion{}, fmt.Errorf("%s is a synced folder; pause it instead", folder.Path)
+	}
+
+	list, err := LoadTempExclusions()
+	if err != nil {
+		return TempExclusion{}, err
+	}
+
+	x := TempExclusion{FolderPath: folder.Path, RelPath: relPath, Until: time.Now().Add(d)}
+	found := false
+	kept := list[:0]
+	for _, other := range list {
+		if other.FolderPath == x.FolderPath && other.RelPath == x.RelPath {
+			found = found || !other.Expired()
+			continue
+		}
+		if !other.Expired() {
+			kept = append(kept, other)
+		}
+	}
+	if d > 0 {
+		kept = append(kept, x)
+	} else if !found {
+		return TempExclusion{}, fmt.Errorf("%s isn't excluded", abs)
+	}
+	return x, SaveTempExclusions(kept)
+}
+
+// tempExcluded returns the exclusion in force for a path or a directory it
+// is in, if any
+func tempExcluded(list []TempExclusion, folderPath, relPath string) (TempExclusion, bool) {
+	for _, x := range list {
+		if x.FolderPath != folderPath || x.Expired() {
+			continue
+		}
+		if relPath == x.RelPath || strings.HasPrefix(relPath, x.RelPath+string(filepath.Separator)) {
+			return x, true
+		}
+	}
+	return TempExclusion{}, false
+}
+
+// ExcludePath stops syncing a file or directory in a synced folder for d,
+// e.g. a database an app keeps rewriting, without editing the config. Once
+// d has passed, or IncludePath is called, it syncs again.
+func (e *Engine) ExcludePath(path string, d time.Duration) error {
+	if d <= 0 {
+		d = DefaultExclusionTTL
+	}
+	x, err := SetTempExclusion(e.cfg, path, d)
+	if err != nil {
+		return err
+	}
+	e.reloadExclusions()
+
+	log.Info().
+		Str("folder_id", x.FolderPath).
+		Str("file", x.RelPath).
+		Time("until", x.Until).
+		Msg("Path excluded from syncing for a while")
+	return nil
+}
+
+// IncludePath lets a path excluded with ExcludePath sync again
+func (e *Engine) IncludePath(path string) error {
+	if _, err := SetTempExclusion(e.cfg, path, 0); err != nil {
+		return err
+	}
+	e.reloadExclusions()
+	return nil
+}
+
+// TemporaryExclusions returns the exclusions in force
+func (e *Engine) TemporaryExclusions() []TempExclusion {
+	return e.ignores.TempExclusions()
+}
+
+// reloadExclusions applies the saved exclusions. Folders with a path that
+// stopped being excluded catch up on what changed there meanwhile.
+func (e *Engine) reloadExclusions() {
+	list, err := LoadTempExclusions()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to load exclusions")
+		return
+	}
+
+	var active []TempExclusion
+	for _, x := range list {
+		if !x.Expired() {
+			active = append(active, x)
+		}
+	}
+	if len(active) < len(list) {
+		if err := SaveTempExclusions(active); err != nil {
+			log.Warn().Err(err).Msg("Failed to save exclusions")
+		}
+	}
+
+	ended := make(map[string]bool)
+	for _, x := range e.ignores.SetTempExclusions(active) {
+		log.Info().Str("folder_id", x.FolderPath).Str("file", x.RelPath).Msg("Path syncs again")
+		ended[x.FolderPath] = true
+	}
+	for folderPath := range ended {
+		if !e.IsFolderPaused(folderPath) {
+			e.catchUp(folderPath)
+		}
+	}
+}
+
+// exclusionLoop picks up exclusions made with the exclude command and
+// lets paths sync again once their exclusion expires
+func (e *Engine) exclusionLoop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(exclusionCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			e.reloadExclusions()
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package sync
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+)
+
+// Explanation traces why a file is or isn't synced, one decision at a time
+type Explanation struct {
+	Path    string
+	Folder  string // Synced folder the file is in; empty if none
+	RelPath string
+	Steps   []ExplainStep
+}
+
+// ExplainStep is one decision point a file passes through
+type ExplainStep struct {
+	Check  string // What was checked, e.g. "ignore rules"
+	OK     bool   // Whether the file gets past it
+	Detail string
+}
+
+// Syncing reports whether the file passed every check
+func (x *Explanation) Syncing() bool {
+	for _, step := range x.Steps {
+		if !step.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// Blockers returns the checks the file didn't pass
+func (x *Explanation) Blockers() []ExplainStep {
+	var blockers []ExplainStep
+	for _, step := range x.Steps {
+		if !step.OK {
+			blockers = append(blockers, step)
+		}
+	}
+	return blockers
+}
+
+func (x *Explanation) add(check string, ok bool, format string, args ...interface{}) {
+	x.Steps = append(x.Steps, ExplainStep{Check: check, OK: ok, Detail: fmt.Sprintf(format, args...)})
+}
+
+// Explain reports why a file is or isn't synced, following the decisions the
+// daemon makes for it, from the configuration and the state the daemon last
+// saved
+func Explain(cfg *config.Config, path string) (*Explanation, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path: %w", err)
+	}
+	x := &Explanation{Path: path}
+
+	if cfg.IsSyncEnabled() {
+		x.add("sync", true, "enabled")
+	} else {
+		x.add("sync", false, "disabled; enable it in 'mac-profile-sync tui'")
+	}
+	daemonPID := config.DaemonPID()
+	if daemonPID != 0 {
+		x.add("daemon", true, "running (pid %d)", daemonPID)
+	} else {
+		x.add("daemon", false, "not running")
+	}
+
+	folder, relPath := cfg.FolderContaining(path)
+	if folder == nil {
+		x.add("folder", false, "not inside any synced folder")
+		return x, nil
+	}
+	x.Folder, x.RelPath = folder.Path, relPath
+	if !folder.Enabled {
+		x.add("folder", false, "%s is disabled", folder.Path)
+		return x, nil
+	}
+	x.add("folder", true, "in %s", folder.Path)
+	if relPath == "." {
+		return x, nil
+	}
+
+	switch cfg.GetSyncDirection() {
+	case config.SyncSendOnly:
+		x.add("direction", false, "send_only: changes here are sent, peers' changes aren't received")
+	case config.SyncMaster:
+		x.add("direction", false, "master: changes here are sent, peers' changes aren't received, and files peers delete are restored on them")
+	case config.SyncReceiveOnly:
+		x.add("direction", false, "receive_only: peers' changes are received, changes here aren't sent")
+	default:
+		x.add("direction", true, "bidirectional")
+	}
+
+	if excluded := folder.ExcludedBy(relPath); excluded != "" {
+		x.add("subfolders", false, "in %s, which is excluded from this folder", excluded)
+		return x, nil
+	}
+	if !folder.IncludesPath(relPath) {
+		x.add("subfolders", false, "outside the selected subfolders (%s)", strings.Join(folder.Subfolders, ", "))
+		return x, nil
+	}
+	if len(folder.Subfolders) > 0 {
+		x.add("subfolders", true, "in a selected subfolder")
+	}
+
+	if rule := explainIgnore(cfg, folder.Path, relPath); rule != "" {
+		x.add("ignore rules", false, "%s", rule)
+		return x, nil
+	}
+	x.add("ignore rules", true, "no rule matches")
+
+	state := NewStateStore()
+	_ = state.Load()
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		if tomb := state.GetTombstone(folder.Path, relPath); tomb != nil {
+			x.add("file", true, "deleted here %s; peers are told to delete their copy", fileutil.FormatTime(tomb.DeletedAt))
+		} else if state.GetFileState(folder.Path, relPath) != nil {
+			x.add("file", true, "deleted since the last sync; the deletion is sent to peers")
+		} else {
+			x.add("file", false, "doesn't exist here; it syncs once it exists on this Mac or a connected peer")
+		}
+	} else if err != nil {
+		x.add("file", false, "can't be read: %v", err)
+		return x, nil
+	} else if info.IsDir() {
+		x.add("file", true, "directory; created on peers, its contents sync file by file")
+	} else if readErr := checkReadable(path); readErr != nil {
+		x.add("file", false, "can't be read: %v", readErr)
+	} else if reason, unreadable := state.GetUnreadable(folder.Path)[relPath]; unreadable {
+		x.add("file", false, "was unreadable (%s); retried every minute", reason)
+	} else {
+		x.add("file", true, "readable, %s", fileutil.FormatSize(info.Size()))
+
+		if limit := cfg.GetMaxFileSize(); limit > 0 && info.Size() > limit {
+			x.add("size", false, "over max_file_size (%s), so it isn't synced", fileutil.FormatSize(limit))
+		} else if reason := databasePending(path); cfg.Sync.ProtectDatabases && reason != "" && isDatabase(path) {
+			x.add("database", false, "SQLite database that %s; it syncs once the app using it checkpoints or closes it", reason)
+		} else if info.Size() > network.MaxFileSize {
+			x.add("size", false, "too large: files over %s can't be sent", fileutil.FormatSize(network.MaxFileSize))
+		} else if info.Size() >= cfg.GetLargeFileSize() {
+			x.add("size", true, "at least large_file_mb, so it transfers after smaller files")
+		}
+
+		if maxAge := cfg.GetMaxAge(); maxAge > 0 && time.Since(info.ModTime()) > maxAge {
+			x.add("age", false, "last modified %s, longer ago than max_age (%s), so it isn't synced", fileutil.FormatTime(info.ModTime()), cfg.Sync.MaxAge)
+		}
+
+		if reason, unwritable := state.GetUnwritable(folder.Path)[relPath]; unwritable {
+			x.add("writable", false, "a peer's update couldn't be written over it (%s); %s", reason, unlockAdvice(path))
+		}
+	}
+
+	explainFolderHolds(x, folder.Path, relPath, daemonPID != 0)
+	explainPeers(x, daemonPID != 0)
+	explainState(x, state, folder.Path, relPath, info)
+	return x, nil
+}
+
+// explainIgnore returns the rule that ignores a path or any directory it's
+// in, or "" if none does. The daemon doesn't look inside ignored directories.
+func explainIgnore(cfg *config.Config, folderPath, relPath string) string {
+	ignores := NewIgnoreRules(cfg)
+	var dirs []string
+	for dir := relPath; dir != "."; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+
+	// Outermost first, like the walk
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel := dirs[i]
+		rule := cfg.IgnoreMatch(filepath.Join(folderPath, rel))
+		if rule == "" {
+			rule = ignores.Match(folderPath, rel)
+		}
+		if rule == "" {
+			continue
+		}
+		if rel != relPath {
+			return fmt.Sprintf("%s is ignored by %s", rel, rule)
+		}
+		return "ignored by " + rule
+	}
+	return ""
+}
+
+// checkReadable opens a file and reads from it
+func checkReadable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	if _, err := f.Read(make([]byte, 1)); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// explainFolderHolds reports what is holding up changes to a folder or file:
+// a paused pipeline, a backup, a restore, approval, or the safe-mode plan
+func explainFolderHolds(x *Explanation, folderPath, relPath string, daemonRunning bool) {
+	if daemonRunning {
+		if statuses, err := LoadFolderStatus(); err == nil {
+			for _, status := range statuses {
+				if status.Path == folderPath && status.State == FolderBackoff {
+					x.add("folder errors", false, "paused after repeated errors until %s: %s", fileutil.FormatClock(status.BackoffUntil), status.LastError)
+				}
+				if status.Path == folderPath && status.State == FolderLowDisk {
+					x.add("disk space", false, "receiving paused until the volume has more than min_free_space free")
+				}
+			}
+		}
+	}
+
+	if lock, _ := LoadBackupLock(); lock != nil && !lock.Expired() {
+		x.add("backup", false, "incoming changes paused: backup lock held by %s until %s", lock.Holder, fileutil.FormatClock(lock.ExpiresAt))
+	}
+
+	reconcile := NewReconcileStore()
+	_ = reconcile.Load()
+	for _, r := range reconcile.List() {
+		if r.FolderPath != folderPath {
+			continue
+		}
+		if r.Reason == ReasonFirstSync {
+			x.add("restore", false, "first sync with %s waits for confirmation; run 'mac-profile-sync reconcile'", r.PeerName)
+		} else if r.Reason == ReasonStale {
+			x.add("restore", false, "folder held because %s was away longer than its missed deletions were remembered; run 'mac-profile-sync reconcile'", r.PeerName)
+		} else {
+			x.add("restore", false, "folder held after a restore was detected with %s; run 'mac-profile-sync reconcile'", r.PeerName)
+		}
+	}
+
+	if pending, err := LoadPlan(ApprovalsPath()); err == nil {
+		if item := findPlanItem(pending, folderPath, relPath); item != nil {
+			x.add("approval", false, "change from %s awaits approval (%s); run 'mac-profile-sync approve'", item.PeerName, item.Reason)
+		}
+	}
+	if plan, err := LoadPlan(PlanPath()); err == nil {
+		if item := findPlanItem(plan, folderPath, relPath); item != nil {
+			x.add("safe mode", false, "recorded in the safe-mode change plan (%s) instead of applied", item.Reason)
+		}
+	}
+}
+
+// findPlanItem returns a plan's item for a file, if it has one
+func findPlanItem(plan *Plan, folderPath, relPath string) *PlanItem {
+	for _, items := range [][]PlanItem{plan.Adds, plan.Updates, plan.Deletes, plan.Conflicts} {
+		for i := range items {
+			if items[i].FolderPath == folderPath && items[i].RelPath == relPath {
+				return &items[i]
+			}
+		}
+	}
+	return nil
+}
+
+// explainPeers reports which peers the file can sync with right now
+func explainPeers(x *Explanation, daemonRunning bool) {
+	if !daemonRunning {
+		return
+	}
+
+	statuses, _ := LoadPeerStatus()
+	connected := make(map[string]bool)
+	var names []string
+	for _, p := range statuses {
+		name := p.Name
+		if name == "" {
+			name = p.Address
+		}
+		if !connected[name] {
+			connected[name] = true
+			names = append(names, name)
+		}
+	}
+
+	known := NewPeerStore()
+	_ = known.Load()
+	var offline []string
+	for _, p := range known.List() {
+		if !connected[p.Name] {
+			offline = append(offline, p.Name)
+		}
+	}
+
+	switch {
+	case len(names) == 0 && len(offline) > 0:
+		x.add("peers", false, "none connected; offline: %s", strings.Join(offline, ", "))
+	case len(names) == 0:
+		x.add("peers", false, "none connected")
+	case len(offline) > 0:
+		x.add("peers", true, "connected: %s; offline: %s", strings.Join(names, ", "), strings.Join(offline, ", "))
+	default:
+		x.add("peers", true, "connected: %s", strings.Join(names, ", "))
+	}
+}
+
+// explainState reports the file's last sync and any conflict decision that
+// keeps it different from a peer's copy
+func explainState(x *Explanation, state *StateStore, folderPath, relPath string, info os.FileInfo) {
+	if fs := state.GetFolderState(folderPath); fs != nil {
+		if resolved, ok := fs.Resolved[relPath]; ok {
+			x.add("conflict", false, "a conflict was resolved with %s %s; these versions stay different until either side changes",
+				resolved.Resolution, fileutil.FormatTime(resolved.ResolvedAt))
+		}
+	}
+
+	if info == nil || info.IsDir() {
+		return
+	}
+	synced := state.GetFileState(folderPath, relPath)
+	switch {
+	case synced == nil:
+		x.add("last sync", true, "never synced; it is sent with the next change or file list")
+	case synced.Size != info.Size() || !synced.ModTime.Equal(info.ModTime()):
+		x.add("last sync", true, "changed since it last synced %s; waiting to be sent", fileutil.FormatTime(synced.SyncedAt))
+	default:
+		from := synced.SyncedFrom
+		if from == "" {
+			from = "unknown"
+		}
+		x.add("last sync", true, "up to date, last synced %s from %s", fileutil.FormatTime(synced.SyncedAt), from)
+	}
+}
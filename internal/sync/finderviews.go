@@ -0,0 +1,98 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+// finderEchoWindow is how long after a received .DS_Store is written that
+// Finder rewriting it counts as Finder reacting to the new layout rather than
+// a change made here
+const finderEchoWindow = 30 * time.Second
+
+// isFinderView reports whether a file holds Finder's view settings. These
+// never raise conflicts: the newest copy wins.
+func isFinderView(relPath string) bool {
+	return filepath.Base(relPath) == config.FinderViewFile
+}
+
+// finderViews remembers the .DS_Store files just written from peers, so
+// Finder's rewrite of them isn't sent back and bounced between Macs
+type finderViews struct {
+	mu       sync.Mutex
+	received map[string]finderWrite // Full path -> last write from a peer
+}
+
+type finderWrite struct {
+	at      time.Time
+	modTime time.Time // Mod time of the peer's copy
+}
+
+func newFinderViews() *finderViews {
+	return &finderViews{received: make(map[string]finderWrite)}
+}
+
+// wrote records a .DS_Store file written from a peer's copy
+func (f *finderViews) wrote(fullPath string, modTime time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	for path, w := range f.received {
+		if now.Sub(w.at) > finderEchoWindow {
+			delete(f.received, path)
+		}
+	}
+	f.received[fullPath] = finderWrite{at: now, modTime: modTime}
+}
+
+// echo returns the peer's mod time if a .DS_Store file was written from a
+// peer within finderEchoWindow
+func (f *finderViews) echo(fullPath string) (time.Time, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w, ok := f.received[fullPath]
+	if !ok || time.Since(w.at) > finderEchoWindow {
+		return time.Time{}, false
+	}
+	return w.modTime, true
+}
+
+// finderViewEcho reports whether a local change is Finder rewriting a
+// .DS_Store file just received. The rewrite keeps the received mod time, so
+// newest-wins leaves both Macs as they are instead of sending it back.
+func (e *Engine) finderViewEcho(event FileEvent) bool {
+	if !isFinderView(event.RelPath) {
+		return false
+	}
+	modTime, ok := e.finderViews.echo(event.Path)
+	if !ok {
+		return false
+	}
+
+	if err := os.Chtimes(event.Path, time.Now(), modTime); err != nil {
+		log.Debug().Err(err).Str("path", event.Path).Msg("Failed to keep received mod time of Finder view settings")
+		return false
+	}
+	fi, err := e.localFileInfo(event.FolderPath, event.Path)
+	if err != nil {
+		return false
+	}
+	if state := e.state.GetFileState(event.FolderPath, fi.RelPath); state != nil {
+		updated := *state
+		updated.Hash = fi.Hash
+		updated.HashAlgo = fi.HashAlgo
+		updated.Size = fi.Size
+		updated.ModTime = fi.ModTime
+		e.state.UpdateFileState(event.FolderPath, &updated)
+	}
+
+	log.Debug().Str("path", event.Path).Msg("Finder rewrote received view settings, not sending them back")
+	return true
+}
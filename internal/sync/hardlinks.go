@@ -0,0 +1,168 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/rs/zerolog/log"
+)
+
+// hardLinks remembers files a peer has as hard links to files still being
+// fetched, to link once those arrive
+type hardLinks struct {
+	mu      sync.Mutex
+	waiting map[string][]waitingLink // Full path of the file linked to -> links to it
+}
+
+// waitingLink is a hard link to make once the file it links to arrives
+type waitingLink struct {
+	relPath  string
+	hash     string // Contents the file linked to must arrive with
+	peerName string
+}
+
+func newHardLinks() *hardLinks {
+	return &hardLinks{waiting: make(map[string][]waitingLink)}
+}
+
+func (h *hardLinks) wait(targetPath string, link waitingLink) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, w := range h.waiting[targetPath] {
+		if w.relPath == link.relPath {
+			return
+		}
+	}
+	h.waiting[targetPath] = append(h.waiting[targetPath], link)
+}
+
+func (h *hardLinks) take(targetPath string) []waitingLink {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	links := h.waiting[targetPath]
+	delete(h.waiting, targetPath)
+	return links
+}
+
+// linkFromList deals with a file a peer's list has as a hard link to another
+// file in it, target. The file is linked to target here too, if target is
+// here with the same contents, or once target is fetched. It reports
+// whether the file was dealt with; otherwise it is synced as a file of its
+// own.
+func (e *Engine) linkFromList(localFolderPath string, remoteFile network.FileInfo, target *network.FileInfo, item PlanItem, peerName string) bool {
+	if target == nil || target.Hash != remoteFile.Hash || target.HashAlgo != remoteFile.HashAlgo {
+		return false
+	}
+	if folderCfg := e.cfg.GetFolder(localFolderPath); folderCfg != nil && !folderCfg.IncludesPath(target.RelPath) {
+		return false
+	}
+	if e.ignores.Ignored(localFolderPath, target.RelPath) || e.stillLocked(localFolderPath, target.RelPath) {
+		return false
+	}
+
+	localPath := filepath.Join(localFolderPath, remoteFile.RelPath)
+	targetPath := filepath.Join(localFolderPath, target.RelPath)
+	algo := e.hashAlgo(localFolderPath)
+
+	targetInfo, err := os.Stat(targetPath)
+	if os.IsNotExist(err) {
+		// Fetched with the rest of this list, unless deleted here on purpose
+		if _, err := os.Lstat(localPath); err == nil || e.deletedHere(localFolderPath, *target) {
+			return false
+		}
+		e.hardLinks.wait(targetPath, waitingLink{relPath: remoteFile.RelPath, hash: target.Hash, peerName: peerName})
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	if hash, err := e.hashFile(localFolderPath, targetPath); err != nil || !matchesHash(targetPath, hash, algo, target.Hash, target.HashAlgo) {
+		return false
+	}
+
+	action := PlanAdd
+	if info, err := os.Stat(localPath); err == nil {
+		if os.SameFile(info, targetInfo) {
+			return true
+		}
+		// A copy of the same contents, such as one sent before the peer
+		// scanned the link, is replaced by the link
+		if hash, err := e.hashFile(localFolderPath, localPath); err != nil || !matchesHash(localPath, hash, algo, remoteFile.Hash, remoteFile.HashAlgo) {
+			return false
+		}
+		action = PlanUpdate
+	}
+
+	item.Reason = "hard link to " + target.RelPath + " on " + peerName
+	if !e.planAllowed(action, item) {
+		return true
+	}
+	if err := e.makeLink(localFolderPath, target.RelPath, remoteFile.RelPath, peerName); err != nil {
+		log.Warn().Err(err).Str("folder_id", localFolderPath).Str("file", remoteFile.RelPath).Msg("Failed to link file, fetching a copy")
+		return false
+	}
+	return true
+}
+
+// linkWaiting makes the hard links waiting for a file that just arrived
+func (e *Engine) linkWaiting(localFolderPath, relPath, hash string) {
+	for _, link := range e.hardLinks.take(filepath.Join(localFolderPath, relPath)) {
+		if link.hash != hash {
+			continue
+		}
+		if err := e.makeLink(localFolderPath, relPath, link.relPath, link.peerName); err != nil {
+			log.Warn().Err(err).Str("folder_id", localFolderPath).Str("file", link.relPath).Msg("Failed to link file")
+		}
+	}
+}
+
+// makeLink makes relPath a hard link to targetRel, replacing whatever is at
+// relPath in one step, and records it as synced from peerName
+func (e *Engine) makeLink(localFolderPath, targetRel, relPath, peerName string) error {
+	targetPath := filepath.Join(localFolderPath, targetRel)
+	fullPath := filepath.Join(localFolderPath, relPath)
+
+	f, err := createTemp(fullPath)
+	if err != nil {
+		return err
+	}
+	temp := f.Name()
+	_ = f.Close()
+	_ = os.Remove(temp)
+
+	if err := os.Link(targetPath, temp); err != nil {
+		return fmt.Errorf("failed to link file: %w", err)
+	}
+	if err := os.Rename(temp, fullPath); err != nil {
+		_ = os.Remove(temp)
+		return fmt.Errorf("failed to link file: %w", err)
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	hash, _ := e.hashFile(localFolderPath, fullPath)
+	e.state.UpdateFileState(localFolderPath, &FileState{
+		RelPath:    relPath,
+		Hash:       hash,
+		HashAlgo:   e.hashAlgo(localFolderPath),
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+		Permission: info.Mode().Perm(),
+		SyncedAt:   time.Now(),
+		SyncedFrom: peerName,
+	})
+
+	log.Info().
+		Str("file", relPath).
+		Str("folder_id", localFolderPath).
+		Str("peer_id", peerName).
+		Str("link_of", targetRel).
+		Msg("Linked file")
+	return nil
+}
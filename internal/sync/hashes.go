@@ -0,0 +1,159 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// Hash migration limits
+const (
+	hashMigrationInterval = 30 * time.Second
+	hashMigrationBatch    = 200 // Files rehashed per interval, so migration stays in the background
+)
+
+// hashCacheSettle is how long a file must go unmodified before its hash is
+// cached. A file written again within its file system's mod time resolution
+// would otherwise keep a stale hash.
+const hashCacheSettle = 2 * time.Second
+
+// hashFile returns the hash of a file in a synced folder, made with the
+// folder's algorithm. The cached hash is used while the file's size, mod time
+// and inode are unchanged; otherwise the file is read and the new hash cached.
+// Folders that only compare size and mod time never read it.
+func (e *Engine) hashFile(folderPath, path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat file: %w", err)
+	}
+	return e.cachedHash(folderPath, path, info)
+}
+
+// cachedHash hashes a file through the hash cache, given its stat taken
+// before reading it
+func (e *Engine) cachedHash(folderPath, path string, info os.FileInfo) (string, error) {
+	if e.hashAlgo(folderPath) == fileutil.SizeModTimeAlgorithm {
+		return fileutil.SizeModTimeHash(info.Size(), info.ModTime()), nil
+	}
+
+	ctx := e.folderContext(folderPath)
+	relPath, err := filepath.Rel(folderPath, path)
+	if err != nil {
+		return fileutil.HashFileContext(ctx, path, fileutil.HashAlgorithm)
+	}
+	relPath = fileutil.NormalizePath(relPath)
+
+	inode := fileutil.Inode(info)
+	if hash := e.state.GetCachedHash(folderPath, relPath, info.Size(), info.ModTime(), inode); hash != "" {
+		return hash, nil
+	}
+
+	hash, err := fileutil.HashFileContext(ctx, path, fileutil.HashAlgorithm)
+	if err != nil {
+		return "", err
+	}
+	if time.Since(info.ModTime()) >= hashCacheSettle {
+		e.state.SetCachedHash(folderPath, relPath, &CachedHash{
+			Hash:     hash,
+			HashAlgo: fileutil.HashAlgorithm,
+			Size:     info.Size(),
+			ModTime:  info.ModTime(),
+			Inode:    inode,
+		})
+	}
+	return hash, nil
+}
+
+// fileInfo is localFileInfo hashing through the hash cache
+func (e *Engine) fileInfo(folderPath, path string) (*fileutil.FileInfo, error) {
+	fi, err := fileutil.GetFileInfoWith(path, folderPath, func(info os.FileInfo) (string, error) {
+		return e.cachedHash(folderPath, path, info)
+	})
+	if err == nil && fi.Hash != "" {
+		fi.HashAlgo = e.hashAlgo(folderPath)
+	}
+	return fi, err
+}
+
+// matchesHash reports whether the file at path, whose hash made with
+// currentAlgo is currentHash, has the contents described by a hash made with
+// algorithm. The file is hashed again when the algorithms differ; a hash made
+// with an unknown algorithm never matches.
+func matchesHash(path, currentHash, currentAlgo, hash, algorithm string) bool {
+	if fileutil.HashAlgorithmOf(algorithm) == currentAlgo {
+		return currentHash == hash
+	}
+	rehashed, err := fileutil.HashFileWith(path, algorithm)
+	return err == nil && rehashed == hash
+}
+
+// hashMigrationLoop rehashes state entries recorded with an older hash
+// algorithm, a batch at a time, once the hash algorithm changes
+func (e *Engine) hashMigrationLoop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(hashMigrationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			if migrated := e.migrateHashes(hashMigrationBatch); migrated > 0 {
+				if err := e.state.Save(); err != nil {
+					log.Warn().Err(err).Msg("Failed to save state")
+				}
+				log.Info().Int("files", migrated).Msg("Migrated file hashes")
+			}
+		}
+	}
+}
+
+// migrateHashes rehashes up to limit state entries made with an algorithm
+// other than their folder's, an older one or one its change_detection no
+// longer uses. Only files unchanged since they were synced are rehashed; a
+// file that changed gets a new hash when the change is synced.
+func (e *Engine) migrateHashes(limit int) int {
+	migrated := 0
+	for _, folder := range e.cfg.Folders {
+		if !folder.Enabled {
+			continue
+		}
+		algo := folder.HashAlgorithm()
+
+		for relPath, state := range e.state.GetAllFiles(folder.Path) {
+			if migrated >= limit {
+				return migrated
+			}
+			if state.Algorithm() == algo || state.Hash == "" {
+				continue
+			}
+
+			fullPath := filepath.Join(folder.Path, relPath)
+			info, err := os.Stat(fullPath)
+			if err != nil || info.Size() != state.Size || !info.ModTime().Equal(state.ModTime) {
+				continue
+			}
+
+			// Make sure the contents are still what was synced, if the old
+			// algorithm is still known
+			if old, err := fileutil.HashFileWith(fullPath, state.Algorithm()); err == nil && old != state.Hash {
+				continue
+			}
+
+			hash, err := fileutil.HashFileWith(fullPath, algo)
+			if err != nil {
+				continue
+			}
+			if e.state.RehashFileState(folder.Path, relPath, state.Hash, hash, algo) {
+				migrated++
+			}
+		}
+	}
+	return migrated
+}
@@ -0,0 +1,276 @@
+package sync
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// IgnoreFileName is the ignore file in a folder's root. It syncs like any
+// other file, so rules added on one Mac reach its peers, unless the folder
+// keeps it private.
+const IgnoreFileName = ".mpsignore"
+
+// ignoreRecheck limits how often an ignore file is checked for changes the
+// watcher didn't report
+const ignoreRecheck = 2 * time.Second
+
+// IgnoreRules applies per-folder ignore rules: local-only patterns from the
+// config and, for folders that share them, the synced ignore file
+type IgnoreRules struct {
+	cfg *config.Config
+
+	mu     sync.Mutex
+	shared map[string]*sharedIgnore // Folder path -> parsed ignore file
+	temp   []TempExclusion          // Paths excluded for a while with the exclude command
+}
+
+type sharedIgnore struct {
+	patterns []string
+	rules    config.IgnoreList
+	modTime  time.Time
+	checked  time.Time
+}
+
+// NewIgnoreRules creates ignore rules for the configured folders
+func NewIgnoreRules(cfg *config.Config) *IgnoreRules {
+	temp, _ := LoadTempExclusions()
+	return &IgnoreRules{
+		cfg:    cfg,
+		shared: make(map[string]*sharedIgnore),
+		temp:   temp,
+	}
+}
+
+// SetTempExclusions replaces the paths excluded for a while, returning the
+// ones that were in force and no longer are
+func (r *IgnoreRules) SetTempExclusions(list []TempExclusion) []TempExclusion {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ended []TempExclusion
+	for _, old := range r.temp {
+		if _, ok := tempExcluded(list, old.FolderPath, old.RelPath); !ok {
+			ended = append(ended, old)
+		}
+	}
+	r.temp = list
+	return ended
+}
+
+// TempExclusions returns the paths excluded for a while that still are
+func (r *IgnoreRules) TempExclusions() []TempExclusion {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var active []TempExclusion
+	for _, x := range r.temp {
+		if !x.Expired() {
+			active = append(active, x)
+		}
+	}
+	return active
+}
+
+// Ignored reports whether a path in a folder is excluded by the folder's
+// ignore rules. The ignore file itself is only ignored if it is private.
+func (r *IgnoreRules) Ignored(folderPath, relPath string) bool {
+	return r.Match(folderPath, relPath) != ""
+}
+
+// Match returns the rule that excludes a path in a folder, or "" if none does
+func (r *IgnoreRules) Match(folderPath, relPath string) string {
+	if relPath == "." {
+		return ""
+	}
+
+	r.mu.Lock()
+	x, excluded := tempExcluded(r.temp, folderPath, relPath)
+	r.mu.Unlock()
+	if excluded {
+		return "excluded with the exclude command until " + fileutil.FormatClock(x.Until)
+	}
+
+	// Writes in progress, archived deletes and previous versions stay on this Mac
+	if isTempFile(relPath) {
+		return "temporary file of a transfer in progress"
+	}
+	for _, dir := range []string{config.ArchiveDirName, config.VersionsDirName} {
+		if relPath == dir || strings.HasPrefix(relPath, dir+string(filepath.Separator)) {
+			return "inside " + dir + ", which stays on this Mac"
+		}
+	}
+
+	if r.cfg.Sync.ProtectDatabases && databaseOf(relPath) != "" {
+		return "SQLite journal file, which syncs only as part of its database"
+	}
+
+	folderCfg := r.cfg.GetFolder(folderPath)
+	if folderCfg == nil {
+		return ""
+	}
+	if relPath == IgnoreFileName {
+		if folderCfg.PrivateIgnoreFile {
+			return "private_ignore_file, which keeps it on this Mac"
+		}
+		return ""
+	}
+	// Peers with finder_views on send .DS_Store files; they only apply here
+	// if this Mac syncs them too
+	if filepath.Base(relPath) == config.FinderViewFile && !folderCfg.FinderViews {
+		if match := r.cfg.IgnoreMatch(filepath.Join(folderPath, relPath)); match != "" {
+			return match
+		}
+	}
+	for _, pattern := range folderCfg.LocalIgnore {
+		if config.MatchIgnorePattern(pattern, relPath) {
+			return fmt.Sprintf("local_ignore %q", pattern)
+		}
+	}
+	if !folderCfg.SharedIgnore {
+		return ""
+	}
+
+	isDir := func() bool { return fileutil.IsDir(filepath.Join(folderPath, relPath)) }
+	if pattern := r.sharedRules(folderPath).Match(relPath, isDir); pattern != "" {
+		return fmt.Sprintf("%s %q", IgnoreFileName, pattern)
+	}
+	return ""
+}
+
+// sharedRules returns the folder's ignore file rules, re-reading the file
+// when it has changed
+func (r *IgnoreRules) sharedRules(folderPath string) config.IgnoreList {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cached, ok := r.shared[folderPath]
+	if ok && time.Since(cached.checked) < ignoreRecheck {
+		return cached.rules
+	}
+	if !ok {
+		cached = &sharedIgnore{}
+		r.shared[folderPath] = cached
+	}
+	r.load(folderPath, cached)
+	return cached.rules
+}
+
+// Reload re-reads a folder's ignore file now, reporting whether its patterns
+// changed
+func (r *IgnoreRules) Reload(folderPath string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cached, ok := r.shared[folderPath]
+	if !ok {
+		cached = &sharedIgnore{}
+		r.shared[folderPath] = cached
+	}
+	before := cached.patterns
+	cached.modTime = time.Time{}
+	r.load(folderPath, cached)
+	return !slices.Equal(before, cached.patterns)
+}
+
+// load reads a folder's ignore file into the cache if it changed since it was
+// last read. Callers hold r.mu.
+func (r *IgnoreRules) load(folderPath string, cached *sharedIgnore) {
+	cached.checked = time.Now()
+
+	info, err := os.Stat(filepath.Join(folderPath, IgnoreFileName))
+	if err != nil {
+		cached.patterns, cached.rules = nil, nil
+		cached.modTime = time.Time{}
+		return
+	}
+	if info.ModTime().Equal(cached.modTime) {
+		return
+	}
+
+	patterns, err := ReadIgnoreFile(folderPath)
+	if err != nil {
+		return
+	}
+	cached.patterns = patterns
+	cached.rules = config.ParseIgnoreList(patterns)
+	cached.modTime = info.ModTime()
+}
+
+// ReadIgnoreFile returns the patterns in a folder's ignore file, one per
+// line; blank lines and lines starting with # are skipped. Patterns follow
+// gitignore syntax: "!" re-includes, a leading or inner "/" anchors to the
+// folder root, a trailing "/" matches directories only, and "**" matches any
+// number of directories.
+func ReadIgnoreFile(folderPath string) ([]string, error) {
+	f, err := os.Open(filepath.Join(folderPath, IgnoreFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ignore file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read ignore file: %w", err)
+	}
+	return patterns, nil
+}
+
+// ignoreFileChanged picks up an edit to a folder's ignore file right away.
+// Files the old rules ignored and the new ones don't are found by a rescan
+// and sent; synced files the new rules ignore are reported for cleanup.
+func (e *Engine) ignoreFileChanged(folderPath string) {
+	folderCfg := e.cfg.GetFolder(folderPath)
+	if folderCfg == nil || !folderCfg.SharedIgnore || !e.ignores.Reload(folderPath) {
+		return
+	}
+
+	log.Info().Str("folder_id", folderPath).Msg("Ignore rules changed, rescanning folder")
+	e.rescanFolder(folderPath)
+	e.reportNewlyIgnored(folderPath)
+}
+
+// AddToIgnoreFile appends patterns that aren't already in a folder's ignore file
+func AddToIgnoreFile(folderPath string, patterns []string) error {
+	existing, err := ReadIgnoreFile(folderPath)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(folderPath, IgnoreFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open ignore file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	for _, pattern := range patterns {
+		if slices.Contains(existing, pattern) {
+			continue
+		}
+		if _, err := fmt.Fprintln(f, pattern); err != nil {
+			return fmt.Errorf("failed to write ignore file: %w", err)
+		}
+		existing = append(existing, pattern)
+	}
+	return nil
+}
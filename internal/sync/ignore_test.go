@@ -0,0 +1,85 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+)
+
+func TestIgnoreListMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		relPath  string
+		isDir    bool
+		want     string
+	}{
+		{"basename anywhere", []string{"*.tmp"}, "a/b/x.tmp", false, "*.tmp"},
+		{"no match", []string{"*.tmp"}, "a/b/x.txt", false, ""},
+		{"negation re-includes", []string{"*.tmp", "!keep.tmp"}, "keep.tmp", false, ""},
+		{"negation leaves others", []string{"*.tmp", "!keep.tmp"}, "other.tmp", false, "*.tmp"},
+		{"last rule wins", []string{"!a.txt", "*.txt"}, "a.txt", false, "*.txt"},
+		{"ignored directory can't be re-included", []string{"build/", "!build/keep.txt"}, "build/keep.txt", false, "build/"},
+		{"escaped bang", []string{`\!important`}, "!important", false, `\!important`},
+		{"trailing doublestar matches inside", []string{"Archive/**"}, "Archive/2020/a.txt", false, "Archive/**"},
+		{"trailing doublestar skips the directory", []string{"Archive/**"}, "Archive", true, ""},
+		{"leading doublestar at any depth", []string{"**/cache"}, "a/b/cache", true, "**/cache"},
+		{"leading doublestar at the root", []string{"**/cache"}, "cache", true, "**/cache"},
+		{"inner doublestar spans directories", []string{"a/**/b"}, "a/x/y/b", false, "a/**/b"},
+		{"inner doublestar spans none", []string{"a/**/b"}, "a/b", false, "a/**/b"},
+		{"leading slash anchors", []string{"/build"}, "build", true, "/build"},
+		{"leading slash not deeper", []string{"/build"}, "src/build", true, ""},
+		{"inner slash anchors", []string{"docs/build"}, "docs/build", true, "docs/build"},
+		{"inner slash not deeper", []string{"docs/build"}, "x/docs/build", true, ""},
+		{"unanchored name at any depth", []string{"build"}, "src/build", true, "build"},
+		{"unanchored name covers contents", []string{"build"}, "src/build/out.o", false, "build"},
+		{"dir-only matches a directory", []string{"logs/"}, "logs", true, "logs/"},
+		{"dir-only skips a file", []string{"logs/"}, "logs", false, ""},
+		{"dir-only covers contents", []string{"logs/"}, "logs/a.txt", false, "logs/"},
+		{"root is never ignored", []string{"*"}, ".", true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list := config.ParseIgnoreList(tt.patterns)
+			got := list.Match(tt.relPath, func() bool { return tt.isDir })
+			if got != tt.want {
+				t.Errorf("Match(%q) with %q = %q, want %q", tt.relPath, tt.patterns, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIgnoreRulesSharedFile(t *testing.T) {
+	folder := t.TempDir()
+	if err := os.WriteFile(filepath.Join(folder, IgnoreFileName), []byte("# scratch files\n*.tmp\n!keep.tmp\nbuild/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(folder, "src", "build"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{Folders: []config.FolderConfig{{Path: folder, Enabled: true, SharedIgnore: true}}}
+	rules := &IgnoreRules{cfg: cfg, shared: make(map[string]*sharedIgnore)}
+
+	tests := []struct {
+		relPath string
+		want    string
+	}{
+		{"notes.tmp", `.mpsignore "*.tmp"`},
+		{"keep.tmp", ""},
+		{"src/build", `.mpsignore "build/"`},
+		{"src/build/out.o", `.mpsignore "build/"`},
+		{"src/main.go", ""},
+		{IgnoreFileName, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.relPath, func(t *testing.T) {
+			if got := rules.Match(folder, tt.relPath); got != tt.want {
+				t.Errorf("Match(%q) = %q, want %q", tt.relPath, got, tt.want)
+			}
+		})
+	}
+}
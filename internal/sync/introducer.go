@@ -0,0 +1,141 @@
+package sync
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/rs/zerolog/log"
+)
+
+// introduceInterval is how often an introducer sends connected peers its
+// peer table
+const introduceInterval = 30 * time.Second
+
+// SetIntroductionHandler sets what is called with the peers an introducer
+// tells this Mac about, to connect to the ones it doesn't know yet
+func (e *Engine) SetIntroductionHandler(handler func(name string, addresses []string)) {
+	e.introduce = handler
+}
+
+// introducerLoop shares this Mac's peers with every peer connected to it,
+// with network.introducer set on an always-on Mac
+func (e *Engine) introducerLoop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(introduceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			e.sendPeerTables()
+		}
+	}
+}
+
+// sendPeerTables sends each connected peer that understands introductions
+// where to reach the other connected peers
+func (e *Engine) sendPeerTables() {
+	table := e.peerTable()
+	if len(table) < 2 {
+		return
+	}
+
+	send := func(peerName, version string, sendFn func(*network.Message) error) {
+		if peerName == "" || !network.VersionAtLeast(version, network.IntroducerVersion) {
+			return
+		}
+		var others []network.PeerTableEntry
+		for _, entry := range table {
+			if entry.Name != peerName {
+				others = append(others, entry)
+			}
+		}
+		msg, err := network.NewMessage(network.MsgPeerTable, network.PeerTableMessage{Peers: others})
+		if err != nil {
+			return
+		}
+		if err := sendFn(msg); err != nil {
+			log.Debug().Err(err).Str("peer_id", peerName).Msg("Failed to send peer table")
+		}
+	}
+	for _, conn := range e.server.GetConnections() {
+		send(conn.DeviceName, conn.Version, conn.Send)
+	}
+	for _, conn := range e.client.GetConnections() {
+		send(conn.DeviceName, conn.Version, conn.Send)
+	}
+}
+
+// peerTable lists the connected peers that can be dialed, at the addresses
+// they announced, or else the ones this Mac reached them at
+func (e *Engine) peerTable() []network.PeerTableEntry {
+	addresses := make(map[string][]string)
+	var names []string
+	add := func(name string, addrs []string) {
+		if name == "" || len(addrs) == 0 {
+			return
+		}
+		if _, ok := addresses[name]; !ok {
+			names = append(names, name)
+		}
+		addresses[name] = addrs
+	}
+
+	known := make(map[string][]string)
+	for _, p := range e.peerDB.List() {
+		known[p.Name] = p.Addresses
+	}
+	for _, conn := range e.server.GetConnections() {
+		if _, ok := addresses[conn.DeviceName]; !ok {
+			add(conn.DeviceName, known[conn.DeviceName])
+		}
+	}
+	for _, conn := range e.client.GetConnections() {
+		// Relayed and hole-punched connections have no address to pass on
+		if _, ok := addresses[conn.DeviceName]; !ok && !strings.Contains(conn.Address, "://") {
+			add(conn.DeviceName, []string{conn.Address})
+		}
+	}
+	for _, name := range names {
+		add(name, e.announced.get(name))
+	}
+
+	table := make([]network.PeerTableEntry, 0, len(names))
+	for _, name := range names {
+		table = append(table, network.PeerTableEntry{Name: name, Addresses: addresses[name]})
+	}
+	return table
+}
+
+// handlePeerTable answers an introducer with this Mac's addresses, to pass
+// on to others, and connects to the peers it introduced that aren't
+// connected yet
+func (e *Engine) handlePeerTable(table network.PeerTableMessage, peerName string, send func(*network.Message) error) {
+	if addrs := localAddresses(e.cfg.Network.Port, e.cfg.Network.MDNSInterfaces); len(addrs) > 0 {
+		msg, err := network.NewMessage(network.MsgAddressUpdate, network.AddressUpdateMessage{Addresses: addrs, Introduce: true})
+		if err == nil {
+			if err := send(msg); err != nil {
+				log.Debug().Err(err).Str("peer_id", peerName).Msg("Failed to send addresses to introducer")
+			}
+		}
+	}
+
+	connected := e.connectedPeers()
+	for _, entry := range table.Peers {
+		if entry.Name == e.cfg.Device.Name || connected[entry.Name] || len(entry.Addresses) == 0 {
+			continue
+		}
+		log.Debug().
+			Str("peer_id", entry.Name).
+			Str("introducer", peerName).
+			Strs("addresses", entry.Addresses).
+			Msg("Peer introduced")
+		if e.introduce != nil {
+			e.introduce(entry.Name, entry.Addresses)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/rs/zerolog/log"
+)
+
+// changeJournal remembers the files changed here while a known peer was
+// away, per peer and folder, across restarts. When the peer says hello again
+// it is sent a list of just those files, which it compares and fetches like
+// any file list, without waiting for the full lists to be scanned and sent.
+// Deletions reach it through tombstones.
+type changeJournal struct {
+	mu    sync.Mutex
+	path  string
+	peers map[string]map[string]map[string]time.Time // Peer -> folder path -> rel path -> changed at
+	dirty bool
+}
+
+// journalPath is where the change journal is saved
+func journalPath() string {
+	return filepath.Join(config.ConfigDir(), "journal.json")
+}
+
+func newChangeJournal() *changeJournal {
+	return &changeJournal{
+		path:  journalPath(),
+		peers: make(map[string]map[string]map[string]time.Time),
+	}
+}
+
+// load reads the journal saved by the last run
+func (j *changeJournal) load() error {
+	data, err := os.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read change journal: %w", err)
+	}
+
+	peers := make(map[string]map[string]map[string]time.Time)
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return fmt.Errorf("failed to parse change journal: %w", err)
+	}
+
+	j.mu.Lock()
+	j.peers = peers
+	j.mu.Unlock()
+	return nil
+}
+
+// saveIfChanged writes the journal if anything changed since the last save
+func (j *changeJournal) saveIfChanged() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if !j.dirty {
+		return
+	}
+	data, err := json.Marshal(j.peers)
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(j.path, data, 0644); err != nil {
+		log.Debug().Err(err).Msg("Failed to save change journal")
+		return
+	}
+	j.dirty = false
+}
+
+// record notes a changed file for each of peers. A peer past maxFiles has
+// its journal dropped; the full lists exchanged on reconnect cover it.
+func (j *changeJournal) record(peers []string, folderPath, relPath string, maxFiles int) {
+	if len(peers) == 0 || maxFiles <= 0 {
+		return
+	}
+	now := time.Now()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, peer := range peers {
+		folders, ok := j.peers[peer]
+		if !ok {
+			folders = make(map[string]map[string]time.Time)
+			j.peers[peer] = folders
+		}
+		files, ok := folders[folderPath]
+		if !ok {
+			files = make(map[string]time.Time)
+			folders[folderPath] = files
+		}
+		files[relPath] = now
+		j.dirty = true
+
+		total := 0
+		for _, files := range folders {
+			total += len(files)
+		}
+		if total > maxFiles {
+			log.Warn().
+				Str("peer_id", peer).
+				Int("files", total).
+				Msg("Too many changes journaled for an absent peer, it will catch up from the full file lists")
+			delete(j.peers, peer)
+		}
+	}
+}
+
+// take removes and returns a peer's journal
+func (j *changeJournal) take(peer string) map[string]map[string]time.Time {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	folders, ok := j.peers[peer]
+	if !ok {
+		return nil
+	}
+	delete(j.peers, peer)
+	j.dirty = true
+	return folders
+}
+
+// forget drops the journals of peers no longer known
+func (j *changeJournal) forget(known map[string]bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for peer := range j.peers {
+		if !known[peer] {
+			delete(j.peers, peer)
+			j.dirty = true
+		}
+	}
+}
+
+// PendingChange is a file changed here while peers were away, sent to them
+// when they reconnect
+type PendingChange struct {
+	FolderPath string
+	RelPath    string
+	Peers      []string  // Absent peers waiting for it, sorted
+	ChangedAt  time.Time // Latest change
+}
+
+// LoadPendingChanges reads the change journal saved by the daemon and
+// returns the files waiting for absent peers, sorted by folder and path
+func LoadPendingChanges() ([]PendingChange, error) {
+	data, err := os.ReadFile(journalPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read change journal: %w", err)
+	}
+
+	var peers map[string]map[string]map[string]time.Time
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return nil, fmt.Errorf("failed to parse change journal: %w", err)
+	}
+
+	byPath := make(map[string]*PendingChange)
+	for peer, folders := range peers {
+		for folderPath, files := range folders {
+			for relPath, changedAt := range files {
+				key := folderPath + "\x00" + relPath
+				change, ok := byPath[key]
+				if !ok {
+					change = &PendingChange{FolderPath: folderPath, RelPath: relPath}
+					byPath[key] = change
+				}
+				change.Peers = append(change.Peers, peer)
+				if changedAt.After(change.ChangedAt) {
+					change.ChangedAt = changedAt
+				}
+			}
+		}
+	}
+
+	changes := make([]PendingChange, 0, len(byPath))
+	for _, change := range byPath {
+		sort.Strings(change.Peers)
+		changes = append(changes, *change)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].FolderPath != changes[j].FolderPath {
+			return changes[i].FolderPath < changes[j].FolderPath
+		}
+		return changes[i].RelPath < changes[j].RelPath
+	})
+	return changes, nil
+}
+
+// connectedPeers returns the device names of the peers connected now
+func (e *Engine) connectedPeers() map[string]bool {
+	connected := make(map[string]bool)
+	for _, conn := range e.server.GetConnections() {
+		if conn.DeviceName != "" {
+			connected[conn.DeviceName] = true
+		}
+	}
+	for _, conn := range e.client.GetConnections() {
+		if conn.DeviceName != "" {
+			connected[conn.DeviceName] = true
+		}
+	}
+	return connected
+}
+
+// journalChange records a file sent to connected peers for the known peers
+// that aren't connected
+func (e *Engine) journalChange(folderPath, relPath string) {
+	connected := e.connectedPeers()
+	var absent []string
+	for _, p := range e.peerDB.List() {
+		if p.Name != e.cfg.Device.Name && !connected[p.Name] {
+			absent = append(absent, p.Name)
+		}
+	}
+	e.journal.record(absent, folderPath, relPath, e.cfg.Sync.JournalMaxFiles)
+}
+
+// replayJournal sends a peer that just said hello the files changed while it
+// was away, folder by folder, as file lists marked as a journal
+func (e *Engine) replayJournal(peerName, version string, send func(*network.Message) error) {
+	if peerName == "" || !network.VersionAtLeast(version, network.JournalVersion) {
+		return
+	}
+	folders := e.journal.take(peerName)
+	if len(folders) == 0 {
+		return
+	}
+
+	for folderPath, files := range folders {
+		if e.cfg.GetFolder(folderPath) == nil || e.IsFolderPaused(folderPath) {
+			continue
+		}
+
+		relPaths := make([]string, 0, len(files))
+		for relPath := range files {
+			relPaths = append(relPaths, relPath)
+		}
+		sort.Strings(relPaths)
+
+		msg := network.FileListMessage{
+			FolderPath: folderPath,
+			FolderName: e.folderName(folderPath),
+			Journal:    true,
+		}
+		for _, relPath := range relPaths {
+			fullPath := filepath.Join(folderPath, relPath)
+			if e.ignores.Ignored(folderPath, relPath) {
+				continue
+			}
+			// Gone since; the peer learns that from the tombstones
+			fi, err := e.localFileInfo(folderPath, fullPath)
+			if err != nil || fi.IsDir {
+				continue
+			}
+			msg.Files = append(msg.Files, network.FileInfo{
+				RelPath:    fi.RelPath,
+				Size:       fi.Size,
+				ModTime:    fi.ModTime,
+				Hash:       fi.Hash,
+				HashAlgo:   fi.HashAlgo,
+				Permission: uint32(fi.Permission),
+				FolderPath: folderPath,
+			})
+		}
+		if len(msg.Files) == 0 {
+			continue
+		}
+
+		out, err := network.NewMessage(network.MsgFileList, msg)
+		if err != nil {
+			continue
+		}
+		if err := send(out); err != nil {
+			log.Error().Err(err).Str("peer_id", peerName).Str("folder_id", folderPath).Msg("Failed to send change journal")
+			return
+		}
+		log.Info().
+			Str("peer_id", peerName).
+			Str("folder_id", folderPath).
+			Int("files", len(msg.Files)).
+			Msg("Sent changes made while peer was away")
+	}
+}
+
+// skipJournal reports whether a peer's journal list must be left for the
+// full lists: it only offers files, so it can't start a folder's first sync
+// or bypass a held reconciliation
+func (e *Engine) skipJournal(localFolderPath, peerName string) bool {
+	if peerName == "" || e.state.GetPeerSequences(localFolderPath)[peerName] == 0 {
+		return true
+	}
+	return e.reconcile.Get(localFolderPath, peerName) != nil
+}
@@ -0,0 +1,240 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+// lockedFiles remembers the peer update each unwritable file turned away,
+// so it can be fetched again once the file is unlocked
+type lockedFiles struct {
+	mu      sync.Mutex
+	updates map[string]lockedUpdate // Full path -> update that couldn't be written
+}
+
+type lockedUpdate struct {
+	peerName   string
+	folderPath string // The peer's path for the folder
+	folderName string
+}
+
+func newLockedFiles() *lockedFiles {
+	return &lockedFiles{updates: make(map[string]lockedUpdate)}
+}
+
+func (l *lockedFiles) set(path string, update lockedUpdate) {
+	l.mu.Lock()
+	l.updates[path] = update
+	l.mu.Unlock()
+}
+
+func (l *lockedFiles) take(path string) (lockedUpdate, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	update, ok := l.updates[path]
+	delete(l.updates, path)
+	return update, ok
+}
+
+// writeBlocked reports whether a received file can't be written to fullPath:
+// the file there is locked (uchg or uappnd), or its directory is read-only
+func writeBlocked(fullPath string) bool {
+	if info, err := os.Lstat(fullPath); err == nil && fileutil.FileFlags(info)&fileutil.LockFlags != 0 {
+		return true
+	}
+	dir := filepath.Dir(fullPath)
+	if info, err := os.Lstat(dir); err == nil && fileutil.FileFlags(info)&fileutil.LockFlags != 0 {
+		return true
+	}
+	return unix.Access(dir, unix.W_OK) != nil
+}
+
+// unlockForWrite clears the locks keeping a received file from being written
+// to fullPath: the file's lock flags, and its directory's lock flags and
+// read-only permissions. The returned function puts them back, applying the
+// file's lock to whichever copy is in place by then.
+func unlockForWrite(fullPath string) (func(), error) {
+	var restores []func()
+	restore := func() {
+		for i := len(restores) - 1; i >= 0; i-- {
+			restores[i]()
+		}
+	}
+
+	dir := filepath.Dir(fullPath)
+	if info, err := os.Lstat(dir); err == nil {
+		if locked := fileutil.FileFlags(info) & fileutil.LockFlags; locked != 0 {
+			if err := fileutil.SetFileFlags(dir, fileutil.FileFlags(info)&^locked); err != nil {
+				return restore, err
+			}
+			restores = append(restores, func() { relock(dir, locked) })
+		}
+		if perm := info.Mode().Perm(); perm&0200 == 0 {
+			if err := os.Chmod(dir, perm|0200); err != nil {
+				restore()
+				return func() {}, fmt.Errorf("failed to make directory writable: %w", err)
+			}
+			restores = append(restores, func() {
+				if err := os.Chmod(dir, perm); err != nil {
+					log.Warn().Err(err).Str("path", dir).Msg("Failed to make directory read-only again")
+				}
+			})
+		}
+	}
+
+	if info, err := os.Lstat(fullPath); err == nil {
+		if locked := fileutil.FileFlags(info) & fileutil.LockFlags; locked != 0 {
+			if err := fileutil.SetFileFlags(fullPath, fileutil.FileFlags(info)&^locked); err != nil {
+				restore()
+				return func() {}, err
+			}
+			restores = append(restores, func() { relock(fullPath, locked) })
+		}
+	}
+	return restore, nil
+}
+
+// relock sets lock flags on a path again, keeping its other flags
+func relock(path string, locked uint32) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return
+	}
+	if err := fileutil.SetFileFlags(path, fileutil.FileFlags(info)|locked); err != nil {
+		log.Warn().Err(err).Str("path", path).Msg("Failed to lock file again")
+	}
+}
+
+// isUnwritable reports whether err means a received file was refused by a
+// lock or permissions, which retrying won't get past
+func isUnwritable(err error) bool {
+	return errors.Is(err, os.ErrPermission)
+}
+
+// unlockAdvice says how to let peers' updates through to a file
+func unlockAdvice(fullPath string) string {
+	if info, err := os.Lstat(fullPath); err == nil && fileutil.FileFlags(info)&fileutil.LockFlags != 0 {
+		return fmt.Sprintf("unlock it in Finder's Get Info or with `chflags nouchg,nouappnd %q`, or set sync.unlock_readonly", fullPath)
+	}
+	return "make its folder writable, or set sync.unlock_readonly"
+}
+
+// markUnwritable records a peer's update that couldn't be written because
+// the local copy is locked, so it is reported and fetched again once the
+// file is unlocked. Sending it again before then would not help.
+func (e *Engine) markUnwritable(localFolderPath string, fileData network.FileDataMessage, peerName string, writeErr error) {
+	fullPath := filepath.Join(localFolderPath, fileData.RelPath)
+	e.locked.set(fullPath, lockedUpdate{
+		peerName:   peerName,
+		folderPath: fileData.FolderPath,
+		folderName: fileData.FolderName,
+	})
+
+	_, known := e.state.GetUnwritable(localFolderPath)[fileData.RelPath]
+	e.state.MarkUnwritable(localFolderPath, fileData.RelPath, writeErr)
+	if known {
+		log.Debug().Err(writeErr).Str("path", fullPath).Msg("File is still locked, not updated")
+		return
+	}
+
+	e.addActivity(&SyncActivity{
+		Type:       "locked",
+		FileName:   filepath.Base(fileData.RelPath),
+		FolderPath: localFolderPath,
+		RelPath:    fileData.RelPath,
+		PeerName:   peerName,
+		Timestamp:  time.Now(),
+	})
+
+	log.Warn().
+		Err(writeErr).
+		Str("file", fileData.RelPath).
+		Str("folder_id", localFolderPath).
+		Str("peer_id", peerName).
+		Msg("File is locked or read-only, not updated")
+
+	e.publishError(fmt.Errorf("%s wasn't updated from %s because it is locked or read-only; %s", fullPath, peerName, unlockAdvice(fullPath)))
+}
+
+// stillLocked reports whether a file a peer's update was turned away from is
+// still locked, so the update isn't requested again for nothing
+func (e *Engine) stillLocked(localFolderPath, relPath string) bool {
+	if e.cfg.Sync.UnlockReadOnly {
+		return false
+	}
+	if _, unwritable := e.state.GetUnwritable(localFolderPath)[relPath]; !unwritable {
+		return false
+	}
+	return writeBlocked(filepath.Join(localFolderPath, relPath))
+}
+
+// retryUnwritable fetches the updates turned away by locked files again once
+// the files are unlocked or gone
+func (e *Engine) retryUnwritable() {
+	changed := false
+
+	for _, folder := range e.cfg.Folders {
+		if !folder.Enabled {
+			continue
+		}
+
+		for relPath := range e.state.GetUnwritable(folder.Path) {
+			fullPath := filepath.Join(folder.Path, relPath)
+			if !e.cfg.Sync.UnlockReadOnly && writeBlocked(fullPath) {
+				continue
+			}
+
+			e.state.ClearUnwritable(folder.Path, relPath)
+			changed = true
+
+			update, ok := e.locked.take(fullPath)
+			if !ok {
+				// Left from an earlier run; the next file list brings it
+				continue
+			}
+			e.requestUnlocked(folder.Path, relPath, update)
+		}
+	}
+
+	if changed {
+		if err := e.state.Save(); err != nil {
+			log.Warn().Err(err).Msg("Failed to save state")
+		}
+	}
+}
+
+// requestUnlocked asks the peer whose update a locked file turned away for
+// it again, if it is still connected
+func (e *Engine) requestUnlocked(localFolderPath, relPath string, update lockedUpdate) {
+	req := network.FileRequestMessage{
+		FolderPath: update.folderPath,
+		FolderName: update.folderName,
+		RelPath:    relPath,
+	}
+	priority := e.transferPriorityFor(localFolderPath, 0, time.Now())
+
+	for _, conn := range e.server.GetConnections() {
+		if conn.DeviceName == update.peerName {
+			log.Info().Str("file", relPath).Str("folder_id", localFolderPath).Str("peer_id", update.peerName).Msg("File is writable again, fetching update")
+			e.transfers.enqueue(conn.ID, conn.Send, req, priority)
+			return
+		}
+	}
+	for _, conn := range e.client.GetConnections() {
+		if conn.DeviceName == update.peerName {
+			log.Info().Str("file", relPath).Str("folder_id", localFolderPath).Str("peer_id", update.peerName).Msg("File is writable again, fetching update")
+			e.transfers.enqueue(conn.Address, conn.Send, req, priority)
+			return
+		}
+	}
+}
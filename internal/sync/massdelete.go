@@ -0,0 +1,418 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// massDeleteWindow is how long local deletions are collected into one batch
+// before the batch is checked against sync.mass_delete_files and
+// sync.mass_delete_percent
+const massDeleteWindow = 2 * time.Second
+
+// massDeleteMinFiles is the fewest deleted files sync.mass_delete_percent
+// applies to, so emptying a small folder isn't held
+const massDeleteMinFiles = 10
+
+// massDeleteCheckInterval is how often the daemon picks up deletions
+// approved or restored with the deletes command or the TUI
+const massDeleteCheckInterval = 5 * time.Second
+
+// What to do with held deletions
+const (
+	DeletesApprove = "approve" // Tell peers to delete the files
+	DeletesRestore = "restore" // Fetch the files back from peers
+)
+
+// HeldDeletes are local deletions held back from peers because one batch
+// removed more of a folder than sync.mass_delete_files or
+// sync.mass_delete_percent allow, as a mistyped rm -rf would
+type HeldDeletes struct {
+	FolderPath string    `json:"folder_path"`
+	Paths      []string  `json:"paths"`       // In the order peers are told: files before their directories
+	Files      int       `json:"files"`       // Files among Paths
+	FolderSize int       `json:"folder_size"` // Files the folder had before the first batch
+	DetectedAt time.Time `json:"detected_at"`
+	Decision   string    `json:"decision,omitempty"` // approve | restore, set by the user
+}
+
+// heldDeletesPath is where held deletions are saved for the CLI and TUI
+func heldDeletesPath() string {
+	return filepath.Join(config.ConfigDir(), "held_deletes.json")
+}
+
+// LoadHeldDeletes reads the folders with held deletions, sorted by folder
+func LoadHeldDeletes() ([]*HeldDeletes, error) {
+	data, err := os.ReadFile(heldDeletesPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read held deletions: %w", err)
+	}
+
+	var list []*HeldDeletes
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse held deletions: %w", err)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].FolderPath < list[j].FolderPath
+	})
+	return list, nil
+}
+
+// saveHeldDeletes writes the folders with held deletions, removing the file
+// once none are
+func saveHeldDeletes(list []*HeldDeletes) error {
+	if len(list) == 0 {
+		if err := os.Remove(heldDeletesPath()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove held deletions: %w", err)
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(heldDeletesPath()), 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal held deletions: %w", err)
+	}
+	if err := os.WriteFile(heldDeletesPath(), data, 0644); err != nil {
+		return fmt.Errorf("failed to write held deletions: %w", err)
+	}
+	return nil
+}
+
+// DecideHeldDeletes records whether a folder's held deletions are sent to
+// peers or restored from them. The running daemon applies the decision.
+func DecideHeldDeletes(folderPath, decision string) error {
+	if decision != DeletesApprove && decision != DeletesRestore {
+		return fmt.Errorf("invalid decision %q (use %s or %s)", decision, DeletesApprove, DeletesRestore)
+	}
+
+	list, err := LoadHeldDeletes()
+	if err != nil {
+		return err
+	}
+	for _, held := range list {
+		if held.FolderPath == folderPath {
+			held.Decision = decision
+			return saveHeldDeletes(list)
+		}
+	}
+	return fmt.Errorf("no deletions are held for %s", folderPath)
+}
+
+// massDeletes collects local deletions into batches, and holds the batches
+// too large to send without the user's approval
+type massDeletes struct {
+	mu      sync.Mutex
+	batches map[string][]string     // Folder path -> deletions waiting to be checked
+	timers  map[string]*time.Timer  // Folder path -> when its batch is checked
+	held    map[string]*HeldDeletes // Folder path -> deletions held for approval
+}
+
+func newMassDeletes() *massDeletes {
+	return &massDeletes{
+		batches: make(map[string][]string),
+		timers:  make(map[string]*time.Timer),
+		held:    make(map[string]*HeldDeletes),
+	}
+}
+
+// stop cancels the batch checks still waiting
+func (md *massDeletes) stop() {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	for folderPath, timer := range md.timers {
+		timer.Stop()
+		delete(md.timers, folderPath)
+	}
+}
+
+// loadHeldDeletes picks up deletions held when the daemon last ran
+func (e *Engine) loadHeldDeletes() {
+	list, err := LoadHeldDeletes()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to load held deletions")
+		return
+	}
+
+	e.massDeletes.mu.Lock()
+	defer e.massDeletes.mu.Unlock()
+	for _, held := range list {
+		e.massDeletes.held[held.FolderPath] = held
+	}
+}
+
+// queueDeletes sends local deletions to peers once the batch they belong to
+// is known not to be a mass deletion. Deletions in a folder that already has
+// deletions held join them.
+func (e *Engine) queueDeletes(folderPath string, relPaths []string) {
+	maxFiles, maxPercent := e.cfg.GetMassDeleteLimits()
+	if maxFiles == 0 && maxPercent == 0 {
+		e.sendDeletes(folderPath, relPaths)
+		return
+	}
+
+	md := e.massDeletes
+	md.mu.Lock()
+	if held := md.held[folderPath]; held != nil {
+		held.Paths = append(held.Paths, relPaths...)
+		held.Files += e.deletedFiles(folderPath, relPaths)
+		md.mu.Unlock()
+		e.saveHeldDeletes()
+		return
+	}
+
+	md.batches[folderPath] = append(md.batches[folderPath], relPaths...)
+	if timer := md.timers[folderPath]; timer != nil {
+		timer.Reset(massDeleteWindow)
+	} else {
+		md.timers[folderPath] = time.AfterFunc(massDeleteWindow, func() {
+			e.flushDeletes(folderPath)
+		})
+	}
+	md.mu.Unlock()
+}
+
+// flushDeletes checks a folder's batch of deletions: a batch within the
+// limits is sent to peers, a larger one is held until the user approves it
+func (e *Engine) flushDeletes(folderPath string) {
+	md := e.massDeletes
+	md.mu.Lock()
+	relPaths := md.batches[folderPath]
+	delete(md.batches, folderPath)
+	delete(md.timers, folderPath)
+	md.mu.Unlock()
+
+	// Once stopped, peers learn of the deletions from the next file list
+	if len(relPaths) == 0 || e.ctx.Err() != nil {
+		return
+	}
+
+	// The folder itself went: its files weren't deleted one by one, and
+	// peers keep them for when it is back
+	if !e.folderPresent(folderPath) {
+		for _, relPath := range relPaths {
+			e.state.ClearTombstones(folderPath, relPath)
+		}
+		return
+	}
+
+	files := e.deletedFiles(folderPath, relPaths)
+	before := len(e.state.GetAllFiles(folderPath)) + files
+	maxFiles, maxPercent := e.cfg.GetMassDeleteLimits()
+	overFiles := maxFiles > 0 && files > maxFiles
+	overPercent := maxPercent > 0 && files >= massDeleteMinFiles && files*100 > maxPercent*before
+	if !overFiles && !overPercent {
+		e.sendDeletes(folderPath, relPaths)
+		return
+	}
+
+	md.mu.Lock()
+	md.held[folderPath] = &HeldDeletes{
+		FolderPath: folderPath,
+		Paths:      relPaths,
+		Files:      files,
+		FolderSize: before,
+		DetectedAt: time.Now(),
+	}
+	md.mu.Unlock()
+	e.saveHeldDeletes()
+
+	log.Warn().
+		Str("folder_id", folderPath).
+		Int("files", files).
+		Int("folder_files", before).
+		Msg("Holding mass deletion until it is approved")
+	e.publishError(fmt.Errorf("%s: %s of %s files were deleted at once; peers aren't told until you run 'mac-profile-sync deletes %s --approve', or '--restore' to get them back",
+		folderPath, fileutil.FormatCount(int64(files)), fileutil.FormatCount(int64(before)), folderPath))
+}
+
+// deletedFiles returns how many of the deleted paths were files
+func (e *Engine) deletedFiles(folderPath string, relPaths []string) int {
+	count := 0
+	for _, relPath := range relPaths {
+		if tomb := e.state.GetTombstone(folderPath, relPath); tomb != nil && tomb.Hash != "" {
+			count++
+		}
+	}
+	return count
+}
+
+// sendDeletes tells peers to delete paths deleted here
+func (e *Engine) sendDeletes(folderPath string, relPaths []string) {
+	for _, relPath := range relPaths {
+		e.broadcastPayload(network.MsgFileDelete, network.FileDeleteMessage{
+			FolderPath: folderPath,
+			FolderName: e.folderName(folderPath),
+			RelPath:    relPath,
+		})
+	}
+}
+
+// withoutHeldDeletes drops the paths whose deletion is held or not yet
+// checked, so peers aren't told about them when they list the files
+func (e *Engine) withoutHeldDeletes(folderPath string, relPaths []string) []string {
+	md := e.massDeletes
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	skip := make(map[string]bool)
+	for _, relPath := range md.batches[folderPath] {
+		skip[relPath] = true
+	}
+	if held := md.held[folderPath]; held != nil {
+		for _, relPath := range held.Paths {
+			skip[relPath] = true
+		}
+	}
+	if len(skip) == 0 {
+		return relPaths
+	}
+
+	kept := relPaths[:0:0]
+	for _, relPath := range relPaths {
+		if !skip[relPath] {
+			kept = append(kept, relPath)
+		}
+	}
+	return kept
+}
+
+// saveHeldDeletes writes the held deletions, keeping decisions the user made
+// since they were last read
+func (e *Engine) saveHeldDeletes() {
+	saved, _ := LoadHeldDeletes()
+
+	md := e.massDeletes
+	md.mu.Lock()
+	for _, s := range saved {
+		if held := md.held[s.FolderPath]; held != nil && held.Decision == "" {
+			held.Decision = s.Decision
+		}
+	}
+	list := make([]*HeldDeletes, 0, len(md.held))
+	for _, held := range md.held {
+		list = append(list, held)
+	}
+	md.mu.Unlock()
+
+	if err := saveHeldDeletes(list); err != nil {
+		log.Warn().Err(err).Msg("Failed to save held deletions")
+	}
+}
+
+// massDeleteLoop applies decisions made with the deletes command or the TUI
+func (e *Engine) massDeleteLoop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(massDeleteCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			list, err := LoadHeldDeletes()
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to load held deletions")
+				continue
+			}
+			for _, saved := range list {
+				if saved.Decision != "" {
+					e.decideHeldDeletes(saved.FolderPath, saved.Decision)
+				}
+			}
+		}
+	}
+}
+
+// decideHeldDeletes sends a folder's held deletions to peers, or restores
+// the files from peers. In safe mode the deletions and the decision are kept
+// until it is off.
+func (e *Engine) decideHeldDeletes(folderPath, decision string) {
+	if e.IsSafeMode() {
+		return
+	}
+
+	md := e.massDeletes
+	md.mu.Lock()
+	held := md.held[folderPath]
+	delete(md.held, folderPath)
+	md.mu.Unlock()
+
+	if held != nil {
+		switch decision {
+		case DeletesApprove:
+			e.approveHeldDeletes(held)
+		case DeletesRestore:
+			e.restoreHeldDeletes(held)
+		}
+	}
+	e.saveHeldDeletes()
+}
+
+// approveHeldDeletes tells peers to delete the held paths that are still
+// gone here
+func (e *Engine) approveHeldDeletes(held *HeldDeletes) {
+	var relPaths []string
+	for _, relPath := range held.Paths {
+		if !fileutil.Exists(filepath.Join(held.FolderPath, relPath)) {
+			relPaths = append(relPaths, relPath)
+		}
+	}
+
+	log.Info().
+		Str("folder_id", held.FolderPath).
+		Int("paths", len(relPaths)).
+		Msg("Mass deletion approved, telling peers")
+	e.sendDeletes(held.FolderPath, relPaths)
+}
+
+// restoreHeldDeletes forgets the held deletions and fetches the files back
+// from peers. Files peers no longer list come with their next file list.
+func (e *Engine) restoreHeldDeletes(held *HeldDeletes) {
+	folderPath := held.FolderPath
+	restore := make(map[string]bool, len(held.Paths))
+	for _, relPath := range held.Paths {
+		e.state.ClearTombstones(folderPath, relPath)
+		restore[relPath] = true
+	}
+	if err := e.state.Save(); err != nil {
+		log.Warn().Err(err).Msg("Failed to save state")
+	}
+
+	log.Info().
+		Str("folder_id", folderPath).
+		Int("paths", len(held.Paths)).
+		Msg("Mass deletion rejected, restoring files from peers")
+
+	listing := e.RemoteBrowse(folderPath)
+	if listing == nil || !e.cfg.CanReceive() {
+		return
+	}
+	for _, remoteFile := range listing.Files {
+		if remoteFile.IsDir || !restore[remoteFile.RelPath] || fileutil.Exists(filepath.Join(folderPath, remoteFile.RelPath)) {
+			continue
+		}
+		e.broadcastPayload(network.MsgFileRequest, network.FileRequestMessage{
+			FolderPath: listing.RemoteFolderPath,
+			FolderName: listing.FolderName,
+			RelPath:    remoteFile.RelPath,
+		})
+	}
+}
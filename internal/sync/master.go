@@ -0,0 +1,135 @@
+package sync
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/rs/zerolog/log"
+)
+
+// restoreDelay gathers the deletes a peer sends in a burst, so it is sent
+// one restore list rather than one per file
+const restoreDelay = 2 * time.Second
+
+// restoreQueue schedules restore lists for peers that deleted or moved files
+// in a master's folders
+type restoreQueue struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer // Folder path + peer -> pending list
+}
+
+func newRestoreQueue() *restoreQueue {
+	return &restoreQueue{timers: make(map[string]*time.Timer)}
+}
+
+// connVersion returns the protocol version of the peer on a connection
+func (e *Engine) connVersion(connID string) string {
+	if conn := e.server.GetConnection(connID); conn != nil {
+		return conn.Version
+	}
+	if conn := e.client.GetConnection(connID); conn != nil {
+		return conn.Version
+	}
+	return ""
+}
+
+// connName returns the device name of the peer on a connection, or the
+// connection itself before the peer said hello
+func (e *Engine) connName(connID string) string {
+	if conn := e.server.GetConnection(connID); conn != nil && conn.DeviceName != "" {
+		return conn.DeviceName
+	}
+	if conn := e.client.GetConnection(connID); conn != nil && conn.DeviceName != "" {
+		return conn.DeviceName
+	}
+	return connID
+}
+
+// ignoredCleanup reports whether a peer's delete is a cleanup of a file this
+// Mac's own ignore rules exclude too. The peer's rules alone don't decide it,
+// or any delete marked as a cleanup would get past a master.
+func (e *Engine) ignoredCleanup(del network.FileDeleteMessage) bool {
+	if !del.Ignored {
+		return false
+	}
+	localFolderPath := e.findLocalFolderByName(del.FolderName)
+	return localFolderPath != "" && e.ignores.Ignored(localFolderPath, del.RelPath)
+}
+
+// refuseRemoteDelete reports whether a peer's delete or move must be refused
+// because this Mac is the master. Nothing changes here, and the peer is sent
+// a restore list, which has it fetch what it deleted or moved away again.
+func (e *Engine) refuseRemoteDelete(folderName, relPath, connID, peerName string, send func(*network.Message) error) bool {
+	if e.cfg.GetSyncDirection() != config.SyncMaster {
+		return false
+	}
+	localFolderPath := e.findLocalFolderByName(folderName)
+	if localFolderPath == "" || peerName == "" {
+		return true
+	}
+
+	// Older peers would only ask again, so they are left as they are
+	if !network.VersionAtLeast(e.connVersion(connID), network.RestoreVersion) {
+		log.Warn().
+			Str("file", relPath).
+			Str("folder_id", localFolderPath).
+			Str("peer_id", peerName).
+			Msg("Refusing peer's delete (master mode); peer is too old to restore it")
+		return true
+	}
+
+	log.Info().
+		Str("file", relPath).
+		Str("folder_id", localFolderPath).
+		Str("peer_id", peerName).
+		Msg("Refusing peer's delete (master mode), restoring it on the peer")
+	e.addActivity(&SyncActivity{
+		Type:       "restored",
+		FileName:   filepath.Base(relPath),
+		FolderPath: localFolderPath,
+		RelPath:    relPath,
+		PeerName:   peerName,
+		Timestamp:  time.Now(),
+	})
+
+	key := reconcileKey(localFolderPath, peerName)
+	e.restores.mu.Lock()
+	defer e.restores.mu.Unlock()
+	if _, pending := e.restores.timers[key]; pending {
+		return true
+	}
+	e.restores.timers[key] = time.AfterFunc(restoreDelay, func() {
+		e.restores.mu.Lock()
+		delete(e.restores.timers, key)
+		e.restores.mu.Unlock()
+
+		if e.ctx.Err() == nil && !e.IsFolderPaused(localFolderPath) {
+			e.sendRestoreList(localFolderPath, peerName, send)
+		}
+	})
+	return true
+}
+
+// sendRestoreList sends a peer the folder's file list marked as a restore
+func (e *Engine) sendRestoreList(folderPath, peerName string, send func(*network.Message) error) {
+	e.listMu.Lock()
+	defer e.listMu.Unlock()
+
+	msg, err := e.fileListMessage(folderPath)
+	if err != nil {
+		log.Error().Err(err).Str("folder_id", folderPath).Msg("Failed to build restore list")
+		return
+	}
+	msg.Restore = true
+
+	out, err := network.NewMessage(network.MsgFileList, msg)
+	if err != nil {
+		return
+	}
+	if err := send(out); err != nil {
+		log.Error().Err(err).Str("peer_id", peerName).Msg("Failed to send restore list")
+	}
+}
@@ -0,0 +1,447 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/logging"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// moveWindow is how long the old path of a rename waits for its new path
+// before it is treated as a delete
+const moveWindow = 2 * time.Second
+
+// pendingMove is the old path of a rename waiting for its new path
+type pendingMove struct {
+	event FileEvent
+	files map[string]*FileState // Path under the old path ("" = the path itself) -> state
+	timer *time.Timer
+}
+
+// moveTracker pairs the old and new paths of local renames, and remembers
+// renames applied for peers so their watcher events aren't sent back
+type moveTracker struct {
+	mu       sync.Mutex
+	pending  map[string]*pendingMove // moveKey of the old path
+	expected map[string]time.Time    // moveKey -> when to stop ignoring events for it
+}
+
+func newMoveTracker() *moveTracker {
+	return &moveTracker{
+		pending:  make(map[string]*pendingMove),
+		expected: make(map[string]time.Time),
+	}
+}
+
+func moveKey(folderPath, relPath string) string {
+	return folderPath + "\x00" + relPath
+}
+
+func (t *moveTracker) add(move *pendingMove) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := moveKey(move.event.FolderPath, move.event.RelPath)
+	if old, ok := t.pending[key]; ok {
+		old.timer.Stop()
+	}
+	t.pending[key] = move
+}
+
+// take claims a pending move; only one caller gets it
+func (t *moveTracker) take(key string) *pendingMove {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	move, ok := t.pending[key]
+	if ok {
+		delete(t.pending, key)
+	}
+	return move
+}
+
+func (t *moveTracker) candidates(folderPath string) []*pendingMove {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var moves []*pendingMove
+	for _, move := range t.pending {
+		if move.event.FolderPath == folderPath {
+			moves = append(moves, move)
+		}
+	}
+	return moves
+}
+
+// expect ignores watcher events for paths a peer's move is about to touch
+func (t *moveTracker) expect(folderPath string, relPaths ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	until := time.Now().Add(2 * moveWindow)
+	for _, relPath := range relPaths {
+		t.expected[moveKey(folderPath, relPath)] = until
+	}
+}
+
+// isExpected reports whether an event was caused by applying a peer's move
+func (t *moveTracker) isExpected(folderPath, relPath string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for key, until := range t.expected {
+		if now.After(until) {
+			delete(t.expected, key)
+		}
+	}
+	_, ok := t.expected[moveKey(folderPath, relPath)]
+	return ok
+}
+
+// startMove holds the old path of a rename until its new path shows up, so
+// the rename can be sent as a move instead of a delete and a full upload
+func (e *Engine) startMove(event FileEvent) {
+	if e.moves.isExpected(event.FolderPath, event.RelPath) {
+		return
+	}
+
+	files := e.statesUnder(event.FolderPath, event.RelPath)
+	if len(files) == 0 {
+		e.handleFileDelete(event)
+		return
+	}
+
+	move := &pendingMove{event: event, files: files}
+	key := moveKey(event.FolderPath, event.RelPath)
+	move.timer = time.AfterFunc(moveWindow, func() {
+		if e.moves.take(key) == nil {
+			return
+		}
+		// No new path turned up: moved out of the folder or to the Trash
+		deleted := event
+		deleted.Type = EventDelete
+		e.queueFileEvent(deleted)
+	})
+	e.moves.add(move)
+}
+
+// statesUnder returns the tracked state for a path and everything under it,
+// keyed by path relative to it
+func (e *Engine) statesUnder(folderPath, relPath string) map[string]*FileState {
+	files := make(map[string]*FileState)
+	prefix := relPath + string(filepath.Separator)
+	for path, state := range e.state.GetAllFiles(folderPath) {
+		switch {
+		case path == relPath:
+			files[""] = state
+		case strings.HasPrefix(path, prefix):
+			files[strings.TrimPrefix(path, prefix)] = state
+		}
+	}
+	return files
+}
+
+// completeMove sends a new path as a move if it is the other half of a pending
+// rename. It reports whether the event was handled.
+func (e *Engine) completeMove(event FileEvent) bool {
+	if e.moves.isExpected(event.FolderPath, event.RelPath) {
+		return true
+	}
+	if _, err := os.Lstat(event.Path); err != nil {
+		return false
+	}
+
+	for _, move := range e.moves.candidates(event.FolderPath) {
+		if !movedTo(move.files, event.Path) {
+			continue
+		}
+		if e.moves.take(moveKey(move.event.FolderPath, move.event.RelPath)) == nil {
+			continue
+		}
+		move.timer.Stop()
+		e.sendLocalMove(move.event.RelPath, event)
+		return true
+	}
+	return false
+}
+
+// movedTo reports whether every file tracked under the old path is at newPath,
+// unchanged. Renames keep sizes and mod times, so nothing needs hashing.
+func movedTo(files map[string]*FileState, newPath string) bool {
+	matched := 0
+	for sub, state := range files {
+		info, err := os.Lstat(filepath.Join(newPath, sub))
+		if err != nil {
+			return false
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if info.Size() != state.Size || !info.ModTime().Equal(state.ModTime) {
+			return false
+		}
+		matched++
+	}
+	return matched > 0
+}
+
+// sendLocalMove updates state for a local rename and tells peers about it
+func (e *Engine) sendLocalMove(oldRelPath string, event FileEvent) {
+	info, err := os.Lstat(event.Path)
+	if err != nil {
+		return
+	}
+
+	e.state.MoveFileStates(event.FolderPath, oldRelPath, event.RelPath)
+
+	msg := network.FileMoveMessage{
+		FolderPath: event.FolderPath,
+		FolderName: e.folderName(event.FolderPath),
+		OldRelPath: oldRelPath,
+		NewRelPath: event.RelPath,
+		IsDir:      info.IsDir(),
+	}
+	for relPath, state := range e.statesUnder(event.FolderPath, event.RelPath) {
+		path := filepath.Join(event.RelPath, relPath)
+		if fi, err := os.Lstat(filepath.Join(event.FolderPath, path)); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		msg.Files = append(msg.Files, network.FileInfo{
+			RelPath:    path,
+			Size:       state.Size,
+			ModTime:    state.ModTime,
+			Hash:       state.Hash,
+			HashAlgo:   state.Algorithm(),
+			Permission: uint32(state.Permission),
+			FolderPath: event.FolderPath,
+		})
+	}
+	sort.Slice(msg.Files, func(i, j int) bool {
+		return msg.Files[i].RelPath < msg.Files[j].RelPath
+	})
+
+	for _, conn := range e.server.GetConnections() {
+		e.sendMove(conn.ID, conn.Version, conn.Send, msg)
+	}
+	for _, conn := range e.client.GetConnections() {
+		e.sendMove(conn.Address, conn.Version, conn.Send, msg)
+	}
+	for _, f := range msg.Files {
+		e.journalChange(event.FolderPath, f.RelPath)
+	}
+
+	e.addActivity(&SyncActivity{
+		Type:       "moved",
+		FileName:   filepath.Base(event.Path),
+		FolderPath: event.FolderPath,
+		RelPath:    event.RelPath,
+		PeerName:   "all",
+		Timestamp:  time.Now(),
+	})
+	log.Info().
+		Str("from", oldRelPath).
+		Str("to", event.RelPath).
+		Int("files", len(msg.Files)).
+		Msg("Sent move")
+}
+
+// sendMove sends a move to one peer. Peers too old to understand moves get a
+// delete of each old path and a copy of each new one.
+func (e *Engine) sendMove(peerID, version string, send func(*network.Message) error, move network.FileMoveMessage) {
+	if network.VersionAtLeast(version, network.FileMoveVersion) {
+		msg, err := network.NewMessage(network.MsgFileMove, move)
+		if err != nil {
+			return
+		}
+		if err := send(msg); err != nil {
+			log.Error().Err(err).Str("peer_id", e.connName(peerID)).Msg("Failed to send move")
+		}
+		return
+	}
+
+	for _, f := range move.Files {
+		del := network.FileDeleteMessage{
+			FolderPath: move.FolderPath,
+			FolderName: move.FolderName,
+			RelPath:    movedFrom(move, f.RelPath),
+		}
+		if msg, err := network.NewMessage(network.MsgFileDelete, del); err == nil {
+			_ = send(msg)
+		}
+
+		data, err := e.fileDataMessage(move.FolderPath, f.RelPath)
+		if err != nil {
+			log.Error().Err(err).Str("file", f.RelPath).Msg("Failed to read moved file")
+			continue
+		}
+		if err := e.pushFileData(peerID, send, data); err != nil {
+			log.Error().Err(err).Str("peer_id", e.connName(peerID)).Str("transfer_id", logging.TransferID(data.FolderName, data.RelPath, data.Hash)).Msg("Failed to send file")
+		}
+	}
+}
+
+// movedFrom returns where a moved file was before the move
+func movedFrom(move network.FileMoveMessage, relPath string) string {
+	if relPath == move.NewRelPath {
+		return move.OldRelPath
+	}
+	sub, err := filepath.Rel(move.NewRelPath, relPath)
+	if err != nil {
+		return relPath
+	}
+	return filepath.Join(move.OldRelPath, sub)
+}
+
+// handleFileMove renames the local copy of a file or folder a peer moved. If
+// that isn't possible, the move is handled as deletes and new files.
+func (e *Engine) handleFileMove(move network.FileMoveMessage, connID, peerName string, send func(*network.Message) error) {
+	if !e.cfg.CanReceive() {
+		log.Debug().Str("file", move.OldRelPath).Msg("Ignoring remote move (send_only mode)")
+		return
+	}
+
+	localFolderPath := e.findLocalFolderByName(move.FolderName)
+	if localFolderPath == "" {
+		log.Debug().
+			Str("folderName", move.FolderName).
+			Msg("No matching local folder for move")
+		return
+	}
+
+	if err := e.applyRemoteMove(localFolderPath, move); err != nil {
+		log.Info().Err(err).Str("file", move.OldRelPath).Msg("Can't rename local copy, syncing the move as deletes and new files")
+		e.fallbackMove(localFolderPath, move, connID, peerName, send)
+		return
+	}
+
+	e.addActivity(&SyncActivity{
+		Type:       "moved",
+		FileName:   filepath.Base(move.NewRelPath),
+		FolderPath: localFolderPath,
+		RelPath:    move.NewRelPath,
+		PeerName:   peerName,
+		Timestamp:  time.Now(),
+	})
+	log.Info().
+		Str("from", move.OldRelPath).
+		Str("to", move.NewRelPath).
+		Str("folder_id", localFolderPath).
+		Str("peer_id", peerName).
+		Msg("Moved file (remote request)")
+}
+
+// applyRemoteMove renames the local copy when nothing needs approval, both
+// paths are synced here, and the local copy is the one the peer moved
+func (e *Engine) applyRemoteMove(localFolderPath string, move network.FileMoveMessage) error {
+	folderCfg := e.cfg.GetFolder(localFolderPath)
+	if e.IsSafeMode() || (folderCfg != nil && folderCfg.RequiresApproval()) {
+		return errors.New("changes to this folder need approval")
+	}
+	for _, relPath := range []string{move.OldRelPath, move.NewRelPath} {
+		fullPath := filepath.Join(localFolderPath, relPath)
+		if (folderCfg != nil && !folderCfg.IncludesPath(relPath)) || e.cfg.ShouldIgnore(fullPath) || e.ignores.Ignored(localFolderPath, relPath) {
+			return fmt.Errorf("%s is not synced on this Mac", relPath)
+		}
+	}
+
+	oldPath := filepath.Join(localFolderPath, move.OldRelPath)
+	newPath := filepath.Join(localFolderPath, move.NewRelPath)
+
+	info, err := os.Lstat(oldPath)
+	if err != nil {
+		return fmt.Errorf("failed to find %s: %w", move.OldRelPath, err)
+	}
+	if info.IsDir() != move.IsDir {
+		return fmt.Errorf("%s is a different kind of item here", move.OldRelPath)
+	}
+	if _, err := os.Lstat(newPath); err == nil {
+		return fmt.Errorf("%s already exists", move.NewRelPath)
+	}
+	if !move.IsDir {
+		if len(move.Files) != 1 || e.localHash(localFolderPath, move.OldRelPath, info, move.Files[0].HashAlgo) != move.Files[0].Hash {
+			return fmt.Errorf("%s differs from the peer's copy", move.OldRelPath)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return fmt.Errorf("failed to create parent folder: %w", err)
+	}
+	applied, ok := e.startApply(localFolderPath)
+	defer applied()
+	if !ok {
+		return e.ctx.Err()
+	}
+
+	e.moves.expect(localFolderPath, move.OldRelPath, move.NewRelPath)
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return fmt.Errorf("failed to rename: %w", err)
+	}
+
+	e.state.MoveFileStates(localFolderPath, move.OldRelPath, move.NewRelPath)
+	return nil
+}
+
+// localHash returns a file's hash made with algorithm, from state when the
+// file is unchanged
+func (e *Engine) localHash(folderPath, relPath string, info os.FileInfo, algorithm string) string {
+	if state := e.state.GetFileState(folderPath, relPath); state != nil &&
+		state.Algorithm() == fileutil.HashAlgorithmOf(algorithm) &&
+		state.Size == info.Size() && state.ModTime.Equal(info.ModTime()) {
+		return state.Hash
+	}
+	hash, _ := fileutil.HashFileWith(filepath.Join(folderPath, relPath), algorithm)
+	return hash
+}
+
+// fallbackMove handles a move that couldn't be applied as a rename: each old
+// path is deleted and each new path requested, going through the usual
+// approval and safe-mode checks
+func (e *Engine) fallbackMove(localFolderPath string, move network.FileMoveMessage, connID, peerName string, send func(*network.Message) error) {
+	folderCfg := e.cfg.GetFolder(localFolderPath)
+
+	for _, f := range move.Files {
+		e.handleRemoteDelete(network.FileDeleteMessage{
+			FolderPath: move.FolderPath,
+			FolderName: move.FolderName,
+			RelPath:    movedFrom(move, f.RelPath),
+		}, peerName)
+
+		fullPath := filepath.Join(localFolderPath, f.RelPath)
+		if folderCfg != nil && !folderCfg.IncludesPath(f.RelPath) {
+			continue
+		}
+		if e.cfg.ShouldIgnore(fullPath) || e.ignores.Ignored(localFolderPath, f.RelPath) {
+			continue
+		}
+		if info, err := os.Lstat(fullPath); err == nil && e.localHash(localFolderPath, f.RelPath, info, f.HashAlgo) == f.Hash {
+			continue
+		}
+
+		if !e.planAllowed(PlanAdd, PlanItem{
+			FolderPath:       localFolderPath,
+			RelPath:          f.RelPath,
+			PeerName:         peerName,
+			Reason:           "moved on " + peerName,
+			RemoteHash:       f.Hash,
+			RemoteFolderPath: move.FolderPath,
+			FolderName:       move.FolderName,
+		}) {
+			continue
+		}
+		e.transfers.enqueue(connID, send, network.FileRequestMessage{
+			FolderPath: move.FolderPath,
+			FolderName: move.FolderName,
+			RelPath:    f.RelPath,
+		}, e.transferPriorityFor(localFolderPath, f.Size, f.ModTime))
+	}
+}
@@ -0,0 +1,272 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// reconcileOffline compares a folder with its saved state when the daemon
+// starts. Files changed, added or deleted while it was stopped are handled
+// like live changes, instead of being undone by the next file list from a
+// peer that still has the old versions.
+func (e *Engine) reconcileOffline(folderPath string) {
+	defer e.limitDeletions(folderPath)
+
+	// See rootPresent: a missing root isn't compared against state
+	if !rootPresent(folderPath) {
+		log.Warn().Str("folder_id", folderPath).Msg("Folder is missing, not checking it for changes made while stopped")
+		return
+	}
+
+	// FSEvents can say what changed since the last run, sparing a walk of
+	// the whole folder
+	var events []FileEvent
+	var err error
+	if changed, ok := e.watcher.ChangedSince(folderPath); ok {
+		roots := changedRoots(folderPath, changed)
+		log.Debug().Str("folder_id", folderPath).Int("paths", len(roots)).Msg("Checking paths FSEvents reported changed while stopped")
+		events, err = e.missedChangesUnder(folderPath, roots)
+	} else {
+		events, err = e.missedChanges(folderPath)
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("folder_id", folderPath).Msg("Failed to scan folder for changes made while stopped")
+		return
+	}
+	if len(events) == 0 {
+		return
+	}
+	log.Info().
+		Str("folder_id", folderPath).
+		Int("changes", len(events)).
+		Msg("Found changes made while stopped")
+
+	for _, event := range events {
+		e.handleFileEvent(event)
+	}
+}
+
+// limitDeletions keeps the deletions a folder remembers for peers that are
+// away within sync.deletions_max_age and sync.deletions_max_count. Deletions
+// every peer has seen are forgotten first; sync.deletions_overflow decides
+// what happens to the rest.
+func (e *Engine) limitDeletions(folderPath string) {
+	maxAge, maxCount := e.cfg.GetDeletionLimits()
+	policy := e.cfg.GetDeletionsOverflow()
+	forgotten, over := e.state.PruneTombstones(folderPath, maxAge, maxCount, policy == config.OverflowDropOldest)
+
+	if forgotten > 0 {
+		log.Warn().
+			Str("folder_id", folderPath).
+			Int("forgotten", forgotten).
+			Msg("Forgot deletions offline peers haven't seen; they will be held for a full resync")
+		e.publishError(fmt.Errorf("%s: forgot %d deletion(s) offline peers haven't seen; they are held for reconciliation when they return", folderPath, forgotten))
+		if err := e.state.Save(); err != nil {
+			log.Warn().Err(err).Msg("Failed to save state")
+		}
+	}
+
+	p := e.pipeline(folderPath)
+	p.paused.Store(over && policy == config.OverflowPause)
+	if wasOver := p.deletionsOver.Swap(over); over == wasOver {
+		return
+	}
+	if !over {
+		log.Info().Str("folder_id", folderPath).Msg("Deletions waiting for peers are back within limits")
+		return
+	}
+
+	pressure := e.state.GetDeletionPressure(folderPath)
+	log.Warn().
+		Str("folder_id", folderPath).
+		Int("deletions", pressure.Count).
+		Time("oldest", pressure.Oldest).
+		Str("policy", string(policy)).
+		Msg("Too many deletions waiting for offline peers")
+	if policy == config.OverflowPause {
+		e.publishError(fmt.Errorf("%s paused: %d deletion(s) waiting for offline peers", folderPath, pressure.Count))
+	} else {
+		e.publishError(fmt.Errorf("%s: %d deletion(s) waiting for offline peers, over the limit", folderPath, pressure.Count))
+	}
+}
+
+// missedChanges compares a folder on disk with its saved state and returns
+// the events that would bring the state up to date: deletes first, grouped
+// under the outermost deleted directory, then files added or changed
+func (e *Engine) missedChanges(folderPath string) ([]FileEvent, error) {
+	return e.missedChangesUnder(folderPath, []string{"."})
+}
+
+// changedRoots turns the full paths that changed under a folder into the
+// relative paths to check: each one once, leaving out those inside another
+func changedRoots(folderPath string, paths []string) []string {
+	set := make(map[string]bool)
+	for _, path := range paths {
+		if rel, ok := fileutil.RelWithin(folderPath, path); ok {
+			set[fileutil.NormalizePath(rel)] = true
+		}
+	}
+
+	var roots []string
+	for rel := range set {
+		if rel == "." || !underAny(set, filepath.Dir(rel)) {
+			roots = append(roots, rel)
+		}
+	}
+	sort.Strings(roots)
+	return roots
+}
+
+// underAny reports whether relPath, or a directory it is in, is in set
+func underAny(set map[string]bool, relPath string) bool {
+	for {
+		if set[relPath] {
+			return true
+		}
+		if relPath == "." || relPath == "/" || relPath == "" {
+			return false
+		}
+		relPath = filepath.Dir(relPath)
+	}
+}
+
+// missedChangesUnder is missedChanges limited to the given relative paths
+// and everything under them
+func (e *Engine) missedChangesUnder(folderPath string, roots []string) ([]FileEvent, error) {
+	known := e.state.GetAllFiles(folderPath)
+	folderCfg := e.cfg.GetFolder(folderPath)
+	rootSet := make(map[string]bool, len(roots))
+	for _, root := range roots {
+		rootSet[root] = true
+	}
+
+	var changed []FileEvent
+	visit := func(path string, info os.FileInfo, err error) {
+		if err != nil || info.IsDir() {
+			return
+		}
+		relPath, _ := filepath.Rel(folderPath, path)
+		relPath = fileutil.NormalizePath(relPath)
+
+		event := FileEvent{Type: EventCreate, Path: path, RelPath: relPath, FolderPath: folderPath, Timestamp: time.Now()}
+		if state := known[relPath]; state != nil {
+			if state.Size == info.Size() && state.ModTime.Equal(info.ModTime()) {
+				return
+			}
+			event.Type = EventModify
+		}
+		changed = append(changed, event)
+	}
+	for _, root := range roots {
+		if err := walkFolderFrom(e.folderContext(folderPath), e.cfg, e.ignores, folderPath, filepath.Join(folderPath, root), visit); err != nil {
+			return nil, err
+		}
+	}
+
+	// Tracked files that are gone, grouped under the outermost deleted directory
+	deleted := make(map[string]bool)
+	for relPath := range known {
+		if !underAny(rootSet, relPath) {
+			continue
+		}
+		if folderCfg != nil && !folderCfg.IncludesPath(relPath) {
+			continue
+		}
+		if e.ignores.Ignored(folderPath, relPath) {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(folderPath, relPath)); !os.IsNotExist(err) {
+			continue
+		}
+		top := relPath
+		for dir := filepath.Dir(relPath); dir != "."; dir = filepath.Dir(dir) {
+			if _, err := os.Lstat(filepath.Join(folderPath, dir)); !os.IsNotExist(err) {
+				break
+			}
+			top = dir
+		}
+		deleted[top] = true
+	}
+
+	paths := make([]string, 0, len(deleted))
+	for relPath := range deleted {
+		paths = append(paths, relPath)
+	}
+	sort.Strings(paths)
+
+	events := make([]FileEvent, 0, len(paths)+len(changed))
+	for _, relPath := range paths {
+		events = append(events, FileEvent{
+			Type:       EventDelete,
+			Path:       filepath.Join(folderPath, relPath),
+			RelPath:    relPath,
+			FolderPath: folderPath,
+			Timestamp:  time.Now(),
+		})
+	}
+	return append(events, changed...), nil
+}
+
+// deletedHere reports whether a file in a peer's list is one deleted here
+// since the peer last synced it. Only the version that was deleted counts: a
+// copy the peer changed since is sent back. Directories count as deleted
+// when they or a directory they're in was.
+func (e *Engine) deletedHere(folderPath string, remoteFile network.FileInfo) bool {
+	if remoteFile.IsDir {
+		for dir := remoteFile.RelPath; dir != "."; dir = filepath.Dir(dir) {
+			if e.state.GetTombstone(folderPath, dir) != nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	tomb := e.state.GetTombstone(folderPath, remoteFile.RelPath)
+	if tomb == nil {
+		return false
+	}
+	return tomb.Hash != "" && tomb.Hash == remoteFile.Hash &&
+		fileutil.HashAlgorithmOf(tomb.HashAlgo) == fileutil.HashAlgorithmOf(remoteFile.HashAlgo)
+}
+
+// sendTombstones tells a peer to delete files it listed that were deleted
+// here. Files go before the directories holding them. Deletions held as part
+// of a mass deletion aren't sent.
+func (e *Engine) sendTombstones(localFolderPath string, relPaths []string, peerName string, send func(*network.Message) error) {
+	relPaths = e.withoutHeldDeletes(localFolderPath, relPaths)
+	if len(relPaths) == 0 || !e.propagationAllowed("send delete", localFolderPath) {
+		return
+	}
+	sort.Slice(relPaths, func(i, j int) bool {
+		return len(relPaths[i]) > len(relPaths[j])
+	})
+
+	log.Info().
+		Str("folder_id", localFolderPath).
+		Str("peer_id", peerName).
+		Int("files", len(relPaths)).
+		Msg("Peer still has files deleted here, asking it to delete them")
+
+	for _, relPath := range relPaths {
+		msg, err := network.NewMessage(network.MsgFileDelete, network.FileDeleteMessage{
+			FolderPath: localFolderPath,
+			FolderName: e.folderName(localFolderPath),
+			RelPath:    relPath,
+		})
+		if err != nil {
+			continue
+		}
+		if err := send(msg); err != nil {
+			log.Error().Err(err).Str("peer_id", peerName).Msg("Failed to send delete")
+			return
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package sync
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// Apps, photo libraries and other packages are directories macOS treats as a
+// single file. Synced file by file, a peer's copy would be a mix of old and
+// new files until the last one arrived, which can leave an app that won't
+// launch or a library its app calls damaged. With sync.atomic_packages on,
+// changes inside a package aren't sent one by one: once the package has
+// settled, peers get the folder's list and fetch what changed into a copy of
+// the package, which replaces theirs once every file has arrived.
+
+// packages tracks packages changed here and packages assembled from peers
+type packages struct {
+	mu        sync.Mutex
+	settling  map[string]*time.Timer      // Full package path -> list send once it settles
+	assembled map[string]*packageAssembly // Full package path -> copy being assembled
+}
+
+// packageAssembly is a copy of a package a peer changed, filled with the
+// files fetched from it until it can replace the package here
+type packageAssembly struct {
+	folderPath string
+	root       string                 // Package path in the folder
+	shadow     string                 // Full path of the copy
+	dirs       map[string]os.FileMode // Directories in the peer's package
+	waiting    map[string]bool        // Files still to arrive
+	states     map[string]*FileState  // Received files, recorded once swapped in
+	removed    []string               // Files the peer deleted from the package
+	peerName   string
+}
+
+// remotePackage is a package in a peer's file list
+type remotePackage struct {
+	listed    map[string]network.FileInfo // Its directories and files by path
+	requested map[string]bool             // Files fetched from the peer
+	deleted   bool                        // Deleted here; the peer is asked to delete it too
+}
+
+func newPackages() *packages {
+	return &packages{
+		settling:  make(map[string]*time.Timer),
+		assembled: make(map[string]*packageAssembly),
+	}
+}
+
+// settle runs fn once path has gone delay without changing
+func (p *packages) settle(path string, delay time.Duration, fn func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if t, ok := p.settling[path]; ok {
+		t.Stop()
+	}
+	p.settling[path] = time.AfterFunc(delay, func() {
+		p.mu.Lock()
+		delete(p.settling, path)
+		p.mu.Unlock()
+		fn()
+	})
+}
+
+// target returns the assembly a received file belongs in, and where in its
+// copy to write it, or nil and fullPath for a file written in place
+func (p *packages) target(localFolderPath, relPath, fullPath string) (*packageAssembly, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, a := range p.assembled {
+		if a.folderPath != localFolderPath {
+			continue
+		}
+		if rel, ok := fileutil.RelWithin(a.root, relPath); ok && rel != "." {
+			return a, filepath.Join(a.shadow, rel)
+		}
+	}
+	return nil, fullPath
+}
+
+// arrived records a received file, reporting whether it was the last one
+// the assembly waited for
+func (p *packages) arrived(a *packageAssembly, state *FileState) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	a.states[state.RelPath] = state
+	delete(a.waiting, state.RelPath)
+	return len(a.waiting) == 0 && p.assembled[filepath.Join(a.folderPath, a.root)] == a
+}
+
+// done forgets a finished or abandoned assembly
+func (p *packages) done(a *packageAssembly) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key := filepath.Join(a.folderPath, a.root); p.assembled[key] == a {
+		delete(p.assembled, key)
+	}
+}
+
+// holds reports whether path is the copy of a package being assembled
+func (p *packages) holds(path string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, a := range p.assembled {
+		if a.shadow == path {
+			return true
+		}
+	}
+	return false
+}
+
+// packageRoot returns the outermost package a path in a folder is in, or is
+// itself, or "" if it isn't part of one
+func (e *Engine) packageRoot(folderPath, relPath string) string {
+	if !e.cfg.Sync.AtomicPackages || relPath == "." {
+		return ""
+	}
+
+	parts := strings.Split(relPath, string(filepath.Separator))
+	for i := range parts {
+		prefix := filepath.Join(parts[:i+1]...)
+		info, err := os.Lstat(filepath.Join(folderPath, prefix))
+		switch {
+		case err == nil && fileutil.IsPackage(filepath.Join(folderPath, prefix), info):
+			return prefix
+		// Parents of a path are directories even once it is gone
+		case err != nil && fileutil.HasPackageExtension(prefix) && (i < len(parts)-1 || os.IsNotExist(err)):
+			return prefix
+		}
+	}
+	return ""
+}
+
+// packageChanged handles a change inside a package here. Peers get the
+// folder's list once the package has gone sync.package_settle without
+// changing, and fetch the package as a whole. It reports whether the change
+// was inside a package; a package itself created, moved or deleted is synced
+// like any directory.
+func (e *Engine) packageChanged(event FileEvent) bool {
+	root := e.packageRoot(event.FolderPath, event.RelPath)
+	if root == "" || root == event.RelPath {
+		return false
+	}
+
+	if event.Type == EventDelete || event.Type == EventRename {
+		e.state.MarkDeleted(event.FolderPath, event.RelPath)
+	}
+	if !e.cfg.CanSend() || !e.propagationAllowed("send package change", event.Path) {
+		return true
+	}
+	e.journalChange(event.FolderPath, event.RelPath)
+
+	folderPath := event.FolderPath
+	e.packages.settle(filepath.Join(folderPath, root), e.cfg.GetPackageSettle(), func() {
+		if e.ctx.Err() != nil {
+			return
+		}
+		log.Debug().Str("folder_id", folderPath).Str("package", root).Msg("Package settled, sending folder list")
+		if err := e.SyncFolder(folderPath); err != nil {
+			log.Error().Err(err).Str("folder_id", folderPath).Msg("Failed to send folder list")
+		}
+	})
+	return true
+}
+
+// listPackages returns the packages in a peer's file list by path, leaving
+// out packages inside others, which are synced with them
+func (e *Engine) listPackages(files []network.FileInfo) map[string]*remotePackage {
+	pkgs := make(map[string]*remotePackage)
+	if !e.cfg.Sync.AtomicPackages {
+		return pkgs
+	}
+	for _, f := range files {
+		if f.IsDir && (f.Package || fileutil.HasPackageExtension(f.RelPath)) {
+			pkgs[f.RelPath] = &remotePackage{
+				listed:    make(map[string]network.FileInfo),
+				requested: make(map[string]bool),
+			}
+		}
+	}
+	for root := range pkgs {
+		if packageOf(pkgs, filepath.Dir(root)) != "" {
+			delete(pkgs, root)
+		}
+	}
+	return pkgs
+}
+
+// packageOf returns the package in pkgs a path is in, or is itself, or ""
+func packageOf(pkgs map[string]*remotePackage, relPath string) string {
+	if len(pkgs) == 0 || relPath == "." {
+		return ""
+	}
+	parts := strings.Split(relPath, string(filepath.Separator))
+	for i := range parts {
+		if prefix := filepath.Join(parts[:i+1]...); pkgs[prefix] != nil {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// assemblePackage starts assembling a copy of a package from a peer's list,
+// with the files requested from it. A package the peer deleted files from
+// loses those it had synced here, if they haven't changed since; exact is
+// unset for lists that don't name every file, which can't tell.
+func (e *Engine) assemblePackage(localFolderPath, root string, pkg *remotePackage, peerName string, exact bool) {
+	if pkg.deleted {
+		return
+	}
+	fullRoot := filepath.Join(localFolderPath, root)
+
+	_, err := os.Lstat(fullRoot)
+	missing := os.IsNotExist(err)
+	var removed []string
+	if exact && err == nil {
+		removed = e.packageRemovals(localFolderPath, root, pkg.listed)
+	}
+
+	switch {
+	case len(pkg.requested) > 0:
+	case missing:
+		// A new package waits for its files, unless it has none
+		for _, f := range pkg.listed {
+			if !f.IsDir {
+				return
+			}
+		}
+	case len(removed) == 0:
+		return
+	}
+	if !e.propagationAllowed("assemble package", fullRoot) {
+		return
+	}
+
+	dirs := make(map[string]os.FileMode)
+	for relPath, f := range pkg.listed {
+		if f.IsDir {
+			dirs[relPath] = os.FileMode(f.Permission)
+		}
+	}
+
+	e.packages.mu.Lock()
+	a := e.packages.assembled[fullRoot]
+	if a == nil {
+		shadow, err := shadowPackage(fullRoot)
+		if err != nil {
+			e.packages.mu.Unlock()
+			log.Error().Err(err).Str("path", fullRoot).Msg("Failed to copy package")
+			e.folderError(localFolderPath, err)
+			return
+		}
+		a = &packageAssembly{
+			folderPath: localFolderPath,
+			root:       root,
+			shadow:     shadow,
+			states:     make(map[string]*FileState),
+		}
+		e.packages.assembled[fullRoot] = a
+	}
+	// A later list supersedes what an earlier one was waiting for
+	a.dirs = dirs
+	a.waiting = pkg.requested
+	a.peerName = peerName
+	for _, relPath := range removed {
+		rel, _ := fileutil.RelWithin(root, relPath)
+		if err := os.Remove(filepath.Join(a.shadow, rel)); err == nil || os.IsNotExist(err) {
+			a.removed = append(a.removed, relPath)
+		}
+	}
+	complete := len(a.waiting) == 0
+	e.packages.mu.Unlock()
+
+	log.Info().
+		Str("folder_id", localFolderPath).
+		Str("package", root).
+		Str("peer_id", peerName).
+		Int("files", len(pkg.requested)).
+		Msg("Assembling package")
+
+	if complete {
+		e.finishPackage(a)
+	}
+}
+
+// packageRemovals returns files in a package here that the peer's package
+// no longer has. Only files synced before and unchanged since are removed;
+// files added here are kept.
+func (e *Engine) packageRemovals(localFolderPath, root string, listed map[string]network.FileInfo) []string {
+	var removed []string
+	_ = filepath.WalkDir(filepath.Join(localFolderPath, root), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || isTempFile(path) {
+			return nil
+		}
+		relPath, _ := filepath.Rel(localFolderPath, path)
+		relPath = fileutil.NormalizePath(relPath)
+		if _, ok := listed[relPath]; ok {
+			return nil
+		}
+		state := e.state.GetFileState(localFolderPath, relPath)
+		if state == nil {
+			return nil
+		}
+		if hash, err := e.hashFile(localFolderPath, path); err == nil && hash == state.Hash {
+			removed = append(removed, relPath)
+		}
+		return nil
+	})
+	return removed
+}
+
+// shadowPackage makes a copy of a package next to it to assemble a peer's
+// changes in. Files are cloned or hard linked rather than copied; received
+// files replace them in the copy without touching the package.
+func shadowPackage(fullRoot string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(fullRoot), 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+	shadow, err := os.MkdirTemp(filepath.Dir(fullRoot), tempPrefix+filepath.Base(fullRoot)+"-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create package copy: %w", err)
+	}
+	if _, err := os.Lstat(fullRoot); os.IsNotExist(err) {
+		return shadow, nil
+	}
+
+	_ = os.Remove(shadow)
+	if err := fileutil.CloneTree(fullRoot, shadow); err == nil {
+		return shadow, nil
+	}
+	if err := linkTree(fullRoot, shadow); err != nil {
+		_ = os.RemoveAll(shadow)
+		return "", fmt.Errorf("failed to copy package: %w", err)
+	}
+	return shadow, nil
+}
+
+// linkTree recreates the directory tree src at dst, hard linking its files,
+// or copying them where they can't be linked
+func linkTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dst, rel)
+		if isTempFile(path) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+		if err := os.Link(path, target); err == nil {
+			return nil
+		}
+		return fileutil.CopyFile(path, target)
+	})
+}
+
+// placePackageFile moves a received file into the copy of its package,
+// swapping the copy in if it was the last file the copy waited for
+func (e *Engine) placePackageFile(a *packageAssembly, staged, dest string, fileData network.FileDataMessage, peerName string) error {
+	if err := placeStaged(staged, dest); err != nil {
+		log.Error().Err(err).Str("path", dest).Msg("Failed to write package file")
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	e.publishProgress(a.folderPath, fileData.RelPath, peerName, "receive", fileData.Size, fileData.Size)
+	e.peerDB.recordTransfer(peerName, false, fileData.Size)
+
+	hash, hashAlgo := e.receivedHash(a.folderPath, dest, fileData)
+	state := &FileState{
+		RelPath:    fileData.RelPath,
+		Hash:       hash,
+		HashAlgo:   hashAlgo,
+		Size:       fileData.Size,
+		ModTime:    fileData.ModTime,
+		Permission: os.FileMode(fileData.Permission),
+		SyncedFrom: peerName,
+	}
+	log.Debug().
+		Str("file", fileData.RelPath).
+		Str("folder_id", a.folderPath).
+		Str("package", a.root).
+		Str("peer_id", peerName).
+		Msg("Received package file")
+
+	if e.packages.arrived(a, state) {
+		e.finishPackage(a)
+	}
+	return nil
+}
+
+// finishPackage swaps a fully assembled copy of a package in for the
+// package here, and records its files as synced
+func (e *Engine) finishPackage(a *packageAssembly) {
+	defer e.packages.done(a)
+	fullRoot := filepath.Join(a.folderPath, a.root)
+
+	// Directories the peer has, empty ones included, with their permissions
+	for relPath, perm := range a.dirs {
+		rel, _ := fileutil.RelWithin(a.root, relPath)
+		dir := filepath.Join(a.shadow, rel)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Warn().Err(err).Str("path", dir).Msg("Failed to create package directory")
+			continue
+		}
+		_ = os.Chmod(dir, perm|0700)
+	}
+
+	// The package is moved aside, not removed, until its copy is in place
+	var old string
+	if _, err := os.Lstat(fullRoot); err == nil {
+		old = a.shadow + "-old"
+		if err := os.Rename(fullRoot, old); err != nil {
+			log.Error().Err(err).Str("path", fullRoot).Msg("Failed to replace package")
+			e.folderError(a.folderPath, err)
+			_ = os.RemoveAll(a.shadow)
+			return
+		}
+	}
+	if err := os.Rename(a.shadow, fullRoot); err != nil {
+		if old != "" {
+			_ = os.Rename(old, fullRoot)
+		}
+		log.Error().Err(err).Str("path", fullRoot).Msg("Failed to replace package")
+		e.folderError(a.folderPath, err)
+		_ = os.RemoveAll(a.shadow)
+		return
+	}
+	if old != "" {
+		if err := os.RemoveAll(old); err != nil {
+			log.Warn().Err(err).Str("path", old).Msg("Failed to remove replaced package")
+		}
+	}
+
+	now := time.Now()
+	for _, state := range a.states {
+		state.SyncedAt = now
+		e.state.UpdateFileState(a.folderPath, state)
+	}
+	for _, relPath := range a.removed {
+		e.state.MarkDeleted(a.folderPath, relPath)
+	}
+
+	e.addActivity(&SyncActivity{
+		Type:       "received",
+		FileName:   filepath.Base(a.root),
+		FolderPath: a.folderPath,
+		RelPath:    a.root,
+		PeerName:   a.peerName,
+		Timestamp:  now,
+	})
+	log.Info().
+		Str("package", a.root).
+		Str("folder_id", a.folderPath).
+		Str("peer_id", a.peerName).
+		Int("files", len(a.states)).
+		Int("removed", len(a.removed)).
+		Msg("Received package")
+}
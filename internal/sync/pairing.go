@@ -0,0 +1,128 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/rs/zerolog/log"
+)
+
+// Initial strategies for a folder's first sync with a peer. Deletions are
+// never sent during a first sync, so an empty side can't empty the other.
+const (
+	PairSeedLocal  = "seed_local"  // Only this Mac has files; the peer is seeded from it
+	PairSeedRemote = "seed_remote" // Only the peer has files; this Mac is seeded from it
+	PairMerge      = "merge"       // Both have files; they are merged, conflicts resolved as usual
+)
+
+// PairingCheck compares both sides of a folder before its first sync with a
+// peer
+type PairingCheck struct {
+	LocalFiles  int    `json:"local_files"`
+	LocalBytes  int64  `json:"local_bytes"`
+	RemoteFiles int    `json:"remote_files"`
+	RemoteBytes int64  `json:"remote_bytes"`
+	Strategy    string `json:"strategy"` // seed_local | seed_remote | merge; empty if both sides are empty
+}
+
+// isFirstSync reports whether neither side has synced a folder with the
+// other yet. Peers that don't track sequences can't be told apart.
+func (e *Engine) isFirstSync(localFolderPath string, fileList network.FileListMessage, peerName string) bool {
+	return peerName != "" && fileList.Sequence != 0 &&
+		e.state.GetPeerSequences(localFolderPath)[peerName] == 0 &&
+		fileList.PeerSequences[e.cfg.Device.Name] == 0
+}
+
+// pairingCheck counts the files on both sides of a folder and picks the
+// strategy for its first sync
+func (e *Engine) pairingCheck(localFolderPath string, fileList network.FileListMessage) *PairingCheck {
+	check := &PairingCheck{}
+
+	_ = walkFolder(e.folderContext(localFolderPath), e.cfg, e.ignores, localFolderPath, func(path string, info os.FileInfo, err error) {
+		if err != nil || info.IsDir() {
+			return
+		}
+		check.LocalFiles++
+		check.LocalBytes += info.Size()
+	})
+
+	folderCfg := e.cfg.GetFolder(localFolderPath)
+	for _, f := range fileList.Files {
+		if f.IsDir || (folderCfg != nil && !folderCfg.IncludesPath(f.RelPath)) || e.ignores.Ignored(localFolderPath, f.RelPath) {
+			continue
+		}
+		check.RemoteFiles++
+		check.RemoteBytes += f.Size
+	}
+
+	switch {
+	case check.LocalFiles > 0 && check.RemoteFiles > 0:
+		check.Strategy = PairMerge
+	case check.LocalFiles > 0:
+		check.Strategy = PairSeedLocal
+	case check.RemoteFiles > 0:
+		check.Strategy = PairSeedRemote
+	}
+	return check
+}
+
+// holdFirstSync holds a folder's first sync with a peer until the user
+// confirms it, unless both sides are empty. It returns true if the list must
+// not be applied yet.
+func (e *Engine) holdFirstSync(localFolderPath string, fileList network.FileListMessage, connID, peerName string, send func(*network.Message) error) bool {
+	existing := e.reconcile.Get(localFolderPath, peerName)
+	if existing != nil && existing.Reason == ReasonFirstSync && existing.Confirmed {
+		log.Info().
+			Str("folder_id", localFolderPath).
+			Str("peer_id", peerName).
+			Str("strategy", existing.Pairing.Strategy).
+			Msg("First sync confirmed, starting")
+		e.finishReconciliation(localFolderPath, peerName, fileList)
+		return false
+	}
+
+	check := e.pairingCheck(localFolderPath, fileList)
+	if check.Strategy == "" || !e.cfg.Sync.ConfirmFirstSync {
+		return false
+	}
+
+	e.remoteMu.Lock()
+	e.heldLists[reconcileKey(localFolderPath, peerName)] = &heldList{fileList: fileList, connID: connID, send: send}
+	e.remoteMu.Unlock()
+
+	rec := &Reconciliation{
+		FolderPath:     localFolderPath,
+		PeerName:       peerName,
+		Reason:         ReasonFirstSync,
+		LocalSequence:  e.state.GetSequence(localFolderPath),
+		RemoteSequence: fileList.Sequence,
+		Pairing:        check,
+		Preview:        e.reconcilePreview(localFolderPath, fileList),
+		DetectedAt:     time.Now(),
+	}
+	if existing != nil {
+		rec.DetectedAt = existing.DetectedAt
+		rec.Authoritative = existing.Authoritative
+	} else {
+		log.Info().
+			Str("folder_id", localFolderPath).
+			Str("peer_id", peerName).
+			Int("localFiles", check.LocalFiles).
+			Int("remoteFiles", check.RemoteFiles).
+			Str("strategy", check.Strategy).
+			Msg("First sync with peer, holding folder for confirmation")
+		e.publishError(fmt.Errorf("first sync of %s with %s is waiting: run 'mac-profile-sync reconcile' to review and confirm it", localFolderPath, peerName))
+	}
+
+	e.reconcile.Put(rec)
+	if err := e.reconcile.Save(); err != nil {
+		log.Warn().Err(err).Msg("Failed to save reconciliations")
+	}
+
+	if rec.Authoritative != "" {
+		e.applyReconciliation(rec)
+	}
+	return true
+}
@@ -0,0 +1,300 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// pauseCheckInterval is how often the daemon picks up pauses made with the
+// pause command or the TUI
+const pauseCheckInterval = 2 * time.Second
+
+// errSyncPaused is returned for incoming files while their folder is paused
+var errSyncPaused = errors.New("sync is paused")
+
+// Pauses are what the user has paused: all syncing, or single folders. They
+// are saved, so a pause lasts across daemon restarts until resumed.
+type Pauses struct {
+	All     bool     `json:"all,omitempty"`
+	Folders []string `json:"folders,omitempty"`
+}
+
+// IsPaused reports whether a folder is paused, on its own or with all syncing
+func (p *Pauses) IsPaused(folderPath string) bool {
+	return p.All || slices.Contains(p.Folders, folderPath)
+}
+
+// SetFolder pauses or resumes a single folder
+func (p *Pauses) SetFolder(folderPath string, paused bool) {
+	p.Folders = slices.DeleteFunc(p.Folders, func(f string) bool { return f == folderPath })
+	if paused {
+		p.Folders = append(p.Folders, folderPath)
+	}
+}
+
+// pausesPath is where pauses are saved for the daemon
+func pausesPath() string {
+	return filepath.Join(config.ConfigDir(), "pause.json")
+}
+
+// LoadPauses reads the saved pauses, returning none if nothing is paused
+func LoadPauses() (*Pauses, error) {
+	data, err := os.ReadFile(pausesPath())
+	if os.IsNotExist(err) {
+		return &Pauses{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pauses: %w", err)
+	}
+
+	var pauses Pauses
+	if err := json.Unmarshal(data, &pauses); err != nil {
+		return nil, fmt.Errorf("failed to parse pauses: %w", err)
+	}
+	return &pauses, nil
+}
+
+// SavePauses saves pauses for the daemon to apply
+func SavePauses(pauses *Pauses) error {
+	if !pauses.All && len(pauses.Folders) == 0 {
+		if err := os.Remove(pausesPath()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove pauses: %w", err)
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(pauses, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal pauses: %w", err)
+	}
+	if err := os.WriteFile(pausesPath(), data, 0644); err != nil {
+		return fmt.Errorf("failed to write pauses: %w", err)
+	}
+	return nil
+}
+
+// pauseState is what the engine has paused, and the newest file list each
+// peer sent for a paused folder, applied on resume
+type pauseState struct {
+	mu       sync.Mutex
+	all      bool
+	schedule string // Why sync.schedule keeps syncing off, or ""
+	folders  map[string]bool
+	offline  map[string]bool              // Portable folders whose drive isn't mounted
+	missing  map[string]bool              // Other folders whose root is gone
+	held     map[string]map[string]func() // Folder path -> peer -> apply its list
+}
+
+func newPauseState() *pauseState {
+	return &pauseState{
+		folders: make(map[string]bool),
+		offline: make(map[string]bool),
+		missing: make(map[string]bool),
+		held:    make(map[string]map[string]func()),
+	}
+}
+
+// Pause stops sending local changes and applying peers' changes in every
+// folder. Connections stay up.
+func (e *Engine) Pause() {
+	e.paused.mu.Lock()
+	wasPaused := e.paused.all
+	e.paused.all = true
+	e.paused.mu.Unlock()
+
+	if !wasPaused {
+		log.Info().Msg("Sync paused")
+	}
+}
+
+// Resume undoes Pause. Folders paused on their own stay paused.
+func (e *Engine) Resume() {
+	e.paused.mu.Lock()
+	wasPaused := e.paused.all
+	e.paused.all = false
+	e.paused.mu.Unlock()
+
+	if !wasPaused {
+		return
+	}
+	log.Info().Msg("Sync resumed")
+	e.catchUpAll()
+}
+
+// PauseFolder stops syncing a single folder
+func (e *Engine) PauseFolder(folderPath string) {
+	e.paused.mu.Lock()
+	wasPaused := e.paused.folders[folderPath]
+	e.paused.folders[folderPath] = true
+	e.paused.mu.Unlock()
+
+	if !wasPaused {
+		log.Info().Str("folder_id", folderPath).Msg("Folder paused")
+	}
+}
+
+// ResumeFolder undoes PauseFolder. The folder stays paused while all syncing
+// is, by the user or the schedule, or while it is offline or missing.
+func (e *Engine) ResumeFolder(folderPath string) {
+	e.paused.mu.Lock()
+	wasPaused := e.paused.folders[folderPath]
+	delete(e.paused.folders, folderPath)
+	stillPaused := e.paused.all || e.paused.schedule != "" || e.paused.offline[folderPath] || e.paused.missing[folderPath]
+	e.paused.mu.Unlock()
+
+	if !wasPaused {
+		return
+	}
+	log.Info().Str("folder_id", folderPath).Msg("Folder resumed")
+	if !stillPaused {
+		e.catchUp(folderPath)
+	}
+}
+
+// IsPaused reports whether all syncing is paused
+func (e *Engine) IsPaused() bool {
+	e.paused.mu.Lock()
+	defer e.paused.mu.Unlock()
+	return e.paused.all
+}
+
+// IsFolderPaused reports whether a folder is paused, on its own or with all
+// syncing by the user or the schedule, is a portable folder whose drive
+// isn't mounted, or is missing
+func (e *Engine) IsFolderPaused(folderPath string) bool {
+	e.paused.mu.Lock()
+	defer e.paused.mu.Unlock()
+	return e.paused.all || e.paused.schedule != "" || e.paused.folders[folderPath] || e.paused.offline[folderPath] || e.paused.missing[folderPath]
+}
+
+// catchUpAll catches up every enabled folder that is no longer paused
+func (e *Engine) catchUpAll() {
+	for _, folder := range e.cfg.Folders {
+		if folder.Enabled && !e.IsFolderPaused(folder.Path) {
+			e.catchUp(folder.Path)
+		}
+	}
+}
+
+// catchUp brings a resumed folder up to date: peers' newest lists are
+// applied, and ours is sent so peers fetch our changes and send deletions
+// we missed. Local changes dropped while paused are found by a rescan.
+func (e *Engine) catchUp(folderPath string) {
+	e.paused.mu.Lock()
+	lists := e.paused.held[folderPath]
+	delete(e.paused.held, folderPath)
+	e.paused.mu.Unlock()
+
+	e.pipeline(folderPath).overflowed.Store(true)
+	for _, apply := range lists {
+		apply()
+	}
+	go func() {
+		if err := e.SyncFolder(folderPath); err != nil {
+			log.Warn().Err(err).Str("folder_id", folderPath).Msg("Failed to send file list after resuming")
+		}
+	}()
+}
+
+// holdForPause deals with a peer's change to a paused folder: its newest
+// file list is kept for when the folder resumes, file data is refused so
+// the peer retries, and other changes are dropped, since lists exchanged on
+// resume bring them back. It reports whether the message was dealt with.
+func (e *Engine) holdForPause(msg *network.Message, connID, peerName string, send func(*network.Message) error) bool {
+	switch msg.Type {
+	case network.MsgFileList, network.MsgFileRequest, network.MsgFileData, network.MsgFileDelete, network.MsgFileMove, network.MsgDirCreate, network.MsgFileMeta:
+	default:
+		return false
+	}
+
+	var target struct {
+		FolderName string `json:"folder_name"`
+	}
+	if err := msg.DecodePayload(&target); err != nil {
+		return false
+	}
+	localFolderPath := e.findLocalFolderByName(target.FolderName)
+	if localFolderPath == "" || !e.IsFolderPaused(localFolderPath) {
+		return false
+	}
+
+	switch msg.Type {
+	case network.MsgFileList:
+		e.paused.mu.Lock()
+		if e.paused.held[localFolderPath] == nil {
+			e.paused.held[localFolderPath] = make(map[string]func())
+		}
+		e.paused.held[localFolderPath][peerName] = func() {
+			e.dispatchMessage(msg, connID, peerName, send)
+		}
+		e.paused.mu.Unlock()
+
+	case network.MsgFileData:
+		var fileData network.FileDataMessage
+		if err := msg.DecodePayload(&fileData); err != nil {
+			return false
+		}
+		// Free the transfer slot; the peer sends it again after resuming
+		e.transfers.complete(connID, fileData.FolderName, fileutil.NormalizePath(fileData.RelPath))
+		reason := errSyncPaused
+		if e.IsFolderOffline(localFolderPath) {
+			reason = errFolderOffline
+		} else if e.IsFolderMissing(localFolderPath) {
+			reason = errFolderMissing
+		}
+		e.ackFileData(fileData, reason, false, send)
+	}
+
+	log.Debug().Str("folder_id", localFolderPath).Str("peer_id", peerName).Str("type", msg.Type.String()).Msg("Folder paused, not applying peer change")
+	return true
+}
+
+// pauseLoop applies pauses saved by the pause command and the TUI
+func (e *Engine) pauseLoop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(pauseCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			e.applyPauses()
+		}
+	}
+}
+
+// applyPauses brings the engine's pauses in line with the saved ones
+func (e *Engine) applyPauses() {
+	pauses, err := LoadPauses()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to load pauses")
+		return
+	}
+
+	for _, folder := range e.cfg.Folders {
+		if slices.Contains(pauses.Folders, folder.Path) {
+			e.PauseFolder(folder.Path)
+		} else {
+			e.ResumeFolder(folder.Path)
+		}
+	}
+	if pauses.All {
+		e.Pause()
+	} else {
+		e.Resume()
+	}
+}
@@ -0,0 +1,260 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/rs/zerolog/log"
+)
+
+// maxKnownAddresses is how many working addresses are remembered per peer
+const maxKnownAddresses = 5
+
+// KnownPeer is what this Mac remembers about a peer, connected or not
+type KnownPeer struct {
+	Name          string        `json:"name"`
+	Addresses     []string      `json:"addresses,omitempty"` // Addresses we reached it at, most recent first
+	Version       string        `json:"version,omitempty"`   // Protocol version from its last hello
+	FirstSeen     time.Time     `json:"first_seen"`
+	LastSeen      time.Time     `json:"last_seen"`
+	Connections   int           `json:"connections"`
+	RTT           time.Duration `json:"rtt,omitempty"` // Last measured round trip
+	FilesSent     int           `json:"files_sent"`
+	FilesReceived int           `json:"files_received"`
+	BytesSent     int64         `json:"bytes_sent"`
+	BytesReceived int64         `json:"bytes_received"`
+}
+
+// Capabilities lists the protocol features the peer supports
+func (p *KnownPeer) Capabilities() []string {
+	return network.Capabilities(p.Version)
+}
+
+// PeerStore persists what is known about peers across restarts, so the daemon
+// can reconnect before discovery finds them and the CLI can describe peers
+// that are offline
+type PeerStore struct {
+	mu      sync.Mutex
+	peers   map[string]*KnownPeer
+	path    string
+	dirty   bool
+	written time.Time // Mod time of the file as we last read or wrote it
+}
+
+// NewPeerStore creates a new peer store
+func NewPeerStore() *PeerStore {
+	return &PeerStore{
+		peers: make(map[string]*KnownPeer),
+		path:  filepath.Join(config.ConfigDir(), "known_peers.json"),
+	}
+}
+
+// Load reads known peers from disk
+func (s *PeerStore) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers, modTime, err := s.readLocked()
+	if err != nil {
+		return err
+	}
+	if peers != nil {
+		s.peers = peers
+		s.written = modTime
+	}
+	return nil
+}
+
+// readLocked reads the peers on disk, returning nil if there is no file
+func (s *PeerStore) readLocked() (map[string]*KnownPeer, time.Time, error) {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to read known peers: %w", err)
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to read known peers: %w", err)
+	}
+
+	peers := make(map[string]*KnownPeer)
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to parse known peers: %w", err)
+	}
+	return peers, info.ModTime(), nil
+}
+
+// Save writes known peers to disk
+func (s *PeerStore) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saveLocked()
+}
+
+func (s *PeerStore) saveLocked() error {
+	data, err := json.MarshalIndent(s.peers, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal known peers: %w", err)
+	}
+	if err := os.WriteFile(s.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write known peers: %w", err)
+	}
+	s.dirty = false
+	if info, err := os.Stat(s.path); err == nil {
+		s.written = info.ModTime()
+	}
+	return nil
+}
+
+// saveIfChanged writes known peers if anything changed since the last save.
+// Peers forgotten with the peers command meanwhile stay forgotten unless
+// they have been seen since.
+func (s *PeerStore) saveIfChanged() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.dirty {
+		return
+	}
+	if onDisk, modTime, err := s.readLocked(); err == nil && onDisk != nil && modTime.After(s.written) {
+		for name, p := range s.peers {
+			if _, ok := onDisk[name]; !ok && p.LastSeen.Before(modTime) {
+				delete(s.peers, name)
+			}
+		}
+	}
+	if err := s.saveLocked(); err != nil {
+		log.Debug().Err(err).Msg("Failed to save known peers")
+	}
+}
+
+// List returns known peers, most recently seen first
+func (s *PeerStore) List() []*KnownPeer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := make([]*KnownPeer, 0, len(s.peers))
+	for _, p := range s.peers {
+		copied := *p
+		copied.Addresses = slices.Clone(p.Addresses)
+		peers = append(peers, &copied)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].LastSeen.After(peers[j].LastSeen)
+	})
+	return peers
+}
+
+// Forget removes a peer, reporting whether it was known
+func (s *PeerStore) Forget(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.peers[name]; !ok {
+		return false
+	}
+	delete(s.peers, name)
+	s.dirty = true
+	return true
+}
+
+// peerLocked returns a peer's record, creating it if needed
+func (s *PeerStore) peerLocked(name string) *KnownPeer {
+	p, ok := s.peers[name]
+	if !ok {
+		p = &KnownPeer{Name: name, FirstSeen: time.Now()}
+		s.peers[name] = p
+	}
+	return p
+}
+
+// recordHello notes a peer identifying itself on a new connection. address is
+// where we dialed it, or empty for incoming connections.
+func (s *PeerStore) recordHello(name, version, address string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.peerLocked(name)
+	p.Version = version
+	p.LastSeen = time.Now()
+	p.Connections++
+	if address != "" {
+		addrs := slices.DeleteFunc(p.Addresses, func(a string) bool { return a == address })
+		p.Addresses = append([]string{address}, addrs...)
+		if len(p.Addresses) > maxKnownAddresses {
+			p.Addresses = p.Addresses[:maxKnownAddresses]
+		}
+	}
+	s.dirty = true
+}
+
+// recordSeen notes a connected peer still answering
+func (s *PeerStore) recordSeen(name string, rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.peerLocked(name)
+	p.LastSeen = time.Now()
+	if rtt > 0 {
+		p.RTT = rtt
+	}
+	s.dirty = true
+}
+
+// recordTransfer counts a file sent to or received from a peer
+func (s *PeerStore) recordTransfer(name string, sent bool, bytes int64) {
+	if name == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.peerLocked(name)
+	if sent {
+		p.FilesSent++
+		p.BytesSent += bytes
+	} else {
+		p.FilesReceived++
+		p.BytesReceived += bytes
+	}
+	s.dirty = true
+}
+
+// reconnectKnownPeers dials the addresses peers were last reached at, so
+// sync resumes without waiting for discovery to find them again
+func (e *Engine) reconnectKnownPeers() {
+	defer e.wg.Done()
+	e.dialKnownPeers()
+}
+
+// dialKnownPeers connects to each known peer at the first of its addresses
+// that answers
+func (e *Engine) dialKnownPeers() {
+	for _, p := range e.peerDB.List() {
+		if p.Name == e.cfg.Device.Name {
+			continue
+		}
+		for _, addr := range p.Addresses {
+			if e.ctx.Err() != nil {
+				return
+			}
+			if _, err := e.client.Connect(addr); err != nil {
+				log.Debug().Err(err).Str("peer_id", p.Name).Str("addr", addr).Msg("Known peer address didn't answer")
+				continue
+			}
+			log.Info().Str("peer_id", p.Name).Str("addr", addr).Msg("Reconnected to known peer")
+			break
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/rs/zerolog/log"
+)
+
+// PeerStatus describes a connected peer as last reported by the daemon
+type PeerStatus struct {
+	Name      string        `json:"name"`
+	Address   string        `json:"address"`
+	Direction string        `json:"direction"` // incoming | outgoing
+	RTT       time.Duration `json:"rtt"`
+	LastSeen  time.Time     `json:"last_seen"`
+
+	ClockOffset time.Duration `json:"clock_offset,omitempty"` // How far its clock is ahead of ours
+
+	Queue network.QueueStats `json:"queue"` // Messages waiting to be sent to it, and those dropped
+}
+
+// peerStatusPath is where the daemon publishes its connected peers
+func peerStatusPath() string {
+	return filepath.Join(config.ConfigDir(), "peers.json")
+}
+
+// LoadPeerStatus reads the connected peers last published by the daemon
+func LoadPeerStatus() ([]PeerStatus, error) {
+	data, err := os.ReadFile(peerStatusPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peer status: %w", err)
+	}
+
+	var peers []PeerStatus
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return nil, fmt.Errorf("failed to parse peer status: %w", err)
+	}
+	return peers, nil
+}
+
+// PeerStatuses returns the currently connected peers with measured latency
+// and the state of their send queues
+func (e *Engine) PeerStatuses() []PeerStatus {
+	var peers []PeerStatus
+
+	for _, conn := range e.server.GetConnections() {
+		peers = append(peers, PeerStatus{
+			Name:      conn.DeviceName,
+			Address:   conn.ID,
+			Direction: "incoming",
+			RTT:       conn.RTT(),
+			LastSeen:  conn.LastSeen,
+
+			ClockOffset: e.clocks.offset(conn.DeviceName),
+			Queue:       conn.QueueStats(),
+		})
+	}
+	for _, conn := range e.client.GetConnections() {
+		peers = append(peers, PeerStatus{
+			Name:      conn.DeviceName,
+			Address:   conn.Address,
+			Direction: "outgoing",
+			RTT:       conn.RTT(),
+			LastSeen:  conn.LastSeen,
+
+			ClockOffset: e.clocks.offset(conn.DeviceName),
+			Queue:       conn.QueueStats(),
+		})
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Address < peers[j].Address
+	})
+	return peers
+}
+
+// peerStatusLoop publishes connected peers for the CLI and TUI
+func (e *Engine) peerStatusLoop() {
+	defer e.wg.Done()
+	defer func() { _ = os.Remove(peerStatusPath()) }()
+	defer func() { _ = os.Remove(peerTracePath()) }()
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			peers := e.PeerStatuses()
+			for _, p := range peers {
+				if p.Name != "" {
+					e.peerDB.recordSeen(p.Name, p.RTT)
+				}
+			}
+			e.peerDB.saveIfChanged()
+			e.journal.saveIfChanged()
+
+			data, err := json.MarshalIndent(peers, "", "  ")
+			if err != nil {
+				continue
+			}
+			if err := os.WriteFile(peerStatusPath(), data, 0644); err != nil {
+				log.Debug().Err(err).Msg("Failed to write peer status")
+			}
+			e.publishPeerTraces()
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+// Per-folder pipeline limits
+const (
+	folderEventQueueSize = 256             // Local changes buffered per folder before it falls back to a rescan
+	folderErrorThreshold = 20              // Errors within folderErrorWindow that put a folder in backoff
+	folderErrorWindow    = time.Minute     // How far back errors are counted
+	folderBackoff        = 2 * time.Minute // How long a failing folder stops syncing
+)
+
+// Folder pipeline states
+const (
+	FolderRunning = "running"
+	FolderBackoff = "backoff"
+	FolderPaused  = "paused"   // Too many deletions waiting for offline peers (deletions_overflow: pause)
+	FolderLowDisk = "low_disk" // Not receiving until the folder's volume has more than min_free_space
+	FolderOnHold  = "on_hold"  // Paused with the pause command, the TUI or sync.schedule
+	FolderOffline = "offline"  // A portable folder, or one on an external volume, whose drive isn't mounted
+	FolderMissing = "missing"  // A folder deleted, moved, or on a volume that was unmounted
+)
+
+// errFolderBackoff is returned for incoming files while their folder backs off
+var errFolderBackoff = errors.New("folder is backing off after repeated errors")
+
+// FolderStatus describes a folder's pipeline as last reported by the daemon
+type FolderStatus struct {
+	Path           string    `json:"path"`
+	State          string    `json:"state"`
+	QueuedEvents   int       `json:"queued_events"`
+	QueuedRequests int       `json:"queued_requests"`
+	Errors         int       `json:"errors"` // Within the last folderErrorWindow
+	LastError      string    `json:"last_error,omitempty"`
+	BackoffUntil   time.Time `json:"backoff_until,omitempty"`
+
+	// Deletions remembered for peers that haven't seen them yet
+	Deletions       int       `json:"deletions"`
+	UnseenDeletions int       `json:"unseen_deletions"`
+	OldestDeletion  time.Time `json:"oldest_deletion,omitempty"`
+	DeletionsLimit  int       `json:"deletions_limit"`
+}
+
+// folderPipeline is one folder's own event queue, serve workers, and error
+// state, so heavy churn or repeated failures in one folder don't hold up the
+// others
+type folderPipeline struct {
+	path     string
+	events   chan FileEvent
+	requests *serveQueue
+
+	// Local changes were dropped; the folder is rescanned once it catches up
+	overflowed atomic.Bool
+	// Deletions waiting for offline peers are over their limits, and with
+	// deletions_overflow: pause, local changes aren't sent until they aren't
+	deletionsOver atomic.Bool
+	paused        atomic.Bool
+
+	mu           sync.Mutex
+	errors       []time.Time
+	lastError    string
+	backoffUntil time.Time
+}
+
+func newFolderPipeline(path string) *folderPipeline {
+	return &folderPipeline{
+		path:     path,
+		events:   make(chan FileEvent, folderEventQueueSize),
+		requests: newServeQueue(),
+	}
+}
+
+// backingOff reports whether the folder is paused after repeated errors
+func (p *folderPipeline) backingOff() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return time.Now().Before(p.backoffUntil)
+}
+
+// fail records an error and reports whether it put the folder in backoff
+func (p *folderPipeline) fail(err error) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	p.lastError = err.Error()
+	p.errors = append(p.pruneErrorsLocked(now), now)
+	if len(p.errors) < folderErrorThreshold || now.Before(p.backoffUntil) {
+		return false
+	}
+
+	p.backoffUntil = now.Add(folderBackoff)
+	p.errors = nil
+	return true
+}
+
+func (p *folderPipeline) pruneErrorsLocked(now time.Time) []time.Time {
+	i := 0
+	for i < len(p.errors) && now.Sub(p.errors[i]) > folderErrorWindow {
+		i++
+	}
+	return p.errors[i:]
+}
+
+func (p *folderPipeline) status() FolderStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	p.errors = p.pruneErrorsLocked(now)
+	status := FolderStatus{
+		Path:           p.path,
+		State:          FolderRunning,
+		QueuedEvents:   len(p.events),
+		QueuedRequests: p.requests.len(),
+		Errors:         len(p.errors),
+		LastError:      p.lastError,
+	}
+	if now.Before(p.backoffUntil) {
+		status.State = FolderBackoff
+		status.BackoffUntil = p.backoffUntil
+	} else if p.paused.Load() {
+		status.State = FolderPaused
+	}
+	return status
+}
+
+// pipelineSet holds the running folder pipelines, started on first use
+type pipelineSet struct {
+	mu        sync.Mutex
+	pipelines map[string]*folderPipeline
+}
+
+func newPipelineSet() *pipelineSet {
+	return &pipelineSet{pipelines: make(map[string]*folderPipeline)}
+}
+
+// folderWorkers is each folder's share of the concurrent transfer limit
+func (e *Engine) folderWorkers() int {
+	enabled := 0
+	for _, folder := range e.cfg.Folders {
+		if folder.Enabled {
+			enabled++
+		}
+	}
+	if enabled == 0 {
+		enabled = 1
+	}
+
+	workers := (e.cfg.GetMaxConcurrentTransfers() + enabled - 1) / enabled
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
+}
+
+// pipeline returns a folder's pipeline, starting it if needed
+func (e *Engine) pipeline(folderPath string) *folderPipeline {
+	e.pipelines.mu.Lock()
+	defer e.pipelines.mu.Unlock()
+
+	if p, ok := e.pipelines.pipelines[folderPath]; ok {
+		return p
+	}
+
+	workers := e.folderWorkers()
+	p := newFolderPipeline(folderPath)
+	e.pipelines.pipelines[folderPath] = p
+	if e.ctx.Err() != nil {
+		return p
+	}
+
+	e.wg.Add(1)
+	go e.folderEventLoop(p)
+	for i := 0; i < workers; i++ {
+		e.wg.Add(1)
+		go e.folderServeWorker(p)
+	}
+	return p
+}
+
+// queueFileEvent hands a local change to its folder. A folder that can't keep
+// up, or is backing off, drops the change and is rescanned later instead of
+// blocking events for every other folder.
+func (e *Engine) queueFileEvent(event FileEvent) {
+	p := e.pipeline(event.FolderPath)
+	if p.backingOff() || p.paused.Load() || e.IsFolderPaused(p.path) {
+		p.overflowed.Store(true)
+		return
+	}
+
+	select {
+	case p.events <- event:
+	default:
+		if !p.overflowed.Swap(true) {
+			log.Warn().Str("folder_id", p.path).Msg("Folder has too many changes queued, will rescan once it catches up")
+		}
+	}
+}
+
+// queueFileRequest hands a peer's file request to its folder's serve workers.
+// Requests for a folder that is backing off are dropped; the peer asks again.
+// Peers limit how many requests they have outstanding, which bounds the queue.
+func (e *Engine) queueFileRequest(job fileRequestJob) {
+	p := e.pipeline(job.req.FolderPath)
+	if p.backingOff() {
+		log.Debug().Str("folder_id", p.path).Str("file", job.req.RelPath).Msg("Folder backing off, dropping file request")
+		return
+	}
+	p.requests.push(job)
+}
+
+// serveQueue holds a folder's file requests by peer connection and hands them
+// out round-robin, so a peer fetching a whole folder doesn't hold up another
+// peer's requests
+type serveQueue struct {
+	mu    sync.Mutex
+	conns map[string][]fileRequestJob
+	order []string // Connections with queued requests, next turn first
+	size  int
+	ready chan struct{} // Signaled when requests are queued
+}
+
+func newServeQueue() *serveQueue {
+	return &serveQueue{
+		conns: make(map[string][]fileRequestJob),
+		ready: make(chan struct{}, 1),
+	}
+}
+
+func (q *serveQueue) push(job fileRequestJob) {
+	q.mu.Lock()
+	if len(q.conns[job.connID]) == 0 {
+		q.order = append(q.order, job.connID)
+	}
+	q.conns[job.connID] = append(q.conns[job.connID], job)
+	q.size++
+	q.mu.Unlock()
+
+	q.signal()
+}
+
+// pop returns the next connection's oldest request, if any are queued
+func (q *serveQueue) pop() (fileRequestJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.order) == 0 {
+		return fileRequestJob{}, false
+	}
+	connID := q.order[0]
+	q.order = q.order[1:]
+	jobs := q.conns[connID]
+	job := jobs[0]
+	if len(jobs) == 1 {
+		delete(q.conns, connID)
+	} else {
+		q.conns[connID] = jobs[1:]
+		q.order = append(q.order, connID)
+	}
+	q.size--
+
+	// Wake another worker for what's left
+	if q.size > 0 {
+		q.signal()
+	}
+	return job, true
+}
+
+func (q *serveQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *serveQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// folderEventLoop applies a folder's local changes, then rescans it if changes
+// were dropped
+func (e *Engine) folderEventLoop(p *folderPipeline) {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case event := <-p.events:
+			e.handleFileEvent(event)
+		case <-ticker.C:
+			if len(p.events) > 0 || p.backingOff() || p.paused.Load() || e.IsFolderPaused(p.path) || !p.overflowed.Swap(false) {
+				continue
+			}
+			log.Info().Str("folder_id", p.path).Msg("Rescanning folder after dropped changes")
+			if err := e.SyncFolder(p.path); err != nil {
+				e.folderError(p.path, err)
+			}
+		}
+	}
+}
+
+// folderServeWorker answers a folder's queued file requests
+func (e *Engine) folderServeWorker(p *folderPipeline) {
+	defer e.wg.Done()
+
+	for e.ctx.Err() == nil {
+		job, ok := p.requests.pop()
+		if !ok {
+			select {
+			case <-e.ctx.Done():
+			case <-p.requests.ready:
+			}
+			continue
+		}
+		if err := e.handleFileRequest(job.req, job.connID, job.send); err != nil {
+			e.folderError(p.path, err)
+		}
+	}
+}
+
+// folderError records an error against a folder, putting it in backoff if
+// errors keep coming
+func (e *Engine) folderError(folderPath string, err error) {
+	if isCanceled(err) {
+		return // Stopping, or the folder was removed
+	}
+	p := e.pipeline(folderPath)
+	if !p.fail(err) {
+		return
+	}
+
+	log.Warn().Err(err).Str("folder_id", folderPath).Dur("backoff", folderBackoff).Msg("Too many errors, pausing folder")
+	p.overflowed.Store(true)
+	e.events.Publish(Event{
+		Kind:  EventError,
+		Error: fmt.Sprintf("%s paused for %s after repeated errors: %v", folderPath, folderBackoff, err),
+	})
+}
+
+// FolderStatuses returns the state of each folder's pipeline
+func (e *Engine) FolderStatuses() []FolderStatus {
+	e.pipelines.mu.Lock()
+	pipelines := make([]*folderPipeline, 0, len(e.pipelines.pipelines))
+	for _, p := range e.pipelines.pipelines {
+		pipelines = append(pipelines, p)
+	}
+	e.pipelines.mu.Unlock()
+
+	_, limit := e.cfg.GetDeletionLimits()
+	statuses := make([]FolderStatus, 0, len(pipelines))
+	for _, p := range pipelines {
+		status := p.status()
+		if status.State == FolderRunning && e.IsFolderOffline(p.path) {
+			status.State = FolderOffline
+		} else if status.State == FolderRunning && e.IsFolderMissing(p.path) {
+			status.State = FolderMissing
+		} else if status.State == FolderRunning && e.IsFolderPaused(p.path) {
+			status.State = FolderOnHold
+		} else if status.State == FolderRunning && e.space.isLow(p.path) {
+			status.State = FolderLowDisk
+		}
+		pressure := e.state.GetDeletionPressure(p.path)
+		status.Deletions, status.UnseenDeletions, status.OldestDeletion = pressure.Count, pressure.Unseen, pressure.Oldest
+		status.DeletionsLimit = limit
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Path < statuses[j].Path
+	})
+	return statuses
+}
+
+// folderStatusPath is where the daemon publishes folder pipeline states
+func folderStatusPath() string {
+	return filepath.Join(config.ConfigDir(), "folders.json")
+}
+
+// LoadFolderStatus reads the folder pipeline states last published by the daemon
+func LoadFolderStatus() ([]FolderStatus, error) {
+	data, err := os.ReadFile(folderStatusPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read folder status: %w", err)
+	}
+
+	var folders []FolderStatus
+	if err := json.Unmarshal(data, &folders); err != nil {
+		return nil, fmt.Errorf("failed to parse folder status: %w", err)
+	}
+	return folders, nil
+}
+
+// folderStatusLoop publishes folder pipeline states for the CLI and TUI
+func (e *Engine) folderStatusLoop() {
+	defer e.wg.Done()
+	defer func() { _ = os.Remove(folderStatusPath()) }()
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			data, err := json.MarshalIndent(e.FolderStatuses(), "", "  ")
+			if err != nil {
+				continue
+			}
+			if err := os.WriteFile(folderStatusPath(), data, 0644); err != nil {
+				log.Debug().Err(err).Msg("Failed to write folder status")
+			}
+		}
+	}
+}
@@ -0,0 +1,508 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// PlanAction is the kind of change a plan item makes
+type PlanAction string
+
+const (
+	PlanAdd      PlanAction = "add"
+	PlanUpdate   PlanAction = "update"
+	PlanDelete   PlanAction = "delete"
+	PlanConflict PlanAction = "conflict"
+)
+
+// PlanItem is one change the daemon would make to this Mac
+type PlanItem struct {
+	FolderPath       string `json:"folder_path"`
+	RelPath          string `json:"rel_path"`
+	PeerName         string `json:"peer_name,omitempty"`
+	Reason           string `json:"reason"`
+	LocalHash        string `json:"local_hash,omitempty"`  // Empty if the file doesn't exist locally
+	RemoteHash       string `json:"remote_hash,omitempty"` // Empty for deletes
+	RemoteFolderPath string `json:"remote_folder_path,omitempty"`
+	FolderName       string `json:"folder_name,omitempty"`
+
+	// For conflicts, set to keep_local, keep_remote, or keep_both before applying
+	Resolution ConflictResolution `json:"resolution,omitempty"`
+}
+
+// Plan is a reviewable set of changes, recorded by a safe-mode daemon
+type Plan struct {
+	Device    string     `json:"device"`
+	CreatedAt time.Time  `json:"created_at"`
+	Adds      []PlanItem `json:"adds"`
+	Updates   []PlanItem `json:"updates"`
+	Deletes   []PlanItem `json:"deletes"`
+	Conflicts []PlanItem `json:"conflicts"`
+}
+
+// Len returns the number of items in the plan
+func (p *Plan) Len() int {
+	return len(p.Adds) + len(p.Updates) + len(p.Deletes) + len(p.Conflicts)
+}
+
+// Filter returns a plan with only the items keep accepts
+func (p *Plan) Filter(keep func(PlanItem) bool) *Plan {
+	filter := func(items []PlanItem) []PlanItem {
+		kept := []PlanItem{}
+		for _, item := range items {
+			if keep(item) {
+				kept = append(kept, item)
+			}
+		}
+		return kept
+	}
+
+	return &Plan{
+		Device:    p.Device,
+		CreatedAt: p.CreatedAt,
+		Adds:      filter(p.Adds),
+		Updates:   filter(p.Updates),
+		Deletes:   filter(p.Deletes),
+		Conflicts: filter(p.Conflicts),
+	}
+}
+
+// PlanPath returns where the safe-mode daemon writes its change plan
+func PlanPath() string {
+	return filepath.Join(config.ConfigDir(), "plan.json")
+}
+
+// ApprovalsPath returns where the daemon lists changes awaiting approval
+func ApprovalsPath() string {
+	return filepath.Join(config.ConfigDir(), "approvals.json")
+}
+
+// applyPath is where the apply command queues a plan for the daemon
+func applyPath() string {
+	return filepath.Join(config.ConfigDir(), "apply.json")
+}
+
+// ApplyStatus reports the daemon's progress through a queued plan
+type ApplyStatus struct {
+	Total      int       `json:"total"`
+	Done       int       `json:"done"`
+	Applied    int       `json:"applied"`
+	Skipped    int       `json:"skipped"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+}
+
+// Finished returns true once every item in the plan has been handled
+func (s *ApplyStatus) Finished() bool {
+	return !s.FinishedAt.IsZero()
+}
+
+// applyStatusPath is where the daemon reports progress through a queued plan
+func applyStatusPath() string {
+	return filepath.Join(config.ConfigDir(), "apply-status.json")
+}
+
+// LoadApplyStatus reads the progress of the most recent queued plan
+func LoadApplyStatus() (*ApplyStatus, error) {
+	data, err := os.ReadFile(applyStatusPath())
+	if err != nil {
+		return nil, err
+	}
+
+	var status ApplyStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, fmt.Errorf("failed to parse apply status: %w", err)
+	}
+	return &status, nil
+}
+
+func writeApplyStatus(status *ApplyStatus) {
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(applyStatusPath(), data, 0644); err != nil {
+		log.Warn().Err(err).Msg("Failed to save apply status")
+	}
+}
+
+// LoadPlan reads a plan from a file
+func LoadPlan(path string) (*Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plan: %w", err)
+	}
+
+	var plan Plan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("failed to parse plan: %w", err)
+	}
+	return &plan, nil
+}
+
+// WritePlan writes a plan to a file
+func WritePlan(path string, plan *Plan) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal plan: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write plan: %w", err)
+	}
+	return nil
+}
+
+// QueuePlan hands a plan to the running daemon to execute
+func QueuePlan(plan *Plan) error {
+	for _, item := range plan.Conflicts {
+		switch item.Resolution {
+		case "", ResolutionKeepLocal, ResolutionKeepRemote, ResolutionKeepBoth:
+		default:
+			return fmt.Errorf("invalid resolution %q for %s", item.Resolution, item.RelPath)
+		}
+	}
+
+	if err := os.MkdirAll(config.ConfigDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+
+	// Progress from an earlier plan would look like this one's
+	_ = os.Remove(applyStatusPath())
+	return WritePlan(applyPath(), plan)
+}
+
+type plannedChange struct {
+	action PlanAction
+	item   PlanItem
+}
+
+// planRecorder collects the changes safe mode holds back
+type planRecorder struct {
+	mu      sync.Mutex
+	device  string
+	started time.Time
+	changes map[string]plannedChange
+	dirty   bool
+}
+
+func newPlanRecorder(device string) *planRecorder {
+	return &planRecorder{
+		device:  device,
+		started: time.Now(),
+		changes: make(map[string]plannedChange),
+	}
+}
+
+// clear starts a new, empty plan
+func (r *planRecorder) clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.started = time.Now()
+	r.changes = make(map[string]plannedChange)
+	r.dirty = true
+}
+
+// restore repopulates the recorder from a saved plan
+func (r *planRecorder) restore(plan *Plan) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	groups := map[PlanAction][]PlanItem{
+		PlanAdd:      plan.Adds,
+		PlanUpdate:   plan.Updates,
+		PlanDelete:   plan.Deletes,
+		PlanConflict: plan.Conflicts,
+	}
+	for action, items := range groups {
+		for _, item := range items {
+			r.changes[fileKey(item.FolderPath, item.RelPath)] = plannedChange{action: action, item: item}
+		}
+	}
+}
+
+// remove forgets the planned change for a file
+func (r *planRecorder) remove(folderPath, relPath string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := fileKey(folderPath, relPath)
+	if _, ok := r.changes[key]; ok {
+		delete(r.changes, key)
+		r.dirty = true
+	}
+}
+
+// record adds or replaces the planned change for a file
+func (r *planRecorder) record(action PlanAction, item PlanItem) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.changes[fileKey(item.FolderPath, item.RelPath)] = plannedChange{action: action, item: item}
+	r.dirty = true
+}
+
+// resetFolder forgets changes a peer's previous file list produced, so a new
+// list replaces them rather than piling up stale entries
+func (r *planRecorder) resetFolder(folderPath, peerName string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, c := range r.changes {
+		if c.item.FolderPath == folderPath && c.item.PeerName == peerName && c.action != PlanDelete {
+			delete(r.changes, key)
+			r.dirty = true
+		}
+	}
+}
+
+// snapshot returns the plan if it changed since the last snapshot
+func (r *planRecorder) snapshot() (*Plan, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.dirty {
+		return nil, false
+	}
+	r.dirty = false
+
+	plan := &Plan{
+		Device:    r.device,
+		CreatedAt: r.started,
+		Adds:      []PlanItem{},
+		Updates:   []PlanItem{},
+		Deletes:   []PlanItem{},
+		Conflicts: []PlanItem{},
+	}
+	for _, c := range r.changes {
+		switch c.action {
+		case PlanAdd:
+			plan.Adds = append(plan.Adds, c.item)
+		case PlanUpdate:
+			plan.Updates = append(plan.Updates, c.item)
+		case PlanDelete:
+			plan.Deletes = append(plan.Deletes, c.item)
+		case PlanConflict:
+			plan.Conflicts = append(plan.Conflicts, c.item)
+		}
+	}
+	for _, items := range [][]PlanItem{plan.Adds, plan.Updates, plan.Deletes, plan.Conflicts} {
+		sort.Slice(items, func(i, j int) bool {
+			if items[i].FolderPath != items[j].FolderPath {
+				return items[i].FolderPath < items[j].FolderPath
+			}
+			return items[i].RelPath < items[j].RelPath
+		})
+	}
+	return plan, true
+}
+
+// planAllowed is propagationAllowed for changes to this Mac. Changes to
+// folders that need approval are staged; in safe mode the change is
+// recorded in the plan instead of being made.
+func (e *Engine) planAllowed(action PlanAction, item PlanItem) bool {
+	if folderCfg := e.cfg.GetFolder(item.FolderPath); folderCfg != nil && folderCfg.RequiresApproval() {
+		log.Info().Str("path", filepath.Join(item.FolderPath, item.RelPath)).Str("reason", item.Reason).Msg("Staged change for approval")
+		e.pending.record(action, item)
+		return false
+	}
+	if e.propagationAllowed(item.Reason, filepath.Join(item.FolderPath, item.RelPath)) {
+		return true
+	}
+	e.plan.record(action, item)
+	return false
+}
+
+// takeApproved consumes a plan approval to write a received file. The
+// approval only counts if the file is the version the plan was made for.
+func (e *Engine) takeApproved(fullPath, hash string) bool {
+	e.remoteMu.Lock()
+	defer e.remoteMu.Unlock()
+
+	expected, ok := e.approved[fullPath]
+	if !ok {
+		return false
+	}
+	delete(e.approved, fullPath)
+
+	if expected != hash {
+		log.Warn().Str("path", fullPath).Msg("Received file changed since the plan was made, not applying")
+		return false
+	}
+	return true
+}
+
+// planLoop saves the recorded plan and executes plans queued by the apply command
+func (e *Engine) planLoop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			if plan, changed := e.plan.snapshot(); changed {
+				if err := WritePlan(PlanPath(), plan); err != nil {
+					log.Warn().Err(err).Msg("Failed to save change plan")
+				}
+			}
+			if pending, changed := e.pending.snapshot(); changed {
+				if err := WritePlan(ApprovalsPath(), pending); err != nil {
+					log.Warn().Err(err).Msg("Failed to save pending approvals")
+				}
+			}
+
+			plan, err := LoadPlan(applyPath())
+			if err != nil {
+				continue
+			}
+			_ = os.Remove(applyPath())
+			e.executePlan(plan)
+		}
+	}
+}
+
+// executePlan makes exactly the changes in a plan, skipping any whose local
+// file changed since the plan was made
+func (e *Engine) executePlan(plan *Plan) {
+	log.Info().Int("items", plan.Len()).Msg("Applying change plan")
+
+	status := &ApplyStatus{Total: plan.Len(), StartedAt: time.Now()}
+	writeApplyStatus(status)
+	lastWrite := time.Now()
+
+	progress := func(ok bool) {
+		status.Done++
+		if ok {
+			status.Applied++
+		} else {
+			status.Skipped++
+		}
+		if time.Since(lastWrite) > 250*time.Millisecond {
+			writeApplyStatus(status)
+			lastWrite = time.Now()
+		}
+	}
+	apply := func(item PlanItem, ok bool) {
+		// Applied or stale, a staged change has been dealt with
+		e.pending.remove(item.FolderPath, item.RelPath)
+		progress(ok)
+	}
+
+	for _, item := range plan.Adds {
+		apply(item, e.applyFetch(item))
+	}
+	for _, item := range plan.Updates {
+		apply(item, e.applyFetch(item))
+	}
+	// Files go before the directories holding them
+	deletes := append([]PlanItem(nil), plan.Deletes...)
+	sort.SliceStable(deletes, func(i, j int) bool {
+		return len(deletes[i].RelPath) > len(deletes[j].RelPath)
+	})
+	for _, item := range deletes {
+		apply(item, e.applyDelete(item))
+	}
+	for _, item := range plan.Conflicts {
+		switch item.Resolution {
+		case ResolutionKeepRemote:
+			apply(item, e.applyFetch(item))
+		case ResolutionKeepBoth:
+			apply(item, e.applyKeepBoth(item))
+		case ResolutionKeepLocal:
+			apply(item, true)
+		default:
+			log.Info().Str("file", item.RelPath).Msg("Skipping conflict without a resolution")
+			progress(false)
+		}
+	}
+
+	status.FinishedAt = time.Now()
+	writeApplyStatus(status)
+
+	log.Info().Int("applied", status.Applied).Int("skipped", status.Skipped).Msg("Change plan applied")
+}
+
+// unchangedSincePlan checks that a local file still matches the plan
+func (e *Engine) unchangedSincePlan(item PlanItem) bool {
+	fullPath := filepath.Join(item.FolderPath, item.RelPath)
+
+	hash, err := e.hashFile(item.FolderPath, fullPath)
+	if err != nil {
+		hash = ""
+	}
+	if hash != item.LocalHash {
+		log.Warn().Str("path", fullPath).Msg("File changed since the plan was made, skipping")
+		return false
+	}
+	return true
+}
+
+func (e *Engine) applyFetch(item PlanItem) bool {
+	if !e.unchangedSincePlan(item) {
+		return false
+	}
+
+	e.remoteMu.Lock()
+	e.approved[filepath.Join(item.FolderPath, item.RelPath)] = item.RemoteHash
+	e.remoteMu.Unlock()
+
+	e.broadcastPayload(network.MsgFileRequest, network.FileRequestMessage{
+		FolderPath: item.RemoteFolderPath,
+		FolderName: item.FolderName,
+		RelPath:    item.RelPath,
+	})
+	return true
+}
+
+func (e *Engine) applyKeepBoth(item PlanItem) bool {
+	if !e.unchangedSincePlan(item) {
+		return false
+	}
+
+	fullPath := filepath.Join(item.FolderPath, item.RelPath)
+	conflictPath := fileutil.GenerateConflictName(fullPath, e.cfg.Device.Name)
+	if err := os.Rename(fullPath, conflictPath); err != nil {
+		log.Error().Err(err).Str("path", fullPath).Msg("Failed to rename local file")
+		return false
+	}
+
+	item.LocalHash = ""
+	return e.applyFetch(item)
+}
+
+func (e *Engine) applyDelete(item PlanItem) bool {
+	if !e.unchangedSincePlan(item) {
+		return false
+	}
+
+	fullPath := filepath.Join(item.FolderPath, item.RelPath)
+	if err := e.removeDeleted(item.FolderPath, item.RelPath); err != nil {
+		log.Error().Err(err).Str("path", fullPath).Msg("Failed to delete file")
+		return false
+	}
+	e.state.MarkDeleted(item.FolderPath, item.RelPath)
+
+	e.addActivity(&SyncActivity{
+		Type:       "deleted",
+		FileName:   filepath.Base(item.RelPath),
+		FolderPath: item.FolderPath,
+		RelPath:    item.RelPath,
+		PeerName:   item.PeerName,
+		Timestamp:  time.Now(),
+	})
+	return true
+}
@@ -0,0 +1,163 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// mountCheckInterval is how often portable folders' drives are looked for
+const mountCheckInterval = 2 * time.Second
+
+// errFolderOffline is returned for incoming files while their portable
+// folder's drive isn't mounted
+var errFolderOffline = errors.New("folder's drive is not mounted")
+
+// errFolderMissing is returned for incoming files while their folder is
+// missing
+var errFolderMissing = errors.New("folder is missing")
+
+// mountLoop takes portable folders offline when their drive is ejected, and
+// pauses other folders that go missing, and reconciles them when they are
+// back
+func (e *Engine) mountLoop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(mountCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			e.checkMounts()
+		}
+	}
+}
+
+// checkMounts marks each folder offline or missing, or back, by whether it
+// is there
+func (e *Engine) checkMounts() {
+	for _, folder := range e.cfg.Folders {
+		if folder.Enabled {
+			e.folderPresent(folder.Path)
+		}
+	}
+}
+
+// rootPresent reports whether a folder's root is there to be read. A root
+// that is missing, or on an external volume that isn't mounted, looks like
+// every file in the folder was deleted, so nothing may scan the folder or
+// compare it against its state until this holds again.
+func rootPresent(folderPath string) bool {
+	return fileutil.IsDir(folderPath) && fileutil.VolumeMounted(folderPath)
+}
+
+// folderPresent reports whether a folder is there. A portable folder that
+// isn't, or one on an external volume that isn't mounted, is taken offline;
+// any other is paused as missing.
+func (e *Engine) folderPresent(folderPath string) bool {
+	present := rootPresent(folderPath)
+	folderCfg := e.cfg.GetFolder(folderPath)
+	switch {
+	case present:
+		e.setFolderOffline(folderPath, false)
+		e.setFolderMissing(folderPath, false)
+	case folderCfg != nil && folderCfg.IsPortable(), !fileutil.VolumeMounted(folderPath):
+		e.setFolderMissing(folderPath, false)
+		e.setFolderOffline(folderPath, true)
+	default:
+		e.setFolderOffline(folderPath, false)
+		e.setFolderMissing(folderPath, true)
+	}
+	return present
+}
+
+// setFolderOffline takes a portable folder, or one on an external volume,
+// offline, where it is held like a paused one, or brings it back. Coming
+// back reconciles it: a rescan finds what changed on the drive while it was
+// elsewhere, and file lists are exchanged with peers.
+func (e *Engine) setFolderOffline(folderPath string, offline bool) {
+	e.paused.mu.Lock()
+	wasOffline := e.paused.offline[folderPath]
+	if offline {
+		e.paused.offline[folderPath] = true
+	} else {
+		delete(e.paused.offline, folderPath)
+	}
+	stillPaused := e.paused.all || e.paused.schedule != "" || e.paused.folders[folderPath]
+	e.paused.mu.Unlock()
+
+	if wasOffline == offline {
+		return
+	}
+	if offline {
+		log.Info().Str("folder_id", folderPath).Msg("Drive unmounted, folder offline")
+		return
+	}
+	log.Info().Str("folder_id", folderPath).Msg("Drive mounted, reconciling folder")
+	e.rewatch(folderPath)
+	if !stillPaused {
+		e.catchUp(folderPath)
+	}
+}
+
+// setFolderMissing pauses a folder that was deleted or moved, or whose
+// volume was unmounted, so its absence isn't sent to peers as the deletion
+// of every file in it, or resumes it once it is back. Coming back reconciles
+// it like a portable folder whose drive is mounted again.
+func (e *Engine) setFolderMissing(folderPath string, missing bool) {
+	e.paused.mu.Lock()
+	wasMissing := e.paused.missing[folderPath]
+	if missing {
+		e.paused.missing[folderPath] = true
+	} else {
+		delete(e.paused.missing, folderPath)
+	}
+	stillPaused := e.paused.all || e.paused.schedule != "" || e.paused.folders[folderPath] || e.paused.offline[folderPath]
+	e.paused.mu.Unlock()
+
+	if wasMissing == missing {
+		return
+	}
+	if missing {
+		log.Warn().Str("folder_id", folderPath).Msg("Folder is missing, pausing it")
+		e.publishError(fmt.Errorf("%s is missing: it was deleted or moved, or its volume was unmounted. It is paused and peers keep their copies until it is back", folderPath))
+		return
+	}
+
+	log.Info().Str("folder_id", folderPath).Msg("Folder is back, reconciling it")
+	e.rewatch(folderPath)
+	if !stillPaused {
+		e.catchUp(folderPath)
+	}
+}
+
+// rewatch watches a folder that is back again; watches on the old folder,
+// if there were any, went with it. Portable folders stay unwatched.
+func (e *Engine) rewatch(folderPath string) {
+	_ = e.watcher.RemoveFolder(folderPath)
+	if err := e.watcher.AddFolder(folderPath); err != nil {
+		log.Error().Err(err).Str("folder_id", folderPath).Msg("Failed to watch folder")
+	}
+}
+
+// IsFolderMissing reports whether a folder that isn't portable is paused
+// because it is gone
+func (e *Engine) IsFolderMissing(folderPath string) bool {
+	e.paused.mu.Lock()
+	defer e.paused.mu.Unlock()
+	return e.paused.missing[folderPath]
+}
+
+// IsFolderOffline reports whether a folder is a portable one, or one on an
+// external volume, whose drive isn't mounted
+func (e *Engine) IsFolderOffline(folderPath string) bool {
+	e.paused.mu.Lock()
+	defer e.paused.mu.Unlock()
+	return e.paused.offline[folderPath]
+}
@@ -0,0 +1,227 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// SyncPreview is what syncing a folder with a peer would do, worked out from
+// the peer's latest file list without changing anything
+type SyncPreview struct {
+	FolderPath  string     `json:"folder_path"`
+	PeerName    string     `json:"peer_name"`
+	ListedAt    time.Time  `json:"listed_at"`  // When the peer's file list arrived
+	FirstSync   bool       `json:"first_sync"` // Nothing is deleted on a folder's first sync
+	Sends       []PlanItem `json:"sends"`
+	Receives    []PlanItem `json:"receives"`
+	Deletes     []PlanItem `json:"deletes"`      // Deleted here, as they were on the peer
+	PeerDeletes []PlanItem `json:"peer_deletes"` // Deleted on the peer, as they were here
+	Conflicts   []PlanItem `json:"conflicts"`
+}
+
+// Total returns the number of files the sync would change
+func (p *SyncPreview) Total() int {
+	return len(p.Sends) + len(p.Receives) + len(p.Deletes) + len(p.PeerDeletes) + len(p.Conflicts)
+}
+
+// PlanFromPreviews makes a plan of the changes previews would make to this
+// Mac. Files this Mac would send are changes to peers and aren't included.
+func PlanFromPreviews(device string, previews []*SyncPreview) *Plan {
+	plan := &Plan{Device: device, CreatedAt: time.Now()}
+	for _, preview := range previews {
+		for _, item := range preview.Receives {
+			if item.LocalHash == "" {
+				plan.Adds = append(plan.Adds, item)
+			} else {
+				plan.Updates = append(plan.Updates, item)
+			}
+		}
+		plan.Deletes = append(plan.Deletes, preview.Deletes...)
+		plan.Conflicts = append(plan.Conflicts, preview.Conflicts...)
+	}
+	return plan
+}
+
+// StartPreview connects the engine just far enough to preview a sync: peers
+// are greeted, so they send their file lists, and the lists are kept for
+// Preview. Unlike Start, it runs no watcher or background loops and saves
+// nothing, and every other message is ignored, so neither this Mac nor a peer
+// is changed. Stop it with StopPreview.
+func (e *Engine) StartPreview() {
+	if err := e.state.Load(); err != nil {
+		log.Warn().Err(err).Msg("Failed to load state, previewing without it")
+	}
+	e.safeMode.Store(true)
+
+	e.server.SetHandlers(e.onClientConnect, e.onClientDisconnect, func(conn *network.Connection, msg *network.Message) {
+		if name := helloDeviceName(msg); name != "" {
+			conn.DeviceName = name
+		}
+		e.previewMessage(msg, conn.DeviceName, conn.Send)
+	})
+	e.client.SetHandlers(e.onServerConnect, e.onServerDisconnect, func(conn *network.ClientConnection, msg *network.Message) {
+		if name := helloDeviceName(msg); name != "" {
+			conn.DeviceName = name
+		}
+		e.previewMessage(msg, conn.DeviceName, conn.Send)
+	})
+}
+
+// StopPreview ends a preview started with StartPreview
+func (e *Engine) StopPreview() {
+	e.cancel()
+}
+
+// previewMessage handles a peer message during a preview: hellos are
+// answered and full file lists kept
+func (e *Engine) previewMessage(msg *network.Message, peerName string, send func(*network.Message) error) {
+	switch msg.Type {
+	case network.MsgHello:
+		e.measureClock(peerName, msg.Timestamp)
+		e.ackHello(send)
+
+	case network.MsgFileList:
+		var fileList network.FileListMessage
+		if err := msg.DecodePayload(&fileList); err != nil || fileList.Journal {
+			return
+		}
+		if localFolderPath := e.findLocalFolderByName(fileList.FolderName); localFolderPath != "" {
+			e.rememberListing(localFolderPath, fileList, "", peerName, send)
+		}
+	}
+}
+
+// Preview works out what syncing a folder would do with the peer whose file
+// list for it arrived last. Only hashes are cached; nothing is written.
+func (e *Engine) Preview(folderPath string) (*SyncPreview, error) {
+	folderCfg := e.cfg.GetFolder(folderPath)
+	if folderCfg == nil {
+		return nil, fmt.Errorf("folder not found: %s", folderPath)
+	}
+	folderPath = folderCfg.Path
+
+	listing := e.RemoteBrowse(folderPath)
+	if listing == nil {
+		return nil, fmt.Errorf("no file list for %s from a peer: %w", folderPath, ErrPeerOffline)
+	}
+
+	local := make(map[string]os.FileInfo)
+	err := walkFolder(e.folderContext(folderPath), e.cfg, e.ignores, folderPath, func(path string, info os.FileInfo, err error) {
+		if err != nil || info.IsDir() || isTempFile(path) {
+			return
+		}
+		if rel, err := filepath.Rel(folderPath, path); err == nil {
+			local[fileutil.NormalizePath(rel)] = info
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan folder: %w", err)
+	}
+
+	preview := &SyncPreview{
+		FolderPath: folderPath,
+		PeerName:   listing.PeerName,
+		ListedAt:   listing.ReceivedAt,
+		FirstSync:  e.state.GetPeerSequences(folderPath)[listing.PeerName] == 0,
+	}
+	limit := e.cfg.GetMaxFileSize()
+	receives, sends := e.cfg.CanReceive(), e.cfg.CanSend()
+
+	remote := make(map[string]network.FileInfo)
+	for _, remoteFile := range listing.Files {
+		if remoteFile.IsDir || !folderCfg.IncludesPath(remoteFile.RelPath) || e.ignores.Ignored(folderPath, remoteFile.RelPath) {
+			continue
+		}
+		if limit > 0 && remoteFile.Size > limit {
+			continue
+		}
+		remote[remoteFile.RelPath] = remoteFile
+
+		item := PlanItem{
+			FolderPath:       folderPath,
+			RelPath:          remoteFile.RelPath,
+			PeerName:         listing.PeerName,
+			RemoteHash:       remoteFile.Hash,
+			RemoteFolderPath: listing.RemoteFolderPath,
+			FolderName:       listing.FolderName,
+		}
+
+		localPath := filepath.Join(folderPath, remoteFile.RelPath)
+		if _, ok := local[remoteFile.RelPath]; !ok {
+			switch {
+			case !preview.FirstSync && e.deletedHere(folderPath, remoteFile):
+				if sends {
+					item.Reason = "deleted on this Mac"
+					preview.PeerDeletes = append(preview.PeerDeletes, item)
+				}
+			case receives:
+				item.Reason = "new on " + listing.PeerName
+				preview.Receives = append(preview.Receives, item)
+			}
+			continue
+		}
+
+		localHash, err := e.hashFile(folderPath, localPath)
+		if err != nil {
+			continue
+		}
+		item.LocalHash = localHash
+		if matchesHash(localPath, localHash, e.hashAlgo(folderPath), remoteFile.Hash, remoteFile.HashAlgo) {
+			continue
+		}
+
+		// The side still at the last synced version is the one that didn't change
+		known := e.state.GetFileState(folderPath, remoteFile.RelPath)
+		switch {
+		case known != nil && known.Algorithm() == e.hashAlgo(folderPath) && known.Hash == localHash:
+			if receives {
+				item.Reason = "newer on " + listing.PeerName
+				preview.Receives = append(preview.Receives, item)
+			}
+		case known != nil && known.Hash == remoteFile.Hash && known.Algorithm() == fileutil.HashAlgorithmOf(remoteFile.HashAlgo):
+			if sends {
+				item.Reason = "changed on this Mac"
+				preview.Sends = append(preview.Sends, item)
+			}
+		default:
+			item.Reason = e.conflictReason(folderPath, remoteFile.RelPath, false)
+			preview.Conflicts = append(preview.Conflicts, item)
+		}
+	}
+
+	for rel := range local {
+		if _, ok := remote[rel]; ok {
+			continue
+		}
+		item := PlanItem{FolderPath: folderPath, RelPath: rel, PeerName: listing.PeerName}
+
+		// A file last received from the peer and unchanged since is one it deleted
+		known := e.state.GetFileState(folderPath, rel)
+		if !preview.FirstSync && known != nil && known.SyncedFrom == listing.PeerName {
+			if hash, err := e.hashFile(folderPath, filepath.Join(folderPath, rel)); err == nil && hash == known.Hash {
+				if receives {
+					item.LocalHash = hash
+					item.Reason = "deleted on " + listing.PeerName
+					preview.Deletes = append(preview.Deletes, item)
+				}
+				continue
+			}
+		}
+		if sends {
+			item.Reason = "new on this Mac"
+			preview.Sends = append(preview.Sends, item)
+		}
+	}
+
+	for _, items := range [][]PlanItem{preview.Sends, preview.Receives, preview.Deletes, preview.PeerDeletes, preview.Conflicts} {
+		sort.Slice(items, func(i, j int) bool { return items[i].RelPath < items[j].RelPath })
+	}
+	return preview, nil
+}
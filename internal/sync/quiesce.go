@@ -0,0 +1,181 @@
+package sync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+// openCheckMinSize is the smallest file checked for processes writing it.
+// Smaller files are written in one go, and lsof costs more than waiting.
+const openCheckMinSize = 1 << 20
+
+// openCheckTimeout bounds how long lsof may take
+const openCheckTimeout = 5 * time.Second
+
+// quiescence holds new and changed files until they have stopped changing,
+// so a file still being copied or downloaded into a folder isn't sent half
+// written. A file is sent once its size and modification time have stayed
+// the same for sync.stable_interval and, if it is large, no process has it
+// open for writing.
+type quiescence struct {
+	cfg  *config.Config
+	emit func(FileEvent) bool
+
+	mu    sync.Mutex
+	files map[string]*unsettledFile
+}
+
+// unsettledFile is a file waiting to stop changing
+type unsettledFile struct {
+	event      FileEvent
+	size       int64
+	modTime    time.Time
+	openSince  time.Time // When it was first found open for writing
+	timer      *time.Timer
+	reportedAt time.Time
+}
+
+func newQuiescence(cfg *config.Config, emit func(FileEvent) bool) *quiescence {
+	return &quiescence{
+		cfg:   cfg,
+		emit:  emit,
+		files: make(map[string]*unsettledFile),
+	}
+}
+
+// hold reports whether a change is held until its file stops changing.
+// Only new and modified files are held; a later change to a held file
+// restarts its wait.
+func (q *quiescence) hold(event *FileEvent) bool {
+	interval := q.cfg.GetStableInterval()
+	if interval <= 0 || (event.Type != EventCreate && event.Type != EventModify) {
+		return false
+	}
+	info, err := os.Stat(event.Path)
+	if err != nil || info.IsDir() {
+		return false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	f, ok := q.files[event.Path]
+	if !ok {
+		f = &unsettledFile{}
+		q.files[event.Path] = f
+	} else if f.timer != nil {
+		f.timer.Stop()
+	}
+	// A create followed by writes is still new to peers
+	if !ok || f.event.Type != EventCreate {
+		f.event = *event
+	}
+	f.size, f.modTime = info.Size(), info.ModTime()
+
+	path := event.Path
+	f.timer = time.AfterFunc(interval, func() { q.check(path) })
+	return true
+}
+
+// check sends a held file if it hasn't changed since it was last looked at,
+// and otherwise waits another interval
+func (q *quiescence) check(path string) {
+	q.mu.Lock()
+	f, ok := q.files[path]
+	if !ok {
+		q.mu.Unlock()
+		return
+	}
+	size, modTime := f.size, f.modTime
+	q.mu.Unlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		// Gone; its delete or rename event follows
+		q.drop(path)
+		return
+	}
+
+	changed := info.Size() != size || !info.ModTime().Equal(modTime)
+	writing := false
+	if !changed && info.Size() >= openCheckMinSize && q.cfg.Sync.CheckOpenFiles {
+		writing = openForWriting(path)
+	}
+
+	q.mu.Lock()
+	f, ok = q.files[path]
+	if !ok {
+		q.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	_, _, maxDelay := q.cfg.GetChurnLimits()
+	switch {
+	case changed:
+		f.size, f.modTime = info.Size(), info.ModTime()
+		f.openSince = time.Time{}
+	case writing && f.openSince.IsZero():
+		f.openSince = now
+		log.Debug().Str("path", path).Msg("File is open for writing, holding it until it is closed")
+	case writing && now.Sub(f.openSince) < maxDelay:
+	default:
+		// Stable, or kept open longer than a busy file is held
+		if writing {
+			log.Debug().Str("path", path).Dur("open", now.Sub(f.openSince)).Msg("File still open for writing, sending it anyway")
+		}
+		event := f.event
+		delete(q.files, path)
+		q.mu.Unlock()
+		_ = q.emit(event)
+		return
+	}
+	if changed && now.Sub(f.reportedAt) >= time.Minute {
+		f.reportedAt = now
+		log.Debug().Str("path", path).Int64("size", info.Size()).Msg("File is still changing, waiting for it to settle")
+	}
+	f.timer = time.AfterFunc(q.cfg.GetStableInterval(), func() { q.check(path) })
+	q.mu.Unlock()
+}
+
+// drop forgets a held file, when it is deleted or renamed or a busy file's
+// own hold takes over
+func (q *quiescence) drop(path string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if f, ok := q.files[path]; ok {
+		if f.timer != nil {
+			f.timer.Stop()
+		}
+		delete(q.files, path)
+	}
+}
+
+// openForWriting reports whether a process has a file open for writing,
+// according to lsof. If lsof can't tell, the file is taken as closed.
+func openForWriting(path string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), openCheckTimeout)
+	defer cancel()
+
+	// -F a lists each open descriptor's access mode: r, w or u (read/write)
+	output, err := exec.CommandContext(ctx, "lsof", "-w", "-F", "a", "--", path).Output()
+	if err != nil {
+		// lsof exits 1 when no process has the file open
+		return false
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		if line := scanner.Text(); line == "aw" || line == "au" {
+			return true
+		}
+	}
+	return false
+}
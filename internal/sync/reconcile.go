@@ -0,0 +1,588 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/rs/zerolog/log"
+)
+
+// Sides of a reconciliation
+const (
+	SideLocal  = "local"
+	SideRemote = "remote"
+)
+
+// Reasons a folder is held for reconciliation
+const (
+	ReasonRestore   = "restore"    // One side appears to have been restored from a backup
+	ReasonStale     = "stale"      // The peer was away longer than the deletions it missed were remembered
+	ReasonFirstSync = "first_sync" // Neither side has synced the folder with the other yet
+)
+
+// Reconciliation is a folder held back from syncing with a peer because one
+// side appears to have been restored from a backup, the peer missed
+// deletions that were since forgotten, or it is their first sync
+type Reconciliation struct {
+	FolderPath     string            `json:"folder_path"`
+	PeerName       string            `json:"peer_name"`
+	Reason         string            `json:"reason,omitempty"` // restore (default) | stale | first_sync
+	RestoredSide   string            `json:"restored_side"`    // local | remote; remote when stale
+	LocalSequence  uint64            `json:"local_sequence"`   // Our sequence when detected
+	RemoteSequence uint64            `json:"remote_sequence"`  // Peer's sequence when detected
+	Preview        *ReconcilePreview `json:"preview"`
+	DetectedAt     time.Time         `json:"detected_at"`
+	Authoritative  string            `json:"authoritative,omitempty"` // Side chosen by the user
+	Pairing        *PairingCheck     `json:"pairing,omitempty"`       // Both sides' contents, for a first sync
+	Confirmed      bool              `json:"confirmed,omitempty"`     // First sync confirmed by the user
+}
+
+// ReconcilePreview lists how the two sides of a folder differ
+type ReconcilePreview struct {
+	OnlyLocal   []string `json:"only_local"`
+	OnlyRemote  []string `json:"only_remote"`
+	LocalNewer  []string `json:"local_newer"`
+	RemoteNewer []string `json:"remote_newer"`
+}
+
+// Total returns the number of differing files
+func (p *ReconcilePreview) Total() int {
+	return len(p.OnlyLocal) + len(p.OnlyRemote) + len(p.LocalNewer) + len(p.RemoteNewer)
+}
+
+// ReconcileStore persists pending reconciliations so the CLI can review them
+// and record which side should win
+type ReconcileStore struct {
+	mu    sync.RWMutex
+	items map[string]*Reconciliation
+	path  string
+}
+
+// NewReconcileStore creates a new reconciliation store
+func NewReconcileStore() *ReconcileStore {
+	return &ReconcileStore{
+		items: make(map[string]*Reconciliation),
+		path:  filepath.Join(config.ConfigDir(), "reconcile.json"),
+	}
+}
+
+func reconcileKey(folderPath, peerName string) string {
+	return folderPath + "\x00" + peerName
+}
+
+// Load reads pending reconciliations from disk
+func (s *ReconcileStore) Load() error {
+	list, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.items = make(map[string]*Reconciliation, len(list))
+	for _, r := range list {
+		s.items[reconcileKey(r.FolderPath, r.PeerName)] = r
+	}
+	return nil
+}
+
+// LoadDecisions picks up the sides chosen and first syncs confirmed on disk
+// for reconciliations still pending in memory. Unlike Load it never drops or
+// replaces them, so reconciliations raised since the file was written stay.
+func (s *ReconcileStore) LoadDecisions() error {
+	return s.mergeDecisions(true)
+}
+
+// mergeDecisions copies decisions on disk into pending reconciliations. A
+// side chosen in memory is only replaced if overwrite is set.
+func (s *ReconcileStore) mergeDecisions(overwrite bool) error {
+	list, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, onDisk := range list {
+		r := s.items[reconcileKey(onDisk.FolderPath, onDisk.PeerName)]
+		if r == nil {
+			continue
+		}
+		if onDisk.Authoritative != "" && (overwrite || r.Authoritative == "") {
+			r.Authoritative = onDisk.Authoritative
+		}
+		if onDisk.Confirmed {
+			r.Confirmed = true
+		}
+	}
+	return nil
+}
+
+func (s *ReconcileStore) read() ([]*Reconciliation, error) {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reconciliations: %w", err)
+	}
+
+	var list []*Reconciliation
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse reconciliations: %w", err)
+	}
+	return list, nil
+}
+
+// Save writes pending reconciliations to disk, keeping decisions written
+// there since they were last loaded
+func (s *ReconcileStore) Save() error {
+	if err := s.mergeDecisions(false); err != nil {
+		log.Warn().Err(err).Msg("Failed to load reconciliation decisions")
+	}
+	list := s.List()
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal reconciliations: %w", err)
+	}
+
+	if err := os.WriteFile(s.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write reconciliations: %w", err)
+	}
+	return nil
+}
+
+// Get returns the pending reconciliation for a folder and peer
+func (s *ReconcileStore) Get(folderPath, peerName string) *Reconciliation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.items[reconcileKey(folderPath, peerName)]
+}
+
+// Put adds or replaces a pending reconciliation
+func (s *ReconcileStore) Put(r *Reconciliation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[reconcileKey(r.FolderPath, r.PeerName)] = r
+}
+
+// Remove deletes a pending reconciliation
+func (s *ReconcileStore) Remove(folderPath, peerName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, reconcileKey(folderPath, peerName))
+}
+
+// List returns all pending reconciliations sorted by folder and peer
+func (s *ReconcileStore) List() []*Reconciliation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]*Reconciliation, 0, len(s.items))
+	for _, r := range s.items {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].FolderPath != list[j].FolderPath {
+			return list[i].FolderPath < list[j].FolderPath
+		}
+		return list[i].PeerName < list[j].PeerName
+	})
+	return list
+}
+
+// SetAuthoritative records the side that should win for every pending
+// reconciliation of a folder. Returns the number of reconciliations updated.
+func (s *ReconcileStore) SetAuthoritative(folderPath, side string) (int, error) {
+	if side != SideLocal && side != SideRemote {
+		return 0, fmt.Errorf("invalid side %q (use %s or %s)", side, SideLocal, SideRemote)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, r := range s.items {
+		if r.FolderPath == folderPath {
+			r.Authoritative = side
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Confirm confirms the pending first syncs of a folder with their suggested
+// strategy. Returns the number of reconciliations updated.
+func (s *ReconcileStore) Confirm(folderPath string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, r := range s.items {
+		if r.FolderPath == folderPath && r.Reason == ReasonFirstSync {
+			r.Confirmed = true
+			count++
+		}
+	}
+	return count
+}
+
+// heldList is a peer's file list kept while its folder awaits reconciliation
+type heldList struct {
+	fileList network.FileListMessage
+	connID   string
+	send     func(*network.Message) error
+}
+
+// holdForReconciliation checks a received file list for signs that either
+// side was restored from backup. It returns true if the list must not be
+// applied incrementally.
+func (e *Engine) holdForReconciliation(localFolderPath string, fileList network.FileListMessage, connID, peerName string, send func(*network.Message) error) bool {
+	// Peers that don't track sequences can't be checked
+	if peerName == "" || fileList.Sequence == 0 {
+		return false
+	}
+
+	key := reconcileKey(localFolderPath, peerName)
+
+	// The peer's user chose their side as authoritative; mirror it, but only
+	// if this Mac is holding the folder for reconciliation with that peer too
+	if fileList.Authoritative && e.reconcile.Get(localFolderPath, peerName) == nil {
+		log.Warn().
+			Str("folder_id", localFolderPath).
+			Str("peer_id", peerName).
+			Msg("Ignoring authoritative file list with no reconciliation pending")
+		fileList.Authoritative = false
+	}
+	if fileList.Authoritative {
+		log.Info().
+			Str("folder_id", localFolderPath).
+			Str("peer_id", peerName).
+			Msg("Peer sent authoritative file list, mirroring")
+		e.mirrorRemote(localFolderPath, fileList, connID, peerName, send)
+		e.finishReconciliation(localFolderPath, peerName, fileList)
+		return true
+	}
+
+	// Neither side has synced this folder with the other; compare them first
+	if e.isFirstSync(localFolderPath, fileList, peerName) && e.holdFirstSync(localFolderPath, fileList, connID, peerName, send) {
+		return true
+	}
+
+	known := e.state.GetPeerSequences(localFolderPath)[peerName]
+	localSeq := e.state.GetSequence(localFolderPath)
+
+	e.state.SetPeerAck(localFolderPath, peerName, fileList.PeerSequences[e.cfg.Device.Name])
+
+	restored, reason := "", ReasonRestore
+	switch {
+	case fileList.Sequence < known:
+		restored = SideRemote
+	case fileList.PeerSequences[e.cfg.Device.Name] > localSeq:
+		restored = SideLocal
+	case e.state.MissedForgottenDeletions(localFolderPath, peerName):
+		// Applying its list would bring back files deleted here
+		restored, reason = SideRemote, ReasonStale
+	}
+
+	existing := e.reconcile.Get(localFolderPath, peerName)
+
+	if restored == "" {
+		if existing != nil {
+			log.Info().
+				Str("folder_id", localFolderPath).
+				Str("peer_id", peerName).
+				Msg("Restore no longer detected, resuming sync")
+			e.finishReconciliation(localFolderPath, peerName, fileList)
+		} else {
+			e.state.SetPeerSequence(localFolderPath, peerName, fileList.Sequence)
+		}
+		return false
+	}
+
+	e.remoteMu.Lock()
+	e.heldLists[key] = &heldList{fileList: fileList, connID: connID, send: send}
+	e.remoteMu.Unlock()
+
+	rec := &Reconciliation{
+		FolderPath:     localFolderPath,
+		PeerName:       peerName,
+		Reason:         reason,
+		RestoredSide:   restored,
+		LocalSequence:  localSeq,
+		RemoteSequence: fileList.Sequence,
+		Preview:        e.reconcilePreview(localFolderPath, fileList),
+		DetectedAt:     time.Now(),
+	}
+	if existing != nil {
+		rec.DetectedAt = existing.DetectedAt
+		rec.Authoritative = existing.Authoritative
+	} else if reason == ReasonStale {
+		log.Warn().
+			Str("folder_id", localFolderPath).
+			Str("peer_id", peerName).
+			Int("differences", rec.Preview.Total()).
+			Msg("Peer missed forgotten deletions, holding folder for reconciliation")
+		e.publishError(fmt.Errorf("%s was away too long to sync %s incrementally: run 'mac-profile-sync reconcile'", peerName, localFolderPath))
+	} else {
+		// Our own state came back from a backup; make peers re-verify it
+		if restored == SideLocal {
+			e.state.BumpGeneration(localFolderPath)
+		}
+		log.Warn().
+			Str("folder_id", localFolderPath).
+			Str("peer_id", peerName).
+			Str("restored", restored).
+			Int("differences", rec.Preview.Total()).
+			Msg("Restore detected, holding folder for reconciliation")
+		e.publishError(fmt.Errorf("restore detected for %s with %s: run 'mac-profile-sync reconcile'", localFolderPath, peerName))
+	}
+
+	e.reconcile.Put(rec)
+	if err := e.reconcile.Save(); err != nil {
+		log.Warn().Err(err).Msg("Failed to save reconciliations")
+	}
+
+	if rec.Authoritative != "" {
+		e.applyReconciliation(rec)
+	}
+	return true
+}
+
+// reconcilePreview compares a peer's file list with the local folder
+func (e *Engine) reconcilePreview(localFolderPath string, fileList network.FileListMessage) *ReconcilePreview {
+	preview := &ReconcilePreview{}
+	folderCfg := e.cfg.GetFolder(localFolderPath)
+
+	remote := make(map[string]bool, len(fileList.Files))
+	for _, f := range fileList.Files {
+		if f.IsDir || (folderCfg != nil && !folderCfg.IncludesPath(f.RelPath)) || e.ignores.Ignored(localFolderPath, f.RelPath) {
+			continue
+		}
+		remote[f.RelPath] = true
+
+		localPath := filepath.Join(localFolderPath, f.RelPath)
+		info, err := os.Stat(localPath)
+		if err != nil {
+			preview.OnlyRemote = append(preview.OnlyRemote, f.RelPath)
+			continue
+		}
+		if hash, _ := e.hashFile(localFolderPath, localPath); matchesHash(localPath, hash, e.hashAlgo(localFolderPath), f.Hash, f.HashAlgo) {
+			continue
+		}
+		if info.ModTime().After(f.ModTime) {
+			preview.LocalNewer = append(preview.LocalNewer, f.RelPath)
+		} else {
+			preview.RemoteNewer = append(preview.RemoteNewer, f.RelPath)
+		}
+	}
+
+	for relPath := range e.state.GetAllFiles(localFolderPath) {
+		if remote[relPath] || (folderCfg != nil && !folderCfg.IncludesPath(relPath)) || e.ignores.Ignored(localFolderPath, relPath) {
+			continue
+		}
+		preview.OnlyLocal = append(preview.OnlyLocal, relPath)
+	}
+
+	sort.Strings(preview.OnlyLocal)
+	sort.Strings(preview.OnlyRemote)
+	sort.Strings(preview.LocalNewer)
+	sort.Strings(preview.RemoteNewer)
+	return preview
+}
+
+// reconcileLoop picks up sides chosen with the reconcile command
+func (e *Engine) reconcileLoop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.reconcile.LoadDecisions(); err != nil {
+				log.Warn().Err(err).Msg("Failed to load reconciliations")
+				continue
+			}
+			for _, rec := range e.reconcile.List() {
+				if rec.Authoritative != "" || rec.Confirmed {
+					e.applyReconciliation(rec)
+				}
+			}
+		}
+	}
+}
+
+// applyReconciliation makes the chosen side authoritative for a held folder
+func (e *Engine) applyReconciliation(rec *Reconciliation) {
+	key := reconcileKey(rec.FolderPath, rec.PeerName)
+
+	e.remoteMu.RLock()
+	held := e.heldLists[key]
+	e.remoteMu.RUnlock()
+
+	// Wait for the peer to reconnect and send its list again
+	if held == nil {
+		return
+	}
+
+	log.Info().
+		Str("folder_id", rec.FolderPath).
+		Str("peer_id", rec.PeerName).
+		Str("authoritative", rec.Authoritative).
+		Msg("Applying reconciliation")
+
+	// A confirmed first sync applies the held list as usual
+	if rec.Authoritative == "" {
+		e.handleFileList(held.fileList, held.connID, rec.PeerName, held.send)
+		return
+	}
+
+	switch rec.Authoritative {
+	case SideRemote:
+		e.mirrorRemote(rec.FolderPath, held.fileList, held.connID, rec.PeerName, held.send)
+		e.finishReconciliation(rec.FolderPath, rec.PeerName, held.fileList)
+
+	case SideLocal:
+		if !e.propagationAllowed("send authoritative list", rec.FolderPath) {
+			return
+		}
+		e.finishReconciliation(rec.FolderPath, rec.PeerName, held.fileList)
+
+		e.listMu.Lock()
+		defer e.listMu.Unlock()
+
+		msg, err := e.fileListMessage(rec.FolderPath)
+		if err != nil {
+			log.Error().Err(err).Str("folder_id", rec.FolderPath).Msg("Failed to build authoritative file list")
+			return
+		}
+		msg.Authoritative = true
+
+		out, err := network.NewMessage(network.MsgFileList, msg)
+		if err != nil {
+			return
+		}
+		if err := held.send(out); err != nil {
+			log.Error().Err(err).Str("peer_id", rec.PeerName).Msg("Failed to send authoritative file list")
+		}
+	}
+}
+
+// finishReconciliation accepts the peer's current sequence, moves ours past
+// anything the peer remembers, and releases the folder
+func (e *Engine) finishReconciliation(localFolderPath, peerName string, fileList network.FileListMessage) {
+	e.state.SetPeerSequence(localFolderPath, peerName, fileList.Sequence)
+	e.state.AdvanceSequence(localFolderPath, fileList.PeerSequences[e.cfg.Device.Name])
+	e.state.ClearMissedDeletions(localFolderPath, peerName)
+	if err := e.state.Save(); err != nil {
+		log.Warn().Err(err).Msg("Failed to save state")
+	}
+
+	e.remoteMu.Lock()
+	delete(e.heldLists, reconcileKey(localFolderPath, peerName))
+	e.remoteMu.Unlock()
+
+	e.reconcile.Remove(localFolderPath, peerName)
+	if err := e.reconcile.Save(); err != nil {
+		log.Warn().Err(err).Msg("Failed to save reconciliations")
+	}
+}
+
+// mirrorRemote makes the local folder match a peer's file list: differing
+// files are fetched regardless of mod time and tracked files the peer no
+// longer has are deleted. Untracked local files are left alone.
+func (e *Engine) mirrorRemote(localFolderPath string, fileList network.FileListMessage, connID, peerName string, send func(*network.Message) error) {
+	if !e.cfg.CanReceive() {
+		log.Debug().Msg("Not mirroring peer (send_only mode)")
+		return
+	}
+
+	folderCfg := e.cfg.GetFolder(localFolderPath)
+	remote := make(map[string]bool, len(fileList.Files))
+
+	for _, f := range fileList.Files {
+		if f.IsDir || (folderCfg != nil && !folderCfg.IncludesPath(f.RelPath)) || e.ignores.Ignored(localFolderPath, f.RelPath) {
+			continue
+		}
+		remote[f.RelPath] = true
+
+		localPath := filepath.Join(localFolderPath, f.RelPath)
+		hash, err := e.hashFile(localFolderPath, localPath)
+		if err == nil && matchesHash(localPath, hash, e.hashAlgo(localFolderPath), f.Hash, f.HashAlgo) {
+			continue
+		}
+
+		action := PlanUpdate
+		if errors.Is(err, os.ErrNotExist) {
+			action = PlanAdd
+		}
+		if !e.planAllowed(action, PlanItem{
+			FolderPath:       localFolderPath,
+			RelPath:          f.RelPath,
+			PeerName:         peerName,
+			Reason:           "reconcile: " + peerName + " is authoritative",
+			LocalHash:        hash,
+			RemoteHash:       f.Hash,
+			RemoteFolderPath: fileList.FolderPath,
+			FolderName:       fileList.FolderName,
+		}) {
+			continue
+		}
+		e.transfers.enqueue(connID, send, network.FileRequestMessage{
+			FolderPath: fileList.FolderPath,
+			FolderName: fileList.FolderName,
+			RelPath:    f.RelPath,
+		}, e.transferPriorityFor(localFolderPath, f.Size, f.ModTime))
+	}
+
+	for relPath := range e.state.GetAllFiles(localFolderPath) {
+		if remote[relPath] || (folderCfg != nil && !folderCfg.IncludesPath(relPath)) || e.ignores.Ignored(localFolderPath, relPath) {
+			continue
+		}
+
+		fullPath := filepath.Join(localFolderPath, relPath)
+		hash, _ := e.hashFile(localFolderPath, fullPath)
+		if !e.planAllowed(PlanDelete, PlanItem{
+			FolderPath: localFolderPath,
+			RelPath:    relPath,
+			PeerName:   peerName,
+			Reason:     "reconcile: not on authoritative " + peerName,
+			LocalHash:  hash,
+		}) {
+			continue
+		}
+		if err := e.removeDeleted(localFolderPath, relPath); err != nil {
+			log.Error().Err(err).Str("path", fullPath).Msg("Failed to delete file")
+			continue
+		}
+		e.state.RemoveFileState(localFolderPath, relPath)
+
+		e.addActivity(&SyncActivity{
+			Type:       "deleted",
+			FileName:   filepath.Base(relPath),
+			FolderPath: localFolderPath,
+			RelPath:    relPath,
+			PeerName:   peerName,
+			Timestamp:  time.Now(),
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package sync
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// rescanCheckInterval is how often folders are checked for a due rescan
+const rescanCheckInterval = time.Minute
+
+// rescanLoop rescans each folder every sync.rescan_interval, for changes the
+// watcher missed: editors' atomic saves, network volumes that send no
+// events, and events dropped under load. It also keeps each folder's
+// remembered deletions within their limits.
+func (e *Engine) rescanLoop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(rescanCheckInterval)
+	defer ticker.Stop()
+
+	// Folders were reconciled with their state on startup
+	started := time.Now()
+	lastRescan := make(map[string]time.Time)
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, folder := range e.cfg.Folders {
+				if folder.Enabled {
+					e.limitDeletions(folder.Path)
+				}
+				interval := e.cfg.GetRescanInterval(folder.Path)
+				if !folder.Enabled || interval == 0 {
+					continue
+				}
+				last, ok := lastRescan[folder.Path]
+				if !ok {
+					last = started
+				}
+				if now.Sub(last) < interval {
+					continue
+				}
+
+				// Changes still queued would show up as missed
+				p := e.pipeline(folder.Path)
+				if len(p.events) > 0 || p.backingOff() || p.paused.Load() {
+					continue
+				}
+				lastRescan[folder.Path] = now
+				e.rescanFolder(folder.Path)
+			}
+		}
+	}
+}
+
+// rescanFolder compares a folder with its saved state and queues whatever
+// doesn't match as local changes
+func (e *Engine) rescanFolder(folderPath string) {
+	if !e.cfg.CanSend() {
+		return
+	}
+	// See rootPresent: a missing root isn't rescanned
+	if !rootPresent(folderPath) {
+		log.Debug().Str("folder_id", folderPath).Msg("Folder is missing, skipping rescan")
+		return
+	}
+
+	events, err := e.missedChanges(folderPath)
+	if err != nil {
+		log.Warn().Err(err).Str("folder_id", folderPath).Msg("Failed to rescan folder")
+		e.folderError(folderPath, err)
+		return
+	}
+	if len(events) == 0 {
+		log.Debug().Str("folder_id", folderPath).Msg("Rescan found no missed changes")
+		return
+	}
+
+	log.Info().
+		Str("folder_id", folderPath).
+		Int("changes", len(events)).
+		Msg("Rescan found changes the watcher missed")
+
+	for _, event := range events {
+		e.queueFileEvent(event)
+	}
+}
@@ -0,0 +1,368 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/internal/logging"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/rs/zerolog/log"
+)
+
+// checkpointMaxAge is how long a partial download is kept for resuming
+const checkpointMaxAge = 7 * 24 * time.Hour
+
+// transferCheckpoint is how far a download sent in parts got
+type transferCheckpoint struct {
+	Temp     string    `json:"temp"`     // Partial file in the folder's staging directory
+	Received int64     `json:"received"` // Bytes written to Temp
+	Hash     string    `json:"hash"`     // Content being received
+	HashAlgo string    `json:"hash_algo,omitempty"`
+	Size     int64     `json:"size"`
+	Updated  time.Time `json:"updated"`
+}
+
+// resumeOffset returns where the download can pick up: the whole parts
+// written to the temp file, in case the daemon stopped before it was saved
+func (cp transferCheckpoint) resumeOffset() int64 {
+	info, err := os.Stat(cp.Temp)
+	if err != nil {
+		return 0
+	}
+	received := cp.Received
+	if info.Size() < received {
+		received = info.Size()
+	}
+	return received - received%network.ChunkSize
+}
+
+// checkpointStore remembers partial downloads across restarts, in
+// ~/.mac-profile-sync/transfers.json, so they resume instead of starting over
+type checkpointStore struct {
+	mu          sync.Mutex
+	path        string
+	checkpoints map[string]transferCheckpoint // Destination path -> its partial download
+}
+
+func newCheckpointStore() *checkpointStore {
+	s := &checkpointStore{
+		path:        filepath.Join(config.ConfigDir(), "transfers.json"),
+		checkpoints: make(map[string]transferCheckpoint),
+	}
+	if err := s.load(); err != nil {
+		log.Debug().Err(err).Msg("Failed to load transfer checkpoints")
+	}
+	return s
+}
+
+func (s *checkpointStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read transfer checkpoints: %w", err)
+	}
+
+	checkpoints := make(map[string]transferCheckpoint)
+	if err := json.Unmarshal(data, &checkpoints); err != nil {
+		return fmt.Errorf("failed to parse transfer checkpoints: %w", err)
+	}
+	s.checkpoints = checkpoints
+	return nil
+}
+
+func (s *checkpointStore) saveLocked() {
+	data, err := json.Marshal(s.checkpoints)
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(s.path, data, 0644); err != nil {
+		log.Debug().Err(err).Msg("Failed to save transfer checkpoints")
+	}
+}
+
+func (s *checkpointStore) get(fullPath string) (transferCheckpoint, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp, ok := s.checkpoints[fullPath]
+	return cp, ok
+}
+
+func (s *checkpointStore) put(fullPath string, cp transferCheckpoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoints[fullPath] = cp
+	s.saveLocked()
+}
+
+// forget drops a checkpoint, leaving its temp file to the caller
+func (s *checkpointStore) forget(fullPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.checkpoints[fullPath]; ok {
+		delete(s.checkpoints, fullPath)
+		s.saveLocked()
+	}
+}
+
+// discard drops a checkpoint and its partial download
+func (s *checkpointStore) discard(fullPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cp, ok := s.checkpoints[fullPath]; ok {
+		_ = os.Remove(cp.Temp)
+		delete(s.checkpoints, fullPath)
+		s.saveLocked()
+	}
+}
+
+// holds reports whether a temp file is a partial download being kept
+func (s *checkpointStore) holds(temp string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, cp := range s.checkpoints {
+		if cp.Temp == temp {
+			return true
+		}
+	}
+	return false
+}
+
+// prune drops checkpoints whose temp file is gone or too old to resume
+func (s *checkpointStore) prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := false
+	for fullPath, cp := range s.checkpoints {
+		if _, err := os.Stat(cp.Temp); err == nil && time.Since(cp.Updated) < checkpointMaxAge {
+			continue
+		}
+		_ = os.Remove(cp.Temp)
+		delete(s.checkpoints, fullPath)
+		changed = true
+	}
+	if changed {
+		s.saveLocked()
+	}
+}
+
+// resumeRequest asks for only the rest of a file this Mac has part of.
+// Peers that can't send part of a file send all of it.
+func (e *Engine) resumeRequest(req *network.FileRequestMessage) {
+	localFolderPath := e.findLocalFolderByName(req.FolderName)
+	if localFolderPath == "" {
+		return
+	}
+	cp, ok := e.checkpoints.get(filepath.Join(localFolderPath, req.RelPath))
+	if !ok {
+		return
+	}
+	if offset := cp.resumeOffset(); offset > 0 {
+		req.Offset = offset
+		req.Hash = cp.Hash
+	}
+}
+
+// sendFileParts sends a requested file in network.ChunkSize parts, starting
+// where the peer's partial copy left off if it is of the same content
+func (e *Engine) sendFileParts(connID string, send func(*network.Message) error, req network.FileRequestMessage) error {
+	fullPath := filepath.Join(req.FolderPath, req.RelPath)
+
+	fi, err := e.localFileInfo(req.FolderPath, fullPath)
+	if err != nil {
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	defer f.Close()
+
+	msg := network.FileDataMessage{
+		FolderPath:  req.FolderPath,
+		FolderName:  e.folderName(req.FolderPath),
+		RelPath:     req.RelPath,
+		Size:        fi.Size,
+		ModTime:     fi.ModTime,
+		Birthtime:   fi.Birthtime,
+		Permission:  uint32(fi.Permission),
+		Hash:        fi.Hash,
+		HashAlgo:    fi.HashAlgo,
+		ContentHash: e.contentHash(req.FolderPath, fullPath),
+		Xattrs:      fi.Xattrs,
+		IsChunked:   true,
+		TotalChunks: network.ChunkCount(fi.Size),
+	}
+
+	first := 0
+	if req.Hash == fi.Hash && req.Offset > 0 && req.Offset < fi.Size {
+		first = int(req.Offset / network.ChunkSize)
+	}
+
+	ctx := e.folderContext(req.FolderPath)
+	buf := make([]byte, network.ChunkSize)
+	for i := first; i < msg.TotalChunks; i++ {
+		if err := ctx.Err(); err != nil {
+			return err // The peer asks again for the rest
+		}
+		offset := int64(i) * network.ChunkSize
+		n, err := f.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+
+		part := msg
+		part.ChunkIndex = i
+		part.Data = buf[:n]
+		dataMsg, err := network.NewFileDataMessage(part)
+		if err != nil {
+			return err
+		}
+		if err := send(dataMsg); err != nil {
+			return err
+		}
+		e.publishProgress(msg.FolderPath, msg.RelPath, connID, "send", offset+int64(n), msg.Size)
+	}
+
+	e.deliveries.track(connID, send, msg, 1)
+	event := log.Debug()
+	if first > 0 {
+		event = log.Info().Int64("offset", int64(first)*network.ChunkSize)
+	}
+	event.
+		Str("file", msg.RelPath).
+		Str("folder_id", msg.FolderPath).
+		Str("peer_id", e.connName(connID)).
+		Str("transfer_id", logging.TransferID(msg.FolderName, msg.RelPath, msg.Hash)).
+		Msg("Sent file in parts")
+	return nil
+}
+
+// receivePart writes a part of a file sent in parts, other than the last, to
+// its partial download. The last goes through handleFileData like a whole
+// file, which refuses it if this Mac shouldn't take the file.
+func (e *Engine) receivePart(fileData network.FileDataMessage, peerName string) {
+	if !e.cfg.CanReceive() {
+		return
+	}
+	localFolderPath := e.findLocalFolderByName(fileData.FolderName)
+	if localFolderPath == "" || e.ignores.Ignored(localFolderPath, fileData.RelPath) {
+		return
+	}
+	if limit := e.cfg.GetMaxFileSize(); limit > 0 && fileData.Size > limit {
+		return
+	}
+
+	cp, err := e.writePart(fileData, localFolderPath)
+	if err != nil {
+		log.Debug().
+			Err(err).
+			Str("file", fileData.RelPath).
+			Str("folder_id", localFolderPath).
+			Str("peer_id", peerName).
+			Str("transfer_id", logging.TransferID(fileData.FolderName, fileData.RelPath, fileData.Hash)).
+			Msg("Failed to write file part")
+		return
+	}
+	e.publishProgress(localFolderPath, fileData.RelPath, peerName, "receive", cp.Received, fileData.Size)
+}
+
+// writePart writes a part into the partial download of a file, starting one
+// in the folder's staging directory if this is the first part, and
+// checkpoints it
+func (e *Engine) writePart(fileData network.FileDataMessage, localFolderPath string) (transferCheckpoint, error) {
+	fullPath := filepath.Join(localFolderPath, fileData.RelPath)
+	offset := int64(fileData.ChunkIndex) * network.ChunkSize
+
+	cp, ok := e.checkpoints.get(fullPath)
+	if ok && cp.Hash != fileData.Hash {
+		// The file changed on the peer since; what we have is no use
+		e.checkpoints.discard(fullPath)
+		ok = false
+	}
+	if !ok {
+		if offset != 0 {
+			return cp, fmt.Errorf("part at byte %d arrived without the parts before it", offset)
+		}
+		f, err := createStaged(localFolderPath, fileData.RelPath)
+		if err != nil {
+			return cp, err
+		}
+		_ = f.Close()
+		cp = transferCheckpoint{Temp: f.Name(), Hash: fileData.Hash, HashAlgo: fileData.HashAlgo, Size: fileData.Size}
+	}
+	if offset > cp.Received {
+		return cp, fmt.Errorf("part at byte %d arrived with only %d bytes received", offset, cp.Received)
+	}
+
+	f, err := os.OpenFile(cp.Temp, os.O_WRONLY, 0)
+	if err != nil {
+		e.checkpoints.discard(fullPath)
+		return cp, fmt.Errorf("failed to open partial file: %w", err)
+	}
+	// A resent part replaces whatever followed it
+	if err = f.Truncate(offset); err == nil {
+		_, err = f.WriteAt(fileData.Data, offset)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(cp.Temp)
+		e.checkpoints.forget(fullPath)
+		return cp, fmt.Errorf("failed to write partial file: %w", err)
+	}
+
+	cp.Received = offset + int64(len(fileData.Data))
+	cp.Updated = time.Now()
+	e.checkpoints.put(fullPath, cp)
+	return cp, nil
+}
+
+// stageParts writes the last part of a file sent in parts and returns the
+// completed download, staged like a file received whole
+func (e *Engine) stageParts(fileData network.FileDataMessage, localFolderPath string) (string, error) {
+	fullPath := filepath.Join(localFolderPath, fileData.RelPath)
+	cp, err := e.writePart(fileData, localFolderPath)
+	if err != nil {
+		e.checkpoints.discard(fullPath)
+		return "", err
+	}
+	e.checkpoints.forget(fullPath)
+
+	if cp.Received != fileData.Size {
+		_ = os.Remove(cp.Temp)
+		return "", fmt.Errorf("received %d of %d bytes", cp.Received, fileData.Size)
+	}
+	finishStaged(cp.Temp, fileData)
+	return cp.Temp, nil
+}
+
+// leadingData returns the start of received file data, which for a file sent
+// in parts is in its partial download
+func (e *Engine) leadingData(localFolderPath string, fileData network.FileDataMessage) []byte {
+	if !fileData.IsChunked || fileData.ChunkIndex == 0 {
+		return fileData.Data
+	}
+	cp, ok := e.checkpoints.get(filepath.Join(localFolderPath, fileData.RelPath))
+	if !ok {
+		return nil
+	}
+	f, err := os.Open(cp.Temp)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	head := make([]byte, len(sqliteHeader))
+	n, _ := io.ReadFull(f, head)
+	return head[:n]
+}
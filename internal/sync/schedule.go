@@ -0,0 +1,49 @@
+package sync
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// scheduleCheckInterval is how often sync.schedule and sync.quiet_hours are
+// checked for a window opening or closing
+const scheduleCheckInterval = 30 * time.Second
+
+// scheduleLoop pauses syncing outside sync.schedule and during
+// sync.quiet_hours
+func (e *Engine) scheduleLoop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(scheduleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			e.applySchedule()
+		}
+	}
+}
+
+// applySchedule pauses all syncing while the schedule says so, like Pause.
+// Peers' lists are held and local changes are found by a rescan once the
+// window opens, which catches every folder up.
+func (e *Engine) applySchedule() {
+	block := e.cfg.ScheduleBlock(time.Now())
+
+	e.paused.mu.Lock()
+	was := e.paused.schedule
+	e.paused.schedule = block
+	e.paused.mu.Unlock()
+
+	switch {
+	case block != "" && was == "":
+		log.Info().Str("reason", block).Msg("Sync paused by schedule")
+	case block == "" && was != "":
+		log.Info().Msg("Sync window open, catching up")
+		e.catchUpAll()
+	}
+}
@@ -0,0 +1,76 @@
+package sync
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// oversizedFiles remembers files skipped for being over sync.max_file_size,
+// so each size of a file is reported once rather than on every scan
+type oversizedFiles struct {
+	mu    sync.Mutex
+	sizes map[string]int64 // Full path -> size last reported
+}
+
+func newOversizedFiles() *oversizedFiles {
+	return &oversizedFiles{sizes: make(map[string]int64)}
+}
+
+// firstSeen records a file's size and reports whether it wasn't already
+// reported at that size
+func (o *oversizedFiles) firstSeen(path string, size int64) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if reported, ok := o.sizes[path]; ok && reported == size {
+		return false
+	}
+	o.sizes[path] = size
+	return true
+}
+
+// forget drops a file that is back under the limit or gone
+func (o *oversizedFiles) forget(path string) {
+	o.mu.Lock()
+	delete(o.sizes, path)
+	o.mu.Unlock()
+}
+
+// tooLarge reports whether a file is over sync.max_file_size and must be
+// skipped. peerName is the peer offering it, or "" for a local file. The
+// first time each size is skipped it is logged and shown as activity.
+func (e *Engine) tooLarge(folderPath, relPath string, size int64, peerName string) bool {
+	path := filepath.Join(folderPath, relPath)
+	limit := e.cfg.GetMaxFileSize()
+	if limit <= 0 || size <= limit {
+		if peerName == "" {
+			e.oversized.forget(path)
+		}
+		return false
+	}
+	if !e.oversized.firstSeen(path, size) {
+		return true
+	}
+
+	log.Warn().
+		Str("folder_id", folderPath).
+		Str("file", relPath).
+		Str("size", fileutil.FormatSize(size)).
+		Str("limit", fileutil.FormatSize(limit)).
+		Str("peer_id", peerName).
+		Msg("File is over max_file_size, skipping")
+
+	e.addActivity(&SyncActivity{
+		Type:       "skipped",
+		FileName:   filepath.Base(relPath),
+		FolderPath: folderPath,
+		RelPath:    relPath,
+		PeerName:   peerName,
+		Timestamp:  time.Now(),
+	})
+	return true
+}
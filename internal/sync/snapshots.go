@@ -0,0 +1,258 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// snapshotInterval is the least time between automatic snapshots of a folder
+const snapshotInterval = time.Hour
+
+// Snapshot is a copy-on-write clone of a synced folder, taken before a large
+// batch of peer changes so a bad sync round can be undone
+type Snapshot struct {
+	ID         string    `json:"id"`
+	FolderPath string    `json:"folder_path"`
+	CreatedAt  time.Time `json:"created_at"`
+	Reason     string    `json:"reason"`
+	Changes    int       `json:"changes,omitempty"` // Incoming changes that prompted the snapshot
+}
+
+// SnapshotsDir returns where folder snapshots are kept
+func SnapshotsDir() string {
+	return filepath.Join(config.ConfigDir(), "snapshots")
+}
+
+func (s *Snapshot) dir() string {
+	return filepath.Join(SnapshotsDir(), s.ID)
+}
+
+// DataPath returns where the snapshot's copy of the folder is
+func (s *Snapshot) DataPath() string {
+	return filepath.Join(s.dir(), "data")
+}
+
+// CreateSnapshot clones a folder into a new snapshot
+func CreateSnapshot(folderPath, reason string, changes int) (*Snapshot, error) {
+	now := time.Now()
+	id := fmt.Sprintf("%s-%s", filepath.Base(folderPath), now.Format("20060102-150405"))
+	for n := 2; fileutil.Exists(filepath.Join(SnapshotsDir(), id)); n++ {
+		id = fmt.Sprintf("%s-%s-%d", filepath.Base(folderPath), now.Format("20060102-150405"), n)
+	}
+
+	snap := &Snapshot{ID: id, FolderPath: folderPath, CreatedAt: now, Reason: reason, Changes: changes}
+	if err := os.MkdirAll(snap.dir(), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	if err := fileutil.CloneTree(folderPath, snap.DataPath()); err != nil {
+		_ = os.RemoveAll(snap.dir())
+		return nil, fmt.Errorf("failed to snapshot folder: %w", err)
+	}
+
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		_ = os.RemoveAll(snap.dir())
+		return nil, fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(snap.dir(), "snapshot.json"), data, 0644); err != nil {
+		_ = os.RemoveAll(snap.dir())
+		return nil, fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return snap, nil
+}
+
+// ListSnapshots returns snapshots, newest first. An empty folderPath lists
+// snapshots of every folder.
+func ListSnapshots(folderPath string) ([]*Snapshot, error) {
+	entries, err := os.ReadDir(SnapshotsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshots: %w", err)
+	}
+
+	var snapshots []*Snapshot
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		snap, err := LoadSnapshot(entry.Name())
+		if err != nil {
+			log.Debug().Err(err).Str("snapshot", entry.Name()).Msg("Skipping unreadable snapshot")
+			continue
+		}
+		if folderPath == "" || snap.FolderPath == folderPath {
+			snapshots = append(snapshots, snap)
+		}
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt)
+	})
+	return snapshots, nil
+}
+
+// LoadSnapshot reads a snapshot by ID
+func LoadSnapshot(id string) (*Snapshot, error) {
+	if id == "" || filepath.Base(id) != id {
+		return nil, fmt.Errorf("invalid snapshot id %q", id)
+	}
+
+	data, err := os.ReadFile(filepath.Join(SnapshotsDir(), id, "snapshot.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot: %w", err)
+	}
+	return &snap, nil
+}
+
+// PruneSnapshots removes a folder's oldest snapshots beyond keep
+func PruneSnapshots(folderPath string, keep int) error {
+	snapshots, err := ListSnapshots(folderPath)
+	if err != nil {
+		return err
+	}
+	for i := keep; i < len(snapshots); i++ {
+		if err := os.RemoveAll(snapshots[i].dir()); err != nil {
+			return fmt.Errorf("failed to remove snapshot %s: %w", snapshots[i].ID, err)
+		}
+	}
+	return nil
+}
+
+// RestoreSnapshot puts a folder back the way it was when the snapshot was
+// taken. The folder's current contents are snapshotted first, so a restore
+// can itself be undone. It returns that new snapshot.
+func RestoreSnapshot(id string) (*Snapshot, error) {
+	snap, err := LoadSnapshot(id)
+	if err != nil {
+		return nil, err
+	}
+	if !fileutil.IsDir(snap.FolderPath) {
+		return nil, fmt.Errorf("folder %s no longer exists", snap.FolderPath)
+	}
+
+	before, err := CreateSnapshot(snap.FolderPath, "before restoring "+id, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Put back files that changed or were removed since the snapshot
+	src := snap.DataPath()
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(snap.FolderPath, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(dst, info.Mode().Perm())
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		if current, err := os.Lstat(dst); err == nil {
+			if current.Mode().IsRegular() && current.Size() == info.Size() && current.ModTime().Equal(info.ModTime()) {
+				return nil
+			}
+			if err := os.RemoveAll(dst); err != nil {
+				return fmt.Errorf("failed to replace %s: %w", rel, err)
+			}
+		}
+		return fileutil.CloneFile(path, dst)
+	})
+	if err != nil {
+		return before, fmt.Errorf("failed to restore snapshot: %w", err)
+	}
+
+	// Remove files that appeared since the snapshot
+	err = filepath.WalkDir(snap.FolderPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == snap.FolderPath {
+			return err
+		}
+		rel, err := filepath.Rel(snap.FolderPath, path)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(filepath.Join(src, rel)); !os.IsNotExist(err) {
+			return nil
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", rel, err)
+		}
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return before, fmt.Errorf("failed to restore snapshot: %w", err)
+	}
+	return before, nil
+}
+
+// snapshotTimes remembers when each folder was last snapshotted automatically
+type snapshotTimes struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func newSnapshotTimes() *snapshotTimes {
+	return &snapshotTimes{last: make(map[string]time.Time)}
+}
+
+// due reports whether a folder may be snapshotted now, and if so records it
+func (t *snapshotTimes) due(folderPath string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if time.Since(t.last[folderPath]) < snapshotInterval {
+		return false
+	}
+	t.last[folderPath] = time.Now()
+	return true
+}
+
+// snapshotBeforeBatch snapshots a folder before a peer's changes are applied,
+// if there are enough of them to be worth insuring against
+func (e *Engine) snapshotBeforeBatch(folderPath, peerName string, changes int) {
+	threshold := e.cfg.Sync.SnapshotThreshold
+	if threshold <= 0 || changes < threshold || !e.snapshots.due(folderPath) {
+		return
+	}
+
+	snap, err := CreateSnapshot(folderPath, fmt.Sprintf("%d changes from %s", changes, peerName), changes)
+	if err != nil {
+		log.Warn().Err(err).Str("folder_id", folderPath).Msg("Failed to snapshot folder, applying changes anyway")
+		return
+	}
+	log.Info().Str("folder_id", folderPath).Str("snapshot", snap.ID).Int("changes", changes).Msg("Snapshotted folder before applying peer changes")
+
+	if err := PruneSnapshots(folderPath, e.cfg.GetSnapshotKeep()); err != nil {
+		log.Warn().Err(err).Str("folder_id", folderPath).Msg("Failed to prune snapshots")
+	}
+}
@@ -0,0 +1,344 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/rs/zerolog/log"
+)
+
+// browseCheckInterval is how often what peers have outside sparse selections
+// is published for the browse command and the TUI, and fetches queued there
+// are picked up
+const browseCheckInterval = 5 * time.Second
+
+// FetchRequest is a file outside a folder's sparse selection, queued by the
+// fetch command or the TUI for the daemon to fetch
+type FetchRequest struct {
+	FolderPath string `json:"folder_path"`
+	RelPath    string `json:"rel_path"`
+}
+
+// remoteListingsPath is where the daemon publishes the files peers have
+// outside each sparse folder's selection
+func remoteListingsPath() string {
+	return filepath.Join(config.ConfigDir(), "remote.json")
+}
+
+// fetchQueuePath is where files to fetch on demand are queued
+func fetchQueuePath() string {
+	return filepath.Join(config.ConfigDir(), "fetch.json")
+}
+
+// LoadRemoteListings returns the files peers have outside each sparse
+// folder's selection, keyed by folder path, as the daemon last published them
+func LoadRemoteListings() (map[string]*RemoteListing, error) {
+	data, err := os.ReadFile(remoteListingsPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read remote listings: %w", err)
+	}
+
+	var listings map[string]*RemoteListing
+	if err := json.Unmarshal(data, &listings); err != nil {
+		return nil, fmt.Errorf("failed to parse remote listings: %w", err)
+	}
+	return listings, nil
+}
+
+// Under returns the files in a listing inside a directory relative to the
+// folder ("" for all of them), sorted by path
+func (l *RemoteListing) Under(dir string) []network.FileInfo {
+	dir = strings.Trim(filepath.ToSlash(dir), "/")
+
+	var files []network.FileInfo
+	for _, f := range l.Files {
+		if f.IsDir || (dir != "" && f.RelPath != dir && !strings.HasPrefix(f.RelPath, dir+"/")) {
+			continue
+		}
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].RelPath < files[j].RelPath })
+	return files
+}
+
+// QueueFetch hands files outside a folder's sparse selection to the running
+// daemon, which fetches them from the peer that listed them
+func QueueFetch(requests []FetchRequest) error {
+	queued, err := loadFetchQueue()
+	if err != nil {
+		return err
+	}
+	queued = append(queued, requests...)
+
+	data, err := json.MarshalIndent(queued, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal fetches: %w", err)
+	}
+	if err := os.WriteFile(fetchQueuePath(), data, 0644); err != nil {
+		return fmt.Errorf("failed to write fetches: %w", err)
+	}
+	return nil
+}
+
+func loadFetchQueue() ([]FetchRequest, error) {
+	data, err := os.ReadFile(fetchQueuePath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fetches: %w", err)
+	}
+
+	var queued []FetchRequest
+	if err := json.Unmarshal(data, &queued); err != nil {
+		return nil, fmt.Errorf("failed to parse fetches: %w", err)
+	}
+	return queued, nil
+}
+
+// browseLoop publishes what peers have outside each sparse folder's selection
+// and fetches the files queued from it
+func (e *Engine) browseLoop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(browseCheckInterval)
+	defer ticker.Stop()
+
+	var published []byte
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			published = e.publishRemoteListings(published)
+			e.fetchQueued()
+		}
+	}
+}
+
+// publishRemoteListings saves the files peers have outside each sparse
+// folder's selection, if they changed since they were last published
+func (e *Engine) publishRemoteListings(published []byte) []byte {
+	listings := make(map[string]*RemoteListing)
+
+	e.remoteMu.RLock()
+	for folderPath, listing := range e.remoteLists {
+		folderCfg := e.cfg.GetFolder(folderPath)
+		if folderCfg == nil || !folderCfg.IsSparse() {
+			continue
+		}
+
+		unsynced := &RemoteListing{
+			PeerName:         listing.PeerName,
+			RemoteFolderPath: listing.RemoteFolderPath,
+			FolderName:       listing.FolderName,
+			ReceivedAt:       listing.ReceivedAt,
+		}
+		for _, f := range listing.Files {
+			// Excluded subfolders are kept on this Mac only
+			if f.IsDir || folderCfg.IncludesPath(f.RelPath) || folderCfg.ExcludedBy(f.RelPath) != "" || e.ignores.Ignored(folderPath, f.RelPath) {
+				continue
+			}
+			unsynced.Files = append(unsynced.Files, f)
+		}
+		listings[folderPath] = unsynced
+	}
+	e.remoteMu.RUnlock()
+
+	data, err := json.MarshalIndent(listings, "", "  ")
+	if err != nil || bytes.Equal(data, published) {
+		return published
+	}
+	if err := os.WriteFile(remoteListingsPath(), data, 0644); err != nil {
+		log.Warn().Err(err).Msg("Failed to save remote listings")
+		return published
+	}
+	return data
+}
+
+// fetchQueued fetches the files queued with QueueFetch
+func (e *Engine) fetchQueued() {
+	queued, err := loadFetchQueue()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to load fetches")
+	}
+	if len(queued) == 0 {
+		return
+	}
+	_ = os.Remove(fetchQueuePath())
+
+	for _, req := range queued {
+		if err := e.FetchRemote(req.FolderPath, req.RelPath); err != nil {
+			e.publishError(err)
+		}
+	}
+}
+
+// FetchRemote requests a single file from the peer that last listed its
+// folder, even though it lies outside the folder's sparse selection. The
+// copy received isn't tracked, so it isn't synced back or pruned.
+func (e *Engine) FetchRemote(folderPath, relPath string) error {
+	folderCfg := e.cfg.GetFolder(folderPath)
+	if folderCfg == nil {
+		return fmt.Errorf("folder not found: %s", folderPath)
+	}
+	folderPath = folderCfg.Path
+
+	switch {
+	case folderCfg.IncludesPath(relPath):
+		return fmt.Errorf("%s is already synced in %s", relPath, folderPath)
+	case folderCfg.ExcludedBy(relPath) != "":
+		return fmt.Errorf("%s is in %s, which is excluded from %s", relPath, folderCfg.ExcludedBy(relPath), folderPath)
+	}
+
+	listing := e.RemoteBrowse(folderPath)
+	if listing == nil || listing.held == nil {
+		return fmt.Errorf("no file list for %s from a peer: %w", folderPath, ErrPeerOffline)
+	}
+	if len(e.server.GetConnections()) == 0 && len(e.client.GetConnections()) == 0 {
+		return fmt.Errorf("no peer to fetch %s from: %w", relPath, ErrPeerOffline)
+	}
+
+	var remoteFile *network.FileInfo
+	for i := range listing.Files {
+		if listing.Files[i].RelPath == relPath && !listing.Files[i].IsDir {
+			remoteFile = &listing.Files[i]
+			break
+		}
+	}
+	if remoteFile == nil {
+		return fmt.Errorf("%s isn't in %s's file list for %s", relPath, listing.PeerName, folderPath)
+	}
+
+	e.remoteMu.Lock()
+	e.onDemand[fileKey(folderPath, relPath)] = true
+	e.remoteMu.Unlock()
+
+	log.Info().
+		Str("file", relPath).
+		Str("folder_id", folderPath).
+		Str("peer_id", listing.PeerName).
+		Msg("Fetching file outside sparse selection")
+	e.transfers.enqueue(listing.held.connID, listing.held.send, network.FileRequestMessage{
+		FolderPath: listing.RemoteFolderPath,
+		FolderName: listing.FolderName,
+		RelPath:    relPath,
+	}, e.transferPriorityFor(folderPath, remoteFile.Size, remoteFile.ModTime))
+	return nil
+}
+
+// fetchedOnDemand reports whether a file outside a folder's sparse selection
+// was requested with FetchRemote
+func (e *Engine) fetchedOnDemand(folderPath, relPath string) bool {
+	e.remoteMu.RLock()
+	defer e.remoteMu.RUnlock()
+	return e.onDemand[fileKey(folderPath, relPath)]
+}
+
+// doneOnDemand forgets a fetch once the file is in place; a copy that failed
+// verification is still accepted when it is fetched again
+func (e *Engine) doneOnDemand(folderPath, relPath string) {
+	e.remoteMu.Lock()
+	defer e.remoteMu.Unlock()
+	delete(e.onDemand, fileKey(folderPath, relPath))
+}
+
+// SetSubfolders changes which subfolders of a folder are synced without a
+// restart: newly selected ones are backfilled and deselected ones removed
+func (e *Engine) SetSubfolders(folderPath string, subfolders []string) error {
+	return e.changeSelection(folderPath, func() error {
+		return e.cfg.SetSubfolders(folderPath, subfolders)
+	})
+}
+
+// SetExcluded changes which subfolders of a folder are excluded without a
+// restart
+func (e *Engine) SetExcluded(folderPath string, excluded []string) error {
+	return e.changeSelection(folderPath, func() error {
+		return e.cfg.SetExcluded(folderPath, excluded)
+	})
+}
+
+func (e *Engine) changeSelection(folderPath string, change func() error) error {
+	folderCfg := e.cfg.GetFolder(folderPath)
+	if folderCfg == nil {
+		return fmt.Errorf("folder not found: %s", folderPath)
+	}
+	previous := *folderCfg
+
+	if err := change(); err != nil {
+		return err
+	}
+	e.applySelection(previous)
+	return nil
+}
+
+// reloadSelections applies sparse selections changed in the config file, by
+// the subfolders command or the TUI, without a restart
+func (e *Engine) reloadSelections() {
+	changed, err := e.cfg.ReloadSelections()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to reload subfolder selections")
+		return
+	}
+	for _, previous := range changed {
+		e.applySelection(previous)
+	}
+}
+
+// applySelection brings a folder in line with its changed sparse selection:
+// the folder is watched again, local copies of deselected files are removed,
+// and files in newly selected subfolders are requested from the peer that
+// last listed the folder
+func (e *Engine) applySelection(previous config.FolderConfig) {
+	folderCfg := e.cfg.GetFolder(previous.Path)
+	if folderCfg == nil || !folderCfg.Enabled {
+		return
+	}
+	folderPath := folderCfg.Path
+
+	log.Info().
+		Str("folder_id", folderPath).
+		Strs("subfolders", folderCfg.Subfolders).
+		Strs("excluded", folderCfg.Excluded).
+		Msg("Sparse selection changed")
+
+	// Walk the folder again so watches match the new selection
+	_ = e.watcher.RemoveFolder(folderPath)
+	if err := e.watcher.AddFolder(folderPath); err != nil {
+		log.Error().Err(err).Str("folder_id", folderPath).Msg("Failed to watch folder")
+	}
+
+	e.pruneDeselected(folderPath)
+
+	listing := e.RemoteBrowse(folderPath)
+	if listing == nil || listing.held == nil {
+		return
+	}
+
+	// Apply just the newly selected part of the list, like a journal of
+	// changes, so the rest of it isn't applied again
+	backfill := listing.held.fileList
+	backfill.Journal = true
+	backfill.Files = nil
+	for _, f := range listing.held.fileList.Files {
+		if !previous.IncludesPath(f.RelPath) && folderCfg.IncludesPath(f.RelPath) {
+			backfill.Files = append(backfill.Files, f)
+		}
+	}
+	if len(backfill.Files) == 0 {
+		return
+	}
+	e.handleFileList(backfill, listing.held.connID, listing.PeerName, listing.held.send)
+}
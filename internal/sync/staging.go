@@ -0,0 +1,274 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// tempPrefix marks files still being written into a synced folder. They are
+// renamed into place once complete and never synced.
+const tempPrefix = ".mps-tmp-"
+
+// isTempFile reports whether a path is a write still in progress
+func isTempFile(relPath string) bool {
+	return strings.HasPrefix(filepath.Base(relPath), tempPrefix)
+}
+
+// createTemp creates a hidden temp file next to fullPath, so it can be
+// renamed over fullPath atomically
+func createTemp(fullPath string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(fullPath), tempPrefix+filepath.Base(fullPath)+"-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	return f, nil
+}
+
+// stagingDirName is the directory received files are staged in on a volume
+// other than the one holding the config directory
+const stagingDirName = ".mps-staging"
+
+// stagingDir returns where files received for a folder are staged: outside
+// the folder, so nothing unscanned is ever in it, but on its volume, so
+// moving a file into place is a rename. A folder that is a whole volume of
+// its own stages in the config directory, and files are copied in once they
+// pass the scan.
+func stagingDir(folderPath string) string {
+	home := filepath.Join(config.ConfigDir(), "staging")
+	if fileutil.SameVolume(config.ConfigDir(), folderPath) {
+		return home
+	}
+
+	root := folderPath
+	for !fileutil.IsMountPoint(root) && filepath.Dir(root) != root {
+		root = filepath.Dir(root)
+	}
+	if root == folderPath {
+		return home
+	}
+	return filepath.Join(root, stagingDirName)
+}
+
+// createStaged creates a file to stage a received file for a folder in
+func createStaged(folderPath, relPath string) (*os.File, error) {
+	dir := stagingDir(folderPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		// The top of the folder's volume may be read-only
+		dir = filepath.Join(config.ConfigDir(), "staging")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create staging directory: %w", err)
+		}
+	}
+	// Keep the name and extension for the scanner
+	f, err := os.CreateTemp(dir, "*-"+filepath.Base(relPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staged file: %w", err)
+	}
+	return f, nil
+}
+
+// QuarantineDir holds incoming files rejected by the scanner
+func QuarantineDir() string {
+	return filepath.Join(config.ConfigDir(), "quarantine")
+}
+
+// stageIncoming writes received file data to a staged file outside the
+// folder. Until it is verified, scanned and moved into place, a crash or
+// disconnect can't leave a truncated file behind for the watcher to send
+// back out, and nothing in the folder holds data the scanner hasn't passed.
+func stageIncoming(fileData network.FileDataMessage, localFolderPath string) (string, error) {
+	f, err := createStaged(localFolderPath, fileData.RelPath)
+	if err != nil {
+		return "", err
+	}
+	staged := f.Name()
+
+	_, err = f.Write(fileData.Data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(staged)
+		return "", fmt.Errorf("failed to write staged file: %w", err)
+	}
+
+	finishStaged(staged, fileData)
+	return staged, nil
+}
+
+// finishStaged gives a staged file the attributes and dates it was sent with
+func finishStaged(staged string, fileData network.FileDataMessage) {
+	if err := fileutil.WriteXattrs(staged, fileData.Xattrs); err != nil {
+		log.Warn().Err(err).Str("path", staged).Msg("Failed to set extended attributes")
+	}
+	if err := os.Chmod(staged, os.FileMode(fileData.Permission)); err != nil {
+		log.Warn().Err(err).Str("path", staged).Msg("Failed to set permissions on staged file")
+	}
+	if err := os.Chtimes(staged, fileData.ModTime, fileData.ModTime); err != nil {
+		log.Warn().Err(err).Str("path", staged).Msg("Failed to set mod time")
+	}
+	// After the mod time, which would otherwise move it
+	if err := fileutil.SetBirthtime(staged, fileData.Birthtime); err != nil {
+		log.Warn().Err(err).Str("path", staged).Msg("Failed to set creation date")
+	}
+}
+
+// placeStaged moves a staged file into its final location. The file at
+// fullPath is replaced in one step, never left half written.
+func placeStaged(staged, fullPath string) error {
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	if err := os.Rename(staged, fullPath); err == nil {
+		return nil
+	}
+
+	// The staged file may be on another volume; copy it next to fullPath first
+	// so it still replaces fullPath in one step
+	f, err := createTemp(fullPath)
+	if err != nil {
+		return err
+	}
+	temp := f.Name()
+	_ = f.Close()
+
+	if err := fileutil.CopyFile(staged, temp); err != nil {
+		_ = os.Remove(temp)
+		return err
+	}
+	if err := os.Rename(temp, fullPath); err != nil {
+		_ = os.Remove(temp)
+		return fmt.Errorf("failed to move file into place: %w", err)
+	}
+	return os.Remove(staged)
+}
+
+// removeStaleTemps removes temp files left in synced folders by writes that
+// never finished, such as when the daemon was stopped mid-transfer, package
+// copies that were never swapped in, and received files left in staging.
+// Partial downloads with a checkpoint are kept to resume.
+func (e *Engine) removeStaleTemps() {
+	defer e.wg.Done()
+
+	e.checkpoints.prune()
+	cleaned := make(map[string]bool)
+	for _, folder := range e.cfg.Folders {
+		if !folder.Enabled {
+			continue
+		}
+		if dir := stagingDir(folder.Path); !cleaned[dir] {
+			cleaned[dir] = true
+			e.removeStaleStaged(dir)
+		}
+		_ = filepath.WalkDir(folder.Path, func(path string, d fs.DirEntry, err error) error {
+			if e.ctx.Err() != nil {
+				return filepath.SkipAll
+			}
+			if err != nil || !isTempFile(path) || e.checkpoints.holds(path) || e.packages.holds(path) {
+				return nil
+			}
+			// Copies of packages being assembled when the daemon stopped
+			if d.IsDir() {
+				if err := os.RemoveAll(path); err == nil {
+					log.Info().Str("path", path).Msg("Removed incomplete package left by an earlier run")
+				}
+				return filepath.SkipDir
+			}
+			if err := os.Remove(path); err == nil {
+				log.Info().Str("path", path).Msg("Removed incomplete file left by an earlier run")
+			}
+			return nil
+		})
+	}
+}
+
+// removeStaleStaged removes received files left in a staging directory that
+// aren't partial downloads being kept to resume
+func (e *Engine) removeStaleStaged(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() || e.checkpoints.holds(path) {
+			continue
+		}
+		if err := os.Remove(path); err == nil {
+			log.Info().Str("path", path).Msg("Removed staged file left by an earlier run")
+		}
+	}
+}
+
+// scanStaged runs the configured scanner on a staged file. The file path is
+// passed as the last argument; a non-zero exit rejects the file.
+func (e *Engine) scanStaged(staged, localFolderPath, relPath, peerName string) error {
+	command := strings.TrimSpace(e.cfg.Sync.ScanCommand)
+	if command == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(e.ctx, e.cfg.GetScanTimeout())
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command+` "$1"`, "scan", staged)
+	cmd.Env = append(os.Environ(),
+		"MPS_FOLDER="+localFolderPath,
+		"MPS_REL_PATH="+relPath,
+		"MPS_PEER="+peerName,
+	)
+
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("scanner timed out after %s", e.cfg.GetScanTimeout())
+	}
+	if err != nil {
+		if detail := strings.TrimSpace(string(output)); detail != "" {
+			return fmt.Errorf("scanner rejected file: %s", detail)
+		}
+		return fmt.Errorf("scanner rejected file: %w", err)
+	}
+	return nil
+}
+
+// quarantineStaged moves a rejected file out of staging and reports it
+func (e *Engine) quarantineStaged(staged, localFolderPath, relPath, peerName string, scanErr error) {
+	dest := filepath.Join(QuarantineDir(), time.Now().Format("20060102-150405"), e.folderName(localFolderPath), relPath)
+	if err := placeStaged(staged, dest); err != nil {
+		log.Error().Err(err).Str("file", relPath).Msg("Failed to quarantine file")
+		dest = ""
+	}
+
+	e.addActivity(&SyncActivity{
+		Type:       "quarantined",
+		FileName:   filepath.Base(relPath),
+		FolderPath: localFolderPath,
+		RelPath:    relPath,
+		PeerName:   peerName,
+		Timestamp:  time.Now(),
+	})
+
+	log.Warn().
+		Err(scanErr).
+		Str("file", relPath).
+		Str("peer_id", peerName).
+		Str("quarantine", dest).
+		Msg("Quarantined received file")
+
+	e.publishError(fmt.Errorf("quarantined %s from %s: %w", relPath, peerName, scanErr))
+}
@@ -3,18 +3,23 @@ package sync
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
 )
 
 // FileState represents the known state of a file
 type FileState struct {
 	RelPath    string      `json:"rel_path"`
 	Hash       string      `json:"hash"`
+	HashAlgo   string      `json:"hash_algo,omitempty"` // Empty for entries recorded before hash algorithms were tracked
 	Size       int64       `json:"size"`
 	ModTime    time.Time   `json:"mod_time"`
 	Permission os.FileMode `json:"permission"`
@@ -22,11 +27,74 @@ type FileState struct {
 	SyncedFrom string      `json:"synced_from"` // Device name that last synced this file
 }
 
+// Algorithm returns the algorithm the entry's hash was made with
+func (f *FileState) Algorithm() string {
+	return fileutil.HashAlgorithmOf(f.HashAlgo)
+}
+
 // FolderState represents the state of all files in a folder
 type FolderState struct {
-	Path     string                `json:"path"`
-	Files    map[string]*FileState `json:"files"`
-	UpdatedAt time.Time            `json:"updated_at"`
+	Path       string                `json:"path"`
+	Files      map[string]*FileState `json:"files"`
+	Unreadable map[string]string     `json:"unreadable,omitempty"` // Rel path -> last read error
+	Unwritable map[string]string     `json:"unwritable,omitempty"` // Rel path -> why a peer's update couldn't be written
+	UpdatedAt  time.Time             `json:"updated_at"`
+
+	// Resolved remembers conflicts settled without making both sides equal
+	// (keep_local, skip), so the same pair of versions isn't raised again
+	Resolved map[string]*ResolvedConflict `json:"resolved,omitempty"` // Rel path -> decision
+
+	// Sequence increases with every sync of this folder. A restored backup
+	// brings back an older sequence, which lets peers detect the restore.
+	Sequence      uint64            `json:"sequence"`
+	PeerSequences map[string]uint64 `json:"peer_sequences,omitempty"` // Device name -> last sequence seen
+
+	// Generation changes whenever the folder's state can no longer be trusted
+	// incrementally (re-added, rebuilt, or restored). Peers that see a new
+	// generation re-verify every file instead of trusting mod times.
+	Generation      uint64            `json:"generation"`
+	PeerGenerations map[string]uint64 `json:"peer_generations,omitempty"` // Device name -> last generation seen
+
+	// Deleted remembers files deleted here, so a peer that still has them
+	// is told to delete its copy instead of sending it back
+	Deleted map[string]*Tombstone `json:"deleted,omitempty"` // Rel path -> deletion
+
+	// PeerAcks is the newest sequence of ours each peer has seen. Deletions
+	// older than every peer's ack have reached them all.
+	PeerAcks map[string]uint64 `json:"peer_acks,omitempty"` // Device name -> our sequence
+	// ForgottenThrough is the sequence of the newest deletion forgotten before
+	// every peer saw it. Peers that haven't seen it need a full resync.
+	ForgottenThrough uint64 `json:"forgotten_through,omitempty"`
+
+	// Hashes caches the last hash computed for each file, so unchanged
+	// files aren't read again every time a file list is built or compared
+	Hashes map[string]*CachedHash `json:"hashes,omitempty"` // Rel path -> hash
+}
+
+// CachedHash is a file's hash, valid while its size, mod time and inode
+// are unchanged
+type CachedHash struct {
+	Hash     string    `json:"hash"`
+	HashAlgo string    `json:"hash_algo"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Inode    uint64    `json:"inode,omitempty"`
+}
+
+// Tombstone records a deleted file or directory
+type Tombstone struct {
+	Hash      string    `json:"hash,omitempty"` // Version that was deleted; empty for directories
+	HashAlgo  string    `json:"hash_algo,omitempty"`
+	DeletedAt time.Time `json:"deleted_at"`
+	Sequence  uint64    `json:"sequence,omitempty"` // Folder's sequence when deleted
+}
+
+// ResolvedConflict records a conflict decision for one pair of versions
+type ResolvedConflict struct {
+	LocalHash  string    `json:"local_hash"`
+	RemoteHash string    `json:"remote_hash"`
+	Resolution string    `json:"resolution"`
+	ResolvedAt time.Time `json:"resolved_at"`
 }
 
 // StateStore manages sync state persistence
@@ -76,12 +144,37 @@ func (s *StateStore) Load() error {
 			continue
 		}
 
+		// State saved before paths were normalized may hold NFD keys
+		fs.Files = normalizeKeys(fs.Files)
+		fs.Unreadable = normalizeKeys(fs.Unreadable)
+		fs.Unwritable = normalizeKeys(fs.Unwritable)
+		fs.Resolved = normalizeKeys(fs.Resolved)
+		fs.Deleted = normalizeKeys(fs.Deleted)
+		fs.Hashes = normalizeKeys(fs.Hashes)
+		for relPath, file := range fs.Files {
+			file.RelPath = relPath
+		}
+
 		s.folders[fs.Path] = &fs
 	}
 
 	return nil
 }
 
+// normalizeKeys returns a map keyed by relative paths in NFC
+func normalizeKeys[V any](m map[string]V) map[string]V {
+	for relPath := range m {
+		if fileutil.NormalizePath(relPath) != relPath {
+			normalized := make(map[string]V, len(m))
+			for k, v := range m {
+				normalized[fileutil.NormalizePath(k)] = v
+			}
+			return normalized
+		}
+	}
+	return m
+}
+
 // Save persists state to disk
 func (s *StateStore) Save() error {
 	s.mu.RLock()
@@ -148,7 +241,51 @@ func (s *StateStore) UpdateFileState(folderPath string, state *FileState) {
 	}
 
 	fs.Files[state.RelPath] = state
+	clearTombstonesLocked(fs, state.RelPath)
+	fs.UpdatedAt = time.Now()
+}
+
+// RehashFileState replaces a file's hash with one made with another
+// algorithm, unless the entry changed since oldHash was read
+func (s *StateStore) RehashFileState(folderPath, relPath, oldHash, newHash, algorithm string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		return false
+	}
+	state, ok := fs.Files[relPath]
+	if !ok || state.Hash != oldHash {
+		return false
+	}
+
+	rehashed := *state
+	rehashed.Hash = newHash
+	rehashed.HashAlgo = algorithm
+	fs.Files[relPath] = &rehashed
 	fs.UpdatedAt = time.Now()
+	return true
+}
+
+// CountOutdatedHashes returns how many of a folder's entries still have a hash
+// made with an algorithm other than algorithm, the one the folder uses
+func (s *StateStore) CountOutdatedHashes(folderPath, algorithm string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		return 0
+	}
+
+	count := 0
+	for _, state := range fs.Files {
+		if state.Hash != "" && state.Algorithm() != algorithm {
+			count++
+		}
+	}
+	return count
 }
 
 // RemoveFileState removes the state for a file
@@ -165,6 +302,275 @@ func (s *StateStore) RemoveFileState(folderPath, relPath string) {
 	fs.UpdatedAt = time.Now()
 }
 
+// MarkDeleted removes the state for a deleted file, or for everything under a
+// deleted directory, and keeps a tombstone for each path
+func (s *StateStore) MarkDeleted(folderPath, relPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		return
+	}
+	if fs.Deleted == nil {
+		fs.Deleted = make(map[string]*Tombstone)
+	}
+
+	now := time.Now()
+	fs.Deleted[relPath] = &Tombstone{DeletedAt: now, Sequence: fs.Sequence}
+	prefix := relPath + string(filepath.Separator)
+	for path, state := range fs.Files {
+		if path == relPath || strings.HasPrefix(path, prefix) {
+			fs.Deleted[path] = &Tombstone{Hash: state.Hash, HashAlgo: state.HashAlgo, DeletedAt: now, Sequence: fs.Sequence}
+			delete(fs.Files, path)
+		}
+	}
+	fs.UpdatedAt = now
+}
+
+// GetTombstone returns the tombstone for a deleted path, or nil
+func (s *StateStore) GetTombstone(folderPath, relPath string) *Tombstone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		return nil
+	}
+	return fs.Deleted[relPath]
+}
+
+// ClearTombstones forgets the deletion of a path that exists again, and of
+// the directories it is in
+func (s *StateStore) ClearTombstones(folderPath, relPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fs, ok := s.folders[folderPath]; ok {
+		clearTombstonesLocked(fs, relPath)
+	}
+}
+
+func clearTombstonesLocked(fs *FolderState, relPath string) {
+	if len(fs.Deleted) == 0 {
+		return
+	}
+	for path := relPath; path != "." && path != string(filepath.Separator); path = filepath.Dir(path) {
+		delete(fs.Deleted, path)
+	}
+}
+
+// DeletionPressure describes the deletions a folder remembers for peers
+type DeletionPressure struct {
+	Count  int       // Deletions remembered
+	Unseen int       // Of those, deletions some peer hasn't seen yet
+	Oldest time.Time // When the oldest was deleted
+}
+
+// GetDeletionPressure returns how many deletions a folder remembers
+func (s *StateStore) GetDeletionPressure(folderPath string) DeletionPressure {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var pressure DeletionPressure
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		return pressure
+	}
+	seen := seenThroughLocked(fs)
+	for _, tomb := range fs.Deleted {
+		pressure.Count++
+		if tomb.Sequence >= seen {
+			pressure.Unseen++
+		}
+		if pressure.Oldest.IsZero() || tomb.DeletedAt.Before(pressure.Oldest) {
+			pressure.Oldest = tomb.DeletedAt
+		}
+	}
+	return pressure
+}
+
+// GetUnseenDeletions returns the sorted paths deleted in a folder that some
+// peer hasn't seen yet, which it is told about when it next lists them
+func (s *StateStore) GetUnseenDeletions(folderPath string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		return nil
+	}
+	seen := seenThroughLocked(fs)
+	var paths []string
+	for path, tomb := range fs.Deleted {
+		if tomb.Sequence >= seen {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// PruneTombstones keeps a folder's deletions within maxAge and maxCount.
+// Deletions every peer has seen go first. If that isn't enough and forget is
+// set, the oldest of the rest go too, and the newest of those is recorded so
+// peers that missed it can be held for a full resync. Returns how many
+// deletions were forgotten before every peer saw them, and whether the folder
+// is still over its limits.
+func (s *StateStore) PruneTombstones(folderPath string, maxAge time.Duration, maxCount int, forget bool) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok || len(fs.Deleted) == 0 {
+		return 0, false
+	}
+
+	paths := make([]string, 0, len(fs.Deleted))
+	for path := range fs.Deleted {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return fs.Deleted[paths[i]].DeletedAt.Before(fs.Deleted[paths[j]].DeletedAt)
+	})
+	over := func() bool {
+		return len(fs.Deleted) > maxCount || time.Since(fs.Deleted[paths[0]].DeletedAt) > maxAge
+	}
+	if !over() {
+		return 0, false
+	}
+
+	seen := seenThroughLocked(fs)
+	kept := paths[:0]
+	for _, path := range paths {
+		if fs.Deleted[path].Sequence < seen {
+			delete(fs.Deleted, path)
+		} else {
+			kept = append(kept, path)
+		}
+	}
+	paths = kept
+	if len(paths) == 0 || !over() {
+		return 0, false
+	}
+	if !forget {
+		return 0, true
+	}
+
+	forgotten := 0
+	for len(paths) > 0 && over() {
+		tomb := fs.Deleted[paths[0]]
+		if tomb.Sequence > fs.ForgottenThrough {
+			fs.ForgottenThrough = tomb.Sequence
+		}
+		delete(fs.Deleted, paths[0])
+		paths = paths[1:]
+		forgotten++
+	}
+	return forgotten, false
+}
+
+// seenThroughLocked returns the sequence below which every peer that syncs
+// the folder has seen its deletions
+func seenThroughLocked(fs *FolderState) uint64 {
+	if len(fs.PeerSequences) == 0 {
+		return 0
+	}
+	seen := uint64(math.MaxUint64)
+	for peer := range fs.PeerSequences {
+		seen = min(seen, fs.PeerAcks[peer])
+	}
+	return seen
+}
+
+// SetPeerAck records the newest sequence of ours a peer has seen
+func (s *StateStore) SetPeerAck(folderPath, peerName string, seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		return
+	}
+	if fs.PeerAcks == nil {
+		fs.PeerAcks = make(map[string]uint64)
+	}
+	if seq > fs.PeerAcks[peerName] {
+		fs.PeerAcks[peerName] = seq
+	}
+}
+
+// ClearMissedDeletions records that a peer was fully resynced, so deletions
+// forgotten before then no longer hold it back
+func (s *StateStore) ClearMissedDeletions(folderPath, peerName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok || fs.ForgottenThrough == 0 {
+		return
+	}
+	if fs.PeerAcks == nil {
+		fs.PeerAcks = make(map[string]uint64)
+	}
+	if fs.PeerAcks[peerName] <= fs.ForgottenThrough {
+		fs.PeerAcks[peerName] = fs.ForgottenThrough + 1
+	}
+}
+
+// MissedForgottenDeletions reports whether a peer last synced a folder before
+// deletions it never saw were forgotten
+func (s *StateStore) MissedForgottenDeletions(folderPath, peerName string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok || fs.ForgottenThrough == 0 {
+		return false
+	}
+	// Peers this folder never synced with have nothing to bring back
+	if _, known := fs.PeerSequences[peerName]; !known {
+		return false
+	}
+	return fs.PeerAcks[peerName] <= fs.ForgottenThrough
+}
+
+// MoveFileStates moves the state for a renamed file, or for everything under a
+// renamed directory, to the new path
+func (s *StateStore) MoveFileStates(folderPath, oldRelPath, newRelPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		return
+	}
+
+	moved := make(map[string]*FileState)
+	prefix := oldRelPath + string(filepath.Separator)
+	for relPath, state := range fs.Files {
+		var newPath string
+		switch {
+		case relPath == oldRelPath:
+			newPath = newRelPath
+		case strings.HasPrefix(relPath, prefix):
+			newPath = filepath.Join(newRelPath, strings.TrimPrefix(relPath, prefix))
+		default:
+			continue
+		}
+
+		delete(fs.Files, relPath)
+		copied := *state
+		copied.RelPath = newPath
+		moved[newPath] = &copied
+	}
+
+	for relPath, state := range moved {
+		fs.Files[relPath] = state
+	}
+	fs.UpdatedAt = time.Now()
+}
+
 // GetAllFiles returns all tracked files in a folder
 func (s *StateStore) GetAllFiles(folderPath string) map[string]*FileState {
 	s.mu.RLock()
@@ -183,17 +589,354 @@ func (s *StateStore) GetAllFiles(folderPath string) map[string]*FileState {
 	return files
 }
 
-// InitFolder initializes state tracking for a folder
+// MarkUnreadable records a file that could not be read (e.g., permission denied)
+func (s *StateStore) MarkUnreadable(folderPath, relPath string, readErr error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		fs = &FolderState{
+			Path:  folderPath,
+			Files: make(map[string]*FileState),
+		}
+		s.folders[folderPath] = fs
+	}
+
+	if fs.Unreadable == nil {
+		fs.Unreadable = make(map[string]string)
+	}
+	fs.Unreadable[relPath] = readErr.Error()
+	fs.UpdatedAt = time.Now()
+}
+
+// ClearUnreadable removes a file from the unreadable list
+func (s *StateStore) ClearUnreadable(folderPath, relPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok || fs.Unreadable == nil {
+		return
+	}
+
+	if _, ok := fs.Unreadable[relPath]; ok {
+		delete(fs.Unreadable, relPath)
+		fs.UpdatedAt = time.Now()
+	}
+}
+
+// GetUnreadable returns the files in a folder that could not be read
+func (s *StateStore) GetUnreadable(folderPath string) map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		return nil
+	}
+
+	files := make(map[string]string, len(fs.Unreadable))
+	for k, v := range fs.Unreadable {
+		files[k] = v
+	}
+	return files
+}
+
+// MarkUnwritable records a file a peer's update couldn't be written over,
+// such as a locked file
+func (s *StateStore) MarkUnwritable(folderPath, relPath string, writeErr error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		fs = &FolderState{
+			Path:  folderPath,
+			Files: make(map[string]*FileState),
+		}
+		s.folders[folderPath] = fs
+	}
+
+	if fs.Unwritable == nil {
+		fs.Unwritable = make(map[string]string)
+	}
+	fs.Unwritable[relPath] = writeErr.Error()
+	fs.UpdatedAt = time.Now()
+}
+
+// ClearUnwritable removes a file from the unwritable list
+func (s *StateStore) ClearUnwritable(folderPath, relPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok || fs.Unwritable == nil {
+		return
+	}
+
+	if _, ok := fs.Unwritable[relPath]; ok {
+		delete(fs.Unwritable, relPath)
+		fs.UpdatedAt = time.Now()
+	}
+}
+
+// GetUnwritable returns the files in a folder that peers' updates couldn't
+// be written over
+func (s *StateStore) GetUnwritable(folderPath string) map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		return nil
+	}
+
+	files := make(map[string]string, len(fs.Unwritable))
+	for k, v := range fs.Unwritable {
+		files[k] = v
+	}
+	return files
+}
+
+// GetCachedHash returns a file's cached HashAlgorithm hash, or "" if none
+// was computed for this size, mod time and inode
+func (s *StateStore) GetCachedHash(folderPath, relPath string, size int64, modTime time.Time, inode uint64) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		return ""
+	}
+	cached, ok := fs.Hashes[relPath]
+	if !ok || cached.HashAlgo != fileutil.HashAlgorithm ||
+		cached.Size != size || !cached.ModTime.Equal(modTime) || cached.Inode != inode {
+		return ""
+	}
+	return cached.Hash
+}
+
+// SetCachedHash records a file's hash
+func (s *StateStore) SetCachedHash(folderPath, relPath string, cached *CachedHash) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		return
+	}
+	if fs.Hashes == nil {
+		fs.Hashes = make(map[string]*CachedHash)
+	}
+	fs.Hashes[relPath] = cached
+}
+
+// RetainCachedHashes drops cached hashes of files not in keep
+func (s *StateStore) RetainCachedHashes(folderPath string, keep map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		return
+	}
+	for relPath := range fs.Hashes {
+		if !keep[relPath] {
+			delete(fs.Hashes, relPath)
+		}
+	}
+}
+
+// RecordResolution remembers how a conflict between two versions was settled
+func (s *StateStore) RecordResolution(folderPath, relPath string, resolved *ResolvedConflict) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		return
+	}
+	if fs.Resolved == nil {
+		fs.Resolved = make(map[string]*ResolvedConflict)
+	}
+	fs.Resolved[relPath] = resolved
+	fs.UpdatedAt = time.Now()
+}
+
+// IsResolved reports whether the conflict between these two versions was
+// already settled. A decision for other versions is stale and is dropped.
+func (s *StateStore) IsResolved(folderPath, relPath, localHash, remoteHash string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok || fs.Resolved == nil {
+		return false
+	}
+
+	resolved, ok := fs.Resolved[relPath]
+	if !ok {
+		return false
+	}
+	if resolved.LocalHash == localHash && resolved.RemoteHash == remoteHash {
+		return true
+	}
+
+	delete(fs.Resolved, relPath)
+	fs.UpdatedAt = time.Now()
+	return false
+}
+
+// NextSequence increments and returns a folder's sync sequence
+func (s *StateStore) NextSequence(folderPath string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		return 0
+	}
+	fs.Sequence++
+	return fs.Sequence
+}
+
+// GetSequence returns a folder's sync sequence
+func (s *StateStore) GetSequence(folderPath string) uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if fs, ok := s.folders[folderPath]; ok {
+		return fs.Sequence
+	}
+	return 0
+}
+
+// AdvanceSequence moves a folder's sequence past the given value
+func (s *StateStore) AdvanceSequence(folderPath string, past uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fs, ok := s.folders[folderPath]; ok && fs.Sequence <= past {
+		fs.Sequence = past + 1
+	}
+}
+
+// GetPeerSequences returns the last sequence seen from each peer for a folder
+func (s *StateStore) GetPeerSequences(folderPath string) map[string]uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		return nil
+	}
+
+	seqs := make(map[string]uint64, len(fs.PeerSequences))
+	for k, v := range fs.PeerSequences {
+		seqs[k] = v
+	}
+	return seqs
+}
+
+// SetPeerSequence records the last sequence seen from a peer for a folder
+func (s *StateStore) SetPeerSequence(folderPath, peerName string, seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		return
+	}
+	if fs.PeerSequences == nil {
+		fs.PeerSequences = make(map[string]uint64)
+	}
+	fs.PeerSequences[peerName] = seq
+}
+
+// GetGeneration returns a folder's state generation
+func (s *StateStore) GetGeneration(folderPath string) uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if fs, ok := s.folders[folderPath]; ok {
+		return fs.Generation
+	}
+	return 0
+}
+
+// BumpGeneration starts a new state generation for a folder
+func (s *StateStore) BumpGeneration(folderPath string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		return 0
+	}
+	fs.Generation = nextGeneration(fs.Generation)
+	return fs.Generation
+}
+
+// GetPeerGenerations returns the last generation seen from each peer for a folder
+func (s *StateStore) GetPeerGenerations(folderPath string) map[string]uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		return nil
+	}
+
+	gens := make(map[string]uint64, len(fs.PeerGenerations))
+	for k, v := range fs.PeerGenerations {
+		gens[k] = v
+	}
+	return gens
+}
+
+// SetPeerGeneration records the last generation seen from a peer for a folder
+func (s *StateStore) SetPeerGeneration(folderPath, peerName string, gen uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		return
+	}
+	if fs.PeerGenerations == nil {
+		fs.PeerGenerations = make(map[string]uint64)
+	}
+	fs.PeerGenerations[peerName] = gen
+}
+
+// nextGeneration returns a generation newer than prev. Generations are based
+// on the clock so they stay unique even when the state file is deleted.
+func nextGeneration(prev uint64) uint64 {
+	gen := uint64(time.Now().UnixNano())
+	if gen <= prev {
+		gen = prev + 1
+	}
+	return gen
+}
+
+// InitFolder initializes state tracking for a folder. Folders without saved
+// state (new, re-added, or rebuilt) start a new generation.
 func (s *StateStore) InitFolder(folderPath string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if _, ok := s.folders[folderPath]; !ok {
-		s.folders[folderPath] = &FolderState{
+	fs, ok := s.folders[folderPath]
+	if !ok {
+		fs = &FolderState{
 			Path:      folderPath,
 			Files:     make(map[string]*FileState),
 			UpdatedAt: time.Now(),
 		}
+		s.folders[folderPath] = fs
+	}
+	if fs.Generation == 0 {
+		fs.Generation = nextGeneration(0)
 	}
 }
 
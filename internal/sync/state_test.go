@@ -0,0 +1,89 @@
+package sync
+
+import (
+	"os"
+	"testing"
+)
+
+func TestFolderGeneration(t *testing.T) {
+	const folder = "/Users/me/Documents"
+
+	tests := []struct {
+		name string
+		// event happens to a folder whose state has been saved, and returns
+		// the store that syncs the folder afterwards
+		event   func(t *testing.T, s *StateStore) *StateStore
+		changed bool
+	}{
+		{
+			name: "restart",
+			event: func(t *testing.T, s *StateStore) *StateStore {
+				loaded := &StateStore{folders: make(map[string]*FolderState), stateDir: s.stateDir}
+				if err := loaded.Load(); err != nil {
+					t.Fatal(err)
+				}
+				loaded.InitFolder(folder)
+				return loaded
+			},
+		},
+		{
+			name: "re-added",
+			event: func(t *testing.T, s *StateStore) *StateStore {
+				s.ClearFolder(folder)
+				s.InitFolder(folder)
+				return s
+			},
+			changed: true,
+		},
+		{
+			name: "state rebuilt",
+			event: func(t *testing.T, s *StateStore) *StateStore {
+				if err := os.RemoveAll(s.stateDir); err != nil {
+					t.Fatal(err)
+				}
+				rebuilt := &StateStore{folders: make(map[string]*FolderState), stateDir: s.stateDir}
+				if err := rebuilt.Load(); err != nil {
+					t.Fatal(err)
+				}
+				rebuilt.InitFolder(folder)
+				return rebuilt
+			},
+			changed: true,
+		},
+		{
+			name: "restore detected",
+			event: func(t *testing.T, s *StateStore) *StateStore {
+				s.BumpGeneration(folder)
+				return s
+			},
+			changed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &StateStore{folders: make(map[string]*FolderState), stateDir: t.TempDir()}
+			s.InitFolder(folder)
+			s.SetPeerGeneration(folder, "iMac", 7)
+			before := s.GetGeneration(folder)
+			if before == 0 {
+				t.Fatal("new folder has no generation")
+			}
+			if err := s.Save(); err != nil {
+				t.Fatal(err)
+			}
+
+			after := tt.event(t, s)
+			got := after.GetGeneration(folder)
+			if got == 0 {
+				t.Fatal("folder lost its generation")
+			}
+			if changed := got != before; changed != tt.changed {
+				t.Errorf("generation %d -> %d, changed = %v, want %v", before, got, changed, tt.changed)
+			}
+			if !tt.changed && after.GetPeerGenerations(folder)["iMac"] != 7 {
+				t.Errorf("peer generations = %v, want iMac: 7", after.GetPeerGenerations(folder))
+			}
+		})
+	}
+}
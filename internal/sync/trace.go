@@ -0,0 +1,92 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/rs/zerolog/log"
+)
+
+// PeerTrace is the protocol statistics and recent messages of one connection,
+// as last published by the daemon
+type PeerTrace struct {
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+	Direction string `json:"direction"` // incoming | outgoing
+	network.ProtocolStats
+}
+
+// peerTracePath is where the daemon publishes its connections' traces
+func peerTracePath() string {
+	return filepath.Join(config.ConfigDir(), "trace.json")
+}
+
+// LoadPeerTraces reads the connection traces last published by the daemon
+// for a peer, matched by device name, nickname or address
+func LoadPeerTraces(cfg *config.Config, peer string) ([]PeerTrace, error) {
+	data, err := os.ReadFile(peerTracePath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peer traces: %w", err)
+	}
+
+	var traces []PeerTrace
+	if err := json.Unmarshal(data, &traces); err != nil {
+		return nil, fmt.Errorf("failed to parse peer traces: %w", err)
+	}
+
+	var matched []PeerTrace
+	for _, t := range traces {
+		nickname := ""
+		if p := cfg.GetPeer(t.Name); p != nil {
+			nickname = p.Nickname
+		}
+		if strings.EqualFold(t.Name, peer) || (nickname != "" && strings.EqualFold(nickname, peer)) || t.Address == peer {
+			matched = append(matched, t)
+		}
+	}
+	return matched, nil
+}
+
+// PeerTraces returns the protocol statistics of every connection
+func (e *Engine) PeerTraces() []PeerTrace {
+	var traces []PeerTrace
+
+	for _, conn := range e.server.GetConnections() {
+		traces = append(traces, PeerTrace{
+			Name:          conn.DeviceName,
+			Address:       conn.ID,
+			Direction:     "incoming",
+			ProtocolStats: conn.ProtocolStats(),
+		})
+	}
+	for _, conn := range e.client.GetConnections() {
+		traces = append(traces, PeerTrace{
+			Name:          conn.DeviceName,
+			Address:       conn.Address,
+			Direction:     "outgoing",
+			ProtocolStats: conn.ProtocolStats(),
+		})
+	}
+
+	sort.Slice(traces, func(i, j int) bool {
+		return traces[i].Address < traces[j].Address
+	})
+	return traces
+}
+
+// publishPeerTraces writes the connections' traces for the debug command
+func (e *Engine) publishPeerTraces() {
+	data, err := json.Marshal(e.PeerTraces())
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(peerTracePath(), data, 0644); err != nil {
+		log.Debug().Err(err).Msg("Failed to write peer traces")
+	}
+}
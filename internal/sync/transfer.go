@@ -0,0 +1,380 @@
+package sync
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/rs/zerolog/log"
+)
+
+// transferTimeout is how long a request may go without data arriving for it
+// before its slot is reclaimed (e.g., the peer skipped it or the file vanished)
+const transferTimeout = 2 * time.Minute
+
+// transferMinRate is the slowest file data is expected to arrive, in bytes per
+// second. A file sent in one piece shows no progress until all of it is in,
+// so the wait for it grows with its size at this rate.
+const transferMinRate = 64 << 10
+
+// transferWait is how long to wait for size bytes of a transfer to arrive
+func transferWait(size int64) time.Duration {
+	return transferTimeout + time.Duration(size/transferMinRate)*time.Second
+}
+
+// Files below smallFileSize or edited within recentEditWindow jump the queue
+const (
+	smallFileSize    = 1 << 20
+	recentEditWindow = 10 * time.Minute
+)
+
+// Transfer classes, in the order they are requested
+const (
+	classUrgent = iota // Small or recently edited
+	classNormal
+	classLarge
+)
+
+// transferCostFloor is the least a request counts against its folder's
+// share, so a folder of tiny files doesn't get them all sent for free
+const transferCostFloor = 64 << 10
+
+// transferPriority orders a folder's queued requests: small or recently
+// edited files, then the rest, with large files last. Within a class newer
+// files go first, then arrival order. Folders share a peer by weight.
+type transferPriority struct {
+	weight  int   // The folder's share of the peer's transfers
+	size    int64 // Bytes, charged against the folder's share
+	class   int
+	modTime time.Time
+	seq     uint64
+}
+
+func (p transferPriority) before(o transferPriority) bool {
+	switch {
+	case p.class != o.class:
+		return p.class < o.class
+	case !p.modTime.Equal(o.modTime):
+		return p.modTime.After(o.modTime)
+	default:
+		return p.seq < o.seq
+	}
+}
+
+// cost is how far a request advances its folder's virtual time
+func (p transferPriority) cost() float64 {
+	size := p.size
+	if size < transferCostFloor {
+		size = transferCostFloor
+	}
+	weight := p.weight
+	if weight < 1 {
+		weight = 1
+	}
+	return float64(size) / float64(weight)
+}
+
+// transferPriorityFor ranks a file about to be requested from a peer
+func (e *Engine) transferPriorityFor(localFolderPath string, size int64, modTime time.Time) transferPriority {
+	prio := transferPriority{weight: 2, size: size, class: classNormal, modTime: modTime}
+	if folderCfg := e.cfg.GetFolder(localFolderPath); folderCfg != nil {
+		prio.weight = folderCfg.PriorityWeight()
+	}
+
+	switch {
+	case size >= e.cfg.GetLargeFileSize():
+		prio.class = classLarge
+	case size < smallFileSize || time.Since(modTime) < recentEditWindow:
+		prio.class = classUrgent
+	}
+	return prio
+}
+
+type queuedRequest struct {
+	req  network.FileRequestMessage
+	prio transferPriority
+}
+
+// requestQueue is a min-heap of queued requests by priority
+type requestQueue []*queuedRequest
+
+func (q requestQueue) Len() int           { return len(q) }
+func (q requestQueue) Less(i, j int) bool { return q[i].prio.before(q[j].prio) }
+func (q requestQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *requestQueue) Push(x any)        { *q = append(*q, x.(*queuedRequest)) }
+func (q *requestQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// transferScheduler pipelines file requests per peer, keeping at most
+// maxInFlight requests outstanding on each connection. Whenever a slot frees
+// up, folders with queued requests take turns by weighted fair queuing, so a
+// bulk transfer in one folder doesn't hold up small updates in the others.
+type transferScheduler struct {
+	maxInFlight int
+	mu          sync.Mutex
+	peers       map[string]*peerTransfers
+	seq         uint64
+
+	// resume fills in where a request can pick up from, just before it is sent
+	resume func(req *network.FileRequestMessage)
+}
+
+type peerTransfers struct {
+	send        func(*network.Message) error
+	lanes       map[string]*transferLane // Folder name -> its queued requests
+	inFlight    map[string]time.Time     // transferKey -> when its slot is reclaimed
+	vtime       float64                  // Virtual time of the last request sent
+	maxInFlight int                      // 0 = the scheduler's default
+}
+
+// transferLane is one folder's queued requests to a peer. Each request sent
+// advances the lane's virtual time by its size over the folder's weight; the
+// lane furthest behind goes next.
+type transferLane struct {
+	pending requestQueue
+	vtime   float64
+}
+
+func newTransferScheduler(maxInFlight int) *transferScheduler {
+	if maxInFlight <= 0 {
+		maxInFlight = 1
+	}
+	return &transferScheduler{
+		maxInFlight: maxInFlight,
+		peers:       make(map[string]*peerTransfers),
+	}
+}
+
+func transferKey(folderName, relPath string) string {
+	return folderName + "\x00" + relPath
+}
+
+// transferSend is a request given a slot, sent once the scheduler's lock is
+// released so a slow connection doesn't hold up other peers
+type transferSend struct {
+	peerID string
+	send   func(*network.Message) error
+	msg    *network.Message
+	key    string
+	file   string
+}
+
+// enqueue queues a file request for a peer and sends it once a slot is free
+func (t *transferScheduler) enqueue(peerID string, send func(*network.Message) error, req network.FileRequestMessage, prio transferPriority) {
+	t.mu.Lock()
+	p := t.peerLocked(peerID)
+	p.send = send
+
+	key := transferKey(req.FolderName, req.RelPath)
+	if _, ok := p.inFlight[key]; ok {
+		t.mu.Unlock()
+		return
+	}
+	lane, ok := p.lanes[req.FolderName]
+	if !ok {
+		lane = &transferLane{}
+		p.lanes[req.FolderName] = lane
+	}
+	for _, queued := range lane.pending {
+		if queued.req.RelPath == req.RelPath {
+			t.mu.Unlock()
+			return
+		}
+	}
+
+	// A folder that was idle joins at the current virtual time, without
+	// credit for the turns it didn't need
+	if len(lane.pending) == 0 && lane.vtime < p.vtime {
+		lane.vtime = p.vtime
+	}
+
+	t.seq++
+	prio.seq = t.seq
+	heap.Push(&lane.pending, &queuedRequest{req: req, prio: prio})
+	sends := t.dispatchLocked(peerID, p)
+	t.mu.Unlock()
+
+	t.flush(sends)
+}
+
+// setLimit sets how many requests may be outstanding with one peer
+func (t *transferScheduler) setLimit(peerID string, maxInFlight int) {
+	t.mu.Lock()
+	var sends []transferSend
+	p := t.peerLocked(peerID)
+	p.maxInFlight = maxInFlight
+	if p.send != nil {
+		sends = t.dispatchLocked(peerID, p)
+	}
+	t.mu.Unlock()
+
+	t.flush(sends)
+}
+
+func (t *transferScheduler) peerLocked(peerID string) *peerTransfers {
+	p, ok := t.peers[peerID]
+	if !ok {
+		p = &peerTransfers{
+			lanes:    make(map[string]*transferLane),
+			inFlight: make(map[string]time.Time),
+		}
+		t.peers[peerID] = p
+	}
+	return p
+}
+
+// complete frees the slot held by a finished transfer and sends the next request
+func (t *transferScheduler) complete(peerID, folderName, relPath string) {
+	t.mu.Lock()
+	p, ok := t.peers[peerID]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+
+	delete(p.inFlight, transferKey(folderName, relPath))
+	sends := t.dispatchLocked(peerID, p)
+	t.mu.Unlock()
+
+	t.flush(sends)
+}
+
+// progress pushes back the deadline of a transfer whose data is arriving in
+// parts, so a large file on a slow link keeps its slot while it is received
+func (t *transferScheduler) progress(peerID, folderName, relPath string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.peers[peerID]
+	if !ok {
+		return
+	}
+	key := transferKey(folderName, relPath)
+	if _, ok := p.inFlight[key]; ok {
+		p.inFlight[key] = time.Now().Add(transferWait(network.ChunkSize))
+	}
+}
+
+// expire reclaims slots for requests that stopped getting an answer
+func (t *transferScheduler) expire() {
+	t.mu.Lock()
+	var sends []transferSend
+	now := time.Now()
+	for peerID, p := range t.peers {
+		for key, deadline := range p.inFlight {
+			if now.After(deadline) {
+				delete(p.inFlight, key)
+			}
+		}
+		sends = append(sends, t.dispatchLocked(peerID, p)...)
+	}
+	t.mu.Unlock()
+
+	t.flush(sends)
+}
+
+// dropPeer forgets all queued and in-flight requests for a disconnected peer
+func (t *transferScheduler) dropPeer(peerID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.peers, peerID)
+}
+
+// dispatchLocked gives free slots to queued requests and returns them to be
+// sent with flush
+func (t *transferScheduler) dispatchLocked(peerID string, p *peerTransfers) []transferSend {
+	limit := t.maxInFlight
+	if p.maxInFlight > 0 {
+		limit = p.maxInFlight
+	}
+
+	var sends []transferSend
+	for len(p.inFlight) < limit {
+		lane := p.nextLane()
+		if lane == nil {
+			break
+		}
+		queued := heap.Pop(&lane.pending).(*queuedRequest)
+		p.vtime = lane.vtime
+		lane.vtime += queued.prio.cost()
+		req := queued.req
+		if t.resume != nil {
+			t.resume(&req)
+		}
+
+		msg, err := network.NewMessage(network.MsgFileRequest, req)
+		if err != nil {
+			continue
+		}
+		key := transferKey(req.FolderName, req.RelPath)
+		p.inFlight[key] = time.Now().Add(transferWait(queued.prio.size))
+		sends = append(sends, transferSend{peerID: peerID, send: p.send, msg: msg, key: key, file: req.RelPath})
+	}
+	return sends
+}
+
+// flush sends requests given slots by dispatchLocked. A request that can't be
+// sent frees its slot for the next one.
+func (t *transferScheduler) flush(sends []transferSend) {
+	for len(sends) > 0 {
+		s := sends[0]
+		sends = sends[1:]
+		err := s.send(s.msg)
+		if err == nil {
+			continue
+		}
+
+		log.Error().Err(err).Str("remote", s.peerID).Str("file", s.file).Msg("Failed to send file request")
+		t.mu.Lock()
+		if p, ok := t.peers[s.peerID]; ok {
+			delete(p.inFlight, s.key)
+			sends = append(sends, t.dispatchLocked(s.peerID, p)...)
+		}
+		t.mu.Unlock()
+	}
+}
+
+// nextLane returns the folder with queued requests that is furthest behind
+// its share, or nil if nothing is queued
+func (p *peerTransfers) nextLane() *transferLane {
+	var next *transferLane
+	var nextName string
+	for name, lane := range p.lanes {
+		if len(lane.pending) == 0 {
+			continue
+		}
+		if next == nil || lane.vtime < next.vtime || (lane.vtime == next.vtime && name < nextName) {
+			next, nextName = lane, name
+		}
+	}
+	return next
+}
+
+// fileRequestJob is a peer's file request waiting for a serve worker
+type fileRequestJob struct {
+	req    network.FileRequestMessage
+	connID string
+	send   func(*network.Message) error
+}
+
+// transferExpiryLoop periodically reclaims stalled transfer slots
+func (e *Engine) transferExpiryLoop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			e.transfers.expire()
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/network"
+)
+
+func TestTransferExpiry(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int64
+		elapsed time.Duration // Since the request was sent
+		parts   bool          // A part of the file arrived just now
+		expired bool
+	}{
+		{name: "small file answered in time", size: 4 << 10, elapsed: time.Minute},
+		{name: "small file never answered", size: 4 << 10, elapsed: 3 * time.Minute, expired: true},
+		{name: "large file still arriving in one piece", size: 40 << 20, elapsed: 10 * time.Minute},
+		{name: "large file never answered", size: 40 << 20, elapsed: 20 * time.Minute, expired: true},
+		{name: "parts still arriving", size: 1 << 30, elapsed: time.Hour, parts: true},
+		{name: "parts stopped arriving", size: 1 << 30, elapsed: 5 * time.Hour, expired: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent []string
+			send := func(msg *network.Message) error {
+				var req network.FileRequestMessage
+				if err := msg.DecodePayload(&req); err != nil {
+					t.Fatal(err)
+				}
+				sent = append(sent, req.RelPath)
+				return nil
+			}
+
+			ts := newTransferScheduler(1)
+			ts.enqueue("peer", send, network.FileRequestMessage{FolderName: "Documents", RelPath: "a.mov"}, transferPriority{size: tt.size})
+			ts.enqueue("peer", send, network.FileRequestMessage{FolderName: "Documents", RelPath: "b.txt"}, transferPriority{size: 1})
+
+			// Move the request back in time as if it was sent elapsed ago
+			key := transferKey("Documents", "a.mov")
+			ts.peers["peer"].inFlight[key] = ts.peers["peer"].inFlight[key].Add(-tt.elapsed)
+			if tt.parts {
+				ts.progress("peer", "Documents", "a.mov")
+			}
+			ts.expire()
+
+			_, held := ts.peers["peer"].inFlight[key]
+			if held == tt.expired {
+				t.Errorf("slot held = %v, want %v", held, !tt.expired)
+			}
+			if next := len(sent) == 2; next != tt.expired {
+				t.Errorf("requests sent = %v", sent)
+			}
+		})
+	}
+}
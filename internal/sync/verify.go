@@ -0,0 +1,79 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// maxVerifyRetries bounds re-requests for a file that keeps failing verification
+const maxVerifyRetries = 3
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// verifyReceived checks a written file against the hash the sender reported,
+// made with the sender's hash algorithm
+func verifyReceived(fullPath, expected, algorithm string) error {
+	if expected == "" {
+		return nil
+	}
+
+	actual, err := fileutil.HashFileWith(fullPath, algorithm)
+	if errors.Is(err, fileutil.ErrUnsupportedHash) {
+		log.Warn().Err(err).Str("path", fullPath).Msg("Can't verify file hashed with an unknown algorithm")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to verify file: %w", err)
+	}
+	if actual != expected {
+		return fmt.Errorf("%w: expected %.12s, got %.12s", errChecksumMismatch, expected, actual)
+	}
+	return nil
+}
+
+// noteCorrupt records a verification failure for a received file
+func (e *Engine) noteCorrupt(fullPath string) {
+	e.remoteMu.Lock()
+	defer e.remoteMu.Unlock()
+	e.refetching[fullPath]++
+}
+
+// clearCorrupt forgets verification failures once a clean copy arrives
+func (e *Engine) clearCorrupt(fullPath string) {
+	e.remoteMu.Lock()
+	defer e.remoteMu.Unlock()
+	delete(e.refetching, fullPath)
+}
+
+// rerequestCorrupt asks the sender for a clean copy of a file that failed
+// verification, unless it has already failed too many times
+func (e *Engine) rerequestCorrupt(fileData network.FileDataMessage, connID, peerName string, send func(*network.Message) error) bool {
+	localFolderPath := e.findLocalFolderByName(fileData.FolderName)
+	fullPath := filepath.Join(localFolderPath, fileData.RelPath)
+
+	e.remoteMu.RLock()
+	failures := e.refetching[fullPath]
+	e.remoteMu.RUnlock()
+
+	if failures > maxVerifyRetries {
+		log.Error().
+			Str("file", fileData.RelPath).
+			Str("peer_id", peerName).
+			Int("failures", failures).
+			Msg("Received file keeps failing verification, giving up")
+		e.publishError(fmt.Errorf("%s from %s failed verification %d times", fileData.RelPath, peerName, failures))
+		return false
+	}
+
+	e.transfers.enqueue(connID, send, network.FileRequestMessage{
+		FolderPath: fileData.FolderPath,
+		FolderName: fileData.FolderName,
+		RelPath:    fileData.RelPath,
+	}, e.transferPriorityFor(localFolderPath, int64(len(fileData.Data)), fileData.ModTime))
+	return true
+}
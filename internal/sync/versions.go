@@ -0,0 +1,196 @@
+package sync
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// versionTimeFormat names each kept version after when it was replaced
+const versionTimeFormat = "20060102-150405"
+
+// FileVersion is a previous version of a synced file, kept when a peer's copy
+// replaced it
+type FileVersion struct {
+	ID         string    // When it was replaced, e.g. 20240102-150405
+	FolderPath string    // Synced folder
+	RelPath    string    // File path relative to the folder
+	ReplacedAt time.Time // When a peer's copy replaced it
+	ModTime    time.Time // When it was last changed before that
+	Size       int64
+}
+
+// Path returns where the version is stored
+func (v *FileVersion) Path() string {
+	return filepath.Join(versionsDir(v.FolderPath, v.RelPath), v.ID)
+}
+
+// versionsDir returns where a file's previous versions are kept
+func versionsDir(folderPath, relPath string) string {
+	return filepath.Join(folderPath, config.VersionsDirName, relPath)
+}
+
+// keepVersion saves a copy of a file about to be replaced by a peer's, then
+// prunes its versions beyond sync.versions and sync.versions_max_age
+func (e *Engine) keepVersion(folderPath, relPath string) {
+	keep := e.cfg.Sync.Versions
+	if keep <= 0 {
+		return
+	}
+
+	if err := saveVersion(folderPath, relPath); err != nil {
+		log.Warn().Err(err).Str("file", relPath).Str("folder_id", folderPath).Msg("Failed to keep previous version")
+		return
+	}
+	if err := pruneVersions(folderPath, relPath, keep, e.cfg.GetVersionsMaxAge()); err != nil {
+		log.Debug().Err(err).Str("file", relPath).Msg("Failed to prune previous versions")
+	}
+}
+
+// saveVersion clones a file into its versions directory. Missing files and
+// anything that isn't a regular file have nothing to keep.
+func saveVersion(folderPath, relPath string) error {
+	fullPath := filepath.Join(folderPath, relPath)
+	info, err := os.Lstat(fullPath)
+	if os.IsNotExist(err) || (err == nil && !info.Mode().IsRegular()) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat: %w", err)
+	}
+
+	id := time.Now().Format(versionTimeFormat)
+	dest := filepath.Join(versionsDir(folderPath, relPath), id)
+	for n := 2; fileutil.Exists(dest); n++ {
+		dest = filepath.Join(versionsDir(folderPath, relPath), fmt.Sprintf("%s-%d", id, n))
+	}
+	if err := fileutil.CloneFile(fullPath, dest); err != nil {
+		return fmt.Errorf("failed to copy previous version: %w", err)
+	}
+	return nil
+}
+
+// pruneVersions removes a file's oldest versions beyond keep, and any older
+// than maxAge (0 = no age limit)
+func pruneVersions(folderPath, relPath string, keep int, maxAge time.Duration) error {
+	versions, err := ListVersions(folderPath, relPath)
+	if err != nil {
+		return err
+	}
+	for i, v := range versions {
+		if i < keep && (maxAge == 0 || time.Since(v.ReplacedAt) <= maxAge) {
+			continue
+		}
+		if err := os.Remove(v.Path()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove version %s: %w", v.ID, err)
+		}
+	}
+
+	// Drop directories left empty, up to the versions directory itself
+	root := filepath.Join(folderPath, config.VersionsDirName)
+	for dir := versionsDir(folderPath, relPath); dir != root && dir != folderPath; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// ListVersions returns the previous versions of a file, newest first. An
+// empty relPath lists the versions of every file in the folder.
+func ListVersions(folderPath, relPath string) ([]*FileVersion, error) {
+	root := filepath.Join(folderPath, config.VersionsDirName)
+	start := versionsDir(folderPath, relPath)
+
+	var versions []*FileVersion
+	err := filepath.WalkDir(start, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == start {
+				return filepath.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		id := d.Name()
+		replacedAt, err := time.ParseInLocation(versionTimeFormat, id[:min(len(id), len(versionTimeFormat))], time.Local)
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+
+		versions = append(versions, &FileVersion{
+			ID:         id,
+			FolderPath: folderPath,
+			RelPath:    rel,
+			ReplacedAt: replacedAt,
+			ModTime:    info.ModTime(),
+			Size:       info.Size(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read versions: %w", err)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		if versions[i].RelPath != versions[j].RelPath {
+			return versions[i].RelPath < versions[j].RelPath
+		}
+		if len(versions[i].ID) != len(versions[j].ID) {
+			return len(versions[i].ID) > len(versions[j].ID) // 20240102-150405-10 is newer than -9
+		}
+		return versions[i].ID > versions[j].ID
+	})
+	return versions, nil
+}
+
+// RestoreVersion puts a previous version of a file back in place. The current
+// file is kept as a version first, so a restore can itself be undone.
+func RestoreVersion(folderPath, relPath, id string) error {
+	if id == "" || filepath.Base(id) != id {
+		return fmt.Errorf("invalid version %q", id)
+	}
+	version := filepath.Join(versionsDir(folderPath, relPath), id)
+	if !fileutil.Exists(version) {
+		return fmt.Errorf("no version %s of %s", id, relPath)
+	}
+
+	if err := saveVersion(folderPath, relPath); err != nil {
+		return err
+	}
+
+	// Clone next to the file and move into place, so it is never missing
+	fullPath := filepath.Join(folderPath, relPath)
+	f, err := createTemp(fullPath)
+	if err != nil {
+		return err
+	}
+	staged := f.Name()
+	_ = f.Close()
+	_ = os.Remove(staged)
+	if err := fileutil.CloneFile(version, staged); err != nil {
+		return fmt.Errorf("failed to copy version: %w", err)
+	}
+	if err := placeStaged(staged, fullPath); err != nil {
+		_ = os.Remove(staged)
+		return fmt.Errorf("failed to restore version: %w", err)
+	}
+	return nil
+}
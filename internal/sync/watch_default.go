@@ -0,0 +1,9 @@
+//go:build !darwin || !cgo
+
+package sync
+
+// newWatchBackend watches folders with fsnotify. FSEvents needs macOS and
+// cgo.
+func newWatchBackend(w *Watcher) (watchBackend, error) {
+	return newFsnotifyBackend(w)
+}
@@ -0,0 +1,414 @@
+//go:build darwin && cgo
+
+package sync
+
+/*
+#cgo LDFLAGS: -framework CoreServices
+#include <stdlib.h>
+#include <dispatch/dispatch.h>
+#include <CoreServices/CoreServices.h>
+
+extern void fseventsCallback(FSEventStreamRef stream, uintptr_t info, size_t numEvents, char **paths, FSEventStreamEventFlags *flags, FSEventStreamEventId *ids);
+
+static FSEventStreamRef fseventsCreate(uintptr_t info, const char *path, FSEventStreamEventId since, CFTimeInterval latency, FSEventStreamCreateFlags flags) {
+	CFStringRef cfPath = CFStringCreateWithCString(NULL, path, kCFStringEncodingUTF8);
+	if (cfPath == NULL) {
+		return NULL;
+	}
+	CFArrayRef paths = CFArrayCreate(NULL, (const void **)&cfPath, 1, &kCFTypeArrayCallBacks);
+	FSEventStreamContext context = {0, (void *)info, NULL, NULL, NULL};
+	FSEventStreamRef stream = FSEventStreamCreate(NULL, (FSEventStreamCallback)fseventsCallback, &context, paths, since, latency, flags);
+	CFRelease(paths);
+	CFRelease(cfPath);
+	return stream;
+}
+
+static Boolean fseventsStart(FSEventStreamRef stream, dispatch_queue_t queue) {
+	FSEventStreamSetDispatchQueue(stream, queue);
+	if (!FSEventStreamStart(stream)) {
+		FSEventStreamInvalidate(stream);
+		FSEventStreamRelease(stream);
+		return false;
+	}
+	return true;
+}
+
+static void fseventsStop(FSEventStreamRef stream) {
+	FSEventStreamStop(stream);
+	FSEventStreamInvalidate(stream);
+	FSEventStreamRelease(stream);
+}
+
+static dispatch_queue_t fseventsQueue(void) {
+	return dispatch_queue_create("mac-profile-sync.fsevents", NULL);
+}
+
+static Boolean fseventsDeviceUUID(dev_t dev, char *buf, CFIndex size) {
+	CFUUIDRef uuid = FSEventsCopyUUIDForDevice(dev);
+	if (uuid == NULL) {
+		return false;
+	}
+	CFStringRef str = CFUUIDCreateString(NULL, uuid);
+	CFRelease(uuid);
+	if (str == NULL) {
+		return false;
+	}
+	Boolean ok = CFStringGetCString(str, buf, size, kCFStringEncodingUTF8);
+	CFRelease(str);
+	return ok;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+	"github.com/rs/zerolog/log"
+)
+
+// fseventsCheckInterval is how often a folder's position is checkpointed
+const fseventsCheckInterval = time.Minute
+
+// fseventsSafetyMargin is how old a checkpoint must be before it is saved as
+// the position to catch up from. Changes reported since may still be held
+// by the watcher or queued in the engine when the daemon stops.
+const fseventsSafetyMargin = 10 * time.Minute
+
+// fseventsHistoryTimeout bounds how long reading a folder's history may take
+const fseventsHistoryTimeout = 30 * time.Second
+
+// fseventsStreams maps the IDs handed to FSEvents back to their streams
+var fseventsStreams = struct {
+	sync.Mutex
+	next    uintptr
+	streams map[uintptr]*fseventsStream
+}{streams: make(map[uintptr]*fseventsStream)}
+
+//export fseventsCallback
+func fseventsCallback(stream C.FSEventStreamRef, info uintptr, numEvents C.size_t, paths **C.char, flags *C.FSEventStreamEventFlags, ids *C.FSEventStreamEventId) {
+	fseventsStreams.Lock()
+	s := fseventsStreams.streams[info]
+	fseventsStreams.Unlock()
+	if s == nil {
+		return
+	}
+
+	n := int(numEvents)
+	cpaths := unsafe.Slice(paths, n)
+	cflags := unsafe.Slice(flags, n)
+	cids := unsafe.Slice(ids, n)
+
+	events := make([]fsevent, n)
+	for i := range events {
+		events[i] = fsevent{
+			path:  s.localPath(C.GoString(cpaths[i])),
+			flags: uint32(cflags[i]),
+			id:    uint64(cids[i]),
+		}
+	}
+	s.handle(s, events)
+}
+
+// fseventsStream is one FSEvents stream over a folder
+type fseventsStream struct {
+	id     uintptr
+	ref    C.FSEventStreamRef
+	folder string // As configured
+	real   string // With symlinks resolved, as FSEvents reports paths
+	device string
+	handle func(s *fseventsStream, events []fsevent)
+
+	checkpoints []fseventsCheckpoint
+}
+
+// fseventsCheckpoint is the event ID current at a point in time
+type fseventsCheckpoint struct {
+	at time.Time
+	id uint64
+}
+
+// startFSEventsStream starts a stream reporting changes under a folder since
+// an event ID to handle, on queue
+func startFSEventsStream(queue C.dispatch_queue_t, folderPath string, since uint64, latency float64, flags uint32, handle func(*fseventsStream, []fsevent)) (*fseventsStream, error) {
+	real, err := filepath.EvalSymlinks(folderPath)
+	if err != nil {
+		real = folderPath
+	}
+	s := &fseventsStream{
+		folder: folderPath,
+		real:   real,
+		device: volumeUUID(folderPath),
+		handle: handle,
+	}
+
+	fseventsStreams.Lock()
+	fseventsStreams.next++
+	s.id = fseventsStreams.next
+	fseventsStreams.streams[s.id] = s
+	fseventsStreams.Unlock()
+
+	cpath := C.CString(real)
+	defer C.free(unsafe.Pointer(cpath))
+
+	s.ref = C.fseventsCreate(C.uintptr_t(s.id), cpath, C.FSEventStreamEventId(since), C.CFTimeInterval(latency), C.FSEventStreamCreateFlags(flags))
+	if s.ref == nil {
+		s.unregister()
+		return nil, fmt.Errorf("failed to create FSEvents stream for %s", folderPath)
+	}
+	if C.fseventsStart(s.ref, queue) == 0 {
+		s.unregister()
+		return nil, fmt.Errorf("failed to start FSEvents stream for %s", folderPath)
+	}
+	return s, nil
+}
+
+// stop stops the stream; its handler isn't called again
+func (s *fseventsStream) stop() {
+	C.fseventsStop(s.ref)
+	s.unregister()
+}
+
+func (s *fseventsStream) unregister() {
+	fseventsStreams.Lock()
+	delete(fseventsStreams.streams, s.id)
+	fseventsStreams.Unlock()
+}
+
+// localPath turns a path FSEvents reported into one under the folder as
+// configured
+func (s *fseventsStream) localPath(path string) string {
+	path = strings.TrimSuffix(path, "/")
+	if rel, ok := fileutil.RelWithin(s.real, path); ok {
+		return filepath.Join(s.folder, rel)
+	}
+	return path
+}
+
+// currentEventID returns the ID of the most recent change on the system
+func currentEventID() uint64 {
+	return uint64(C.FSEventsGetCurrentEventId())
+}
+
+// volumeUUID returns the UUID FSEvents keeps event IDs under for the volume
+// a path is on, or "" if it has none
+func volumeUUID(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+
+	buf := make([]byte, 64)
+	if C.fseventsDeviceUUID(C.dev_t(st.Dev), (*C.char)(unsafe.Pointer(&buf[0])), C.CFIndex(len(buf))) == 0 {
+		return ""
+	}
+	return C.GoString((*C.char)(unsafe.Pointer(&buf[0])))
+}
+
+// fseventsBackend watches each folder with one recursive FSEvents stream.
+// Unlike fsnotify it needs no watch per directory, and its event IDs let the
+// changes made while the daemon was stopped be found without walking the
+// whole folder.
+type fseventsBackend struct {
+	w         *Watcher
+	queue     C.dispatch_queue_t
+	positions *fseventsPositions
+
+	mu      sync.Mutex
+	streams map[string]*fseventsStream // Folder path -> stream
+	resume  map[string]uint64          // Folder path -> event ID its stream starts from
+}
+
+// newWatchBackend watches folders with FSEvents
+func newWatchBackend(w *Watcher) (watchBackend, error) {
+	b := &fseventsBackend{
+		w:         w,
+		queue:     C.fseventsQueue(),
+		positions: newFSEventsPositions(),
+		streams:   make(map[string]*fseventsStream),
+		resume:    make(map[string]uint64),
+	}
+	go b.checkpointLoop()
+	return b, nil
+}
+
+func (b *fseventsBackend) addFolder(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.streams[path]; ok {
+		return nil
+	}
+
+	// Pick up where catching up on the folder's history left off
+	since, ok := b.resume[path]
+	delete(b.resume, path)
+	if !ok {
+		since = currentEventID()
+	}
+
+	s, err := startFSEventsStream(b.queue, path, since, fseventsLatency, fseventsFileEvents|fseventsWatchRoot|fseventsNoDefer, b.handleEvents)
+	if err != nil {
+		return err
+	}
+	s.checkpoints = []fseventsCheckpoint{{at: time.Now(), id: since}}
+	if _, known := b.positions.get(path); !known && s.device != "" {
+		b.positions.set(path, fseventsPosition{Device: s.device, EventID: since})
+	}
+	b.streams[path] = s
+	return nil
+}
+
+func (b *fseventsBackend) removeFolder(path string) {
+	b.mu.Lock()
+	s, ok := b.streams[path]
+	delete(b.streams, path)
+	b.mu.Unlock()
+
+	if ok {
+		s.stop()
+	}
+}
+
+// addTree does nothing; a folder's stream already covers everything under it
+func (b *fseventsBackend) addTree(folderPath, dir string) {}
+
+func (b *fseventsBackend) close() error {
+	b.mu.Lock()
+	streams := b.streams
+	b.streams = make(map[string]*fseventsStream)
+	b.mu.Unlock()
+
+	for _, s := range streams {
+		s.stop()
+	}
+	b.positions.saveIfChanged()
+	return nil
+}
+
+// handleEvents passes a stream's changes on to the watcher
+func (b *fseventsBackend) handleEvents(s *fseventsStream, events []fsevent) {
+	for _, ev := range events {
+		switch {
+		case ev.flags&fseventHistoryDone != 0:
+			continue
+		case ev.lost():
+			log.Warn().Str("folder_id", s.folder).Str("path", ev.path).Msg("FSEvents dropped changes, rescanning folder")
+			b.w.lostEvents(s.folder)
+			continue
+		case ev.flags&fseventRootChanged != 0:
+			log.Warn().Str("folder_id", s.folder).Msg("Folder was moved, deleted or unmounted")
+			continue
+		}
+
+		if op, ok := ev.op(); ok {
+			b.w.handleFsEvent(fsnotify.Event{Name: ev.path, Op: op})
+		}
+	}
+}
+
+// changedSince reads the changes under a folder since the position saved by
+// the last run, and has the folder's stream start where they end. It fails
+// without a position, if the folder moved to another volume, or if FSEvents
+// can't account for every change.
+func (b *fseventsBackend) changedSince(folderPath string) ([]string, bool) {
+	now := currentEventID()
+	b.mu.Lock()
+	b.resume[folderPath] = now
+	b.mu.Unlock()
+
+	pos, ok := b.positions.get(folderPath)
+	if !ok {
+		return nil, false
+	}
+	if device := volumeUUID(folderPath); device == "" || device != pos.Device || pos.EventID > now {
+		log.Debug().Str("folder_id", folderPath).Msg("FSEvents history doesn't apply, scanning whole folder")
+		return nil, false
+	}
+
+	var (
+		mu    sync.Mutex
+		paths []string
+		lost  bool
+		once  sync.Once
+	)
+	done := make(chan struct{})
+	s, err := startFSEventsStream(b.queue, folderPath, pos.EventID, 0, fseventsFileEvents|fseventsNoDefer, func(_ *fseventsStream, events []fsevent) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, ev := range events {
+			switch {
+			case ev.flags&fseventHistoryDone != 0:
+				once.Do(func() { close(done) })
+			case ev.lost() || ev.flags&fseventRootChanged != 0:
+				lost = true
+			default:
+				paths = append(paths, ev.path)
+			}
+		}
+	})
+	if err != nil {
+		log.Debug().Err(err).Str("folder_id", folderPath).Msg("Failed to read FSEvents history")
+		return nil, false
+	}
+
+	select {
+	case <-done:
+	case <-time.After(fseventsHistoryTimeout):
+		log.Warn().Str("folder_id", folderPath).Msg("Timed out reading FSEvents history, scanning whole folder")
+		lost = true
+	}
+	s.stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if lost {
+		return nil, false
+	}
+	return paths, true
+}
+
+// checkpointLoop saves each folder's position once it is old enough that
+// every change before it has been handled
+func (b *fseventsBackend) checkpointLoop() {
+	ticker := time.NewTicker(fseventsCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.w.done:
+			return
+		case now := <-ticker.C:
+			id := currentEventID()
+
+			b.mu.Lock()
+			for path, s := range b.streams {
+				s.checkpoints = append(s.checkpoints, fseventsCheckpoint{at: now, id: id})
+				i := len(s.checkpoints) - 1
+				for i >= 0 && now.Sub(s.checkpoints[i].at) < fseventsSafetyMargin {
+					i--
+				}
+				if i < 0 || s.device == "" {
+					continue
+				}
+				b.positions.set(path, fseventsPosition{Device: s.device, EventID: s.checkpoints[i].id})
+				s.checkpoints = s.checkpoints[i+1:]
+			}
+			b.mu.Unlock()
+
+			b.positions.saveIfChanged()
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+// FSEvents stream flags (FSEventStreamCreateFlags)
+const (
+	fseventsNoDefer    = 0x00000002
+	fseventsWatchRoot  = 0x00000004
+	fseventsFileEvents = 0x00000010
+)
+
+// FSEvents event flags (FSEventStreamEventFlags)
+const (
+	fseventMustScanSubDirs   = 0x00000001
+	fseventUserDropped       = 0x00000002
+	fseventKernelDropped     = 0x00000004
+	fseventEventIdsWrapped   = 0x00000008
+	fseventHistoryDone       = 0x00000010
+	fseventRootChanged       = 0x00000020
+	fseventItemCreated       = 0x00000100
+	fseventItemRemoved       = 0x00000200
+	fseventItemInodeMetaMod  = 0x00000400
+	fseventItemRenamed       = 0x00000800
+	fseventItemModified      = 0x00001000
+	fseventItemFinderInfoMod = 0x00002000
+	fseventItemChangeOwner   = 0x00004000
+	fseventItemXattrMod      = 0x00008000
+)
+
+// fseventsSinceNow starts a stream with changes from now on
+const fseventsSinceNow = ^uint64(0)
+
+// fseventsLatency is how long FSEvents coalesces changes before reporting
+// them, in seconds. The watcher debounces them further.
+const fseventsLatency = 0.05
+
+// fsevent is one change FSEvents reported
+type fsevent struct {
+	path  string
+	flags uint32
+	id    uint64
+}
+
+// lost reports whether FSEvents dropped changes under the event's path, or
+// can no longer vouch for its event IDs
+func (ev fsevent) lost() bool {
+	return ev.flags&(fseventMustScanSubDirs|fseventUserDropped|fseventKernelDropped|fseventEventIdsWrapped) != 0
+}
+
+// op turns an event into the fsnotify operation the watcher handles.
+// FSEvents coalesces what happened to a path, so whether the path still
+// exists decides between a change and a removal.
+func (ev fsevent) op() (fsnotify.Op, bool) {
+	_, err := os.Lstat(ev.path)
+	exists := err == nil
+
+	switch {
+	case ev.flags&fseventItemRenamed != 0 && !exists:
+		return fsnotify.Rename, true
+	case !exists:
+		if ev.flags&(fseventItemRemoved|fseventItemCreated) != 0 {
+			return fsnotify.Remove, true
+		}
+		return 0, false
+	case ev.flags&(fseventItemCreated|fseventItemRenamed) != 0:
+		return fsnotify.Create, true
+	case ev.flags&fseventItemModified != 0:
+		return fsnotify.Write, true
+	case ev.flags&fseventItemRemoved != 0:
+		// Removed and put back, as by a safe save
+		return fsnotify.Create, true
+	case ev.flags&(fseventItemInodeMetaMod|fseventItemFinderInfoMod|fseventItemChangeOwner|fseventItemXattrMod) != 0:
+		return fsnotify.Chmod, true
+	}
+	return 0, false
+}
+
+// fseventsPosition is where a folder's FSEvents stream left off
+type fseventsPosition struct {
+	Device  string `json:"device"` // Volume UUID; event IDs only hold on the same volume
+	EventID uint64 `json:"event_id"`
+}
+
+// fseventsPositions remembers the last event seen for each folder across
+// restarts, in ~/.mac-profile-sync/fsevents.json
+type fseventsPositions struct {
+	mu        sync.Mutex
+	path      string
+	positions map[string]fseventsPosition // Folder path -> position
+	dirty     bool
+}
+
+func newFSEventsPositions() *fseventsPositions {
+	p := &fseventsPositions{
+		path:      filepath.Join(config.ConfigDir(), "fsevents.json"),
+		positions: make(map[string]fseventsPosition),
+	}
+	if err := p.load(); err != nil {
+		log.Debug().Err(err).Msg("Failed to load FSEvents positions")
+	}
+	return p
+}
+
+func (p *fseventsPositions) load() error {
+	data, err := os.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read FSEvents positions: %w", err)
+	}
+
+	positions := make(map[string]fseventsPosition)
+	if err := json.Unmarshal(data, &positions); err != nil {
+		return fmt.Errorf("failed to parse FSEvents positions: %w", err)
+	}
+	p.positions = positions
+	return nil
+}
+
+func (p *fseventsPositions) get(folderPath string) (fseventsPosition, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pos, ok := p.positions[folderPath]
+	return pos, ok
+}
+
+func (p *fseventsPositions) set(folderPath string, pos fseventsPosition) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.positions[folderPath] != pos {
+		p.positions[folderPath] = pos
+		p.dirty = true
+	}
+}
+
+// forget drops a folder's position, when its events can't be trusted
+func (p *fseventsPositions) forget(folderPath string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.positions[folderPath]; ok {
+		delete(p.positions, folderPath)
+		p.dirty = true
+	}
+}
+
+// saveIfChanged writes the positions if any moved since the last save
+func (p *fseventsPositions) saveIfChanged() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.dirty {
+		return
+	}
+	data, err := json.Marshal(p.positions)
+	if err != nil {
+		return
+	}
+	if err := os.WriteFile(p.path, data, 0644); err != nil {
+		log.Debug().Err(err).Msg("Failed to save FSEvents positions")
+		return
+	}
+	p.dirty = false
+}
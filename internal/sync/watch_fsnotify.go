@@ -0,0 +1,117 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// fsnotifyBackend watches folders with fsnotify, which needs a watch on
+// every directory under them
+type fsnotifyBackend struct {
+	w       *Watcher
+	watcher *fsnotify.Watcher
+}
+
+func newFsnotifyBackend(w *Watcher) (*fsnotifyBackend, error) {
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &fsnotifyBackend{w: w, watcher: fsWatcher}
+	go b.processEvents()
+	return b, nil
+}
+
+// addFolder watches every directory under a folder that isn't ignored or
+// outside its sparse selection
+func (b *fsnotifyBackend) addFolder(path string) error {
+	folderCfg := b.w.cfg.GetFolder(path)
+
+	return filepath.Walk(path, func(walkPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil // Skip errors
+		}
+
+		// Skip ignored paths
+		rel, _ := filepath.Rel(path, walkPath)
+		if b.w.cfg.ShouldIgnore(walkPath) || b.w.ignores.Ignored(path, rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Skip subfolders outside a sparse selection
+		if folderCfg != nil && info.IsDir() && walkPath != path && !folderCfg.IncludesDir(rel) {
+			return filepath.SkipDir
+		}
+
+		// Watch directories
+		if info.IsDir() {
+			if err := b.watcher.Add(walkPath); err != nil {
+				log.Warn().Err(err).Str("path", walkPath).Msg("Failed to add watch")
+			}
+		}
+
+		return nil
+	})
+}
+
+// removeFolder removes the watches under a folder
+func (b *fsnotifyBackend) removeFolder(path string) {
+	_ = filepath.Walk(path, func(walkPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			_ = b.watcher.Remove(walkPath)
+		}
+		return nil
+	})
+}
+
+// addTree watches dir and the directories under it that aren't ignored
+func (b *fsnotifyBackend) addTree(folderPath, dir string) {
+	_ = filepath.Walk(dir, func(walkPath string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(folderPath, walkPath)
+		if walkPath != dir && (b.w.cfg.ShouldIgnore(walkPath) || b.w.ignores.Ignored(folderPath, rel)) {
+			return filepath.SkipDir
+		}
+		if err := b.watcher.Add(walkPath); err != nil {
+			log.Warn().Err(err).Str("path", walkPath).Msg("Failed to add watch")
+		}
+		return nil
+	})
+}
+
+func (b *fsnotifyBackend) close() error {
+	return b.watcher.Close()
+}
+
+func (b *fsnotifyBackend) processEvents() {
+	for {
+		select {
+		case <-b.w.done:
+			return
+
+		case event, ok := <-b.watcher.Events:
+			if !ok {
+				return
+			}
+			b.w.handleFsEvent(event)
+
+		case err, ok := <-b.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Error().Err(err).Msg("Watcher error")
+		}
+	}
+}
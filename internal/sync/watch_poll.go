@@ -0,0 +1,195 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+)
+
+// pollEntry is what a scan saw of one path
+type pollEntry struct {
+	size    int64
+	modTime time.Time
+	mode    os.FileMode
+}
+
+func (e pollEntry) same(other pollEntry) bool {
+	return e.size == other.size && e.modTime.Equal(other.modTime) && e.mode == other.mode
+}
+
+// pollBackend notices changes by scanning each folder every
+// sync.poll_interval and comparing it with the last scan. It is slower than
+// file events, but sees changes other machines make on network volumes,
+// which file events miss.
+type pollBackend struct {
+	w *Watcher
+
+	mu      sync.Mutex
+	folders map[string]chan struct{} // Folder path -> closed to stop polling it
+}
+
+func newPollBackend(w *Watcher) *pollBackend {
+	return &pollBackend{w: w, folders: make(map[string]chan struct{})}
+}
+
+func (b *pollBackend) addFolder(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.folders[path]; ok {
+		return nil
+	}
+	stop := make(chan struct{})
+	b.folders[path] = stop
+	go b.pollLoop(path, stop)
+	return nil
+}
+
+func (b *pollBackend) removeFolder(path string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if stop, ok := b.folders[path]; ok {
+		close(stop)
+		delete(b.folders, path)
+	}
+}
+
+// addTree does nothing; the next scan covers new directories
+func (b *pollBackend) addTree(folderPath, dir string) {}
+
+func (b *pollBackend) close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for path, stop := range b.folders {
+		close(stop)
+		delete(b.folders, path)
+	}
+	return nil
+}
+
+// pollLoop scans a folder until it is removed, reporting what changed
+// between scans
+func (b *pollBackend) pollLoop(folderPath string, stop chan struct{}) {
+	interval := b.w.cfg.GetPollInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last, _ := b.scan(folderPath)
+	for {
+		select {
+		case <-b.w.done:
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+			// See rootPresent: a missing root isn't polled
+			if !rootPresent(folderPath) {
+				continue
+			}
+			current, unreadable := b.scan(folderPath)
+			keepUnreadable(last, current, unreadable)
+			b.report(last, current)
+			last = current
+		}
+	}
+}
+
+// scan records every path under a folder that isn't ignored or outside its
+// sparse selection, and the paths it couldn't read
+func (b *pollBackend) scan(folderPath string) (map[string]pollEntry, []string) {
+	folderCfg := b.w.cfg.GetFolder(folderPath)
+	entries := make(map[string]pollEntry)
+	var unreadable []string
+
+	_ = filepath.Walk(folderPath, func(walkPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			unreadable = append(unreadable, walkPath)
+			return nil // Skip errors
+		}
+		if walkPath == folderPath {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(folderPath, walkPath)
+		if b.w.cfg.ShouldIgnore(walkPath) || b.w.ignores.Ignored(folderPath, rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if folderCfg != nil && info.IsDir() && !folderCfg.IncludesDir(rel) {
+			return filepath.SkipDir
+		}
+
+		entries[walkPath] = pollEntry{size: info.Size(), modTime: info.ModTime(), mode: info.Mode()}
+		return nil
+	})
+	return entries, unreadable
+}
+
+// keepUnreadable carries the last scan's entries at and under paths the
+// current scan couldn't read into it, so a network volume that stops
+// answering for a moment doesn't look like its files were deleted
+func keepUnreadable(last, current map[string]pollEntry, unreadable []string) {
+	if len(unreadable) == 0 {
+		return
+	}
+	for path, entry := range last {
+		for _, dir := range unreadable {
+			if fileutil.IsWithin(path, dir) {
+				current[path] = entry
+				break
+			}
+		}
+	}
+}
+
+// report hands the differences between two scans to the watcher: removals
+// deepest first, then additions and changes outermost first
+func (b *pollBackend) report(last, current map[string]pollEntry) {
+	var removed, changed []string
+	for path := range last {
+		if _, ok := current[path]; !ok {
+			removed = append(removed, path)
+		}
+	}
+	for path, entry := range current {
+		if prev, ok := last[path]; !ok || !prev.same(entry) {
+			changed = append(changed, path)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(removed)))
+	sort.Strings(changed)
+
+	for _, path := range removed {
+		b.w.handleFsEvent(fsnotify.Event{Name: path, Op: fsnotify.Remove})
+	}
+	for _, path := range changed {
+		entry := current[path]
+		prev, existed := last[path]
+
+		var op fsnotify.Op
+		switch {
+		case !existed || prev.mode.Type() != entry.mode.Type():
+			op = fsnotify.Create
+		case entry.mode.IsDir():
+			// A directory's mod time moves with its entries, reported on their own
+			if prev.mode == entry.mode {
+				continue
+			}
+			op = fsnotify.Chmod
+		case prev.size != entry.size || !prev.modTime.Equal(entry.modTime):
+			op = fsnotify.Write
+		default:
+			op = fsnotify.Chmod
+		}
+		b.w.handleFsEvent(fsnotify.Event{Name: path, Op: op})
+	}
+}
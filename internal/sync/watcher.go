@@ -8,6 +8,7 @@ import (
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
 	"github.com/rs/zerolog/log"
 )
 
@@ -28,8 +29,16 @@ const (
 	EventModify
 	EventDelete
 	EventRename
+	EventAttrib // Permissions, flags or extended attributes changed
 )
 
+// eventDebounce is how long changes settle before they are sent
+const eventDebounce = 100 * time.Millisecond
+
+// attribDebounce is how long attribute changes settle before they are sent.
+// Tagging or locking a file in Finder sets several attributes in a row.
+const attribDebounce = 500 * time.Millisecond
+
 func (e EventType) String() string {
 	switch e {
 	case EventCreate:
@@ -40,6 +49,8 @@ func (e EventType) String() string {
 		return "delete"
 	case EventRename:
 		return "rename"
+	case EventAttrib:
+		return "attrib"
 	default:
 		return "unknown"
 	}
@@ -48,33 +59,71 @@ func (e EventType) String() string {
 // Watcher monitors folders for file changes
 type Watcher struct {
 	cfg     *config.Config
-	watcher *fsnotify.Watcher
+	ignores *IgnoreRules
+	native  watchBackend // File events: FSEvents on macOS, fsnotify elsewhere
+	poll    *pollBackend
 	events  chan FileEvent
 	done    chan struct{}
 	mu      sync.RWMutex
-	folders map[string]bool // Active watched folders
+	folders map[string]watchBackend // Active watched folders -> backend watching each
+
+	// Called with a folder whose changes the backend lost track of
+	missed func(folderPath string)
 
 	// Debouncing
 	pendingEvents map[string]*FileEvent
 	debounceTimer *time.Timer
 	debounceMu    sync.Mutex
+
+	// Attribute changes are debounced on their own, longer timer
+	pendingAttribs map[string]*FileEvent
+	attribTimer    *time.Timer
+
+	// Files written continuously are held until their writes stop
+	churn *churnTracker
+
+	// New and changed files are held until they stop changing
+	quiet *quiescence
 }
 
-// NewWatcher creates a new file watcher
-func NewWatcher(cfg *config.Config) (*Watcher, error) {
-	fsWatcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return nil, err
-	}
+// watchBackend is how a Watcher learns of changes under its folders. It
+// hands each one to the watcher's handleFsEvent.
+type watchBackend interface {
+	// addFolder starts watching a folder and everything under it
+	addFolder(folderPath string) error
+	removeFolder(folderPath string)
+	// addTree watches a directory just created in a watched folder
+	addTree(folderPath, dir string)
+	close() error
+}
+
+// historyBackend is a watchBackend that remembers where it left off, so it
+// can tell what changed under a folder while the daemon was stopped
+type historyBackend interface {
+	changedSince(folderPath string) ([]string, bool)
+}
 
-	return &Watcher{
+// NewWatcher creates a new file watcher
+func NewWatcher(cfg *config.Config, ignores *IgnoreRules) (*Watcher, error) {
+	w := &Watcher{
 		cfg:           cfg,
-		watcher:       fsWatcher,
+		ignores:       ignores,
 		events:        make(chan FileEvent, 100),
 		done:          make(chan struct{}),
-		folders:       make(map[string]bool),
+		folders:       make(map[string]watchBackend),
 		pendingEvents: make(map[string]*FileEvent),
-	}, nil
+
+		pendingAttribs: make(map[string]*FileEvent),
+	}
+	native, err := newWatchBackend(w)
+	if err != nil {
+		return nil, err
+	}
+	w.native = native
+	w.poll = newPollBackend(w)
+	w.churn = newChurnTracker(cfg, w.emit)
+	w.quiet = newQuiescence(cfg, w.emit)
+	return w, nil
 }
 
 // Events returns the channel of file events
@@ -82,27 +131,32 @@ func (w *Watcher) Events() <-chan FileEvent {
 	return w.events
 }
 
+// SetMissedHandler sets what is called with a folder whose changes the
+// watcher lost track of, such as when the system dropped events
+func (w *Watcher) SetMissedHandler(handler func(folderPath string)) {
+	w.missed = handler
+}
+
 // Start begins watching configured folders
 func (w *Watcher) Start() error {
 	// Watch enabled folders
 	for _, folder := range w.cfg.Folders {
-		if folder.Enabled {
+		// Folders that aren't there are watched once they are back
+		if folder.Enabled && fileutil.IsDir(folder.Path) {
 			if err := w.AddFolder(folder.Path); err != nil {
 				log.Error().Err(err).Str("path", folder.Path).Msg("Failed to watch folder")
 			}
 		}
 	}
 
-	// Start event processing loop
-	go w.processEvents()
-
 	return nil
 }
 
 // Stop stops the watcher
 func (w *Watcher) Stop() {
 	close(w.done)
-	_ = w.watcher.Close()
+	_ = w.native.close()
+	_ = w.poll.close()
 }
 
 // AddFolder adds a folder to watch (recursively)
@@ -111,40 +165,23 @@ func (w *Watcher) AddFolder(path string) error {
 	defer w.mu.Unlock()
 
 	// Check if already watching
-	if w.folders[path] {
+	if _, ok := w.folders[path]; ok {
 		return nil
 	}
-
-	// Walk the directory tree and add all directories
-	err := filepath.Walk(path, func(walkPath string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil // Skip errors
-		}
-
-		// Skip ignored paths
-		if w.cfg.ShouldIgnore(walkPath) {
-			if info.IsDir() {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-
-		// Watch directories
-		if info.IsDir() {
-			if err := w.watcher.Add(walkPath); err != nil {
-				log.Warn().Err(err).Str("path", walkPath).Msg("Failed to add watch")
-			}
-		}
-
+	// A watch would keep the drive busy so it can't be ejected; the engine
+	// rescans the folder while the drive is mounted instead
+	if folderCfg := w.cfg.GetFolder(path); folderCfg != nil && folderCfg.IsPortable() {
+		log.Info().Str("path", path).Msg("Not watching portable folder")
 		return nil
-	})
+	}
 
-	if err != nil {
+	backend := w.backendFor(path)
+	if err := backend.addFolder(path); err != nil {
 		return err
 	}
 
-	w.folders[path] = true
-	log.Info().Str("path", path).Msg("Watching folder")
+	w.folders[path] = backend
+	log.Info().Str("path", path).Bool("polling", backend == watchBackend(w.poll)).Msg("Watching folder")
 
 	return nil
 }
@@ -154,20 +191,12 @@ func (w *Watcher) RemoveFolder(path string) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	if !w.folders[path] {
+	backend, ok := w.folders[path]
+	if !ok {
 		return nil
 	}
 
-	// Remove all watches under this path
-	_ = filepath.Walk(path, func(walkPath string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil
-		}
-		if info.IsDir() {
-			_ = w.watcher.Remove(walkPath)
-		}
-		return nil
-	})
+	backend.removeFolder(path)
 
 	delete(w.folders, path)
 	log.Info().Str("path", path).Msg("Stopped watching folder")
@@ -175,24 +204,55 @@ func (w *Watcher) RemoveFolder(path string) error {
 	return nil
 }
 
-func (w *Watcher) processEvents() {
-	for {
-		select {
-		case <-w.done:
-			return
+// ChangedSince returns the paths under a folder that changed while the
+// daemon was stopped, if the watcher can tell. Only call it before the
+// folder is watched.
+func (w *Watcher) ChangedSince(folderPath string) ([]string, bool) {
+	if w.backendFor(folderPath) != w.native {
+		return nil, false
+	}
+	if history, ok := w.native.(historyBackend); ok {
+		return history.changedSince(folderPath)
+	}
+	return nil, false
+}
 
-		case event, ok := <-w.watcher.Events:
-			if !ok {
-				return
-			}
-			w.handleFsEvent(event)
+// backendFor picks how a folder is watched from its watch_mode. In auto
+// mode, folders on network volumes are polled, since file events miss
+// changes other machines make there.
+func (w *Watcher) backendFor(folderPath string) watchBackend {
+	mode := config.WatchAuto
+	if folderCfg := w.cfg.GetFolder(folderPath); folderCfg != nil {
+		mode = folderCfg.WatchMode()
+	}
 
-		case err, ok := <-w.watcher.Errors:
-			if !ok {
-				return
-			}
-			log.Error().Err(err).Msg("Watcher error")
-		}
+	switch mode {
+	case config.WatchPoll, config.WatchPortable:
+		// Portable folders aren't watched, so they have no file event history
+		return w.poll
+	case config.WatchFSEvents:
+		return w.native
+	}
+	if fileutil.IsNetworkVolume(folderPath) {
+		return w.poll
+	}
+	return w.native
+}
+
+// backendOf returns the backend watching a folder
+func (w *Watcher) backendOf(folderPath string) watchBackend {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if backend, ok := w.folders[folderPath]; ok {
+		return backend
+	}
+	return w.native
+}
+
+// lostEvents reports a folder whose changes the backend lost track of
+func (w *Watcher) lostEvents(folderPath string) {
+	if w.missed != nil {
+		w.missed(folderPath)
 	}
 }
 
@@ -204,7 +264,20 @@ func (w *Watcher) handleFsEvent(event fsnotify.Event) {
 
 	// Determine folder path and relative path
 	folderPath, relPath := w.resolvePaths(event.Name)
-	if folderPath == "" {
+
+	// A change to a database's journal files is a change to the database
+	if db := databaseOf(relPath); db != "" && folderPath != "" && w.cfg.Sync.ProtectDatabases {
+		relPath = db
+		event = fsnotify.Event{Name: filepath.Join(folderPath, db), Op: fsnotify.Write}
+	}
+
+	if folderPath == "" || (relPath != IgnoreFileName && w.ignores.Ignored(folderPath, relPath)) {
+		return
+	}
+
+	// Skip paths outside a sparse selection
+	folderCfg := w.cfg.GetFolder(folderPath)
+	if folderCfg != nil && !folderCfg.IncludesPath(relPath) {
 		return
 	}
 
@@ -212,9 +285,11 @@ func (w *Watcher) handleFsEvent(event fsnotify.Event) {
 	switch {
 	case event.Op&fsnotify.Create == fsnotify.Create:
 		eventType = EventCreate
-		// If a new directory is created, add it to the watch
+		// If a new directory is created (or moved in), watch it and everything under it
 		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
-			_ = w.watcher.Add(event.Name)
+			if folderCfg == nil || folderCfg.IncludesDir(relPath) {
+				w.backendOf(folderPath).addTree(folderPath, event.Name)
+			}
 		}
 	case event.Op&fsnotify.Write == fsnotify.Write:
 		eventType = EventModify
@@ -222,6 +297,8 @@ func (w *Watcher) handleFsEvent(event fsnotify.Event) {
 		eventType = EventDelete
 	case event.Op&fsnotify.Rename == fsnotify.Rename:
 		eventType = EventRename
+	case event.Op&fsnotify.Chmod == fsnotify.Chmod:
+		eventType = EventAttrib
 	default:
 		return
 	}
@@ -235,6 +312,10 @@ func (w *Watcher) handleFsEvent(event fsnotify.Event) {
 	}
 
 	// Debounce events
+	if eventType == EventAttrib {
+		w.debounceAttrib(fileEvent)
+		return
+	}
 	w.debounceEvent(fileEvent)
 }
 
@@ -242,28 +323,44 @@ func (w *Watcher) resolvePaths(path string) (folderPath, relPath string) {
 	w.mu.RLock()
 	defer w.mu.RUnlock()
 
+	// Prefer the innermost folder; dotfiles like .zshrc are inside it too
 	for folder := range w.folders {
-		if rel, err := filepath.Rel(folder, path); err == nil && len(rel) > 0 && rel[0] != '.' {
-			return folder, rel
+		if rel, ok := fileutil.RelWithin(folder, path); ok && rel != "." && len(folder) > len(folderPath) {
+			folderPath, relPath = folder, fileutil.NormalizePath(rel)
 		}
 	}
-
-	return "", ""
+	return folderPath, relPath
 }
 
 func (w *Watcher) debounceEvent(event *FileEvent) {
 	w.debounceMu.Lock()
 	defer w.debounceMu.Unlock()
 
-	// Store the event, newer events override older ones for the same path
+	// Busy files are sent once their writes stop; other changes end the hold
+	if event.Type == EventModify {
+		if w.churn.hold(event) {
+			delete(w.pendingEvents, event.Path)
+			w.quiet.drop(event.Path)
+			return
+		}
+	} else {
+		w.churn.drop(event.Path)
+	}
+	if event.Type == EventDelete || event.Type == EventRename {
+		w.quiet.drop(event.Path)
+	}
+
+	// Store the event, newer events override older ones for the same path.
+	// Content changes carry attributes too, so a pending attribute change is dropped.
 	w.pendingEvents[event.Path] = event
+	delete(w.pendingAttribs, event.Path)
 
 	// Reset or start the debounce timer
 	if w.debounceTimer != nil {
 		w.debounceTimer.Stop()
 	}
 
-	w.debounceTimer = time.AfterFunc(100*time.Millisecond, w.flushPendingEvents)
+	w.debounceTimer = time.AfterFunc(eventDebounce, w.flushPendingEvents)
 }
 
 func (w *Watcher) flushPendingEvents() {
@@ -272,13 +369,73 @@ func (w *Watcher) flushPendingEvents() {
 	w.pendingEvents = make(map[string]*FileEvent)
 	w.debounceMu.Unlock()
 
+	// Old paths of renames go first so their new paths can be paired with them
+	ordered := make([]*FileEvent, 0, len(events))
+	renamed := false
+	for _, event := range events {
+		if event.Type == EventRename || event.Type == EventDelete {
+			ordered = append(ordered, event)
+			renamed = renamed || event.Type == EventRename
+		}
+	}
+	for _, event := range events {
+		if event.Type == EventRename || event.Type == EventDelete {
+			continue
+		}
+		// A renamed file arrives whole, and must reach the engine while its
+		// old path waits to be paired with it
+		if !renamed && w.quiet.hold(event) {
+			continue
+		}
+		ordered = append(ordered, event)
+	}
+
+	for _, event := range ordered {
+		if !w.emit(*event) {
+			return
+		}
+	}
+}
+
+// emit hands an event to the engine, reporting false once the watcher is
+// stopped
+func (w *Watcher) emit(event FileEvent) bool {
+	select {
+	case w.events <- event:
+	case <-w.done:
+		return false
+	default:
+		log.Warn().Str("path", event.Path).Msg("Event channel full, dropping event")
+	}
+	return true
+}
+
+// debounceAttrib queues an attribute change, unless the path already has a
+// content change pending
+func (w *Watcher) debounceAttrib(event *FileEvent) {
+	w.debounceMu.Lock()
+	defer w.debounceMu.Unlock()
+
+	if _, ok := w.pendingEvents[event.Path]; ok {
+		return
+	}
+	w.pendingAttribs[event.Path] = event
+
+	if w.attribTimer != nil {
+		w.attribTimer.Stop()
+	}
+	w.attribTimer = time.AfterFunc(attribDebounce, w.flushPendingAttribs)
+}
+
+func (w *Watcher) flushPendingAttribs() {
+	w.debounceMu.Lock()
+	events := w.pendingAttribs
+	w.pendingAttribs = make(map[string]*FileEvent)
+	w.debounceMu.Unlock()
+
 	for _, event := range events {
-		select {
-		case w.events <- *event:
-		case <-w.done:
+		if !w.emit(*event) {
 			return
-		default:
-			log.Warn().Str("path", event.Path).Msg("Event channel full, dropping event")
 		}
 	}
 }
@@ -287,7 +444,8 @@ func (w *Watcher) flushPendingEvents() {
 func (w *Watcher) IsWatching(path string) bool {
 	w.mu.RLock()
 	defer w.mu.RUnlock()
-	return w.folders[path]
+	_, ok := w.folders[path]
+	return ok
 }
 
 // WatchedFolders returns a list of watched folder paths
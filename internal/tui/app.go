@@ -19,9 +19,10 @@ const (
 	ViewFolders
 	ViewPeers
 	ViewSettings
+	ViewConflicts
 )
 
-const numViews = 4
+const numViews = 5
 
 // App is the main TUI application model
 type App struct {
@@ -34,6 +35,7 @@ type App struct {
 	folders   *FoldersModel
 	peers     *PeersModel
 	settings  *SettingsModel
+	conflicts *ConflictsModel
 
 	// State
 	currentView View
@@ -43,9 +45,8 @@ type App struct {
 	quitting    bool
 
 	// Update channels
-	peerUpdates     chan []*discovery.Peer
-	activityUpdates chan []*sync.SyncActivity
-	conflictUpdates chan []*sync.Conflict
+	peerUpdates chan []*discovery.Peer
+	events      <-chan sync.Event // Engine activity and conflict events
 }
 
 // NewApp creates a new TUI application
@@ -54,18 +55,32 @@ func NewApp(cfg *config.Config, disc *discovery.Discovery, engine *sync.Engine)
 	s.Spinner = spinner.Dot
 
 	app := &App{
-		cfg:             cfg,
-		discovery:       disc,
-		engine:          engine,
-		dashboard:       NewDashboardModel(cfg),
-		folders:         NewFoldersModel(cfg),
-		peers:           NewPeersModel(cfg, disc),
-		settings:        NewSettingsModel(cfg),
-		currentView:     ViewDashboard,
-		spinner:         s,
-		peerUpdates:     make(chan []*discovery.Peer, 10),
-		activityUpdates: make(chan []*sync.SyncActivity, 10),
-		conflictUpdates: make(chan []*sync.Conflict, 10),
+		cfg:         cfg,
+		discovery:   disc,
+		engine:      engine,
+		dashboard:   NewDashboardModel(cfg),
+		folders:     NewFoldersModel(cfg),
+		peers:       NewPeersModel(cfg, disc),
+		settings:    NewSettingsModel(cfg),
+		conflicts:   NewConflictsModel(),
+		currentView: ViewDashboard,
+		spinner:     s,
+		peerUpdates: make(chan []*discovery.Peer, 10),
+	}
+
+	if engine != nil {
+		app.folders.engine = engine
+		app.conflicts.SetResolveCallback(func(id string, resolution sync.ConflictResolution) error {
+			if err := engine.ResolveConflict(id, resolution); err != nil {
+				return err
+			}
+			// Resolving publishes no event, so the dashboard's count is
+			// brought up to date here
+			app.dashboard.SetConflicts(engine.GetConflicts())
+			return nil
+		})
+		app.conflicts.SetConflicts(engine.GetConflicts())
+		app.events, _ = engine.Events().Subscribe(64, sync.EventActivity, sync.EventConflict)
 	}
 
 	return app
@@ -98,8 +113,16 @@ func (a *App) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		a.peers.height = msg.Height
 		a.settings.width = msg.Width
 		a.settings.height = msg.Height
+		a.conflicts.width = msg.Width
+		a.conflicts.height = msg.Height
 
 	case tea.KeyMsg:
+		// A view taking text input gets every key but ctrl+c
+		if msg.String() != "ctrl+c" && editingView(a.currentView, a.folders, a.peers, a.settings) {
+			cmds = append(cmds, a.updateCurrentView(msg))
+			break
+		}
+
 		switch msg.String() {
 		case "q", "ctrl+c":
 			a.quitting = true
@@ -126,6 +149,9 @@ func (a *App) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case "4":
 			a.currentView = ViewSettings
 			a.refreshCurrentView()
+		case "5":
+			a.currentView = ViewConflicts
+			a.refreshCurrentView()
 
 		default:
 			// Forward to current view
@@ -144,12 +170,16 @@ func (a *App) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 	case peerUpdateMsg:
 		a.dashboard.SetPeers(msg.peers)
-
-	case activityUpdateMsg:
-		a.dashboard.SetActivities(msg.activities)
-
-	case conflictUpdateMsg:
-		a.dashboard.SetConflicts(msg.conflicts)
+		cmds = append(cmds, a.listenForUpdates())
+
+	case engineEventMsg:
+		switch msg.event.Kind {
+		case sync.EventActivity:
+			a.dashboard.SetActivities(a.engine.GetActivities(10))
+		case sync.EventConflict:
+			a.refreshConflicts()
+		}
+		cmds = append(cmds, a.listenForUpdates())
 
 	case SyncToggleMsg:
 		// Start or stop sync engine
@@ -187,6 +217,8 @@ func (a *App) View() string {
 		content = a.peers.View()
 	case ViewSettings:
 		content = a.settings.View()
+	case ViewConflicts:
+		content = a.conflicts.View()
 	}
 
 	return fmt.Sprintf("%s\n%s", tabs, content)
@@ -202,11 +234,17 @@ func (a *App) renderTabs() string {
 		{"Folders", "2", ViewFolders},
 		{"Peers", "3", ViewPeers},
 		{"Settings", "4", ViewSettings},
+		{"Conflicts", "5", ViewConflicts},
 	}
 
 	var rendered []string
 	for _, t := range tabs {
-		rendered = append(rendered, TabWithKey(t.label, t.key, a.currentView == t.view))
+		label := t.label
+		// Badge the tab so conflicts waiting on a decision aren't missed
+		if t.view == ViewConflicts && a.conflicts.HasConflicts() {
+			label = fmt.Sprintf("%s (%d)", label, len(a.conflicts.conflicts))
+		}
+		rendered = append(rendered, TabWithKey(label, t.key, a.currentView == t.view))
 	}
 
 	return lipglossJoinHorizontal(rendered...) + "  " + mutedStyle.Render("Tab: switch  q: quit")
@@ -222,7 +260,20 @@ func (a *App) refreshCurrentView() {
 		a.peers.Refresh()
 	case ViewSettings:
 		a.settings.Refresh()
+	case ViewConflicts:
+		a.refreshConflicts()
+	}
+}
+
+// refreshConflicts reloads the unresolved conflicts into the dashboard and
+// the Conflicts view
+func (a *App) refreshConflicts() {
+	if a.engine == nil {
+		return
 	}
+	conflicts := a.engine.GetConflicts()
+	a.dashboard.SetConflicts(conflicts)
+	a.conflicts.SetConflicts(conflicts)
 }
 
 func (a *App) updateCurrentView(msg tea.Msg) tea.Cmd {
@@ -236,6 +287,8 @@ func (a *App) updateCurrentView(msg tea.Msg) tea.Cmd {
 		a.peers, cmd = a.peers.Update(msg)
 	case ViewSettings:
 		a.settings, cmd = a.settings.Update(msg)
+	case ViewConflicts:
+		a.conflicts, cmd = a.conflicts.Update(msg)
 	}
 	return cmd
 }
@@ -247,19 +300,17 @@ func (a *App) refreshData() {
 		a.dashboard.SetPeers(peers)
 		a.peers.SetDiscoveredPeers(peers)
 	}
-
-	// Update activities
-	if a.engine != nil {
-		activities := a.engine.GetActivities(10)
-		a.dashboard.SetActivities(activities)
+	if a.currentView == ViewPeers {
+		a.peers.Refresh()
 	}
+	// Conflicts resolved elsewhere, e.g. with approve, drop out of the list
+	a.refreshConflicts()
 }
 
 // Message types
 type tickMsg time.Time
 type peerUpdateMsg struct{ peers []*discovery.Peer }
-type activityUpdateMsg struct{ activities []*sync.SyncActivity }
-type conflictUpdateMsg struct{ conflicts []*sync.Conflict }
+type engineEventMsg struct{ event sync.Event }
 
 func (a *App) tickCmd() tea.Cmd {
 	return tea.Tick(2*time.Second, func(t time.Time) tea.Msg {
@@ -272,10 +323,8 @@ func (a *App) listenForUpdates() tea.Cmd {
 		select {
 		case peers := <-a.peerUpdates:
 			return peerUpdateMsg{peers}
-		case activities := <-a.activityUpdates:
-			return activityUpdateMsg{activities}
-		case conflicts := <-a.conflictUpdates:
-			return conflictUpdateMsg{conflicts}
+		case event := <-a.events:
+			return engineEventMsg{event}
 		}
 	}
 }
@@ -288,22 +337,6 @@ func (a *App) NotifyPeerUpdate(peers []*discovery.Peer) {
 	}
 }
 
-// NotifyActivityUpdate sends an activity update notification
-func (a *App) NotifyActivityUpdate(activities []*sync.SyncActivity) {
-	select {
-	case a.activityUpdates <- activities:
-	default:
-	}
-}
-
-// NotifyConflictUpdate sends a conflict update notification
-func (a *App) NotifyConflictUpdate(conflicts []*sync.Conflict) {
-	select {
-	case a.conflictUpdates <- conflicts:
-	default:
-	}
-}
-
 // lipglossJoinHorizontal joins strings horizontally with a space
 func lipglossJoinHorizontal(strs ...string) string {
 	result := ""
@@ -316,6 +349,19 @@ func lipglossJoinHorizontal(strs ...string) string {
 	return result
 }
 
+// editingView reports whether the current view is taking text input
+func editingView(view View, folders *FoldersModel, peers *PeersModel, settings *SettingsModel) bool {
+	switch view {
+	case ViewFolders:
+		return folders.addMode || folders.picker != nil
+	case ViewPeers:
+		return peers.addMode || peers.renaming != ""
+	case ViewSettings:
+		return settings.editMode
+	}
+	return false
+}
+
 // Run starts the TUI application
 func Run(cfg *config.Config, disc *discovery.Discovery, engine *sync.Engine) error {
 	app := NewApp(cfg, disc, engine)
@@ -333,6 +379,7 @@ type ConfigApp struct {
 	folders   *FoldersModel
 	peers     *PeersModel
 	settings  *SettingsModel
+	conflicts *ConflictsModel
 
 	// State
 	currentView View
@@ -343,14 +390,20 @@ type ConfigApp struct {
 
 // NewConfigApp creates a config-only TUI
 func NewConfigApp(cfg *config.Config) *ConfigApp {
-	return &ConfigApp{
+	app := &ConfigApp{
 		cfg:         cfg,
 		dashboard:   NewDashboardModel(cfg),
 		folders:     NewFoldersModel(cfg),
 		peers:       NewPeersModel(cfg, nil),
 		settings:    NewSettingsModel(cfg),
+		conflicts:   NewConflictsModel(),
 		currentView: ViewDashboard,
 	}
+
+	// The daemon applies decisions on its conflicts within a few seconds
+	app.conflicts.SetResolveCallback(sync.DecideConflict)
+	app.refreshConflicts()
+	return app
 }
 
 func (a *ConfigApp) Init() tea.Cmd {
@@ -375,8 +428,16 @@ func (a *ConfigApp) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		a.peers.height = msg.Height
 		a.settings.width = msg.Width
 		a.settings.height = msg.Height
+		a.conflicts.width = msg.Width
+		a.conflicts.height = msg.Height
 
 	case tea.KeyMsg:
+		// A view taking text input gets every key but ctrl+c
+		if msg.String() != "ctrl+c" && editingView(a.currentView, a.folders, a.peers, a.settings) {
+			cmds = append(cmds, a.updateCurrentView(msg))
+			break
+		}
+
 		switch msg.String() {
 		case "q", "ctrl+c":
 			a.quitting = true
@@ -402,12 +463,19 @@ func (a *ConfigApp) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case "4":
 			a.currentView = ViewSettings
 			a.refreshCurrentView()
+		case "5":
+			a.currentView = ViewConflicts
+			a.refreshCurrentView()
 
 		default:
 			cmds = append(cmds, a.updateCurrentView(msg))
 		}
 
 	case tickMsg:
+		if a.currentView == ViewPeers {
+			a.peers.Refresh()
+		}
+		a.refreshConflicts()
 		cmds = append(cmds, a.checkDaemonStatus(), a.tickCmd())
 
 	case DaemonStatusMsg:
@@ -415,8 +483,10 @@ func (a *ConfigApp) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 	case DaemonToggleMsg:
 		if msg.Start {
-			cmds = append(cmds, a.startDaemon())
+			a.dashboard.SetSafeMode(msg.SafeMode)
+			cmds = append(cmds, a.startDaemon(msg.SafeMode))
 		} else {
+			a.dashboard.SetSafeMode(false)
 			cmds = append(cmds, a.stopDaemon())
 		}
 	}
@@ -441,6 +511,8 @@ func (a *ConfigApp) View() string {
 		content = a.peers.View()
 	case ViewSettings:
 		content = a.settings.View()
+	case ViewConflicts:
+		content = a.conflicts.View()
 	}
 
 	return fmt.Sprintf("%s\n%s", tabs, content)
@@ -456,11 +528,16 @@ func (a *ConfigApp) renderTabs() string {
 		{"Folders", "2", ViewFolders},
 		{"Peers", "3", ViewPeers},
 		{"Settings", "4", ViewSettings},
+		{"Conflicts", "5", ViewConflicts},
 	}
 
 	var rendered []string
 	for _, t := range tabs {
-		rendered = append(rendered, TabWithKey(t.label, t.key, a.currentView == t.view))
+		label := t.label
+		if t.view == ViewConflicts && a.conflicts.HasConflicts() {
+			label = fmt.Sprintf("%s (%d)", label, len(a.conflicts.conflicts))
+		}
+		rendered = append(rendered, TabWithKey(label, t.key, a.currentView == t.view))
 	}
 
 	return lipglossJoinHorizontal(rendered...) + "  " + mutedStyle.Render("Tab: switch  q: quit")
@@ -476,7 +553,27 @@ func (a *ConfigApp) refreshCurrentView() {
 		a.peers.Refresh()
 	case ViewSettings:
 		a.settings.Refresh()
+	case ViewConflicts:
+		a.refreshConflicts()
+	}
+}
+
+// refreshConflicts reloads the daemon's unresolved conflicts into the
+// dashboard and the Conflicts view. Conflicts already decided here are left
+// out until the daemon has applied the decision.
+func (a *ConfigApp) refreshConflicts() {
+	saved, err := sync.LoadConflicts()
+	if err != nil {
+		return
+	}
+	conflicts := make([]*sync.Conflict, 0, len(saved))
+	for _, c := range saved {
+		if c.Decision == "" {
+			conflicts = append(conflicts, c)
+		}
 	}
+	a.dashboard.SetConflicts(conflicts)
+	a.conflicts.SetConflicts(conflicts)
 }
 
 func (a *ConfigApp) updateCurrentView(msg tea.Msg) tea.Cmd {
@@ -490,6 +587,8 @@ func (a *ConfigApp) updateCurrentView(msg tea.Msg) tea.Cmd {
 		a.peers, cmd = a.peers.Update(msg)
 	case ViewSettings:
 		a.settings, cmd = a.settings.Update(msg)
+	case ViewConflicts:
+		a.conflicts, cmd = a.conflicts.Update(msg)
 	}
 	return cmd
 }
@@ -3,6 +3,7 @@ package tui
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/jseidel/mac-profile-sync/internal/sync"
@@ -133,7 +134,7 @@ func (m *ConflictsModel) renderConflictDetail(conflict *sync.Conflict) string {
 	b.WriteString(normalItemStyle.Render("Local version:"))
 	b.WriteString("\n")
 	if conflict.LocalFile != nil {
-		b.WriteString(fmt.Sprintf("  Modified: %s\n", conflict.LocalFile.ModTime.Format("Jan 2, 2006 3:04 PM")))
+		b.WriteString(fmt.Sprintf("  Modified: %s\n", fileutil.FormatDateTime(conflict.LocalFile.ModTime)))
 		b.WriteString(fmt.Sprintf("  Size: %s\n", fileutil.FormatSize(conflict.LocalFile.Size)))
 	}
 	b.WriteString("\n")
@@ -145,10 +146,23 @@ func (m *ConflictsModel) renderConflictDetail(conflict *sync.Conflict) string {
 	}
 	b.WriteString(":\n")
 	if conflict.RemoteFile != nil {
-		b.WriteString(fmt.Sprintf("  Modified: %s\n", conflict.RemoteFile.ModTime.Format("Jan 2, 2006 3:04 PM")))
+		b.WriteString(fmt.Sprintf("  Modified: %s\n", fileutil.FormatDateTime(conflict.RemoteFile.ModTime)))
 		b.WriteString(fmt.Sprintf("  Size: %s\n", fileutil.FormatSize(conflict.RemoteFile.Size)))
 	}
 
+	// Both times are shown in one zone; say which is newer outright
+	if conflict.LocalFile != nil && conflict.RemoteFile != nil {
+		diff := conflict.RemoteFile.ModTime.Sub(conflict.LocalFile.ModTime)
+		switch {
+		case diff > 0:
+			b.WriteString(fmt.Sprintf("\nRemote version is newer by %s\n", diff.Round(time.Second)))
+		case diff < 0:
+			b.WriteString(fmt.Sprintf("\nLocal version is newer by %s\n", (-diff).Round(time.Second)))
+		default:
+			b.WriteString("\nBoth versions have the same modification time\n")
+		}
+	}
+
 	return conflictBoxStyle.Render(b.String())
 }
 
@@ -184,7 +198,7 @@ func (m *ConflictsModel) renderConflictList() string {
 
 func (m *ConflictsModel) renderHelpBar() string {
 	if len(m.conflicts) == 0 {
-		return HelpItem("←", "back")
+		return HelpItem("1", "dashboard")
 	}
 
 	items := []string{
@@ -219,9 +233,21 @@ func (m *ConflictsModel) resolveSelected(resolution sync.ConflictResolution) {
 	}
 }
 
-// SetConflicts updates the conflict list
+// SetConflicts updates the conflict list, keeping the selected conflict
+// selected while it is in the list
 func (m *ConflictsModel) SetConflicts(conflicts []*sync.Conflict) {
+	var selectedID string
+	if m.selected < len(m.conflicts) {
+		selectedID = m.conflicts[m.selected].ID
+	}
 	m.conflicts = conflicts
+
+	for i, conflict := range conflicts {
+		if conflict.ID == selectedID {
+			m.selected = i
+			return
+		}
+	}
 	if m.selected >= len(conflicts) {
 		m.selected = 0
 	}
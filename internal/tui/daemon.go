@@ -9,6 +9,7 @@ import (
 	"syscall"
 
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/jseidel/mac-profile-sync/internal/config"
 )
 
 // DaemonStatusMsg reports daemon running status
@@ -18,12 +19,21 @@ type DaemonStatusMsg struct {
 
 // DaemonToggleMsg requests to start/stop daemon
 type DaemonToggleMsg struct {
-	Start bool
+	Start    bool
+	SafeMode bool // Start in observe-only mode
 }
 
-// checkDaemonStatus checks if the daemon is running by checking if the port is in use
+// checkDaemonStatus checks if this user's daemon is running by its pid file,
+// falling back to checking if the port is in use for daemons that predate it
 func (a *ConfigApp) checkDaemonStatus() tea.Cmd {
 	return func() tea.Msg {
+		if config.DaemonPID() != 0 {
+			return DaemonStatusMsg{Running: true}
+		}
+		if _, err := os.Stat(config.PIDFile()); err == nil {
+			return DaemonStatusMsg{Running: false}
+		}
+
 		port := a.cfg.Network.Port
 		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
 		if err != nil {
@@ -35,7 +45,7 @@ func (a *ConfigApp) checkDaemonStatus() tea.Cmd {
 }
 
 // startDaemon starts the sync daemon in the background
-func (a *ConfigApp) startDaemon() tea.Cmd {
+func (a *ConfigApp) startDaemon(safeMode bool) tea.Cmd {
 	return func() tea.Msg {
 		// Get the path to our executable
 		exePath, err := os.Executable()
@@ -54,7 +64,11 @@ func (a *ConfigApp) startDaemon() tea.Cmd {
 		}
 
 		// Start daemon process
-		cmd := exec.Command(exePath, "-v")
+		args := []string{"-v"}
+		if safeMode {
+			args = append(args, "--safe-mode")
+		}
+		cmd := exec.Command(exePath, args...)
 		cmd.Stdout = logF
 		cmd.Stderr = logF
 		cmd.SysProcAttr = &syscall.SysProcAttr{
@@ -79,9 +93,14 @@ func (a *ConfigApp) startDaemon() tea.Cmd {
 // stopDaemon stops the sync daemon
 func (a *ConfigApp) stopDaemon() tea.Cmd {
 	return func() tea.Msg {
+		if pid := config.DaemonPID(); pid != 0 {
+			_ = syscall.Kill(pid, syscall.SIGTERM)
+			return DaemonStatusMsg{Running: false}
+		}
+
 		// Find and kill the daemon process
-		// Use pkill to find processes matching our name
-		cmd := exec.Command("pkill", "-f", "mac-profile-sync")
+		// Use pkill to find processes matching our name, run by this user only
+		cmd := exec.Command("pkill", "-U", strconv.Itoa(os.Getuid()), "-f", "mac-profile-sync")
 		_ = cmd.Run() // Ignore errors - might not be running
 
 		return DaemonStatusMsg{Running: false}
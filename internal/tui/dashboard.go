@@ -2,8 +2,9 @@ package tui
 
 import (
 	"fmt"
-	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
@@ -30,31 +31,86 @@ type DashboardModel struct {
 	selected      int
 	syncRunning   bool // Config setting
 	daemonRunning bool // Actual daemon process status
+	safeMode      bool // Daemon was started in observe-only mode
+	syncPaused    bool // All syncing paused with 'P' or the pause command
+	notice        string
+	confirmDelete string // Folder whose held deletions 'D' approves when pressed again
 }
 
 type folderInfo struct {
-	path      string
-	enabled   bool
-	fileCount int
+	path       string
+	enabled    bool
+	fileCount  int
+	unreadable int
+	unwritable int  // Locked files peers' updates couldn't be written over
+	pending    int  // Peer changes awaiting approval
+	heldFiles  int  // Files whose deletion here is held from peers until approved
+	outbound   int  // Changes and deletions here that peers that are away haven't got yet
+	paused     bool // Paused on its own with 'p' or the pause command
 }
 
 // NewDashboardModel creates a new dashboard model
 func NewDashboardModel(cfg *config.Config) *DashboardModel {
+	return &DashboardModel{
+		cfg:         cfg,
+		folders:     loadFolderInfo(cfg),
+		syncRunning: cfg.IsSyncEnabled(),
+		syncPaused:  loadAllPaused(),
+	}
+}
+
+// loadFolderInfo collects file counts, unreadable counts, and staged changes
+// (from the daemon's saved state) for each configured folder
+func loadFolderInfo(cfg *config.Config) []folderInfo {
+	state := sync.NewStateStore()
+	_ = state.Load()
+
+	pending := make(map[string]int)
+	if plan, err := sync.LoadPlan(sync.ApprovalsPath()); err == nil {
+		for _, items := range [][]sync.PlanItem{plan.Adds, plan.Updates, plan.Deletes, plan.Conflicts} {
+			for _, item := range items {
+				pending[item.FolderPath]++
+			}
+		}
+	}
+
+	pauses, _ := sync.LoadPauses()
+	if pauses == nil {
+		pauses = &sync.Pauses{}
+	}
+
+	outbound := make(map[string]int)
+	if changes, err := sync.LoadPendingChanges(); err == nil {
+		for _, c := range changes {
+			outbound[c.FolderPath]++
+		}
+	}
+
+	heldFiles := make(map[string]int)
+	if held, err := sync.LoadHeldDeletes(); err == nil {
+		for _, h := range held {
+			if h.Decision == "" {
+				heldFiles[h.FolderPath] = h.Files
+			}
+		}
+	}
+
 	folders := make([]folderInfo, len(cfg.Folders))
 	for i, f := range cfg.Folders {
 		count, _ := fileutil.CountFilesRecursive(f.Path)
 		folders[i] = folderInfo{
-			path:      f.Path,
-			enabled:   f.Enabled,
-			fileCount: count,
+			path:       f.Path,
+			enabled:    f.Enabled,
+			fileCount:  count,
+			unreadable: len(state.GetUnreadable(f.Path)),
+			unwritable: len(state.GetUnwritable(f.Path)),
+			pending:    pending[f.Path],
+			heldFiles:  heldFiles[f.Path],
+			outbound:   outbound[f.Path] + len(state.GetUnseenDeletions(f.Path)),
+			paused:     slices.Contains(pauses.Folders, f.Path),
 		}
 	}
-
-	return &DashboardModel{
-		cfg:         cfg,
-		folders:     folders,
-		syncRunning: cfg.IsSyncEnabled(),
-	}
+	return folders
 }
 
 // Init initializes the dashboard
@@ -70,6 +126,10 @@ func (m *DashboardModel) Update(msg tea.Msg) (*DashboardModel, tea.Cmd) {
 		m.height = msg.Height
 
 	case tea.KeyMsg:
+		m.notice = ""
+		if msg.String() != "D" {
+			m.confirmDelete = ""
+		}
 		switch msg.String() {
 		case "up", "k":
 			if m.selected > 0 {
@@ -92,6 +152,26 @@ func (m *DashboardModel) Update(msg tea.Msg) (*DashboardModel, tea.Cmd) {
 			return m, func() tea.Msg {
 				return DaemonToggleMsg{Start: true}
 			}
+		case "m":
+			// Start daemon in safe mode (observe only)
+			if m.daemonRunning {
+				return m, nil
+			}
+			m.cfg.Sync.Enabled = true
+			_ = config.Save(m.cfg)
+			return m, func() tea.Msg {
+				return DaemonToggleMsg{Start: true, SafeMode: true}
+			}
+		case "A":
+			m.approveSelected()
+		case "D":
+			m.decideHeldDeletes(sync.DeletesApprove)
+		case "R":
+			m.decideHeldDeletes(sync.DeletesRestore)
+		case "p":
+			m.togglePause(true)
+		case "P":
+			m.togglePause(false)
 		}
 	}
 
@@ -111,6 +191,10 @@ func (m *DashboardModel) View() string {
 	b.WriteString("Daemon: ")
 	if m.daemonRunning {
 		b.WriteString(connectedStyle.Render("● Running"))
+		if m.safeMode {
+			b.WriteString(" ")
+			b.WriteString(warningStyle.Render("(safe mode - observe only)"))
+		}
 		b.WriteString("  ")
 		b.WriteString(subtitleStyle.Render("(press 's' to stop)"))
 	} else {
@@ -122,7 +206,15 @@ func (m *DashboardModel) View() string {
 
 	// Sync enabled status
 	b.WriteString("Sync:   ")
-	if m.cfg.Sync.Enabled {
+	if m.cfg.Sync.Enabled && m.syncPaused {
+		b.WriteString(warningStyle.Render("⏸ Paused"))
+		b.WriteString("  ")
+		b.WriteString(subtitleStyle.Render("(press 'P' to resume)"))
+	} else if block := m.cfg.ScheduleBlock(time.Now()); m.cfg.Sync.Enabled && block != "" {
+		b.WriteString(warningStyle.Render("⏸ Paused"))
+		b.WriteString("  ")
+		b.WriteString(subtitleStyle.Render("(" + block + ")"))
+	} else if m.cfg.Sync.Enabled {
 		b.WriteString(connectedStyle.Render("Enabled"))
 	} else {
 		b.WriteString(disabledItemStyle.Render("Disabled"))
@@ -183,7 +275,7 @@ func (m *DashboardModel) renderFoldersBox() string {
 		icon := FolderStatusIndicator(folder.enabled)
 
 		// Shorten path
-		shortPath := shortenPath(folder.path, 35)
+		shortPath := fileutil.ShortenPath(folder.path, 35)
 
 		var countStr string
 		if folder.enabled {
@@ -206,6 +298,35 @@ func (m *DashboardModel) renderFoldersBox() string {
 		b.WriteString(line)
 		b.WriteString(strings.Repeat(" ", padding))
 		b.WriteString(disabledItemStyle.Render(countStr))
+		if folder.enabled && folder.unreadable > 0 {
+			b.WriteString(" ")
+			b.WriteString(warningStyle.Render(fmt.Sprintf("⚠ %d unreadable", folder.unreadable)))
+		}
+		if folder.enabled && folder.unwritable > 0 {
+			b.WriteString(" ")
+			b.WriteString(warningStyle.Render(fmt.Sprintf("⚠ %d locked", folder.unwritable)))
+		}
+		if folder.enabled && folder.paused {
+			b.WriteString(" ")
+			b.WriteString(warningStyle.Render("⏸ paused"))
+		}
+		if folder.enabled && folder.pending > 0 {
+			b.WriteString(" ")
+			b.WriteString(warningStyle.Render(fmt.Sprintf("⏸ %d awaiting approval", folder.pending)))
+		}
+		if folder.enabled && folder.outbound > 0 {
+			b.WriteString(" ")
+			b.WriteString(subtitleStyle.Render(fmt.Sprintf("↑ %d pending", folder.outbound)))
+		}
+		if folder.enabled && folder.heldFiles > 0 {
+			b.WriteString(" ")
+			b.WriteString(errorStyle.Render(fmt.Sprintf("⚠ %d deletions held (D send, R restore)", folder.heldFiles)))
+		}
+		b.WriteString("\n")
+	}
+
+	if m.notice != "" {
+		b.WriteString(successStyle.Render(m.notice))
 		b.WriteString("\n")
 	}
 
@@ -244,9 +365,24 @@ func (m *DashboardModel) renderActivityBox() string {
 			action = "Received"
 		case "deleted":
 			action = "Deleted"
+		case "moved":
+			action = "Moved"
+		case "corrupt":
+			action = "Corrupt, refetching"
+		case "quarantined":
+			action = "Quarantined"
+		case "skipped":
+			action = "Too large, skipped"
+		case "restored":
+			action = "Restored on peer"
+		case "locked":
+			action = "Locked, not updated"
 		}
 
 		line := fmt.Sprintf("%s %s %s", icon, action, fileName)
+		if activity.PeerName != "" {
+			line += mutedStyle.Render(" · " + m.cfg.PeerLabel(activity.PeerName))
+		}
 		padding := 45 - lipgloss.Width(line)
 		if padding < 1 {
 			padding = 1
@@ -272,22 +408,125 @@ func (m *DashboardModel) renderHelpBar() string {
 	if m.daemonRunning {
 		daemonHint = HelpItem("s", "top daemon")
 	} else {
-		daemonHint = HelpItem("s", "tart daemon")
+		daemonHint = HelpItem("s", "tart daemon") + " " + HelpItem("m", "safe mode")
 	}
 
 	items := []string{
 		daemonHint,
 		HelpItem("↑↓", "navigate"),
+		HelpItem("A", "pprove all"),
+		HelpItem("p", "ause folder"),
+		HelpItem("P", "ause all"),
 		HelpItem("q", "uit"),
 	}
 	return strings.Join(items, " ")
 }
 
+// approveSelected approves every staged change for the selected folder.
+// Conflicts need a resolution and stay staged for the CLI.
+func (m *DashboardModel) approveSelected() {
+	if m.selected >= len(m.folders) || m.folders[m.selected].pending == 0 {
+		return
+	}
+	folderPath := m.folders[m.selected].path
+
+	pending, err := sync.LoadPlan(sync.ApprovalsPath())
+	if err != nil {
+		m.notice = "No staged changes found"
+		return
+	}
+
+	selected := pending.Filter(func(item sync.PlanItem) bool {
+		return item.FolderPath == folderPath
+	})
+	selected.Conflicts = nil
+
+	if err := sync.QueuePlan(selected); err != nil {
+		m.notice = err.Error()
+		return
+	}
+	m.notice = fmt.Sprintf("Approved %d change(s) in %s", selected.Len(), fileutil.ShortenPath(folderPath, 35))
+}
+
+// decideHeldDeletes sends the selected folder's held deletions to peers, or
+// restores the files from them. Sending asks for a second 'D' first, since
+// peers then delete the files too.
+func (m *DashboardModel) decideHeldDeletes(decision string) {
+	if m.selected >= len(m.folders) || m.folders[m.selected].heldFiles == 0 {
+		return
+	}
+	folder := &m.folders[m.selected]
+	shortPath := fileutil.ShortenPath(folder.path, 35)
+
+	if decision == sync.DeletesApprove && m.confirmDelete != folder.path {
+		m.confirmDelete = folder.path
+		m.notice = fmt.Sprintf("Press D again to delete %d file(s) from %s on every peer", folder.heldFiles, shortPath)
+		return
+	}
+	m.confirmDelete = ""
+
+	if err := sync.DecideHeldDeletes(folder.path, decision); err != nil {
+		m.notice = err.Error()
+		return
+	}
+	if decision == sync.DeletesApprove {
+		m.notice = fmt.Sprintf("Deleting %d file(s) from %s on peers", folder.heldFiles, shortPath)
+	} else {
+		m.notice = fmt.Sprintf("Restoring %d file(s) in %s from peers", folder.heldFiles, shortPath)
+	}
+	folder.heldFiles = 0
+}
+
+// loadAllPaused reports whether all syncing is paused
+func loadAllPaused() bool {
+	pauses, err := sync.LoadPauses()
+	return err == nil && pauses.All
+}
+
+// togglePause pauses or resumes the selected folder, or all syncing. The
+// daemon picks up the change within a few seconds.
+func (m *DashboardModel) togglePause(folder bool) {
+	pauses, err := sync.LoadPauses()
+	if err != nil {
+		m.notice = err.Error()
+		return
+	}
+
+	if folder {
+		if m.selected >= len(m.folders) {
+			return
+		}
+		f := &m.folders[m.selected]
+		f.paused = !f.paused
+		pauses.SetFolder(f.path, f.paused)
+		m.notice = "Resumed " + fileutil.ShortenPath(f.path, 35)
+		if f.paused {
+			m.notice = "Paused " + fileutil.ShortenPath(f.path, 35)
+		}
+	} else {
+		pauses.All = !pauses.All
+		m.syncPaused = pauses.All
+		m.notice = "Resumed syncing"
+		if pauses.All {
+			m.notice = "Paused all syncing"
+		}
+	}
+
+	if err := sync.SavePauses(pauses); err != nil {
+		m.notice = err.Error()
+	}
+}
+
 // SetDaemonRunning updates the daemon running state
 func (m *DashboardModel) SetDaemonRunning(running bool) {
 	m.daemonRunning = running
 }
 
+// SetSafeMode records whether the daemon was started in safe mode
+func (m *DashboardModel) SetSafeMode(safeMode bool) {
+	m.safeMode = safeMode
+}
+
 // SetPeers updates the peer list
 func (m *DashboardModel) SetPeers(peers []*discovery.Peer) {
 	m.peers = peers
@@ -305,15 +544,8 @@ func (m *DashboardModel) SetConflicts(conflicts []*sync.Conflict) {
 
 // RefreshFolders updates folder info
 func (m *DashboardModel) RefreshFolders() {
-	m.folders = make([]folderInfo, len(m.cfg.Folders))
-	for i, f := range m.cfg.Folders {
-		count, _ := fileutil.CountFilesRecursive(f.Path)
-		m.folders[i] = folderInfo{
-			path:      f.Path,
-			enabled:   f.Enabled,
-			fileCount: count,
-		}
-	}
+	m.folders = loadFolderInfo(m.cfg)
+	m.syncPaused = loadAllPaused()
 }
 
 // SetSyncRunning updates the sync running state
@@ -325,29 +557,3 @@ func (m *DashboardModel) SetSyncRunning(running bool) {
 func (m *DashboardModel) IsSyncRunning() bool {
 	return m.syncRunning
 }
-
-func shortenPath(path string, maxLen int) string {
-	home, _ := filepath.Abs(filepath.Join("~"))
-
-	// Replace home with ~
-	if strings.HasPrefix(path, home) {
-		path = "~" + path[len(home):]
-	}
-
-	// Check user home
-	userHome := filepath.Join("/Users")
-	if strings.HasPrefix(path, userHome) {
-		parts := strings.SplitN(path[len(userHome)+1:], string(filepath.Separator), 2)
-		if len(parts) == 2 {
-			path = "~/" + parts[1]
-		}
-	}
-
-	if len(path) <= maxLen {
-		return path
-	}
-
-	// Shorten from the middle
-	half := (maxLen - 3) / 2
-	return path[:half] + "..." + path[len(path)-half:]
-}
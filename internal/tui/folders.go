@@ -8,6 +8,7 @@ import (
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/internal/sync"
 	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
 )
 
@@ -21,6 +22,7 @@ const (
 // FoldersModel represents the folder management view
 type FoldersModel struct {
 	cfg          *config.Config
+	engine       *sync.Engine // Running engine, if any, told about removed folders and selections
 	items        []folderItem
 	selected     int
 	width        int
@@ -28,15 +30,18 @@ type FoldersModel struct {
 	addMode      bool
 	addType      itemType // What type we're adding
 	input        textinput.Model
+	picker       *subfolderPicker // Choosing subfolders of a synced folder
 	err          string
 	success      string
 }
 
 type folderItem struct {
-	path      string
-	enabled   bool
-	fileCount int
-	itemType  itemType
+	path       string
+	enabled    bool
+	fileCount  int
+	itemType   itemType
+	subfolders []string // Sparse selection, empty = all
+	excluded   []string
 }
 
 // NewFoldersModel creates a new folders model
@@ -54,6 +59,23 @@ func NewFoldersModel(cfg *config.Config) *FoldersModel {
 	return m
 }
 
+// removeFolder stops syncing a folder, canceling the engine's work in it
+// when it is running
+func (m *FoldersModel) removeFolder(path string) error {
+	if m.engine != nil {
+		return m.engine.RemoveFolder(path)
+	}
+	folder := m.cfg.GetFolder(path)
+	if err := m.cfg.RemoveFolder(path); err != nil {
+		return err
+	}
+	// A running daemon notices the removal and forgets the folder's state
+	if folder != nil && config.DaemonPID() == 0 {
+		sync.NewStateStore().ClearFolder(folder.Path)
+	}
+	return nil
+}
+
 // Init initializes the folders view
 func (m *FoldersModel) Init() tea.Cmd {
 	return nil
@@ -108,6 +130,11 @@ func (m *FoldersModel) Update(msg tea.Msg) (*FoldersModel, tea.Cmd) {
 			return m, cmd
 		}
 
+		if m.picker != nil {
+			m.updatePicker(msg)
+			return m, nil
+		}
+
 		switch msg.String() {
 		case "up", "k":
 			if m.selected > 0 {
@@ -131,6 +158,11 @@ func (m *FoldersModel) Update(msg tea.Msg) (*FoldersModel, tea.Cmd) {
 			m.input.Placeholder = "~/path/to/exclude"
 			m.input.Focus()
 			return m, textinput.Blink
+		case "s":
+			// Choose subfolders to sync
+			if m.selected < len(m.items) && m.items[m.selected].itemType == itemSyncFolder {
+				m.openPicker(m.items[m.selected].path)
+			}
 		case "enter", " ":
 			if len(m.items) > 0 && m.selected < len(m.items) {
 				item := m.items[m.selected]
@@ -147,7 +179,7 @@ func (m *FoldersModel) Update(msg tea.Msg) (*FoldersModel, tea.Cmd) {
 			if len(m.items) > 0 && m.selected < len(m.items) {
 				item := m.items[m.selected]
 				if item.itemType == itemSyncFolder {
-					if err := m.cfg.RemoveFolder(item.path); err != nil {
+					if err := m.removeFolder(item.path); err != nil {
 						m.err = err.Error()
 					} else {
 						m.success = fmt.Sprintf("Removed sync folder: %s", item.path)
@@ -203,12 +235,16 @@ func (m *FoldersModel) View() string {
 		b.WriteString("\n\n")
 	}
 
-	// Folders list
-	b.WriteString(m.renderFoldersList())
-	b.WriteString("\n\n")
-
-	// Help bar
-	b.WriteString(m.renderHelpBar())
+	// Folders list, or the subfolders of one
+	if m.picker != nil {
+		b.WriteString(m.renderPicker())
+		b.WriteString("\n\n")
+		b.WriteString(m.renderPickerHelp())
+	} else {
+		b.WriteString(m.renderFoldersList())
+		b.WriteString("\n\n")
+		b.WriteString(m.renderHelpBar())
+	}
 
 	// Wrap in main box
 	maxWidth := m.width - 4
@@ -249,7 +285,7 @@ func (m *FoldersModel) renderFoldersList() string {
 			}
 
 			icon := FolderStatusIndicator(item.enabled)
-			shortPath := shortenPath(item.path, 35)
+			shortPath := fileutil.ShortenPath(item.path, 35)
 
 			var status string
 			if item.enabled {
@@ -274,6 +310,15 @@ func (m *FoldersModel) renderFoldersList() string {
 
 			b.WriteString(line)
 			b.WriteString("\n")
+
+			if len(item.subfolders) > 0 {
+				b.WriteString(subtitleStyle.Render("      only: " + strings.Join(item.subfolders, ", ")))
+				b.WriteString("\n")
+			}
+			if len(item.excluded) > 0 {
+				b.WriteString(subtitleStyle.Render("      except: " + strings.Join(item.excluded, ", ")))
+				b.WriteString("\n")
+			}
 		}
 	}
 
@@ -294,7 +339,7 @@ func (m *FoldersModel) renderFoldersList() string {
 				continue
 			}
 
-			shortPath := shortenPath(item.path, 45)
+			shortPath := fileutil.ShortenPath(item.path, 45)
 
 			cursor := "  "
 			if i == m.selected {
@@ -321,6 +366,7 @@ func (m *FoldersModel) renderHelpBar() string {
 		HelpItem("a", "dd sync"),
 		HelpItem("e", "xclude"),
 		HelpItem("enter", "toggle"),
+		HelpItem("s", "ubfolders"),
 		HelpItem("x", "remove"),
 		HelpItem("↑↓", "navigate"),
 	}
@@ -334,10 +380,12 @@ func (m *FoldersModel) refreshFolders() {
 	for _, f := range m.cfg.Folders {
 		count, _ := fileutil.CountFilesRecursive(f.Path)
 		m.items = append(m.items, folderItem{
-			path:      f.Path,
-			enabled:   f.Enabled,
-			fileCount: count,
-			itemType:  itemSyncFolder,
+			path:       f.Path,
+			enabled:    f.Enabled,
+			fileCount:  count,
+			itemType:   itemSyncFolder,
+			subfolders: f.Subfolders,
+			excluded:   f.Excluded,
 		})
 	}
 
@@ -3,11 +3,14 @@ package tui
 import (
 	"fmt"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/jseidel/mac-profile-sync/internal/config"
 	"github.com/jseidel/mac-profile-sync/internal/discovery"
+	"github.com/jseidel/mac-profile-sync/internal/sync"
 )
 
 // PeersModel represents the peers management view
@@ -15,11 +18,13 @@ type PeersModel struct {
 	cfg             *config.Config
 	discovery       *discovery.Discovery
 	discoveredPeers []*discovery.Peer
+	connected       map[string]sync.PeerStatus // Device name -> status published by the daemon
 	manualPeers     []string
 	selected        int
 	width           int
 	height          int
 	addMode         bool
+	renaming        string // Device name of the peer being given a nickname
 	input           textinput.Model
 	err             string
 	success         string
@@ -32,12 +37,14 @@ func NewPeersModel(cfg *config.Config, disc *discovery.Discovery) *PeersModel {
 	ti.CharLimit = 256
 	ti.Width = 40
 
-	return &PeersModel{
+	m := &PeersModel{
 		cfg:         cfg,
 		discovery:   disc,
 		manualPeers: cfg.Network.ManualPeers,
 		input:       ti,
 	}
+	m.loadConnected()
+	return m
 }
 
 // Init initializes the peers view
@@ -58,6 +65,29 @@ func (m *PeersModel) Update(msg tea.Msg) (*PeersModel, tea.Cmd) {
 		m.err = ""
 		m.success = ""
 
+		if m.renaming != "" {
+			switch msg.String() {
+			case "enter":
+				icon, nickname := splitIcon(m.input.Value())
+				if err := m.cfg.SetPeerNickname(m.renaming, nickname, icon); err != nil {
+					m.err = err.Error()
+				} else {
+					m.success = fmt.Sprintf("%s is shown as %s", m.renaming, m.cfg.PeerLabel(m.renaming))
+				}
+				m.renaming = ""
+				m.input.SetValue("")
+				return m, nil
+
+			case "esc":
+				m.renaming = ""
+				m.input.SetValue("")
+				return m, nil
+			}
+
+			m.input, cmd = m.input.Update(msg)
+			return m, cmd
+		}
+
 		if m.addMode {
 			switch msg.String() {
 			case "enter":
@@ -95,6 +125,19 @@ func (m *PeersModel) Update(msg tea.Msg) (*PeersModel, tea.Cmd) {
 			}
 		case "a":
 			m.addMode = true
+			m.input.Placeholder = "192.168.1.100:9876"
+			m.input.Focus()
+			return m, textinput.Blink
+		case "n":
+			if m.selected >= len(m.discoveredPeers) {
+				m.err = "Select a discovered peer to give it a nickname"
+				return m, nil
+			}
+			m.renaming = m.discoveredPeers[m.selected].Name
+			m.input.Placeholder = "💻 Work laptop"
+			if peer := m.cfg.GetPeer(m.renaming); peer != nil {
+				m.input.SetValue(strings.TrimSpace(peer.Icon + " " + peer.Nickname))
+			}
 			m.input.Focus()
 			return m, textinput.Blink
 		case "delete", "backspace", "x":
@@ -119,13 +162,22 @@ func (m *PeersModel) View() string {
 
 	// Add peer input
 	if m.addMode {
-		b.WriteString("Add peer address (host:port):\n")
+		b.WriteString("Add peer address (host:port, or a Tailscale name/IP):\n")
 		b.WriteString(inputStyle.Render(m.input.View()))
 		b.WriteString("\n")
 		b.WriteString(subtitleStyle.Render("Press Enter to add, Esc to cancel"))
 		b.WriteString("\n\n")
 	}
 
+	// Nickname input
+	if m.renaming != "" {
+		b.WriteString(fmt.Sprintf("Nickname for %s, optionally starting with an emoji (empty to clear):\n", m.renaming))
+		b.WriteString(inputStyle.Render(m.input.View()))
+		b.WriteString("\n")
+		b.WriteString(subtitleStyle.Render("Press Enter to save, Esc to cancel"))
+		b.WriteString("\n\n")
+	}
+
 	// Error/Success messages
 	if m.err != "" {
 		b.WriteString(errorStyle.Render("Error: " + m.err))
@@ -174,7 +226,20 @@ func (m *PeersModel) renderDiscoveredPeers() string {
 			}
 
 			status := connectedStyle.Render("●")
-			line := fmt.Sprintf("%s%s %s (%s)", cursor, status, peer.Name, peer.Address())
+			name := peer.Name
+			if label := m.cfg.PeerLabel(peer.Name); label != peer.Name {
+				name = fmt.Sprintf("%s [%s]", label, peer.Name)
+			}
+			line := fmt.Sprintf("%s%s %s (%s)", cursor, status, name, peer.Address())
+			if conn, ok := m.connected[peer.Name]; ok {
+				if conn.RTT > 0 {
+					line += mutedStyle.Render(fmt.Sprintf("  %s", conn.RTT.Round(time.Millisecond)))
+				}
+				line += mutedStyle.Render(fmt.Sprintf("  queue %d/%d", conn.Queue.Depth, conn.Queue.Capacity))
+				if conn.Queue.Dropped > 0 {
+					line += warningStyle.Render(fmt.Sprintf("  %d dropped", conn.Queue.Dropped))
+				}
+			}
 
 			if i == m.selected {
 				line = selectedItemStyle.Render(line)
@@ -228,6 +293,7 @@ func (m *PeersModel) renderHelpBar() string {
 	items := []string{
 		HelpItem("a", "dd peer"),
 		HelpItem("x", " remove"),
+		HelpItem("n", "ickname"),
 		HelpItem("enter", "connect"),
 		HelpItem("↑↓", "navigate"),
 	}
@@ -235,9 +301,9 @@ func (m *PeersModel) renderHelpBar() string {
 }
 
 func (m *PeersModel) addPeer(addr string) error {
-	// Validate format (basic check)
-	if !strings.Contains(addr, ":") {
-		return fmt.Errorf("invalid format, use host:port (e.g., 192.168.1.100:9876)")
+	// Validate format (basic check); the port may be omitted
+	if strings.TrimSpace(addr) == "" || strings.ContainsAny(addr, " /") {
+		return fmt.Errorf("invalid format, use host or host:port (e.g., 192.168.1.100:9876 or macbook.tailnet.ts.net)")
 	}
 
 	// Add to config
@@ -303,7 +369,7 @@ func (m *PeersModel) connectToPeer() {
 	// For manual peers, trigger a connection attempt
 	if m.selected < len(m.discoveredPeers) {
 		peer := m.discoveredPeers[m.selected]
-		m.success = fmt.Sprintf("Connecting to %s...", peer.Name)
+		m.success = fmt.Sprintf("Connecting to %s...", m.cfg.PeerLabel(peer.Name))
 	} else {
 		offset := len(m.discoveredPeers)
 		manualIdx := m.selected - offset
@@ -322,4 +388,32 @@ func (m *PeersModel) SetDiscoveredPeers(peers []*discovery.Peer) {
 // Refresh reloads peer data
 func (m *PeersModel) Refresh() {
 	m.manualPeers = m.cfg.Network.ManualPeers
+	m.loadConnected()
+}
+
+// loadConnected reads connected peers and latency published by the daemon
+func (m *PeersModel) loadConnected() {
+	m.connected = make(map[string]sync.PeerStatus)
+	peers, err := sync.LoadPeerStatus()
+	if err != nil {
+		return
+	}
+	for _, p := range peers {
+		m.connected[p.Name] = p
+	}
+}
+
+// splitIcon splits an emoji or symbol at the start of a nickname from the rest
+func splitIcon(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	first, rest, ok := strings.Cut(s, " ")
+	if !ok {
+		return "", s
+	}
+	for _, r := range first {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return "", s
+		}
+	}
+	return first, strings.TrimSpace(rest)
 }
@@ -245,7 +245,7 @@ func (m *SettingsModel) renderHelpBar() string {
 
 func (m *SettingsModel) refreshSettings() {
 	// Sync direction options
-	directionOptions := []string{"bidirectional", "send_only", "receive_only"}
+	directionOptions := []string{"bidirectional", "send_only", "receive_only", "master"}
 	directionIndex := 0
 	direction := m.cfg.Sync.Direction
 	if direction == "" {
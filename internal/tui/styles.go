@@ -138,6 +138,18 @@ func ActivityIcon(activityType string) string {
 		return receivedStyle.Render("←")
 	case "deleted":
 		return deletedStyle.Render("×")
+	case "moved":
+		return sentStyle.Render("↷")
+	case "corrupt":
+		return warningStyle.Render("!")
+	case "quarantined":
+		return errorStyle.Render("⚠")
+	case "skipped":
+		return warningStyle.Render("⊘")
+	case "restored":
+		return sentStyle.Render("↺")
+	case "locked":
+		return warningStyle.Render("⊘")
 	default:
 		return "•"
 	}
@@ -0,0 +1,380 @@
+package tui
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/jseidel/mac-profile-sync/internal/config"
+	"github.com/jseidel/mac-profile-sync/internal/network"
+	"github.com/jseidel/mac-profile-sync/internal/sync"
+	"github.com/jseidel/mac-profile-sync/pkg/fileutil"
+)
+
+// subfolderPicker chooses which subfolders of a synced folder sync, one
+// directory level at a time
+type subfolderPicker struct {
+	folder   string   // Synced folder
+	dir      string   // Directory listed, relative to the folder ("" = root)
+	entries  []string // Its subdirectories, relative to the folder
+	selected int
+	only     bool // Toggling selects subfolders to sync instead of excluding them
+
+	remote *sync.RemoteListing // What peers have outside the selection, if known
+	browse *remoteBrowser      // Browsing a subfolder that isn't synced
+}
+
+// remoteBrowser lists the files peers have in a subfolder that isn't synced,
+// for fetching on demand
+type remoteBrowser struct {
+	dir      string
+	files    []network.FileInfo
+	selected int
+}
+
+// openPicker starts choosing subfolders for a synced folder
+func (m *FoldersModel) openPicker(folderPath string) {
+	folder := m.cfg.GetFolder(folderPath)
+	if folder == nil {
+		return
+	}
+	m.picker = &subfolderPicker{folder: folder.Path, only: len(folder.Subfolders) > 0}
+	if listings, err := sync.LoadRemoteListings(); err == nil {
+		m.picker.remote = listings[folder.Path]
+	}
+	m.listPicker("")
+}
+
+// listPicker lists the subdirectories of a directory in the picked folder,
+// and those only peers have, skipping ignored ones and the tool's own
+func (m *FoldersModel) listPicker(dir string) {
+	p := m.picker
+	entries, err := os.ReadDir(filepath.Join(p.folder, filepath.FromSlash(dir)))
+	if err != nil && !os.IsNotExist(err) {
+		m.err = err.Error()
+		return
+	}
+
+	names := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names[entry.Name()] = true
+		}
+	}
+	if p.remote != nil {
+		for _, f := range p.remote.Under(dir) {
+			rest := strings.TrimPrefix(f.RelPath, dir+"/")
+			if dir == "" {
+				rest = f.RelPath
+			}
+			if name, _, ok := strings.Cut(rest, "/"); ok {
+				names[name] = true
+			}
+		}
+	}
+
+	p.dir, p.entries, p.selected = dir, nil, 0
+	for name := range names {
+		if strings.HasPrefix(name, ".mps-") {
+			continue
+		}
+		rel := path.Join(dir, name)
+		if m.cfg.ShouldIgnore(filepath.Join(p.folder, filepath.FromSlash(rel))) {
+			continue
+		}
+		p.entries = append(p.entries, rel)
+	}
+	sort.Slice(p.entries, func(i, j int) bool {
+		return strings.ToLower(p.entries[i]) < strings.ToLower(p.entries[j])
+	})
+}
+
+// updatePicker handles keys while choosing subfolders
+func (m *FoldersModel) updatePicker(msg tea.KeyMsg) {
+	p := m.picker
+	if p.browse != nil {
+		m.updateBrowser(msg)
+		return
+	}
+
+	switch msg.String() {
+	case "esc", "q":
+		m.picker = nil
+		m.refreshFolders()
+	case "up", "k":
+		if p.selected > 0 {
+			p.selected--
+		}
+	case "down", "j":
+		if p.selected < len(p.entries)-1 {
+			p.selected++
+		}
+	case "right", "l":
+		if p.selected < len(p.entries) {
+			m.listPicker(p.entries[p.selected])
+		}
+	case "left", "h", "backspace":
+		if p.dir != "" {
+			parent, current := path.Dir(p.dir), p.dir
+			if parent == "." {
+				parent = ""
+			}
+			m.listPicker(parent)
+			if i := slices.Index(p.entries, current); i >= 0 {
+				p.selected = i
+			}
+		}
+	case "o":
+		p.only = !p.only
+	case "b":
+		if p.selected < len(p.entries) {
+			m.openBrowser(p.entries[p.selected])
+		}
+	case "enter", " ":
+		if p.selected < len(p.entries) {
+			m.togglePicked(p.entries[p.selected])
+		}
+	}
+}
+
+// togglePicked selects or deselects a subfolder, or excludes it or includes
+// it again, depending on the picker's mode
+func (m *FoldersModel) togglePicked(rel string) {
+	folder := m.cfg.GetFolder(m.picker.folder)
+	if folder == nil {
+		return
+	}
+
+	list, set := folder.Excluded, m.cfg.SetExcluded
+	if m.picker.only {
+		list, set = folder.Subfolders, m.cfg.SetSubfolders
+	}
+	if i := slices.Index(list, rel); i >= 0 {
+		list = slices.Delete(slices.Clone(list), i, i+1)
+	} else {
+		if m.picker.only && isSelectedBelow(folder.Subfolders, rel) {
+			m.err = fmt.Sprintf("%s is already synced as part of a selected subfolder", rel)
+			return
+		}
+		list = append(slices.Clone(list), rel)
+	}
+
+	switch {
+	case m.engine != nil:
+		set = m.engine.SetExcluded
+		if m.picker.only {
+			set = m.engine.SetSubfolders
+		}
+		m.success = "Backfilling or removing subfolders"
+	case config.DaemonPID() != 0:
+		m.success = "The daemon backfills or removes subfolders within a few seconds"
+	default:
+		m.success = "Subfolders are backfilled or removed when the daemon starts"
+	}
+	if err := set(folder.Path, list); err != nil {
+		m.success = ""
+		m.err = err.Error()
+	}
+}
+
+// isSelectedBelow reports whether a directory is inside one of the selected
+// subfolders
+func isSelectedBelow(subfolders []string, rel string) bool {
+	for _, sub := range subfolders {
+		if strings.HasPrefix(rel, sub+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// pickerStatus describes whether a subfolder syncs
+func (m *FoldersModel) pickerStatus(rel string) string {
+	folder := m.cfg.GetFolder(m.picker.folder)
+	if folder == nil {
+		return ""
+	}
+
+	switch {
+	case folder.ExcludedBy(rel) != "":
+		return errorStyle.Render("✗ excluded")
+	case !folder.IncludesDir(rel):
+		return disabledItemStyle.Render("○ not synced")
+	case len(folder.Subfolders) > 0 && !slices.Contains(folder.Subfolders, rel) && !isSelectedBelow(folder.Subfolders, rel):
+		return warningStyle.Render("◐ partly synced")
+	default:
+		return connectedStyle.Render("✓ synced")
+	}
+}
+
+// renderPicker renders the subfolder picker
+func (m *FoldersModel) renderPicker() string {
+	p := m.picker
+	if p.browse != nil {
+		return m.renderBrowser()
+	}
+	var b strings.Builder
+
+	mode := "sync all except the excluded subfolders"
+	if p.only {
+		mode = "sync only the selected subfolders"
+	}
+	b.WriteString(connectedStyle.Render("Subfolders of " + fileutil.ShortenPath(filepath.Join(p.folder, filepath.FromSlash(p.dir)), 50)))
+	b.WriteString("\n")
+	b.WriteString(subtitleStyle.Render("Mode: " + mode))
+	b.WriteString("\n")
+	b.WriteString(strings.Repeat("─", 60))
+	b.WriteString("\n")
+
+	if len(p.entries) == 0 {
+		b.WriteString(subtitleStyle.Render("  No subfolders"))
+		b.WriteString("\n")
+	}
+	for i, rel := range p.entries {
+		cursor := "  "
+		if i == p.selected {
+			cursor = selectedItemStyle.Render("> ")
+		}
+		line := fmt.Sprintf("%s%-40s %s", cursor, path.Base(rel)+"/", m.pickerStatus(rel))
+		if i == p.selected {
+			line = lipgloss.NewStyle().Bold(true).Render(line)
+		}
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+
+	return innerBoxStyle.Render(b.String())
+}
+
+func (m *FoldersModel) renderPickerHelp() string {
+	if m.picker.browse != nil {
+		items := []string{
+			HelpItem("enter", "fetch file"),
+			HelpItem("a", "fetch all"),
+			HelpItem("esc", "back"),
+		}
+		return strings.Join(items, " ")
+	}
+
+	toggle := "exclude/include"
+	if m.picker.only {
+		toggle = "select/deselect"
+	}
+	items := []string{
+		HelpItem("enter", toggle),
+		HelpItem("o", "switch mode"),
+		HelpItem("b", "browse peer's files"),
+		HelpItem("→", "open"),
+		HelpItem("←", "up"),
+		HelpItem("esc", "done"),
+	}
+	return strings.Join(items, " ")
+}
+
+// openBrowser lists the files peers have in a subfolder that isn't synced
+func (m *FoldersModel) openBrowser(dir string) {
+	p := m.picker
+	if p.remote == nil {
+		m.err = "No file list from a peer yet: start the daemon and wait for a peer to connect"
+		return
+	}
+	files := p.remote.Under(dir)
+	if len(files) == 0 {
+		m.err = fmt.Sprintf("%s has no files in %s outside the synced subfolders", m.cfg.PeerLabel(p.remote.PeerName), dir)
+		return
+	}
+	m.err = ""
+	p.browse = &remoteBrowser{dir: dir, files: files}
+}
+
+// updateBrowser handles keys while browsing a subfolder that isn't synced
+func (m *FoldersModel) updateBrowser(msg tea.KeyMsg) {
+	br := m.picker.browse
+	switch msg.String() {
+	case "esc", "q", "left", "h", "backspace":
+		m.picker.browse = nil
+	case "up", "k":
+		if br.selected > 0 {
+			br.selected--
+		}
+	case "down", "j":
+		if br.selected < len(br.files)-1 {
+			br.selected++
+		}
+	case "enter", " ":
+		if br.selected < len(br.files) {
+			m.fetch(br.files[br.selected : br.selected+1])
+		}
+	case "a":
+		m.fetch(br.files)
+	}
+}
+
+// fetch gets files outside the selection from the peer that listed them,
+// through the running engine or daemon
+func (m *FoldersModel) fetch(files []network.FileInfo) {
+	folder := m.picker.folder
+	var err error
+	switch {
+	case m.engine != nil:
+		for _, f := range files {
+			if err = m.engine.FetchRemote(folder, f.RelPath); err != nil {
+				break
+			}
+		}
+	case config.DaemonPID() == 0:
+		err = fmt.Errorf("the daemon isn't running: start it to fetch files")
+	default:
+		requests := make([]sync.FetchRequest, len(files))
+		for i, f := range files {
+			requests[i] = sync.FetchRequest{FolderPath: folder, RelPath: f.RelPath}
+		}
+		err = sync.QueueFetch(requests)
+	}
+	if err != nil {
+		m.success = ""
+		m.err = err.Error()
+		return
+	}
+	m.err = ""
+	m.success = fmt.Sprintf("Fetching %d file(s) from %s", len(files), m.cfg.PeerLabel(m.picker.remote.PeerName))
+}
+
+// renderBrowser renders the files peers have in a subfolder that isn't synced
+func (m *FoldersModel) renderBrowser() string {
+	p := m.picker
+	br := p.browse
+	var b strings.Builder
+
+	b.WriteString(connectedStyle.Render("Not synced: " + fileutil.ShortenPath(filepath.Join(p.folder, filepath.FromSlash(br.dir)), 50)))
+	b.WriteString("\n")
+	b.WriteString(subtitleStyle.Render(fmt.Sprintf("On %s as of %s", m.cfg.PeerLabel(p.remote.PeerName), fileutil.FormatTime(p.remote.ReceivedAt))))
+	b.WriteString("\n")
+	b.WriteString(strings.Repeat("─", 60))
+	b.WriteString("\n")
+
+	for i, f := range br.files {
+		cursor := "  "
+		if i == br.selected {
+			cursor = selectedItemStyle.Render("> ")
+		}
+		status := ""
+		if _, err := os.Stat(filepath.Join(p.folder, filepath.FromSlash(f.RelPath))); err == nil {
+			status = connectedStyle.Render("✓ fetched")
+		}
+		line := fmt.Sprintf("%s%-44s %10s %s", cursor, strings.TrimPrefix(f.RelPath, br.dir+"/"), fileutil.FormatSize(f.Size), status)
+		if i == br.selected {
+			line = lipgloss.NewStyle().Bold(true).Render(line)
+		}
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+
+	return innerBoxStyle.Render(b.String())
+}
@@ -0,0 +1,17 @@
+package fileutil
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// FreeSpace returns the bytes available to this user on the volume holding
+// path
+func FreeSpace(path string) (int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, fmt.Errorf("failed to get free space: %w", err)
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,166 @@
+package fileutil
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Locale holds how dates, times and numbers are written in one region
+type Locale struct {
+	Date    string // time.Format layout for a date
+	Clock   string // time.Format layout for a time of day, to the second
+	Minutes string // time.Format layout for a time of day, to the minute
+	Decimal string // Decimal separator
+	Group   string // Thousands separator
+}
+
+// locales by language and, where they differ within a language, region.
+// Regions not listed use their language's entry; other languages use ISO
+// dates and a 24-hour clock.
+var locales = map[string]Locale{
+	"en_US": {Date: "Jan 2, 2006", Clock: "3:04:05 PM", Minutes: "3:04 PM", Decimal: ".", Group: ","},
+	"en":    {Date: "2 Jan 2006", Clock: "15:04:05", Minutes: "15:04", Decimal: ".", Group: ","},
+	"de":    {Date: "02.01.2006", Clock: "15:04:05", Minutes: "15:04", Decimal: ",", Group: "."},
+	"de_CH": {Date: "02.01.2006", Clock: "15:04:05", Minutes: "15:04", Decimal: ".", Group: "'"},
+	"fr":    {Date: "02/01/2006", Clock: "15:04:05", Minutes: "15:04", Decimal: ",", Group: " "},
+	"fr_CA": {Date: "2006-01-02", Clock: "15:04:05", Minutes: "15:04", Decimal: ",", Group: " "},
+	"es":    {Date: "02/01/2006", Clock: "15:04:05", Minutes: "15:04", Decimal: ",", Group: "."},
+	"it":    {Date: "02/01/2006", Clock: "15:04:05", Minutes: "15:04", Decimal: ",", Group: "."},
+	"pt":    {Date: "02/01/2006", Clock: "15:04:05", Minutes: "15:04", Decimal: ",", Group: "."},
+	"nl":    {Date: "02-01-2006", Clock: "15:04:05", Minutes: "15:04", Decimal: ",", Group: "."},
+	"sv":    {Date: "2006-01-02", Clock: "15:04:05", Minutes: "15:04", Decimal: ",", Group: " "},
+	"da":    {Date: "02.01.2006", Clock: "15.04.05", Minutes: "15.04", Decimal: ",", Group: "."},
+	"nb":    {Date: "02.01.2006", Clock: "15:04:05", Minutes: "15:04", Decimal: ",", Group: " "},
+	"fi":    {Date: "2.1.2006", Clock: "15.04.05", Minutes: "15.04", Decimal: ",", Group: " "},
+	"pl":    {Date: "02.01.2006", Clock: "15:04:05", Minutes: "15:04", Decimal: ",", Group: " "},
+	"ru":    {Date: "02.01.2006", Clock: "15:04:05", Minutes: "15:04", Decimal: ",", Group: " "},
+	"ja":    {Date: "2006/01/02", Clock: "15:04:05", Minutes: "15:04", Decimal: ".", Group: ","},
+	"zh":    {Date: "2006/01/02", Clock: "15:04:05", Minutes: "15:04", Decimal: ".", Group: ","},
+	"ko":    {Date: "2006. 01. 02.", Clock: "15:04:05", Minutes: "15:04", Decimal: ".", Group: ","},
+}
+
+// isoLocale is used for languages not in locales
+var isoLocale = Locale{Date: "2006-01-02", Clock: "15:04:05", Minutes: "15:04", Decimal: ".", Group: ","}
+
+// display is how times and numbers are shown, set once at startup with
+// SetDisplay
+var display = struct {
+	mu     sync.RWMutex
+	locale Locale
+	zone   *time.Location
+}{locale: locales["en_US"], zone: time.Local}
+
+// LookupLocale returns the formats for a locale name like "en_GB",
+// "de_DE.UTF-8" or "fr-CA", and whether it is one this knows
+func LookupLocale(name string) (Locale, bool) {
+	name, _, _ = strings.Cut(name, ".")
+	name, _, _ = strings.Cut(name, "@")
+	name = strings.ReplaceAll(name, "-", "_")
+	lang, region, _ := strings.Cut(name, "_")
+	lang = strings.ToLower(lang)
+
+	if l, ok := locales[lang+"_"+strings.ToUpper(region)]; ok {
+		return l, true
+	}
+	if l, ok := locales[lang]; ok {
+		return l, true
+	}
+	if lang == "" || lang == "c" || lang == "posix" {
+		return locales["en_US"], true
+	}
+	return isoLocale, false
+}
+
+// SystemLocale returns the locale set in the environment for dates and
+// times (LC_ALL, LC_TIME, then LANG), or "" if none is
+func SystemLocale() string {
+	for _, key := range []string{"LC_ALL", "LC_TIME", "LANG"} {
+		if v := os.Getenv(key); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// SetDisplay sets the locale and time zone times and numbers are shown in.
+// A nil zone shows times in this Mac's time zone.
+func SetDisplay(locale Locale, zone *time.Location) {
+	if zone == nil {
+		zone = time.Local
+	}
+	display.mu.Lock()
+	display.locale, display.zone = locale, zone
+	display.mu.Unlock()
+}
+
+func displayed() (Locale, *time.Location) {
+	display.mu.RLock()
+	defer display.mu.RUnlock()
+	return display.locale, display.zone
+}
+
+// zoneSuffix names the time zone a time is shown in, with its UTC offset, so
+// times from peers in other zones compare at a glance: "PST (UTC-08:00)"
+func zoneSuffix(t time.Time) string {
+	name, _ := t.Zone()
+	offset := t.Format("-07:00")
+	if offset == "+00:00" {
+		return "UTC"
+	}
+	if name == "" || strings.HasPrefix(name, "+") || strings.HasPrefix(name, "-") {
+		return "UTC" + offset
+	}
+	return name + " (UTC" + offset + ")"
+}
+
+// FormatDateTime returns a date and time to the minute in the display
+// locale and time zone, naming the zone
+func FormatDateTime(t time.Time) string {
+	locale, zone := displayed()
+	t = t.In(zone)
+	return t.Format(locale.Date+" "+locale.Minutes) + " " + zoneSuffix(t)
+}
+
+// FormatDateTimeSeconds is FormatDateTime to the second
+func FormatDateTimeSeconds(t time.Time) string {
+	locale, zone := displayed()
+	t = t.In(zone)
+	return t.Format(locale.Date+" "+locale.Clock) + " " + zoneSuffix(t)
+}
+
+// FormatClock returns a time of day to the second in the display locale and
+// time zone, naming the zone, for times within the next or last day
+func FormatClock(t time.Time) string {
+	locale, zone := displayed()
+	t = t.In(zone)
+	return t.Format(locale.Clock) + " " + zoneSuffix(t)
+}
+
+// FormatCount returns a count with the display locale's thousands separator
+func FormatCount(n int64) string {
+	locale, _ := displayed()
+	digits := fmt.Sprintf("%d", n)
+	sign := ""
+	if n < 0 {
+		sign, digits = "-", digits[1:]
+	}
+
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteString(locale.Group)
+		}
+		b.WriteRune(d)
+	}
+	return sign + b.String()
+}
+
+// formatDecimal returns f to one decimal place with the display locale's
+// decimal separator
+func formatDecimal(f float64) string {
+	locale, _ := displayed()
+	return strings.Replace(fmt.Sprintf("%.1f", f), ".", locale.Decimal, 1)
+}
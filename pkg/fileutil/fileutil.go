@@ -1,12 +1,18 @@
 package fileutil
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -16,29 +22,138 @@ type FileInfo struct {
 	RelPath    string    `json:"rel_path"`
 	Size       int64     `json:"size"`
 	ModTime    time.Time `json:"mod_time"`
+	Birthtime  time.Time `json:"birthtime"` // Creation date; zero where unknown
 	Hash       string    `json:"hash"`
+	HashAlgo   string    `json:"hash_algo,omitempty"`
 	IsDir      bool      `json:"is_dir"`
 	Permission os.FileMode `json:"permission"`
+	Xattrs     map[string][]byte `json:"xattrs,omitempty"` // Extended attributes (Finder tags, quarantine flags, ...)
+	LinkOf     string    `json:"link_of,omitempty"` // Path scanned earlier that this file is a hard link to
+	Package    bool      `json:"package,omitempty"` // A directory Finder shows as one file, such as an app
 }
 
-// HashFile computes SHA256 hash of a file
+// Hash algorithms. New hashes are made with HashAlgorithm; hashes recorded
+// without an algorithm were made with LegacyHashAlgorithm.
+const (
+	HashAlgorithm       = "sha256"
+	LegacyHashAlgorithm = "sha256"
+)
+
+// SizeModTimeAlgorithm "hashes" a file by its size and mod time, without
+// reading it. Two files with the same size and mod time match whatever their
+// contents.
+const SizeModTimeAlgorithm = "size_mtime"
+
+// SizeModTimeHash returns the SizeModTimeAlgorithm hash of a file. Mod times
+// are compared to the second, which every volume format keeps.
+func SizeModTimeHash(size int64, modTime time.Time) string {
+	return fmt.Sprintf("%x-%x", size, modTime.Unix())
+}
+
+// hashAlgorithms are the algorithms files can be hashed with, so hashes made
+// with an older algorithm can still be checked while they are migrated
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+}
+
+// ErrUnsupportedHash is returned for a hash algorithm this version doesn't know
+var ErrUnsupportedHash = errors.New("unsupported hash algorithm")
+
+// HashAlgorithmOf returns the algorithm a hash recorded with algorithm was
+// made with, treating an empty algorithm as LegacyHashAlgorithm
+func HashAlgorithmOf(algorithm string) string {
+	if algorithm == "" {
+		return LegacyHashAlgorithm
+	}
+	return algorithm
+}
+
+// HashFile computes the HashAlgorithm hash of a file
 func HashFile(path string) (string, error) {
+	return HashFileWith(path, HashAlgorithm)
+}
+
+// HashFileWith computes a file's hash with the given algorithm
+func HashFileWith(path, algorithm string) (string, error) {
+	return HashFileContext(context.Background(), path, algorithm)
+}
+
+// HashFileContext is HashFileWith, giving up with ctx's error as soon as
+// ctx is canceled instead of reading the rest of a large file
+func HashFileContext(ctx context.Context, path, algorithm string) (string, error) {
+	if algorithm == SizeModTimeAlgorithm {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to stat file: %w", err)
+		}
+		return SizeModTimeHash(info.Size(), info.ModTime()), nil
+	}
+
+	newHash, ok := hashAlgorithms[HashAlgorithmOf(algorithm)]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedHash, algorithm)
+	}
+
 	f, err := os.Open(path)
 	if err != nil {
 		return "", fmt.Errorf("failed to open file: %w", err)
 	}
 	defer func() { _ = f.Close() }()
 
-	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
+	h := newHash()
+	if _, err := io.Copy(h, &contextReader{ctx: ctx, r: f}); err != nil {
 		return "", fmt.Errorf("failed to hash file: %w", err)
 	}
 
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
+// ReadFileContext reads a whole file like os.ReadFile, giving up with ctx's
+// error as soon as ctx is canceled
+func ReadFileContext(ctx context.Context, path string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var buf bytes.Buffer
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		buf.Grow(int(info.Size()))
+	}
+	if _, err := buf.ReadFrom(&contextReader{ctx: ctx, r: f}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// contextReader stops reading with ctx's error once ctx is canceled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
 // GetFileInfo retrieves metadata for a file
 func GetFileInfo(path string, basePath string) (*FileInfo, error) {
+	return GetFileInfoWith(path, basePath, func(os.FileInfo) (string, error) {
+		return HashFile(path)
+	})
+}
+
+// GetFileInfoWith retrieves metadata for a file, getting its HashAlgorithm
+// hash from hashFile, e.g. to reuse hashes of files that haven't changed
+func GetFileInfoWith(path string, basePath string, hashFile func(info os.FileInfo) (string, error)) (*FileInfo, error) {
 	info, err := os.Stat(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to stat file: %w", err)
@@ -51,26 +166,76 @@ func GetFileInfo(path string, basePath string) (*FileInfo, error) {
 
 	fi := &FileInfo{
 		Path:       path,
-		RelPath:    relPath,
+		RelPath:    NormalizePath(relPath),
 		Size:       info.Size(),
 		ModTime:    info.ModTime(),
+		Birthtime:  Birthtime(info),
 		IsDir:      info.IsDir(),
 		Permission: info.Mode().Perm(),
 	}
 
 	// Only hash regular files
 	if !info.IsDir() && info.Size() > 0 {
-		hash, err := HashFile(path)
+		hash, err := hashFile(info)
 		if err != nil {
 			return nil, err
 		}
 		fi.Hash = hash
+		fi.HashAlgo = HashAlgorithm
+	}
+
+	if !info.IsDir() {
+		fi.Xattrs, _ = ReadXattrs(path)
+	} else {
+		fi.Package = IsPackage(path, info)
 	}
 
 	return fi, nil
 }
 
-// CopyFile copies a file from src to dst, preserving permissions and mod time
+// packageExtensions are the extensions of directories macOS treats as a
+// single file: apps, bundles, libraries and documents saved as packages
+var packageExtensions = map[string]bool{
+	".app":           true,
+	".bundle":        true,
+	".framework":     true,
+	".plugin":        true,
+	".kext":          true,
+	".appex":         true,
+	".xpc":           true,
+	".pkg":           true,
+	".mpkg":          true,
+	".photoslibrary": true,
+	".musiclibrary":  true,
+	".tvlibrary":     true,
+	".fcpbundle":     true,
+	".logicx":        true,
+	".band":          true,
+	".imovielibrary": true,
+	".pages":         true,
+	".numbers":       true,
+	".key":           true,
+	".rtfd":          true,
+	".xcodeproj":     true,
+	".xcworkspace":   true,
+	".playground":    true,
+	".sparsebundle":  true,
+}
+
+// HasPackageExtension reports whether a name ends in an extension macOS
+// treats as a package, such as .app or .photoslibrary
+func HasPackageExtension(name string) bool {
+	return packageExtensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// IsPackage reports whether a directory is a package: one with a package
+// extension, or with its bundle bit set in Finder
+func IsPackage(path string, info os.FileInfo) bool {
+	return info.IsDir() && (HasPackageExtension(path) || HasBundleBit(path))
+}
+
+// CopyFile copies a file from src to dst, preserving permissions, mod time,
+// creation date, and extended attributes
 func CopyFile(src, dst string) error {
 	srcFile, err := os.Open(src)
 	if err != nil {
@@ -98,14 +263,68 @@ func CopyFile(src, dst string) error {
 		return fmt.Errorf("failed to copy data: %w", err)
 	}
 
+	// Extended attributes are best effort; some volumes don't support them
+	if attrs, err := ReadXattrs(src); err == nil {
+		_ = WriteXattrs(dst, attrs)
+	}
+
 	// Preserve modification time
 	if err := os.Chtimes(dst, srcInfo.ModTime(), srcInfo.ModTime()); err != nil {
 		return fmt.Errorf("failed to set mod time: %w", err)
 	}
+	_ = SetBirthtime(dst, Birthtime(srcInfo))
 
 	return nil
 }
 
+// ParseSize parses a size like "500MB", "2 GB" or "1048576" into bytes.
+// Units are powers of 1024, as FormatSize shows them.
+func ParseSize(s string) (int64, error) {
+	num := strings.ToUpper(strings.TrimSpace(s))
+	num = strings.TrimSuffix(strings.TrimSuffix(num, "B"), "I")
+
+	shift := 0
+	if n := len(num); n > 0 {
+		if i := strings.IndexByte("KMGTPE", num[n-1]); i >= 0 {
+			shift = 10 * (i + 1)
+			num = num[:n-1]
+		}
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(value * float64(int64(1)<<shift)), nil
+}
+
+// ParseAge parses an age like "180d", "12w" or "36h" into a duration. Days
+// and weeks are added to what time.ParseDuration takes.
+func ParseAge(s string) (time.Duration, error) {
+	age := strings.ToLower(strings.TrimSpace(s))
+
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(age, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(age, "w"):
+		unit = 7 * 24 * time.Hour
+	}
+	if unit == 0 {
+		d, err := time.ParseDuration(age)
+		if err != nil || d < 0 {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		return d, nil
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(age[:len(age)-1]), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return time.Duration(value * float64(unit)), nil
+}
+
 // FormatSize returns a human-readable file size
 func FormatSize(bytes int64) string {
 	const unit = 1024
@@ -117,10 +336,11 @@ func FormatSize(bytes int64) string {
 		div *= unit
 		exp++
 	}
-	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+	return fmt.Sprintf("%s %cB", formatDecimal(float64(bytes)/float64(div)), "KMGTPE"[exp])
 }
 
-// FormatTime returns a human-readable relative time
+// FormatTime returns a human-readable relative time, or the date and time
+// for times over a day ago
 func FormatTime(t time.Time) string {
 	now := time.Now()
 	diff := now.Sub(t)
@@ -133,7 +353,7 @@ func FormatTime(t time.Time) string {
 	case diff < 24*time.Hour:
 		return fmt.Sprintf("%dh ago", int(diff.Hours()))
 	default:
-		return t.Format("Jan 2, 2006 3:04 PM")
+		return FormatDateTime(t)
 	}
 }
 
@@ -157,6 +377,24 @@ func IsDir(path string) bool {
 	return info.IsDir()
 }
 
+// ExternalVolume returns the mount point of the external volume a path is
+// on, like "/Volumes/Backup", or "" for a path on the startup disk
+func ExternalVolume(path string) string {
+	rel, ok := strings.CutPrefix(filepath.Clean(path), "/Volumes/")
+	if !ok || rel == "" {
+		return ""
+	}
+	name, _, _ := strings.Cut(rel, "/")
+	return "/Volumes/" + name
+}
+
+// VolumeMounted reports whether the external volume a path is on is
+// mounted. A path on the startup disk always is.
+func VolumeMounted(path string) bool {
+	volume := ExternalVolume(path)
+	return volume == "" || IsMountPoint(volume)
+}
+
 // CountFiles returns the number of files in a directory (non-recursive)
 func CountFiles(dir string) (int, error) {
 	entries, err := os.ReadDir(dir)
@@ -200,3 +438,15 @@ func GenerateConflictName(originalPath string, deviceName string) string {
 
 	return filepath.Join(dir, newName)
 }
+
+// CloneFile copies a file from src to dst as a copy-on-write clone where the
+// filesystem supports it, falling back to a full copy
+func CloneFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+	if err := CloneTree(src, dst); err == nil {
+		return nil
+	}
+	return CopyFile(src, dst)
+}
@@ -0,0 +1,118 @@
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// VolumesDir is where macOS mounts external and network volumes
+const VolumesDir = "/Volumes"
+
+// ExpandHome expands a leading ~ to the user's home folder and cleans the path
+func ExpandHome(path string) string {
+	if path == "" {
+		return path
+	}
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[1:])
+		}
+	}
+	return filepath.Clean(path)
+}
+
+// NormalizePath returns a relative path in Unicode NFC, the form paths are
+// sent, stored and compared in. macOS filesystems hand out decomposed (NFD)
+// names, so "café" walked there would otherwise differ from a peer's "café".
+func NormalizePath(relPath string) string {
+	if norm.NFC.IsNormalString(relPath) {
+		return relPath
+	}
+	return norm.NFC.String(relPath)
+}
+
+// IsWithin reports whether path is dir or inside it, comparing whole path
+// components so /Volumes/Media doesn't contain /Volumes/MediaBackup
+func IsWithin(path, dir string) bool {
+	_, ok := RelWithin(dir, path)
+	return ok
+}
+
+// RelWithin returns path relative to dir, or false if it isn't dir or inside it
+func RelWithin(dir, path string) (string, bool) {
+	if dir == "" || path == "" {
+		return "", false
+	}
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// VolumeRoot returns the mount point a path is on: /Volumes/<name> for
+// external volumes, or / for the startup disk
+func VolumeRoot(path string) string {
+	rel, ok := RelWithin(VolumesDir, path)
+	if !ok || rel == "." {
+		return string(filepath.Separator)
+	}
+	name, _, _ := strings.Cut(rel, string(filepath.Separator))
+	return filepath.Join(VolumesDir, name)
+}
+
+// displayRoot splits a path into the root it is shown under (~ for the home
+// folder, /Volumes/<name> for a volume, / otherwise) and the rest
+func displayRoot(path string) (string, string) {
+	path = ExpandHome(path)
+	if home, err := os.UserHomeDir(); err == nil && home != "" {
+		if rel, ok := RelWithin(home, path); ok {
+			if rel == "." {
+				return "~", ""
+			}
+			return "~", rel
+		}
+	}
+
+	root := VolumeRoot(path)
+	rel, _ := RelWithin(root, path)
+	if rel == "." {
+		rel = ""
+	}
+	return root, rel
+}
+
+// DisplayPath returns a path as shown to the user, relative to ~ when it is
+// in the home folder
+func DisplayPath(path string) string {
+	root, rel := displayRoot(path)
+	if rel == "" {
+		return root
+	}
+	return filepath.Join(root, rel)
+}
+
+// ShortenPath returns the display form of a path, cut from the middle to at
+// most maxLen characters. Its root and last component are kept if they fit.
+func ShortenPath(path string, maxLen int) string {
+	display := DisplayPath(path)
+	runes := []rune(display)
+	if len(runes) <= maxLen || maxLen < 5 {
+		return display
+	}
+
+	root, _ := displayRoot(path)
+	head := []rune(strings.TrimSuffix(root, string(filepath.Separator)) + string(filepath.Separator))
+	tail := []rune(string(filepath.Separator) + filepath.Base(display))
+	if len(head)+3+len(tail) <= maxLen {
+		// Fill the room left with the end of the middle
+		keep := maxLen - len(head) - 3
+		return string(head) + "..." + string(runes[len(runes)-keep:])
+	}
+
+	half := (maxLen - 3) / 2
+	return string(runes[:half]) + "..." + string(runes[len(runes)-half:])
+}
@@ -0,0 +1,147 @@
+package fileutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// CloneTree makes a copy-on-write clone of a file or directory tree. On APFS
+// this is nearly instant and takes no extra space until either copy changes.
+func CloneTree(src, dst string) error {
+	if err := unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW); err != nil {
+		return fmt.Errorf("failed to clone %s: %w", src, err)
+	}
+	return nil
+}
+
+// Birthtime returns when a file was created
+func Birthtime(info os.FileInfo) time.Time {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Birthtimespec.Sec, st.Birthtimespec.Nsec)
+	}
+	return time.Time{}
+}
+
+// Inode returns a file's inode number
+func Inode(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Ino
+	}
+	return 0
+}
+
+// HardLinkKey identifies the file a path is a hard link to, for a file with
+// more than one link
+func HardLinkKey(info os.FileInfo) (string, bool) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 && !info.IsDir() {
+		return fmt.Sprintf("%d:%d", st.Dev, st.Ino), true
+	}
+	return "", false
+}
+
+// SetBirthtime sets a file's creation date. A zero time leaves it unchanged.
+func SetBirthtime(path string, t time.Time) error {
+	if t.IsZero() {
+		return nil
+	}
+
+	attrs := unix.Attrlist{Bitmapcount: unix.ATTR_BIT_MAP_COUNT, Commonattr: unix.ATTR_CMN_CRTIME}
+	ts := unix.NsecToTimespec(t.UnixNano())
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(&ts)), unsafe.Sizeof(ts))
+	if err := unix.Setattrlist(path, &attrs, buf, unix.FSOPT_NOFOLLOW); err != nil {
+		return fmt.Errorf("failed to set creation date: %w", err)
+	}
+	return nil
+}
+
+// LockFlags are the flags (uchg, uappnd) that stop a file from being
+// replaced or changed
+const LockFlags = unix.UF_IMMUTABLE | unix.UF_APPEND
+
+// FileFlags returns a file's user-settable flags (chflags), such as hidden
+// or locked
+func FileFlags(info os.FileInfo) uint32 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Flags & unix.UF_SETTABLE
+	}
+	return 0
+}
+
+// SetFileFlags sets a file's user-settable flags, keeping its system flags
+func SetFileFlags(path string, flags uint32) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	want := st.Flags&^unix.UF_SETTABLE | flags&unix.UF_SETTABLE
+	if want == st.Flags {
+		return nil
+	}
+	if err := unix.Chflags(path, int(want)); err != nil {
+		return fmt.Errorf("failed to set file flags: %w", err)
+	}
+	return nil
+}
+
+// IsMountPoint reports whether a directory has a volume mounted on it,
+// rather than being a leftover mount point or a folder on the volume above
+func IsMountPoint(path string) bool {
+	var st, parent unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil || st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return false
+	}
+	if err := unix.Stat(filepath.Dir(path), &parent); err != nil {
+		return false
+	}
+	return st.Dev != parent.Dev
+}
+
+// SameVolume reports whether two paths are on the same volume, so a file can
+// be renamed from one to the other
+func SameVolume(a, b string) bool {
+	var sa, sb unix.Stat_t
+	if unix.Stat(a, &sa) != nil || unix.Stat(b, &sb) != nil {
+		return false
+	}
+	return sa.Dev == sb.Dev
+}
+
+// IsNetworkVolume reports whether path is on a volume mounted from another
+// machine (SMB, AFP, NFS, WebDAV), where file events miss changes made by
+// other clients
+func IsNetworkVolume(path string) bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return false
+	}
+	return st.Flags&unix.MNT_LOCAL == 0
+}
+
+// finderInfoAttr holds a file's Finder flags, among other things
+const finderInfoAttr = "com.apple.FinderInfo"
+
+// kHasBundle is the Finder flag that makes a directory a package
+const kHasBundle = 0x2000
+
+// HasBundleBit reports whether a directory's Finder flags mark it as a
+// package
+func HasBundleBit(path string) bool {
+	info := make([]byte, 32)
+	n, err := unix.Lgetxattr(path, finderInfoAttr, info)
+	if err != nil || n < 10 {
+		return false
+	}
+	// The flags are a big-endian uint16 at offset 8
+	return (uint16(info[8])<<8|uint16(info[9]))&kHasBundle != 0
+}
@@ -0,0 +1,82 @@
+//go:build !darwin
+
+package fileutil
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// ErrCloneUnsupported is returned where copy-on-write clones aren't available
+var ErrCloneUnsupported = errors.New("copy-on-write clones need APFS on macOS")
+
+// CloneTree makes a copy-on-write clone of a file or directory tree. Only
+// supported on macOS.
+func CloneTree(src, dst string) error {
+	return ErrCloneUnsupported
+}
+
+// Birthtime returns when a file was created. Only known on macOS; elsewhere
+// it is the zero time.
+func Birthtime(info os.FileInfo) time.Time {
+	return time.Time{}
+}
+
+// Inode returns a file's inode number. Only known on macOS; elsewhere it
+// is 0.
+func Inode(info os.FileInfo) uint64 {
+	return 0
+}
+
+// HardLinkKey identifies the file a path is a hard link to. Only known on
+// macOS; elsewhere no file is a hard link.
+func HardLinkKey(info os.FileInfo) (string, bool) {
+	return "", false
+}
+
+// SetBirthtime sets a file's creation date. Only supported on macOS;
+// elsewhere it does nothing.
+func SetBirthtime(path string, t time.Time) error {
+	return nil
+}
+
+// LockFlags are the flags that stop a file from being replaced or changed.
+// Files are only locked with flags on macOS.
+const LockFlags = 0
+
+// FileFlags returns a file's user-settable flags (chflags). Only known on
+// macOS; elsewhere it is 0.
+func FileFlags(info os.FileInfo) uint32 {
+	return 0
+}
+
+// SetFileFlags sets a file's user-settable flags. Only supported on macOS;
+// elsewhere it does nothing.
+func SetFileFlags(path string, flags uint32) error {
+	return nil
+}
+
+// IsMountPoint reports whether a directory has a volume mounted on it. Only
+// known on macOS; elsewhere any directory counts.
+func IsMountPoint(path string) bool {
+	return IsDir(path)
+}
+
+// SameVolume reports whether two paths are on the same volume. Only known on
+// macOS; elsewhere any two paths that exist count.
+func SameVolume(a, b string) bool {
+	return Exists(a) && Exists(b)
+}
+
+// IsNetworkVolume reports whether path is on a volume mounted from another
+// machine. Only known on macOS; elsewhere it is false.
+func IsNetworkVolume(path string) bool {
+	return false
+}
+
+// HasBundleBit reports whether a directory's Finder flags mark it as a
+// package. Only known on macOS; elsewhere it is false.
+func HasBundleBit(path string) bool {
+	return false
+}
@@ -0,0 +1,89 @@
+package fileutil
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxXattrSize skips extended attributes too big to send with a file
+const maxXattrSize = 8 * 1024 * 1024
+
+// skipXattrs are managed by macOS itself and can't be copied between files
+var skipXattrs = map[string]bool{
+	"com.apple.provenance": true,
+	"com.apple.macl":       true,
+	"com.apple.rootless":   true,
+}
+
+// ReadXattrs returns a file's extended attributes, such as Finder tags,
+// quarantine flags, and custom icons
+func ReadXattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list extended attributes: %w", err)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list extended attributes: %w", err)
+	}
+
+	attrs := make(map[string][]byte)
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name == "" || skipXattrs[name] {
+			continue
+		}
+
+		n, err := unix.Lgetxattr(path, name, nil)
+		if err != nil || n > maxXattrSize {
+			continue
+		}
+		value := make([]byte, n)
+		n, err = unix.Lgetxattr(path, name, value)
+		if err != nil {
+			continue
+		}
+		attrs[name] = value[:n]
+	}
+
+	if len(attrs) == 0 {
+		return nil, nil
+	}
+	return attrs, nil
+}
+
+// WriteXattrs sets extended attributes on a file. Every attribute is tried;
+// the first failure is returned.
+func WriteXattrs(path string, attrs map[string][]byte) error {
+	var firstErr error
+	for name, value := range attrs {
+		if skipXattrs[name] {
+			continue
+		}
+		if err := unix.Lsetxattr(path, name, value, 0); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to set extended attribute %s: %w", name, err)
+		}
+	}
+	return firstErr
+}
+
+// RemoveXattr removes an extended attribute from a file
+func RemoveXattr(path, name string) error {
+	if skipXattrs[name] {
+		return nil
+	}
+	if err := unix.Lremovexattr(path, name); err != nil {
+		return fmt.Errorf("failed to remove extended attribute %s: %w", name, err)
+	}
+	return nil
+}